@@ -0,0 +1,394 @@
+// Command relay is an edge relay: deployed near participants far from the
+// collab servers, it terminates their WebSockets, answering pings and
+// compressing what it sends them, and streams each session's connections
+// to the servers over gRPC. See package relay.
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/i18n"
+	"github.com/codecollab/collab-service/internal/relay"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// writeWait is how long a write to a connection may take
+const writeWait = 10 * time.Second
+
+// streamQueue is how many frames to the server may wait to be sent, per
+// session
+const streamQueue = 1024
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:    1024,
+	WriteBufferSize:   1024,
+	EnableCompression: true,
+	CheckOrigin: func(r *http.Request) bool {
+		return true // Allow all origins in development
+	},
+}
+
+// Config is the relay's configuration, from the environment
+type Config struct {
+	Port string
+	// Upstream is the address of the collab servers' relay endpoint, their
+	// RELAY_GRPC_ADDR, and Secret their RELAY_SECRET
+	Upstream string
+	Secret   string
+	// PingInterval is how often clients are pinged; one that answers
+	// nothing for PongTimeout is closed
+	PingInterval    time.Duration
+	PongTimeout     time.Duration
+	MaxMessageBytes int
+}
+
+func loadConfig() Config {
+	return Config{
+		Port:            envString("PORT", "8003"),
+		Upstream:        os.Getenv("RELAY_UPSTREAM"),
+		Secret:          os.Getenv("RELAY_SECRET"),
+		PingInterval:    time.Duration(envInt("WS_PING_INTERVAL_SECONDS", 25)) * time.Second,
+		PongTimeout:     time.Duration(envInt("WS_PONG_TIMEOUT_SECONDS", 60)) * time.Second,
+		MaxMessageBytes: envInt("MAX_MESSAGE_BYTES", 4*1024*1024),
+	}
+}
+
+func envString(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func envInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return fallback
+	}
+	return n
+}
+
+// Edge relays the sessions its clients are in, on a stream each
+type Edge struct {
+	config   Config
+	upstream *grpc.ClientConn
+	nextConn atomic.Uint64
+
+	mu       sync.Mutex
+	sessions map[string]*edgeSession
+}
+
+// edgeSession is a session's stream to the server and the clients on it
+type edgeSession struct {
+	id      string
+	sender  *relay.Sender
+	cancel  context.CancelFunc
+	clients map[uint64]*client
+}
+
+// client is a participant's WebSocket
+type client struct {
+	id   uint64
+	conn *websocket.Conn
+	// send carries what the server sends the client, and closing the
+	// close frame it ends with
+	send    chan []byte
+	closing chan []byte
+}
+
+// join adds a client to its session's stream, opening it if this is the
+// first
+func (e *Edge) join(sessionID string, c *client, open relay.Frame) (*edgeSession, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	session, ok := e.sessions[sessionID]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		stream, err := relay.Open(ctx, e.upstream, sessionID, e.config.Secret)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		session = &edgeSession{
+			id:      sessionID,
+			sender:  relay.NewSender(stream, streamQueue),
+			cancel:  cancel,
+			clients: make(map[uint64]*client),
+		}
+		e.sessions[sessionID] = session
+		go e.receive(session, stream)
+	}
+	session.clients[c.id] = c
+	open.Conn, open.Kind = c.id, relay.KindOpen
+	if err := session.sender.Send(open, time.Now().Add(writeWait)); err != nil {
+		delete(session.clients, c.id)
+		return nil, err
+	}
+	return session, nil
+}
+
+// leave takes a client off its session's stream, closing it if this was
+// the last
+func (e *Edge) leave(session *edgeSession, c *client, code int, reason string) {
+	e.mu.Lock()
+	_, ok := session.clients[c.id]
+	delete(session.clients, c.id)
+	last := ok && len(session.clients) == 0 && e.sessions[session.id] == session
+	if last {
+		delete(e.sessions, session.id)
+	}
+	e.mu.Unlock()
+
+	if ok {
+		session.sender.Send(relay.Frame{Conn: c.id, Kind: relay.KindClose, Code: code, Reason: reason}, time.Now().Add(writeWait))
+	}
+	if last {
+		// What was queued goes first; the stream ends once the server has
+		// closed its side
+		session.sender.Close()
+	}
+}
+
+// clients counts the clients relayed
+func (e *Edge) clients() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	clients := 0
+	for _, session := range e.sessions {
+		clients += len(session.clients)
+	}
+	return clients
+}
+
+// closeAll tells every client to reconnect, at shutdown
+func (e *Edge) closeAll() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, session := range e.sessions {
+		for _, c := range session.clients {
+			c.close(websocket.CloseServiceRestart, "relay restarting")
+		}
+	}
+}
+
+// receive hands what the server sends on to the clients, until the stream
+// ends, when they are told to reconnect
+func (e *Edge) receive(session *edgeSession, stream relay.Stream) {
+	for {
+		batch, err := stream.Recv()
+		if err != nil {
+			break
+		}
+		e.mu.Lock()
+		for _, f := range batch.Frames {
+			c, ok := session.clients[f.Conn]
+			if !ok {
+				continue
+			}
+			switch f.Kind {
+			case relay.KindMessage:
+				select {
+				case c.send <- f.Data:
+				default:
+					log.Printf("Client %d of session %s is too slow, dropping a message", c.id, session.id)
+				}
+			case relay.KindClose:
+				delete(session.clients, c.id)
+				c.close(f.Code, f.Reason)
+			}
+		}
+		e.mu.Unlock()
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.sessions[session.id] == session {
+		delete(e.sessions, session.id)
+	}
+	for id, c := range session.clients {
+		delete(session.clients, id)
+		c.close(websocket.CloseServiceRestart, "upstream unavailable")
+	}
+	session.cancel()
+}
+
+// close has writePump send what is queued and then a close frame, or
+// just drop the connection without a code
+func (c *client) close(code int, reason string) {
+	var frame []byte
+	if code != 0 && code != websocket.CloseAbnormalClosure {
+		frame = websocket.FormatCloseMessage(code, reason)
+	}
+	select {
+	case c.closing <- frame:
+	default:
+	}
+}
+
+// readPump streams what the client sends to the server, along with the
+// pongs it answers pings with
+func (e *Edge) readPump(session *edgeSession, c *client) {
+	code, reason := websocket.CloseGoingAway, ""
+	defer func() {
+		e.leave(session, c, code, reason)
+		c.conn.Close()
+	}()
+
+	if e.config.MaxMessageBytes > 0 {
+		c.conn.SetReadLimit(int64(e.config.MaxMessageBytes))
+	}
+	if e.config.PingInterval > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(e.config.PongTimeout))
+		c.conn.SetPongHandler(func(string) error {
+			session.sender.Send(relay.Frame{Conn: c.id, Kind: relay.KindPong}, time.Now().Add(writeWait))
+			return c.conn.SetReadDeadline(time.Now().Add(e.config.PongTimeout))
+		})
+	}
+	for {
+		_, message, err := c.conn.ReadMessage()
+		if err != nil {
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) && closeErr.Code != websocket.CloseNoStatusReceived {
+				code, reason = closeErr.Code, closeErr.Text
+			}
+			return
+		}
+		if e.config.PingInterval > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(e.config.PongTimeout))
+		}
+		if err := session.sender.Send(relay.Message(c.id, message), time.Now().Add(writeWait)); err != nil {
+			return
+		}
+	}
+}
+
+// writePump writes what the server sends the client and pings it
+func (e *Edge) writePump(c *client) {
+	defer c.conn.Close()
+
+	var pings <-chan time.Time
+	if e.config.PingInterval > 0 {
+		ticker := time.NewTicker(e.config.PingInterval)
+		defer ticker.Stop()
+		pings = ticker.C
+	}
+	for {
+		select {
+		case message := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		case <-pings:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				return
+			}
+		case frame := <-c.closing:
+			for len(c.send) > 0 {
+				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				if err := c.conn.WriteMessage(websocket.TextMessage, <-c.send); err != nil {
+					return
+				}
+			}
+			if frame != nil {
+				c.conn.WriteControl(websocket.CloseMessage, frame, time.Now().Add(writeWait))
+			}
+			return
+		}
+	}
+}
+
+func handleWebSocket(edge *Edge) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		sessionID := ctx.Param("sessionId")
+		conn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+		if err != nil {
+			log.Printf("Failed to upgrade connection: %v", err)
+			return
+		}
+		conn.EnableWriteCompression(true)
+
+		c := &client{
+			id:      edge.nextConn.Add(1),
+			conn:    conn,
+			send:    make(chan []byte, 256),
+			closing: make(chan []byte, 1),
+		}
+		locales := append([]string{ctx.Query("locale")}, i18n.ParseAcceptLanguage(ctx.GetHeader("Accept-Language"))...)
+		session, err := edge.join(sessionID, c, relay.Frame{Locales: locales, Addr: ctx.ClientIP(), UserAgent: ctx.Request.UserAgent()})
+		if err != nil {
+			log.Printf("Failed to relay a client of session %s: %v", sessionID, err)
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "upstream unavailable"), time.Now().Add(writeWait))
+			conn.Close()
+			return
+		}
+		go edge.writePump(c)
+		go edge.readPump(session, c)
+	}
+}
+
+func main() {
+	config := loadConfig()
+	if config.Upstream == "" || config.Secret == "" {
+		log.Fatal("RELAY_UPSTREAM and RELAY_SECRET are required")
+	}
+	upstream, err := grpc.NewClient(config.Upstream, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatal("Invalid RELAY_UPSTREAM:", err)
+	}
+	defer upstream.Close()
+
+	edge := &Edge{config: config, upstream: upstream, sessions: make(map[string]*edgeSession)}
+	router := gin.Default()
+	router.GET("/health", func(c *gin.Context) {
+		edge.mu.Lock()
+		sessions := len(edge.sessions)
+		edge.mu.Unlock()
+		c.JSON(http.StatusOK, gin.H{
+			"status":   "healthy",
+			"service":  "collab-relay",
+			"upstream": upstream.GetState().String(),
+			"sessions": sessions,
+			"clients":  edge.clients(),
+		})
+	})
+	router.GET("/ws/:sessionId", handleWebSocket(edge))
+
+	server := &http.Server{Addr: ":" + config.Port, Handler: router}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	go func() {
+		log.Printf("Edge relay to %s starting on port %s", config.Upstream, config.Port)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("Failed to start server:", err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	shutdown, cancel := context.WithTimeout(context.Background(), writeWait)
+	defer cancel()
+	go server.Shutdown(shutdown)
+	edge.closeAll()
+	for edge.clients() > 0 && shutdown.Err() == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ActivitySummary is one announceable sentence about what a participant did
+type ActivitySummary struct {
+	UserID string `json:"userId"`
+	Path   string `json:"path,omitempty"`
+	Text   string `json:"text"`
+}
+
+// activity is a participant's pending activity on one file, or their
+// arrival or departure when path is empty. Edits to the same file between
+// summaries are merged into one line range.
+type activity struct {
+	userID   string
+	username string
+	path     string
+	// kind is "edited", "deleted", "created", "joined" or "left"
+	kind       string
+	start, end int
+}
+
+// summaryKey is the timer summaries are throttled on
+const summaryKey = "a11y-summary"
+
+// setSummaries turns accessibility summaries on or off for a client
+func (h *Hub) setSummaries(c *Client, enabled bool) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	c.Summaries = enabled
+	session.mu.Unlock()
+}
+
+// recordActivityLocked queues activity for the next summary, merging it into
+// earlier activity of the same participant on the same file. Nothing is
+// kept while nobody is listening. Caller must hold session.mu.
+func (s *Session) recordActivityLocked(a *activity) {
+	listening := false
+	for _, client := range s.Clients {
+		if client.Summaries && client.ID != a.userID {
+			listening = true
+			break
+		}
+	}
+	if !listening {
+		return
+	}
+
+	if a.kind == "edited" || a.kind == "deleted" {
+		for _, existing := range s.activity {
+			if existing.userID != a.userID || existing.path != a.path {
+				continue
+			}
+			switch existing.kind {
+			case "created":
+				// Filling in a new file is still creating it
+				return
+			case "edited", "deleted":
+				if existing.kind != a.kind {
+					existing.kind = "edited"
+				}
+				existing.start = min(existing.start, a.start)
+				existing.end = max(existing.end, a.end)
+				return
+			}
+		}
+	}
+	s.activity = append(s.activity, a)
+}
+
+// recordEditLocked queues a summary of replacing file's content with
+// content. Caller must hold session.mu.
+func (s *Session) recordEditLocked(userID, username string, file *File, content string) {
+	start, end, deleted := changedLines(file.Content, content)
+	if start == 0 {
+		return
+	}
+	kind := "edited"
+	if deleted {
+		kind = "deleted"
+	}
+	s.recordActivityLocked(&activity{userID: userID, username: username, path: file.Path, kind: kind, start: start, end: end})
+}
+
+// recordPresenceLocked queues a summary of a participant joining or
+// leaving. Caller must hold session.mu.
+func (s *Session) recordPresenceLocked(c *Client, kind string) {
+	s.recordActivityLocked(&activity{userID: c.ID, username: c.Username, kind: kind})
+}
+
+// changedLines returns the 1-based range of lines an edit touched, in the
+// new content, or in the old content when lines were only removed. start
+// is 0 when nothing changed.
+func changedLines(before, after string) (start, end int, deleted bool) {
+	if before == after {
+		return 0, 0, false
+	}
+	oldLines := strings.Split(before, "\n")
+	newLines := strings.Split(after, "\n")
+
+	prefix := 0
+	for prefix < len(oldLines) && prefix < len(newLines) && oldLines[prefix] == newLines[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(oldLines)-prefix && suffix < len(newLines)-prefix &&
+		oldLines[len(oldLines)-1-suffix] == newLines[len(newLines)-1-suffix] {
+		suffix++
+	}
+
+	if len(newLines)-suffix > prefix {
+		return prefix + 1, len(newLines) - suffix, false
+	}
+	return prefix + 1, len(oldLines) - suffix, true
+}
+
+// text is the English sentence for an activity by the participant called
+// name. Localized catalogs key on these.
+func (a *activity) text(name string) string {
+	switch a.kind {
+	case "joined":
+		return fmt.Sprintf("%s joined the session", name)
+	case "left":
+		return fmt.Sprintf("%s left the session", name)
+	case "created":
+		return fmt.Sprintf("%s created %s", name, a.path)
+	case "deleted":
+		if a.start == a.end {
+			return fmt.Sprintf("%s deleted line %d in %s", name, a.start, a.path)
+		}
+		return fmt.Sprintf("%s deleted lines %d–%d in %s", name, a.start, a.end, a.path)
+	}
+	if a.start == a.end {
+		return fmt.Sprintf("%s edited line %d in %s", name, a.start, a.path)
+	}
+	return fmt.Sprintf("%s edited lines %d–%d in %s", name, a.start, a.end, a.path)
+}
+
+// scheduleSummaries sends pending activity to listeners once the summary
+// interval has passed, so bursts of typing make one announcement
+func (h *Hub) scheduleSummaries(session *Session) {
+	session.mu.RLock()
+	pending := len(session.activity) > 0
+	session.mu.RUnlock()
+	if !pending {
+		return
+	}
+	h.throttle(session, summaryKey, h.config.SummaryInterval, func() {
+		h.sendSummaries(session)
+	})
+}
+
+// sendSummaries sends each listener the pending activity of others on files
+// they can see
+func (h *Hub) sendSummaries(session *Session) {
+	type delivery struct {
+		client    *Client
+		summaries []ActivitySummary
+	}
+
+	session.mu.Lock()
+	pending := session.activity
+	session.activity = nil
+	var deliveries []delivery
+	for _, client := range session.Clients {
+		if !client.Summaries {
+			continue
+		}
+		role := session.roleLocked(client)
+		var summaries []ActivitySummary
+		for _, a := range pending {
+			if a.userID == client.ID {
+				continue
+			}
+			if a.path != "" {
+				file, ok := session.Files[a.path]
+				if !ok || !file.visibleTo(role) {
+					continue
+				}
+			}
+			// Participants usually name themselves after connecting
+			name := a.username
+			if current, ok := session.Clients[a.userID]; ok {
+				name = current.Username
+			}
+			summaries = append(summaries, ActivitySummary{UserID: a.userID, Path: a.path, Text: a.text(name)})
+		}
+		if len(summaries) > 0 {
+			deliveries = append(deliveries, delivery{client, summaries})
+		}
+	}
+	session.mu.Unlock()
+
+	for _, d := range deliveries {
+		h.sendToClient(d.client, OutgoingMessage{Type: "a11y-summary", Summaries: d.summaries})
+	}
+}
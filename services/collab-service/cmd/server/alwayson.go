@@ -0,0 +1,72 @@
+package main
+
+import "log"
+
+// maxRoomRecordings is how many recordings an always-on room keeps
+const maxRoomRecordings = 20
+
+// setAlwaysOn makes c's session a room that stays open, with its
+// documents, when everyone has left, or a session that closes again. With
+// a database, the documents are kept however long the room goes unused.
+func (h *Hub) setAlwaysOn(c *Client, enabled bool) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	if session.roleLocked(c) != RoleOwner {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: "only the session owner can make a session always-on"})
+		return
+	}
+	changed := session.AlwaysOn != enabled
+	session.AlwaysOn = enabled
+	session.mu.Unlock()
+
+	if changed {
+		log.Printf("Session %s always-on set to %t by %s", c.SessionID, enabled, c.ID)
+		h.broadcastToSession(c.SessionID, OutgoingMessage{Type: "always-on", Enabled: enabled})
+		h.schedulePersist(c.SessionID)
+	}
+}
+
+func (h *Hub) sendAlwaysOn(c *Client) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	enabled := session.AlwaysOn
+	session.mu.RUnlock()
+
+	if enabled {
+		h.sendToClient(c, OutgoingMessage{Type: "always-on", Enabled: true})
+	}
+}
+
+// compactRoom drops the history an always-on room has built up, once
+// everyone has left, so a room that is never closed doesn't grow without
+// bound. The CRDT state of its files, which keeps every deleted character,
+// is rebuilt from the text when someone next syncs; the recording ends,
+// and only the newest maxRoomRecordings are kept.
+func (h *Hub) compactRoom(session *Session) {
+	session.mu.Lock()
+	if len(session.Clients) > 0 {
+		session.mu.Unlock()
+		return
+	}
+	for _, file := range session.Files {
+		file.crdt, file.crdtPending = nil, nil
+	}
+	session.mu.Unlock()
+
+	h.stopRecording(session)
+	if h.recordings != nil {
+		if err := h.recordings.Prune(session.ID, maxRoomRecordings); err != nil {
+			log.Printf("Failed to prune the recordings of session %s: %v", session.ID, err)
+		}
+	}
+	log.Printf("Compacted always-on session %s", session.ID)
+}
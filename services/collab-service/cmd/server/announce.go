@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Announcement is a system message from the operators, which clients show
+// apart from anything participants say
+type Announcement struct {
+	ID      string `json:"id"`
+	Message string `json:"message"`
+	// Severity is "info", "warning" or "critical"
+	Severity  string     `json:"severity"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// Sessions and Orgs limit who sees it; both empty means everyone
+	Sessions []string `json:"sessions,omitempty"`
+	Orgs     []string `json:"orgs,omitempty"`
+}
+
+// Announcement limits
+const (
+	maxAnnouncementBytes   = 2000
+	maxStoredAnnouncements = 100
+)
+
+// reachesLocked reports whether a session gets the announcement. Caller
+// must hold session.mu.
+func (a *Announcement) reachesLocked(s *Session) bool {
+	if len(a.Sessions) > 0 && !slices.Contains(a.Sessions, s.ID) {
+		return false
+	}
+	if len(a.Orgs) > 0 && !slices.Contains(a.Orgs, s.Org) {
+		return false
+	}
+	return true
+}
+
+// requireAdmin checks the operator token of an admin request, or responds
+// 403. Admin routes are off unless ADMIN_TOKEN is set.
+func (h *Hub) requireAdmin(c *gin.Context) bool {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if h.config.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.config.AdminToken)) != 1 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "admin token required"})
+		return false
+	}
+	return true
+}
+
+// activeAnnouncementsLocked drops expired announcements and returns the
+// rest, oldest first. Caller must hold h.mu for writing.
+func (h *Hub) activeAnnouncementsLocked() []*Announcement {
+	now := time.Now()
+	var active []*Announcement
+	for id, a := range h.announcements {
+		if a.ExpiresAt != nil && !now.Before(*a.ExpiresAt) {
+			delete(h.announcements, id)
+			continue
+		}
+		active = append(active, a)
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].CreatedAt.Before(active[j].CreatedAt) })
+	return active
+}
+
+// deliver sends outMsg to every client of the sessions an announcement
+// reaches and returns the clients that got it
+func (h *Hub) deliver(a *Announcement, outMsg OutgoingMessage) []*Client {
+	h.mu.RLock()
+	sessions := make([]*Session, 0, len(h.sessions))
+	for _, session := range h.sessions {
+		sessions = append(sessions, session)
+	}
+	h.mu.RUnlock()
+
+	var delivered []*Client
+	for _, session := range sessions {
+		session.mu.RLock()
+		var clients []*Client
+		if a.reachesLocked(session) {
+			for _, client := range session.Clients {
+				clients = append(clients, client)
+			}
+		}
+		session.mu.RUnlock()
+
+		for _, client := range clients {
+			h.sendToClient(client, outMsg)
+		}
+		delivered = append(delivered, clients...)
+	}
+	return delivered
+}
+
+// announcementDeliveredLocked records that clients got an announcement.
+// Those that haven't said who they are yet count when they do. Caller must
+// hold h.mu for writing.
+func (h *Hub) announcementDeliveredLocked(id string, clients ...*Client) {
+	receipts, ok := h.announcementReceipts[id]
+	if !ok {
+		return
+	}
+	for _, client := range clients {
+		if client.joined {
+			receipts.deliveredTo(client.Username)
+		}
+	}
+}
+
+// markAnnouncementRead records that c's user read an announcement, and
+// reports whether there is one by that ID
+func (h *Hub) markAnnouncementRead(c *Client, id string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	receipts, ok := h.announcementReceipts[id]
+	if ok {
+		receipts.readBy(c.Username)
+	}
+	return ok
+}
+
+// sendAnnouncements sends a newly connected client the announcements still
+// in effect for its session
+func (h *Hub) sendAnnouncements(c *Client) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	h.mu.Lock()
+	active := h.activeAnnouncementsLocked()
+	h.mu.Unlock()
+
+	session.mu.RLock()
+	var reaching []*Announcement
+	for _, a := range active {
+		if a.reachesLocked(session) {
+			reaching = append(reaching, a)
+		}
+	}
+	session.mu.RUnlock()
+
+	for _, a := range reaching {
+		h.sendToClient(c, OutgoingMessage{Type: "announcement", Announcement: a})
+	}
+}
+
+// handleCreateAnnouncement broadcasts a system message. Announcements with
+// an expiry are also shown to clients connecting before it.
+func handleCreateAnnouncement(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hub.requireAdmin(c) {
+			return
+		}
+
+		var body struct {
+			Message   string     `json:"message"`
+			Severity  string     `json:"severity"`
+			ExpiresAt *time.Time `json:"expiresAt"`
+			Sessions  []string   `json:"sessions"`
+			Orgs      []string   `json:"orgs"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+		body.Message = strings.TrimSpace(body.Message)
+		if body.Message == "" || len(body.Message) > maxAnnouncementBytes {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("message must be 1 to %d bytes", maxAnnouncementBytes)})
+			return
+		}
+		if body.Severity == "" {
+			body.Severity = "info"
+		}
+		switch body.Severity {
+		case "info", "warning", "critical":
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "severity must be info, warning or critical"})
+			return
+		}
+		if body.ExpiresAt != nil && !body.ExpiresAt.After(time.Now()) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expiresAt must be in the future"})
+			return
+		}
+
+		a := &Announcement{
+			Message:   body.Message,
+			Severity:  body.Severity,
+			CreatedAt: time.Now().UTC(),
+			ExpiresAt: body.ExpiresAt,
+			Sessions:  body.Sessions,
+			Orgs:      body.Orgs,
+		}
+		hub.mu.Lock()
+		hub.nextAnnouncementID++
+		a.ID = fmt.Sprintf("a%d", hub.nextAnnouncementID)
+		if a.ExpiresAt != nil {
+			if len(hub.activeAnnouncementsLocked()) >= maxStoredAnnouncements {
+				hub.mu.Unlock()
+				c.JSON(http.StatusConflict, gin.H{"error": "too many announcements in effect"})
+				return
+			}
+			hub.announcements[a.ID] = a
+		}
+		// Receipts outlive the announcement, up to a limit
+		hub.announcementReceipts[a.ID] = newReceipts()
+		hub.receiptOrder = append(hub.receiptOrder, a.ID)
+		if len(hub.receiptOrder) > maxStoredAnnouncements {
+			delete(hub.announcementReceipts, hub.receiptOrder[0])
+			hub.receiptOrder = hub.receiptOrder[1:]
+		}
+		hub.mu.Unlock()
+
+		delivered := hub.deliver(a, OutgoingMessage{Type: "announcement", Announcement: a})
+		hub.mu.Lock()
+		hub.announcementDeliveredLocked(a.ID, delivered...)
+		hub.mu.Unlock()
+		log.Printf("Announcement %s (%s) delivered to %d clients", a.ID, a.Severity, len(delivered))
+		c.JSON(http.StatusCreated, gin.H{"announcement": a, "delivered": len(delivered)})
+	}
+}
+
+// handleListAnnouncements returns the announcements in effect
+func handleListAnnouncements(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hub.requireAdmin(c) {
+			return
+		}
+		hub.mu.Lock()
+		active := hub.activeAnnouncementsLocked()
+		hub.mu.Unlock()
+		if active == nil {
+			active = []*Announcement{}
+		}
+		c.JSON(http.StatusOK, gin.H{"announcements": active})
+	}
+}
+
+// handleAnnouncementReceipts returns who an announcement reached and who
+// has read it
+func handleAnnouncementReceipts(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hub.requireAdmin(c) {
+			return
+		}
+		id := c.Param("id")
+		hub.mu.RLock()
+		receipts, ok := hub.announcementReceipts[id]
+		var state *ReadState
+		if ok {
+			state = receipts.state(id)
+		}
+		hub.mu.RUnlock()
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "announcement not found"})
+			return
+		}
+		c.JSON(http.StatusOK, state)
+	}
+}
+
+// handleDeleteAnnouncement withdraws an announcement, telling the clients
+// it reached to stop showing it
+func handleDeleteAnnouncement(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hub.requireAdmin(c) {
+			return
+		}
+		id := c.Param("id")
+		hub.mu.Lock()
+		a, ok := hub.announcements[id]
+		delete(hub.announcements, id)
+		hub.mu.Unlock()
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "announcement not found"})
+			return
+		}
+		hub.deliver(a, OutgoingMessage{Type: "announcement-withdrawn", Announcement: a})
+		log.Printf("Announcement %s withdrawn", id)
+		c.Status(http.StatusNoContent)
+	}
+}
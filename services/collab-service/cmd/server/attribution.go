@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/ot"
+)
+
+// setContent replaces a text file's content and updates per-line
+// authorship, for the verified user author to undo. Caller must hold
+// session.mu.
+func (f *File) setContent(content, author string) {
+	f.applyOperation(ot.FromDiff(f.Content, content), content, author, userIdentity(author))
+}
+
+// applyOperation records op, which turns the file's content into content,
+// as the next revision, made by author and kept in the undo history of
+// undoer. Caller must hold session.mu.
+func (f *File) applyOperation(op ot.Operation, content, author, undoer string) {
+	if content == f.Content {
+		return
+	}
+	before := f.Content
+	f.commitOperation(op, content, author)
+	f.pushUndo(undoer, author, op, before)
+}
+
+// commitOperation records op as the next revision without touching anyone's
+// undo history. Caller must hold session.mu.
+func (f *File) commitOperation(op ot.Operation, content, author string) {
+	f.doc.Record(op)
+	if f.crdt != nil {
+		if update := f.crdt.Replace(crdtServerSite, content); !update.IsEmpty() {
+			f.crdtPending = append(f.crdtPending, update)
+		}
+	}
+	f.LineAuthors = attributeLines(f.Content, content, f.LineAuthors, author)
+	f.Content = content
+	f.UpdatedAt = time.Now()
+}
+
+// attributeLines carries line authorship across an edit. Lines in the
+// unchanged prefix and suffix keep their author; everything between is
+// attributed to author. This is exact for the localized edits typing
+// produces and cheap enough to run on every change.
+func attributeLines(before, after string, authors []string, author string) []string {
+	oldLines := strings.Split(before, "\n")
+	newLines := strings.Split(after, "\n")
+	if len(authors) != len(oldLines) {
+		authors = make([]string, len(oldLines))
+	}
+
+	prefix := 0
+	for prefix < len(oldLines) && prefix < len(newLines) && oldLines[prefix] == newLines[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(oldLines)-prefix && suffix < len(newLines)-prefix &&
+		oldLines[len(oldLines)-1-suffix] == newLines[len(newLines)-1-suffix] {
+		suffix++
+	}
+
+	result := make([]string, len(newLines))
+	copy(result, authors[:prefix])
+	for i := prefix; i < len(newLines)-suffix; i++ {
+		result[i] = author
+	}
+	copy(result[len(newLines)-suffix:], authors[len(oldLines)-suffix:])
+	return result
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/listquery"
+	"github.com/codecollab/collab-service/internal/ot"
+	"github.com/codecollab/collab-service/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+// Types of the operations in the audit log
+const (
+	auditEdit       = "edit"
+	auditCreate     = "create"
+	auditUndo       = "undo"
+	auditRedo       = "redo"
+	auditRevert     = "revert"
+	auditSuggestion = "suggestion"
+	auditImport     = "import"
+	auditUpload     = "upload"
+)
+
+// historySpec is how a session's audit log can be listed: newest first,
+// the order its IDs go back in
+var historySpec = listquery.Spec{
+	Sorts:   []string{"-id"},
+	Filters: []listquery.Filter{listquery.Since, listquery.Until},
+}
+
+// AuditEntry is one operation of a session's audit log: who changed which
+// file how, and when
+type AuditEntry struct {
+	ID       int64     `json:"id"`
+	Path     string    `json:"path"`
+	UserID   string    `json:"userId,omitempty"`
+	Username string    `json:"username,omitempty"`
+	Type     string    `json:"type"`
+	Ops      []ot.Edit `json:"ops"`
+	At       time.Time `json:"at"`
+}
+
+// auditLocked adds an operation to the session's audit log. Changes synced
+// from another instance have no participant and are logged where they
+// were made. Caller must hold session.mu for writing.
+func (h *Hub) auditLocked(s *Session, kind, userID, username, filePath string, edits []ot.Edit) {
+	if s.Lobby || userID == "" && username == "" {
+		return
+	}
+	if edits == nil {
+		edits = []ot.Edit{}
+	}
+	s.nextOperationID++
+	s.operationLog = append(s.operationLog, &AuditEntry{
+		ID:       s.nextOperationID,
+		Path:     filePath,
+		UserID:   userID,
+		Username: username,
+		Type:     kind,
+		Ops:      edits,
+		At:       time.Now().UTC(),
+	})
+	// While the store is down, the oldest of those waiting to be saved
+	// are given up on
+	if limit := h.config.AuditLogLimit; limit > 0 && len(s.operationLog) > limit {
+		s.operationLog = s.operationLog[len(s.operationLog)-limit:]
+	}
+}
+
+// savedOperationsLocked returns the operations waiting to be saved with the
+// session. Caller must hold session.mu.
+func (s *Session) savedOperationsLocked() []*store.Operation {
+	operations := make([]*store.Operation, 0, len(s.operationLog))
+	for _, entry := range s.operationLog {
+		ops, err := json.Marshal(entry.Ops)
+		if err != nil {
+			continue
+		}
+		operations = append(operations, &store.Operation{
+			SessionID: s.ID,
+			ID:        entry.ID,
+			Path:      entry.Path,
+			UserID:    entry.UserID,
+			Username:  entry.Username,
+			Type:      entry.Type,
+			Ops:       ops,
+			At:        entry.At,
+		})
+	}
+	return operations
+}
+
+// operationsSaved forgets operations that were just saved
+func (h *Hub) operationsSaved(snapshot *store.Session) {
+	if len(snapshot.Operations) == 0 {
+		return
+	}
+	session, exists := h.getSession(snapshot.ID)
+	if !exists {
+		return
+	}
+	last := snapshot.Operations[len(snapshot.Operations)-1].ID
+
+	session.mu.Lock()
+	saved := 0
+	for saved < len(session.operationLog) && session.operationLog[saved].ID <= last {
+		saved++
+	}
+	session.operationLog = session.operationLog[saved:]
+	session.mu.Unlock()
+}
+
+// auditMatches reports whether filter picks an entry
+func auditMatches(entry *AuditEntry, filter store.OperationFilter) bool {
+	return (filter.Before == 0 || entry.ID < filter.Before) &&
+		(filter.Username == "" || entry.Username == filter.Username) &&
+		(filter.Type == "" || entry.Type == filter.Type) &&
+		(filter.Since.IsZero() || !entry.At.Before(filter.Since)) &&
+		(filter.Until.IsZero() || entry.At.Before(filter.Until))
+}
+
+// auditHistory returns the operations of the session's audit log that
+// filter picks, newest first. Those in memory are looked through first, and
+// the store for those older than all of them.
+func (h *Hub) auditHistory(ctx context.Context, session *Session, filter store.OperationFilter) ([]*AuditEntry, error) {
+	var entries []*AuditEntry
+	session.mu.RLock()
+	oldest := int64(0)
+	if len(session.operationLog) > 0 {
+		oldest = session.operationLog[0].ID
+	}
+	for i := len(session.operationLog) - 1; i >= 0 && len(entries) < filter.Limit; i-- {
+		if entry := session.operationLog[i]; auditMatches(entry, filter) {
+			entries = append(entries, entry)
+		}
+	}
+	session.mu.RUnlock()
+	if h.store == nil || len(entries) == filter.Limit {
+		return entries, nil
+	}
+
+	if oldest > 0 && (filter.Before == 0 || oldest < filter.Before) {
+		filter.Before = oldest
+	}
+	filter.Limit -= len(entries)
+	operations, err := h.store.Operations(ctx, session.ID, filter)
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range operations {
+		entry := &AuditEntry{ID: op.ID, Path: op.Path, UserID: op.UserID, Username: op.Username, Type: op.Type, At: op.At}
+		if err := json.Unmarshal(op.Ops, &entry.Ops); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// handleOperationHistory returns the session's audit log, newest first, a
+// page at a time: user and type pick the operations, along with since and
+// until.
+func handleOperationHistory(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.ownerSession(c, "audit the history")
+		if !ok {
+			return
+		}
+		q, ok := listQuery(c, historySpec)
+		if !ok {
+			return
+		}
+
+		filter := store.OperationFilter{Username: c.Query("user"), Type: c.Query("type"), Since: q.Since, Until: q.Until, Limit: q.Limit}
+		if q.After != nil {
+			before, err := strconv.ParseInt(q.After.ID, 10, 64)
+			if err != nil || before <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": listquery.ErrCursor.Error()})
+				return
+			}
+			filter.Before = before
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+		defer cancel()
+		entries, err := hub.auditHistory(ctx, session, filter)
+		if err != nil {
+			log.Printf("Failed to read the history of session %s: %v", session.ID, err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "the history is unavailable"})
+			return
+		}
+		if entries == nil {
+			entries = []*AuditEntry{}
+		}
+		next := ""
+		if len(entries) == filter.Limit {
+			last := entries[len(entries)-1]
+			next = q.Next(listquery.NumberKey(last.ID), strconv.FormatInt(last.ID, 10))
+		}
+		listPage(c, "operations", entries, next)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tokenClaims is the subset of the API gateway's JWT payload we rely on
+type tokenClaims struct {
+	Subject string `json:"sub"`
+	Expiry  int64  `json:"exp"`
+	// Org is the user's organization, which decides the network policy of
+	// the sessions they own
+	Org string `json:"org,omitempty"`
+	// Session limits the token to joining one session. Invitations carry
+	// such tokens; they don't authenticate anything else.
+	Session string `json:"sid,omitempty"`
+	// Role is "viewer" on the tokens of viewer links, which anyone they
+	// are shown to may use, so they don't name who joins
+	Role string `json:"role,omitempty"`
+	// OrgRole is the user's role in Org; admins manage its slugs
+	OrgRole string `json:"org_role,omitempty"`
+	// ID names the share link a viewer token stands for, so the link can
+	// be revoked
+	ID string `json:"jti,omitempty"`
+	// Scope limits the token to the scopes it lists, space-separated, as
+	// OAuth access tokens do. A token without one may do whatever its user
+	// may.
+	Scope string `json:"scope,omitempty"`
+	// URL limits the token to downloading from the one path. Signed URLs
+	// carry such tokens; they don't authenticate anything else.
+	URL string `json:"url,omitempty"`
+}
+
+// allowsSession reports whether the token may be used to join sessionID
+func (t *tokenClaims) allowsSession(sessionID string) bool {
+	return t.URL == "" && (t.Session == "" || t.Session == sessionID)
+}
+
+// allows reports whether the token's scopes include scope. sessions:write
+// includes sessions:read.
+func (t *tokenClaims) allows(scope string) bool {
+	if t.Scope == "" {
+		return true
+	}
+	for _, granted := range strings.Fields(t.Scope) {
+		if granted == scope || granted == scopeSessionsWrite && scope == scopeSessionsRead {
+			return true
+		}
+	}
+	return false
+}
+
+// orgAdmin reports whether the token is an organization admin's
+func (t *tokenClaims) orgAdmin() bool {
+	return t.Org != "" && t.OrgRole == "admin"
+}
+
+// subject is the verified token subject c joined as, or "" for a client
+// that only named itself
+func (c *Client) subject() string {
+	if c.token == nil {
+		return ""
+	}
+	return c.token.Subject
+}
+
+// unverifiedRole is the most a client that didn't verify who they are may
+// do: watch, unless token verification isn't configured, when nobody can
+// verify and everyone edits
+func (h *Hub) unverifiedRole() Role {
+	if h.config.JWTSecret == "" {
+		return RoleEditor
+	}
+	return RoleViewer
+}
+
+// identity is who c is to state that follows a user, such as their undo
+// history: the verified user, whichever connection they use, or else the
+// connection alone, as anyone can take a name
+func (c *Client) identity() string {
+	if subject := c.subject(); subject != "" {
+		return userIdentity(subject)
+	}
+	return "client:" + c.ID
+}
+
+// userIdentity is the identity of a verified user, or "" for none
+func userIdentity(subject string) string {
+	if subject == "" {
+		return ""
+	}
+	return "user:" + subject
+}
+
+// signToken issues an HS256 JWT the way the API gateway does, for tokens
+// the collab service hands out itself
+func signToken(secret string, claims tokenClaims) (string, error) {
+	if secret == "" {
+		return "", errors.New("token signing is not configured")
+	}
+	header, err := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// parseToken checks an HS256 JWT issued by the API gateway and returns its
+// claims
+func parseToken(secret, token string) (*tokenClaims, error) {
+	if secret == "" {
+		return nil, errors.New("token verification is not configured")
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(headerBytes, &header); err != nil || header.Alg != "HS256" {
+		return nil, errors.New("unsupported token algorithm")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errors.New("invalid token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed token payload")
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.New("malformed token payload")
+	}
+	if claims.Expiry != 0 && time.Now().Unix() >= claims.Expiry {
+		return nil, errors.New("token expired")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+	return &claims, nil
+}
+
+// requestUsername returns the verified username of a REST caller, or "" for
+// anonymous requests
+func (h *Hub) requestUsername(c *gin.Context) string {
+	claims := h.requestClaims(c)
+	if claims == nil {
+		return ""
+	}
+	return claims.Subject
+}
+
+// requestClaims returns the verified token of a REST caller, or that of
+// the signed URL requested, or nil for anonymous requests. Tokens limited
+// to joining a session or to another URL don't count.
+func (h *Hub) requestClaims(c *gin.Context) *tokenClaims {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if token == "" {
+		claims, _ := h.signedClaims(c)
+		return claims
+	}
+	claims, err := h.verifyToken(token)
+	if err != nil || claims.Session != "" || claims.URL != "" {
+		return nil
+	}
+	return claims
+}
+
+// requestRoleLocked maps a REST caller to a session role. Anonymous callers are
+// treated as viewers. Caller must hold session.mu.
+func (s *Session) requestRoleLocked(username string) Role {
+	switch {
+	case username != "" && username == s.Owner:
+		return RoleOwner
+	case username != "":
+		return RoleEditor
+	default:
+		return RoleViewer
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/blob"
+	"github.com/gin-gonic/gin"
+)
+
+// assetLinkTTL is how long the blob store's link to an asset, which a
+// download is redirected to, stays valid
+const assetLinkTTL = time.Minute
+
+// detectBinary sniffs uploaded data and returns its content type and
+// whether it must be stored as a binary asset rather than text
+func detectBinary(data []byte) (string, bool) {
+	contentType := http.DetectContentType(data)
+	return contentType, !strings.HasPrefix(contentType, "text/")
+}
+
+// blobKey maps a workspace file to its key in the blob store
+func blobKey(sessionID, filePath string) string {
+	sum := sha256.Sum256([]byte(filePath))
+	return blobPrefix(sessionID) + "/" + hex.EncodeToString(sum[:])
+}
+
+// blobPrefix is the blob store prefix every file of a session is kept under
+func blobPrefix(sessionID string) string {
+	return url.PathEscape(sessionID)
+}
+
+// assetURL is where clients download a binary file
+func assetURL(sessionID, filePath string) string {
+	return "/sessions/" + url.PathEscape(sessionID) + "/assets/" + filePath
+}
+
+// deleteSessionBlobs removes the blob of every binary file in a session
+// that is being discarded. Persisted sessions keep theirs until they are
+// deleted from the store.
+func (h *Hub) deleteSessionBlobs(session *Session) {
+	if session.persist {
+		return
+	}
+	session.mu.RLock()
+	var keys []string
+	for _, file := range session.Files {
+		if file.Binary {
+			keys = append(keys, file.BlobKey)
+		}
+	}
+	session.mu.RUnlock()
+
+	for _, key := range keys {
+		if err := h.blobs.Delete(key); err != nil {
+			log.Printf("Failed to delete blob %s: %v", key, err)
+		}
+	}
+}
+
+// deleteStoredBlobs removes the blobs of a session deleted from the store,
+// including those checkpoints still referred to
+func (h *Hub) deleteStoredBlobs(sessionID string) {
+	if err := h.blobs.DeletePrefix(blobPrefix(sessionID)); err != nil {
+		log.Printf("Failed to delete the blobs of session %s: %v", sessionID, err)
+	}
+}
+
+// handleAsset redirects to the blob store's link to a binary workspace
+// file, or streams it when the store has no links. A link lasts no longer
+// than the signed URL it was requested through.
+func handleAsset(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, exists := hub.getSession(c.Param("sessionId"))
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+			return
+		}
+
+		claims := hub.requestClaims(c)
+		var username string
+		if claims != nil {
+			username = claims.Subject
+		}
+
+		session.mu.RLock()
+		file, err := session.visibleFileLocked(strings.TrimPrefix(c.Param("path"), "/"), session.requestRoleLocked(username))
+		var key, contentType, name string
+		if err == nil {
+			if !file.Binary {
+				err = fmt.Errorf("%s is a text file; use the export endpoint", file.Path)
+			}
+			key, contentType, name = file.BlobKey, file.ContentType, path.Base(file.Path)
+		}
+		session.mu.RUnlock()
+
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+
+		if presigner, ok := hub.blobs.(blob.Presigner); ok {
+			expires := time.Now().Add(assetLinkTTL)
+			if claims != nil && claims.URL != "" && claims.Expiry < expires.Unix() {
+				expires = time.Unix(claims.Expiry, 0)
+			}
+			link, err := presigner.PresignGet(key, expires)
+			if err == nil {
+				c.Redirect(http.StatusFound, link)
+				return
+			}
+			if !errors.Is(err, blob.ErrNotPublished) {
+				log.Printf("Failed to link to blob %s: %v", key, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read asset"})
+				return
+			}
+		}
+
+		data, err := hub.blobs.Get(key)
+		if errors.Is(err, blob.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "asset content is missing"})
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to read blob %s: %v", key, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read asset"})
+			return
+		}
+
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		c.Data(http.StatusOK, contentType, data)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/chatbridge"
+	"github.com/gin-gonic/gin"
+)
+
+// bridgeParticipantID is the participant ID of the bridge bot, which
+// messages relayed from the bridged room are posted by
+const bridgeParticipantID = "bridge"
+
+// ChatBridge is the IRC channel or Matrix room a session's chat is
+// mirrored to
+type ChatBridge struct {
+	Network   string    `json:"network"`
+	Room      string    `json:"room"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// bridgeNetworks lists the networks this server can bridge to
+func (h *Hub) bridgeNetworks() []string {
+	var networks []string
+	if h.config.IRCServer != "" {
+		networks = append(networks, chatbridge.NetworkIRC)
+	}
+	if h.config.MatrixHomeserver != "" {
+		networks = append(networks, chatbridge.NetworkMatrix)
+	}
+	return networks
+}
+
+// openBridge connects to the room of config for the session, relaying
+// what is said there into its chat while config is the session's bridge
+func (h *Hub) openBridge(session *Session, config *ChatBridge) (chatbridge.Bridge, error) {
+	deliver := func(msg chatbridge.Message) {
+		h.relayBridged(session, config, msg)
+	}
+
+	switch {
+	case config.Network == chatbridge.NetworkIRC && h.config.IRCServer != "":
+		return chatbridge.NewIRC(chatbridge.IRCConfig{
+			Addr:      h.config.IRCServer,
+			Plaintext: h.config.IRCPlaintext,
+			Nick:      h.config.IRCNick,
+			Password:  h.config.IRCPassword,
+		}, config.Room, deliver)
+	case config.Network == chatbridge.NetworkMatrix && h.config.MatrixHomeserver != "":
+		return chatbridge.NewMatrix(chatbridge.MatrixConfig{
+			Homeserver:  h.config.MatrixHomeserver,
+			AccessToken: h.config.MatrixAccessToken,
+		}, config.Room, deliver)
+	}
+	return nil, fmt.Errorf("cannot bridge to %q on this server", config.Network)
+}
+
+// relayBridged posts a message from the bridged room to the session chat,
+// unless the bridge has since been replaced or removed
+func (h *Hub) relayBridged(session *Session, config *ChatBridge, msg chatbridge.Message) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.ChatBridge != config {
+		return
+	}
+	err := session.postChatLocked(&ChatMessage{
+		UserID:   bridgeParticipantID,
+		Username: msg.Sender,
+		Text:     msg.Text,
+		Via:      config.Network,
+	})
+	if err != nil {
+		log.Printf("Session %s: message from %s in %s not relayed: %v", session.ID, msg.Sender, config.Room, err)
+	}
+}
+
+// setBridge replaces the session's bridge, closing the old one, and
+// reports whether there was one. A nil config removes it.
+func (h *Hub) setBridge(session *Session, config *ChatBridge, bridge chatbridge.Bridge) bool {
+	session.mu.Lock()
+	old := session.bridge
+	session.ChatBridge = config
+	session.bridge = bridge
+	session.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	if old != nil || bridge != nil {
+		h.broadcastParticipants(session.ID)
+	}
+	return old != nil
+}
+
+// closeBridge disconnects the bridge of a session that is going away
+func (h *Hub) closeBridge(session *Session) {
+	h.setBridge(session, nil, nil)
+}
+
+// handleGetChatBridge returns the session's bridge
+func handleGetChatBridge(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.ownerSession(c, "manage the chat bridge")
+		if !ok {
+			return
+		}
+
+		session.mu.RLock()
+		config := session.ChatBridge
+		session.mu.RUnlock()
+
+		if config == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no chat bridge is set"})
+			return
+		}
+		c.JSON(http.StatusOK, config)
+	}
+}
+
+// handleSetChatBridge mirrors the session chat to the {"network", "room"}
+// in the body, replacing any earlier bridge
+func handleSetChatBridge(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.ownerSession(c, "manage the chat bridge")
+		if !ok {
+			return
+		}
+
+		var body struct {
+			Network string `json:"network"`
+			Room    string `json:"room"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+		config := &ChatBridge{
+			Network:   body.Network,
+			Room:      body.Room,
+			CreatedBy: hub.requestUsername(c),
+			CreatedAt: time.Now().UTC(),
+		}
+		bridge, err := hub.openBridge(session, config)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		hub.setBridge(session, config, bridge)
+		log.Printf("Session %s: chat bridged to %s %s by %s", session.ID, config.Network, config.Room, config.CreatedBy)
+		c.JSON(http.StatusOK, config)
+	}
+}
+
+// handleDeleteChatBridge stops mirroring the session chat
+func handleDeleteChatBridge(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.ownerSession(c, "manage the chat bridge")
+		if !ok {
+			return
+		}
+
+		if !hub.setBridge(session, nil, nil) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no chat bridge is set"})
+			return
+		}
+		log.Printf("Session %s: chat bridge removed", session.ID)
+		c.Status(http.StatusNoContent)
+	}
+}
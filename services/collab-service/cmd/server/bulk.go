@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/backplane"
+	"github.com/codecollab/collab-service/internal/listquery"
+	"github.com/gin-gonic/gin"
+)
+
+// closeByAdmin is the close code of connections to a session an
+// organization admin closed, so clients know not to reconnect
+const closeByAdmin = 4002
+
+// An organization's admins can close, purge and reassign its sessions in
+// bulk rather than one call at a time, picking them with the filters of
+// the session listing. The other instances serving a session are told to
+// do the same.
+const (
+	// peerClose asks the other instances to disconnect everyone in a
+	// session, naming the admin who closed it
+	peerClose = "close"
+	// peerOwner carries a session being reassigned to another owner
+	peerOwner = "owner"
+)
+
+// bulkTimeout bounds a bulk operation, which goes through every session
+// its filters pick
+const bulkTimeout = 2 * time.Minute
+
+type peerOwnerChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// bulkCaller returns the verified token of an organization admin, or
+// responds 401 or 403
+func (h *Hub) bulkCaller(c *gin.Context) (*tokenClaims, bool) {
+	claims := h.requestClaims(c)
+	if claims == nil || claims.Org == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "a valid token with an organization is required"})
+		return nil, false
+	}
+	if !claims.orgAdmin() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only organization admins can manage its sessions in bulk"})
+		return nil, false
+	}
+	return claims, true
+}
+
+// matchingSessions returns every one of an organization's sessions the
+// filters of q pick, going through the listing a page at a time
+func (h *Hub) matchingSessions(ctx context.Context, org string, q listquery.Query) ([]SessionSummary, error) {
+	q.Limit, q.After = listquery.MaxLimit, nil
+	var matching []SessionSummary
+	for {
+		page, next, err := h.listSessions(ctx, org, q)
+		if err != nil {
+			return nil, err
+		}
+		matching = append(matching, page...)
+		if next == "" {
+			return matching, nil
+		}
+		last := page[len(page)-1]
+		q = q.Continue(listquery.TimeKey(last.UpdatedAt), last.ID)
+	}
+}
+
+// disconnectSession disconnects everyone in a session open here, telling
+// them who closed it. An always-on room stays open, empty.
+func (h *Hub) disconnectSession(sessionID, by string) {
+	session, exists := h.getSession(sessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	clients := make([]*Client, 0, len(session.Clients))
+	for _, client := range session.Clients {
+		clients = append(clients, client)
+	}
+	session.mu.RUnlock()
+
+	for _, client := range clients {
+		h.sendToClient(client, OutgoingMessage{Type: "session-closed", Username: by})
+		client.disconnect(closeByAdmin, "closed by an organization admin")
+	}
+	if len(clients) > 0 {
+		log.Printf("Session %s closed by %s, disconnecting %d clients", sessionID, by, len(clients))
+	}
+}
+
+// reassignOpen makes to the owner of a session open here that from owns,
+// and reports whether it did
+func (h *Hub) reassignOpen(session *Session, from, to string) bool {
+	session.mu.Lock()
+	if session.Owner != from {
+		session.mu.Unlock()
+		return false
+	}
+	session.Owner = to
+	session.mu.Unlock()
+
+	log.Printf("Session %s reassigned from %s to %s", session.ID, from, to)
+	h.schedulePersist(session.ID)
+	h.broadcastToSession(session.ID, OutgoingMessage{Type: "session-owner", Owner: to})
+	return true
+}
+
+// handlePeerClose disconnects everyone in a session another instance
+// closed
+func (h *Hub) handlePeerClose(session *Session, env backplane.Envelope) {
+	var by string
+	if err := json.Unmarshal(env.Data, &by); err != nil {
+		log.Printf("Invalid close from instance %s: %v", env.Node, err)
+		return
+	}
+	h.disconnectSession(session.ID, by)
+}
+
+// handlePeerOwner applies a session being reassigned on another instance
+func (h *Hub) handlePeerOwner(session *Session, env backplane.Envelope) {
+	var change peerOwnerChange
+	if err := json.Unmarshal(env.Data, &change); err != nil {
+		log.Printf("Invalid owner from instance %s: %v", env.Node, err)
+		return
+	}
+	h.reassignOpen(session, change.From, change.To)
+}
+
+// handleCloseSessions disconnects everyone in the caller's organization's
+// sessions that owner, language, tag, since and until pick, wherever they
+// are open, and returns the IDs of those that had anyone in them
+func handleCloseSessions(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := hub.bulkCaller(c)
+		if !ok {
+			return
+		}
+		q, ok := listQuery(c, sessionListSpec)
+		if !ok {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), bulkTimeout)
+		defer cancel()
+		matching, err := hub.matchingSessions(ctx, claims.Org, q)
+		if err != nil {
+			log.Printf("Failed to list the sessions of %s to close: %v", claims.Org, err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "sessions are unavailable"})
+			return
+		}
+
+		closed := []string{}
+		for _, summary := range matching {
+			if len(summary.Participants) == 0 {
+				continue
+			}
+			hub.disconnectSession(summary.ID, claims.Subject)
+			if hub.peers != nil {
+				hub.peers.Publish(summary.ID, peerClose, claims.Subject)
+			}
+			closed = append(closed, summary.ID)
+		}
+		log.Printf("%s closed %d sessions of %s", claims.Subject, len(closed), claims.Org)
+		c.JSON(http.StatusOK, gin.H{"closed": closed})
+	}
+}
+
+// handlePurgeSessions deletes what is kept of the caller's organization's
+// sessions last updated before until, and returns their IDs. owner,
+// language, tag and since narrow them down. Sessions someone is in are
+// skipped, and returned apart.
+func handlePurgeSessions(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := hub.bulkCaller(c)
+		if !ok {
+			return
+		}
+		if hub.store == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "sessions are only kept with a database"})
+			return
+		}
+		q, ok := listQuery(c, sessionListSpec)
+		if !ok {
+			return
+		}
+		if q.Until.IsZero() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "until is required, to purge the sessions last updated before it"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), bulkTimeout)
+		defer cancel()
+		matching, err := hub.matchingSessions(ctx, claims.Org, q)
+		if err != nil {
+			log.Printf("Failed to list the sessions of %s to purge: %v", claims.Org, err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "sessions are unavailable"})
+			return
+		}
+
+		purged, skipped := []string{}, []string{}
+		for _, summary := range matching {
+			_, open := hub.getSession(summary.ID)
+			hub.mu.RLock()
+			_, closing := hub.closing[summary.ID]
+			hub.mu.RUnlock()
+			_, queued := hub.queuedSession(summary.ID)
+			if open || closing || queued || len(summary.Participants) > 0 {
+				skipped = append(skipped, summary.ID)
+			} else {
+				purged = append(purged, summary.ID)
+			}
+		}
+		for start := 0; start < len(purged); start += listquery.MaxLimit {
+			batch := purged[start:min(start+listquery.MaxLimit, len(purged))]
+			if err := hub.store.DeleteSessions(ctx, batch); err != nil {
+				log.Printf("Failed to purge sessions of %s: %v", claims.Org, err)
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "sessions are unavailable", "purged": purged[:start]})
+				return
+			}
+		}
+		for _, id := range purged {
+			hub.deleteStoredBlobs(id)
+		}
+		if hub.recordings != nil {
+			for _, id := range purged {
+				if err := hub.recordings.Prune(id, 0); err != nil {
+					log.Printf("Failed to delete the recordings of purged session %s: %v", id, err)
+				}
+			}
+		}
+		hub.metadata.Delete(ctx, sessionsKey(claims.Org))
+
+		log.Printf("%s purged %d sessions of %s updated before %s", claims.Subject, len(purged), claims.Org, q.Until)
+		c.JSON(http.StatusOK, gin.H{"purged": purged, "skipped": skipped})
+	}
+}
+
+// handleReassignSessions makes another user the owner of every session of
+// the caller's organization one user owns, such as someone who left, and
+// returns their IDs
+func handleReassignSessions(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := hub.bulkCaller(c)
+		if !ok {
+			return
+		}
+		var body struct {
+			From string `json:"from"`
+			To   string `json:"to"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+		if body.From == "" || body.To == "" || body.From == body.To {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from and to must name two different users"})
+			return
+		}
+
+		reassigned := []string{}
+		for _, session := range hub.openSessions() {
+			session.mu.RLock()
+			picked := !session.Lobby && session.Org == claims.Org
+			session.mu.RUnlock()
+			if picked && hub.reassignOpen(session, body.From, body.To) {
+				reassigned = append(reassigned, session.ID)
+			}
+		}
+		if hub.store != nil {
+			ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+			defer cancel()
+			kept, err := hub.store.ReassignSessions(ctx, claims.Org, body.From, body.To)
+			if err != nil {
+				log.Printf("Failed to reassign the sessions of %s in %s: %v", body.From, claims.Org, err)
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "sessions are unavailable", "reassigned": reassigned})
+				return
+			}
+			for _, id := range kept {
+				if !slices.Contains(reassigned, id) {
+					reassigned = append(reassigned, id)
+				}
+			}
+			hub.metadata.Delete(ctx, sessionsKey(claims.Org))
+		}
+		if hub.peers != nil {
+			for _, id := range reassigned {
+				hub.peers.Publish(id, peerOwner, peerOwnerChange{From: body.From, To: body.To})
+			}
+		}
+
+		log.Printf("%s reassigned %d sessions of %s from %s to %s", claims.Subject, len(reassigned), claims.Org, body.From, body.To)
+		c.JSON(http.StatusOK, gin.H{"reassigned": reassigned})
+	}
+}
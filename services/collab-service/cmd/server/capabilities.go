@@ -0,0 +1,159 @@
+package main
+
+// protocolVersion is the version of the WebSocket protocol this server
+// speaks; protocolVersions lists every version it still accepts
+const protocolVersion = 1
+
+var protocolVersions = []int{1}
+
+// Capabilities tell a client what this server supports, so it can adapt
+// instead of assuming
+type Capabilities struct {
+	Protocol         int      `json:"protocol"`
+	ProtocolVersions []int    `json:"protocolVersions"`
+	Features         []string `json:"features"`
+	Limits           Limits   `json:"limits"`
+	// Languages are the built-in ones; workspace configs may add more
+	Languages []string `json:"languages"`
+	// Install lists the package managers dependencies can be installed with
+	Install []string `json:"install,omitempty"`
+	// ChatBridges lists the networks session chats can be bridged to
+	ChatBridges []string `json:"chatBridges,omitempty"`
+	// Locales are those server messages can be sent in, and Locale the one
+	// this client gets
+	Locales []string `json:"locales"`
+	Locale  string   `json:"locale"`
+}
+
+// Limits are the bounds the server enforces. Zero means unlimited.
+type Limits struct {
+	MaxMessageBytes   int     `json:"maxMessageBytes"`
+	MessagesPerSecond float64 `json:"messagesPerSecond"`
+	MessageBurst      int     `json:"messageBurst"`
+	LargeEditBytes    int     `json:"largeEditBytes"`
+	MaxWorkspaceFiles int     `json:"maxWorkspaceFiles"`
+	MaxWorkspaceBytes int     `json:"maxWorkspaceBytes"`
+	// Execution timeouts are in seconds
+	ExecutionTimeout    int `json:"executionTimeout"`
+	ExecutionMaxTimeout int `json:"executionMaxTimeout"`
+	SQLMaxRows          int `json:"sqlMaxRows"`
+	// Edits and cursor moves are limited on their own as well
+	EditsPerSecond       float64 `json:"editsPerSecond"`
+	EditBurst            int     `json:"editBurst"`
+	CursorMovesPerSecond float64 `json:"cursorMovesPerSecond"`
+	CursorBurst          int     `json:"cursorBurst"`
+	// Cursor moves are sent in batches every CursorBatchMillis, if set
+	CursorBatchMillis int `json:"cursorBatchMillis,omitempty"`
+	// Larger documents are sent in parts, and larger code changes refused
+	DocumentChunkBytes int `json:"documentChunkBytes"`
+	MaxCodeChangeBytes int `json:"maxCodeChangeBytes"`
+	// Archives imported into the workspace are limited to MaxImportBytes
+	MaxImportBytes int `json:"maxImportBytes,omitempty"`
+}
+
+// capabilities describes the server as configured
+func (h *Hub) capabilities() *Capabilities {
+	features := []string{
+		"workspace", "file-permissions", "follow", "search", "outline",
+		"highlighting", "notebook", "result-cache", "tasks", "run-history",
+		"sql", "http-requests", "port-preview", "a11y-summaries", "presence",
+		"announcements", "ot", "crdt", "checkpoints", "chat", "session-lock",
+		"connectors", "read-receipts", "chat-threads", "typing", "always-on",
+		"undo", "diagnostics", "catch-up-sync", "templates", "session-settings",
+		"revert-user", "suggestions", "version-diff", "suggestion-export",
+		"audit-log", "editor-preset", "session-tags", "list-pagination", "bulk-admin", "session-resume", "message-acks", "scim", "delta-sync", "msgpack",
+	}
+	if h.config.LargeEditBytes > 0 {
+		features = append(features, "edit-approval")
+	}
+	if h.config.SuspiciousDeleteBytes > 0 {
+		features = append(features, "activity-guard")
+	}
+	if h.config.JWTSecret != "" {
+		features = append(features, "token-auth", "invitations", "lobby", "viewer-links",
+			"vanity-urls", "share-links", "token-scopes")
+	}
+	if h.config.JWTSecret != "" && h.config.SignedURLTTL > 0 {
+		features = append(features, "signed-urls")
+	}
+	if h.config.CursorBatch > 0 {
+		features = append(features, "cursor-batching")
+	}
+	if h.config.DocumentChunkBytes > 0 {
+		features = append(features, "document-chunks")
+	}
+	if len(h.lspCommands) > 0 {
+		features = append(features, "lsp")
+	}
+	if len(h.gitHosts()) > 0 {
+		features = append(features, "git")
+	}
+	if h.gists != nil {
+		features = append(features, "gist")
+	}
+	if h.regional() {
+		features = append(features, "regions")
+	}
+	if h.imports != nil {
+		features = append(features, "resumable-imports")
+	}
+	if h.recordings != nil {
+		features = append(features, "recordings")
+	}
+	if len(h.installer.Enabled()) > 0 {
+		features = append(features, "dependency-install")
+	}
+	if len(h.bridgeNetworks()) > 0 {
+		features = append(features, "chat-bridge")
+	}
+	if h.policies.Restricted() {
+		features = append(features, "network-policy")
+	}
+	if h.config.SnapshotInterval > 0 || h.config.SnapshotOperations > 0 {
+		features = append(features, "snapshots")
+	}
+
+	langs := h.languages.Languages()
+	names := make([]string, len(langs))
+	for i, lang := range langs {
+		names[i] = lang.Name
+	}
+
+	return &Capabilities{
+		Protocol:         protocolVersion,
+		ProtocolVersions: protocolVersions,
+		Features:         features,
+		Limits: Limits{
+			MaxMessageBytes:     h.config.MaxMessageBytes,
+			MessagesPerSecond:   h.config.MessageRate,
+			MessageBurst:        h.config.MessageBurst,
+			LargeEditBytes:      h.config.LargeEditBytes,
+			MaxWorkspaceFiles:   h.config.MaxWorkspaceFiles,
+			MaxWorkspaceBytes:   h.config.MaxWorkspaceBytes,
+			ExecutionTimeout:    int(h.config.ExecutionTimeout.Seconds()),
+			ExecutionMaxTimeout: int(h.config.ExecutionMaxTimeout.Seconds()),
+			SQLMaxRows:          h.config.SQLMaxRows,
+
+			EditsPerSecond:       h.config.EditRate,
+			EditBurst:            h.config.EditBurst,
+			CursorMovesPerSecond: h.config.CursorRate,
+			CursorBurst:          h.config.CursorBurst,
+			CursorBatchMillis:    int(h.config.CursorBatch.Milliseconds()),
+
+			DocumentChunkBytes: h.config.DocumentChunkBytes,
+			MaxCodeChangeBytes: h.config.MaxCodeChangeBytes,
+			MaxImportBytes:     h.config.MaxImportBytes,
+		},
+		Languages:   names,
+		Install:     h.installer.Enabled(),
+		ChatBridges: h.bridgeNetworks(),
+		Locales:     h.catalogs.Locales(),
+	}
+}
+
+// sendCapabilities is the first thing a client hears after connecting
+func (h *Hub) sendCapabilities(c *Client) {
+	capabilities := h.capabilities()
+	capabilities.Locale = c.Locale
+	h.sendToClient(c, OutgoingMessage{Type: "capabilities", Capabilities: capabilities})
+}
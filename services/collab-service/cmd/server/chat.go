@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ChatMessage is one message in a session's chat
+type ChatMessage struct {
+	ID       string    `json:"id"`
+	UserID   string    `json:"userId,omitempty"`
+	Username string    `json:"username"`
+	Text     string    `json:"text"`
+	SentAt   time.Time `json:"sentAt"`
+	// Subject is the verified user who sent the message from the editor,
+	// who may change it, or "" when nobody verified sent it
+	Subject string `json:"subject,omitempty"`
+	// Via names the integration that posted the message for Username,
+	// when it wasn't sent from the editor
+	Via string `json:"via,omitempty"`
+	// Notice marks an owner's message that everyone should see, whose
+	// receipts are kept for the owner
+	Notice   bool `json:"notice,omitempty"`
+	receipts *Receipts
+	// ParentID is the message a reply answers, and ThreadID the message
+	// that started its thread
+	ParentID string `json:"parentId,omitempty"`
+	ThreadID string `json:"threadId,omitempty"`
+	// Replies and LastReplyAt sum up the thread a message started
+	Replies     int        `json:"replies,omitempty"`
+	LastReplyAt *time.Time `json:"lastReplyAt,omitempty"`
+	// EditedAt is when the text was last edited
+	EditedAt *time.Time `json:"editedAt,omitempty"`
+}
+
+// Chat limits
+const (
+	maxChatMessageBytes = 4000
+	maxChatHistory      = 200
+)
+
+// postChatLocked adds a message to the session's chat, here and on the
+// other instances. Caller must hold session.mu for writing.
+func (s *Session) postChatLocked(msg *ChatMessage) error {
+	msg.Text = strings.TrimSpace(msg.Text)
+	if msg.Text == "" || len(msg.Text) > maxChatMessageBytes {
+		return fmt.Errorf("chat messages must be 1 to %d bytes", maxChatMessageBytes)
+	}
+	if msg.ParentID != "" {
+		parent := s.chatMessageLocked(msg.ParentID)
+		if parent == nil {
+			return fmt.Errorf("message not found: %s", msg.ParentID)
+		}
+		msg.ThreadID = parent.ThreadID
+		if msg.ThreadID == "" {
+			msg.ThreadID = parent.ID
+		}
+	}
+	s.nextChatID++
+	msg.ID = fmt.Sprintf("m%d", s.nextChatID)
+	msg.SentAt = time.Now().UTC()
+	if msg.Notice {
+		msg.receipts = newReceipts()
+	}
+
+	if s.peers != nil {
+		// Each instance numbers its own messages
+		msg.ID = s.peers.Node() + "-" + msg.ID
+		s.peers.Publish(s.ID, peerChat, *msg)
+	}
+	s.addChatLocked(msg)
+	return nil
+}
+
+// addChatLocked adds a message to the chat and sends it to everyone
+// connected here, in the order it was added, and to the bridged room
+// unless it came from there. Replies only go to those subscribed to their
+// thread. Caller must hold session.mu for writing.
+func (s *Session) addChatLocked(msg *ChatMessage) {
+	s.Chat = append(s.Chat, msg)
+	if len(s.Chat) > maxChatHistory {
+		s.Chat = append([]*ChatMessage(nil), s.Chat[len(s.Chat)-maxChatHistory:]...)
+	}
+	root := s.threadRepliedLocked(msg)
+	for _, client := range s.Clients {
+		if msg.ThreadID != "" {
+			state := s.threadStateLocked(client.Username, msg.ThreadID)
+			if root != nil && state != ThreadMuted {
+				sendLocked(client, OutgoingMessage{Type: "thread-updated", Chat: root})
+			}
+		}
+		if !s.seesMessageLocked(client, msg) {
+			continue
+		}
+		sendLocked(client, OutgoingMessage{Type: "chat-message", Chat: msg})
+		if msg.receipts != nil && client.joined && client.Username != msg.Username {
+			msg.receipts.deliveredTo(client.Username)
+		}
+	}
+	if s.bridge != nil && msg.Via != s.ChatBridge.Network {
+		s.bridge.Post(msg.Username, msg.Text)
+	}
+}
+
+// sendChat posts a participant's chat message, which the owner may make a
+// notice, as a reply to parentID if set
+func (h *Hub) sendChat(c *Client, text string, notice bool, parentID string) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	msg := &ChatMessage{UserID: c.ID, Username: c.Username, Subject: c.subject(), Text: text, Notice: notice, ParentID: parentID}
+	session.mu.Lock()
+	var err error
+	if notice && session.roleLocked(c) != RoleOwner {
+		err = errors.New("only the session owner can send notices")
+	} else {
+		err = session.postChatLocked(msg)
+	}
+	if err == nil {
+		session.stopTypingLocked(c)
+	}
+	session.mu.Unlock()
+
+	if err != nil {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: err.Error()})
+		return
+	}
+	h.chatChanged(session)
+	if notice {
+		h.sendReadState(session, msg.ID, c)
+	}
+}
+
+// sendChatHistory sends a newly connected client the recent chat. Replies
+// are left out, to be fetched with their thread. A restored session's chat
+// is sent once it's loaded, without holding up the rest.
+func (h *Hub) sendChatHistory(c *Client) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+	if session.historyPending() {
+		go func() {
+			h.loadHistory(session)
+			h.sendChatHistory(c)
+		}()
+		return
+	}
+
+	session.mu.RLock()
+	var history []*ChatMessage
+	for _, msg := range session.Chat {
+		if msg.ThreadID == "" {
+			history = append(history, msg)
+		}
+	}
+	session.mu.RUnlock()
+
+	if len(history) > 0 {
+		h.sendToClient(c, OutgoingMessage{Type: "chat-history", Messages: history})
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/listquery"
+	"github.com/gin-gonic/gin"
+)
+
+// Chat change actions
+const (
+	ChatEdited  = "edited"
+	ChatDeleted = "deleted"
+)
+
+// maxChatAudit bounds the changes kept in a session's chat audit log
+const maxChatAudit = 1000
+
+// ChatChange is an edit or deletion of a chat message, as the audit log
+// keeps it for moderation. Original is the text before the change, and
+// Text the text an edit left.
+type ChatChange struct {
+	MessageID string    `json:"messageId"`
+	Action    string    `json:"action"`
+	Author    string    `json:"author"`
+	By        string    `json:"by"`
+	At        time.Time `json:"at"`
+	Original  string    `json:"original"`
+	Text      string    `json:"text,omitempty"`
+}
+
+// seesMessageLocked reports whether client is sent a message and what
+// happens to it: replies only go to those subscribed to their thread.
+// Caller must hold session.mu.
+func (s *Session) seesMessageLocked(client *Client, msg *ChatMessage) bool {
+	return msg.ThreadID == "" || s.threadStateLocked(client.Username, msg.ThreadID) == ThreadSubscribed
+}
+
+// changeableChatLocked finds a message c may edit or delete: one its
+// verified user sent, or any if they own the session. A name alone doesn't
+// make a message anyone's. Caller must hold session.mu.
+func (s *Session) changeableChatLocked(c *Client, messageID string) (*ChatMessage, error) {
+	msg := s.chatMessageLocked(messageID)
+	if msg == nil {
+		return nil, fmt.Errorf("message not found: %s", messageID)
+	}
+	// Messages relayed for someone outside the editor have no subject, so
+	// aren't theirs to change from it
+	own := msg.Subject != "" && msg.Subject == c.subject()
+	if !own && s.roleLocked(c) != RoleOwner {
+		return nil, errors.New("only the author or the session owner can change a message")
+	}
+	return msg, nil
+}
+
+// editChat replaces the text of a chat message
+func (h *Hub) editChat(c *Client, messageID, text string) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	msg, err := session.changeableChatLocked(c, messageID)
+	text = strings.TrimSpace(text)
+	if err == nil && (text == "" || len(text) > maxChatMessageBytes) {
+		err = fmt.Errorf("chat messages must be 1 to %d bytes", maxChatMessageBytes)
+	}
+	changed := err == nil && text != msg.Text
+	if changed {
+		session.changeChatLocked(&ChatChange{
+			MessageID: msg.ID,
+			Action:    ChatEdited,
+			Author:    msg.Username,
+			By:        c.Username,
+			At:        time.Now().UTC(),
+			Original:  msg.Text,
+			Text:      text,
+		})
+	}
+	session.mu.Unlock()
+
+	if err != nil {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: err.Error()})
+	} else if changed {
+		h.chatChanged(session)
+	}
+}
+
+// deleteChat removes a chat message
+func (h *Hub) deleteChat(c *Client, messageID string) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	msg, err := session.changeableChatLocked(c, messageID)
+	if err == nil {
+		session.changeChatLocked(&ChatChange{
+			MessageID: msg.ID,
+			Action:    ChatDeleted,
+			Author:    msg.Username,
+			By:        c.Username,
+			At:        time.Now().UTC(),
+			Original:  msg.Text,
+		})
+	}
+	session.mu.Unlock()
+
+	if err != nil {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: err.Error()})
+		return
+	}
+	h.chatChanged(session)
+}
+
+// changeChatLocked makes a change here and on the other instances. Caller
+// must hold session.mu for writing.
+func (s *Session) changeChatLocked(change *ChatChange) {
+	if s.peers != nil {
+		s.peers.Publish(s.ID, peerChatChange, change)
+	}
+	s.applyChatChangeLocked(change)
+}
+
+// applyChatChangeLocked applies a change to the recent chat, telling
+// everyone connected here who saw the message, and records it in the
+// audit log. Caller must hold session.mu for writing.
+func (s *Session) applyChatChangeLocked(change *ChatChange) {
+	s.ChatAudit = append(s.ChatAudit, change)
+	if len(s.ChatAudit) > maxChatAudit {
+		s.ChatAudit = append([]*ChatChange(nil), s.ChatAudit[len(s.ChatAudit)-maxChatAudit:]...)
+	}
+
+	msg := s.chatMessageLocked(change.MessageID)
+	if msg == nil {
+		return
+	}
+	var outMsg OutgoingMessage
+	var root *ChatMessage
+	switch change.Action {
+	case ChatEdited:
+		msg.Text = change.Text
+		editedAt := change.At
+		msg.EditedAt = &editedAt
+		outMsg = OutgoingMessage{Type: "chat-edited", Chat: msg}
+	case ChatDeleted:
+		for i, m := range s.Chat {
+			if m == msg {
+				s.Chat = append(s.Chat[:i:i], s.Chat[i+1:]...)
+				break
+			}
+		}
+		if msg.ThreadID != "" {
+			if root = s.chatMessageLocked(msg.ThreadID); root != nil {
+				root.Replies--
+			}
+		}
+		outMsg = OutgoingMessage{Type: "chat-deleted", MessageID: msg.ID}
+	default:
+		return
+	}
+
+	for _, client := range s.Clients {
+		if root != nil && s.threadStateLocked(client.Username, root.ID) != ThreadMuted {
+			sendLocked(client, OutgoingMessage{Type: "thread-updated", Chat: root})
+		}
+		if s.seesMessageLocked(client, msg) {
+			sendLocked(client, outMsg)
+		}
+	}
+}
+
+// chatAuditSpec is how the chat audit log can be listed
+var chatAuditSpec = listquery.Spec{
+	Sorts:   []string{"at", "-at"},
+	Filters: []listquery.Filter{listquery.Owner, listquery.Since, listquery.Until},
+}
+
+// handleChatAudit returns the edits and deletions of the session's chat,
+// oldest first, a page at a time. owner picks those of one author's
+// messages.
+func handleChatAudit(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.ownerSession(c, "view the chat audit log")
+		if !ok {
+			return
+		}
+		q, ok := listQuery(c, chatAuditSpec)
+		if !ok {
+			return
+		}
+
+		session.mu.RLock()
+		changes := make([]ChatChange, 0, len(session.ChatAudit))
+		for _, change := range session.ChatAudit {
+			if (q.Owner == "" || change.Author == q.Owner) && q.During(change.At) {
+				changes = append(changes, *change)
+			}
+		}
+		session.mu.RUnlock()
+
+		page, next := listquery.Page(changes, q,
+			func(change ChatChange, _ string) string { return listquery.TimeKey(change.At) },
+			func(change ChatChange) string { return change.MessageID + "/" + change.Action })
+		listPage(c, "changes", page, next)
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/gitrepo"
+	"github.com/codecollab/collab-service/internal/listquery"
+	"github.com/codecollab/collab-service/internal/textdiff"
+	"github.com/codecollab/collab-service/internal/webhook"
+	"github.com/gin-gonic/gin"
+)
+
+// Checkpoint is a named save point of a session's workspace
+type Checkpoint struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	// files holds each file's content, or blob key when binary, so the next
+	// checkpoint can be diffed against this one
+	files map[string]checkpointFile
+}
+
+type checkpointFile struct {
+	content string
+	binary  bool
+}
+
+// CheckpointHook is a session's webhook for checkpoints. Deliveries are
+// signed with Secret, which is only shown when the hook is set.
+type CheckpointHook struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret,omitempty"`
+}
+
+// FileDiff is one file's change between two checkpoints
+type FileDiff struct {
+	Path string `json:"path"`
+	// Status is "added", "modified" or "deleted"
+	Status string `json:"status"`
+	Binary bool   `json:"binary,omitempty"`
+	// Diff is the unified diff of a text file
+	Diff string `json:"diff,omitempty"`
+}
+
+// CheckpointEvent is the data of a "checkpoint" webhook delivery
+type CheckpointEvent struct {
+	SessionID  string      `json:"sessionId"`
+	Checkpoint *Checkpoint `json:"checkpoint"`
+	// Previous is the checkpoint the diff is against. The first checkpoint
+	// of a session is diffed against an empty workspace.
+	Previous int        `json:"previous,omitempty"`
+	Files    []FileDiff `json:"files"`
+	// Diff is the whole change as one patch, left out along with the
+	// per-file diffs when it's too large to deliver
+	Diff      string `json:"diff,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// Checkpoint limits
+const (
+	maxCheckpointNameBytes = 200
+	maxCheckpointDiffBytes = 1 << 20
+)
+
+// trimCheckpoints keeps the newest limit checkpoints, all of them when
+// limit isn't positive
+func trimCheckpoints(checkpoints []*Checkpoint, limit int) []*Checkpoint {
+	if limit > 0 && len(checkpoints) > limit {
+		return append([]*Checkpoint(nil), checkpoints[len(checkpoints)-limit:]...)
+	}
+	return checkpoints
+}
+
+// checkpointLocked finds one of the session's checkpoints. Caller must
+// hold session.mu.
+func (s *Session) checkpointLocked(id int) *Checkpoint {
+	for _, checkpoint := range s.Checkpoints {
+		if checkpoint.ID == id {
+			return checkpoint
+		}
+	}
+	return nil
+}
+
+// snapshotFilesLocked captures the session's files for a checkpoint. Caller
+// must hold session.mu.
+func (s *Session) snapshotFilesLocked() map[string]checkpointFile {
+	files := make(map[string]checkpointFile, len(s.Files))
+	for path, file := range s.Files {
+		if file.Binary {
+			files[path] = checkpointFile{content: file.BlobKey, binary: true}
+		} else {
+			files[path] = checkpointFile{content: file.Content}
+		}
+	}
+	return files
+}
+
+// diffCheckpoints lists the files changed between two checkpoints' files,
+// sorted by path
+func diffCheckpoints(before, after map[string]checkpointFile) []FileDiff {
+	var diffs []FileDiff
+	for path, file := range after {
+		old, existed := before[path]
+		switch {
+		case !existed:
+			diffs = append(diffs, FileDiff{Path: path, Status: "added", Binary: file.binary})
+		case old != file:
+			diffs = append(diffs, FileDiff{Path: path, Status: "modified", Binary: file.binary || old.binary})
+		default:
+			continue
+		}
+		if !file.binary && !old.binary {
+			oldName := "a/" + path
+			if !existed {
+				oldName = "/dev/null"
+			}
+			diffs[len(diffs)-1].Diff = textdiff.Unified(oldName, "b/"+path, old.content, file.content)
+		}
+	}
+	for path, old := range before {
+		if _, exists := after[path]; !exists {
+			diff := FileDiff{Path: path, Status: "deleted", Binary: old.binary}
+			if !old.binary {
+				diff.Diff = textdiff.Unified("a/"+path, "/dev/null", old.content, "")
+			}
+			diffs = append(diffs, diff)
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Path < diffs[j].Path })
+	return diffs
+}
+
+// createCheckpoint saves the workspace as a checkpoint for a participant
+func (h *Hub) createCheckpoint(c *Client, name string) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	role := session.roleLocked(c)
+	session.mu.RUnlock()
+
+	var err error
+	if role == RoleViewer {
+		err = fmt.Errorf("viewers cannot create checkpoints")
+	} else {
+		_, err = h.checkpoint(session, name, c.Username)
+	}
+	if err != nil {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: err.Error()})
+	}
+}
+
+// checkpoint saves the workspace as a checkpoint, announces it to the
+// session and delivers its diff to the session's checkpoint webhook and
+// connector subscriptions
+func (h *Hub) checkpoint(session *Session, name, createdBy string) (*Checkpoint, error) {
+	return h.checkpointOf(session, name, createdBy, nil)
+}
+
+// checkpointOf saves files, taken earlier with snapshotFilesLocked, as a
+// checkpoint, or the workspace when files is nil
+func (h *Hub) checkpointOf(session *Session, name, createdBy string, files map[string]checkpointFile) (*Checkpoint, error) {
+	name = strings.TrimSpace(name)
+	if len(name) > maxCheckpointNameBytes {
+		return nil, fmt.Errorf("checkpoint name exceeds %d bytes", maxCheckpointNameBytes)
+	}
+
+	// The kept checkpoints come first, to be diffed against
+	h.loadHistory(session)
+
+	session.mu.Lock()
+	if files == nil {
+		files = session.snapshotFilesLocked()
+	}
+	session.nextCheckpointID++
+	checkpoint := &Checkpoint{
+		ID:        session.nextCheckpointID,
+		Name:      name,
+		CreatedBy: createdBy,
+		CreatedAt: time.Now().UTC(),
+		files:     files,
+	}
+	var previous *Checkpoint
+	if n := len(session.Checkpoints); n > 0 {
+		previous = session.Checkpoints[n-1]
+	}
+	session.Checkpoints = trimCheckpoints(append(session.Checkpoints, checkpoint), h.config.CheckpointLimit)
+	var hook CheckpointHook
+	if session.CheckpointHook != nil {
+		hook = *session.CheckpointHook
+	}
+	session.mu.Unlock()
+
+	log.Printf("Session %s: checkpoint %d created by %s", session.ID, checkpoint.ID, createdBy)
+	h.schedulePersist(session.ID)
+	h.broadcastToSession(session.ID, OutgoingMessage{Type: "checkpoint-created", Checkpoint: checkpoint})
+	h.fireTrigger(session, TriggerCheckpoint, TriggerEvent{Checkpoint: checkpoint})
+	if hook.URL == "" {
+		return checkpoint, nil
+	}
+
+	event := CheckpointEvent{SessionID: session.ID, Checkpoint: checkpoint}
+	var before map[string]checkpointFile
+	if previous != nil {
+		event.Previous = previous.ID
+		before = previous.files
+	}
+	go func() {
+		event.Files = diffCheckpoints(before, checkpoint.files)
+		var patch strings.Builder
+		for _, diff := range event.Files {
+			patch.WriteString(diff.Diff)
+		}
+		if patch.Len() > maxCheckpointDiffBytes {
+			event.Truncated = true
+			for i := range event.Files {
+				event.Files[i].Diff = ""
+			}
+		} else {
+			event.Diff = patch.String()
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		if err := webhook.New(hook.Secret, 10*time.Second).Send(ctx, hook.URL, "checkpoint", event); err != nil {
+			log.Printf("Checkpoint webhook for session %s failed: %v", session.ID, err)
+		}
+	}()
+	return checkpoint, nil
+}
+
+// restoreCheckpoint puts back the text files of a checkpoint, recreating
+// the ones deleted since, and tells the session. Files created since, and
+// binary files, are left as they are.
+func (h *Hub) restoreCheckpoint(session *Session, checkpoint *Checkpoint, username string) ([]string, error) {
+	files := make([]gitrepo.File, 0, len(checkpoint.files))
+	for path, file := range checkpoint.files {
+		if !file.binary {
+			files = append(files, gitrepo.File{Path: path, Data: []byte(file.content)})
+		}
+	}
+	restored, _, err := h.importFiles(session, files, username)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(restored)
+
+	log.Printf("Session %s: checkpoint %d restored by %s", session.ID, checkpoint.ID, username)
+	h.schedulePersist(session.ID)
+	h.broadcastToSession(session.ID, OutgoingMessage{Type: "document-restored", Username: username, Checkpoint: checkpoint})
+	return restored, nil
+}
+
+// checkpointListSpec is how a session's checkpoints can be listed
+var checkpointListSpec = listquery.Spec{
+	Sorts:   []string{"-created", "created"},
+	Filters: []listquery.Filter{listquery.Owner, listquery.Since, listquery.Until},
+}
+
+// handleListCheckpoints returns the session's checkpoints, newest first, a
+// page at a time. owner picks those one user made.
+func handleListCheckpoints(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, exists := hub.getSession(c.Param("sessionId"))
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+			return
+		}
+		q, ok := listQuery(c, checkpointListSpec)
+		if !ok {
+			return
+		}
+
+		hub.loadHistory(session)
+		session.mu.RLock()
+		checkpoints := make([]*Checkpoint, 0, len(session.Checkpoints))
+		for _, checkpoint := range session.Checkpoints {
+			if (q.Owner == "" || checkpoint.CreatedBy == q.Owner) && q.During(checkpoint.CreatedAt) {
+				checkpoints = append(checkpoints, checkpoint)
+			}
+		}
+		session.mu.RUnlock()
+
+		page, next := listquery.Page(checkpoints, q,
+			func(checkpoint *Checkpoint, _ string) string { return listquery.TimeKey(checkpoint.CreatedAt) },
+			func(checkpoint *Checkpoint) string { return listquery.NumberKey(int64(checkpoint.ID)) })
+		listPage(c, "checkpoints", page, next)
+	}
+}
+
+// handleRestoreCheckpoint rolls the session's files back to a checkpoint
+// and lists the files restored
+func handleRestoreCheckpoint(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.ownerSession(c, "restore checkpoints")
+		if !ok {
+			return
+		}
+
+		hub.loadHistory(session)
+		id, err := strconv.Atoi(c.Param("checkpointId"))
+		session.mu.RLock()
+		checkpoint := session.checkpointLocked(id)
+		session.mu.RUnlock()
+		if err != nil || checkpoint == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "checkpoint not found"})
+			return
+		}
+
+		restored, err := hub.restoreCheckpoint(session, checkpoint, hub.requestUsername(c))
+		if err != nil {
+			c.JSON(http.StatusInsufficientStorage, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"checkpoint": checkpoint, "restored": restored})
+	}
+}
+
+// handleGetCheckpointHook returns the session's checkpoint webhook
+func handleGetCheckpointHook(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.ownerSession(c, "manage webhooks")
+		if !ok {
+			return
+		}
+
+		session.mu.RLock()
+		hook := session.CheckpointHook
+		session.mu.RUnlock()
+
+		if hook == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no checkpoint webhook is set"})
+			return
+		}
+		c.JSON(http.StatusOK, CheckpointHook{URL: hook.URL})
+	}
+}
+
+// handleSetCheckpointHook sets the URL every checkpoint is posted to from a
+// {"url"} body. Each call generates a new signing secret.
+func handleSetCheckpointHook(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.ownerSession(c, "manage webhooks")
+		if !ok {
+			return
+		}
+
+		var body struct {
+			URL string `json:"url"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+		target, err := url.Parse(body.URL)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "url must be an absolute http or https URL"})
+			return
+		}
+
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate secret"})
+			return
+		}
+		hook := &CheckpointHook{URL: target.String(), Secret: hex.EncodeToString(buf)}
+
+		session.mu.Lock()
+		session.CheckpointHook = hook
+		session.mu.Unlock()
+
+		log.Printf("Session %s: checkpoint webhook set to %s", session.ID, target.Redacted())
+		c.JSON(http.StatusOK, hook)
+	}
+}
+
+// handleDeleteCheckpointHook stops checkpoint deliveries
+func handleDeleteCheckpointHook(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.ownerSession(c, "manage webhooks")
+		if !ok {
+			return
+		}
+
+		session.mu.Lock()
+		existed := session.CheckpointHook != nil
+		session.CheckpointHook = nil
+		session.mu.Unlock()
+
+		if !existed {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no checkpoint webhook is set"})
+			return
+		}
+		log.Printf("Session %s: checkpoint webhook removed", session.ID)
+		c.Status(http.StatusNoContent)
+	}
+}
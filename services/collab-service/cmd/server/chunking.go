@@ -0,0 +1,90 @@
+package main
+
+import (
+	"time"
+	"unicode/utf8"
+)
+
+// chunkPoll is how long sending a chunked document waits for the client to
+// catch up before queueing the next part
+const chunkPoll = 10 * time.Millisecond
+
+// Documents larger than DocumentChunkBytes reach clients in parts. The
+// document-sync or file-opened comes first, with everything but the
+// content and with Size, the document's length in bytes, and Chunks, the
+// number of parts. A document-chunk follows for each part, in order, with
+// the path, revision, Part counting from 1, Chunks and the part's Code.
+// Parts are queued no faster than the client reads them, so whatever else
+// it is sent goes out in between. Operations on the document may arrive
+// before the last part; clients apply them once it has.
+
+// documentChunks splits content into parts of at most size bytes, never
+// inside a UTF-8 sequence
+func documentChunks(content string, size int) []string {
+	var parts []string
+	for len(content) > size {
+		cut := size
+		for cut > 0 && !utf8.RuneStart(content[cut]) {
+			cut--
+		}
+		if cut == 0 {
+			cut = size
+		}
+		parts = append(parts, content[:cut])
+		content = content[cut:]
+	}
+	return append(parts, content)
+}
+
+// sendDocument sends a client a document-sync or file-opened, in parts if
+// its content is too large to go in one message
+func (h *Hub) sendDocument(c *Client, outMsg OutgoingMessage) {
+	size := h.config.DocumentChunkBytes
+	if size <= 0 || len(outMsg.Code) <= size {
+		h.sendToClient(c, outMsg)
+		return
+	}
+
+	parts := documentChunks(outMsg.Code, size)
+	header := outMsg
+	header.Code = ""
+	header.Size = len(outMsg.Code)
+	header.Chunks = len(parts)
+	h.sendToClient(c, header)
+	go h.sendChunks(c, outMsg.Path, outMsg.Revision, parts)
+}
+
+// sendChunks queues the parts of a document as the client reads them,
+// stopping if it leaves
+func (h *Hub) sendChunks(c *Client, path string, revision int, parts []string) {
+	for i, part := range parts {
+		for c.Send.Len() > c.Send.Cap()/2 {
+			if !h.connected(c) {
+				return
+			}
+			time.Sleep(chunkPoll)
+		}
+		if !h.connected(c) {
+			return
+		}
+		h.sendToClient(c, OutgoingMessage{
+			Type:     "document-chunk",
+			Path:     path,
+			Revision: revision,
+			Part:     i + 1,
+			Chunks:   len(parts),
+			Code:     part,
+		})
+	}
+}
+
+// connected reports whether the client is still in its session
+func (h *Hub) connected(c *Client) bool {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return false
+	}
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+	return session.Clients[c.ID] == c
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+)
+
+// paletteColor is the color of userColors a name hashes to
+func paletteColor(name string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+	return int(hash.Sum32() % uint32(len(userColors)))
+}
+
+// colorLocked returns the color of a client: that of its user if they were
+// given one before, so it stays the same when they reconnect, or else the
+// color their name hashes to or, while others in the session have it, the
+// next one that's free. Colors only repeat once all are taken. Clients
+// that haven't joined yet have no username to keep a color for and get a
+// free one for now. added reports whether username was given a color.
+// Caller must hold session.mu for writing.
+func (s *Session) colorLocked(c *Client, username string) (color string, added bool) {
+	if color, ok := s.Colors[username]; ok && username != "" {
+		return color, false
+	}
+	taken := make(map[string]bool)
+	for _, client := range s.Clients {
+		if client != c {
+			taken[client.color] = true
+		}
+	}
+	key := username
+	if key == "" {
+		key = c.ID
+	}
+	first := paletteColor(key)
+	color = userColors[first]
+	for i := range userColors {
+		if candidate := userColors[(first+i)%len(userColors)]; !taken[candidate] {
+			color = candidate
+			break
+		}
+	}
+	if username == "" {
+		return color, false
+	}
+	if s.Colors == nil {
+		s.Colors = make(map[string]string)
+	}
+	s.Colors[username] = color
+	return color, true
+}
+
+// assignColor gives a client that just joined the color of its user
+func (h *Hub) assignColor(c *Client) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	color, added := session.colorLocked(c, c.Username)
+	c.color = color
+	session.mu.Unlock()
+
+	if added {
+		log.Printf("Session %s gave %s the color %s", c.SessionID, c.Username, color)
+		h.schedulePersist(c.SessionID)
+	}
+}
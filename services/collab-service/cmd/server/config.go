@@ -0,0 +1,518 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Config holds tunables read from the environment at startup
+type Config struct {
+	Port string
+	// InvalidUTF8Policy is "fix" (replace bad sequences) or "reject" (drop the edit)
+	InvalidUTF8Policy string
+	// LargeEditBytes is how much of a file an edit from an untrusted client
+	// may change before it waits for owner approval; 0 disables the check
+	LargeEditBytes int
+	// MaxWorkspaceFiles and MaxWorkspaceBytes bound each session's
+	// workspace; 0 disables the limit
+	MaxWorkspaceFiles int
+	MaxWorkspaceBytes int
+	// MaxMessageBytes is the largest WebSocket message a client may send.
+	// Clients may send MessageRate messages per second on average, in
+	// bursts of up to MessageBurst; 0 disables the rate limit.
+	MaxMessageBytes int
+	MessageRate     float64
+	MessageBurst    int
+	// Edits and cursor moves have budgets of their own on top, so neither
+	// can crowd out the other. A client with more than RateLimitStrikes
+	// messages dropped within a minute is disconnected; 0 only drops them.
+	EditRate         float64
+	EditBurst        int
+	CursorRate       float64
+	CursorBurst      int
+	RateLimitStrikes int
+	// Cursor moves are batched over CursorBatch and sent together in a
+	// single cursors-update, with each participant's latest position; 0
+	// sends each one as it comes
+	CursorBatch time.Duration
+	// Documents larger than DocumentChunkBytes are sent in parts of that
+	// size when a client syncs or opens them, so one huge message doesn't
+	// hold up everything queued behind it; 0 sends them whole. Code
+	// changes, which carry the whole file, are refused beyond
+	// MaxCodeChangeBytes, as operations carry only what changed.
+	DocumentChunkBytes int
+	MaxCodeChangeBytes int
+
+	// OrgImportMaxBytes bounds the archives organization admins may import
+	OrgImportMaxBytes int
+	// OutlineDebounce is how long a file must be idle before its symbol
+	// outline is recomputed and broadcast
+	OutlineDebounce time.Duration
+	// PreviewDebounce is the idle time before Markdown previews re-render
+	PreviewDebounce time.Duration
+	// SummaryInterval is how often accessibility summaries of activity go
+	// out at most
+	SummaryInterval time.Duration
+	// BlobDir is where binary workspace files are stored. BlobURL is where
+	// another server serves it, checking links signed with BlobURLSecret,
+	// for downloads to be redirected there; by default they are streamed.
+	BlobDir       string
+	BlobURL       string
+	BlobURLSecret string
+	// PreferencesDir is where users' notification preferences are stored
+	PreferencesDir string
+	// RecordSessions records the changes to every session's documents in
+	// RecordingDir, for playback. Changes older than RecordingHorizon are
+	// folded into snapshots every RecordingCompaction; a horizon of 0 keeps
+	// every change.
+	RecordSessions      bool
+	RecordingDir        string
+	RecordingHorizon    time.Duration
+	RecordingCompaction time.Duration
+	// PresenceIdle is how long a connected user may do nothing before
+	// they count as idle. Changes are posted to PresenceWebhookURL,
+	// signed with WebhookSecret.
+	PresenceIdle       time.Duration
+	PresenceWebhookURL string
+	WebhookSecret      string
+	// PingInterval is how often connections are pinged; one that answers
+	// nothing for PongTimeout is closed, and shows as disconnected once a
+	// ping goes unanswered. A participant who sends nothing for ClientIdle
+	// shows as idle. A PingInterval of 0 disables heartbeats.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+	ClientIdle   time.Duration
+	// InviteTTL is how long the join token of an invitation stays valid
+	InviteTTL time.Duration
+	// JWTSecret verifies tokens issued by the API gateway (its SECRET_KEY)
+	JWTSecret string
+	// AdminToken authenticates operators on the admin API, which is off
+	// without one
+	AdminToken string
+	// ExecutionServiceURL is where notebook cells are run, and
+	// ExecutionTimeout bounds each run. Workspace configs may raise the
+	// timeout of their resource presets up to ExecutionMaxTimeout.
+	ExecutionServiceURL string
+	ExecutionTimeout    time.Duration
+	ExecutionMaxTimeout time.Duration
+	// ExecutionConcurrency is how many runs this node sends to the sandbox
+	// at once; the rest queue for up to ExecutionQueueTimeout
+	ExecutionConcurrency  int
+	ExecutionQueueTimeout time.Duration
+	// SQLSandboxDir holds the per-session databases for .sql files. Query
+	// results stream in pages of SQLPageSize rows, up to SQLMaxRows.
+	SQLSandboxDir   string
+	SQLPageSize     int
+	SQLMaxRows      int
+	SQLQueryTimeout time.Duration
+	// HTTPRunner* bound "run-request". Private and loopback destinations
+	// are refused unless HTTPRunnerAllowPrivate is set.
+	HTTPRunnerTimeout      time.Duration
+	HTTPRunnerMaxBodyBytes int
+	HTTPRunnerAllowPrivate bool
+	// EnvEncryptionKey is a base64 AES-256 key sealing session environment
+	// variables; a random key is used when unset
+	EnvEncryptionKey string
+	// PortPreviewHost is where ports of the shared execution service are
+	// reached, and PortPreviewTTL how long a preview URL stays valid
+	PortPreviewHost string
+	PortPreviewTTL  time.Duration
+	// RunHistoryLimit is how many runs each session keeps, and RunLogBytes
+	// how much of each run's code and output is retained
+	RunHistoryLimit int
+	RunLogBytes     int
+	// CheckpointLimit is how many checkpoints each session keeps
+	CheckpointLimit int
+	// SandboxDriver is "service" (the shared execution service),
+	// "docker", "kubernetes" or "firecracker". Dedicated drivers give each
+	// session its own sandbox, keeping SandboxWarmPool ready ahead of
+	// demand and at most SandboxMaxPool in total.
+	SandboxDriver       string
+	SandboxWarmPool     int
+	SandboxMaxPool      int
+	SandboxImage        string
+	SandboxMemoryMB     int
+	SandboxMilliCPUs    int
+	SandboxDockerHost   string
+	SandboxNetwork      string
+	SandboxK8sNamespace string
+	// Firecracker* locate the microVM assets. FirecrackerTaps lists the
+	// host tap devices as device:guestIP:hostIP, comma separated.
+	FirecrackerBinary  string
+	FirecrackerKernel  string
+	FirecrackerRootFS  string
+	FirecrackerWorkDir string
+	FirecrackerTaps    string
+	// ResultCacheSize is how many execution results are kept for sessions
+	// that enable result caching, each for up to ResultCacheTTL
+	ResultCacheSize int
+	ResultCacheTTL  time.Duration
+	// InstallRegistries are the registries dependency installs may use, as
+	// manager=url, comma separated; the first for each manager is the one
+	// installs go to. Managers without one can't install.
+	InstallRegistries string
+	InstallTimeout    time.Duration
+	// NetworkPolicyFile sets per-organization sandbox network policies;
+	// without one sandboxes get full access. Sandboxes under an allowlist
+	// reach EgressProxyURL, served on EgressProxyPort.
+	NetworkPolicyFile string
+	EgressProxyPort   string
+	EgressProxyURL    string
+	// SandboxEgressNetwork is the Docker network sandboxes with full access
+	// join, and SandboxK8sProxyLabels select the collab service's pods
+	SandboxEgressNetwork  string
+	SandboxK8sProxyLabels string
+	// IRCServer is the host:port of the IRC network session chats can be
+	// bridged to, reached over TLS unless IRCPlaintext; each bridged
+	// session connects as IRCNick. Matrix bridges use the bot account
+	// MatrixAccessToken is for on MatrixHomeserver. A network without a
+	// server can't be bridged to.
+	IRCServer         string
+	IRCPlaintext      bool
+	IRCNick           string
+	IRCPassword       string
+	MatrixHomeserver  string
+	MatrixAccessToken string
+	// DatabaseURL is the PostgreSQL database sessions are saved to, or
+	// sqlite: and the path of an SQLite database file, so they can be
+	// restored after everyone has left; without one they are gone. A session is saved once it has been unchanged for
+	// PersistDebounce, and when it closes.
+	DatabaseURL     string
+	PersistDebounce time.Duration
+	// RedisURL is the Redis server instances share sessions through, so
+	// more than one can serve them behind a load balancer
+	RedisURL string
+	// AppURL is where the web app is served, which viewer links point
+	// into. Their tokens stay valid for ViewerLinkTTL.
+	AppURL        string
+	ViewerLinkTTL time.Duration
+	// ShareLinkMaxTTL bounds how long owners may make share links last
+	ShareLinkMaxTTL time.Duration
+	// DownloadURL is the origin signed URLs point at, such as a CDN in
+	// front of this service, so downloads needn't pass through the API
+	// gateway; by default they are relative. They stay valid for at least
+	// SignedURLTTL, and 0 disables them.
+	DownloadURL  string
+	SignedURLTTL time.Duration
+	// ShutdownTimeout is how long the server takes at most, on SIGTERM, to
+	// save the sessions and see its clients off
+	ShutdownTimeout time.Duration
+	// MetadataCacheSize is how many session listings and participant lists
+	// REST endpoints keep cached here, each for up to MetadataCacheTTL.
+	// With a backplane, values are shared through Redis and kept here for
+	// MetadataCacheLocal at most, as other instances' updates only
+	// invalidate them there.
+	MetadataCacheSize  int
+	MetadataCacheTTL   time.Duration
+	MetadataCacheLocal time.Duration
+	// On start, up to RecoveryLimit sessions saved within RecoveryWindow
+	// are opened again, so clients coming back after a crash or restart
+	// find them ready. Those nobody rejoins within RecoveryWindow close
+	// again. A window of 0 opens none.
+	RecoveryWindow time.Duration
+	RecoveryLimit  int
+	// The database and Redis are given up on after BreakerThreshold
+	// failures in a row, and tried again every BreakerCooldown
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// DataDir, if set, runs the service on its own: sessions are saved to
+	// an SQLite database there, and blobs, preferences and recordings are
+	// kept there too, unless configured otherwise. Without Redis, one
+	// instance serves every session.
+	DataDir string
+
+	// Region is the region this instance serves, and RegionEndpoints the
+	// base URLs of every region's collab service, like
+	// "us=https://us.collab.example.com,eu=https://eu.collab.example.com".
+	// With them, sessions are homed in the region of whoever opens them,
+	// and clients connecting in another region are relayed to it.
+	Region          string
+	RegionEndpoints string
+
+	// RelayAddr is where edge relays stream their sessions' connections to
+	// this instance, over gRPC, when set; they must present RelaySecret
+	RelayAddr   string
+	RelaySecret string
+
+	// LSPServers are the language servers sessions may get, like
+	// "go=gopls,python=pyright-langserver --stdio", which run on this host
+	// with a copy of the session's files under LSPDir. LSPTimeout bounds
+	// starting one and each request.
+	LSPServers string
+	LSPDir     string
+	LSPTimeout time.Duration
+
+	// MaxConnections and MaxSessions cap the connections and sessions open
+	// on this instance, and MaxSessionClients the participants in one
+	// session here; 0 is unlimited
+	MaxConnections    int
+	MaxSessions       int
+	MaxSessionClients int
+
+	// LintDebounce is how long a file must be idle before it is checked
+	// for syntax errors and the diagnostics broadcast
+	LintDebounce time.Duration
+
+	// GitHosts are the hosts session owners may import repositories from
+	// and push to, and GitTimeout bounds each clone and push
+	GitHosts   string
+	GitTimeout time.Duration
+
+	// MaxImportBytes bounds the zip archives session owners may import,
+	// which are kept in ImportDir while they are uploaded, for ImportTTL at
+	// most; 0 disables imports
+	MaxImportBytes int
+	ImportDir      string
+	ImportTTL      time.Duration
+
+	// SlowClientTimeout is how long a client too slow to keep up may take
+	// to catch up before it is disconnected; 0 waits as long as it takes
+	SlowClientTimeout time.Duration
+
+	// DuplicateConnections is what happens when a user connected to a
+	// session joins it again: "allow", "replace" or "reject"
+	DuplicateConnections string
+
+	// GistAPIURL is the GitHub API sessions are exported to gists and
+	// seeded from them with, "" to disable that; GistTimeout bounds each
+	// request
+	GistAPIURL  string
+	GistTimeout time.Duration
+
+	// SuspiciousDeleteBytes is how much a participant other than the owner
+	// may delete, in one edit that empties a file or, for those who joined
+	// within SuspiciousNewcomer, within SuspiciousWindow, before a
+	// protective checkpoint is taken and, with SuspiciousLock, the session
+	// is locked until the owner looks; 0 disables the check
+	SuspiciousDeleteBytes int
+	SuspiciousWindow      time.Duration
+	SuspiciousNewcomer    time.Duration
+	SuspiciousLock        bool
+
+	// SnapshotInterval and SnapshotOperations are how often sessions that
+	// changed are snapshotted: every so long, or after so many edits; both
+	// 0 disables snapshots. Those of the last hour are kept, then the
+	// newest of each hour for SnapshotHourly, and of each day for
+	// SnapshotDaily.
+	SnapshotInterval   time.Duration
+	SnapshotOperations int
+	SnapshotHourly     time.Duration
+	SnapshotDaily      time.Duration
+
+	// AuditLogLimit is how many operations of a session's audit log are
+	// kept in memory: all that are kept without a store, and those waiting
+	// to be saved with one
+	AuditLogLimit int
+}
+
+func loadConfig() Config {
+	dataDir := os.Getenv("DATA_DIR")
+	// inData is where something is kept under DataDir, or fallback
+	// without one
+	inData := func(name, fallback string) string {
+		if dataDir == "" {
+			return fallback
+		}
+		return filepath.Join(dataDir, name)
+	}
+	databaseURL := ""
+	if dataDir != "" {
+		databaseURL = "sqlite:" + filepath.Join(dataDir, "codecollab.db")
+	}
+
+	return Config{
+		Port:              envString("PORT", "8002"),
+		InvalidUTF8Policy: envString("INVALID_UTF8_POLICY", "fix"),
+		LargeEditBytes:    envInt("LARGE_EDIT_BYTES", 64*1024),
+		MaxWorkspaceFiles: envInt("MAX_WORKSPACE_FILES", 200),
+		MaxWorkspaceBytes: envInt("MAX_WORKSPACE_BYTES", 10*1024*1024),
+		MaxMessageBytes:   envInt("MAX_MESSAGE_BYTES", 4*1024*1024),
+		MessageRate:       float64(envInt("MESSAGE_RATE_PER_SECOND", 50)),
+		MessageBurst:      envInt("MESSAGE_BURST", 200),
+		EditRate:          float64(envInt("EDIT_RATE_PER_SECOND", 30)),
+		EditBurst:         envInt("EDIT_BURST", 100),
+		CursorRate:        float64(envInt("CURSOR_RATE_PER_SECOND", 20)),
+		CursorBurst:       envInt("CURSOR_BURST", 40),
+		RateLimitStrikes:  envInt("RATE_LIMIT_STRIKES", 500),
+		OutlineDebounce:   time.Duration(envInt("OUTLINE_DEBOUNCE_MS", 500)) * time.Millisecond,
+		PreviewDebounce:   time.Duration(envInt("PREVIEW_DEBOUNCE_MS", 300)) * time.Millisecond,
+		SummaryInterval:   time.Duration(envInt("A11Y_SUMMARY_INTERVAL_MS", 5000)) * time.Millisecond,
+		BlobDir:           envString("BLOB_DIR", inData("blobs", "/tmp/codecollab_blobs")),
+		BlobURL:           os.Getenv("BLOB_URL"),
+		BlobURLSecret:     os.Getenv("BLOB_URL_SECRET"),
+		PreferencesDir:    envString("PREFERENCES_DIR", inData("preferences", "/tmp/codecollab_prefs")),
+		RecordSessions:    os.Getenv("RECORD_SESSIONS") == "true",
+		RecordingDir:      envString("RECORDING_DIR", inData("recordings", "/tmp/codecollab_recordings")),
+		JWTSecret:         os.Getenv("JWT_SECRET"),
+		AdminToken:        os.Getenv("ADMIN_TOKEN"),
+
+		RecordingHorizon:    time.Duration(envInt("RECORDING_HORIZON_HOURS", 7*24)) * time.Hour,
+		RecordingCompaction: time.Duration(envInt("RECORDING_COMPACTION_MINUTES", 60)) * time.Minute,
+
+		PingInterval: time.Duration(envInt("WS_PING_INTERVAL_SECONDS", 25)) * time.Second,
+		PongTimeout:  time.Duration(envInt("WS_PONG_TIMEOUT_SECONDS", 60)) * time.Second,
+		ClientIdle:   time.Duration(envInt("CLIENT_IDLE_SECONDS", 60)) * time.Second,
+
+		PresenceIdle:       time.Duration(envInt("PRESENCE_IDLE_SECONDS", 300)) * time.Second,
+		PresenceWebhookURL: os.Getenv("PRESENCE_WEBHOOK_URL"),
+		WebhookSecret:      os.Getenv("WEBHOOK_SECRET"),
+		InviteTTL:          time.Duration(envInt("INVITE_TTL_MINUTES", 15)) * time.Minute,
+
+		ExecutionServiceURL: envString("EXECUTION_SERVICE_URL", "http://execution-service:8004"),
+		ExecutionTimeout:    time.Duration(envInt("EXECUTION_TIMEOUT_SECONDS", 10)) * time.Second,
+		ExecutionMaxTimeout: time.Duration(envInt("EXECUTION_MAX_TIMEOUT_SECONDS", 60)) * time.Second,
+
+		ExecutionConcurrency:  envInt("EXECUTION_CONCURRENCY", 4),
+		ExecutionQueueTimeout: time.Duration(envInt("EXECUTION_QUEUE_TIMEOUT_SECONDS", 300)) * time.Second,
+
+		SQLSandboxDir:   envString("SQL_SANDBOX_DIR", "/tmp/codecollab_sql"),
+		SQLPageSize:     envInt("SQL_PAGE_SIZE", 100),
+		SQLMaxRows:      envInt("SQL_MAX_ROWS", 10000),
+		SQLQueryTimeout: time.Duration(envInt("SQL_QUERY_TIMEOUT_SECONDS", 10)) * time.Second,
+
+		HTTPRunnerTimeout:      time.Duration(envInt("HTTP_RUNNER_TIMEOUT_SECONDS", 15)) * time.Second,
+		HTTPRunnerMaxBodyBytes: envInt("HTTP_RUNNER_MAX_BODY_BYTES", 1024*1024),
+		HTTPRunnerAllowPrivate: os.Getenv("HTTP_RUNNER_ALLOW_PRIVATE") == "true",
+
+		EnvEncryptionKey: os.Getenv("ENV_ENCRYPTION_KEY"),
+
+		PortPreviewHost: envString("PORT_PREVIEW_HOST", "execution-service"),
+		PortPreviewTTL:  time.Duration(envInt("PORT_PREVIEW_TTL_MINUTES", 30)) * time.Minute,
+
+		RunHistoryLimit: envInt("RUN_HISTORY_LIMIT", 50),
+		RunLogBytes:     envInt("RUN_LOG_BYTES", 16*1024),
+		CheckpointLimit: envInt("CHECKPOINT_LIMIT", 20),
+
+		SandboxDriver:       envString("SANDBOX_DRIVER", "service"),
+		SandboxWarmPool:     envInt("SANDBOX_WARM_POOL", 2),
+		SandboxMaxPool:      envInt("SANDBOX_MAX_POOL", 50),
+		SandboxImage:        envString("SANDBOX_IMAGE", "codecollab-execution-service"),
+		SandboxMemoryMB:     envInt("SANDBOX_MEMORY_MB", 512),
+		SandboxMilliCPUs:    envInt("SANDBOX_MILLICPUS", 1000),
+		SandboxDockerHost:   envString("DOCKER_HOST", "unix:///var/run/docker.sock"),
+		SandboxNetwork:      envString("SANDBOX_NETWORK", "codecollab-network"),
+		SandboxK8sNamespace: os.Getenv("SANDBOX_K8S_NAMESPACE"),
+
+		FirecrackerBinary:  envString("FIRECRACKER_BIN", "firecracker"),
+		FirecrackerKernel:  os.Getenv("FIRECRACKER_KERNEL"),
+		FirecrackerRootFS:  os.Getenv("FIRECRACKER_ROOTFS"),
+		FirecrackerWorkDir: envString("FIRECRACKER_WORKDIR", "/tmp/codecollab_vms"),
+		FirecrackerTaps:    os.Getenv("FIRECRACKER_TAPS"),
+
+		ResultCacheSize: envInt("RESULT_CACHE_SIZE", 1000),
+		ResultCacheTTL:  time.Duration(envInt("RESULT_CACHE_TTL_MINUTES", 60)) * time.Minute,
+
+		InstallRegistries: envString("INSTALL_REGISTRIES", "pip=https://pypi.org/simple,npm=https://registry.npmjs.org,go=https://proxy.golang.org"),
+		InstallTimeout:    time.Duration(envInt("INSTALL_TIMEOUT_SECONDS", 120)) * time.Second,
+
+		NetworkPolicyFile:     os.Getenv("NETWORK_POLICY_FILE"),
+		EgressProxyPort:       envString("EGRESS_PROXY_PORT", "3128"),
+		EgressProxyURL:        envString("EGRESS_PROXY_URL", "http://collab-service:3128"),
+		SandboxEgressNetwork:  os.Getenv("SANDBOX_EGRESS_NETWORK"),
+		SandboxK8sProxyLabels: envString("SANDBOX_K8S_PROXY_LABELS", "app=collab-service"),
+
+		IRCServer:         os.Getenv("IRC_SERVER"),
+		IRCPlaintext:      os.Getenv("IRC_PLAINTEXT") == "true",
+		IRCNick:           envString("IRC_NICK", "codecollab"),
+		IRCPassword:       os.Getenv("IRC_PASSWORD"),
+		MatrixHomeserver:  os.Getenv("MATRIX_HOMESERVER"),
+		MatrixAccessToken: os.Getenv("MATRIX_ACCESS_TOKEN"),
+
+		DatabaseURL:     envString("DATABASE_URL", databaseURL),
+		PersistDebounce: time.Duration(envInt("PERSIST_DEBOUNCE_MS", 2000)) * time.Millisecond,
+
+		RedisURL: os.Getenv("REDIS_URL"),
+
+		AppURL:        envString("APP_URL", "http://localhost:3000"),
+		ViewerLinkTTL: time.Duration(envInt("VIEWER_LINK_TTL_MINUTES", 240)) * time.Minute,
+
+		ShareLinkMaxTTL: time.Duration(envInt("SHARE_LINK_MAX_TTL_HOURS", 720)) * time.Hour,
+
+		DownloadURL:  os.Getenv("DOWNLOAD_URL"),
+		SignedURLTTL: time.Duration(envInt("SIGNED_URL_TTL_SECONDS", 300)) * time.Second,
+
+		ShutdownTimeout: time.Duration(envInt("SHUTDOWN_TIMEOUT_SECONDS", 20)) * time.Second,
+
+		MetadataCacheSize:  envInt("METADATA_CACHE_SIZE", 1000),
+		MetadataCacheTTL:   time.Duration(envInt("METADATA_CACHE_TTL_SECONDS", 60)) * time.Second,
+		MetadataCacheLocal: time.Duration(envInt("METADATA_CACHE_LOCAL_SECONDS", 5)) * time.Second,
+
+		RecoveryWindow: time.Duration(envInt("RECOVERY_WINDOW_MINUTES", 15)) * time.Minute,
+		RecoveryLimit:  envInt("RECOVERY_LIMIT", 100),
+
+		CursorBatch:        time.Duration(envInt("CURSOR_BATCH_MS", 50)) * time.Millisecond,
+		DocumentChunkBytes: envInt("DOCUMENT_CHUNK_BYTES", 256*1024),
+		MaxCodeChangeBytes: envInt("MAX_CODE_CHANGE_BYTES", 1024*1024),
+
+		OrgImportMaxBytes: envInt("ORG_IMPORT_MAX_BYTES", 1024*1024*1024),
+
+		BreakerThreshold: envInt("BREAKER_THRESHOLD", 5),
+		BreakerCooldown:  time.Duration(envInt("BREAKER_COOLDOWN_SECONDS", 10)) * time.Second,
+
+		DataDir: dataDir,
+
+		Region:          os.Getenv("REGION"),
+		RegionEndpoints: os.Getenv("REGION_ENDPOINTS"),
+
+		RelayAddr:   os.Getenv("RELAY_GRPC_ADDR"),
+		RelaySecret: os.Getenv("RELAY_SECRET"),
+
+		LSPServers: os.Getenv("LSP_SERVERS"),
+		LSPDir:     envString("LSP_WORKSPACE_DIR", filepath.Join(os.TempDir(), "codecollab-lsp")),
+		LSPTimeout: time.Duration(envInt("LSP_TIMEOUT_SECONDS", 10)) * time.Second,
+
+		MaxConnections:    envInt("MAX_CONNECTIONS", 0),
+		MaxSessions:       envInt("MAX_SESSIONS", 0),
+		MaxSessionClients: envInt("MAX_SESSION_CLIENTS", 0),
+
+		LintDebounce: time.Duration(envInt("LINT_DEBOUNCE_MS", 500)) * time.Millisecond,
+
+		GitHosts:   envString("GIT_HOSTS", "github.com,gitlab.com"),
+		GitTimeout: time.Duration(envInt("GIT_TIMEOUT_SECONDS", 120)) * time.Second,
+
+		MaxImportBytes: envInt("MAX_IMPORT_BYTES", 256*1024*1024),
+		ImportDir:      envString("IMPORT_DIR", inData("imports", "/tmp/codecollab_imports")),
+		ImportTTL:      time.Duration(envInt("IMPORT_TTL_HOURS", 24)) * time.Hour,
+
+		SlowClientTimeout: time.Duration(envInt("SLOW_CLIENT_TIMEOUT_SECONDS", 60)) * time.Second,
+
+		DuplicateConnections: envString("DUPLICATE_CONNECTIONS", duplicatesAllow),
+
+		GistAPIURL:  envString("GIST_API_URL", "https://api.github.com"),
+		GistTimeout: time.Duration(envInt("GIST_TIMEOUT_SECONDS", 30)) * time.Second,
+
+		SuspiciousDeleteBytes: envInt("SUSPICIOUS_DELETE_BYTES", 2000),
+		SuspiciousWindow:      time.Duration(envInt("SUSPICIOUS_WINDOW_SECONDS", 30)) * time.Second,
+		SuspiciousNewcomer:    time.Duration(envInt("SUSPICIOUS_NEWCOMER_SECONDS", 300)) * time.Second,
+		SuspiciousLock:        os.Getenv("SUSPICIOUS_LOCK") == "true",
+
+		SnapshotInterval:   time.Duration(envInt("SNAPSHOT_INTERVAL_MINUTES", 10)) * time.Minute,
+		SnapshotOperations: envInt("SNAPSHOT_OPERATIONS", 500),
+		SnapshotHourly:     time.Duration(envInt("SNAPSHOT_HOURLY_HOURS", 24)) * time.Hour,
+		SnapshotDaily:      time.Duration(envInt("SNAPSHOT_DAILY_DAYS", 30)) * 24 * time.Hour,
+
+		AuditLogLimit: envInt("AUDIT_LOG_LIMIT", 10000),
+	}
+}
+
+func envString(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func envInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return fallback
+	}
+	return n
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/webhook"
+	"github.com/gin-gonic/gin"
+)
+
+// Connector triggers, the session events no-code tools can subscribe to
+const (
+	TriggerJoined      = "joined"
+	TriggerCheckpoint  = "checkpoint"
+	TriggerRunFinished = "run-finished"
+)
+
+var connectorTriggers = []string{TriggerJoined, TriggerCheckpoint, TriggerRunFinished}
+
+// maxSubscriptions bounds the connector subscriptions of one session
+const maxSubscriptions = 20
+
+// Subscription is a REST hook: a URL a trigger's events are posted to,
+// signed with Secret, which is only shown when the subscription is made
+type Subscription struct {
+	ID        string    `json:"id"`
+	Trigger   string    `json:"trigger"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// TriggerEvent is the data of a trigger delivery. Only the field of the
+// trigger is set.
+type TriggerEvent struct {
+	SessionID      string      `json:"sessionId"`
+	SubscriptionID string      `json:"subscriptionId"`
+	UserID         string      `json:"userId,omitempty"`
+	Username       string      `json:"username,omitempty"`
+	Checkpoint     *Checkpoint `json:"checkpoint,omitempty"`
+	Run            *Run        `json:"run,omitempty"`
+}
+
+// connectorAction is something a no-code tool can do in a session. run
+// gets the raw request body and returns the response.
+type connectorAction struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	run         func(h *Hub, session *Session, username string, body []byte) (gin.H, error)
+}
+
+var connectorActions = []connectorAction{
+	{
+		Name:        "post-chat",
+		Description: `Posts {"text"} to the session chat`,
+		run: func(h *Hub, session *Session, username string, body []byte) (gin.H, error) {
+			var params struct {
+				Text string `json:"text"`
+			}
+			if err := json.Unmarshal(body, &params); err != nil {
+				return nil, errors.New("invalid request body")
+			}
+			msg := &ChatMessage{Username: username, Text: params.Text, Via: "connector"}
+			session.mu.Lock()
+			err := session.postChatLocked(msg)
+			session.mu.Unlock()
+			if err != nil {
+				return nil, err
+			}
+			return gin.H{"message": msg}, nil
+		},
+	},
+	{
+		Name:        "create-checkpoint",
+		Description: `Saves the workspace as a checkpoint, optionally {"name"}d`,
+		run: func(h *Hub, session *Session, username string, body []byte) (gin.H, error) {
+			var params struct {
+				Name string `json:"name"`
+			}
+			if len(body) > 0 {
+				if err := json.Unmarshal(body, &params); err != nil {
+					return nil, errors.New("invalid request body")
+				}
+			}
+			checkpoint, err := h.checkpoint(session, params.Name, username)
+			if err != nil {
+				return nil, err
+			}
+			return gin.H{"checkpoint": checkpoint}, nil
+		},
+	},
+	{
+		Name:        "lock-session",
+		Description: `Makes the session's files read-only to everyone but the owner, or {"locked": false} to undo it`,
+		run: func(h *Hub, session *Session, username string, body []byte) (gin.H, error) {
+			params := struct {
+				Locked bool `json:"locked"`
+			}{Locked: true}
+			if len(body) > 0 {
+				if err := json.Unmarshal(body, &params); err != nil {
+					return nil, errors.New("invalid request body")
+				}
+			}
+			h.setLock(session, params.Locked, username)
+			return gin.H{"locked": params.Locked}, nil
+		},
+	},
+}
+
+// fireTrigger delivers a trigger's event to the session's subscriptions for
+// it. Deliveries run in the background.
+func (h *Hub) fireTrigger(session *Session, trigger string, event TriggerEvent) {
+	session.mu.RLock()
+	var subs []Subscription
+	for _, sub := range session.Subscriptions {
+		if sub.Trigger == trigger {
+			subs = append(subs, *sub)
+		}
+	}
+	session.mu.RUnlock()
+
+	for _, sub := range subs {
+		event := event
+		event.SessionID = session.ID
+		event.SubscriptionID = sub.ID
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+			defer cancel()
+			if err := webhook.New(sub.Secret, 10*time.Second).Send(ctx, sub.URL, trigger, event); err != nil {
+				log.Printf("Session %s: %s delivery to subscription %s failed: %v", session.ID, trigger, sub.ID, err)
+			}
+		}()
+	}
+}
+
+// participantJoined fires the joined trigger the first time a client says
+// who it is, and records the receipts of what it was sent before that
+func (h *Hub) participantJoined(c *Client) {
+	if c.joined {
+		return
+	}
+	c.joined = true
+	h.noticesDelivered(c)
+	h.sendThreadSubscriptions(c)
+	if session, exists := h.getSession(c.SessionID); exists {
+		h.fireTrigger(session, TriggerJoined, TriggerEvent{UserID: c.ID, Username: c.Username})
+	}
+}
+
+// handleListConnectors describes the triggers and actions, for no-code
+// tools setting up an integration
+func handleListConnectors(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"triggers": connectorTriggers, "actions": connectorActions})
+	}
+}
+
+// handleListSubscriptions returns the session's subscriptions
+func handleListSubscriptions(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.ownerSession(c, "use connectors")
+		if !ok {
+			return
+		}
+
+		session.mu.RLock()
+		subs := make([]Subscription, 0, len(session.Subscriptions))
+		for _, sub := range session.Subscriptions {
+			listed := *sub
+			listed.Secret = ""
+			subs = append(subs, listed)
+		}
+		session.mu.RUnlock()
+
+		slices.SortFunc(subs, func(a, b Subscription) int { return a.CreatedAt.Compare(b.CreatedAt) })
+		c.JSON(http.StatusOK, gin.H{"subscriptions": subs})
+	}
+}
+
+// handleSubscribe subscribes a URL to a trigger from a {"trigger", "url"}
+// body
+func handleSubscribe(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.ownerSession(c, "use connectors")
+		if !ok {
+			return
+		}
+
+		var body struct {
+			Trigger string `json:"trigger"`
+			URL     string `json:"url"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+		if !slices.Contains(connectorTriggers, body.Trigger) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown trigger: %q", body.Trigger)})
+			return
+		}
+		target, err := url.Parse(body.URL)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "url must be an absolute http or https URL"})
+			return
+		}
+
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate secret"})
+			return
+		}
+		sub := &Subscription{
+			Trigger:   body.Trigger,
+			URL:       target.String(),
+			Secret:    hex.EncodeToString(buf),
+			CreatedBy: hub.requestUsername(c),
+			CreatedAt: time.Now().UTC(),
+		}
+
+		session.mu.Lock()
+		if len(session.Subscriptions) >= maxSubscriptions {
+			session.mu.Unlock()
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("at most %d subscriptions per session", maxSubscriptions)})
+			return
+		}
+		session.nextSubscriptionID++
+		sub.ID = fmt.Sprintf("s%d", session.nextSubscriptionID)
+		session.Subscriptions[sub.ID] = sub
+		session.mu.Unlock()
+
+		log.Printf("Session %s: subscription %s to %s at %s", session.ID, sub.ID, sub.Trigger, target.Redacted())
+		c.JSON(http.StatusCreated, sub)
+	}
+}
+
+// handleUnsubscribe removes a subscription
+func handleUnsubscribe(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.ownerSession(c, "use connectors")
+		if !ok {
+			return
+		}
+
+		id := c.Param("id")
+		session.mu.Lock()
+		_, existed := session.Subscriptions[id]
+		delete(session.Subscriptions, id)
+		session.mu.Unlock()
+
+		if !existed {
+			c.JSON(http.StatusNotFound, gin.H{"error": "subscription not found"})
+			return
+		}
+		log.Printf("Session %s: subscription %s removed", session.ID, id)
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// handleRunAction performs a connector action with the request body as
+// its parameters
+func handleRunAction(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.ownerSession(c, "use connectors")
+		if !ok {
+			return
+		}
+
+		name := c.Param("action")
+		i := slices.IndexFunc(connectorActions, func(a connectorAction) bool { return a.Name == name })
+		if i < 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("unknown action: %q", name)})
+			return
+		}
+		body, err := c.GetRawData()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+
+		username := hub.requestUsername(c)
+		result, err := connectorActions[i].run(hub, session, username, body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		log.Printf("Session %s: connector action %s by %s", session.ID, name, username)
+		c.JSON(http.StatusOK, result)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"unicode/utf8"
+
+	"github.com/codecollab/collab-service/internal/crdt"
+	"github.com/codecollab/collab-service/internal/ot"
+)
+
+// Sync modes. In "ot" sessions clients send operations the server
+// transforms; in "crdt" sessions the server also keeps a CRDT of every text
+// file, and clients exchange "crdt-update" messages, ignoring code-updates
+// and operations.
+const (
+	SyncOT   = "ot"
+	SyncCRDT = "crdt"
+)
+
+// crdtServerSite is the site of CRDT changes made for edits that arrive
+// in any other form, such as code-changes, uploads and approved pastes
+const crdtServerSite = "server"
+
+var errNotCRDT = errors.New("the session is not in crdt sync mode")
+
+// crdtDocLocked returns the CRDT of a text file in a CRDT session, starting
+// it from the file's content the first time. Caller must hold session.mu
+// for writing.
+func (s *Session) crdtDocLocked(f *File) *crdt.Doc {
+	if s.SyncMode != SyncCRDT || f.Binary {
+		return nil
+	}
+	if f.crdt == nil {
+		f.crdt = crdt.FromText(crdtServerSite, f.Content)
+	}
+	return f.crdt
+}
+
+// flushCRDTLocked broadcasts the CRDT changes the server made to a file
+// since the last flush. Caller must hold session.mu for writing.
+func (s *Session) flushCRDTLocked(f *File) {
+	for _, update := range f.crdtPending {
+		s.broadcastToReadersLocked("", f, OutgoingMessage{Type: "crdt-update", Path: f.Path, Update: &update})
+	}
+	f.crdtPending = nil
+}
+
+// flushCRDT runs flushCRDTLocked for a file that just changed
+func (h *Hub) flushCRDT(sessionID, filePath string) {
+	session, exists := h.getSession(sessionID)
+	if !exists {
+		return
+	}
+	session.mu.Lock()
+	if file, ok := session.Files[filePath]; ok {
+		session.flushCRDTLocked(file)
+	}
+	session.mu.Unlock()
+}
+
+// setSyncMode switches the session between OT and CRDT sync. Only the owner
+// may change it; clients reopen their files when told the mode changed.
+func (h *Hub) setSyncMode(c *Client, mode string) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	var err error
+	switch {
+	case session.roleLocked(c) != RoleOwner:
+		err = fmt.Errorf("only the session owner can change the sync mode")
+	case mode != SyncOT && mode != SyncCRDT:
+		err = fmt.Errorf("sync mode must be ot or crdt")
+	}
+	if err != nil {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: err.Error()})
+		return
+	}
+	session.SyncMode = mode
+	if mode == SyncOT {
+		for _, file := range session.Files {
+			file.crdt, file.crdtPending = nil, nil
+		}
+	}
+	session.mu.Unlock()
+
+	log.Printf("Session %s sync mode set to %s by %s", c.SessionID, mode, c.ID)
+	h.broadcastToSession(c.SessionID, OutgoingMessage{Type: "sync-mode", SyncMode: mode})
+}
+
+func (h *Hub) sendSyncMode(c *Client) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	mode := session.SyncMode
+	session.mu.RUnlock()
+
+	if mode == SyncCRDT {
+		h.sendToClient(c, OutgoingMessage{Type: "sync-mode", SyncMode: mode})
+	}
+}
+
+// sendCRDTState sends a client what it is missing of a file's CRDT given
+// its state vector, everything when sv is empty, along with the server's
+// state vector and the site the client inserts as. Updates a client gets
+// before the state of a file it just opened are included in the state.
+func (h *Hub) sendCRDTState(c *Client, filePath string, sv crdt.StateVector) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	file, err := session.visibleFileLocked(filePath, session.roleLocked(c))
+	var doc *crdt.Doc
+	if err == nil {
+		if doc = session.crdtDocLocked(file); doc == nil {
+			err = errNotCRDT
+		}
+	}
+	if err != nil {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Path: filePath, Error: err.Error()})
+		return
+	}
+	session.flushCRDTLocked(file)
+	update := doc.Diff(sv)
+	sendLocked(c, OutgoingMessage{
+		Type:        "crdt-state",
+		Path:        file.Path,
+		Update:      &update,
+		StateVector: doc.StateVector(),
+		Site:        c.ID,
+	})
+	session.mu.Unlock()
+}
+
+// applyCRDTUpdate integrates a client's CRDT update to a file and relays it
+// to everyone else who can see the file. Clients insert as their own site,
+// the one crdt-state told them.
+func (h *Hub) applyCRDTUpdate(c *Client, filePath string, update crdt.Update) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	file, err := session.editableFileLocked(c, filePath)
+	var doc *crdt.Doc
+	if err == nil {
+		if doc = session.crdtDocLocked(file); doc == nil {
+			err = errNotCRDT
+		} else if session.suggestingLocked(c) {
+			err = errSuggestingCRDT
+		}
+	}
+	inserted, deleted := 0, 0
+	for _, ins := range update.Inserts {
+		if err == nil && ins.ID.Site != c.ID {
+			err = fmt.Errorf("inserts must use your own site")
+		}
+		inserted += len(ins.Text)
+	}
+	for _, del := range update.Deletes {
+		deleted += del.Length
+	}
+	if err == nil {
+		err = h.checkQuotaLocked(session, 0, inserted)
+	}
+	// Only updates that may change the size by more than the threshold
+	// are tried on a copy first, so they can be held for approval
+	if err == nil && !isTrustedLocked(session, c) && h.config.LargeEditBytes > 0 && inserted+utf8.UTFMax*deleted > h.config.LargeEditBytes {
+		doc = doc.Clone()
+	}
+	if err == nil {
+		err = doc.Apply(update)
+	}
+	if err != nil {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Path: filePath, Error: err.Error()})
+		return
+	}
+
+	content := doc.Text()
+	normalized, warnings, _ := normalizeEdit(session.Settings, content, true, h.config.InvalidUTF8Policy)
+	if doc != file.crdt && h.isLargeEdit(file, normalized) {
+		pending := session.holdEdit(c, file, normalized)
+		pending.Resync = true
+		state := file.crdt.Diff(nil)
+		sendLocked(c, OutgoingMessage{
+			Type:        "crdt-state",
+			Path:        file.Path,
+			Update:      &state,
+			StateVector: file.crdt.StateVector(),
+			Site:        c.ID,
+			Reset:       true,
+		})
+		session.mu.Unlock()
+
+		h.requestApproval(c, pending)
+		return
+	}
+
+	file.crdt = doc
+	session.flushCRDTLocked(file)
+	session.recordEditLocked(c.ID, c.Username, file, normalized)
+	h.watchEditLocked(session, c, file, normalized)
+	h.recordChangeLocked(session, auditEdit, c.ID, c.Username, file, normalized)
+	file.applyOperation(ot.FromDiff(file.Content, content), content, c.Username, c.identity())
+	session.broadcastToReadersLocked(c.ID, file, OutgoingMessage{Type: "crdt-update", UserID: c.ID, Path: file.Path, Update: &update})
+	if normalized != content {
+		file.applyOperation(ot.FromDiff(content, normalized), normalized, c.Username, c.identity())
+		session.flushCRDTLocked(file)
+	}
+	session.mu.Unlock()
+
+	if len(warnings) > 0 {
+		h.sendToClient(c, OutgoingMessage{Type: "edit-warning", Warnings: warnings})
+	}
+	h.fileChanged(c.SessionID, file.Path)
+	h.scheduleSummaries(session)
+}
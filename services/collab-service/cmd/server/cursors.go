@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// cursorKey is the timer cursor moves are batched on
+const cursorKey = "cursors"
+
+// CursorPosition is where a participant's cursor moved to, in a
+// cursors-update
+type CursorPosition struct {
+	UserID string                 `json:"userId"`
+	Cursor map[string]interface{} `json:"cursor"`
+	Color  string                 `json:"color,omitempty"`
+}
+
+// batchCursor adds a cursor move to the session's next cursors-update,
+// replacing the participant's earlier position in it. The batch is sent
+// CursorBatch after the first move in it, however many follow, so a
+// session sends at most one cursors-update per CursorBatch.
+func (h *Hub) batchCursor(sessionID string, position CursorPosition) {
+	session, exists := h.getSession(sessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	replaced := false
+	for i := range session.cursors {
+		if session.cursors[i].UserID == position.UserID {
+			session.cursors[i] = position
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		session.cursors = append(session.cursors, position)
+	}
+	session.mu.Unlock()
+
+	h.throttle(session, cursorKey, h.config.CursorBatch, func() {
+		h.sendCursors(session)
+	})
+}
+
+// sendCursors sends every client in the session the cursors that moved
+// since the last cursors-update, but its own
+func (h *Hub) sendCursors(session *Session) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	pending := session.cursors
+	session.cursors = nil
+	if len(pending) == 0 {
+		return
+	}
+
+	marshal := func(cursors []CursorPosition) []byte {
+		msgBytes, err := json.Marshal(OutgoingMessage{Type: "cursors-update", Cursors: cursors})
+		if err != nil {
+			log.Printf("Error marshaling cursors-update: %v", err)
+			return nil
+		}
+		return msgBytes
+	}
+	all := marshal(pending)
+	for _, client := range session.Clients {
+		msgBytes := all
+		for i, position := range pending {
+			if position.UserID == client.ID {
+				others := append(append([]CursorPosition(nil), pending[:i]...), pending[i+1:]...)
+				msgBytes = nil
+				if len(others) > 0 {
+					msgBytes = marshal(others)
+				}
+				break
+			}
+		}
+		if msgBytes != nil {
+			client.deliverCursors(msgBytes)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import "time"
+
+// debounce runs fn once key has been quiet for delay. Calling it again
+// for the same key before the timer fires pushes the run back.
+func (h *Hub) debounce(session *Session, key string, delay time.Duration, fn func()) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if timer, ok := session.timers[key]; ok {
+		timer.Reset(delay)
+		return
+	}
+	session.timers[key] = time.AfterFunc(delay, func() {
+		session.mu.Lock()
+		delete(session.timers, key)
+		session.mu.Unlock()
+		fn()
+	})
+}
+
+// throttle runs fn delay after the first call for key. Calls made before
+// it fires are folded into that run rather than pushing it back, so steady
+// activity still gets through at a bounded rate.
+func (h *Hub) throttle(session *Session, key string, delay time.Duration, fn func()) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if _, ok := session.timers[key]; ok {
+		return
+	}
+	session.timers[key] = time.AfterFunc(delay, func() {
+		session.mu.Lock()
+		delete(session.timers, key)
+		session.mu.Unlock()
+		fn()
+	})
+}
+
+// stopTimers cancels pending debounced work for a discarded session
+func (h *Hub) stopTimers(session *Session) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	for key, timer := range session.timers {
+		timer.Stop()
+		delete(session.timers, key)
+	}
+}
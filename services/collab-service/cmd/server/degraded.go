@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/store"
+)
+
+// Services the collab service may run without, each named in the
+// degraded status while it is down
+const (
+	serviceDatabase  = "database"
+	serviceBackplane = "backplane"
+)
+
+// The service degrades rather than fails when the database or Redis goes
+// down. Their breakers make calls to them fail at once instead of holding
+// up sessions, which carry on live on each instance: edits, chat and
+// cursors work among the clients connected to the same one. Saves that
+// fail are kept, the newest of each session and lobby, and retried until
+// they go through; a session opening meanwhile gets what is waiting to be
+// saved, which is newer than what the database has. Sessions that open
+// while the database is down and have nothing waiting aren't saved, as
+// what the database had of them may be newer. Clients and /health are
+// told what is down.
+
+// queueSessionSave keeps a session that failed to save, to save again
+func (h *Hub) queueSessionSave(snapshot *store.Session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if queued, ok := h.retrySessions[snapshot.ID]; !ok || !queued.UpdatedAt.After(snapshot.UpdatedAt) {
+		h.retrySessions[snapshot.ID] = snapshot
+	}
+}
+
+// sessionSaveDone drops what was waiting to be saved of a session, if a
+// newer snapshot was just saved
+func (h *Hub) sessionSaveDone(snapshot *store.Session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if queued, ok := h.retrySessions[snapshot.ID]; ok && !queued.UpdatedAt.After(snapshot.UpdatedAt) {
+		delete(h.retrySessions, snapshot.ID)
+	}
+}
+
+// queuedSession returns what is waiting to be saved of a session
+func (h *Hub) queuedSession(sessionID string) (*store.Session, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	snapshot, ok := h.retrySessions[sessionID]
+	return snapshot, ok
+}
+
+// queueLobbySave keeps a lobby chat that failed to save, to save again
+func (h *Hub) queueLobbySave(snapshot *store.Lobby) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if queued, ok := h.retryLobbies[snapshot.Org]; !ok || !queued.UpdatedAt.After(snapshot.UpdatedAt) {
+		h.retryLobbies[snapshot.Org] = snapshot
+	}
+}
+
+// lobbySaveDone drops what was waiting to be saved of a lobby, if a newer
+// snapshot was just saved
+func (h *Hub) lobbySaveDone(snapshot *store.Lobby) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if queued, ok := h.retryLobbies[snapshot.Org]; ok && !queued.UpdatedAt.After(snapshot.UpdatedAt) {
+		delete(h.retryLobbies, snapshot.Org)
+	}
+}
+
+// queuedLobby returns what is waiting to be saved of a lobby
+func (h *Hub) queuedLobby(org string) (*store.Lobby, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	snapshot, ok := h.retryLobbies[org]
+	return snapshot, ok
+}
+
+// pendingSaves counts the saves waiting to be retried
+func (h *Hub) pendingSaves() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.retrySessions) + len(h.retryLobbies)
+}
+
+// retrySaves saves again what failed to save, stopping at the first
+// failure, as the database is still down then
+func (h *Hub) retrySaves() {
+	if h.store == nil || h.store.Down() && !h.probe(h.store.Ping) {
+		return
+	}
+
+	h.mu.RLock()
+	sessions := make([]*store.Session, 0, len(h.retrySessions))
+	for _, snapshot := range h.retrySessions {
+		sessions = append(sessions, snapshot)
+	}
+	lobbies := make([]*store.Lobby, 0, len(h.retryLobbies))
+	for _, snapshot := range h.retryLobbies {
+		lobbies = append(lobbies, snapshot)
+	}
+	h.mu.RUnlock()
+
+	for _, snapshot := range sessions {
+		if !h.saveSession(snapshot) {
+			return
+		}
+	}
+	for _, snapshot := range lobbies {
+		if !h.storeLobby(snapshot) {
+			return
+		}
+	}
+	if len(sessions)+len(lobbies) > 0 {
+		log.Printf("Saved %d sessions and lobbies that had failed to save", len(sessions)+len(lobbies))
+	}
+}
+
+// probe tries a service that is thought to be down, reporting whether it
+// is back
+func (h *Hub) probe(ping func(ctx context.Context) error) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+	defer cancel()
+	return ping(ctx) == nil
+}
+
+// degradedServices lists the services that are down
+func (h *Hub) degradedServices() []string {
+	down := []string{}
+	if h.store != nil && h.store.Down() {
+		down = append(down, serviceDatabase)
+	}
+	if h.peers != nil && h.peers.Down() {
+		down = append(down, serviceBackplane)
+	}
+	return down
+}
+
+// runDegraded retries failed saves, probes the services that are down and
+// tells every client when what is down changes
+func (h *Hub) runDegraded() {
+	if h.store == nil && h.peers == nil {
+		return
+	}
+	ticker := time.NewTicker(max(h.config.BreakerCooldown, time.Second))
+	defer ticker.Stop()
+
+	var reported []string
+	for range ticker.C {
+		h.retrySaves()
+		if h.peers != nil && h.peers.Down() {
+			h.probe(h.peers.Ping)
+		}
+
+		down := h.degradedServices()
+		if slices.Equal(down, reported) {
+			continue
+		}
+		if len(down) > 0 {
+			log.Printf("Degraded: %v unavailable", down)
+		} else {
+			log.Printf("No longer degraded")
+		}
+		if slices.Contains(reported, serviceBackplane) && !slices.Contains(down, serviceBackplane) {
+			h.rejoinPeers()
+		}
+		reported = down
+
+		for _, session := range h.openSessions() {
+			h.broadcastToSession(session.ID, OutgoingMessage{Type: "service-status", Degraded: down})
+		}
+	}
+}
+
+// rejoinPeers subscribes again to the open sessions once the backplane is
+// back, as what was sent while it was down was dropped, and asks the other
+// instances for their files and participants
+func (h *Hub) rejoinPeers() {
+	for _, session := range h.openSessions() {
+		h.joinPeers(session.ID)
+	}
+}
+
+// sendServiceStatus tells a newly connected client what is down, if
+// anything
+func (h *Hub) sendServiceStatus(c *Client) {
+	if down := h.degradedServices(); len(down) > 0 {
+		h.sendToClient(c, OutgoingMessage{Type: "service-status", Degraded: down})
+	}
+}
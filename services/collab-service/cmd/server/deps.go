@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/deps"
+	"github.com/codecollab/collab-service/internal/execution"
+	"github.com/codecollab/collab-service/internal/sandbox"
+)
+
+// InstallStatus reports the install phase of a run
+type InstallStatus struct {
+	RunID string `json:"runId"`
+	// Status is "running", "done" or "error"
+	Status   string   `json:"status"`
+	Managers []string `json:"managers"`
+	// Cached is set when an earlier install in the session was reused
+	Cached bool   `json:"cached,omitempty"`
+	Output string `json:"output,omitempty"`
+}
+
+// install is a session's install of one plan. Runs needing the same plan
+// wait on done instead of installing again.
+type install struct {
+	done chan struct{}
+	dir  string
+	err  error
+}
+
+// installPlanLocked plans the install phase for a run from the manifests
+// at the workspace root that role can see. Caller must hold session.mu.
+func (h *Hub) installPlanLocked(s *Session, role Role) (*deps.Plan, error) {
+	files := make(map[string]string)
+	for _, manager := range deps.Managers {
+		for _, name := range append([]string{manager.Manifest}, manager.Lockfiles...) {
+			if file, ok := s.Files[name]; ok && !file.Binary && file.visibleTo(role) {
+				files[name] = file.Content
+			}
+		}
+	}
+	return h.installer.Plan(s.ID, files)
+}
+
+// ensureInstalled runs the plan's install in the run's sandbox with env
+// added, unless the session already has it, and returns the directory it
+// was installed in. Progress goes to everyone who can see the run.
+func (h *Hub) ensureInstalled(ctx context.Context, session *Session, run *Run, sb sandbox.Sandbox, plan *deps.Plan, env map[string]string) (string, error) {
+	session.mu.Lock()
+	runID := run.ID
+	existing, ok := session.installs[plan.Key]
+	if !ok {
+		if session.installs == nil {
+			session.installs = make(map[string]*install)
+		}
+		session.installs[plan.Key] = &install{done: make(chan struct{})}
+	}
+	pending := session.installs[plan.Key]
+	session.mu.Unlock()
+
+	status := func(state string, cached bool, output string) {
+		h.broadcastToRunReaders(session, run, OutgoingMessage{
+			Type: "install-status",
+			Path: run.Path,
+			Install: &InstallStatus{
+				RunID:    runID,
+				Status:   state,
+				Managers: plan.Managers,
+				Cached:   cached,
+				Output:   output,
+			},
+		})
+	}
+
+	if ok {
+		select {
+		case <-existing.done:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		if existing.err != nil {
+			return "", existing.err
+		}
+		status("done", true, "")
+		return existing.dir, nil
+	}
+
+	status("running", false, "")
+	result, err := sb.Install(ctx, execution.InstallRequest{
+		Key:     plan.Key,
+		Files:   plan.Files,
+		Command: plan.Command,
+		Env:     env,
+		Timeout: int(h.config.InstallTimeout / time.Second),
+	})
+	switch {
+	case err != nil:
+		err = fmt.Errorf("installing dependencies: %w", err)
+	case result.ExitCode != 0:
+		err = fmt.Errorf("installing dependencies failed with exit code %d", result.ExitCode)
+	}
+
+	session.mu.Lock()
+	if err != nil {
+		// A later run tries again, since the manifests may be fixed by then
+		// or the failure may have been transient
+		delete(session.installs, plan.Key)
+		pending.err = err
+	} else {
+		pending.dir = result.Dir
+	}
+	close(pending.done)
+	session.mu.Unlock()
+
+	if err != nil {
+		output := err.Error()
+		if result != nil {
+			output = result.Stdout + result.Stderr
+		}
+		status("error", false, output)
+		return "", err
+	}
+	status("done", result.Cached, result.Stdout+result.Stderr)
+	return result.Dir, nil
+}
+
+// purgeInstalls removes the session's installs from the execution service
+// when the session ends. Per-session sandboxes take theirs with them. The
+// request is made in the background, as the hub loop calls this.
+func (h *Hub) purgeInstalls(session *Session) {
+	session.mu.Lock()
+	keys := make([]string, 0, len(session.installs))
+	for key, inst := range session.installs {
+		select {
+		case <-inst.done:
+			if inst.err == nil {
+				keys = append(keys, key)
+			}
+		default:
+		}
+	}
+	session.installs = nil
+	session.mu.Unlock()
+
+	if len(keys) == 0 {
+		return
+	}
+	sb, ok := h.sandboxes.Lookup(session.ID)
+	if !ok {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := sb.PurgeInstalls(ctx, keys); err != nil {
+			log.Printf("Failed to remove dependency installs for session %s: %v", session.ID, err)
+		}
+	}()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// closeSignedOut is the close code of connections their user signed out
+// from somewhere else, so clients know not to reconnect
+const closeSignedOut = 4001
+
+// errSignedOut is sent to a connection before it is signed out
+const errSignedOut = "you were signed out from another device"
+
+// Connection is one of a user's connections to this instance
+type Connection struct {
+	ID        string    `json:"id"`
+	SessionID string    `json:"sessionId"`
+	Device    string    `json:"device"`
+	UserAgent string    `json:"userAgent,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	Since     time.Time `json:"since"`
+}
+
+// Browsers and systems by what their user agents contain, most specific
+// first: Edge and Opera say Chrome too, and Chrome says Safari
+var (
+	browsers = []struct{ token, name string }{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"}, {"Safari/", "Safari"},
+	}
+	systems = []struct{ token, name string }{
+		{"iPhone", "iOS"}, {"iPad", "iPadOS"}, {"Android", "Android"},
+		{"Windows", "Windows"}, {"Mac OS X", "macOS"}, {"CrOS", "ChromeOS"}, {"Linux", "Linux"},
+	}
+)
+
+// describeDevice names the browser and system of a user agent, as in
+// "Firefox on Linux", or says what the agent is if it's not a browser
+func describeDevice(userAgent string) string {
+	var browser, system string
+	for _, b := range browsers {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	for _, s := range systems {
+		if strings.Contains(userAgent, s.token) {
+			system = s.name
+			break
+		}
+	}
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case userAgent == "":
+		return "unknown device"
+	}
+	// Command-line clients and libraries name themselves first
+	name, _, _ := strings.Cut(userAgent, " ")
+	return name
+}
+
+// connectionsOf lists username's connections, oldest first
+func (h *Hub) connectionsOf(username string) []Connection {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	connections := []Connection{}
+	for client := range h.online[username] {
+		connections = append(connections, Connection{
+			ID:        client.ID,
+			SessionID: client.SessionID,
+			Device:    describeDevice(client.userAgent),
+			UserAgent: client.userAgent,
+			IP:        client.addr,
+			Since:     client.connectedAt,
+		})
+	}
+	sort.Slice(connections, func(i, j int) bool { return connections[i].Since.Before(connections[j].Since) })
+	return connections
+}
+
+// handleListConnections returns the caller's connections to this instance
+func handleListConnections(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, ok := hub.requireUser(c)
+		if !ok {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"connections": hub.connectionsOf(username)})
+	}
+}
+
+// handleCloseConnection signs the caller out of one of their connections,
+// which is closed with closeSignedOut
+func handleCloseConnection(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, ok := hub.requireUser(c)
+		if !ok {
+			return
+		}
+
+		id := c.Param("connectionId")
+		var target *Client
+		hub.mu.RLock()
+		for client := range hub.online[username] {
+			if client.ID == id {
+				target = client
+				break
+			}
+		}
+		hub.mu.RUnlock()
+		if target == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "connection not found"})
+			return
+		}
+
+		hub.sendToClient(target, OutgoingMessage{Type: "signed-out", Error: errSignedOut})
+		target.disconnect(closeSignedOut, "signed out")
+		log.Printf("%s signed client %s of session %s out", username, target.ID, target.SessionID)
+		c.Status(http.StatusNoContent)
+	}
+}
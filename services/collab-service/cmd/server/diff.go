@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/codecollab/collab-service/internal/ot"
+	"github.com/codecollab/collab-service/internal/recording"
+	"github.com/codecollab/collab-service/internal/store"
+	"github.com/codecollab/collab-service/internal/textdiff"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	errVersionSyntax  = errors.New("versions are current, snapshot:ID, checkpoint:ID or recording:ID[@TIME]")
+	errVersionMissing = errors.New("version not found")
+)
+
+// VersionDiff is one file's change between two versions of a session, as
+// hunks to render
+type VersionDiff struct {
+	Path string `json:"path"`
+	// Status is "added", "modified" or "deleted"
+	Status string          `json:"status"`
+	Hunks  []textdiff.Hunk `json:"hunks"`
+}
+
+// versionFiles returns the text files of a version of the session:
+// current for the files as they are, snapshot:<id> or checkpoint:<id> for
+// one of its snapshots or checkpoints, or recording:<id>@<time> for the
+// files as one of its recordings had them at an RFC 3339 time, at its end
+// without one
+func (h *Hub) versionFiles(ctx context.Context, session *Session, version string) (map[string]checkpointFile, error) {
+	kind, id, _ := strings.Cut(version, ":")
+	var files map[string]checkpointFile
+	switch kind {
+	case "", "current":
+		if id != "" {
+			return nil, errVersionSyntax
+		}
+		session.mu.RLock()
+		files = session.snapshotFilesLocked()
+		session.mu.RUnlock()
+	case "snapshot":
+		snapshot, err := h.lookupSnapshot(ctx, session, id)
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, errVersionMissing
+		}
+		if err != nil {
+			return nil, err
+		}
+		files = snapshot.textFiles()
+	case "checkpoint":
+		n, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, errVersionSyntax
+		}
+		h.loadHistory(session)
+		session.mu.RLock()
+		if checkpoint := session.checkpointLocked(n); checkpoint != nil {
+			files = checkpoint.files
+		}
+		session.mu.RUnlock()
+		if files == nil {
+			return nil, errVersionMissing
+		}
+	case "recording":
+		recordingID, raw, timed := strings.Cut(id, "@")
+		var at time.Time
+		if timed {
+			var err error
+			if at, err = time.Parse(time.RFC3339, raw); err != nil {
+				return nil, errVersionSyntax
+			}
+		}
+		var err error
+		if files, err = h.replayRecording(session, recordingID, at); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errVersionSyntax
+	}
+
+	text := make(map[string]checkpointFile, len(files))
+	for filePath, file := range files {
+		if !file.binary {
+			text[filePath] = file
+		}
+	}
+	return text, nil
+}
+
+// replayRecording plays one of the session's recordings up to at, or to
+// its end when at is zero, and returns its documents then. Files deleted
+// since aren't recorded as such, so they stay.
+func (h *Hub) replayRecording(session *Session, id string, at time.Time) (map[string]checkpointFile, error) {
+	if h.recordings == nil {
+		return nil, errVersionMissing
+	}
+	info, err := h.recordings.Stat(session.ID, id)
+	session.mu.RLock()
+	owner := session.Owner
+	session.mu.RUnlock()
+	if errors.Is(err, recording.ErrNotFound) || err == nil && info.Owner != owner {
+		return nil, errVersionMissing
+	}
+	if err != nil {
+		return nil, err
+	}
+	reader, err := h.recordings.Open(session.ID, id)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	documents := make(map[string]string)
+	for {
+		event, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Snapshots of a compacted recording stand for everything before
+		// them, so they are always played
+		if !at.IsZero() && event.At.After(at) && event.Kind != recording.Snapshot {
+			break
+		}
+		switch event.Kind {
+		case recording.Snapshot:
+			documents[event.Path] = event.Content
+		case recording.Create:
+			documents[event.Path] = ""
+		case recording.Edit:
+			content := documents[event.Path]
+			op, err := ot.FromEdits(utf8.RuneCountInString(content), event.Ops)
+			if err == nil {
+				content, err = op.Apply(content)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("replaying an edit of %s: %w", event.Path, err)
+			}
+			documents[event.Path] = content
+		}
+	}
+
+	files := make(map[string]checkpointFile, len(documents))
+	for filePath, content := range documents {
+		files[filePath] = checkpointFile{content: content}
+	}
+	return files, nil
+}
+
+// handleDiff compares two versions of the session's text files, from and
+// to, the current files by default. The changes are JSON hunks with the
+// characters that differ within changed lines marked, or with
+// format=unified, one patch.
+func handleDiff(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.ownerSession(c, "compare versions")
+		if !ok {
+			return
+		}
+		format := c.DefaultQuery("format", "json")
+		if format != "json" && format != "unified" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or unified"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+		defer cancel()
+		var versions [2]map[string]checkpointFile
+		for i, version := range []string{c.Query("from"), c.Query("to")} {
+			files, err := hub.versionFiles(ctx, session, version)
+			switch {
+			case errors.Is(err, errVersionSyntax):
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			case errors.Is(err, errVersionMissing):
+				c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("version %q not found", version)})
+				return
+			case err != nil:
+				log.Printf("Failed to read version %q of session %s: %v", version, session.ID, err)
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "versions are unavailable"})
+				return
+			}
+			versions[i] = files
+		}
+		before, after := versions[0], versions[1]
+
+		changes := diffCheckpoints(before, after)
+		if format == "unified" {
+			var patch strings.Builder
+			for _, change := range changes {
+				patch.WriteString(change.Diff)
+			}
+			c.Data(http.StatusOK, "text/x-diff; charset=utf-8", []byte(patch.String()))
+			return
+		}
+		diffs := make([]VersionDiff, len(changes))
+		for i, change := range changes {
+			diffs[i] = VersionDiff{
+				Path:   change.Path,
+				Status: change.Status,
+				Hunks:  textdiff.Hunks(before[change.Path].content, after[change.Path].content),
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"from": c.Query("from"), "to": c.Query("to"), "files": diffs})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+
+	"github.com/gorilla/websocket"
+)
+
+// What happens when a verified user who is connected to a session joins it
+// again, set with DUPLICATE_CONNECTIONS
+const (
+	// duplicatesAllow keeps every connection, as the user's devices
+	duplicatesAllow = "allow"
+	// duplicatesReplace closes the older connections
+	duplicatesReplace = "replace"
+	// duplicatesReject turns the new connection away
+	duplicatesReject = "reject"
+)
+
+// errReplacedConnection and errDuplicateConnection are sent with the
+// session-conflict to the connection that is closed
+const (
+	errReplacedConnection  = "you joined this session from somewhere else"
+	errDuplicateConnection = "you are already connected to this session"
+)
+
+// validDuplicatePolicy reports whether policy is one of the above
+func validDuplicatePolicy(policy string) bool {
+	switch policy {
+	case duplicatesAllow, duplicatesReplace, duplicatesReject:
+		return true
+	}
+	return false
+}
+
+// duplicatesOf returns the other connections of username to c's session on
+// this instance
+func (h *Hub) duplicatesOf(c *Client, username string) []*Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var others []*Client
+	for other := range h.online[username] {
+		if other != c && other.SessionID == c.SessionID {
+			others = append(others, other)
+		}
+	}
+	return others
+}
+
+// admitDuplicate applies the duplicate connection policy to c joining as
+// username, before it is counted as theirs. Each connection affected gets a
+// session-conflict naming the other one; it reports whether c may join.
+func (h *Hub) admitDuplicate(c *Client, username string) bool {
+	others := h.duplicatesOf(c, username)
+	if len(others) == 0 {
+		return true
+	}
+	policy := h.config.DuplicateConnections
+	switch policy {
+	case duplicatesReject:
+		log.Printf("Turning away client %s: %s is already in session %s", c.ID, username, c.SessionID)
+		h.sendToClient(c, OutgoingMessage{Type: "session-conflict", Policy: policy, UserID: others[0].ID, Error: errDuplicateConnection})
+		c.disconnect(websocket.ClosePolicyViolation, "already connected")
+		return false
+	case duplicatesReplace:
+		for _, other := range others {
+			log.Printf("Client %s of %s in session %s replaced by %s", other.ID, username, c.SessionID, c.ID)
+			h.sendToClient(other, OutgoingMessage{Type: "session-conflict", Policy: policy, UserID: c.ID, Error: errReplacedConnection})
+			other.disconnect(websocket.ClosePolicyViolation, "replaced by a newer connection")
+		}
+	default:
+		for _, other := range others {
+			h.sendToClient(other, OutgoingMessage{Type: "session-conflict", Policy: policy, UserID: c.ID})
+		}
+	}
+	return true
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/relay"
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// edgeQueue is how many frames to an edge may wait to be sent, per session
+const edgeQueue = 1024
+
+// clientConn is a client's connection: its WebSocket, or the connection an
+// edge relay terminates and streams here
+type clientConn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetReadLimit(limit int64)
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	SetPongHandler(h func(appData string) error)
+	Close() error
+}
+
+// Edge relays terminate participants' WebSockets near them and stream
+// each session's connections here, as frames on one stream; see package
+// relay. Every connection becomes a client like any other, over an
+// edgeConn. The edge pings its clients itself and passes on only that
+// they answered, so heartbeats don't cross the distance, and a client
+// whose edge stream ends is gone.
+
+// serveEdges serves edge relays on RelayAddr, if set
+func (h *Hub) serveEdges() *grpc.Server {
+	if h.config.RelayAddr == "" {
+		return nil
+	}
+	if h.config.RelaySecret == "" {
+		log.Fatal("RELAY_GRPC_ADDR is set without RELAY_SECRET")
+	}
+	listener, err := net.Listen("tcp", h.config.RelayAddr)
+	if err != nil {
+		log.Fatal("Failed to listen for edge relays:", err)
+	}
+	server := grpc.NewServer()
+	relay.Register(server, edgeServer{h})
+	go func() {
+		log.Printf("Serving edge relays on %s", h.config.RelayAddr)
+		if err := server.Serve(listener); err != nil {
+			log.Printf("Stopped serving edge relays: %v", err)
+		}
+	}()
+	return server
+}
+
+type edgeServer struct{ hub *Hub }
+
+// Relay serves a session's stream from an edge until it ends
+func (e edgeServer) Relay(stream relay.Stream) error {
+	h := e.hub
+	sessionID, err := relay.Authenticate(stream, h.config.RelaySecret)
+	if err != nil {
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	if isLobby(sessionID) {
+		return status.Error(codes.InvalidArgument, "lobbies are joined through /lobby")
+	}
+	if h.draining.Load() {
+		return status.Error(codes.Unavailable, "the server is restarting")
+	}
+
+	sender := relay.NewSender(stream, edgeQueue)
+	conns := make(map[uint64]*edgeConn)
+	defer func() {
+		for _, conn := range conns {
+			conn.ended(&websocket.CloseError{Code: websocket.CloseAbnormalClosure, Text: "edge relay gone"})
+		}
+	}()
+	for {
+		batch, err := stream.Recv()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		for _, f := range batch.Frames {
+			conn := conns[f.Conn]
+			switch {
+			case f.Kind == relay.KindOpen && conn == nil:
+				if reason, _ := h.overCapacity(sessionID); reason != "" {
+					// The edge tells the client to try again later
+					sender.Send(relay.Frame{Conn: f.Conn, Kind: relay.KindClose, Code: websocket.CloseTryAgainLater, Reason: "at capacity: " + reason}, time.Now().Add(writeWait))
+					continue
+				}
+				conn = newEdgeConn(f.Conn, sender)
+				conns[f.Conn] = conn
+				client := newClient(h, conn, sessionID, h.catalogs.Negotiate(f.Locales...))
+				client.userAgent, client.addr = f.UserAgent, f.Addr
+				h.register <- client
+				go client.writePump(h)
+				go client.readPump(h)
+			case conn == nil:
+				// Frames after the connection closed
+			case f.Kind == relay.KindMessage:
+				conn.receive(f)
+			case f.Kind == relay.KindPong:
+				conn.receive(f)
+			case f.Kind == relay.KindClose:
+				conn.ended(&websocket.CloseError{Code: f.Code, Text: f.Reason})
+				delete(conns, f.Conn)
+			}
+		}
+	}
+}
+
+// edgeConn is a client's connection through an edge. What it reads are
+// the frames the edge sent for it; what it writes goes on the session's
+// stream.
+type edgeConn struct {
+	id     uint64
+	sender *relay.Sender
+	frames chan relay.Frame
+	done   chan struct{}
+
+	// pong and readDeadline only change on the reading goroutine
+	pong         func(string) error
+	readDeadline time.Time
+	readLimit    int64
+
+	mu            sync.Mutex
+	writeDeadline time.Time
+	err           error
+}
+
+func newEdgeConn(id uint64, sender *relay.Sender) *edgeConn {
+	return &edgeConn{id: id, sender: sender, frames: make(chan relay.Frame, 256), done: make(chan struct{})}
+}
+
+// receive hands a frame from the edge to the reader, waiting while it
+// catches up
+func (c *edgeConn) receive(f relay.Frame) {
+	select {
+	case c.frames <- f:
+	case <-c.done:
+	}
+}
+
+// ended closes the connection, for err, unless it is already. It reports
+// whether this did.
+func (c *edgeConn) ended(err error) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return false
+	}
+	c.err = err
+	close(c.done)
+	return true
+}
+
+func (c *edgeConn) closedErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *edgeConn) ReadMessage() (int, []byte, error) {
+	for {
+		f, err := c.next()
+		if err != nil {
+			return 0, nil, err
+		}
+		if f.Kind == relay.KindPong {
+			if c.pong != nil {
+				if err := c.pong(""); err != nil {
+					return 0, nil, err
+				}
+			}
+			continue
+		}
+		if c.readLimit > 0 && int64(len(f.Data)) > c.readLimit {
+			c.Close()
+			return 0, nil, websocket.ErrReadLimit
+		}
+		return websocket.TextMessage, f.Data, nil
+	}
+}
+
+// next waits for the next frame for the connection, until the read
+// deadline
+func (c *edgeConn) next() (relay.Frame, error) {
+	var timeout <-chan time.Time
+	if !c.readDeadline.IsZero() {
+		timer := time.NewTimer(time.Until(c.readDeadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case f := <-c.frames:
+		return f, nil
+	case <-c.done:
+		return relay.Frame{}, c.closedErr()
+	case <-timeout:
+		c.Close()
+		return relay.Frame{}, errors.New("edge connection timed out")
+	}
+}
+
+func (c *edgeConn) WriteMessage(_ int, data []byte) error {
+	if err := c.closedErr(); err != nil {
+		return websocket.ErrCloseSent
+	}
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	return c.sender.Send(relay.Message(c.id, data), deadline)
+}
+
+// WriteControl sends close frames on to the edge; it answers pings itself
+func (c *edgeConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	if messageType != websocket.CloseMessage {
+		return nil
+	}
+	code, reason := websocket.CloseNoStatusReceived, ""
+	if len(data) >= 2 {
+		code, reason = int(binary.BigEndian.Uint16(data)), string(data[2:])
+	}
+	if !c.ended(&websocket.CloseError{Code: code, Text: reason}) {
+		return websocket.ErrCloseSent
+	}
+	return c.sender.Send(relay.Frame{Conn: c.id, Kind: relay.KindClose, Code: code, Reason: reason}, deadline)
+}
+
+func (c *edgeConn) SetReadLimit(limit int64) {
+	c.readLimit = limit
+}
+
+func (c *edgeConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline = t
+	return nil
+}
+
+func (c *edgeConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return nil
+}
+
+func (c *edgeConn) SetPongHandler(h func(string) error) {
+	c.pong = h
+}
+
+// Close has the edge drop the connection, unless it is closed already
+func (c *edgeConn) Close() error {
+	if c.ended(&websocket.CloseError{Code: websocket.CloseAbnormalClosure}) {
+		c.sender.Send(relay.Frame{Conn: c.id, Kind: relay.KindClose}, time.Now().Add(writeWait))
+	}
+	return nil
+}
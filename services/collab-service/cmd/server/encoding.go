@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"log"
+
+	"github.com/codecollab/collab-service/internal/msgpack"
+	"github.com/gorilla/websocket"
+)
+
+// Clients choose how messages are encoded with the WebSocket subprotocol
+// they ask for when they connect. JSON is the default, and the encoding of
+// every message. Those that ask for subprotocolMessagePack are also sent
+// the messages of binaryTypes, the hot paths, as binary MessagePack
+// frames, and may send any message as one.
+const (
+	subprotocolJSON        = "codecollab.json"
+	subprotocolMessagePack = "codecollab.msgpack"
+)
+
+// binaryTypes are the messages sent as MessagePack to the clients that
+// asked for it
+var binaryTypes = []string{"operation", "operation-ack", "cursor-update", "cursors-update"}
+
+// binaryPrefixes are how the JSON of binaryTypes starts, Type being the
+// first field of an OutgoingMessage
+var binaryPrefixes = func() [][]byte {
+	prefixes := make([][]byte, len(binaryTypes))
+	for i, msgType := range binaryTypes {
+		prefixes[i] = []byte(`{"type":"` + msgType + `"`)
+	}
+	return prefixes
+}()
+
+// frame is how a queued message is written to the client: as MessagePack
+// if it's one of binaryTypes and the client asked for that, otherwise as
+// the JSON it is
+func (c *Client) frame(message []byte) (int, []byte) {
+	if !c.msgpack {
+		return websocket.TextMessage, message
+	}
+	for _, prefix := range binaryPrefixes {
+		if !bytes.HasPrefix(message, prefix) {
+			continue
+		}
+		encoded, err := msgpack.FromJSON(message)
+		if err != nil {
+			log.Printf("Error encoding a message for %s as MessagePack: %v", c.ID, err)
+			break
+		}
+		return websocket.BinaryMessage, encoded
+	}
+	return websocket.TextMessage, message
+}
+
+// decodeFrame returns the JSON of a message the client sent, which is
+// MessagePack if it came in a binary frame from a client that asked for
+// that
+func (c *Client) decodeFrame(messageType int, message []byte) ([]byte, error) {
+	if messageType != websocket.BinaryMessage || !c.msgpack {
+		return message, nil
+	}
+	return msgpack.ToJSON(message)
+}
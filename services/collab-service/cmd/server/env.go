@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// envNamePattern matches names every execution runtime accepts
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+const (
+	maxEnvVars       = 100
+	maxEnvValueBytes = 32 * 1024
+	secretMask       = "********"
+)
+
+// EnvVar is an environment variable injected into the session's runs. The
+// value is always kept sealed.
+type EnvVar struct {
+	Name      string
+	Sealed    []byte
+	Secret    bool
+	UpdatedAt time.Time
+}
+
+// EnvEntry describes a variable to clients. Secret values are never
+// included.
+type EnvEntry struct {
+	Name      string    `json:"name"`
+	Value     string    `json:"value,omitempty"`
+	Secret    bool      `json:"secret"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// envEntriesLocked lists the session's variables, with the values of
+// non-secret ones when withValues is set. Caller must hold session.mu.
+func (h *Hub) envEntriesLocked(s *Session, withValues bool) []EnvEntry {
+	entries := make([]EnvEntry, 0, len(s.Env))
+	for _, v := range s.Env {
+		entry := EnvEntry{Name: v.Name, Secret: v.Secret, UpdatedAt: v.UpdatedAt}
+		if withValues && !v.Secret {
+			value, err := h.secrets.Open(v.Sealed)
+			if err != nil {
+				log.Printf("Failed to open env var %s in session %s: %v", v.Name, s.ID, err)
+				continue
+			}
+			entry.Value = value
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+// runEnvLocked decrypts the variables for a run and returns the secret
+// values that must be masked in its output. Caller must hold session.mu.
+func (h *Hub) runEnvLocked(s *Session) (map[string]string, []string, error) {
+	env := make(map[string]string, len(s.Env))
+	var secrets []string
+	for _, v := range s.Env {
+		value, err := h.secrets.Open(v.Sealed)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decrypt %s", v.Name)
+		}
+		env[v.Name] = value
+		if v.Secret && value != "" {
+			secrets = append(secrets, value)
+		}
+	}
+	// Longest first, so a secret containing another is masked whole
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+	return env, secrets, nil
+}
+
+// maskSecrets replaces every occurrence of a secret value in text
+func maskSecrets(text string, secrets []string) string {
+	for _, secret := range secrets {
+		text = strings.ReplaceAll(text, secret, secretMask)
+	}
+	return text
+}
+
+// broadcastEnv tells participants which variables exist, without values
+func (h *Hub) broadcastEnv(sessionID string) {
+	session, exists := h.getSession(sessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	entries := h.envEntriesLocked(session, false)
+	session.mu.RUnlock()
+
+	h.broadcastToSession(sessionID, OutgoingMessage{Type: "env-update", Env: entries})
+}
+
+// ownerSession resolves the session of a REST request made by its owner.
+// action describes the request for the 403 sent to anyone else.
+func (h *Hub) ownerSession(c *gin.Context, action string) (*Session, bool) {
+	session, exists := h.getSession(c.Param("sessionId"))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return nil, false
+	}
+
+	username := h.requestUsername(c)
+	session.mu.RLock()
+	role := session.requestRoleLocked(username)
+	session.mu.RUnlock()
+
+	if role != RoleOwner {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the session owner can " + action})
+		return nil, false
+	}
+	return session, true
+}
+
+// handleListEnv returns the session's variables. Secret values are masked.
+func handleListEnv(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.ownerSession(c, "manage environment variables")
+		if !ok {
+			return
+		}
+
+		session.mu.RLock()
+		entries := hub.envEntriesLocked(session, true)
+		session.mu.RUnlock()
+
+		c.JSON(http.StatusOK, gin.H{"env": entries})
+	}
+}
+
+// handleSetEnv creates or replaces a variable from a {"value", "secret"} body
+func handleSetEnv(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.ownerSession(c, "manage environment variables")
+		if !ok {
+			return
+		}
+
+		name := c.Param("name")
+		if !envNamePattern.MatchString(name) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid variable name: %q", name)})
+			return
+		}
+		var body struct {
+			Value  string `json:"value"`
+			Secret bool   `json:"secret"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+		if len(body.Value) > maxEnvValueBytes {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("value exceeds %d bytes", maxEnvValueBytes)})
+			return
+		}
+
+		sealed, err := hub.secrets.Seal(body.Value)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to encrypt value"})
+			return
+		}
+
+		session.mu.Lock()
+		_, existed := session.Env[name]
+		if !existed && len(session.Env) >= maxEnvVars {
+			err = errors.New("too many environment variables")
+		} else {
+			session.Env[name] = &EnvVar{Name: name, Sealed: sealed, Secret: body.Secret, UpdatedAt: time.Now()}
+		}
+		session.mu.Unlock()
+
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		log.Printf("Session %s: env var %s set (secret=%t)", session.ID, name, body.Secret)
+		hub.broadcastEnv(session.ID)
+		c.JSON(http.StatusOK, gin.H{"name": name, "secret": body.Secret})
+	}
+}
+
+// handleDeleteEnv removes a variable
+func handleDeleteEnv(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.ownerSession(c, "manage environment variables")
+		if !ok {
+			return
+		}
+
+		name := c.Param("name")
+		session.mu.Lock()
+		_, existed := session.Env[name]
+		delete(session.Env, name)
+		session.mu.Unlock()
+
+		if !existed {
+			c.JSON(http.StatusNotFound, gin.H{"error": "variable not found: " + name})
+			return
+		}
+
+		log.Printf("Session %s: env var %s deleted", session.ID, name)
+		hub.broadcastEnv(session.ID)
+		c.Status(http.StatusNoContent)
+	}
+}
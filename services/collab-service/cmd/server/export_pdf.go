@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/pdf"
+	"github.com/gin-gonic/gin"
+)
+
+// PDF listing layout, in points
+const (
+	pdfMargin      = 40.0
+	pdfFontSize    = 8.0
+	pdfLeading     = 10.0
+	pdfCharWidth   = 4.8 // Courier advance width at pdfFontSize
+	pdfGutterWidth = 36.0
+)
+
+var pdfGray = pdf.Color{R: 0.55, G: 0.58, B: 0.62}
+
+type pdfListing struct {
+	path    string
+	lines   []string
+	authors []string
+}
+
+// renderAttributionPDF lays out each listing with a colored bar per line
+// marking its author in their session color, preceded by a legend of
+// participants
+func renderAttributionPDF(sessionID string, listings []pdfListing, sessionColors map[string]string) []byte {
+	authorSet := make(map[string]bool)
+	for _, listing := range listings {
+		for _, author := range listing.authors {
+			authorSet[author] = true
+		}
+	}
+	authors := make([]string, 0, len(authorSet))
+	for author := range authorSet {
+		if author != "" {
+			authors = append(authors, author)
+		}
+	}
+	sort.Strings(authors)
+	colors := make(map[string]pdf.Color, len(authors)+1)
+	for _, author := range authors {
+		color, ok := sessionColors[author]
+		if !ok {
+			color = userColors[paletteColor(author)]
+		}
+		colors[author] = pdf.ParseHex(color)
+	}
+	colors[""] = pdfGray
+	if authorSet[""] {
+		authors = append(authors, "")
+	}
+
+	doc := &pdf.Document{}
+	doc.AddPage()
+	y := pdf.PageHeight - pdfMargin
+	newline := func(height float64) {
+		y -= height
+		if y < pdfMargin {
+			doc.AddPage()
+			y = pdf.PageHeight - pdfMargin - height
+		}
+	}
+
+	doc.Text(pdfMargin, y, pdf.FontBold, 14, pdf.Black, "Session "+sessionID)
+	newline(16)
+	doc.Text(pdfMargin, y, pdf.FontSans, 9, pdfGray, "Exported "+time.Now().UTC().Format(time.RFC1123))
+	newline(20)
+	doc.Text(pdfMargin, y, pdf.FontBold, 10, pdf.Black, "Participants")
+	newline(14)
+	for _, author := range authors {
+		name := author
+		if name == "" {
+			name = "(unattributed)"
+		}
+		doc.Rect(pdfMargin, y-1, 8, 8, colors[author])
+		doc.Text(pdfMargin+14, y, pdf.FontSans, 9, pdf.Black, name)
+		newline(12)
+	}
+
+	textWidth := pdf.PageWidth - 2*pdfMargin - pdfGutterWidth
+	maxChars := int(textWidth / pdfCharWidth)
+	for _, listing := range listings {
+		newline(18)
+		doc.Text(pdfMargin, y, pdf.FontBold, 10, pdf.Black, listing.path)
+		newline(14)
+		for i, line := range listing.lines {
+			color := colors[listing.authors[i]]
+			line = strings.ReplaceAll(strings.TrimRight(line, "\r"), "\t", "    ")
+			runes := []rune(line)
+			for start := 0; start == 0 || start < len(runes); start += maxChars {
+				end := start + maxChars
+				if end > len(runes) {
+					end = len(runes)
+				}
+				doc.Rect(pdfMargin, y-2.5, 3, pdfLeading, color)
+				if start == 0 {
+					doc.Text(pdfMargin+6, y, pdf.FontMono, pdfFontSize, pdfGray, fmt.Sprintf("%4d", i+1))
+				}
+				doc.Text(pdfMargin+pdfGutterWidth, y, pdf.FontMono, pdfFontSize, pdf.Black, string(runes[start:end]))
+				newline(pdfLeading)
+			}
+		}
+	}
+	return doc.Bytes()
+}
+
+// handleExportPDF renders the text files the caller can see as a printable
+// PDF with per-line author colors
+func handleExportPDF(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, exists := hub.getSession(c.Param("sessionId"))
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+			return
+		}
+
+		username := hub.requestUsername(c)
+
+		session.mu.RLock()
+		role := session.requestRoleLocked(username)
+		var listings []pdfListing
+		for _, file := range session.Files {
+			if file.Binary || !file.visibleTo(role) {
+				continue
+			}
+			lines := strings.Split(strings.TrimSuffix(file.Content, "\n"), "\n")
+			authors := make([]string, len(lines))
+			if len(file.LineAuthors) >= len(lines) {
+				copy(authors, file.LineAuthors)
+			}
+			listings = append(listings, pdfListing{path: file.Path, lines: lines, authors: authors})
+		}
+		colors := make(map[string]string, len(session.Colors))
+		for username, color := range session.Colors {
+			colors[username] = color
+		}
+		session.mu.RUnlock()
+
+		sort.Slice(listings, func(i, j int) bool { return listings[i].path < listings[j].path })
+
+		body := renderAttributionPDF(session.ID, listings, colors)
+		c.Header("Content-Disposition", "attachment; filename="+strconv.Quote(session.ID+".pdf"))
+		c.Data(http.StatusOK, "application/pdf", body)
+	}
+}
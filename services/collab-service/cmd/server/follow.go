@@ -0,0 +1,124 @@
+package main
+
+import "log"
+
+// FoldRange is a collapsed region, as 1-based inclusive line numbers
+type FoldRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// ViewState is what a participant currently sees of one file
+type ViewState struct {
+	Path       string      `json:"path"`
+	ScrollLine int         `json:"scrollLine"`
+	Folds      []FoldRange `json:"folds,omitempty"`
+}
+
+// updateViewState records the client's view of a file and forwards it to
+// everyone following them
+func (h *Hub) updateViewState(c *Client, state *ViewState) {
+	if state == nil {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: "viewState is required"})
+		return
+	}
+
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	file, err := session.visibleFileLocked(state.Path, session.roleLocked(c))
+	if err != nil {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Path: state.Path, Error: err.Error()})
+		return
+	}
+	stored := *state
+	stored.Path = file.Path
+	stored.Folds = append([]FoldRange(nil), state.Folds...)
+	c.ViewStates[file.Path] = &stored
+	c.ActivePath = file.Path
+
+	var followers []*Client
+	for _, client := range session.Clients {
+		if client.Following == c.ID && file.visibleTo(session.roleLocked(client)) {
+			followers = append(followers, client)
+		}
+	}
+	session.mu.Unlock()
+
+	for _, follower := range followers {
+		h.sendToClient(follower, OutgoingMessage{
+			Type:      "view-state-update",
+			UserID:    c.ID,
+			ViewState: &stored,
+		})
+	}
+}
+
+// follow attaches c to a leader and sends the leader's current view
+func (h *Hub) follow(c *Client, leaderID string) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	leader, ok := session.Clients[leaderID]
+	if !ok || leaderID == c.ID {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", UserID: leaderID, Error: "cannot follow that participant"})
+		return
+	}
+	c.Following = leaderID
+
+	var state *ViewState
+	if current, ok := leader.ViewStates[leader.ActivePath]; ok {
+		if file, ok := session.Files[current.Path]; ok && file.visibleTo(session.roleLocked(c)) {
+			copied := *current
+			state = &copied
+		}
+	}
+	session.mu.Unlock()
+
+	log.Printf("Client %s is following %s", c.ID, leaderID)
+	h.sendToClient(c, OutgoingMessage{Type: "follow-started", UserID: leaderID})
+	if state != nil {
+		h.sendToClient(c, OutgoingMessage{
+			Type:      "view-state-update",
+			UserID:    leaderID,
+			ViewState: state,
+		})
+	}
+}
+
+func (h *Hub) unfollow(c *Client) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	leaderID := c.Following
+	c.Following = ""
+	session.mu.Unlock()
+
+	if leaderID != "" {
+		h.sendToClient(c, OutgoingMessage{Type: "follow-ended", UserID: leaderID})
+	}
+}
+
+// releaseFollowersLocked detaches everyone following a client that has left.
+// Caller must hold session.mu.
+func (s *Session) releaseFollowersLocked(leaderID string) []*Client {
+	var followers []*Client
+	for _, client := range s.Clients {
+		if client.Following == leaderID {
+			client.Following = ""
+			followers = append(followers, client)
+		}
+	}
+	return followers
+}
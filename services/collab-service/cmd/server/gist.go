@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+
+	"github.com/codecollab/collab-service/internal/gist"
+	"github.com/codecollab/collab-service/internal/gitrepo"
+	"github.com/gin-gonic/gin"
+)
+
+// newGists returns the client of the configured GitHub API, or nil when
+// gists are disabled
+func newGists(config Config) *gist.Client {
+	if config.GistAPIURL == "" {
+		return nil
+	}
+	return gist.New(config.GistAPIURL, config.GistTimeout)
+}
+
+// gistStatus maps a failed gist request to its response status
+func gistStatus(err error) int {
+	switch {
+	case errors.Is(err, gist.ErrAuth):
+		return http.StatusForbidden
+	case errors.Is(err, gist.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// gistsEnabled reports whether gists can be used, responding 404 if not
+func (h *Hub) gistsEnabled(c *gin.Context) bool {
+	if h.gists == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "gists aren't enabled"})
+		return false
+	}
+	return true
+}
+
+// handleExportGist makes a gist of the session's text files, or of
+// {"paths"}, with {"token"}, {"description"} and {"public"}. Files in
+// folders are named with their paths, slashes escaped. Binary and empty
+// files, which gists can't hold, are skipped and listed.
+func handleExportGist(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hub.gistsEnabled(c) {
+			return
+		}
+		session, ok := hub.ownerSession(c, "export to a gist")
+		if !ok {
+			return
+		}
+
+		var body struct {
+			Token       string   `json:"token"`
+			Description string   `json:"description"`
+			Public      bool     `json:"public"`
+			Paths       []string `json:"paths"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+		if body.Token == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "a GitHub token is required"})
+			return
+		}
+
+		var files []gist.File
+		skipped := []string{}
+		session.mu.RLock()
+		for filePath, file := range session.Files {
+			if len(body.Paths) > 0 && !slices.Contains(body.Paths, filePath) {
+				continue
+			}
+			if file.Binary || file.Content == "" {
+				skipped = append(skipped, filePath)
+				continue
+			}
+			files = append(files, gist.File{Path: filePath, Content: file.Content})
+		}
+		for _, filePath := range body.Paths {
+			if _, ok := session.Files[filePath]; !ok {
+				skipped = append(skipped, filePath)
+			}
+		}
+		session.mu.RUnlock()
+		sort.Strings(skipped)
+
+		if len(files) == 0 {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "there are no text files to export", "skipped": skipped})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), hub.config.GistTimeout)
+		defer cancel()
+		created, err := hub.gists.Create(ctx, body.Token, body.Description, body.Public, files)
+		if err != nil {
+			log.Printf("Failed to export session %s to a gist: %v", session.ID, err)
+			c.JSON(gistStatus(err), gin.H{"error": "export failed: " + err.Error()})
+			return
+		}
+
+		log.Printf("Exported %d files of session %s to gist %s for %s", len(files), session.ID, created.ID, hub.requestUsername(c))
+		c.JSON(http.StatusCreated, gin.H{"id": created.ID, "url": created.URL, "exported": len(files), "skipped": skipped})
+	}
+}
+
+// handleImportGist seeds a new session with the files of the gist at
+// {"url"}, read with {"token"} if it's secret, and returns its ID. Files
+// named with escaped paths go in their folders.
+func handleImportGist(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hub.gistsEnabled(c) {
+			return
+		}
+
+		var body struct {
+			URL   string `json:"url"`
+			Token string `json:"token"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+		id, err := gist.ParseID(body.URL)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), hub.config.GistTimeout)
+		defer cancel()
+		source, err := hub.gists.Get(ctx, id, body.Token)
+		if err != nil {
+			log.Printf("Failed to read gist %s: %v", id, err)
+			c.JSON(gistStatus(err), gin.H{"error": "import failed: " + err.Error()})
+			return
+		}
+
+		files := make([]gitrepo.File, len(source.Files))
+		for i, file := range source.Files {
+			files[i] = gitrepo.File{Path: file.Path, Data: []byte(file.Content)}
+		}
+		session, imported, skipped, ok := hub.seedSession(c, files)
+		if !ok {
+			return
+		}
+
+		log.Printf("Seeded session %s with %d files of gist %s for %s", session.ID, len(imported), source.ID, hub.requestUsername(c))
+		c.JSON(http.StatusCreated, gin.H{
+			"sessionId": session.ID,
+			"gist":      gin.H{"id": source.ID, "url": source.URL, "owner": source.Owner},
+			"imported":  len(imported),
+			"skipped":   skipped,
+			"truncated": source.Truncated,
+		})
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/codecollab/collab-service/internal/gitrepo"
+	"github.com/codecollab/collab-service/internal/recording"
+	"github.com/gin-gonic/gin"
+)
+
+// GitSource is the repository a session's files were imported from, and
+// the commit of it they were last imported or pushed as. Tokens aren't
+// kept; each import and push brings its own.
+type GitSource struct {
+	URL    string `json:"url"`
+	Branch string `json:"branch"`
+	Commit string `json:"commit"`
+	// Paths are the files in the commit that are in the session too, so
+	// those deleted from the session are deleted from the repository
+	Paths      []string   `json:"paths,omitempty"`
+	ImportedBy string     `json:"importedBy"`
+	ImportedAt time.Time  `json:"importedAt"`
+	PushedBy   string     `json:"pushedBy,omitempty"`
+	PushedAt   *time.Time `json:"pushedAt,omitempty"`
+}
+
+// gitAuthorDomain is the domain of the email commits are made under when
+// the author gives none
+const gitAuthorDomain = "codecollab.invalid"
+
+// gitMessage tells a session about its repository, leaving out the paths,
+// which only pushes need
+func gitMessage(username string, source *GitSource) OutgoingMessage {
+	announced := *source
+	announced.Paths = nil
+	return OutgoingMessage{Type: "git-update", Username: username, Git: &announced}
+}
+
+// gitHosts are the hosts repositories may be imported from
+func (h *Hub) gitHosts() []string {
+	var hosts []string
+	for _, host := range strings.Split(h.config.GitHosts, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// gitStatus maps a failed import or push to its response status
+func gitStatus(err error) int {
+	switch {
+	case errors.Is(err, gitrepo.ErrAuth):
+		return http.StatusForbidden
+	case errors.Is(err, gitrepo.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, gitrepo.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, gitrepo.ErrNothingToCommit):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// handleGetGit returns the repository the session was imported from
+func handleGetGit(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.ownerSession(c, "manage the repository")
+		if !ok {
+			return
+		}
+
+		session.mu.RLock()
+		source := session.Git
+		session.mu.RUnlock()
+
+		if source == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "the session wasn't imported from a repository"})
+			return
+		}
+		c.JSON(http.StatusOK, source)
+	}
+}
+
+// handleImportGit clones {"url", "token", "branch"} and puts its files in
+// the session, over those with the same paths, binary ones as assets.
+// Those with invalid paths are skipped and listed.
+func handleImportGit(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.ownerSession(c, "import a repository")
+		if !ok {
+			return
+		}
+
+		var body struct {
+			URL    string `json:"url"`
+			Token  string `json:"token"`
+			Branch string `json:"branch"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+		repoURL, err := gitrepo.ParseURL(body.URL, hub.gitHosts())
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if body.Branch != "" && !gitrepo.ValidBranch(body.Branch) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid branch name"})
+			return
+		}
+
+		dir, err := os.MkdirTemp("", "codecollab-git-")
+		if err != nil {
+			log.Printf("Failed to make a directory to clone into: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to clone the repository"})
+			return
+		}
+		defer os.RemoveAll(dir)
+		ctx, cancel := context.WithTimeout(c.Request.Context(), hub.config.GitTimeout)
+		defer cancel()
+		remote := gitrepo.Remote{URL: repoURL, Token: body.Token}
+		commit, branch, err := gitrepo.Clone(ctx, remote, body.Branch, dir)
+		var files []gitrepo.File
+		if err == nil {
+			files, err = gitrepo.Files(dir)
+		}
+		if err != nil {
+			log.Printf("Failed to clone %s into session %s: %v", repoURL, session.ID, err)
+			c.JSON(gitStatus(err), gin.H{"error": "clone failed: " + err.Error()})
+			return
+		}
+
+		username := hub.requestUsername(c)
+		imported, skipped, err := hub.importFiles(session, files, username)
+		if err != nil {
+			c.JSON(http.StatusInsufficientStorage, gin.H{"error": err.Error()})
+			return
+		}
+
+		source := &GitSource{
+			URL:        repoURL,
+			Branch:     branch,
+			Commit:     commit,
+			ImportedBy: username,
+			ImportedAt: time.Now().UTC(),
+		}
+		session.mu.Lock()
+		// Assets aren't pushed, so they aren't deleted by pushes either
+		for _, filePath := range imported {
+			if file, ok := session.Files[filePath]; ok && !file.Binary {
+				source.Paths = append(source.Paths, filePath)
+			}
+		}
+		session.Git = source
+		session.mu.Unlock()
+		hub.schedulePersist(session.ID)
+		hub.broadcastToSession(session.ID, gitMessage(username, source))
+
+		log.Printf("Imported %d files of %s@%s into session %s for %s", len(imported), repoURL, commit, session.ID, username)
+		c.JSON(http.StatusOK, gin.H{"git": source, "imported": len(imported), "skipped": skipped})
+	}
+}
+
+// importFiles puts the files of a checkout or an archive in the session
+// and tells everyone. Binary files go to the blob store as assets, the way
+// uploads do. It returns the paths imported and those skipped, or why
+// nothing was.
+func (h *Hub) importFiles(session *Session, files []gitrepo.File, username string) (imported, skipped []string, err error) {
+	type document struct {
+		path, content string
+		// data is the content of a binary file, of contentType
+		data        []byte
+		contentType string
+	}
+	var documents []document
+	for _, file := range files {
+		filePath, err := cleanFilePath(file.Path)
+		contentType, binary := detectBinary(file.Data)
+		switch {
+		case err != nil || !binary && !utf8.Valid(file.Data):
+			skipped = append(skipped, file.Path)
+		case binary:
+			documents = append(documents, document{path: filePath, data: file.Data, contentType: contentType})
+		default:
+			documents = append(documents, document{path: filePath, content: string(file.Data)})
+		}
+	}
+
+	session.mu.Lock()
+	newFiles, growth := 0, 0
+	for _, doc := range documents {
+		size := len(doc.content)
+		if doc.data != nil {
+			size = len(doc.data)
+		}
+		if existing, ok := session.Files[doc.path]; ok {
+			growth += size - existing.size()
+		} else {
+			newFiles++
+			growth += size
+		}
+	}
+	if err := h.checkQuotaLocked(session, newFiles, growth); err != nil {
+		session.mu.Unlock()
+		return nil, nil, err
+	}
+
+	var created, changed []string
+	// treeChanged is set when assets were imported, or files turned from
+	// one kind into the other
+	treeChanged := false
+	revisions := make(map[string]int)
+	for _, doc := range documents {
+		file, existed := session.Files[doc.path]
+		if doc.data != nil {
+			key := blobKey(session.ID, doc.path)
+			if err := h.blobs.Put(key, doc.data); err != nil {
+				log.Printf("Failed to store blob for %s: %v", doc.path, err)
+				skipped = append(skipped, doc.path)
+				continue
+			}
+			if !existed {
+				file = newFile(doc.path)
+				session.Files[doc.path] = file
+				h.auditLocked(session, auditCreate, "", username, doc.path, nil)
+				h.recordLocked(session, recording.Event{Kind: recording.Create, Path: doc.path, Username: username})
+			}
+			file.Content, file.LineAuthors = "", nil
+			file.doc.Reset()
+			file.crdt, file.crdtPending = nil, nil
+			file.Binary, file.BlobKey, file.ContentType, file.BlobSize = true, key, doc.contentType, len(doc.data)
+			file.UpdatedAt = time.Now()
+			treeChanged = true
+			imported = append(imported, doc.path)
+			continue
+		}
+
+		content, _, _ := normalizeEdit(session.Settings, doc.content, true, h.config.InvalidUTF8Policy)
+		if existed && file.Binary {
+			if err := h.blobs.Delete(file.BlobKey); err != nil {
+				log.Printf("Failed to delete blob %s: %v", file.BlobKey, err)
+			}
+			file.Binary, file.BlobKey, file.ContentType, file.BlobSize = false, "", "", 0
+			existed, treeChanged = false, true
+		}
+		if !existed {
+			if file == nil {
+				file = newFile(doc.path)
+				session.Files[doc.path] = file
+			}
+			h.auditLocked(session, auditCreate, "", username, doc.path, nil)
+			h.recordLocked(session, recording.Event{Kind: recording.Create, Path: doc.path, Username: username})
+			created = append(created, doc.path)
+		} else if file.Content == content {
+			imported = append(imported, doc.path)
+			continue
+		}
+		h.recordChangeLocked(session, auditImport, "", username, file, content)
+		file.setContent(content, username)
+		file.UpdatedAt = time.Now()
+		revisions[doc.path] = file.doc.Revision()
+		changed = append(changed, doc.path)
+		imported = append(imported, doc.path)
+	}
+	session.mu.Unlock()
+
+	if len(created) > 0 || treeChanged {
+		h.broadcastFileTree(session.ID)
+	}
+	for _, filePath := range changed {
+		h.fileChanged(session.ID, filePath)
+		session.mu.RLock()
+		content := session.Files[filePath].Content
+		session.mu.RUnlock()
+		h.broadcastToReaders(session.ID, "", filePath, OutgoingMessage{
+			Type:     "code-update",
+			Username: username,
+			Path:     filePath,
+			Code:     content,
+			Revision: revisions[filePath],
+		})
+	}
+	return imported, skipped, nil
+}
+
+// handlePushGit commits the session's text files on top of the commit
+// they were imported or last pushed as, with {"message"}, and pushes it to
+// {"branch"}, the imported one by default, with {"token"}. A branch that
+// moved on since is left alone: the push is refused with 409.
+func handlePushGit(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.ownerSession(c, "push to the repository")
+		if !ok {
+			return
+		}
+
+		var body struct {
+			Token       string `json:"token"`
+			Message     string `json:"message"`
+			Branch      string `json:"branch"`
+			AuthorName  string `json:"authorName"`
+			AuthorEmail string `json:"authorEmail"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+		if strings.TrimSpace(body.Message) == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "a commit message is required"})
+			return
+		}
+		username := hub.requestUsername(c)
+		if body.AuthorName == "" {
+			body.AuthorName = username
+		}
+		if body.AuthorEmail == "" {
+			body.AuthorEmail = username + "@" + gitAuthorDomain
+		}
+
+		session.mu.RLock()
+		source := session.Git
+		commit := gitrepo.Commit{Message: body.Message, AuthorName: body.AuthorName, AuthorEmail: body.AuthorEmail}
+		var pushed []string
+		if source != nil {
+			commit.Base, commit.Branch = source.Commit, source.Branch
+			for filePath, file := range session.Files {
+				// Binary files aren't pushed, nor the empty file new sessions
+				// start with unless the repository has it
+				placeholder := filePath == defaultFilePath && file.Content == "" && !slices.Contains(source.Paths, filePath)
+				if file.Binary || placeholder {
+					continue
+				}
+				commit.Files = append(commit.Files, gitrepo.File{Path: filePath, Data: []byte(file.Content)})
+				pushed = append(pushed, filePath)
+			}
+			for _, filePath := range source.Paths {
+				if file, ok := session.Files[filePath]; !ok || file.Binary {
+					commit.Deleted = append(commit.Deleted, filePath)
+				}
+			}
+		}
+		session.mu.RUnlock()
+
+		if source == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "the session wasn't imported from a repository"})
+			return
+		}
+		if body.Branch != "" {
+			if !gitrepo.ValidBranch(body.Branch) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid branch name"})
+				return
+			}
+			commit.Branch = body.Branch
+		}
+
+		dir, err := os.MkdirTemp("", "codecollab-git-")
+		if err != nil {
+			log.Printf("Failed to make a directory to commit in: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to push"})
+			return
+		}
+		defer os.RemoveAll(dir)
+		ctx, cancel := context.WithTimeout(c.Request.Context(), hub.config.GitTimeout)
+		defer cancel()
+		sha, err := gitrepo.Push(ctx, gitrepo.Remote{URL: source.URL, Token: body.Token}, dir, commit)
+		if err != nil {
+			log.Printf("Failed to push session %s to %s %s: %v", session.ID, source.URL, commit.Branch, err)
+			c.JSON(gitStatus(err), gin.H{"error": "push failed: " + err.Error()})
+			return
+		}
+
+		slices.Sort(pushed)
+		now := time.Now().UTC()
+		updated := *source
+		updated.Branch, updated.Commit, updated.Paths = commit.Branch, sha, pushed
+		updated.PushedBy, updated.PushedAt = username, &now
+		session.mu.Lock()
+		// An import that finished meanwhile replaced what this built on
+		if session.Git == source {
+			session.Git = &updated
+		}
+		session.mu.Unlock()
+		hub.schedulePersist(session.ID)
+		hub.broadcastToSession(session.ID, gitMessage(username, &updated))
+
+		log.Printf("Pushed session %s to %s %s as %s for %s", session.ID, source.URL, commit.Branch, sha, username)
+		c.JSON(http.StatusOK, gin.H{"git": &updated, "commit": sha})
+	}
+}
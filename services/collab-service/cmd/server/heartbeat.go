@@ -0,0 +1,116 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// writeWait is how long a write to a connection may take
+const writeWait = 10 * time.Second
+
+// Participant statuses
+const (
+	StatusActive       = "active"
+	StatusIdle         = "idle"
+	StatusDisconnected = "disconnected"
+)
+
+// startHeartbeat makes the connection fail once it has answered nothing,
+// neither a message nor a pong, for PongTimeout
+func (c *Client) startHeartbeat(hub *Hub) {
+	if hub.config.PingInterval <= 0 {
+		return
+	}
+	c.Conn.SetReadDeadline(time.Now().Add(hub.config.PongTimeout))
+	c.Conn.SetPongHandler(func(string) error {
+		c.lastSeen.Store(time.Now().UnixNano())
+		return c.Conn.SetReadDeadline(time.Now().Add(hub.config.PongTimeout))
+	})
+}
+
+// heard records a message from the client, which counts as input
+func (h *Hub) heard(c *Client) {
+	now := time.Now()
+	c.lastSeen.Store(now.UnixNano())
+	c.lastInput.Store(now.UnixNano())
+	if h.config.PingInterval > 0 {
+		c.Conn.SetReadDeadline(now.Add(h.config.PongTimeout))
+	}
+
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+	session.mu.RLock()
+	returned := c.status != StatusActive
+	session.mu.RUnlock()
+	if returned {
+		h.sweepStatuses(session, now)
+	}
+}
+
+// statusAt is what c's status is at now
+func (h *Hub) statusAt(c *Client, now time.Time) string {
+	if h.config.PingInterval > 0 && now.Sub(time.Unix(0, c.lastSeen.Load())) > h.config.PingInterval*3/2 {
+		return StatusDisconnected
+	}
+	if h.config.ClientIdle > 0 && now.Sub(time.Unix(0, c.lastInput.Load())) > h.config.ClientIdle {
+		return StatusIdle
+	}
+	return StatusActive
+}
+
+// sweepStatuses updates the statuses of a session's clients, and sends
+// everyone the participants again if any changed
+func (h *Hub) sweepStatuses(session *Session, now time.Time) {
+	changed := false
+	session.mu.Lock()
+	for _, client := range session.Clients {
+		if status := h.statusAt(client, now); status != client.status {
+			client.status = status
+			changed = true
+		}
+	}
+	session.mu.Unlock()
+
+	if changed {
+		h.publishPresence(session)
+		h.sendParticipants(session)
+	}
+}
+
+// statusSweepInterval is how often client statuses are checked, at most
+const statusSweepInterval = 5 * time.Second
+
+// runStatuses moves participants between active, idle and disconnected as
+// time passes without input or heartbeats
+func (h *Hub) runStatuses() {
+	interval := statusSweepInterval
+	if h.config.ClientIdle > 0 {
+		interval = min(interval, h.config.ClientIdle/2)
+	}
+	if h.config.PingInterval > 0 {
+		interval = min(interval, h.config.PingInterval/2)
+	}
+	ticker := time.NewTicker(max(interval, 100*time.Millisecond))
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		h.mu.RLock()
+		sessions := make([]*Session, 0, len(h.sessions))
+		for _, session := range h.sessions {
+			sessions = append(sessions, session)
+		}
+		h.mu.RUnlock()
+
+		for _, session := range sessions {
+			h.sweepStatuses(session, now)
+		}
+	}
+}
+
+// ping sends a heartbeat the client answers with a pong
+func (c *Client) ping() error {
+	return c.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
+}
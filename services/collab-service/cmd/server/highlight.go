@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/codecollab/collab-service/internal/highlight"
+)
+
+// setHighlighting turns server-computed highlight tokens on or off for a
+// client. Enabling sends tokens for every text file the client can see.
+func (h *Hub) setHighlighting(c *Client, enabled bool) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	c.Highlight = enabled
+	var files []File
+	if enabled {
+		role := session.roleLocked(c)
+		for _, file := range session.Files {
+			if file.visibleTo(role) {
+				files = append(files, *file)
+			}
+		}
+	}
+	session.mu.Unlock()
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	for i := range files {
+		h.sendHighlights(c, &files[i])
+	}
+}
+
+// sendHighlights sends the highlight tokens of a file to one client
+func (h *Hub) sendHighlights(c *Client, file *File) {
+	language := fileLanguage(file)
+	if file.Binary || !highlight.Supported(language) {
+		return
+	}
+	h.sendToClient(c, OutgoingMessage{
+		Type:   "highlight-update",
+		Path:   file.Path,
+		Tokens: highlight.Tokenize(language, file.Content),
+	})
+}
+
+// broadcastHighlights sends fresh tokens for a file to every subscribed
+// client that can see it. Tokens are only computed if someone asked.
+func (h *Hub) broadcastHighlights(sessionID, filePath string) {
+	session, exists := h.getSession(sessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	file, ok := session.Files[filePath]
+	var subscribers []*Client
+	var snapshot File
+	if ok && !file.Binary && highlight.Supported(fileLanguage(file)) {
+		snapshot = *file
+		for _, client := range session.Clients {
+			if client.Highlight && file.visibleTo(session.roleLocked(client)) {
+				subscribers = append(subscribers, client)
+			}
+		}
+	}
+	session.mu.RUnlock()
+
+	if len(subscribers) == 0 {
+		return
+	}
+
+	outMsg := OutgoingMessage{
+		Type:   "highlight-update",
+		Path:   filePath,
+		Tokens: highlight.Tokenize(fileLanguage(&snapshot), snapshot.Content),
+	}
+	for _, client := range subscribers {
+		h.sendToClient(client, outMsg)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/codecollab/collab-service/internal/httprunner"
+)
+
+// runRequest sends an HTTP request for a participant and shares the
+// response with the session. The request comes from the message, or is
+// parsed from the .http file at filePath when the message doesn't carry one.
+func (h *Hub) runRequest(c *Client, filePath string, req *httprunner.Request) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	role := session.roleLocked(c)
+	var err error
+	var spec httprunner.Request
+	switch {
+	case role == RoleViewer:
+		err = fmt.Errorf("viewers cannot run requests")
+	case req != nil:
+		spec = *req
+		filePath = ""
+	default:
+		var file *File
+		file, err = session.visibleFileLocked(filePath, role)
+		if err == nil {
+			if file.Binary || !strings.EqualFold(path.Ext(file.Path), ".http") {
+				err = fmt.Errorf("requests can only be run from .http files")
+			} else {
+				spec, err = httprunner.Parse(file.Content)
+				filePath = file.Path
+			}
+		}
+	}
+	session.mu.RUnlock()
+
+	if err != nil {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Path: filePath, Error: err.Error()})
+		return
+	}
+
+	log.Printf("Client %s in session %s running %s %s", c.ID, c.SessionID, spec.Method, spec.URL)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), h.config.HTTPRunnerTimeout)
+		defer cancel()
+
+		resp, err := h.requests.Do(ctx, spec)
+		outMsg := OutgoingMessage{
+			Type:     "request-result",
+			UserID:   c.ID,
+			Username: c.Username,
+			Path:     filePath,
+			Request:  &spec,
+			Response: resp,
+		}
+		if err != nil {
+			outMsg.Error = err.Error()
+		}
+
+		if filePath != "" {
+			h.broadcastToReaders(c.SessionID, "", filePath, outMsg)
+		} else {
+			h.broadcastToSession(c.SessionID, outMsg)
+		}
+	}()
+}
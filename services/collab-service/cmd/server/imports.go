@@ -0,0 +1,349 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/codecollab/collab-service/internal/gitrepo"
+	"github.com/codecollab/collab-service/internal/resumable"
+	"github.com/gin-gonic/gin"
+)
+
+// Workspace archives are uploaded with the tus protocol, so that a large
+// one sent over a flaky connection resumes where it was cut off: the owner
+// creates an import with the archive's Upload-Length, PATCHes its bytes in
+// one or more parts from the Upload-Offset a HEAD reports, and once all
+// have arrived the zip is unpacked into the session's files.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+	// tusPart is the content type of the parts PATCHed
+	tusPart = "application/offset+octet-stream"
+)
+
+// importSweep is how often expired imports are removed
+const importSweep = 10 * time.Minute
+
+// errArchiveTooLarge is returned for an archive with more in it than a
+// workspace may hold
+var errArchiveTooLarge = errors.New("the archive's files are larger than the workspace limit")
+
+// tusHeaders describe the server's tus support
+func (h *Hub) tusHeaders(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", tusExtensions)
+	c.Header("Tus-Max-Size", strconv.Itoa(h.config.MaxImportBytes))
+}
+
+// importCaller returns the session of a tus request, responding instead
+// unless imports are enabled, the request speaks tusVersion and the caller
+// owns the session
+func (h *Hub) importCaller(c *gin.Context) (*Session, bool) {
+	c.Header("Tus-Resumable", tusVersion)
+	if h.imports == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "workspace imports are disabled"})
+		return nil, false
+	}
+	if c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "only version " + tusVersion + " of the tus protocol is supported"})
+		return nil, false
+	}
+	return h.ownerSession(c, "import an archive")
+}
+
+// sessionImport returns the import of the request, responding 404 unless
+// it is the caller's into session
+func (h *Hub) sessionImport(c *gin.Context, session *Session) (resumable.Upload, bool) {
+	upload, err := h.imports.Get(c.Param("importId"))
+	if err == nil && (upload.Session != session.ID || upload.Owner != h.requestUsername(c)) {
+		err = resumable.ErrNotFound
+	}
+	if errors.Is(err, resumable.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "import not found"})
+		return resumable.Upload{}, false
+	}
+	if err != nil {
+		log.Printf("Failed to read import %s: %v", c.Param("importId"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read the import"})
+		return resumable.Upload{}, false
+	}
+	return upload, true
+}
+
+// importHeaders describe how far an import is
+func importHeaders(c *gin.Context, upload resumable.Upload) {
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	c.Header("Upload-Expires", upload.Expires.Format(http.TimeFormat))
+	c.Header("Cache-Control", "no-store")
+}
+
+// handleImportOptions answers tus clients discovering what the server
+// supports
+func handleImportOptions(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if hub.imports == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "workspace imports are disabled"})
+			return
+		}
+		hub.tusHeaders(c)
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// handleCreateImport starts the import of an archive of Upload-Length
+// bytes, answering with the Location to send them to
+func handleCreateImport(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.importCaller(c)
+		if !ok {
+			return
+		}
+
+		length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+		if err != nil || length < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Length must be the archive's size in bytes"})
+			return
+		}
+		if length > int64(hub.config.MaxImportBytes) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("archives are limited to %d bytes", hub.config.MaxImportBytes)})
+			return
+		}
+
+		username := hub.requestUsername(c)
+		upload, err := hub.imports.Create(session.ID, username, length)
+		if err != nil {
+			log.Printf("Failed to start an import into session %s: %v", session.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start the import"})
+			return
+		}
+		log.Printf("%s started importing %d bytes into session %s as %s", username, length, session.ID, upload.ID)
+
+		c.Header("Location", "/sessions/"+url.PathEscape(session.ID)+"/imports/"+upload.ID)
+		importHeaders(c, upload)
+		c.Status(http.StatusCreated)
+	}
+}
+
+// handleImportOffset reports how much of an import has arrived, for the
+// client to resume from
+func handleImportOffset(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.importCaller(c)
+		if !ok {
+			return
+		}
+		upload, ok := hub.sessionImport(c, session)
+		if !ok {
+			return
+		}
+		importHeaders(c, upload)
+		c.Status(http.StatusOK)
+	}
+}
+
+// handleImportPart adds the bytes of an import from Upload-Offset on. The
+// last of them unpacks the archive into the session, answering which
+// files were imported and which skipped.
+func handleImportPart(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.importCaller(c)
+		if !ok {
+			return
+		}
+		if c.ContentType() != tusPart {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "parts must be sent as " + tusPart})
+			return
+		}
+		offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Offset must be where the part starts"})
+			return
+		}
+		upload, ok := hub.sessionImport(c, session)
+		if !ok {
+			return
+		}
+
+		upload.Offset, err = hub.imports.Append(upload.ID, offset, c.Request.Body)
+		c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		switch {
+		case errors.Is(err, resumable.ErrOffset), errors.Is(err, resumable.ErrBusy):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		case errors.Is(err, resumable.ErrNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "import not found"})
+			return
+		case err != nil:
+			// What arrived is kept; the client resumes from the offset
+			log.Printf("Import %s into session %s was cut off at %d bytes: %v", upload.ID, session.ID, upload.Offset, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "the part was cut off"})
+			return
+		}
+		if !upload.Complete() {
+			c.Status(http.StatusNoContent)
+			return
+		}
+		hub.finishImport(c, session, upload)
+	}
+}
+
+// handleDeleteImport abandons an import
+func handleDeleteImport(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.importCaller(c)
+		if !ok {
+			return
+		}
+		upload, ok := hub.sessionImport(c, session)
+		if !ok {
+			return
+		}
+		if err := hub.imports.Remove(upload.ID); err != nil {
+			log.Printf("Failed to remove import %s: %v", upload.ID, err)
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// finishImport unpacks an import whose every byte arrived into the
+// session, and removes it, whether or not that worked
+func (h *Hub) finishImport(c *gin.Context, session *Session, upload resumable.Upload) {
+	defer func() {
+		if err := h.imports.Remove(upload.ID); err != nil {
+			log.Printf("Failed to remove import %s: %v", upload.ID, err)
+		}
+	}()
+
+	file, err := h.imports.Open(upload.ID)
+	if err != nil {
+		log.Printf("Failed to open import %s: %v", upload.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read the import"})
+		return
+	}
+	defer file.Close()
+	archive, err := zip.NewReader(file, upload.Length)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "the upload is not a zip archive"})
+		return
+	}
+	files, skipped, err := archiveFiles(archive, h.config.MaxWorkspaceBytes)
+	if errors.Is(err, errArchiveTooLarge) {
+		c.JSON(http.StatusInsufficientStorage, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "the archive is corrupt: " + err.Error()})
+		return
+	}
+
+	imported, notImported, err := h.importFiles(session, files, upload.Owner)
+	if err != nil {
+		c.JSON(http.StatusInsufficientStorage, gin.H{"error": err.Error()})
+		return
+	}
+	skipped = append(skipped, notImported...)
+	slices.Sort(skipped)
+
+	log.Printf("Imported %d files of an archive into session %s for %s", len(imported), session.ID, upload.Owner)
+	c.JSON(http.StatusOK, gin.H{"imported": imported, "skipped": skipped})
+}
+
+// archiveFiles reads the files of a zip archive, leaving out folders,
+// symlinks, .git and macOS metadata, and taking the files out of the one
+// folder they are all in, if any. Text that isn't UTF-8 is skipped, and
+// more than limit bytes, if set, is refused.
+func archiveFiles(archive *zip.Reader, limit int) (files []gitrepo.File, skipped []string, err error) {
+	total := 0
+	for _, entry := range archive.File {
+		segments := strings.Split(entry.Name, "/")
+		if !entry.Mode().IsRegular() || slices.Contains(segments, ".git") || slices.Contains(segments, "__MACOSX") {
+			continue
+		}
+		if limit > 0 && entry.UncompressedSize64 > uint64(limit) {
+			skipped = append(skipped, entry.Name)
+			continue
+		}
+
+		reader, err := entry.Open()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", entry.Name, err)
+		}
+		var data []byte
+		if limit > 0 {
+			data, err = io.ReadAll(io.LimitReader(reader, int64(limit)+1))
+		} else {
+			data, err = io.ReadAll(reader)
+		}
+		reader.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", entry.Name, err)
+		}
+		if _, binary := detectBinary(data); !binary && !utf8.Valid(data) || limit > 0 && len(data) > limit {
+			skipped = append(skipped, entry.Name)
+			continue
+		}
+		if total += len(data); limit > 0 && total > limit {
+			return nil, nil, errArchiveTooLarge
+		}
+		files = append(files, gitrepo.File{Path: entry.Name, Data: data})
+	}
+
+	if folder := commonFolder(files); folder != "" {
+		for i := range files {
+			files[i].Path = strings.TrimPrefix(files[i].Path, folder)
+		}
+		for i := range skipped {
+			skipped[i] = strings.TrimPrefix(skipped[i], folder)
+		}
+	}
+	return files, skipped, nil
+}
+
+// commonFolder is the top folder every file is in, with its slash, or ""
+func commonFolder(files []gitrepo.File) string {
+	if len(files) == 0 {
+		return ""
+	}
+	folder, _, ok := strings.Cut(files[0].Path, "/")
+	if !ok {
+		return ""
+	}
+	for _, file := range files {
+		if !strings.HasPrefix(file.Path, folder+"/") {
+			return ""
+		}
+	}
+	return folder + "/"
+}
+
+// runImports removes the imports that expired before they were finished
+func (h *Hub) runImports() {
+	if h.imports == nil {
+		return
+	}
+	ticker := time.NewTicker(importSweep)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		removed, err := h.imports.Expire()
+		if err != nil {
+			log.Printf("Failed to remove expired imports: %v", err)
+		}
+		if removed > 0 {
+			log.Printf("Removed %d expired imports", removed)
+		}
+	}
+}
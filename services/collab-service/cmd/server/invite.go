@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Colleague is an organization member who shares their presence
+type Colleague struct {
+	Username     string     `json:"username"`
+	State        string     `json:"state"`
+	LastActiveAt *time.Time `json:"lastActiveAt,omitempty"`
+}
+
+// Invitation asks a colleague to join the inviter's session. Token is
+// sent as the join-session token to join as the invitee in one click.
+type Invitation struct {
+	From      string    `json:"from"`
+	SessionID string    `json:"sessionId"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// colleagues lists the online members of org, other than username, who
+// opted in to sharing their presence
+func (h *Hub) colleagues(username, org string) []Colleague {
+	colleagues := []Colleague{}
+	if org == "" {
+		return colleagues
+	}
+	for _, status := range h.presence.Online(org, username) {
+		if p, err := h.prefs.Get(status.Username); err != nil || !p.SharePresence {
+			continue
+		}
+		colleagues = append(colleagues, Colleague{
+			Username:     status.Username,
+			State:        status.State,
+			LastActiveAt: status.LastActiveAt,
+		})
+	}
+	return colleagues
+}
+
+// listColleagues sends a verified client its online colleagues
+func (h *Hub) listColleagues(c *Client) {
+	if c.presenceUser == "" || c.Org == "" {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: "seeing colleagues needs a verified account in an organization"})
+		return
+	}
+	h.sendToClient(c, OutgoingMessage{Type: "colleagues", Colleagues: h.colleagues(c.presenceUser, c.Org)})
+}
+
+// inviteUser sends a colleague, wherever they're connected, an invitation
+// with a join token for c's session
+func (h *Hub) inviteUser(c *Client, username string) {
+	if c.presenceUser == "" || c.Org == "" {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: "inviting needs a verified account in an organization"})
+		return
+	}
+	if username == c.presenceUser {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: "cannot invite yourself"})
+		return
+	}
+
+	h.mu.RLock()
+	var targets []*Client
+	for client, org := range h.online[username] {
+		if org == c.Org {
+			targets = append(targets, client)
+		}
+	}
+	h.mu.RUnlock()
+
+	// Users outside the organization look offline, so invitations can't be
+	// used to probe for them
+	if len(targets) == 0 {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Username: username, Error: fmt.Sprintf("%s is not online", username)})
+		return
+	}
+	for _, target := range targets {
+		if target.SessionID == c.SessionID {
+			h.sendToClient(c, OutgoingMessage{Type: "error", Username: username, Error: fmt.Sprintf("%s is already in this session", username)})
+			return
+		}
+	}
+	if !h.notificationAllowed(username, true) {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Username: username, Error: fmt.Sprintf("%s is not accepting invitations right now", username)})
+		return
+	}
+
+	expiresAt := time.Now().Add(h.config.InviteTTL).UTC()
+	token, err := signToken(h.config.JWTSecret, tokenClaims{
+		Subject: username,
+		Org:     c.Org,
+		Session: c.SessionID,
+		Expiry:  expiresAt.Unix(),
+	})
+	if err != nil {
+		log.Printf("Failed to sign invitation for %s: %v", username, err)
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: "failed to create invitation"})
+		return
+	}
+
+	invitation := &Invitation{From: c.presenceUser, SessionID: c.SessionID, Token: token, ExpiresAt: expiresAt}
+	for _, target := range targets {
+		h.sendToClient(target, OutgoingMessage{Type: "invitation", Invitation: invitation})
+	}
+	log.Printf("%s invited %s to session %s", c.presenceUser, username, c.SessionID)
+	h.sendToClient(c, OutgoingMessage{Type: "invite-sent", Username: username})
+}
+
+// handleListColleagues returns the caller's online colleagues
+func handleListColleagues(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := hub.requestClaims(c)
+		if claims == nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "a valid token is required"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"colleagues": hub.colleagues(claims.Subject, claims.Org)})
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/codecollab/collab-service/internal/execution"
+	"github.com/codecollab/collab-service/internal/languages"
+)
+
+// workspaceConfigPath is the workspace file that overrides the language
+// registry for a session
+const workspaceConfigPath = ".codecollab.yml"
+
+// fileLanguageLocked is the name of the language a path is detected as,
+// or the session's language, which may be empty, if none. A broken
+// workspace config still leaves the built-in languages. Caller must hold
+// session.mu for writing.
+func (h *Hub) fileLanguageLocked(s *Session, filePath string) string {
+	registry, err := h.languagesLocked(s)
+	if err != nil {
+		registry = h.languages
+	}
+	if lang, ok := registry.Detect(filePath); ok {
+		return lang.Name
+	}
+	return s.Language
+}
+
+// languagesLocked returns the session's language registry: the built-in
+// one with the workspace config applied. The parsed config is kept until
+// the file changes. Caller must hold session.mu for writing.
+func (h *Hub) languagesLocked(s *Session) (*languages.Registry, error) {
+	file, ok := s.Files[workspaceConfigPath]
+	if !ok || file.Binary {
+		return h.languages, nil
+	}
+	if s.langRegistry != nil && s.langSource == file.Content {
+		return s.langRegistry, nil
+	}
+	if s.langErr != nil && s.langSource == file.Content {
+		return nil, s.langErr
+	}
+
+	s.langSource = file.Content
+	s.langRegistry, s.langErr = h.languages.Override([]byte(file.Content), int(h.config.ExecutionMaxTimeout.Seconds()))
+	return s.langRegistry, s.langErr
+}
+
+// resolveLanguageLocked finds the language to run a file with: by
+// extension, or the given language when the extension is unknown. Caller
+// must hold session.mu for writing.
+func (h *Hub) resolveLanguageLocked(s *Session, file *File, language string) (*languages.Registry, *languages.Language, error) {
+	registry, err := h.languagesLocked(s)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", workspaceConfigPath, err)
+	}
+	if lang, ok := registry.Detect(file.Path); ok {
+		return registry, lang, nil
+	}
+	if language == "" {
+		return nil, nil, fmt.Errorf("language is required to run %s", file.Path)
+	}
+	lang, ok := registry.Lookup(language)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported language: %s", language)
+	}
+	return registry, lang, nil
+}
+
+// buildRequest turns a resolved build into an execution request
+func buildRequest(build languages.Build, code string, env map[string]string) execution.Request {
+	return execution.Request{
+		Code:     code,
+		Language: build.Language,
+		Env:      env,
+		File:     build.File,
+		Compile:  build.Compile,
+		Run:      build.Run,
+		Timeout:  build.Resources.Timeout,
+		MemoryMB: build.Resources.MemoryMB,
+	}
+}
+
+// workspaceConfigMessageLocked describes the session's workspace config as seen
+// by role, or returns false when there is none the role can read. Caller
+// must hold session.mu for writing.
+func (h *Hub) workspaceConfigMessageLocked(s *Session, role Role) (OutgoingMessage, bool) {
+	file, ok := s.Files[workspaceConfigPath]
+	if !ok || !file.visibleTo(role) {
+		return OutgoingMessage{}, false
+	}
+	outMsg := OutgoingMessage{Type: "workspace-config", Path: workspaceConfigPath}
+	registry, err := h.languagesLocked(s)
+	if err != nil {
+		outMsg.Error = err.Error()
+	} else {
+		outMsg.Languages = registry.Languages()
+		outMsg.Tasks = registry.Tasks()
+	}
+	return outMsg, true
+}
+
+// sendWorkspaceConfig tells a joining client about the workspace config
+func (h *Hub) sendWorkspaceConfig(c *Client) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	outMsg, ok := h.workspaceConfigMessageLocked(session, session.roleLocked(c))
+	session.mu.Unlock()
+
+	if ok {
+		h.sendToClient(c, outMsg)
+	}
+}
+
+// scheduleConfigCheck validates the workspace config once it stops
+// changing and tells its readers whether it is valid, along with the
+// languages and tasks it defines
+func (h *Hub) scheduleConfigCheck(sessionID, filePath string) {
+	if filePath != workspaceConfigPath {
+		return
+	}
+	session, exists := h.getSession(sessionID)
+	if !exists {
+		return
+	}
+
+	h.debounce(session, "config:"+filePath, h.config.OutlineDebounce, func() {
+		session.mu.Lock()
+		outMsg, ok := h.workspaceConfigMessageLocked(session, RoleOwner)
+		session.mu.Unlock()
+
+		if ok {
+			h.broadcastToReaders(sessionID, "", filePath, outMsg)
+		}
+	})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// shedRetryAfter is how many seconds a connection turned away is told to
+// wait before trying this instance again
+const shedRetryAfter = 5
+
+// Load shedding: an instance with MaxConnections connections or
+// MaxSessions sessions open turns new ones away, answering 503 and that
+// another instance may take them, instead of slowing down everyone it
+// already serves. Joining a session that is open here takes no new
+// session, but a session with MaxSessionClients participants here is
+// full, which another instance doesn't change. The caps are checked
+// before upgrading, so connections racing in at once may land a few over.
+
+// Shed reasons
+const (
+	shedConnections    = "connections"
+	shedSessions       = "sessions"
+	shedSessionClients = "session-clients"
+)
+
+// LoadStats are the connections an instance serves and those it turned
+// away, by reason
+type LoadStats struct {
+	Connections int64            `json:"connections"`
+	Sessions    int              `json:"sessions"`
+	Limits      map[string]int   `json:"limits"`
+	Shed        map[string]int64 `json:"shed"`
+}
+
+// shedCounts counts the connections turned away, by reason
+type shedCounts struct {
+	connections    atomic.Int64
+	sessions       atomic.Int64
+	sessionClients atomic.Int64
+}
+
+// overCapacity returns why a new connection to sessionID is turned away,
+// and whether another instance might take it, or "" if it isn't
+func (h *Hub) overCapacity(sessionID string) (reason string, elsewhere bool) {
+	if limit := h.config.MaxConnections; limit > 0 && h.connections.Load() >= int64(limit) {
+		h.shed.connections.Add(1)
+		return shedConnections, true
+	}
+	h.mu.RLock()
+	session, open := h.sessions[sessionID]
+	sessions := len(h.sessions)
+	h.mu.RUnlock()
+	if !open {
+		if limit := h.config.MaxSessions; limit > 0 && sessions >= limit {
+			h.shed.sessions.Add(1)
+			return shedSessions, true
+		}
+		return "", false
+	}
+	if limit := h.config.MaxSessionClients; limit > 0 {
+		session.mu.RLock()
+		clients := len(session.Clients)
+		session.mu.RUnlock()
+		if clients >= limit {
+			h.shed.sessionClients.Add(1)
+			return shedSessionClients, false
+		}
+	}
+	return "", false
+}
+
+// admitting reports whether there is room for a new connection to
+// sessionID, responding 503 with why if there isn't
+func (h *Hub) admitting(c *gin.Context, sessionID string) bool {
+	reason, elsewhere := h.overCapacity(sessionID)
+	if reason == "" {
+		return true
+	}
+	message := "this server has all the connections it can take"
+	switch reason {
+	case shedSessions:
+		message = "this server has all the sessions it can take"
+	case shedSessionClients:
+		message = "the session has all the participants it can take"
+	}
+	c.Header("Retry-After", strconv.Itoa(shedRetryAfter))
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"error":          message,
+		"reason":         reason,
+		"tryAnotherNode": elsewhere,
+		"retryAfter":     shedRetryAfter,
+	})
+	return false
+}
+
+// loadStats reports the instance's load for /health
+func (h *Hub) loadStats() LoadStats {
+	h.mu.RLock()
+	sessions := len(h.sessions)
+	h.mu.RUnlock()
+	return LoadStats{
+		Connections: h.connections.Load(),
+		Sessions:    sessions,
+		Limits: map[string]int{
+			shedConnections:    h.config.MaxConnections,
+			shedSessions:       h.config.MaxSessions,
+			shedSessionClients: h.config.MaxSessionClients,
+		},
+		Shed: map[string]int64{
+			shedConnections:    h.shed.connections.Load(),
+			shedSessions:       h.shed.sessions.Load(),
+			shedSessionClients: h.shed.sessionClients.Load(),
+		},
+	}
+}
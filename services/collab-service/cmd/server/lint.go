@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/codecollab/collab-service/internal/lint"
+)
+
+// lintLanguage returns the language a file is checked as
+func lintLanguage(file *File) string {
+	if format := lint.FormatFromPath(file.Path); format != "" {
+		return format
+	}
+	return fileLanguage(file)
+}
+
+// lintMessage checks a file and describes what was found. The content is
+// a string, so it can be checked after the session's lock is released.
+func lintMessage(filePath, language, content string) OutgoingMessage {
+	diagnostics, _ := json.Marshal(lint.Check(language, content))
+	return OutgoingMessage{
+		Type:        "diagnostics-update",
+		Path:        filePath,
+		Diagnostics: diagnostics,
+	}
+}
+
+// scheduleLint debounces checking a file and broadcasting what was found
+// to everyone who can see it, so they all see the same problems
+func (h *Hub) scheduleLint(sessionID, filePath string) {
+	session, exists := h.getSession(sessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	file, ok := session.Files[filePath]
+	supported := ok && !file.Binary && lint.Supported(lintLanguage(file))
+	session.mu.RUnlock()
+	if !supported {
+		return
+	}
+
+	h.debounce(session, "lint:"+filePath, h.config.LintDebounce, func() {
+		session.mu.RLock()
+		file, ok := session.Files[filePath]
+		var language, content string
+		if ok {
+			language, content = lintLanguage(file), file.Content
+		}
+		session.mu.RUnlock()
+
+		if ok {
+			h.broadcastToReaders(sessionID, "", filePath, lintMessage(filePath, language, content))
+		}
+	})
+}
+
+// sendLint sends what checking a file finds to one client
+func (h *Hub) sendLint(c *Client, file *File) {
+	if file.Binary || !lint.Supported(lintLanguage(file)) {
+		return
+	}
+	h.sendToClient(c, lintMessage(file.Path, lintLanguage(file), file.Content))
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/codecollab/collab-service/internal/listquery"
+	"github.com/gin-gonic/gin"
+)
+
+// listQuery reads the page a list request asks for, answering one it
+// can't make sense of with a 400
+func listQuery(c *gin.Context, spec listquery.Spec) (listquery.Query, bool) {
+	q, err := listquery.Parse(c.Request.URL.Query(), spec)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return listquery.Query{}, false
+	}
+	return q, true
+}
+
+// listPage answers a list request with a page of what it lists, under
+// name, and the cursor of the page after it if there is one
+func listPage(c *gin.Context, name string, page any, next string) {
+	response := gin.H{name: page}
+	if next != "" {
+		response["nextCursor"] = next
+	}
+	c.JSON(http.StatusOK, response)
+}
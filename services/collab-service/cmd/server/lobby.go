@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/i18n"
+	"github.com/codecollab/collab-service/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+// lobbyPrefix starts the session ID of each organization's lobby, a chat
+// room that stays open whether or not anyone is in it
+const lobbyPrefix = "lobby:"
+
+// lobbyMessages are the messages a lobby connection may send: it has no
+// files, only chat
+var lobbyMessages = map[string]bool{
+	"heartbeat":               true,
+	"ack":                     true,
+	"resend":                  true,
+	"chat":                    true,
+	"chat-message":            true,
+	"typing":                  true,
+	"edit-chat":               true,
+	"delete-chat":             true,
+	"get-thread":              true,
+	"set-thread-subscription": true,
+	"mark-read":               true,
+	"read-receipts":           true,
+}
+
+func lobbyID(org string) string {
+	return lobbyPrefix + org
+}
+
+func isLobby(sessionID string) bool {
+	return strings.HasPrefix(sessionID, lobbyPrefix)
+}
+
+// openLobby returns an organization's lobby, opening it with the chat
+// that was saved of it the first time
+func (h *Hub) openLobby(org string) *Session {
+	if session, exists := h.getSession(lobbyID(org)); exists {
+		return session
+	}
+	saved := h.loadLobby(org)
+
+	session := h.getOrCreateSession(lobbyID(org))
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.Lobby {
+		return session
+	}
+	session.Lobby = true
+	session.Org = org
+	session.Files = make(map[string]*File)
+	if saved != nil {
+		var chat []*ChatMessage
+		if err := json.Unmarshal(saved.Chat, &chat); err != nil {
+			log.Printf("Lobby of %s: saved chat not restored: %v", org, err)
+		} else {
+			session.Chat = chat
+			session.nextChatID = saved.NextChatID
+		}
+	}
+	return session
+}
+
+// loadLobby finds what was kept of an organization's lobby, if anything
+func (h *Hub) loadLobby(org string) *store.Lobby {
+	if h.store == nil {
+		return nil
+	}
+	if queued, ok := h.queuedLobby(org); ok {
+		return queued
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+	defer cancel()
+	saved, err := h.store.LoadLobby(ctx, org)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			log.Printf("Failed to load the lobby of %s: %v", org, err)
+		}
+		return nil
+	}
+	return saved
+}
+
+// chatChanged saves the chat of a lobby once it has gone unchanged for
+// PersistDebounce. The chat of code sessions is saved with the rest.
+func (h *Hub) chatChanged(session *Session) {
+	if h.store == nil {
+		return
+	}
+	if !isLobby(session.ID) {
+		h.schedulePersist(session.ID)
+		return
+	}
+	h.debounce(session, "lobby", h.config.PersistDebounce, func() {
+		h.saveLobby(session)
+	})
+}
+
+// saveLobby saves the chat of a lobby
+func (h *Hub) saveLobby(session *Session) {
+	session.mu.RLock()
+	chat, err := json.Marshal(session.Chat)
+	snapshot := &store.Lobby{Org: session.Org, Chat: chat, NextChatID: session.nextChatID, UpdatedAt: time.Now().UTC()}
+	session.mu.RUnlock()
+	if err != nil {
+		log.Printf("Error marshaling the lobby chat of %s: %v", session.Org, err)
+		return
+	}
+	h.storeLobby(snapshot)
+}
+
+// storeLobby saves a snapshot of a lobby, or keeps it to retry if that
+// fails, and reports whether it was saved
+func (h *Hub) storeLobby(snapshot *store.Lobby) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+	defer cancel()
+	if err := h.store.SaveLobby(ctx, snapshot); err != nil {
+		log.Printf("Failed to save the lobby of %s, to be retried: %v", snapshot.Org, err)
+		h.queueLobbySave(snapshot)
+		return false
+	}
+	h.lobbySaveDone(snapshot)
+	return true
+}
+
+// allowedInLobby reports whether a lobby connection may send a message,
+// telling it if not
+func (h *Hub) allowedInLobby(c *Client, msgType string) bool {
+	if lobbyMessages[msgType] {
+		return true
+	}
+	h.sendToClient(c, OutgoingMessage{Type: "error", Error: fmt.Sprintf("not available in the lobby: %s", msgType)})
+	return false
+}
+
+// handleLobby connects a verified user to their organization's lobby. The
+// token comes in the token parameter, as browsers can't set headers on
+// WebSocket requests, or as a bearer token.
+func handleLobby(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.Query("token")
+		if token == "" {
+			token = strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		}
+		claims, err := hub.verifyToken(token)
+		if err != nil || claims.Session != "" || claims.URL != "" || claims.Org == "" || !claims.allows(scopeSessionsRead) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "the lobby needs a verified token with an organization"})
+			return
+		}
+		if !hub.accepting(c) || !hub.admitting(c, lobbyID(claims.Org)) {
+			return
+		}
+
+		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			log.Printf("Failed to upgrade connection: %v", err)
+			return
+		}
+		session := hub.openLobby(claims.Org)
+		locale := hub.catalogs.Negotiate(append([]string{c.Query("locale")}, i18n.ParseAcceptLanguage(c.GetHeader("Accept-Language"))...)...)
+		client := newClient(hub, conn, session.ID, locale)
+		client.msgpack = conn.Subprotocol() == subprotocolMessagePack
+		client.Username = claims.Subject
+		client.Org = claims.Org
+		client.token = claims
+		client.Role = RoleEditor
+		client.lobby = true
+		client.userAgent, client.addr = c.Request.UserAgent(), c.ClientIP()
+
+		hub.register <- client
+		go client.writePump(hub)
+		go client.readPump(hub)
+	}
+}
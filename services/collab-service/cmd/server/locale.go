@@ -0,0 +1,45 @@
+package main
+
+import (
+	"github.com/codecollab/collab-service/internal/i18n"
+)
+
+// localize translates the server-generated text of a message into locale
+func (h *Hub) localize(outMsg *OutgoingMessage, locale string) {
+	if locale == "" || locale == i18n.Default {
+		return
+	}
+	outMsg.Error = h.catalogs.Translate(locale, outMsg.Error)
+	if len(outMsg.Warnings) > 0 {
+		warnings := make([]EditWarning, len(outMsg.Warnings))
+		for i, warning := range outMsg.Warnings {
+			warning.Message = h.catalogs.Translate(locale, warning.Message)
+			warnings[i] = warning
+		}
+		outMsg.Warnings = warnings
+	}
+	if len(outMsg.Summaries) > 0 {
+		summaries := make([]ActivitySummary, len(outMsg.Summaries))
+		for i, summary := range outMsg.Summaries {
+			summary.Text = h.catalogs.Translate(locale, summary.Text)
+			summaries[i] = summary
+		}
+		outMsg.Summaries = summaries
+	}
+}
+
+// setLocale switches the language a client gets server-generated text in
+// to the supported locale closest to the one it asked for
+func (h *Hub) setLocale(c *Client, requested string) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	locale := h.catalogs.Negotiate(requested)
+	session.mu.Lock()
+	c.Locale = locale
+	session.mu.Unlock()
+
+	h.sendToClient(c, OutgoingMessage{Type: "locale", Locale: locale})
+}
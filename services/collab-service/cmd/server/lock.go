@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"log"
+)
+
+var errSessionLocked = errors.New("the session is locked; only the owner can change files")
+
+// writableLocked reports whether role may change the workspace, which only
+// the owner may do while the session is locked. Caller must hold
+// session.mu.
+func (s *Session) writableLocked(role Role) error {
+	if s.Locked && role != RoleOwner {
+		return errSessionLocked
+	}
+	return nil
+}
+
+// setLock locks or unlocks the session's files and tells everyone,
+// reporting whether that changed anything
+func (h *Hub) setLock(session *Session, locked bool, by string) bool {
+	session.mu.Lock()
+	changed := session.Locked != locked
+	session.Locked = locked
+	session.mu.Unlock()
+
+	if changed {
+		h.announceLock(session, locked, by)
+	}
+	return changed
+}
+
+// announceLock tells the session it was locked or unlocked
+func (h *Hub) announceLock(session *Session, locked bool, by string) {
+	log.Printf("Session %s locked=%t by %s", session.ID, locked, by)
+	h.broadcastToSession(session.ID, OutgoingMessage{Type: "session-lock", Enabled: locked, Username: by})
+	h.broadcastSessionSettings(session, by)
+}
+
+func (h *Hub) sendLock(c *Client) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	locked := session.Locked
+	session.mu.RUnlock()
+
+	if locked {
+		h.sendToClient(c, OutgoingMessage{Type: "session-lock", Enabled: true})
+	}
+}
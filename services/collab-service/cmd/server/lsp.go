@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/codecollab/collab-service/internal/lsp"
+)
+
+// Each session gets its own language server for each language its
+// participants ask about, started by the first request. The server works
+// on a copy of the session's text files in a workspace directory of the
+// session's own, kept up to date as they change, and its documents are
+// synced in full after every change, so whoever asks sees the same
+// answers. Requests are the read-only ones in lspMethods; the diagnostics
+// the server publishes go to everyone who can see the file. Servers stop
+// when the session closes.
+
+// lspMethods are the requests participants may send language servers.
+// Those under textDocument/ are about the request's path.
+var lspMethods = map[string]bool{
+	"textDocument/completion":        true,
+	"textDocument/hover":             true,
+	"textDocument/signatureHelp":     true,
+	"textDocument/definition":        true,
+	"textDocument/typeDefinition":    true,
+	"textDocument/implementation":    true,
+	"textDocument/references":        true,
+	"textDocument/documentHighlight": true,
+	"textDocument/documentSymbol":    true,
+	"textDocument/formatting":        true,
+	"completionItem/resolve":         true,
+}
+
+// errNoLanguageServers is sent to whoever asks a language server something
+// of a server running none
+const errNoLanguageServers = "language servers are not enabled"
+
+// languageServer is one of a session's language servers. ready is closed
+// once it started, or failed to, in err.
+type languageServer struct {
+	language string
+	dir      string
+	ready    chan struct{}
+	conn     *lsp.Conn
+	err      error
+
+	// mu orders what is sent about documents; versions are those open on
+	// the server, with the version last sent
+	mu       sync.Mutex
+	versions map[string]int
+}
+
+// parseLanguageServers reads a list like "go=gopls,python=pyright-langserver
+// --stdio" of the command that serves each language
+func parseLanguageServers(spec string) (map[string][]string, error) {
+	commands := make(map[string][]string)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		language, command, ok := strings.Cut(entry, "=")
+		fields := strings.Fields(command)
+		if !ok || language == "" || len(fields) == 0 {
+			return nil, fmt.Errorf("invalid language server %q, expected language=command", entry)
+		}
+		commands[strings.TrimSpace(language)] = fields
+	}
+	return commands, nil
+}
+
+// makeLSPDir makes a directory for a session's language servers to keep
+// its files in
+func (h *Hub) makeLSPDir() (string, error) {
+	if err := os.MkdirAll(h.config.LSPDir, 0o700); err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(h.config.LSPDir, "session-")
+}
+
+// workspacePath returns the session path of a file URI in dir, if it is
+// in dir
+func workspacePath(uri, dir string) (string, bool) {
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Scheme != "file" {
+		return "", false
+	}
+	rel, err := filepath.Rel(dir, filepath.FromSlash(parsed.Path))
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// sessionPaths replaces the URIs of files in dir within a result with
+// their session paths
+func sessionPaths(result json.RawMessage, dir string) json.RawMessage {
+	var value any
+	if len(result) == 0 || json.Unmarshal(result, &value) != nil {
+		return result
+	}
+	var walk func(any) any
+	walk = func(v any) any {
+		switch v := v.(type) {
+		case map[string]any:
+			for key, item := range v {
+				v[key] = walk(item)
+			}
+		case []any:
+			for i, item := range v {
+				v[i] = walk(item)
+			}
+		case string:
+			if path, ok := workspacePath(v, dir); ok {
+				return path
+			}
+		}
+		return v
+	}
+	data, err := json.Marshal(walk(value))
+	if err != nil {
+		return result
+	}
+	return data
+}
+
+// writeWorkspaceFile copies a session file into dir
+func writeWorkspaceFile(dir, filePath, content string) error {
+	name := filepath.FromSlash(filePath)
+	if !filepath.IsLocal(name) {
+		return fmt.Errorf("file outside the workspace: %s", filePath)
+	}
+	target := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(target), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(target, []byte(content), 0o600)
+}
+
+// languageServer returns the session's language server for language,
+// starting it if it isn't running
+func (h *Hub) languageServer(ctx context.Context, session *Session, language string) (*languageServer, error) {
+	command, ok := h.lspCommands[language]
+	if !ok {
+		return nil, errors.New("there is no language server for this file")
+	}
+
+	session.mu.Lock()
+	if session.lspClosed {
+		session.mu.Unlock()
+		return nil, errors.New("session closed")
+	}
+	if session.lspDir == "" {
+		dir, err := h.makeLSPDir()
+		if err != nil {
+			session.mu.Unlock()
+			log.Printf("Failed to make a workspace for the language servers of session %s: %v", session.ID, err)
+			return nil, errors.New("the language server is not available")
+		}
+		session.lspDir = dir
+	}
+	server, running := session.languageServers[language]
+	if !running {
+		server = &languageServer{
+			language: language,
+			dir:      session.lspDir,
+			ready:    make(chan struct{}),
+			versions: make(map[string]int),
+		}
+		if session.languageServers == nil {
+			session.languageServers = make(map[string]*languageServer)
+		}
+		session.languageServers[language] = server
+	}
+	session.mu.Unlock()
+
+	if !running {
+		h.startLanguageServer(session, server, command)
+	}
+	select {
+	case <-server.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if server.err != nil {
+		return nil, server.err
+	}
+	return server, nil
+}
+
+// startLanguageServer copies the session's files to its workspace and
+// starts the server there, opening the documents in its language
+func (h *Hub) startLanguageServer(session *Session, server *languageServer, command []string) {
+	var docs []string
+	session.mu.Lock()
+	for _, file := range session.Files {
+		if file.Binary {
+			continue
+		}
+		if err := writeWorkspaceFile(server.dir, file.Path, file.Content); err != nil {
+			log.Printf("Failed to copy %s of session %s for its language server: %v", file.Path, session.ID, err)
+			continue
+		}
+		if h.fileLanguageLocked(session, file.Path) == server.language {
+			docs = append(docs, file.Path)
+		}
+	}
+	session.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.LSPTimeout)
+	defer cancel()
+	conn, err := lsp.Start(ctx, command, server.dir, func(method string, params json.RawMessage) {
+		if method == "textDocument/publishDiagnostics" {
+			h.publishDiagnostics(session, server, params)
+		}
+	})
+	if err != nil {
+		log.Printf("Failed to start the %s language server of session %s: %v", server.language, session.ID, err)
+		server.err = fmt.Errorf("the language server is not available: %s", command[0])
+		session.mu.Lock()
+		if session.languageServers[server.language] == server {
+			delete(session.languageServers, server.language)
+		}
+		session.mu.Unlock()
+		close(server.ready)
+		return
+	}
+	server.conn = conn
+	log.Printf("Started the %s language server of session %s", server.language, session.ID)
+
+	// Changes from now on are synced as they happen; the documents are
+	// opened with whatever content they have by then
+	close(server.ready)
+	for _, filePath := range docs {
+		h.syncDocument(session, server, filePath)
+	}
+
+	go func() {
+		<-conn.Done()
+		session.mu.Lock()
+		if session.languageServers[server.language] == server {
+			delete(session.languageServers, server.language)
+			log.Printf("The %s language server of session %s exited", server.language, session.ID)
+		}
+		session.mu.Unlock()
+	}()
+}
+
+// open sends the server a document it doesn't have open yet. Caller must
+// hold server.mu.
+func (s *languageServer) open(filePath, content string) {
+	s.versions[filePath] = 1
+	s.conn.Notify("textDocument/didOpen", map[string]any{
+		"textDocument": map[string]any{
+			"uri":        lsp.URI(filepath.Join(s.dir, filepath.FromSlash(filePath))),
+			"languageId": s.language,
+			"version":    1,
+			"text":       content,
+		},
+	})
+}
+
+// syncDocument sends the server a document's content, opening it if it
+// isn't yet
+func (h *Hub) syncDocument(session *Session, server *languageServer, filePath string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	session.mu.RLock()
+	file, ok := session.Files[filePath]
+	ok = ok && !file.Binary
+	var content string
+	if ok {
+		content = file.Content
+	}
+	session.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	version, open := server.versions[filePath]
+	if !open {
+		server.open(filePath, content)
+		return
+	}
+	server.versions[filePath] = version + 1
+	server.conn.Notify("textDocument/didChange", map[string]any{
+		"textDocument":   map[string]any{"uri": lsp.URI(filepath.Join(server.dir, filepath.FromSlash(filePath))), "version": version + 1},
+		"contentChanges": []map[string]string{{"text": content}},
+	})
+}
+
+// syncLanguageServer updates the language servers' copy of a file and
+// brings the one for its language, if it is running, up to date with it
+func (h *Hub) syncLanguageServer(sessionID, filePath string) {
+	session, exists := h.getSession(sessionID)
+	if !exists {
+		return
+	}
+	session.mu.Lock()
+	if session.lspDir == "" {
+		session.mu.Unlock()
+		return
+	}
+	if file, ok := session.Files[filePath]; ok && !file.Binary {
+		if err := writeWorkspaceFile(session.lspDir, filePath, file.Content); err != nil {
+			log.Printf("Failed to copy %s of session %s for its language servers: %v", filePath, session.ID, err)
+		}
+	}
+	server := session.languageServers[h.fileLanguageLocked(session, filePath)]
+	session.mu.Unlock()
+	if server == nil {
+		return
+	}
+	select {
+	case <-server.ready:
+	default:
+		// It opens the file once it has started
+		return
+	}
+	if server.err == nil {
+		h.syncDocument(session, server, filePath)
+	}
+}
+
+// publishDiagnostics keeps a server's diagnostics for a file and sends
+// them to everyone who can see it
+func (h *Hub) publishDiagnostics(session *Session, server *languageServer, params json.RawMessage) {
+	var published struct {
+		URI         string          `json:"uri"`
+		Diagnostics json.RawMessage `json:"diagnostics"`
+	}
+	if err := json.Unmarshal(params, &published); err != nil {
+		return
+	}
+	filePath, ok := workspacePath(published.URI, server.dir)
+	if !ok {
+		return
+	}
+	diagnostics := sessionPaths(published.Diagnostics, server.dir)
+
+	session.mu.Lock()
+	if _, exists := session.Files[filePath]; !exists {
+		session.mu.Unlock()
+		return
+	}
+	if session.diagnostics == nil {
+		session.diagnostics = make(map[string]json.RawMessage)
+	}
+	session.diagnostics[filePath] = diagnostics
+	session.mu.Unlock()
+
+	h.broadcastToReaders(session.ID, "", filePath, OutgoingMessage{
+		Type:        "lsp-diagnostics",
+		Path:        filePath,
+		Diagnostics: diagnostics,
+	})
+}
+
+// sendDiagnostics sends a client the latest diagnostics of the files it
+// can see
+func (h *Hub) sendDiagnostics(c *Client) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+	session.mu.RLock()
+	role := session.roleLocked(c)
+	var diagnostics []OutgoingMessage
+	for filePath, published := range session.diagnostics {
+		if file, ok := session.Files[filePath]; ok && file.visibleTo(role) {
+			diagnostics = append(diagnostics, OutgoingMessage{Type: "lsp-diagnostics", Path: filePath, Diagnostics: published})
+		}
+	}
+	session.mu.RUnlock()
+
+	for _, outMsg := range diagnostics {
+		h.sendToClient(c, outMsg)
+	}
+}
+
+// lspRequest asks the session's language server for a file's language
+// something about the file, and sends the client the answer
+func (h *Hub) lspRequest(c *Client, inMsg IncomingMessage) {
+	fail := func(message string) {
+		h.sendToClient(c, OutgoingMessage{Type: "lsp-response", RequestID: inMsg.RequestID, Path: inMsg.Path, Error: message})
+	}
+	if len(h.lspCommands) == 0 {
+		fail(errNoLanguageServers)
+		return
+	}
+	if !lspMethods[inMsg.Method] {
+		fail(fmt.Sprintf("%s is not a supported language server request", inMsg.Method))
+		return
+	}
+	params := map[string]any{}
+	if len(inMsg.Params) > 0 {
+		if err := json.Unmarshal(inMsg.Params, &params); err != nil {
+			fail("params must be an object")
+			return
+		}
+	}
+
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+	session.mu.Lock()
+	file, err := session.visibleFileLocked(inMsg.Path, session.roleLocked(c))
+	var language, filePath string
+	if err == nil {
+		language, filePath = h.fileLanguageLocked(session, file.Path), file.Path
+		if file.Binary {
+			err = errors.New("there is no language server for this file")
+		}
+	}
+	session.mu.Unlock()
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.LSPTimeout)
+	defer cancel()
+	server, err := h.languageServer(ctx, session, language)
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+	// Changes are synced as they happen, but the server may not have the
+	// document open yet
+	server.mu.Lock()
+	_, open := server.versions[filePath]
+	server.mu.Unlock()
+	if !open {
+		h.syncDocument(session, server, filePath)
+	}
+	if strings.HasPrefix(inMsg.Method, "textDocument/") {
+		params["textDocument"] = map[string]string{"uri": lsp.URI(filepath.Join(server.dir, filepath.FromSlash(filePath)))}
+	}
+	result, err := server.conn.Call(ctx, inMsg.Method, params)
+	if err != nil {
+		fail(fmt.Sprintf("the language server failed: %s", err.Error()))
+		return
+	}
+	h.sendToClient(c, OutgoingMessage{
+		Type:      "lsp-response",
+		RequestID: inMsg.RequestID,
+		Path:      filePath,
+		Result:    sessionPaths(result, server.dir),
+	})
+}
+
+// closeLanguageServers stops the session's language servers and removes
+// their copy of its files
+func (h *Hub) closeLanguageServers(session *Session) {
+	session.mu.Lock()
+	servers, dir := session.languageServers, session.lspDir
+	session.languageServers = nil
+	session.lspClosed = true
+	session.mu.Unlock()
+	if dir == "" {
+		return
+	}
+
+	go func() {
+		for _, server := range servers {
+			<-server.ready
+			if server.conn != nil {
+				server.conn.Close()
+			}
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Failed to remove the language servers' files of session %s: %v", session.ID, err)
+		}
+	}()
+}
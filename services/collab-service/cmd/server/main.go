@@ -1,14 +1,47 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
+	"os/signal"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
+	"github.com/codecollab/collab-service/internal/backplane"
+	"github.com/codecollab/collab-service/internal/blob"
+	"github.com/codecollab/collab-service/internal/breaker"
+	"github.com/codecollab/collab-service/internal/chatbridge"
+	"github.com/codecollab/collab-service/internal/crdt"
+	"github.com/codecollab/collab-service/internal/deps"
+	"github.com/codecollab/collab-service/internal/gist"
+	"github.com/codecollab/collab-service/internal/highlight"
+	"github.com/codecollab/collab-service/internal/httprunner"
+	"github.com/codecollab/collab-service/internal/i18n"
+	"github.com/codecollab/collab-service/internal/languages"
+	"github.com/codecollab/collab-service/internal/metacache"
+	"github.com/codecollab/collab-service/internal/netpolicy"
+	"github.com/codecollab/collab-service/internal/ot"
+	"github.com/codecollab/collab-service/internal/outbox"
+	"github.com/codecollab/collab-service/internal/outline"
+	"github.com/codecollab/collab-service/internal/prefs"
+	"github.com/codecollab/collab-service/internal/presence"
+	"github.com/codecollab/collab-service/internal/ratelimit"
+	"github.com/codecollab/collab-service/internal/recording"
+	"github.com/codecollab/collab-service/internal/resultcache"
+	"github.com/codecollab/collab-service/internal/resumable"
+	"github.com/codecollab/collab-service/internal/runqueue"
+	"github.com/codecollab/collab-service/internal/sandbox"
+	"github.com/codecollab/collab-service/internal/secrets"
+	"github.com/codecollab/collab-service/internal/sqlsandbox"
+	"github.com/codecollab/collab-service/internal/store"
+	"github.com/codecollab/collab-service/internal/webhook"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 )
@@ -17,22 +50,278 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
 		return true // Allow all origins in development
 	},
+	Subprotocols: []string{subprotocolMessagePack, subprotocolJSON},
 }
 
 // Client represents a connected user
 type Client struct {
 	ID        string
-	Conn      *websocket.Conn
+	Conn      clientConn
 	SessionID string
 	Username  string
-	Send      chan []byte
+	Role      Role
+	// Send holds the messages waiting to be written to the client. It is
+	// closed, under session.mu, when the client leaves its session.
+	Send *outbox.Queue
+	// Org is the user's organization, taken from a verified token only
+	Org string
+	// Locale is the language server-generated text is sent in. It changes
+	// under session.mu.
+	Locale string
+	// limiter bounds how fast the client may send messages, and budgets
+	// how fast it may send those of the types with a budget of their own.
+	// throttled holds the limits it is over, and strikes counts down the
+	// messages it may have dropped before it is disconnected. Once it has
+	// been, flooded is set and whatever else it sends is dropped.
+	limiter   *ratelimit.Bucket
+	budgets   map[string]*ratelimit.Bucket
+	throttled map[string]bool
+	strikes   *ratelimit.Bucket
+	flooded   bool
+	// presenceUser is the verified user this connection counts towards
+	presenceUser string
+	// joined is set once the client has sent join-session
+	joined bool
+	// lobby is set on connections to an organization's lobby, whose user
+	// was verified on connecting
+	lobby bool
+	// shareLink is the share link the client joined through, if any. It is
+	// set under session.mu.
+	shareLink string
+	// registered is closed once the hub has added the client to its
+	// session and sent it the session's state, before anything it sends
+	// is read
+	registered chan struct{}
+	// Highlight asks for server-computed syntax tokens with document syncs
+	Highlight bool
+	// Summaries asks for textual summaries of others' activity, for
+	// screen readers
+	Summaries bool
+
+	// Follow mode: the client's last view of each file, the file it's
+	// looking at, and the ID of the client it follows
+	ViewStates map[string]*ViewState
+	ActivePath string
+	Following  string
+
+	// lastSeen is when anything, a pong included, last came from the
+	// client and lastInput when it last sent a message, in Unix
+	// nanoseconds. status follows from them and changes under session.mu.
+	lastSeen  atomic.Int64
+	lastInput atomic.Int64
+	status    string
+	// color is the user's color in the session, set when the hub adds it
+	color string
+	// resume is the resume token the client reconnected with, if any, and
+	// resuming is set from when the hub accepts it until the client says
+	// which revisions it has. It changes under session.mu.
+	resume   string
+	resuming bool
+	// token is the verified token the client joined as its user with, if
+	// any, whose scopes limit what it may do
+	token *tokenClaims
+	// msgpack is set for clients that connected with the MessagePack
+	// subprotocol
+	msgpack bool
+	// seqMu numbers what is queued for the client: seq is the last
+	// message's number and acked that of the last the client acked, if
+	// acking, with unacked those since, kept to resend
+	seqMu        sync.Mutex
+	seq, acked   int64
+	acking       bool
+	unacked      []numbered
+	unackedBytes int
+
+	// closing carries the close frame writePump sends, after what is
+	// queued, when the server disconnects the client
+	closing chan []byte
+	// quarantined is set while the client is too far behind to be sent
+	// updates, and lagging tells writePump it fell that far behind
+	quarantined atomic.Bool
+	lagging     chan struct{}
+	// userAgent and addr are what the client connected with and from, and
+	// connectedAt when
+	userAgent   string
+	addr        string
+	connectedAt time.Time
 }
 
 // Session represents a collaboration session with multiple clients
 type Session struct {
 	ID      string
 	Clients map[string]*Client
-	mu      sync.RWMutex
+	// Owner is the verified token subject of the session's owner
+	Owner    string
+	Settings EditorSettings
+	Files    map[string]*File
+
+	PendingEdits map[string]*PendingEdit
+	nextEditID   int
+
+	// timers holds pending debounced work, keyed by purpose and path
+	timers map[string]*time.Timer
+
+	// Notebook enables cell execution, with one kernel per file
+	Notebook bool
+	Kernels  map[string]*Kernel
+
+	// CacheResults lets identical runs reuse an earlier result instead of
+	// going to a sandbox
+	CacheResults bool
+
+	// SyncMode is SyncOT or SyncCRDT; empty means SyncOT
+	SyncMode string
+
+	// langSource is the workspace config the cached registry (or error)
+	// was parsed from
+	langSource   string
+	langRegistry *languages.Registry
+	langErr      error
+
+	// installs are the dependency installs done for the session, by plan key
+	installs map[string]*install
+
+	// activity is what has happened since accessibility summaries last went
+	// out. It is only recorded while someone has asked for them.
+	activity []*activity
+
+	// Org is the owner's organization, whose network policy the session's
+	// sandbox gets
+	Org string
+
+	// Sandbox is the session's SQL database, created by the first query
+	Sandbox       *sqlsandbox.Sandbox
+	sandboxClosed bool
+	nextQueryID   int
+
+	// languageServers are the session's running language servers, by
+	// language, working on the copy of its files in lspDir. diagnostics
+	// are the latest they published, by path.
+	languageServers map[string]*languageServer
+	lspDir          string
+	lspClosed       bool
+	diagnostics     map[string]json.RawMessage
+
+	// Env is injected into every run in the session
+	Env map[string]*EnvVar
+
+	// Checkpoints are the kept checkpoints, oldest first; the newest is
+	// what the next one is diffed against
+	Checkpoints      []*Checkpoint
+	nextCheckpointID int
+	CheckpointHook   *CheckpointHook
+
+	// snapshots are the scheduled snapshots, newest first, when there's no
+	// store to keep them in. lastSnapshot is when the latest was taken,
+	// and snapshotRevisions the files' revisions then.
+	snapshots         []*store.Snapshot
+	lastSnapshot      time.Time
+	snapshotRevisions map[string]int
+
+	// cursors are the positions moved to since the last cursors-update,
+	// one per participant, in the order they first moved
+	cursors []CursorPosition
+
+	// Lobby marks an organization's lobby, which has chat but no files
+	Lobby bool
+	// AlwaysOn makes the session a room that stays open when everyone has
+	// left, such as a team scratchpad
+	AlwaysOn bool
+	// RoomCode is the short code the session can be joined with, once
+	// someone has connected
+	RoomCode string
+
+	// Chat is the recent chat, oldest first
+	Chat       []*ChatMessage
+	nextChatID int
+	// threadSubs are the users' thread states, by username and thread
+	threadSubs map[string]map[string]string
+	// typing is who is typing a chat message, by client ID
+	typing map[string]bool
+	// ChatAudit is the recent edits and deletions of chat messages, oldest
+	// first
+	ChatAudit []*ChatChange
+
+	// ChatBridge is the outside room the chat is mirrored to, through
+	// bridge
+	ChatBridge *ChatBridge
+	bridge     chatbridge.Bridge
+
+	// Locked makes the files read-only to everyone but the owner
+	Locked bool
+	// Alert is the suspicious activity waiting for the owner, if any, and
+	// suspects the recent deletions of newcomers, by client ID
+	Alert    *ActivityAlert
+	suspects map[string]*suspect
+	// Suggestions are the edits proposed in suggestion mode waiting for the
+	// owner, by ID, and suggesters who is in suggestion mode, by identity,
+	// with the identity of who put them in it
+	Suggestions      map[string]*Suggestion
+	nextSuggestionID int
+	suggesters       map[string]string
+	// operationLog is the newest of the audit log, oldest first: what
+	// hasn't been saved yet when there's a store, or all that is kept
+	operationLog    []*AuditEntry
+	nextOperationID int64
+	// Language is that of the files whose paths don't say, if set, and
+	// FormatOnSave has editors format files when saving them
+	Language     string
+	FormatOnSave bool
+	// Preset is the editor preset the owner recommends, if any
+	Preset *EditorPreset
+	// Colors are the colors of everyone who joined, by username, so theirs
+	// is the same whenever they come back
+	Colors map[string]string
+	// Tags are what the organization's sessions can be listed by
+	Tags []string
+	// Git is the repository the files were imported from, if they were
+	Git *GitSource
+	// ShareLinks are the links anyone may watch the session through, by ID
+	ShareLinks map[string]*ShareLink
+
+	// Subscriptions are the connector REST hooks, by ID
+	Subscriptions      map[string]*Subscription
+	nextSubscriptionID int
+
+	// remote is who is connected to the session on the other instances,
+	// by instance, and peers the backplane to them, if any
+	remote map[string]*remoteNode
+	peers  *backplane.Backplane
+
+	// Previews are sandbox ports exposed through the preview proxy
+	Previews map[int]*PortPreview
+
+	// Runs is the run history, oldest first
+	Runs      []*Run
+	nextRunID int
+
+	// recorder is the recording of the session, once something has
+	// changed, unless recording it failed
+	recorder        *recording.Recorder
+	recordingFailed bool
+
+	// persist is set when the session is saved to the store; persistMu
+	// makes saves go one at a time
+	persist   bool
+	persistMu sync.Mutex
+	// stored is set once the session was saved, or restored from a save,
+	// from when the store lists it along with the others
+	stored bool
+
+	// resumeToken is what clients reconnect with to be sent only what they
+	// missed. It is new each time the session opens, since revisions start
+	// over, and differs between instances, which count them apart.
+	resumeToken string
+
+	// historyReady is closed once the chat and run history kept of a
+	// restored session, loaded after it opens, are in; it's nil when there
+	// was nothing to load. historyLoaded is set unless loading failed, so
+	// a save doesn't overwrite the kept history with part of it.
+	historyOnce   sync.Once
+	historyReady  chan struct{}
+	historyLoaded bool
+
+	mu sync.RWMutex
 }
 
 // Hub manages all sessions and clients
@@ -41,7 +330,87 @@ type Hub struct {
 	register   chan *Client
 	unregister chan *Client
 	broadcast  chan *BroadcastMessage
-	mu         sync.RWMutex
+	config     Config
+	blobs      blob.Store
+	sandboxes  *sandbox.Pool
+	requests   *httprunner.Runner
+	secrets    *secrets.Box
+	runQueue   *runqueue.Queue
+	results    *resultcache.Cache
+	languages  *languages.Registry
+	installer  *deps.Installer
+	policies   *netpolicy.Policies
+	catalogs   *i18n.Catalogs
+	prefs      *prefs.Store
+	presence   *presence.Tracker
+	// announcements are those in effect until they expire, by ID
+	announcements      map[string]*Announcement
+	nextAnnouncementID int
+	// announcementReceipts are kept for the latest announcements, oldest
+	// first in receiptOrder
+	announcementReceipts map[string]*Receipts
+	receiptOrder         []string
+	// online indexes the connections of verified users, with the
+	// organization each was verified in
+	online   map[string]map[*Client]string
+	webhooks *webhook.Sender
+	// deprovisioned holds the usernames each organization's identity
+	// provider deactivated or deleted, whose tokens are refused
+	deprovisioned map[string]map[string]bool
+
+	// store keeps sessions past their last connection, if configured.
+	// closing holds the sessions that have closed but aren't saved yet.
+	store   *store.Store
+	closing map[string]*store.Session
+	// retrySessions and retryLobbies hold the newest snapshots that failed
+	// to save, by session ID and organization, to save again
+	retrySessions map[string]*store.Session
+	retryLobbies  map[string]*store.Lobby
+	// peers connects this instance to the others serving the same
+	// sessions, if configured
+	peers *backplane.Backplane
+	// recordings keeps the sessions' recordings, if they are recorded
+	recordings *recording.Store
+	// imports are the workspace archives being uploaded, nil if disabled
+	imports *resumable.Store
+	// roomCodes maps the room codes of the open sessions to their IDs
+	roomCodes map[string]string
+	// slugs are the organizations' slugs, by organization and name, when
+	// there is no store to keep them
+	slugs map[string]*store.Slug
+	// templates are the session templates, by ID, when there is no store
+	// to keep them
+	templates map[string]*store.Template
+	// draining is set once the server is shutting down, when no new
+	// connections are taken
+	draining atomic.Bool
+	// metadata caches what the REST listings return
+	metadata *metacache.Cache
+	// expire takes recovered and seeded sessions back to the hub when they
+	// may close
+	expire chan *Session
+	// loaded takes sessions read from the store back to the hub, and
+	// loading holds the clients waiting on each, by session ID. Only run
+	// touches loading.
+	loaded  chan loadedSession
+	loading map[string][]*Client
+	// regions are the endpoints of each region, when sessions are placed
+	// in regions. homes are where the sessions this instance placed are
+	// homed, when there is no backplane to keep that.
+	regions     map[string]string
+	homes       map[string]string
+	regionStats *regionStats
+	// lspCommands are the commands that serve each language, when
+	// sessions get language servers
+	lspCommands map[string][]string
+	// connections counts the clients and region relays connected here,
+	// and shed those turned away at the caps
+	connections atomic.Int64
+	shed        shedCounts
+	// gists reads and makes GitHub Gists, if enabled
+	gists *gist.Client
+
+	mu sync.RWMutex
 }
 
 // BroadcastMessage contains message and target session
@@ -49,16 +418,75 @@ type BroadcastMessage struct {
 	SessionID string
 	Message   []byte
 	Sender    *Client
+	// Path restricts delivery to clients that can see this file, if set
+	Path string
+	// Cursor is set on cursor updates, to the ID of the client whose
+	// cursor moved, so that one still waiting to be written is replaced
+	Cursor string
 }
 
 // Message types
 type IncomingMessage struct {
-	Type      string                 `json:"type"`
-	SessionID string                 `json:"sessionId"`
-	Token     string                 `json:"token,omitempty"`
-	Username  string                 `json:"username,omitempty"`
-	Code      string                 `json:"code,omitempty"`
+	Type      string `json:"type"`
+	SessionID string `json:"sessionId"`
+	Token     string `json:"token,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Code      string `json:"code,omitempty"`
+	// Revision and Ops carry an operation: position-based edits made
+	// against that revision of the file
+	Revision  int                    `json:"revision,omitempty"`
+	Ops       []ot.Edit              `json:"ops,omitempty"`
 	Cursor    map[string]interface{} `json:"cursor,omitempty"`
+	Settings  *EditorSettings        `json:"settings,omitempty"`
+	EditID    string                 `json:"editId,omitempty"`
+	Path      string                 `json:"path,omitempty"`
+	Query     string                 `json:"query,omitempty"`
+	Enabled   bool                   `json:"enabled,omitempty"`
+	UserID    string                 `json:"userId,omitempty"`
+	ViewState *ViewState             `json:"viewState,omitempty"`
+	Cell      int                    `json:"cell,omitempty"`
+	Request   *httprunner.Request    `json:"request,omitempty"`
+	Port      int                    `json:"port,omitempty"`
+	Language  string                 `json:"language,omitempty"`
+	RunID     string                 `json:"runId,omitempty"`
+	Task      string                 `json:"task,omitempty"`
+	Locale    string                 `json:"locale,omitempty"`
+	Name      string                 `json:"name,omitempty"`
+	Text      string                 `json:"text,omitempty"`
+	Notice    bool                   `json:"notice,omitempty"`
+	MessageID string                 `json:"messageId,omitempty"`
+	// ParentID makes a chat message a reply; Subscription is a thread
+	// state for "set-thread-subscription"
+	ParentID     string `json:"parentId,omitempty"`
+	Subscription string `json:"subscription,omitempty"`
+	// SyncMode, Update and StateVector are for CRDT sync
+	SyncMode    string           `json:"syncMode,omitempty"`
+	Update      *crdt.Update     `json:"update,omitempty"`
+	StateVector crdt.StateVector `json:"stateVector,omitempty"`
+	// Permissions carries per-role access for "set-file-permissions"
+	Permissions map[Role]FileAccess `json:"permissions,omitempty"`
+	// RequestID, Method and Params make up an "lsp-request", a Language
+	// Server Protocol request about Path; the reply has the same RequestID
+	RequestID string          `json:"requestId,omitempty"`
+	Method    string          `json:"method,omitempty"`
+	Params    json.RawMessage `json:"params,omitempty"`
+	// SessionSettings are what a "session-settings" sets
+	SessionSettings *SessionSettings `json:"sessionSettings,omitempty"`
+	// Minutes is how far back a "revert-user" goes
+	Minutes int `json:"minutes,omitempty"`
+	// SuggestionID is the suggestion an "accept-suggestion" or
+	// "reject-suggestion" resolves
+	SuggestionID string `json:"suggestionId,omitempty"`
+	// Preset is what a "set-editor-preset" recommends; none stops
+	// recommending one
+	Preset *EditorPreset `json:"preset,omitempty"`
+	// Tags are what a "set-tags" tags the session with; none removes them
+	Tags []string `json:"tags,omitempty"`
+	// Revisions are the revisions of the files a "resume" has, by path
+	Revisions map[string]int `json:"revisions,omitempty"`
+	// Seq is the last message an "ack" acks, or the first a "resend" asks
+	// for again
+	Seq int64 `json:"seq,omitempty"`
 }
 
 type OutgoingMessage struct {
@@ -66,14 +494,121 @@ type OutgoingMessage struct {
 	UserID       string                 `json:"userId,omitempty"`
 	Username     string                 `json:"username,omitempty"`
 	Code         string                 `json:"code,omitempty"`
+	Revision     int                    `json:"revision,omitempty"`
+	Ops          []ot.Edit              `json:"ops,omitempty"`
+	SyncMode     string                 `json:"syncMode,omitempty"`
+	Update       *crdt.Update           `json:"update,omitempty"`
+	StateVector  crdt.StateVector       `json:"stateVector,omitempty"`
+	Site         string                 `json:"site,omitempty"`
+	Reset        bool                   `json:"reset,omitempty"`
 	Cursor       map[string]interface{} `json:"cursor,omitempty"`
 	Participants []Participant          `json:"participants,omitempty"`
+	Settings     *EditorSettings        `json:"settings,omitempty"`
+	Error        string                 `json:"error,omitempty"`
+	Warnings     []EditWarning          `json:"warnings,omitempty"`
+	Summaries    []ActivitySummary      `json:"summaries,omitempty"`
+	Colleagues   []Colleague            `json:"colleagues,omitempty"`
+	Invitation   *Invitation            `json:"invitation,omitempty"`
+	Announcement *Announcement          `json:"announcement,omitempty"`
+	Checkpoint   *Checkpoint            `json:"checkpoint,omitempty"`
+	Chat         *ChatMessage           `json:"chat,omitempty"`
+	Messages     []*ChatMessage         `json:"messages,omitempty"`
+	Receipts     *ReadState             `json:"receipts,omitempty"`
+	Thread       *ChatThread            `json:"thread,omitempty"`
+	MessageID    string                 `json:"messageId,omitempty"`
+	EditID       string                 `json:"editId,omitempty"`
+	Size         int                    `json:"size,omitempty"`
+	Path         string                 `json:"path,omitempty"`
+	Access       FileAccess             `json:"access,omitempty"`
+	Files        []FileEntry            `json:"files,omitempty"`
+	Binary       bool                   `json:"binary,omitempty"`
+	DownloadURL  string                 `json:"downloadUrl,omitempty"`
+	Results      []SearchResult         `json:"results,omitempty"`
+	Symbols      []outline.Symbol       `json:"symbols,omitempty"`
+	Tokens       []highlight.Token      `json:"tokens,omitempty"`
+	ViewState    *ViewState             `json:"viewState,omitempty"`
+	HTML         string                 `json:"html,omitempty"`
+	Enabled      bool                   `json:"enabled,omitempty"`
+	Cells        []Cell                 `json:"cells,omitempty"`
+	Output       *CellOutput            `json:"output,omitempty"`
+	QueryID      string                 `json:"queryId,omitempty"`
+	Columns      []string               `json:"columns,omitempty"`
+	Rows         [][]any                `json:"rows,omitempty"`
+	RowCount     int                    `json:"rowCount,omitempty"`
+	RowsAffected int64                  `json:"rowsAffected,omitempty"`
+	Truncated    bool                   `json:"truncated,omitempty"`
+	Request      *httprunner.Request    `json:"request,omitempty"`
+	Response     *httprunner.Response   `json:"response,omitempty"`
+	Env          []EnvEntry             `json:"env,omitempty"`
+	PortPreview  *PortPreview           `json:"portPreview,omitempty"`
+	Run          *Run                   `json:"run,omitempty"`
+	Queue        *QueueStatus           `json:"queue,omitempty"`
+	Languages    []languages.Language   `json:"languages,omitempty"`
+	Tasks        []languages.Task       `json:"tasks,omitempty"`
+	Chunk        *OutputChunk           `json:"chunk,omitempty"`
+	Install      *InstallStatus         `json:"install,omitempty"`
+	Capabilities *Capabilities          `json:"capabilities,omitempty"`
+	Locale       string                 `json:"locale,omitempty"`
+	Language     string                 `json:"language,omitempty"`
+	RoomCode     string                 `json:"roomCode,omitempty"`
+
+	ThreadSubscriptions []ThreadSubscription `json:"threadSubscriptions,omitempty"`
+
+	// Limit is the rate limit a rate-limited warning is about
+	Limit string `json:"limit,omitempty"`
+	// Degraded lists the services that are down; a service-status without
+	// any means everything is back
+	Degraded []string `json:"degraded,omitempty"`
+	// Chunks is how many parts a document too large for one message comes
+	// in, and Part which of them a document-chunk is
+	Chunks int `json:"chunks,omitempty"`
+	Part   int `json:"part,omitempty"`
+	// RequestID and Result answer an lsp-request; Diagnostics are a
+	// language server's latest for Path, or what checking it found
+	RequestID   string          `json:"requestId,omitempty"`
+	Result      json.RawMessage `json:"result,omitempty"`
+	Diagnostics json.RawMessage `json:"diagnostics,omitempty"`
+	Git         *GitSource      `json:"git,omitempty"`
+	// Documents are the document-syncs of a catch-up-sync
+	Documents []OutgoingMessage `json:"documents,omitempty"`
+	// Policy is the duplicate connection policy a session-conflict applied
+	Policy string `json:"policy,omitempty"`
+	// SessionSettings are the session's, in a session-settings
+	SessionSettings *SessionSettings `json:"sessionSettings,omitempty"`
+	// Alert is the suspicious activity a suspicious-activity or
+	// activity-resolved is about
+	Alert *ActivityAlert `json:"alert,omitempty"`
+	// Reversal is what an edits-reverted took back
+	Reversal *Reversal `json:"reversal,omitempty"`
+	// Suggestion is the suggestion a suggestion-added, suggestion-accepted
+	// or suggestion-rejected is about, and Suggestions the open ones sent on
+	// joining
+	Suggestion  *Suggestion   `json:"suggestion,omitempty"`
+	Suggestions []*Suggestion `json:"suggestions,omitempty"`
+	// Preset is the recommended editor preset of an editor-preset, none
+	// when the owner stopped recommending one
+	Preset *EditorPreset `json:"preset,omitempty"`
+	// Color is the color of the user a cursor-update is from
+	Color string `json:"color,omitempty"`
+	// Tags are the session's tags, of a session-tags
+	Tags []string `json:"tags,omitempty"`
+	// Owner is who a session-owner made the session's owner
+	Owner string `json:"owner,omitempty"`
+	// ResumeToken is what a resume-token gives the client to reconnect
+	// with
+	ResumeToken string `json:"resumeToken,omitempty"`
+	// Cursors are the cursors that moved, of a cursors-update
+	Cursors []CursorPosition `json:"cursors,omitempty"`
 }
 
 type Participant struct {
 	ID       string `json:"id"`
 	Username string `json:"username"`
 	Color    string `json:"color"`
+	// Via is set on the bridge bot to the network it bridges to
+	Via string `json:"via,omitempty"`
+	// Status is "active", "idle" or "disconnected"
+	Status string `json:"status,omitempty"`
 }
 
 var userColors = []string{
@@ -81,72 +616,232 @@ var userColors = []string{
 	"#98D8C8", "#F7DC6F", "#BB8FCE", "#85C1E2",
 }
 
-func newHub() *Hub {
+func newHub(config Config, blobs blob.Store, box *secrets.Box, sandboxes *sandbox.Pool, installer *deps.Installer, policies *netpolicy.Policies, catalogs *i18n.Catalogs, preferences *prefs.Store, sessions *store.Store, peers *backplane.Backplane, recordings *recording.Store, imports *resumable.Store, regions map[string]string, lspCommands map[string][]string) *Hub {
 	return &Hub{
-		sessions:   make(map[string]*Session),
-		broadcast:  make(chan *BroadcastMessage, 256),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
+		config:    config,
+		blobs:     blobs,
+		secrets:   box,
+		sandboxes: sandboxes,
+		installer: installer,
+		policies:  policies,
+		catalogs:  catalogs,
+		prefs:     preferences,
+		presence:  presence.New(config.PresenceIdle),
+		online:    make(map[string]map[*Client]string),
+		store:     sessions,
+		closing:   make(map[string]*store.Session),
+		peers:     peers,
+		roomCodes: make(map[string]string),
+		slugs:     make(map[string]*store.Slug),
+
+		recordings: recordings,
+		imports:    imports,
+		metadata:   newMetadataCache(config, peers),
+
+		retrySessions: make(map[string]*store.Session),
+		retryLobbies:  make(map[string]*store.Lobby),
+
+		regions:     regions,
+		homes:       make(map[string]string),
+		regionStats: newRegionStats(),
+
+		lspCommands: lspCommands,
+		gists:       newGists(config),
+		templates:   make(map[string]*store.Template),
+
+		announcementReceipts: make(map[string]*Receipts),
+		deprovisioned:        make(map[string]map[string]bool),
+
+		announcements: make(map[string]*Announcement),
+		webhooks:      webhook.New(config.WebhookSecret, 10*time.Second),
+		runQueue:      runqueue.New(config.ExecutionConcurrency),
+		results:       resultcache.New(config.ResultCacheSize, config.ResultCacheTTL),
+		languages:     languages.Default(int(config.ExecutionTimeout.Seconds())),
+		sessions:      make(map[string]*Session),
+		broadcast:     make(chan *BroadcastMessage, 256),
+		register:      make(chan *Client),
+		unregister:    make(chan *Client),
+		expire:        make(chan *Session),
+		loaded:        make(chan loadedSession),
+		loading:       make(map[string][]*Client),
+		requests: httprunner.NewRunner(httprunner.Options{
+			Timeout:      config.HTTPRunnerTimeout,
+			MaxBodyBytes: int64(config.HTTPRunnerMaxBodyBytes),
+			AllowPrivate: config.HTTPRunnerAllowPrivate,
+		}),
 	}
 }
 
+// getOrCreateSession returns the open session, or opens it, restoring it
+// from the store if it was saved
 func (h *Hub) getOrCreateSession(sessionID string) *Session {
+	if session, exists := h.getSession(sessionID); exists {
+		return session
+	}
+	saved, persist := h.loadSession(sessionID)
+	return h.openSession(sessionID, saved, persist)
+}
+
+// loadedSession is what loadSession found for a session clients are
+// waiting to join
+type loadedSession struct {
+	id      string
+	saved   *store.Session
+	persist bool
+}
+
+// openSession returns the open session, or opens it from what loadSession
+// found
+func (h *Hub) openSession(sessionID string, saved *store.Session, persist bool) *Session {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
 	session, exists := h.sessions[sessionID]
 	if !exists {
 		session = &Session{
-			ID:      sessionID,
-			Clients: make(map[string]*Client),
+			ID:       sessionID,
+			Clients:  make(map[string]*Client),
+			Settings: defaultEditorSettings(),
+			Files:    map[string]*File{defaultFilePath: newFile(defaultFilePath)},
+
+			PendingEdits: make(map[string]*PendingEdit),
+
+			timers: make(map[string]*time.Timer),
+
+			Kernels: make(map[string]*Kernel),
+			Env:     make(map[string]*EnvVar),
+
+			Previews: make(map[int]*PortPreview),
+
+			Subscriptions: make(map[string]*Subscription),
+			ShareLinks:    make(map[string]*ShareLink),
+
+			threadSubs: make(map[string]map[string]string),
+			typing:     make(map[string]bool),
+
+			remote: make(map[string]*remoteNode),
+			peers:  h.peers,
+
+			persist:       persist,
+			historyLoaded: true,
+
+			resumeToken: newResumeToken(),
+		}
+		if saved != nil {
+			session.restoreLocked(saved)
 		}
 		h.sessions[sessionID] = session
+		h.joinPeers(sessionID)
 		log.Printf("Created new session: %s", sessionID)
 	}
 	return session
 }
 
+// closeSession saves and closes a session everyone has left. It runs on
+// the hub's goroutine, so nobody joins meanwhile.
+func (h *Hub) closeSession(session *Session) {
+	h.persistClosed(session)
+	h.mu.Lock()
+	delete(h.sessions, session.ID)
+	h.mu.Unlock()
+	h.deleteSessionBlobs(session)
+	h.stopTimers(session)
+	h.closeSandbox(session)
+	h.closeLanguageServers(session)
+	h.closeBridge(session)
+	h.leavePeers(session.ID)
+	go h.uncacheParticipants(session.ID)
+	h.releaseRoomCode(session)
+	h.stopRecording(session)
+	h.purgeInstalls(session)
+	h.sandboxes.Release(session.ID)
+	log.Printf("Deleted empty session: %s", session.ID)
+}
+
+func (h *Hub) getSession(sessionID string) (*Session, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	session, exists := h.sessions[sessionID]
+	return session, exists
+}
+
 func (h *Hub) run() {
 	for {
 		select {
 		case client := <-h.register:
-			session := h.getOrCreateSession(client.SessionID)
-			session.mu.Lock()
-			session.Clients[client.ID] = client
-			session.mu.Unlock()
-
-			log.Printf("Client %s connected to session %s. Total in session: %d",
-				client.ID, client.SessionID, len(session.Clients))
+			session, exists := h.getSession(client.SessionID)
+			if !exists {
+				// Reading the store can take as long as persistTimeout, so it
+				// happens off the loop; later joins wait with the first
+				waiting, loading := h.loading[client.SessionID]
+				h.loading[client.SessionID] = append(waiting, client)
+				if !loading {
+					go func(id string) {
+						saved, persist := h.loadSession(id)
+						h.loaded <- loadedSession{id: id, saved: saved, persist: persist}
+					}(client.SessionID)
+				}
+				continue
+			}
+			h.registerClient(session, client)
 
-			// Send participant list to all clients in session
-			h.broadcastParticipants(client.SessionID)
+		case loaded := <-h.loaded:
+			session := h.openSession(loaded.id, loaded.saved, loaded.persist)
+			for _, client := range h.loading[loaded.id] {
+				h.registerClient(session, client)
+			}
+			delete(h.loading, loaded.id)
 
 		case client := <-h.unregister:
+			h.untrackPresence(client)
 			h.mu.RLock()
 			session, exists := h.sessions[client.SessionID]
 			h.mu.RUnlock()
 
 			if exists {
 				session.mu.Lock()
+				var followers []*Client
 				if _, ok := session.Clients[client.ID]; ok {
 					delete(session.Clients, client.ID)
-					close(client.Send)
+					client.Send.Close()
+					followers = session.releaseFollowersLocked(client.ID)
+					session.stopTypingLocked(client)
+					delete(session.suspects, client.ID)
+					session.recordPresenceLocked(client, "left")
 					log.Printf("Client %s disconnected from session %s. Remaining: %d",
 						client.ID, client.SessionID, len(session.Clients))
 				}
+				empty, alwaysOn := len(session.Clients) == 0, session.AlwaysOn
 				session.mu.Unlock()
 
-				// Clean up empty sessions
-				if len(session.Clients) == 0 {
-					h.mu.Lock()
-					delete(h.sessions, client.SessionID)
-					h.mu.Unlock()
-					log.Printf("Deleted empty session: %s", client.SessionID)
+				for _, follower := range followers {
+					h.sendToClient(follower, OutgoingMessage{Type: "follow-ended", UserID: client.ID})
+				}
+				h.scheduleSummaries(session)
+
+				// Clean up empty sessions; lobbies and always-on rooms stay open
+				if empty && !isLobby(session.ID) && !alwaysOn {
+					h.closeSession(session)
 				} else {
+					if empty && alwaysOn {
+						h.compactRoom(session)
+					}
 					h.broadcastParticipants(client.SessionID)
 				}
 			}
 
+		case session := <-h.expire:
+			// A recovered or seeded session nobody came to
+			h.mu.RLock()
+			open := h.sessions[session.ID] == session
+			h.mu.RUnlock()
+			session.mu.RLock()
+			empty, alwaysOn := len(session.Clients) == 0, session.AlwaysOn
+			session.mu.RUnlock()
+			if open && empty && !alwaysOn {
+				h.closeSession(session)
+			}
+
 		case msg := <-h.broadcast:
 			h.mu.RLock()
 			session, exists := h.sessions[msg.SessionID]
@@ -154,17 +849,21 @@ func (h *Hub) run() {
 
 			if exists {
 				session.mu.RLock()
+				var file *File
+				if msg.Path != "" {
+					file = session.Files[msg.Path]
+				}
 				for _, client := range session.Clients {
+					if file != nil && !file.visibleTo(session.roleLocked(client)) {
+						continue
+					}
 					// Don't send message back to sender
-					if client.ID != msg.Sender.ID {
-						select {
-						case client.Send <- msg.Message:
-						default:
-							close(client.Send)
-							session.mu.RUnlock()
-							h.unregister <- client
-							session.mu.RLock()
-						}
+					switch {
+					case client.ID == msg.Sender.ID:
+					case msg.Cursor != "":
+						client.deliverCursor(msg.Cursor, msg.Message)
+					default:
+						client.deliver(msg.Message)
 					}
 				}
 				session.mu.RUnlock()
@@ -173,6 +872,49 @@ func (h *Hub) run() {
 	}
 }
 
+// registerClient adds a client to its open session and brings it up to
+// date. It runs on the hub loop.
+func (h *Hub) registerClient(session *Session, client *Client) {
+	session.mu.Lock()
+	client.color, _ = session.colorLocked(client, "")
+	session.Clients[client.ID] = client
+	session.recordPresenceLocked(client, "joined")
+	session.mu.Unlock()
+	h.scheduleSummaries(session)
+
+	log.Printf("Client %s connected to session %s. Total in session: %d",
+		client.ID, client.SessionID, len(session.Clients))
+
+	h.sendCapabilities(client)
+	// Send participant list to all clients in session
+	h.broadcastParticipants(client.SessionID)
+	if !client.lobby {
+		h.sendSettings(client)
+		h.sendSessionSettings(client)
+		h.sendEditorPreset(client)
+		h.sendTags(client)
+		h.sendNotebookMode(client)
+		h.sendResultCache(client)
+		h.sendSyncMode(client)
+		h.sendLock(client)
+		h.sendAlert(client)
+		h.sendAlwaysOn(client)
+		h.sendWorkspaceConfig(client)
+		h.sendPortPreviews(client)
+		h.sendFileTree(client)
+		if !h.offerResume(session, client) {
+			h.sendDocuments(client)
+		}
+		h.sendSuggestions(client)
+		h.sendDiagnostics(client)
+		h.sendRoomCode(session, client)
+	}
+	h.sendAnnouncements(client)
+	h.sendServiceStatus(client)
+	h.sendChatHistory(client)
+	close(client.registered)
+}
+
 func (h *Hub) broadcastParticipants(sessionID string) {
 	h.mu.RLock()
 	session, exists := h.sessions[sessionID]
@@ -181,19 +923,15 @@ func (h *Hub) broadcastParticipants(sessionID string) {
 	if !exists {
 		return
 	}
+	h.publishPresence(session)
+	h.sendParticipants(session)
+}
 
-	session.mu.RLock()
-	participants := make([]Participant, 0, len(session.Clients))
-	colorIndex := 0
-	for _, client := range session.Clients {
-		participants = append(participants, Participant{
-			ID:       client.ID,
-			Username: client.Username,
-			Color:    userColors[colorIndex%len(userColors)],
-		})
-		colorIndex++
-	}
-	session.mu.RUnlock()
+// sendParticipants sends the clients connected here everyone in the
+// session, on this instance and the others
+func (h *Hub) sendParticipants(session *Session) {
+	participants := h.participants(session)
+	h.participantsChanged(session)
 
 	outMsg := OutgoingMessage{
 		Type:         "participants-update",
@@ -209,24 +947,176 @@ func (h *Hub) broadcastParticipants(sessionID string) {
 	// Broadcast to all clients in session (including sender for this message)
 	session.mu.RLock()
 	for _, client := range session.Clients {
-		select {
-		case client.Send <- msgBytes:
-		default:
-			log.Printf("Failed to send participants update to client %s", client.ID)
+		client.deliver(msgBytes)
+	}
+	session.mu.RUnlock()
+}
+
+// sendToClient delivers a message to a single client without blocking.
+// Clients that already left the session are skipped, since their Send
+// channel is closed. Must be called without holding session.mu.
+func (h *Hub) sendToClient(client *Client, outMsg OutgoingMessage) {
+	session, exists := h.getSession(client.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+	if session.Clients[client.ID] != client {
+		return
+	}
+
+	h.localize(&outMsg, client.Locale)
+	msgBytes, err := json.Marshal(outMsg)
+	if err != nil {
+		log.Printf("Error marshaling %s: %v", outMsg.Type, err)
+		return
+	}
+
+	client.deliver(msgBytes)
+}
+
+// broadcastToSession delivers a message to every client in a session,
+// including the one that triggered it
+func (h *Hub) broadcastToSession(sessionID string, outMsg OutgoingMessage) {
+	h.broadcastExcept(sessionID, "", outMsg)
+}
+
+// broadcastExcept delivers a message to every client in a session other
+// than excludeID
+func (h *Hub) broadcastExcept(sessionID, excludeID string, outMsg OutgoingMessage) {
+	session, exists := h.getSession(sessionID)
+	if !exists {
+		return
+	}
+
+	msgBytes, err := json.Marshal(outMsg)
+	if err != nil {
+		log.Printf("Error marshaling %s: %v", outMsg.Type, err)
+		return
+	}
+
+	session.mu.RLock()
+	for _, client := range session.Clients {
+		if client.ID == excludeID {
+			continue
 		}
+		client.deliver(msgBytes)
 	}
 	session.mu.RUnlock()
 }
 
+// applyCodeChange normalizes an incoming document and stores it as the
+// content of the target file, sending the other clients what changed. Any
+// fixes are reported back to the sender. Edits that are rejected or held
+// for approval aren't sent.
+func (h *Hub) applyCodeChange(c *Client, filePath, code string, rawValid bool) {
+	if limit := h.config.MaxCodeChangeBytes; limit > 0 && len(code) > limit {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Path: filePath, Error: fmt.Sprintf("code changes are limited to %d bytes; send operations instead", limit)})
+		return
+	}
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	file, err := session.editableFileLocked(c, filePath)
+	if err != nil {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Path: filePath, Error: err.Error()})
+		return
+	}
+
+	normalized, warnings, ok := normalizeEdit(session.Settings, code, rawValid, h.config.InvalidUTF8Policy)
+	if ok {
+		if err := h.checkQuotaLocked(session, 0, len(normalized)-len(file.Content)); err != nil {
+			session.mu.Unlock()
+			h.sendToClient(c, OutgoingMessage{Type: "error", Path: file.Path, Error: err.Error()})
+			return
+		}
+	}
+	var pending *PendingEdit
+	if ok {
+		if session.suggestingLocked(c) {
+			if err := session.suggestLocked(c, file, normalized); err != nil {
+				session.mu.Unlock()
+				h.sendToClient(c, OutgoingMessage{Type: "error", Path: file.Path, Error: err.Error()})
+				return
+			}
+			ok = false
+		} else if h.isLargeEdit(file, normalized) && !isTrustedLocked(session, c) {
+			pending = session.holdEdit(c, file, normalized)
+			ok = false
+		} else {
+			session.recordEditLocked(c.ID, c.Username, file, normalized)
+			h.watchEditLocked(session, c, file, normalized)
+			h.recordChangeLocked(session, auditEdit, c.ID, c.Username, file, normalized)
+			op := ot.FromDiff(file.Content, normalized)
+			file.applyOperation(op, normalized, c.Username, c.identity())
+			sendLocked(c, OutgoingMessage{Type: "operation-ack", Path: file.Path, Revision: file.doc.Revision()})
+			if normalized != code {
+				// The sender's editor still has what they sent
+				sendLocked(c, OutgoingMessage{Type: "code-update", Path: file.Path, Code: file.Content, Revision: file.doc.Revision()})
+			}
+			if !op.IsNoop() {
+				session.broadcastChangeLocked(c.ID, file, op)
+			}
+		}
+	}
+	session.mu.Unlock()
+
+	if len(warnings) > 0 {
+		h.sendToClient(c, OutgoingMessage{Type: "edit-warning", Warnings: warnings})
+	}
+	if pending != nil {
+		h.requestApproval(c, pending)
+	}
+	if ok {
+		h.fileChanged(c.SessionID, file.Path)
+		h.scheduleSummaries(session)
+	}
+}
+
+// fileChanged runs the follow-up work after a file's content changes
+func (h *Hub) fileChanged(sessionID, filePath string) {
+	h.publishFile(sessionID, filePath)
+	h.refreshFile(sessionID, filePath)
+}
+
+// refreshFile brings what is derived from a file up to date with its
+// content
+func (h *Hub) refreshFile(sessionID, filePath string) {
+	h.flushCRDT(sessionID, filePath)
+	h.schedulePersist(sessionID)
+	h.scheduleOutline(sessionID, filePath)
+	h.scheduleLint(sessionID, filePath)
+	h.broadcastHighlights(sessionID, filePath)
+	h.schedulePreview(sessionID, filePath)
+	h.broadcastCells(sessionID, filePath)
+	h.scheduleConfigCheck(sessionID, filePath)
+	h.syncLanguageServer(sessionID, filePath)
+}
+
 // Read messages from WebSocket and handle them
 func (c *Client) readPump(hub *Hub) {
 	defer func() {
 		hub.unregister <- c
 		c.Conn.Close()
+		hub.connections.Add(-1)
 	}()
+	<-c.registered
+	if c.lobby {
+		hub.participantJoined(c)
+	}
 
+	if hub.config.MaxMessageBytes > 0 {
+		c.Conn.SetReadLimit(int64(hub.config.MaxMessageBytes))
+	}
+	c.startHeartbeat(hub)
 	for {
-		_, message, err := c.Conn.ReadMessage()
+		messageType, message, err := c.Conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("WebSocket error for client %s: %v", c.ID, err)
@@ -234,49 +1124,308 @@ func (c *Client) readPump(hub *Hub) {
 			break
 		}
 
+		if c.flooded {
+			continue
+		}
+		if !c.admit(hub, limitMessages, c.limiter) {
+			if c.flooding() {
+				c.disconnectFlooding()
+			}
+			continue
+		}
+		hub.heard(c)
+		hub.touchPresence(c)
+
+		message, err = c.decodeFrame(messageType, message)
+		if err != nil {
+			log.Printf("Error decoding MessagePack from %s: %v", c.ID, err)
+			continue
+		}
 		var inMsg IncomingMessage
 		if err := json.Unmarshal(message, &inMsg); err != nil {
 			log.Printf("Error unmarshaling message from %s: %v", c.ID, err)
 			continue
 		}
 
+		if budget, ok := messageBudgets[inMsg.Type]; ok && !c.admit(hub, budget, c.budgets[budget]) {
+			if c.flooding() {
+				c.disconnectFlooding()
+			}
+			continue
+		}
+
 		log.Printf("Received from %s: type=%s", c.ID, inMsg.Type)
+		if c.lobby && !hub.allowedInLobby(c, inMsg.Type) {
+			continue
+		}
+		if !hub.allowedByScope(c, inMsg.Type) {
+			continue
+		}
+		if historyMessages[inMsg.Type] {
+			if session, exists := hub.getSession(c.SessionID); exists {
+				hub.loadHistory(session)
+			}
+		}
 
 		switch inMsg.Type {
 		case "join-session":
+			claims, err := hub.verifyToken(inMsg.Token)
+			switch {
+			case err != nil || !claims.allowsSession(c.SessionID) || !claims.allows(scopeSessionsRead):
+				// Anyone can pick a name, so it alone doesn't let them edit
+				c.Role = hub.unverifiedRole()
+			case claims.Role == string(RoleViewer):
+				if claims.ID != "" && !hub.joinShareLink(c, claims.ID) {
+					continue
+				}
+				// Viewer links only grant the role; who joins names themselves
+				c.Role = RoleViewer
+			default:
+				// A verified token takes precedence over the self-reported name
+				inMsg.Username = claims.Subject
+				c.Org = claims.Org
+				c.token = claims
+				c.Role = RoleEditor
+				if !claims.allows(scopeSessionsWrite) {
+					c.Role = RoleViewer
+				}
+				if !hub.admitDuplicate(c, claims.Subject) {
+					continue
+				}
+				hub.trackPresence(c, claims.Subject)
+			}
 			// Update username if provided
 			if inMsg.Username != "" {
 				c.Username = inMsg.Username
 				log.Printf("Client %s username set to: %s", c.ID, c.Username)
+				hub.assignColor(c)
 				// Broadcast updated participant list
 				hub.broadcastParticipants(c.SessionID)
 			}
+			if inMsg.Locale != "" {
+				hub.setLocale(c, inMsg.Locale)
+			}
+			hub.claimOwnership(c)
+			hub.sendFileTree(c)
+			hub.participantJoined(c)
 			continue
 
-		case "code-change":
-			// Broadcast code change to other clients
-			outMsg := OutgoingMessage{
-				Type:   "code-update",
-				UserID: c.ID,
-				Code:   inMsg.Code,
-			}
-			msgBytes, err := json.Marshal(outMsg)
-			if err != nil {
-				log.Printf("Error marshaling code update: %v", err)
-				continue
+		case "chat", "chat-message":
+			hub.sendChat(c, inMsg.Text, inMsg.Notice, inMsg.ParentID)
+			continue
+
+		case "typing":
+			hub.setTyping(c, inMsg.Enabled)
+			continue
+
+		case "edit-chat":
+			hub.editChat(c, inMsg.MessageID, inMsg.Text)
+			continue
+
+		case "delete-chat":
+			hub.deleteChat(c, inMsg.MessageID)
+			continue
+
+		case "get-thread":
+			hub.sendThread(c, inMsg.MessageID)
+			continue
+
+		case "set-thread-subscription":
+			hub.setThreadSubscription(c, inMsg.MessageID, inMsg.Subscription)
+			continue
+
+		case "mark-read":
+			hub.markRead(c, inMsg.MessageID)
+			continue
+
+		case "read-receipts":
+			if session, exists := hub.getSession(c.SessionID); exists {
+				hub.sendReadState(session, inMsg.MessageID, c)
 			}
-			hub.broadcast <- &BroadcastMessage{
-				SessionID: c.SessionID,
-				Message:   msgBytes,
-				Sender:    c,
+			continue
+
+		case "ack":
+			c.ack(inMsg.Seq)
+			continue
+
+		case "resend":
+			hub.resend(c, inMsg.Seq)
+			continue
+
+		case "heartbeat":
+			// Only marks the user active, for clients with nothing else to
+			// send while someone is reading or thinking
+			continue
+
+		case "list-colleagues":
+			hub.listColleagues(c)
+			continue
+
+		case "invite-user":
+			hub.inviteUser(c, inMsg.Username)
+			continue
+
+		case "update-settings":
+			hub.updateSettings(c, inMsg.Settings)
+			continue
+
+		case "session-settings":
+			hub.updateSessionSettings(c, inMsg.SessionSettings)
+			continue
+
+		case "approve-edit", "reject-edit":
+			hub.resolvePendingEdit(c, inMsg.EditID, inMsg.Type == "approve-edit")
+			continue
+
+		case "confirm-activity", "revert-activity":
+			hub.resolveAlert(c, inMsg.Type == "revert-activity")
+			continue
+
+		case "open-file":
+			hub.openFile(c, inMsg.Path)
+			continue
+
+		case "resume":
+			hub.resume(c, inMsg.Revisions)
+			continue
+
+		case "create-file":
+			hub.createFile(c, inMsg.Path)
+			continue
+
+		case "set-file-permissions":
+			hub.setFilePermissions(c, inMsg.Path, inMsg.Permissions)
+			continue
+
+		case "set-highlighting":
+			hub.setHighlighting(c, inMsg.Enabled)
+			continue
+
+		case "view-state":
+			hub.updateViewState(c, inMsg.ViewState)
+			continue
+
+		case "follow":
+			hub.follow(c, inMsg.UserID)
+			continue
+
+		case "unfollow":
+			hub.unfollow(c)
+			continue
+
+		case "search":
+			hub.search(c, inMsg.Query)
+			continue
+
+		case "set-a11y-summaries":
+			hub.setSummaries(c, inMsg.Enabled)
+			continue
+
+		case "set-notebook-mode":
+			hub.setNotebookMode(c, inMsg.Enabled)
+			continue
+
+		case "set-sync-mode":
+			hub.setSyncMode(c, inMsg.SyncMode)
+			continue
+
+		case "crdt-sync":
+			hub.sendCRDTState(c, inMsg.Path, inMsg.StateVector)
+			continue
+
+		case "crdt-update":
+			if inMsg.Update != nil {
+				hub.applyCRDTUpdate(c, inMsg.Path, *inMsg.Update)
 			}
 
+		case "set-always-on":
+			hub.setAlwaysOn(c, inMsg.Enabled)
+			continue
+
+		case "set-result-cache":
+			hub.setResultCache(c, inMsg.Enabled)
+			continue
+
+		case "run-file":
+			hub.runFile(c, inMsg.Path, inMsg.Language)
+			continue
+
+		case "checkpoint":
+			hub.createCheckpoint(c, inMsg.Name)
+			continue
+
+		case "run-task":
+			hub.runTask(c, inMsg.Task)
+			continue
+
+		case "run-cell":
+			hub.runCell(c, inMsg.Path, inMsg.Cell)
+			continue
+
+		case "cancel-run":
+			hub.cancelRun(c, inMsg.RunID)
+			continue
+
+		case "restart-kernel":
+			hub.restartKernel(c, inMsg.Path)
+			continue
+
+		case "run-query":
+			hub.runQuery(c, inMsg.Path, inMsg.Query)
+			continue
+
+		case "run-request":
+			hub.runRequest(c, inMsg.Path, inMsg.Request)
+			continue
+
+		case "lsp-request":
+			go hub.lspRequest(c, inMsg)
+			continue
+
+		case "expose-port":
+			hub.exposePort(c, inMsg.Port)
+			continue
+
+		case "close-port":
+			hub.closePort(c, inMsg.Port)
+			continue
+
+		case "code-change":
+			hub.applyCodeChange(c, inMsg.Path, inMsg.Code, utf8.Valid(message))
+
+		case "operation":
+			hub.applyOperation(c, inMsg.Path, inMsg.Revision, inMsg.Ops)
+
+		case "revert-user":
+			hub.revertUser(c, inMsg.Username, inMsg.Minutes)
+
+		case "set-editor-preset":
+			hub.setEditorPreset(c, inMsg.Preset)
+
+		case "set-tags":
+			hub.setTags(c, inMsg.Tags)
+
+		case "set-suggest-mode":
+			hub.setSuggestMode(c, inMsg.UserID, inMsg.Enabled)
+
+		case "accept-suggestion", "reject-suggestion":
+			hub.resolveSuggestion(c, inMsg.SuggestionID, inMsg.Type == "accept-suggestion")
+
+		case "undo", "redo":
+			hub.undo(c, inMsg.Path, inMsg.Type == "redo")
+
 		case "cursor-move":
 			// Broadcast cursor position to other clients
 			outMsg := OutgoingMessage{
 				Type:   "cursor-update",
 				UserID: c.ID,
 				Cursor: inMsg.Cursor,
+				Color:  c.color,
+			}
+			if hub.config.CursorBatch > 0 {
+				hub.batchCursor(c.SessionID, CursorPosition{UserID: c.ID, Cursor: inMsg.Cursor, Color: c.color})
+				hub.publishCursor(c.SessionID, outMsg)
+				continue
 			}
 			msgBytes, err := json.Marshal(outMsg)
 			if err != nil {
@@ -287,21 +1436,76 @@ func (c *Client) readPump(hub *Hub) {
 				SessionID: c.SessionID,
 				Message:   msgBytes,
 				Sender:    c,
+				Cursor:    c.ID,
 			}
+			hub.publishCursor(c.SessionID, outMsg)
 		}
 	}
 }
 
-// Write messages to WebSocket
-func (c *Client) writePump() {
+// Write messages to WebSocket, and ping it every PingInterval. At
+// shutdown, what is queued is written and the connection closed with a
+// close frame.
+func (c *Client) writePump(hub *Hub) {
 	defer func() {
 		c.Conn.Close()
 	}()
 
-	for message := range c.Send {
-		if err := c.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
-			log.Printf("Error writing to client %s: %v", c.ID, err)
-			break
+	var pings <-chan time.Time
+	if hub.config.PingInterval > 0 {
+		ticker := time.NewTicker(hub.config.PingInterval)
+		defer ticker.Stop()
+		pings = ticker.C
+	}
+	for {
+		select {
+		case <-c.Send.Ready():
+			message, ok := c.Send.Pop()
+			if !ok {
+				if c.Send.Drained() {
+					return
+				}
+				continue
+			}
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.Conn.WriteMessage(c.frame(message)); err != nil {
+				log.Printf("Error writing to client %s: %v", c.ID, err)
+				return
+			}
+		case <-pings:
+			if err := c.ping(); err != nil {
+				return
+			}
+		case <-c.lagging:
+			go hub.quarantine(c)
+		case frame := <-c.closing:
+			c.flushSend()
+			c.Conn.WriteControl(websocket.CloseMessage, frame, time.Now().Add(writeWait))
+			return
+		}
+	}
+}
+
+// disconnect has writePump send the client what is queued and then close
+// the connection with code. Only the first call counts.
+func (c *Client) disconnect(code int, reason string) {
+	select {
+	case c.closing <- websocket.FormatCloseMessage(code, reason):
+	default:
+	}
+}
+
+// flushSend writes the messages queued for the client, without waiting
+// for more
+func (c *Client) flushSend() {
+	for {
+		message, ok := c.Send.Pop()
+		if !ok {
+			return
+		}
+		c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := c.Conn.WriteMessage(c.frame(message)); err != nil {
+			return
 		}
 	}
 }
@@ -310,6 +1514,19 @@ func handleWebSocket(hub *Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		sessionID := c.Param("sessionId")
 		log.Printf("WebSocket connection request for session: %s", sessionID)
+		if isLobby(sessionID) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "lobbies are joined through /lobby"})
+			return
+		}
+		if !hub.accepting(c) {
+			return
+		}
+		if hub.relayHome(c, sessionID) {
+			return
+		}
+		if !hub.admitting(c, sessionID) {
+			return
+		}
 
 		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 		if err != nil {
@@ -317,63 +1534,201 @@ func handleWebSocket(hub *Hub) gin.HandlerFunc {
 			return
 		}
 
-		// Generate client ID (in production, use proper UUID)
-		clientID := generateClientID()
-
-		client := &Client{
-			ID:        clientID,
-			Conn:      conn,
-			SessionID: sessionID,
-			Username:  "User-" + clientID[:8], // Extract username from token in production
-			Send:      make(chan []byte, 256),
-		}
+		locale := hub.catalogs.Negotiate(append([]string{c.Query("locale")}, i18n.ParseAcceptLanguage(c.GetHeader("Accept-Language"))...)...)
+		client := newClient(hub, conn, sessionID, locale)
+		client.userAgent, client.addr = c.Request.UserAgent(), c.ClientIP()
+		client.resume = c.Query("resume")
+		client.msgpack = conn.Subprotocol() == subprotocolMessagePack
 
 		hub.register <- client
 
 		// Start read and write pumps
-		go client.writePump()
+		go client.writePump(hub)
 		go client.readPump(hub)
 	}
 }
 
+// newClient sets up a connection to a session, under a placeholder name
+// until it says who it is
+func newClient(hub *Hub, conn clientConn, sessionID, locale string) *Client {
+	// Generate client ID (in production, use proper UUID)
+	clientID := generateClientID()
+	c := &Client{
+		ID:        clientID,
+		Conn:      conn,
+		SessionID: sessionID,
+		Username:  "User-" + clientID[:8], // Extract username from token in production
+		Role:      hub.unverifiedRole(),
+		Locale:    locale,
+
+		ViewStates: make(map[string]*ViewState),
+		Send:       outbox.New(256),
+		registered: make(chan struct{}),
+		limiter:    ratelimit.New(hub.config.MessageRate, hub.config.MessageBurst),
+		budgets:    hub.newBudgets(),
+		throttled:  make(map[string]bool),
+		strikes:    hub.newStrikes(),
+		status:     StatusActive,
+		closing:    make(chan []byte, 1),
+		lagging:    make(chan struct{}, 1),
+
+		connectedAt: time.Now(),
+	}
+	hub.connections.Add(1)
+	now := time.Now().UnixNano()
+	c.lastSeen.Store(now)
+	c.lastInput.Store(now)
+	return c
+}
+
 func generateClientID() string {
 	// Simple ID generation (use UUID in production)
 	return fmt.Sprintf("%d", time.Now().UnixNano())
 }
 
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8002"
+	config := loadConfig()
+
+	blobs, err := blob.NewFileStore(config.BlobDir)
+	if err != nil {
+		log.Fatal("Failed to open blob store:", err)
+	}
+	if config.BlobURL != "" {
+		if err := blobs.Publish(config.BlobURL, config.BlobURLSecret); err != nil {
+			log.Fatal("Failed to publish blob store:", err)
+		}
+	}
+	prefBlobs, err := blob.NewFileStore(config.PreferencesDir)
+	if err != nil {
+		log.Fatal("Failed to open preference store:", err)
+	}
+
+	key, err := secrets.ParseKey(config.EnvEncryptionKey)
+	if err != nil {
+		log.Fatal("Invalid ENV_ENCRYPTION_KEY:", err)
+	}
+	if config.EnvEncryptionKey == "" {
+		log.Printf("ENV_ENCRYPTION_KEY not set; using a random key for this process")
+	}
+	box, err := secrets.NewBox(key)
+	if err != nil {
+		log.Fatal("Invalid ENV_ENCRYPTION_KEY:", err)
+	}
+
+	sandboxes, err := newSandboxPool(config)
+	if err != nil {
+		log.Fatal("Failed to set up sandbox driver:", err)
+	}
+	defer sandboxes.Close()
+
+	registries, err := deps.ParseRegistries(config.InstallRegistries)
+	if err != nil {
+		log.Fatal("Invalid INSTALL_REGISTRIES:", err)
+	}
+
+	regions, err := parseRegions(config.RegionEndpoints)
+	if err != nil {
+		log.Fatal("Invalid REGION_ENDPOINTS:", err)
+	}
+	if _, ok := regions[config.Region]; config.Region != "" && len(regions) > 0 && !ok {
+		log.Fatalf("REGION %s is not one of REGION_ENDPOINTS", config.Region)
+	}
+
+	if !validDuplicatePolicy(config.DuplicateConnections) {
+		log.Fatalf("DUPLICATE_CONNECTIONS must be allow, replace or reject, not %q", config.DuplicateConnections)
+	}
+
+	lspCommands, err := parseLanguageServers(config.LSPServers)
+	if err != nil {
+		log.Fatal("Invalid LSP_SERVERS:", err)
+	}
+
+	policies, err := loadNetworkPolicies(config)
+	if err != nil {
+		log.Fatal("Invalid network policies:", err)
 	}
 
-	hub := newHub()
+	catalogs, err := i18n.Load()
+	if err != nil {
+		log.Fatal("Invalid message catalogs:", err)
+	}
+
+	var sessions *store.Store
+	if config.DatabaseURL != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		sessions, err = store.Open(ctx, config.DatabaseURL, breaker.New(config.BreakerThreshold, config.BreakerCooldown))
+		cancel()
+		if err != nil {
+			log.Fatal("Failed to open session store:", err)
+		}
+		defer sessions.Close()
+	}
+	if config.DataDir != "" {
+		log.Printf("Running self-hosted, keeping data in %s", config.DataDir)
+	}
+
+	var peers *backplane.Backplane
+	if config.RedisURL != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		peers, err = backplane.Open(ctx, config.RedisURL, breaker.New(config.BreakerThreshold, config.BreakerCooldown))
+		cancel()
+		if err != nil {
+			log.Fatal("Failed to connect to the backplane:", err)
+		}
+		defer peers.Close()
+	}
+
+	var recordings *recording.Store
+	if config.RecordSessions {
+		recordings, err = recording.NewStore(config.RecordingDir)
+		if err != nil {
+			log.Fatal("Failed to open recording store:", err)
+		}
+	}
+
+	var imports *resumable.Store
+	if config.MaxImportBytes > 0 {
+		imports, err = resumable.NewStore(config.ImportDir, config.ImportTTL)
+		if err != nil {
+			log.Fatal("Failed to open import store:", err)
+		}
+	}
+
+	hub := newHub(config, blobs, box, sandboxes, deps.NewInstaller(registries), policies, catalogs, prefs.NewStore(prefBlobs), sessions, peers, recordings, imports, regions, lspCommands)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	if err := hub.loadDeprovisioned(ctx); err != nil {
+		log.Printf("Failed to load deprovisioned users, refusing none until the next sweep: %v", err)
+	}
+	cancel()
 	go hub.run()
+	go hub.recoverSessions()
+	go hub.runDegraded()
+	go hub.runPresence()
+	go hub.runStatuses()
+	go hub.runPeers()
+	go hub.runRecordingCompaction()
+	go hub.runSnapshots()
+	go hub.runDirectory()
+	go hub.runImports()
+	go hub.serveEgressProxy()
+
+	router := newRouter(hub)
+	server := &http.Server{Addr: ":" + config.Port, Handler: router}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	go func() {
+		log.Printf("Collaboration Service starting on port %s", config.Port)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("Failed to start server:", err)
+		}
+	}()
+
+	edges := hub.serveEdges()
 
-	router := gin.Default()
-
-	// Health check
-	router.GET("/health", func(c *gin.Context) {
-		c.JSON(200, gin.H{
-			"status":  "healthy",
-			"service": "collab-service",
-		})
-	})
-
-	// Root
-	router.GET("/", func(c *gin.Context) {
-		c.JSON(200, gin.H{
-			"service": "collab-service",
-			"status":  "running",
-			"version": "0.1.0",
-		})
-	})
-
-	// WebSocket endpoint
-	router.GET("/ws/:sessionId", handleWebSocket(hub))
-
-	log.Printf("Collaboration Service starting on port %s", port)
-	if err := router.Run(":" + port); err != nil {
-		log.Fatal("Failed to start server:", err)
+	<-ctx.Done()
+	stop()
+	hub.shutdown(server)
+	if edges != nil {
+		edges.Stop()
 	}
 }
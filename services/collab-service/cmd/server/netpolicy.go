@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/codecollab/collab-service/internal/egress"
+	"github.com/codecollab/collab-service/internal/netpolicy"
+)
+
+// loadNetworkPolicies reads the configured policy file. Only dedicated
+// sandbox drivers can enforce restrictions, since the shared execution
+// service runs every session's code side by side.
+func loadNetworkPolicies(config Config) (*netpolicy.Policies, error) {
+	if config.NetworkPolicyFile == "" {
+		return netpolicy.Unrestricted(), nil
+	}
+	policies, err := netpolicy.Load(config.NetworkPolicyFile)
+	if err != nil {
+		return nil, err
+	}
+	if policies.Restricted() && config.SandboxDriver == "service" {
+		return nil, fmt.Errorf("restricting network access needs a dedicated sandbox driver, not %q", config.SandboxDriver)
+	}
+	return policies, nil
+}
+
+// sessionPolicyLocked returns the network policy of a session's sandbox.
+// Caller must hold session.mu.
+func (h *Hub) sessionPolicyLocked(s *Session) netpolicy.Policy {
+	return h.policies.For(s.Org)
+}
+
+// networkEnv points a run's HTTP clients at the egress proxy when its
+// policy only allows some hosts
+func (h *Hub) networkEnv(policy netpolicy.Policy) map[string]string {
+	if policy.Mode != netpolicy.Allowlist {
+		return nil
+	}
+	return map[string]string{
+		"HTTP_PROXY":  h.config.EgressProxyURL,
+		"HTTPS_PROXY": h.config.EgressProxyURL,
+		"http_proxy":  h.config.EgressProxyURL,
+		"https_proxy": h.config.EgressProxyURL,
+	}
+}
+
+// sandboxPolicy finds the policy of the sandbox at addr, for the egress
+// proxy
+func (h *Hub) sandboxPolicy(addr string) (netpolicy.Policy, bool) {
+	sessionID, ok := h.sandboxes.SessionAt(addr)
+	if !ok {
+		return netpolicy.Policy{}, false
+	}
+	session, exists := h.getSession(sessionID)
+	if !exists {
+		return netpolicy.Policy{}, false
+	}
+
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+	return h.sessionPolicyLocked(session), true
+}
+
+// serveEgressProxy serves the egress proxy when some policy needs it
+func (h *Hub) serveEgressProxy() {
+	if !h.policies.Restricted() {
+		return
+	}
+	log.Printf("Egress proxy listening on port %s", h.config.EgressProxyPort)
+	if err := http.ListenAndServe(":"+h.config.EgressProxyPort, egress.New(h.sandboxPolicy)); err != nil {
+		log.Fatal("Egress proxy failed:", err)
+	}
+}
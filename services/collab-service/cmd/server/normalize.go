@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// EditWarning describes a fix or rejection applied to an incoming edit
+type EditWarning struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Warning codes sent in "edit-warning" messages
+const (
+	WarnInvalidUTF8       = "invalid-utf8"
+	WarnMixedLineEndings  = "mixed-line-endings"
+	WarnLineEndingsFixed  = "line-endings-normalized"
+	WarnByteOrderMarkDrop = "bom-removed"
+)
+
+// normalizeEdit validates and normalizes an edit against the session
+// settings. rawValid reports whether the raw frame was valid UTF-8; the JSON
+// decoder has already substituted U+FFFD for bad sequences by the time the
+// code reaches us. ok is false when the edit must be rejected.
+func normalizeEdit(settings EditorSettings, code string, rawValid bool, policy string) (normalized string, warnings []EditWarning, ok bool) {
+	if !rawValid || !utf8.ValidString(code) {
+		if policy == "reject" {
+			return "", []EditWarning{{
+				Code:    WarnInvalidUTF8,
+				Message: "edit rejected: content is not valid UTF-8",
+			}}, false
+		}
+		code = strings.ToValidUTF8(code, "\uFFFD")
+		warnings = append(warnings, EditWarning{
+			Code:    WarnInvalidUTF8,
+			Message: "invalid UTF-8 sequences were replaced with U+FFFD",
+		})
+	}
+
+	if strings.HasPrefix(code, utf8BOM) {
+		warnings = append(warnings, EditWarning{
+			Code:    WarnByteOrderMarkDrop,
+			Message: "leading byte order mark was removed",
+		})
+	}
+
+	crlf := strings.Count(code, "\r\n")
+	lf := strings.Count(code, "\n") - crlf
+	cr := strings.Count(code, "\r") - crlf
+	switch {
+	case crlf > 0 && (lf > 0 || cr > 0):
+		warnings = append(warnings, EditWarning{
+			Code:    WarnMixedLineEndings,
+			Message: "mixed line endings were normalized to " + settings.LineEnding,
+		})
+	case settings.LineEnding == LineEndingLF && (crlf > 0 || cr > 0),
+		settings.LineEnding == LineEndingCRLF && (lf > 0 || cr > 0):
+		warnings = append(warnings, EditWarning{
+			Code:    WarnLineEndingsFixed,
+			Message: "line endings were converted to " + settings.LineEnding,
+		})
+	}
+
+	return settings.normalizeImport(code), warnings, true
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// cellMarker starts a new cell, following the "percent" notebook format
+// (`# %%`, `// %%`, ...) so notebooks stay plain text files
+var cellMarker = regexp.MustCompile(`^\s*(#|//|--|;)\s*%%`)
+
+// notebookLanguages are the languages whose cells can be replayed to
+// rebuild interpreter state
+var notebookLanguages = map[string]bool{
+	"python":     true,
+	"javascript": true,
+	"typescript": true,
+	"elixir":     true,
+}
+
+// Cell is one executable section of a notebook document. Lines are 1-based
+// and inclusive.
+type Cell struct {
+	Index     int    `json:"index"`
+	StartLine int    `json:"startLine"`
+	EndLine   int    `json:"endLine"`
+	Source    string `json:"-"`
+}
+
+// CellOutput is the result of running a cell
+type CellOutput struct {
+	Cell          int       `json:"cell"`
+	Status        string    `json:"status"`
+	Stdout        string    `json:"stdout,omitempty"`
+	Stderr        string    `json:"stderr,omitempty"`
+	ExitCode      int       `json:"exitCode"`
+	ExecutionTime float64   `json:"executionTime,omitempty"`
+	RunID         string    `json:"runId,omitempty"`
+	RunBy         string    `json:"runBy,omitempty"`
+	FinishedAt    time.Time `json:"finishedAt,omitzero"`
+	// CachedAt is set when the output was reused from an identical run
+	CachedAt time.Time `json:"cachedAt,omitzero"`
+}
+
+// Cell output statuses
+const (
+	CellRunning   = "running"
+	CellDone      = "done"
+	CellError     = "error"
+	CellCancelled = "cancelled"
+)
+
+// Kernel is the execution state of one notebook file. The execution
+// service is stateless, so state is rebuilt on each run by replaying the
+// cells that already ran, and only the new part of stdout is attributed to
+// the cell being run.
+type Kernel struct {
+	History []string
+	Stdout  string
+	Outputs map[int]*CellOutput
+	Running bool
+}
+
+// splitCells splits content on cell markers. Text before the first marker
+// is a cell of its own if it isn't blank.
+func splitCells(content string) []Cell {
+	lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	var cells []Cell
+	start := 0
+	flush := func(end int) {
+		source := strings.Join(lines[start:end], "\n")
+		if start == 0 && strings.TrimSpace(source) == "" && end < len(lines) {
+			return
+		}
+		if end > start {
+			cells = append(cells, Cell{Index: len(cells), StartLine: start + 1, EndLine: end, Source: source})
+		}
+	}
+	for i, line := range lines {
+		if i > start && cellMarker.MatchString(line) {
+			flush(i)
+			start = i
+		}
+	}
+	flush(len(lines))
+	return cells
+}
+
+// setNotebookMode turns notebook mode on or off for the session
+func (h *Hub) setNotebookMode(c *Client, enabled bool) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	if session.roleLocked(c) != RoleOwner {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: "only the session owner can change notebook mode"})
+		return
+	}
+	session.Notebook = enabled
+	var paths []string
+	for filePath, file := range session.Files {
+		if !file.Binary {
+			paths = append(paths, filePath)
+		}
+	}
+	session.mu.Unlock()
+
+	log.Printf("Session %s notebook mode set to %t by %s", c.SessionID, enabled, c.ID)
+	h.broadcastToSession(c.SessionID, OutgoingMessage{Type: "notebook-mode", Enabled: enabled})
+	if enabled {
+		for _, filePath := range paths {
+			h.broadcastCells(c.SessionID, filePath)
+		}
+	}
+}
+
+func (h *Hub) sendNotebookMode(c *Client) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	enabled := session.Notebook
+	session.mu.RUnlock()
+
+	if enabled {
+		h.sendToClient(c, OutgoingMessage{Type: "notebook-mode", Enabled: true})
+	}
+}
+
+// sendCells sends the cell layout and existing outputs of a file that was
+// just opened, when the session is in notebook mode
+func (h *Hub) sendCells(c *Client, file *File) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	enabled := session.Notebook
+	var outputs []*CellOutput
+	if kernel, ok := session.Kernels[file.Path]; ok {
+		for _, output := range kernel.Outputs {
+			copied := *output
+			outputs = append(outputs, &copied)
+		}
+	}
+	session.mu.RUnlock()
+
+	if !enabled || file.Binary {
+		return
+	}
+	sort.Slice(outputs, func(i, j int) bool { return outputs[i].Cell < outputs[j].Cell })
+
+	h.sendToClient(c, OutgoingMessage{Type: "cells-update", Path: file.Path, Cells: splitCells(file.Content)})
+	for _, output := range outputs {
+		h.sendToClient(c, OutgoingMessage{Type: "cell-output", Path: file.Path, Output: output})
+	}
+}
+
+// broadcastCells sends the cell layout of a file to everyone who can see
+// it, when the session is in notebook mode
+func (h *Hub) broadcastCells(sessionID, filePath string) {
+	session, exists := h.getSession(sessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	file, ok := session.Files[filePath]
+	var cells []Cell
+	if ok && session.Notebook && !file.Binary {
+		cells = splitCells(file.Content)
+	}
+	session.mu.RUnlock()
+
+	if cells == nil {
+		return
+	}
+	h.broadcastToReaders(sessionID, "", filePath, OutgoingMessage{
+		Type:  "cells-update",
+		Path:  filePath,
+		Cells: cells,
+	})
+}
+
+// runCell executes one cell on the file's kernel and syncs its output to
+// everyone who can see the file
+func (h *Hub) runCell(c *Client, filePath string, index int) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	role := session.roleLocked(c)
+	file, err := session.visibleFileLocked(filePath, role)
+	fail := func(msg string) {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Path: filePath, Error: msg})
+	}
+	switch {
+	case err != nil:
+		fail(err.Error())
+		return
+	case !session.Notebook:
+		fail("notebook mode is not enabled")
+		return
+	case role == RoleViewer:
+		fail("viewers cannot run cells")
+		return
+	case file.Binary || !notebookLanguages[fileLanguage(file)]:
+		fail("notebook cells are not supported for this file type")
+		return
+	}
+
+	cells := splitCells(file.Content)
+	if index < 0 || index >= len(cells) {
+		fail("cell does not exist")
+		return
+	}
+
+	kernel := session.kernelLocked(file.Path)
+	if kernel.Running {
+		fail("another cell is still running")
+		return
+	}
+	kernel.Running = true
+	history := append([]string(nil), kernel.History...)
+	previousStdout := kernel.Stdout
+	source := cells[index].Source
+	language := fileLanguage(file)
+	filePath = file.Path
+	registry, lang, err := h.resolveLanguageLocked(session, file, language)
+	var env map[string]string
+	var secrets []string
+	if err == nil {
+		env, secrets, err = h.runEnvLocked(session)
+	}
+	if err != nil {
+		kernel.Running = false
+		fail(err.Error())
+		return
+	}
+	cell := index
+	run := &Run{Kind: RunKindCell, Path: filePath, Cell: &cell, Language: language, Command: source, RunBy: c.Username, role: role, subject: c.subject()}
+	h.startRunLocked(session, run, env)
+	running := &CellOutput{Cell: index, Status: CellRunning, RunID: run.ID, RunBy: c.Username}
+	kernel.Outputs[index] = running
+	session.mu.Unlock()
+
+	h.broadcastToReaders(c.SessionID, "", filePath, OutgoingMessage{Type: "cell-output", Path: filePath, Output: running})
+
+	go func() {
+		program := strings.Join(append(history, source), "\n")
+		// Cells always use the language's first build; matrices only
+		// apply to whole-file runs
+		result, err := h.execute(session, run, buildRequest(registry.Builds(lang)[0], program, env))
+
+		output := &CellOutput{Cell: index, RunID: run.ID, RunBy: c.Username, FinishedAt: time.Now()}
+		if err != nil {
+			output.Status = CellError
+			output.Stderr = err.Error()
+			output.ExitCode = -1
+		} else {
+			output.Status = CellDone
+			output.Stdout = maskSecrets(strings.TrimPrefix(result.Stdout, previousStdout), secrets)
+			output.Stderr = maskSecrets(result.Stderr, secrets)
+			output.ExitCode = result.ExitCode
+			output.ExecutionTime = result.ExecutionTime
+			output.CachedAt = run.CachedAt
+			if result.ExitCode != 0 {
+				output.Status = CellError
+			}
+		}
+
+		session.mu.Lock()
+		if run.CancelledBy != "" {
+			output.Status = CellCancelled
+		}
+		kernel.Running = false
+		kernel.Outputs[index] = output
+		h.finishRunLocked(run, output.Stdout, output.Stderr, output.ExitCode, output.ExecutionTime)
+		// Only cells that succeeded become part of the replayed state
+		if output.Status == CellDone {
+			kernel.History = append(kernel.History, source)
+			kernel.Stdout = result.Stdout
+		}
+		session.mu.Unlock()
+
+		h.broadcastToReaders(c.SessionID, "", filePath, OutgoingMessage{Type: "cell-output", Path: filePath, Output: output})
+		for _, port := range detectListeningPorts(output.Stdout + output.Stderr) {
+			if err := h.openPortPreview(session, port, c.Username); err != nil {
+				log.Printf("Failed to expose port %d for session %s: %v", port, c.SessionID, err)
+			}
+		}
+	}()
+}
+
+// restartKernel discards a notebook's interpreter state and outputs
+func (h *Hub) restartKernel(c *Client, filePath string) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	role := session.roleLocked(c)
+	file, err := session.visibleFileLocked(filePath, role)
+	if err == nil && role == RoleViewer {
+		err = fmt.Errorf("viewers cannot restart kernels")
+	}
+	if err != nil {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Path: filePath, Error: err.Error()})
+		return
+	}
+	if kernel, ok := session.Kernels[file.Path]; ok && kernel.Running {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Path: file.Path, Error: "wait for the running cell to finish"})
+		return
+	}
+	delete(session.Kernels, file.Path)
+	session.mu.Unlock()
+
+	h.broadcastToReaders(c.SessionID, "", file.Path, OutgoingMessage{Type: "kernel-restarted", Path: file.Path})
+}
+
+// kernelLocked returns the kernel of a file, creating it on first use.
+// Caller must hold session.mu.
+func (s *Session) kernelLocked(filePath string) *Kernel {
+	kernel, ok := s.Kernels[filePath]
+	if !ok {
+		kernel = &Kernel{Outputs: make(map[int]*CellOutput)}
+		s.Kernels[filePath] = kernel
+	}
+	return kernel
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"unicode/utf8"
+
+	"github.com/codecollab/collab-service/internal/ot"
+)
+
+// maxOperationEdits bounds the edits in one operation message
+const maxOperationEdits = 1000
+
+// applyOperation transforms a client's edits, made against revision of a
+// file, past everything applied since and applies them. The sender gets an
+// "operation-ack" with the new revision and everyone else who can see the
+// file the transformed "operation", so all copies converge.
+//
+// Acks and operations are queued while the session is locked, so each
+// client receives revisions in order. A client that sees a gap, or gets
+// an error for a stale revision, reopens the file.
+func (h *Hub) applyOperation(c *Client, filePath string, revision int, edits []ot.Edit) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	file, err := session.editableFileLocked(c, filePath)
+	if err == nil && len(edits) > maxOperationEdits {
+		err = fmt.Errorf("at most %d edits are allowed per operation", maxOperationEdits)
+	}
+	var op ot.Operation
+	var content string
+	if err == nil {
+		op, err = file.doc.Rebase(revision, utf8.RuneCountInString(file.Content), edits)
+	}
+	if err == nil {
+		content, err = op.Apply(file.Content)
+	}
+	if err == nil {
+		err = h.checkQuotaLocked(session, 0, len(content)-len(file.Content))
+	}
+	if err != nil {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Path: filePath, Revision: revision, Error: err.Error()})
+		return
+	}
+
+	normalized, warnings, _ := normalizeEdit(session.Settings, content, true, h.config.InvalidUTF8Policy)
+	if session.suggestingLocked(c) {
+		err := session.suggestLocked(c, file, normalized)
+		session.mu.Unlock()
+		if err != nil {
+			h.sendToClient(c, OutgoingMessage{Type: "error", Path: filePath, Revision: revision, Error: err.Error()})
+		}
+		return
+	}
+	if h.isLargeEdit(file, normalized) && !isTrustedLocked(session, c) {
+		pending := session.holdEdit(c, file, normalized)
+		pending.Resync = true
+		current, currentRevision := file.Content, file.doc.Revision()
+		session.mu.Unlock()
+
+		h.requestApproval(c, pending)
+		h.sendToClient(c, OutgoingMessage{Type: "code-update", Path: file.Path, Code: current, Revision: currentRevision})
+		return
+	}
+
+	session.recordEditLocked(c.ID, c.Username, file, normalized)
+	h.watchEditLocked(session, c, file, normalized)
+	h.recordChangeLocked(session, auditEdit, c.ID, c.Username, file, normalized)
+	file.applyOperation(op, content, c.Username, c.identity())
+	sendLocked(c, OutgoingMessage{Type: "operation-ack", Path: file.Path, Revision: file.doc.Revision()})
+	session.broadcastToReadersLocked(c.ID, file, OutgoingMessage{
+		Type:     "operation",
+		UserID:   c.ID,
+		Path:     file.Path,
+		Revision: file.doc.Revision(),
+		Ops:      op.Edits(),
+	})
+	if normalized != content {
+		// Normalizing is a revision of its own, which the sender needs too
+		fix := ot.FromDiff(content, normalized)
+		file.applyOperation(fix, normalized, c.Username, c.identity())
+		session.broadcastToReadersLocked("", file, OutgoingMessage{
+			Type:     "operation",
+			UserID:   c.ID,
+			Path:     file.Path,
+			Revision: file.doc.Revision(),
+			Ops:      fix.Edits(),
+		})
+	}
+	session.mu.Unlock()
+
+	if len(warnings) > 0 {
+		h.sendToClient(c, OutgoingMessage{Type: "edit-warning", Warnings: warnings})
+	}
+	h.fileChanged(c.SessionID, file.Path)
+	h.scheduleSummaries(session)
+}
+
+// broadcastChangeLocked sends the readers of a file, but the client that
+// made it, a change to the file recorded as op: as an operation, like
+// those clients send, or as the whole file when that's no larger. A client
+// that finds it can't apply an operation opens the file again for all of
+// it. Caller must hold session.mu.
+func (s *Session) broadcastChangeLocked(senderID string, file *File, op ot.Operation) {
+	edits := op.Edits()
+	outMsg := OutgoingMessage{
+		Type:     "operation",
+		UserID:   senderID,
+		Path:     file.Path,
+		Revision: file.doc.Revision(),
+		Ops:      edits,
+	}
+	if encoded, err := json.Marshal(edits); err != nil || len(encoded) >= len(file.Content) {
+		outMsg = OutgoingMessage{
+			Type:     "code-update",
+			UserID:   senderID,
+			Path:     file.Path,
+			Code:     file.Content,
+			Revision: file.doc.Revision(),
+		}
+	}
+	s.broadcastToReadersLocked(senderID, file, outMsg)
+}
+
+// sendLocked queues a message for a client without taking the session
+// lock. Text in it isn't localized. Caller must hold session.mu.
+func sendLocked(client *Client, outMsg OutgoingMessage) {
+	msgBytes, err := json.Marshal(outMsg)
+	if err != nil {
+		log.Printf("Error marshaling %s: %v", outMsg.Type, err)
+		return
+	}
+	client.deliver(msgBytes)
+}
+
+// broadcastToReadersLocked is broadcastToReaders for callers already
+// holding the session lock. Caller must hold session.mu.
+func (s *Session) broadcastToReadersLocked(excludeID string, file *File, outMsg OutgoingMessage) {
+	msgBytes, err := json.Marshal(outMsg)
+	if err != nil {
+		log.Printf("Error marshaling %s: %v", outMsg.Type, err)
+		return
+	}
+	for _, client := range s.Clients {
+		if client.ID == excludeID || !file.visibleTo(s.roleLocked(client)) {
+			continue
+		}
+		// A resuming client is sent the operations it missed in one go
+		if client.resuming && outMsg.Type == "operation" {
+			continue
+		}
+		client.deliver(msgBytes)
+	}
+}
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/breaker"
+	"github.com/codecollab/collab-service/internal/recording"
+	"github.com/codecollab/collab-service/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+// archiveVersion is the version of the organization archive format this
+// server writes and reads
+const archiveVersion = 1
+
+// An organization archive is a gzipped tar of JSON files, for backups and
+// to move an organization to another deployment:
+//
+//	manifest.json                      archiveManifest, always first
+//	sessions/<id>.json                 archivedSession, with its history
+//	recordings/<id>/<recording>.jsonl  a recording's events, one per line
+//	lobby.json                         archivedLobby, if the lobby was kept
+//	slugs.json                         []archivedSlug
+//
+// Session IDs are path-escaped. Each session's recordings follow it, with
+// their snapshots whole, so they don't depend on the bases they were
+// stored against.
+
+// archiveManifest describes an archive
+type archiveManifest struct {
+	Version    int       `json:"version"`
+	Org        string    `json:"org"`
+	ExportedAt time.Time `json:"exportedAt"`
+}
+
+// archivedSession is what is kept of a session, as archived
+type archivedSession struct {
+	ID        string             `json:"id"`
+	Owner     string             `json:"owner"`
+	Metadata  json.RawMessage    `json:"metadata,omitempty"`
+	Documents []archivedDocument `json:"documents"`
+	History   json.RawMessage    `json:"history,omitempty"`
+	UpdatedAt time.Time          `json:"updatedAt"`
+}
+
+type archivedDocument struct {
+	Path      string            `json:"path"`
+	Content   string            `json:"content"`
+	Language  string            `json:"language,omitempty"`
+	Access    map[string]string `json:"access,omitempty"`
+	UpdatedAt time.Time         `json:"updatedAt"`
+}
+
+type archivedLobby struct {
+	Chat       json.RawMessage `json:"chat"`
+	NextChatID int             `json:"nextChatId"`
+	UpdatedAt  time.Time       `json:"updatedAt"`
+}
+
+type archivedSlug struct {
+	Slug      string    `json:"slug"`
+	SessionID string    `json:"sessionId"`
+	CreatedBy string    `json:"createdBy,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// OrgImport is what importing an archive did. Sessions and slugs the
+// organization already has are skipped rather than overwritten.
+type OrgImport struct {
+	Sessions        int      `json:"sessions"`
+	SkippedSessions []string `json:"skippedSessions"`
+	Recordings      int      `json:"recordings"`
+	Lobby           bool     `json:"lobby"`
+	Slugs           int      `json:"slugs"`
+	SkippedSlugs    []string `json:"skippedSlugs"`
+}
+
+func archiveSession(saved *store.Session) archivedSession {
+	archived := archivedSession{
+		ID:        saved.ID,
+		Owner:     saved.Owner,
+		Metadata:  saved.Metadata,
+		Documents: make([]archivedDocument, len(saved.Documents)),
+		History:   saved.History,
+		UpdatedAt: saved.UpdatedAt,
+	}
+	for i, doc := range saved.Documents {
+		archived.Documents[i] = archivedDocument(doc)
+	}
+	return archived
+}
+
+func (a archivedSession) stored(org string) *store.Session {
+	saved := &store.Session{
+		ID:        a.ID,
+		Owner:     a.Owner,
+		Org:       org,
+		Metadata:  a.Metadata,
+		Documents: make([]store.Document, len(a.Documents)),
+		History:   a.History,
+		UpdatedAt: a.UpdatedAt,
+	}
+	for i, doc := range a.Documents {
+		saved.Documents[i] = store.Document(doc)
+	}
+	return saved
+}
+
+// orgAdminCaller returns the verified token of an organization admin, or
+// responds 401 or 403
+func (h *Hub) orgAdminCaller(c *gin.Context, action string) (*tokenClaims, bool) {
+	claims := h.requestClaims(c)
+	if claims == nil || claims.Org == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "a valid token with an organization is required"})
+		return nil, false
+	}
+	if !claims.orgAdmin() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only organization admins can " + action})
+		return nil, false
+	}
+	if h.store == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "organization data is only kept with a database"})
+		return nil, false
+	}
+	return claims, true
+}
+
+// orgSessionIDs lists the sessions of an organization that are kept, and
+// those open here which aren't yet
+func (h *Hub) orgSessionIDs(ctx context.Context, org string) ([]string, error) {
+	ids, err := h.store.SessionIDs(ctx, org)
+	if err != nil {
+		return nil, err
+	}
+	listed := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		listed[id] = true
+	}
+	for _, session := range h.openSessions() {
+		session.mu.RLock()
+		if !session.Lobby && session.persist && session.Org == org && !listed[session.ID] {
+			ids = append(ids, session.ID)
+		}
+		session.mu.RUnlock()
+	}
+	return ids, nil
+}
+
+// exportedSession returns the newest of a session there is: as it is, if
+// it's open here, or what is waiting to be saved of it, or what is kept
+func (h *Hub) exportedSession(ctx context.Context, id string) (*store.Session, error) {
+	var snapshot *store.Session
+	if session, exists := h.getSession(id); exists {
+		session.mu.Lock()
+		if session.persist {
+			snapshot = h.snapshotLocked(session)
+		}
+		session.mu.Unlock()
+	}
+	if snapshot == nil {
+		h.mu.RLock()
+		snapshot = h.closing[id]
+		h.mu.RUnlock()
+	}
+	if snapshot == nil {
+		snapshot, _ = h.queuedSession(id)
+	}
+	if snapshot == nil {
+		saved, err := h.store.Load(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		snapshot = saved
+	}
+
+	if snapshot.History != nil {
+		return snapshot, nil
+	}
+	history, err := h.store.LoadHistory(ctx, id)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return nil, err
+	}
+	// The snapshot may be shared with the save waiting for it
+	withHistory := *snapshot
+	withHistory.History = history
+	return &withHistory, nil
+}
+
+// writeArchiveEntry adds a file to the archive
+func writeArchiveEntry(tw *tar.Writer, name string, data []byte) error {
+	header := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), ModTime: time.Now()}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// writeArchiveJSON adds v to the archive as a JSON file
+func writeArchiveJSON(tw *tar.Writer, name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeArchiveEntry(tw, name, data)
+}
+
+// archiveRecordings adds a session's recordings to the archive
+func (h *Hub) archiveRecordings(tw *tar.Writer, sessionID string) error {
+	if h.recordings == nil {
+		return nil
+	}
+	infos, err := h.recordings.List(sessionID)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		reader, err := h.recordings.Open(sessionID, info.ID)
+		if err != nil {
+			return err
+		}
+		var lines []byte
+		for {
+			event, err := reader.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				reader.Close()
+				return err
+			}
+			line, err := json.Marshal(event)
+			if err != nil {
+				reader.Close()
+				return err
+			}
+			lines = append(append(lines, line...), '\n')
+		}
+		reader.Close()
+		name := "recordings/" + url.PathEscape(sessionID) + "/" + info.ID + ".jsonl"
+		if err := writeArchiveEntry(tw, name, lines); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeOrgArchive writes the archive of an organization's sessions. It is
+// only finished if everything went in, so a failed export is a broken
+// archive rather than one missing something.
+func (h *Hub) writeOrgArchive(ctx context.Context, w io.Writer, org string, ids []string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	if err := writeArchiveJSON(tw, "manifest.json", archiveManifest{
+		Version:    archiveVersion,
+		Org:        org,
+		ExportedAt: time.Now().UTC(),
+	}); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		loadCtx, cancel := context.WithTimeout(ctx, persistTimeout)
+		snapshot, err := h.exportedSession(loadCtx, id)
+		cancel()
+		if errors.Is(err, store.ErrNotFound) {
+			// Deleted since it was listed
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("session %s: %w", id, err)
+		}
+		if err := writeArchiveJSON(tw, "sessions/"+url.PathEscape(id)+".json", archiveSession(snapshot)); err != nil {
+			return err
+		}
+		if err := h.archiveRecordings(tw, id); err != nil {
+			return fmt.Errorf("recordings of session %s: %w", id, err)
+		}
+	}
+
+	loadCtx, cancel := context.WithTimeout(ctx, persistTimeout)
+	defer cancel()
+	lobby, err := h.store.LoadLobby(loadCtx, org)
+	if err == nil {
+		if err := writeArchiveJSON(tw, "lobby.json", archivedLobby{
+			Chat:       lobby.Chat,
+			NextChatID: lobby.NextChatID,
+			UpdatedAt:  lobby.UpdatedAt,
+		}); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("lobby: %w", err)
+	}
+
+	slugs, err := h.store.Slugs(loadCtx, org)
+	if err != nil {
+		return fmt.Errorf("slugs: %w", err)
+	}
+	archived := make([]archivedSlug, len(slugs))
+	for i, slug := range slugs {
+		archived[i] = archivedSlug{Slug: slug.Slug, SessionID: slug.SessionID, CreatedBy: slug.CreatedBy, CreatedAt: slug.CreatedAt}
+	}
+	if err := writeArchiveJSON(tw, "slugs.json", archived); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// handleExportOrg streams an archive of everything kept of the admin's
+// organization: its sessions with their history and recordings, its
+// lobby's chat and its slugs
+func handleExportOrg(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := hub.orgAdminCaller(c, "export and import its data")
+		if !ok {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+		ids, err := hub.orgSessionIDs(ctx, claims.Org)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to list the sessions of %s for export: %v", claims.Org, err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "organization data is unavailable"})
+			return
+		}
+
+		name := fmt.Sprintf("%s-%s.tar.gz", claims.Org, time.Now().UTC().Format("20060102-150405"))
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		c.Header("Content-Type", "application/gzip")
+		c.Status(http.StatusOK)
+		if err := hub.writeOrgArchive(c.Request.Context(), c.Writer, claims.Org, ids); err != nil {
+			log.Printf("Export of %s failed: %v", claims.Org, err)
+			return
+		}
+		log.Printf("Exported %d sessions of %s for %s", len(ids), claims.Org, claims.Subject)
+	}
+}
+
+// importSession keeps an archived session for the organization, unless it
+// already has one by that ID
+func (h *Hub) importSession(ctx context.Context, org string, archived archivedSession) (bool, error) {
+	if archived.ID == "" || isLobby(archived.ID) {
+		return false, errors.New("archive has a session without a valid ID")
+	}
+	if _, exists := h.getSession(archived.ID); exists {
+		return false, nil
+	}
+	_, err := h.store.Load(ctx, archived.ID)
+	if err == nil {
+		return false, nil
+	}
+	if !errors.Is(err, store.ErrNotFound) {
+		return false, err
+	}
+	snapshot := archived.stored(org)
+	if err := h.store.Save(ctx, snapshot); err != nil {
+		return false, err
+	}
+	h.sessionSaved(snapshot)
+	return true, nil
+}
+
+// importRecording keeps an archived recording of a session, unless it is
+// already kept. Its ID is when it started, as its Start event says.
+func (h *Hub) importRecording(sessionID string, r io.Reader) (bool, error) {
+	dec := json.NewDecoder(r)
+	var start recording.Event
+	if err := dec.Decode(&start); err != nil || start.Kind != recording.Start {
+		return false, errors.New("recording doesn't begin with its start")
+	}
+	recorder, err := h.recordings.Start(sessionID, start.Owner, start.At)
+	if err != nil {
+		// Started before, so kept already
+		return false, nil
+	}
+	defer recorder.Close()
+	for {
+		var event recording.Event
+		err := dec.Decode(&event)
+		if errors.Is(err, io.EOF) {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if err := recorder.Append(event); err != nil {
+			return false, err
+		}
+	}
+}
+
+// importOrgArchive reads an archive into the organization, which needn't
+// be the one it was exported from
+func (h *Hub) importOrgArchive(ctx context.Context, r io.Reader, org string) (*OrgImport, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.New("not a gzipped archive")
+	}
+	tr := tar.NewReader(gz)
+
+	result := &OrgImport{SkippedSessions: []string{}, SkippedSlugs: []string{}}
+	imported := make(map[string]bool)
+	manifest := false
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return result, fmt.Errorf("reading the archive: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		saveCtx, cancel := context.WithTimeout(ctx, persistTimeout)
+		err = h.importArchiveEntry(saveCtx, tr, header.Name, org, &manifest, imported, result)
+		cancel()
+		if err != nil {
+			return result, fmt.Errorf("%s: %w", header.Name, err)
+		}
+	}
+	if !manifest {
+		return result, errors.New("archive has no manifest")
+	}
+	return result, nil
+}
+
+// importArchiveEntry imports one file of an archive
+func (h *Hub) importArchiveEntry(ctx context.Context, r io.Reader, name, org string, manifest *bool, imported map[string]bool, result *OrgImport) error {
+	if name == "manifest.json" {
+		var m archiveManifest
+		if err := json.NewDecoder(r).Decode(&m); err != nil {
+			return err
+		}
+		if m.Version != archiveVersion {
+			return fmt.Errorf("archive version %d isn't supported", m.Version)
+		}
+		*manifest = true
+		return nil
+	}
+	if !*manifest {
+		return errors.New("archive doesn't begin with its manifest")
+	}
+
+	switch {
+	case name == "lobby.json":
+		var archived archivedLobby
+		if err := json.NewDecoder(r).Decode(&archived); err != nil {
+			return err
+		}
+		_, err := h.store.LoadLobby(ctx, org)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, store.ErrNotFound) {
+			return err
+		}
+		if err := h.store.SaveLobby(ctx, &store.Lobby{
+			Org:        org,
+			Chat:       archived.Chat,
+			NextChatID: archived.NextChatID,
+			UpdatedAt:  archived.UpdatedAt,
+		}); err != nil {
+			return err
+		}
+		result.Lobby = true
+
+	case name == "slugs.json":
+		var archived []archivedSlug
+		if err := json.NewDecoder(r).Decode(&archived); err != nil {
+			return err
+		}
+		for _, slug := range archived {
+			err := h.store.ReserveSlug(ctx, &store.Slug{
+				Org:       org,
+				Slug:      slug.Slug,
+				SessionID: slug.SessionID,
+				CreatedBy: slug.CreatedBy,
+				CreatedAt: slug.CreatedAt,
+			})
+			if errors.Is(err, store.ErrSlugTaken) {
+				result.SkippedSlugs = append(result.SkippedSlugs, slug.Slug)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			result.Slugs++
+		}
+
+	case strings.HasPrefix(name, "sessions/") && strings.HasSuffix(name, ".json"):
+		var archived archivedSession
+		if err := json.NewDecoder(r).Decode(&archived); err != nil {
+			return err
+		}
+		ok, err := h.importSession(ctx, org, archived)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			result.SkippedSessions = append(result.SkippedSessions, archived.ID)
+			return nil
+		}
+		imported[archived.ID] = true
+		result.Sessions++
+
+	case strings.HasPrefix(name, "recordings/") && strings.HasSuffix(name, ".jsonl"):
+		sessionID, err := url.PathUnescape(path.Base(path.Dir(name)))
+		if err != nil || !imported[sessionID] || h.recordings == nil {
+			// Recordings of skipped sessions are skipped with them
+			return nil
+		}
+		ok, err := h.importRecording(sessionID, r)
+		if err != nil {
+			return err
+		}
+		if ok {
+			result.Recordings++
+		}
+	}
+	return nil
+}
+
+// handleImportOrg imports an archive another deployment, or this one,
+// exported into the admin's organization. What the organization already
+// has is left as it is.
+func handleImportOrg(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := hub.orgAdminCaller(c, "export and import its data")
+		if !ok {
+			return
+		}
+
+		body := io.Reader(c.Request.Body)
+		if limit := hub.config.OrgImportMaxBytes; limit > 0 {
+			body = http.MaxBytesReader(c.Writer, c.Request.Body, int64(limit))
+		}
+		result, err := hub.importOrgArchive(c.Request.Context(), body, claims.Org)
+		if errors.Is(err, breaker.ErrOpen) {
+			log.Printf("Import into %s failed: %v", claims.Org, err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "organization data is unavailable", "imported": result})
+			return
+		}
+		if err != nil {
+			log.Printf("Import into %s failed: %v", claims.Org, err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "import failed: " + err.Error(), "imported": result})
+			return
+		}
+		log.Printf("Imported %d sessions and %d recordings into %s for %s", result.Sessions, result.Recordings, claims.Org, claims.Subject)
+		c.JSON(http.StatusOK, result)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/codecollab/collab-service/internal/outline"
+)
+
+// fileLanguage returns the language a file is treated as
+func fileLanguage(file *File) string {
+	return outline.LanguageFromPath(file.Path)
+}
+
+// scheduleOutline debounces recomputing a file's outline and broadcasting
+// it to everyone who can see the file
+func (h *Hub) scheduleOutline(sessionID, filePath string) {
+	session, exists := h.getSession(sessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	file, ok := session.Files[filePath]
+	supported := ok && !file.Binary && outline.Supported(fileLanguage(file))
+	session.mu.RUnlock()
+	if !supported {
+		return
+	}
+
+	h.debounce(session, "outline:"+filePath, h.config.OutlineDebounce, func() {
+		session.mu.RLock()
+		file, ok := session.Files[filePath]
+		var symbols []outline.Symbol
+		if ok {
+			symbols = outline.Extract(fileLanguage(file), file.Content)
+		}
+		session.mu.RUnlock()
+
+		if ok {
+			h.broadcastToReaders(sessionID, "", filePath, OutgoingMessage{
+				Type:    "outline-update",
+				Path:    filePath,
+				Symbols: symbols,
+			})
+		}
+	})
+}
+
+// sendOutline sends the current outline of a file to one client
+func (h *Hub) sendOutline(c *Client, file *File) {
+	if file.Binary || !outline.Supported(fileLanguage(file)) {
+		return
+	}
+	h.sendToClient(c, OutgoingMessage{
+		Type:    "outline-update",
+		Path:    file.Path,
+		Symbols: outline.Extract(fileLanguage(file), file.Content),
+	})
+}
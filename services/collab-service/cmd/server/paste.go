@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/ot"
+)
+
+// PendingEdit is a large edit held until the session owner approves it. Op
+// is the edit, made against Revision of the file, so that it is rebased
+// past whatever others change in the meantime.
+type PendingEdit struct {
+	ID       string
+	ClientID string
+	Username string
+	// Undoer is whose undo history the edit goes to once approved
+	Undoer    string
+	Path      string
+	Op        ot.Operation
+	Revision  int
+	Size      int
+	CreatedAt time.Time
+	// Resync is set for edits held from an operation. The author's editor
+	// was reset to the file, so they get the approved content too.
+	Resync bool
+}
+
+// isLargeEdit reports whether replacing the file content with code changes
+// more than the configured threshold. Caller must hold session.mu.
+func (h *Hub) isLargeEdit(file *File, code string) bool {
+	if h.config.LargeEditBytes <= 0 {
+		return false
+	}
+	return editSize(file.Content, code) > h.config.LargeEditBytes
+}
+
+// editSize is how many bytes replacing before with after deletes and
+// inserts, leaving out what the two start and end with in common
+func editSize(before, after string) int {
+	prefix := 0
+	for prefix < len(before) && prefix < len(after) && before[prefix] == after[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(before)-prefix && suffix < len(after)-prefix && before[len(before)-1-suffix] == after[len(after)-1-suffix] {
+		suffix++
+	}
+	return len(before) + len(after) - 2*(prefix+suffix)
+}
+
+// isTrustedLocked reports whether c may apply large edits without approval.
+// Caller must hold session.mu.
+func isTrustedLocked(session *Session, c *Client) bool {
+	return session.roleLocked(c) == RoleOwner
+}
+
+// holdEdit parks an edit replacing the file content with code as pending.
+// A client only ever has one pending edit per file; newer edits replace the
+// held one. Caller must hold session.mu.
+func (s *Session) holdEdit(c *Client, file *File, code string) *PendingEdit {
+	op, revision, size := ot.FromDiff(file.Content, code), file.doc.Revision(), editSize(file.Content, code)
+	for _, pending := range s.PendingEdits {
+		if pending.ClientID == c.ID && pending.Path == file.Path {
+			pending.Op, pending.Revision, pending.Size = op, revision, size
+			return pending
+		}
+	}
+
+	s.nextEditID++
+	pending := &PendingEdit{
+		ID:        fmt.Sprintf("%s-%d", s.ID, s.nextEditID),
+		ClientID:  c.ID,
+		Username:  c.Username,
+		Undoer:    c.identity(),
+		Path:      file.Path,
+		Op:        op,
+		Revision:  revision,
+		Size:      size,
+		CreatedAt: time.Now(),
+	}
+	s.PendingEdits[pending.ID] = pending
+	return pending
+}
+
+// requestApproval tells the author their edit is held and asks the owner's
+// connections to approve it. If no owner is connected the edit is dropped.
+func (h *Hub) requestApproval(c *Client, pending *PendingEdit) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	var owners []*Client
+	for _, client := range session.Clients {
+		if session.roleLocked(client) == RoleOwner {
+			owners = append(owners, client)
+		}
+	}
+	session.mu.RUnlock()
+
+	if len(owners) == 0 {
+		session.mu.Lock()
+		delete(session.PendingEdits, pending.ID)
+		var current string
+		var revision int
+		if file, ok := session.Files[pending.Path]; ok {
+			current, revision = file.Content, file.doc.Revision()
+		}
+		session.mu.Unlock()
+
+		h.sendToClient(c, OutgoingMessage{
+			Type:   "edit-rejected",
+			EditID: pending.ID,
+			Error:  "edit exceeds the size limit and no session owner is available to approve it",
+		})
+		h.sendToClient(c, OutgoingMessage{Type: "code-update", Path: pending.Path, Code: current, Revision: revision})
+		return
+	}
+
+	log.Printf("Holding %d byte edit %s from %s for approval", pending.Size, pending.ID, c.ID)
+	h.sendToClient(c, OutgoingMessage{
+		Type:   "edit-pending",
+		EditID: pending.ID,
+		Path:   pending.Path,
+		Size:   pending.Size,
+	})
+	for _, owner := range owners {
+		h.sendToClient(owner, OutgoingMessage{
+			Type:     "edit-approval-request",
+			EditID:   pending.ID,
+			UserID:   pending.ClientID,
+			Username: pending.Username,
+			Path:     pending.Path,
+			Size:     pending.Size,
+		})
+	}
+}
+
+// resolvePendingEdit applies or discards a held edit on the owner's decision.
+// An approved edit is rebased past the changes made since it was held and
+// sent like any other; one that no longer applies is rejected.
+func (h *Hub) resolvePendingEdit(c *Client, editID string, approve bool) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	if !isTrustedLocked(session, c) {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: "only the session owner can resolve pending edits"})
+		return
+	}
+	pending, ok := session.PendingEdits[editID]
+	if !ok {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: "unknown pending edit"})
+		return
+	}
+	delete(session.PendingEdits, editID)
+	file, ok := session.Files[pending.Path]
+	if !ok || file.Binary {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Path: pending.Path, Error: "file can no longer be edited"})
+		return
+	}
+	author := session.Clients[pending.ClientID]
+	var applyErr error
+	if approve {
+		op, err := file.doc.Transform(pending.Revision, pending.Op)
+		var content string
+		if err == nil {
+			content, err = op.Apply(file.Content)
+		}
+		if err == nil {
+			err = h.checkQuotaLocked(session, 0, len(content)-len(file.Content))
+		}
+		if err != nil {
+			approve, applyErr = false, err
+		} else {
+			session.recordEditLocked(pending.ClientID, pending.Username, file, content)
+			h.recordChangeLocked(session, auditEdit, pending.ClientID, pending.Username, file, content)
+			file.applyOperation(op, content, pending.Username, pending.Undoer)
+			session.broadcastChangeLocked(pending.ClientID, file, op)
+			if pending.Resync && author != nil {
+				// The author's editor was reset to the file when the
+				// edit was held, so it needs the edit too
+				sendLocked(author, OutgoingMessage{
+					Type:     "operation",
+					UserID:   pending.ClientID,
+					Path:     file.Path,
+					Revision: file.doc.Revision(),
+					Ops:      op.Edits(),
+				})
+			}
+		}
+	}
+	current, revision := file.Content, file.doc.Revision()
+	session.mu.Unlock()
+
+	if applyErr != nil {
+		h.sendToClient(c, OutgoingMessage{Type: "error", EditID: editID, Error: applyErr.Error()})
+	}
+
+	if !approve {
+		log.Printf("Edit %s rejected by %s", editID, c.ID)
+		if author != nil {
+			outMsg := OutgoingMessage{Type: "edit-rejected", EditID: editID}
+			if applyErr != nil {
+				outMsg.Error = applyErr.Error()
+			}
+			h.sendToClient(author, outMsg)
+			h.sendToClient(author, OutgoingMessage{Type: "code-update", Path: pending.Path, Code: current, Revision: revision})
+		}
+		return
+	}
+
+	log.Printf("Edit %s approved by %s", editID, c.ID)
+	h.fileChanged(c.SessionID, pending.Path)
+	h.scheduleSummaries(session)
+	if author != nil {
+		h.sendToClient(author, OutgoingMessage{Type: "edit-approved", EditID: editID})
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/backplane"
+	"github.com/codecollab/collab-service/internal/recording"
+)
+
+// Backplane message kinds. A session's files, chat, cursors and
+// participants are shared between instances; the rest of its state, such
+// as runs and settings, stays with the instance that has it.
+const (
+	// peerHello is sent by an instance opening a session, for those
+	// already serving it to send their files and participants
+	peerHello = "hello"
+	// peerPresence carries who is connected to the sending instance
+	peerPresence = "presence"
+	peerFile     = "file"
+	peerChat     = "chat"
+	// peerChatChange carries an edit or deletion of a chat message
+	peerChatChange = "chat-change"
+	peerCursor     = "cursor"
+	// peerTyping carries a participant starting or stopping typing
+	peerTyping = "typing"
+)
+
+// Instances repeat who is connected to them every presenceHeartbeat, and
+// forget another instance's participants when it has been quiet for
+// peerTimeout
+const (
+	presenceHeartbeat = 10 * time.Second
+	peerTimeout       = 3 * presenceHeartbeat
+)
+
+// remoteNode is who is connected to a session on another instance
+type remoteNode struct {
+	participants []Participant
+	seen         time.Time
+}
+
+// peerFileState is a text file as sent between instances. The line
+// authors go along, so blame is the same everywhere.
+type peerFileState struct {
+	Path        string   `json:"path"`
+	Content     string   `json:"content"`
+	LineAuthors []string `json:"lineAuthors"`
+}
+
+// joinPeers subscribes to a session that was just opened and asks the
+// instances already serving it for its files and participants
+func (h *Hub) joinPeers(sessionID string) {
+	if h.peers == nil {
+		return
+	}
+	h.peers.Join(sessionID)
+	h.peers.Publish(sessionID, peerHello, nil)
+}
+
+// leavePeers tells the other instances that everyone here has left a
+// session, which is closing
+func (h *Hub) leavePeers(sessionID string) {
+	if h.peers == nil {
+		return
+	}
+	h.peers.Publish(sessionID, peerPresence, []Participant{})
+	h.peers.Leave(sessionID)
+}
+
+// localParticipantsLocked lists the clients connected to this instance.
+// Caller must hold session.mu.
+func (s *Session) localParticipantsLocked() []Participant {
+	participants := make([]Participant, 0, len(s.Clients))
+	for _, client := range s.Clients {
+		participants = append(participants, Participant{ID: client.ID, Username: client.Username, Color: client.color, Status: client.status})
+	}
+	return participants
+}
+
+// remoteParticipantsLocked lists the clients connected to the other
+// instances, in a stable order. Caller must hold session.mu.
+func (s *Session) remoteParticipantsLocked() []Participant {
+	nodes := make([]string, 0, len(s.remote))
+	for node := range s.remote {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	var participants []Participant
+	for _, node := range nodes {
+		participants = append(participants, s.remote[node].participants...)
+	}
+	return participants
+}
+
+// publishPresence tells the other instances who is connected here
+func (h *Hub) publishPresence(session *Session) {
+	if h.peers == nil {
+		return
+	}
+	session.mu.RLock()
+	participants := session.localParticipantsLocked()
+	session.mu.RUnlock()
+	h.peers.Publish(session.ID, peerPresence, participants)
+}
+
+// publishFile sends a text file's content to the other instances. What is
+// sent is the content when its version is assigned, which may be newer
+// than the change it was published for.
+func (h *Hub) publishFile(sessionID, filePath string) {
+	if h.peers == nil {
+		return
+	}
+	session, exists := h.getSession(sessionID)
+	if !exists {
+		return
+	}
+	h.peers.PublishLatest(sessionID, "file:"+filePath, peerFile, func(version int64) (any, bool) {
+		session.mu.Lock()
+		defer session.mu.Unlock()
+		file, ok := session.Files[filePath]
+		if !ok || file.Binary {
+			return nil, false
+		}
+		file.version = max(file.version, version)
+		return peerFileState{
+			Path:        file.Path,
+			Content:     file.Content,
+			LineAuthors: slices.Clone(file.LineAuthors),
+		}, true
+	})
+}
+
+// publishCursor relays a cursor move to the other instances
+func (h *Hub) publishCursor(sessionID string, outMsg OutgoingMessage) {
+	if h.peers == nil {
+		return
+	}
+	h.peers.Publish(sessionID, peerCursor, outMsg)
+}
+
+// runPeers applies what the other instances send, and keeps telling them
+// who is connected here
+func (h *Hub) runPeers() {
+	if h.peers == nil {
+		return
+	}
+	log.Printf("Sharing sessions through the backplane as %s", h.peers)
+	go h.peers.Receive(h.handlePeer)
+
+	ticker := time.NewTicker(presenceHeartbeat)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.mu.RLock()
+		sessions := make([]*Session, 0, len(h.sessions))
+		for _, session := range h.sessions {
+			sessions = append(sessions, session)
+		}
+		h.mu.RUnlock()
+
+		for _, session := range sessions {
+			h.publishPresence(session)
+			h.cacheParticipants(session)
+			session.mu.Lock()
+			expired := session.expireRemoteLocked(time.Now().Add(-peerTimeout))
+			session.mu.Unlock()
+			if expired {
+				h.sendParticipants(session)
+			}
+		}
+	}
+}
+
+// expireRemoteLocked forgets the instances not heard from since cutoff,
+// which have probably gone down, and reports whether there were any.
+// Caller must hold session.mu for writing.
+func (s *Session) expireRemoteLocked(cutoff time.Time) bool {
+	expired := false
+	for node, remote := range s.remote {
+		if remote.seen.Before(cutoff) {
+			delete(s.remote, node)
+			expired = true
+		}
+	}
+	return expired
+}
+
+// handlePeer applies a message from another instance to the session it is
+// about, if it is open here
+func (h *Hub) handlePeer(env backplane.Envelope) {
+	session, exists := h.getSession(env.Session)
+	if !exists {
+		return
+	}
+
+	switch env.Kind {
+	case peerHello:
+		h.publishPresence(session)
+		session.mu.RLock()
+		var paths []string
+		for filePath, file := range session.Files {
+			if !file.Binary {
+				paths = append(paths, filePath)
+			}
+		}
+		session.mu.RUnlock()
+		for _, filePath := range paths {
+			h.publishFile(session.ID, filePath)
+		}
+		h.publishShareLinks(session, "")
+
+	case peerPresence:
+		var participants []Participant
+		if err := json.Unmarshal(env.Data, &participants); err != nil {
+			log.Printf("Invalid presence from instance %s: %v", env.Node, err)
+			return
+		}
+		session.mu.Lock()
+		previous, known := session.remote[env.Node]
+		changed := !known || !slices.Equal(previous.participants, participants)
+		if len(participants) == 0 {
+			delete(session.remote, env.Node)
+		} else {
+			session.remote[env.Node] = &remoteNode{participants: participants, seen: time.Now()}
+		}
+		session.mu.Unlock()
+		if changed {
+			h.sendParticipants(session)
+		}
+
+	case peerShareLinks:
+		h.handlePeerShareLinks(session, env)
+
+	case peerClose:
+		h.handlePeerClose(session, env)
+
+	case peerOwner:
+		h.handlePeerOwner(session, env)
+
+	case peerFile:
+		var state peerFileState
+		if err := json.Unmarshal(env.Data, &state); err != nil {
+			log.Printf("Invalid file from instance %s: %v", env.Node, err)
+			return
+		}
+		h.applyPeerFile(session, env.Version, state)
+
+	case peerChat:
+		var msg ChatMessage
+		if err := json.Unmarshal(env.Data, &msg); err != nil {
+			log.Printf("Invalid chat message from instance %s: %v", env.Node, err)
+			return
+		}
+		session.mu.Lock()
+		session.addChatLocked(&msg)
+		session.mu.Unlock()
+		h.chatChanged(session)
+
+	case peerChatChange:
+		var change ChatChange
+		if err := json.Unmarshal(env.Data, &change); err != nil {
+			log.Printf("Invalid chat change from instance %s: %v", env.Node, err)
+			return
+		}
+		h.loadHistory(session)
+		session.mu.Lock()
+		session.applyChatChangeLocked(&change)
+		session.mu.Unlock()
+		h.chatChanged(session)
+
+	case peerCursor:
+		var cursor OutgoingMessage
+		if err := json.Unmarshal(env.Data, &cursor); err != nil {
+			log.Printf("Invalid cursor from instance %s: %v", env.Node, err)
+			return
+		}
+		if h.config.CursorBatch > 0 {
+			h.batchCursor(session.ID, CursorPosition{UserID: cursor.UserID, Cursor: cursor.Cursor, Color: cursor.Color})
+			return
+		}
+		session.mu.RLock()
+		for _, client := range session.Clients {
+			client.deliverCursor(cursor.UserID, env.Data)
+		}
+		session.mu.RUnlock()
+
+	case peerTyping:
+		session.mu.RLock()
+		for _, client := range session.Clients {
+			client.deliver(env.Data)
+		}
+		session.mu.RUnlock()
+	}
+}
+
+// applyPeerFile takes another instance's content for a file, unless the
+// file here is already as new, and sends it to the readers connected here
+func (h *Hub) applyPeerFile(session *Session, version int64, state peerFileState) {
+	session.mu.Lock()
+	file, existed := session.Files[state.Path]
+	if existed && (file.Binary || version <= file.version) {
+		session.mu.Unlock()
+		return
+	}
+	if !existed {
+		file = newFile(state.Path)
+		session.Files[state.Path] = file
+	}
+	file.version = version
+	changed := file.Content != state.Content
+	if !existed {
+		h.recordLocked(session, recording.Event{Kind: recording.Create, Path: state.Path})
+	}
+	if changed {
+		h.recordChangeLocked(session, auditEdit, "", "", file, state.Content)
+		file.setContent(state.Content, "")
+		if len(state.LineAuthors) == len(file.LineAuthors) {
+			file.LineAuthors = state.LineAuthors
+		}
+		session.broadcastToReadersLocked("", file, OutgoingMessage{
+			Type:     "code-update",
+			Path:     file.Path,
+			Code:     file.Content,
+			Revision: file.doc.Revision(),
+		})
+	}
+	session.mu.Unlock()
+
+	if !existed {
+		h.broadcastFileTree(session.ID)
+	}
+	if changed {
+		h.refreshFile(session.ID, state.Path)
+	}
+}
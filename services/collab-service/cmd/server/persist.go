@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/store"
+)
+
+// persistTimeout bounds each load or save of a session
+const persistTimeout = 10 * time.Second
+
+// persistedMetadata is what is kept of a session besides its documents
+type persistedMetadata struct {
+	Settings     EditorSettings    `json:"settings"`
+	SyncMode     string            `json:"syncMode,omitempty"`
+	Notebook     bool              `json:"notebook,omitempty"`
+	CacheResults bool              `json:"cacheResults,omitempty"`
+	Locked       bool              `json:"locked,omitempty"`
+	AlwaysOn     bool              `json:"alwaysOn,omitempty"`
+	Language     string            `json:"language,omitempty"`
+	FormatOnSave bool              `json:"formatOnSave,omitempty"`
+	Preset       *EditorPreset     `json:"preset,omitempty"`
+	Colors       map[string]string `json:"colors,omitempty"`
+
+	// The counters are kept with the metadata, so what's added before the
+	// history is loaded doesn't reuse its IDs
+	NextChatID       int   `json:"nextChatId,omitempty"`
+	NextRunID        int   `json:"nextRunId,omitempty"`
+	NextCheckpointID int   `json:"nextCheckpointId,omitempty"`
+	NextOperationID  int64 `json:"nextOperationId,omitempty"`
+
+	ShareLinks []*ShareLink `json:"shareLinks,omitempty"`
+	Git        *GitSource   `json:"git,omitempty"`
+
+	// Assets are the binary files, whose bytes stay in the blob store
+	Assets []persistedAsset `json:"assets,omitempty"`
+}
+
+// persistedAsset is what is kept of a binary file
+type persistedAsset struct {
+	Path        string              `json:"path"`
+	BlobKey     string              `json:"blobKey"`
+	ContentType string              `json:"contentType"`
+	Size        int                 `json:"size"`
+	Access      map[Role]FileAccess `json:"access,omitempty"`
+	UpdatedAt   time.Time           `json:"updatedAt"`
+}
+
+// persistedHistory is the chat, run and checkpoint history kept of a
+// session
+type persistedHistory struct {
+	Chat        []*ChatMessage        `json:"chat,omitempty"`
+	Runs        []persistedRun        `json:"runs,omitempty"`
+	Checkpoints []persistedCheckpoint `json:"checkpoints,omitempty"`
+}
+
+// persistedRun is a run with the files it was given, which decide who may
+// see it
+type persistedRun struct {
+	*Run
+	Files []string `json:"files,omitempty"`
+}
+
+// persistedCheckpoint is a checkpoint with its text files' content, and
+// its binary files' blob keys, by path
+type persistedCheckpoint struct {
+	*Checkpoint
+	Files  map[string]string `json:"files"`
+	Binary map[string]string `json:"binary,omitempty"`
+}
+
+// snapshotLocked captures the session for the store. Binary files are kept
+// as their blob keys with the metadata; the store only has documents for
+// text. Caller must hold session.mu for writing.
+func (h *Hub) snapshotLocked(s *Session) *store.Session {
+	var assets []persistedAsset
+	for _, file := range s.Files {
+		if file.Binary {
+			assets = append(assets, persistedAsset{
+				Path:        file.Path,
+				BlobKey:     file.BlobKey,
+				ContentType: file.ContentType,
+				Size:        file.BlobSize,
+				Access:      file.Access,
+				UpdatedAt:   file.UpdatedAt,
+			})
+		}
+	}
+	metadata, _ := json.Marshal(persistedMetadata{
+		Settings:     s.Settings,
+		SyncMode:     s.SyncMode,
+		Notebook:     s.Notebook,
+		CacheResults: s.CacheResults,
+		Locked:       s.Locked,
+		AlwaysOn:     s.AlwaysOn,
+		Language:     s.Language,
+		FormatOnSave: s.FormatOnSave,
+		Preset:       s.Preset,
+		Colors:       s.Colors,
+
+		NextChatID:       s.nextChatID,
+		NextRunID:        s.nextRunID,
+		NextCheckpointID: s.nextCheckpointID,
+		NextOperationID:  s.nextOperationID,
+
+		ShareLinks: s.shareLinksLocked(),
+		Git:        s.Git,
+		Assets:     assets,
+	})
+	snapshot := &store.Session{
+		ID:         s.ID,
+		Owner:      s.Owner,
+		Org:        s.Org,
+		Metadata:   metadata,
+		Tags:       s.Tags,
+		Operations: s.savedOperationsLocked(),
+		UpdatedAt:  time.Now().UTC(),
+	}
+
+	for _, file := range s.Files {
+		if file.Binary {
+			continue
+		}
+		doc := store.Document{
+			Path:      file.Path,
+			Content:   file.Content,
+			Language:  h.fileLanguageLocked(s, file.Path),
+			Access:    make(map[string]string, len(file.Access)),
+			UpdatedAt: file.UpdatedAt,
+		}
+		for role, access := range file.Access {
+			doc.Access[string(role)] = string(access)
+		}
+		snapshot.Documents = append(snapshot.Documents, doc)
+	}
+
+	if s.historyLoaded {
+		history := persistedHistory{Chat: s.Chat}
+		for _, run := range s.Runs {
+			history.Runs = append(history.Runs, persistedRun{Run: run, Files: run.files})
+		}
+		for _, checkpoint := range s.Checkpoints {
+			kept := persistedCheckpoint{Checkpoint: checkpoint, Files: make(map[string]string, len(checkpoint.files))}
+			for path, file := range checkpoint.files {
+				if !file.binary {
+					kept.Files[path] = file.content
+					continue
+				}
+				if kept.Binary == nil {
+					kept.Binary = make(map[string]string)
+				}
+				kept.Binary[path] = file.content
+			}
+			history.Checkpoints = append(history.Checkpoints, kept)
+		}
+		var err error
+		if snapshot.History, err = json.Marshal(history); err != nil {
+			log.Printf("Error marshaling the history of session %s: %v", s.ID, err)
+			snapshot.History = nil
+		}
+	}
+	return snapshot
+}
+
+// restoreLocked puts a saved session's documents and metadata back.
+// Caller must hold session.mu for writing, or own a session no one else
+// has seen yet.
+func (s *Session) restoreLocked(saved *store.Session) {
+	var metadata persistedMetadata
+	if err := json.Unmarshal(saved.Metadata, &metadata); err != nil || metadata.Settings.validate() != nil {
+		metadata = persistedMetadata{}
+	} else {
+		s.Settings = metadata.Settings
+		s.SyncMode = metadata.SyncMode
+		s.Notebook = metadata.Notebook
+		s.CacheResults = metadata.CacheResults
+		s.Locked = metadata.Locked
+		s.AlwaysOn = metadata.AlwaysOn
+		s.Language = metadata.Language
+		s.FormatOnSave = metadata.FormatOnSave
+		s.Preset = metadata.Preset
+		s.Colors = metadata.Colors
+		s.nextChatID = metadata.NextChatID
+		s.nextRunID = metadata.NextRunID
+		s.nextCheckpointID = metadata.NextCheckpointID
+		s.nextOperationID = metadata.NextOperationID
+		for _, link := range metadata.ShareLinks {
+			s.ShareLinks[link.ID] = link
+		}
+		s.Git = metadata.Git
+	}
+	s.Owner = saved.Owner
+	s.Org = saved.Org
+	s.Tags = saved.Tags
+	s.stored = true
+	// A session that was just closed still has its history, and the store
+	// only does once the save is done; otherwise it's loaded once the
+	// session is open, by loadHistory
+	var history persistedHistory
+	if saved.History == nil || json.Unmarshal(saved.History, &history) != nil {
+		s.historyReady = make(chan struct{})
+		s.historyLoaded = false
+	} else {
+		s.addHistoryLocked(history, 0, 0)
+	}
+
+	if len(saved.Documents) == 0 && len(metadata.Assets) == 0 {
+		return
+	}
+	s.Files = make(map[string]*File, len(saved.Documents)+len(metadata.Assets))
+	for _, doc := range saved.Documents {
+		file := newFile(doc.Path)
+		file.Content = doc.Content
+		file.UpdatedAt = doc.UpdatedAt
+		for role, access := range doc.Access {
+			file.Access[Role(role)] = FileAccess(access)
+		}
+		s.Files[doc.Path] = file
+	}
+	for _, asset := range metadata.Assets {
+		file := newFile(asset.Path)
+		file.Binary, file.BlobKey, file.ContentType, file.BlobSize = true, asset.BlobKey, asset.ContentType, asset.Size
+		file.UpdatedAt = asset.UpdatedAt
+		for role, access := range asset.Access {
+			file.Access[role] = access
+		}
+		s.Files[asset.Path] = file
+	}
+}
+
+// historyMessages are the messages about chat that may be in a restored
+// session's history, which wait for it to be loaded
+var historyMessages = map[string]bool{
+	"edit-chat":               true,
+	"delete-chat":             true,
+	"get-thread":              true,
+	"set-thread-subscription": true,
+	"mark-read":               true,
+	"read-receipts":           true,
+}
+
+// historyPending reports whether the session's kept history is still to
+// be loaded
+func (s *Session) historyPending() bool {
+	if s.historyReady == nil {
+		return false
+	}
+	select {
+	case <-s.historyReady:
+		return false
+	default:
+		return true
+	}
+}
+
+// loadHistory loads the chat, run and checkpoint history kept of a
+// restored session, the first time it's called, and waits until they're
+// in. Restoring a session only loads its documents, so joining doesn't
+// wait for a long history. What was added meanwhile goes after what was
+// kept.
+func (h *Hub) loadHistory(session *Session) {
+	if session.historyReady == nil {
+		return
+	}
+	session.historyOnce.Do(func() {
+		defer close(session.historyReady)
+
+		ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+		defer cancel()
+		raw, err := h.store.LoadHistory(ctx, session.ID)
+		var history persistedHistory
+		if err == nil {
+			err = json.Unmarshal(raw, &history)
+		} else if errors.Is(err, store.ErrNotFound) {
+			err = nil
+		}
+		if err != nil {
+			log.Printf("Failed to load the history of session %s, which won't be saved: %v", session.ID, err)
+			return
+		}
+
+		session.mu.Lock()
+		session.addHistoryLocked(history, h.config.RunHistoryLimit, h.config.CheckpointLimit)
+		session.historyLoaded = true
+		session.mu.Unlock()
+		log.Printf("Loaded the history of session %s: %d messages, %d runs, %d checkpoints",
+			session.ID, len(history.Chat), len(history.Runs), len(history.Checkpoints))
+	})
+	<-session.historyReady
+}
+
+// addHistoryLocked puts kept history before what the session has, keeping
+// the newest messages, and runLimit runs and checkpointLimit checkpoints
+// at most. Caller must hold session.mu for writing, or own a session no
+// one else has seen yet.
+func (s *Session) addHistoryLocked(history persistedHistory, runLimit, checkpointLimit int) {
+	chat := append(history.Chat, s.Chat...)
+	if len(chat) > maxChatHistory {
+		chat = append([]*ChatMessage(nil), chat[len(chat)-maxChatHistory:]...)
+	}
+	s.Chat = chat
+
+	var runs []*Run
+	for _, kept := range history.Runs {
+		if kept.Run == nil {
+			continue
+		}
+		run := kept.Run
+		run.files = kept.Files
+		if run.Status == RunRunning {
+			// It stopped when the session closed
+			run.Status = RunCancelled
+		}
+		runs = append(runs, run)
+	}
+	runs = append(runs, s.Runs...)
+	if runLimit > 0 && len(runs) > runLimit {
+		runs = append([]*Run(nil), runs[len(runs)-runLimit:]...)
+	}
+	s.Runs = runs
+
+	var checkpoints []*Checkpoint
+	for _, kept := range history.Checkpoints {
+		if kept.Checkpoint == nil {
+			continue
+		}
+		checkpoint := kept.Checkpoint
+		checkpoint.files = make(map[string]checkpointFile, len(kept.Files))
+		for path, content := range kept.Files {
+			checkpoint.files[path] = checkpointFile{content: content}
+		}
+		for path, key := range kept.Binary {
+			checkpoint.files[path] = checkpointFile{content: key, binary: true}
+		}
+		checkpoints = append(checkpoints, checkpoint)
+	}
+	s.Checkpoints = trimCheckpoints(append(checkpoints, s.Checkpoints...), checkpointLimit)
+}
+
+// loadSession finds what was kept of a session that isn't open. It
+// reports whether the session may be saved: a session that couldn't be
+// loaded isn't, so it doesn't overwrite the copy in the store.
+func (h *Hub) loadSession(sessionID string) (*store.Session, bool) {
+	// Lobbies are kept apart, by openLobby
+	if h.store == nil || isLobby(sessionID) {
+		return nil, false
+	}
+
+	// A session that was just closed may not be saved yet, or may have
+	// failed to save
+	h.mu.RLock()
+	closing, ok := h.closing[sessionID]
+	h.mu.RUnlock()
+	if ok {
+		return closing, true
+	}
+	if queued, ok := h.queuedSession(sessionID); ok {
+		return queued, true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+	defer cancel()
+	saved, err := h.store.Load(ctx, sessionID)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, true
+	}
+	if err != nil {
+		log.Printf("Failed to load session %s, which won't be saved: %v", sessionID, err)
+		return nil, false
+	}
+	log.Printf("Restored session %s with %d documents", sessionID, len(saved.Documents))
+	return saved, true
+}
+
+// schedulePersist saves the session once it has gone unchanged for
+// PersistDebounce
+func (h *Hub) schedulePersist(sessionID string) {
+	if h.store == nil {
+		return
+	}
+	session, exists := h.getSession(sessionID)
+	if !exists {
+		return
+	}
+	h.debounce(session, "persist", h.config.PersistDebounce, func() {
+		session.persistMu.Lock()
+		defer session.persistMu.Unlock()
+		session.mu.Lock()
+		if !session.persist {
+			session.mu.Unlock()
+			return
+		}
+		snapshot := h.snapshotLocked(session)
+		session.mu.Unlock()
+		h.saveSession(snapshot)
+	})
+}
+
+// persistClosed saves a session that is going away. Until the save is
+// done, reopening the session restores it from memory.
+func (h *Hub) persistClosed(session *Session) {
+	if h.store == nil {
+		return
+	}
+	session.mu.Lock()
+	if !session.persist {
+		session.mu.Unlock()
+		return
+	}
+	snapshot := h.snapshotLocked(session)
+	session.mu.Unlock()
+
+	h.mu.Lock()
+	h.closing[session.ID] = snapshot
+	h.mu.Unlock()
+
+	go func() {
+		// After any save already under way, which has older state
+		session.persistMu.Lock()
+		defer session.persistMu.Unlock()
+		h.saveSession(snapshot)
+
+		h.mu.Lock()
+		if h.closing[session.ID] == snapshot {
+			delete(h.closing, session.ID)
+		}
+		h.mu.Unlock()
+	}()
+}
+
+// saveSession saves a snapshot, or keeps it to retry if that fails, and
+// reports whether it was saved
+func (h *Hub) saveSession(snapshot *store.Session) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+	defer cancel()
+	if err := h.store.Save(ctx, snapshot); err != nil {
+		log.Printf("Failed to save session %s, to be retried: %v", snapshot.ID, err)
+		h.queueSessionSave(snapshot)
+		return false
+	}
+	h.sessionSaveDone(snapshot)
+	h.sessionSaved(snapshot)
+	h.operationsSaved(snapshot)
+	return true
+}
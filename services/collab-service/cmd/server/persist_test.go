@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBinaryFilesSurviveReopening(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "collab.db")
+	hub := storeHub(t, path)
+	updated := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	session := hub.openSession("s1", nil, true)
+	session.mu.Lock()
+	session.Owner = "alice"
+	text := newFile("main.go")
+	text.Content, text.UpdatedAt = "package main\n", updated
+	text.Access[RoleViewer] = AccessHidden
+	logo := newFile("assets/logo.png")
+	logo.Binary, logo.BlobKey, logo.ContentType, logo.BlobSize = true, blobPrefix("s1")+"4f9a", "image/png", 2048
+	logo.UpdatedAt = updated
+	logo.Access[RoleViewer] = AccessHidden
+	session.Files = map[string]*File{text.Path: text, logo.Path: logo}
+	session.Checkpoints = []*Checkpoint{{ID: 1, CreatedBy: "alice", CreatedAt: updated, files: map[string]checkpointFile{
+		text.Path: {content: text.Content},
+		logo.Path: {content: logo.BlobKey, binary: true},
+	}}}
+	snapshot := hub.snapshotLocked(session)
+	session.mu.Unlock()
+	if err := hub.store.Save(context.Background(), snapshot); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	// Reopened by an instance started afterwards
+	reopened := storeHub(t, path)
+	saved, persist := reopened.loadSession("s1")
+	if saved == nil || !persist {
+		t.Fatalf("loadSession = %v, %t", saved, persist)
+	}
+	restored := reopened.openSession("s1", saved, persist)
+	reopened.loadHistory(restored)
+	restored.mu.RLock()
+	defer restored.mu.RUnlock()
+
+	if len(restored.Files) != 2 {
+		t.Fatalf("restored %d files, want 2", len(restored.Files))
+	}
+	gotText := restored.Files[text.Path]
+	if gotText == nil || gotText.Binary || gotText.Content != text.Content || gotText.Access[RoleViewer] != AccessHidden {
+		t.Fatalf("restored %s as %+v", text.Path, gotText)
+	}
+	gotLogo := restored.Files[logo.Path]
+	if gotLogo == nil {
+		t.Fatalf("%s wasn't restored", logo.Path)
+	}
+	if !gotLogo.Binary || gotLogo.BlobKey != logo.BlobKey || gotLogo.ContentType != logo.ContentType || gotLogo.BlobSize != logo.BlobSize ||
+		gotLogo.Access[RoleViewer] != AccessHidden || !gotLogo.UpdatedAt.Equal(updated) || gotLogo.Content != "" {
+		t.Fatalf("restored %s as %+v", logo.Path, gotLogo)
+	}
+
+	if len(restored.Checkpoints) != 1 {
+		t.Fatalf("restored %d checkpoints, want 1", len(restored.Checkpoints))
+	}
+	files := restored.Checkpoints[0].files
+	if got := files[logo.Path]; !got.binary || got.content != logo.BlobKey {
+		t.Fatalf("checkpoint has %s as %+v", logo.Path, got)
+	}
+	if got := files[text.Path]; got.binary || got.content != text.Content {
+		t.Fatalf("checkpoint has %s as %+v", text.Path, got)
+	}
+}
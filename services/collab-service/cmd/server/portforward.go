@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// listeningPattern picks up the "listening on" lines dev servers print
+var listeningPattern = regexp.MustCompile(`(?i)(?:listen|running|serving|started|available)[^\n]*?(?:localhost|127\.0\.0\.1|0\.0\.0\.0|\[::\]|port)[: ]\s*(\d{4,5})\b`)
+
+// PortPreview exposes a port inside the execution sandbox through the
+// collab service. The token in its URL is the credential.
+type PortPreview struct {
+	Port      int       `json:"port"`
+	URL       string    `json:"url,omitempty"`
+	CreatedBy string    `json:"createdBy,omitempty"`
+	ExpiresAt time.Time `json:"expiresAt,omitzero"`
+	token     string
+}
+
+// previewCredentials are the request headers a preview never forwards, so
+// the sandbox can't replay the caller's collab credentials
+var previewCredentials = []string{"Authorization", "Cookie", "X-Api-Key"}
+
+// previewPolicy puts previews in a sandbox with an opaque origin, so their
+// scripts can't read the collab service's cookies or storage or call its
+// API as the viewer
+const previewPolicy = "sandbox allow-scripts allow-forms allow-popups allow-modals allow-downloads"
+
+func previewURL(sessionID, token string) string {
+	return "/sessions/" + url.PathEscape(sessionID) + "/preview/" + token + "/"
+}
+
+// detectListeningPorts returns the ports a run's output says it is serving on
+func detectListeningPorts(output string) []int {
+	var ports []int
+	seen := make(map[int]bool)
+	for _, match := range listeningPattern.FindAllStringSubmatch(output, -1) {
+		port, err := strconv.Atoi(match[1])
+		if err != nil || port < 1024 || port > 65535 || seen[port] {
+			continue
+		}
+		seen[port] = true
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+// exposePort creates or refreshes the preview of a sandbox port and
+// announces its URL to the session
+func (h *Hub) exposePort(c *Client, port int) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	role := session.roleLocked(c)
+	session.mu.RUnlock()
+	if role == RoleViewer {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: "viewers cannot expose ports"})
+		return
+	}
+	if err := h.openPortPreview(session, port, c.Username); err != nil {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: err.Error()})
+	}
+}
+
+func (h *Hub) openPortPreview(session *Session, port int, username string) error {
+	if port < 1024 || port > 65535 {
+		return fmt.Errorf("port must be between 1024 and 65535")
+	}
+
+	session.mu.Lock()
+	preview, ok := session.Previews[port]
+	if !ok {
+		buf := make([]byte, 16)
+		if _, err := rand.Read(buf); err != nil {
+			session.mu.Unlock()
+			return err
+		}
+		token := hex.EncodeToString(buf)
+		preview = &PortPreview{Port: port, URL: previewURL(session.ID, token), CreatedBy: username, token: token}
+		session.Previews[port] = preview
+		log.Printf("Session %s: port %d exposed at %s by %s", session.ID, port, preview.URL, username)
+	}
+	preview.ExpiresAt = time.Now().Add(h.config.PortPreviewTTL)
+	announced := *preview
+	session.mu.Unlock()
+
+	// Exposing the port again pushes the expiry back
+	h.debounce(session, fmt.Sprintf("port-preview:%d", port), h.config.PortPreviewTTL, func() {
+		h.closePortPreview(session, port)
+	})
+	h.broadcastToSession(session.ID, OutgoingMessage{Type: "port-preview", PortPreview: &announced})
+	return nil
+}
+
+// closePort stops previewing a port
+func (h *Hub) closePort(c *Client, port int) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	role := session.roleLocked(c)
+	_, ok := session.Previews[port]
+	session.mu.RUnlock()
+
+	switch {
+	case role == RoleViewer:
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: "viewers cannot close ports"})
+	case !ok:
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: fmt.Sprintf("port %d is not exposed", port)})
+	default:
+		h.closePortPreview(session, port)
+	}
+}
+
+func (h *Hub) closePortPreview(session *Session, port int) {
+	session.mu.Lock()
+	preview, ok := session.Previews[port]
+	delete(session.Previews, port)
+	if timer, exists := session.timers[fmt.Sprintf("port-preview:%d", port)]; exists {
+		timer.Stop()
+		delete(session.timers, fmt.Sprintf("port-preview:%d", port))
+	}
+	session.mu.Unlock()
+
+	if ok {
+		log.Printf("Session %s: preview of port %d closed", session.ID, port)
+		h.broadcastToSession(session.ID, OutgoingMessage{Type: "port-preview-closed", PortPreview: &PortPreview{Port: preview.Port}})
+	}
+}
+
+// sendPortPreviews tells a joining client about the ports already exposed
+func (h *Hub) sendPortPreviews(c *Client) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	previews := make([]PortPreview, 0, len(session.Previews))
+	for _, preview := range session.Previews {
+		previews = append(previews, *preview)
+	}
+	session.mu.RUnlock()
+
+	for i := range previews {
+		h.sendToClient(c, OutgoingMessage{Type: "port-preview", PortPreview: &previews[i]})
+	}
+}
+
+// handlePortPreview proxies a preview URL to the port inside the sandbox
+func handlePortPreview(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, exists := hub.getSession(c.Param("sessionId"))
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+			return
+		}
+
+		token := c.Param("token")
+		session.mu.RLock()
+		var port int
+		for _, preview := range session.Previews {
+			if preview.token == token && time.Now().Before(preview.ExpiresAt) {
+				port = preview.Port
+				break
+			}
+		}
+		session.mu.RUnlock()
+
+		if port == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "preview not found or expired"})
+			return
+		}
+		sb, ok := hub.sandboxes.Lookup(session.ID)
+		if !ok {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "session has no sandbox"})
+			return
+		}
+
+		target := &url.URL{Scheme: "http", Host: net.JoinHostPort(sb.Host(), fmt.Sprint(port))}
+		prefix := strings.TrimSuffix(previewURL(session.ID, token), "/")
+		proxy := &httputil.ReverseProxy{
+			Rewrite: func(r *httputil.ProxyRequest) {
+				r.SetURL(target)
+				r.Out.URL.Path = "/" + strings.TrimPrefix(c.Param("path"), "/")
+				r.Out.URL.RawPath = ""
+				r.Out.Host = target.Host
+				for _, header := range previewCredentials {
+					r.Out.Header.Del(header)
+				}
+				r.Out.Header.Set("X-Forwarded-Prefix", prefix)
+				r.SetXForwarded()
+			},
+			// Cookies the preview sets would land on the collab origin
+			ModifyResponse: func(resp *http.Response) error {
+				resp.Header.Del("Set-Cookie")
+				resp.Header.Add("Content-Security-Policy", previewPolicy)
+				return nil
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				log.Printf("Preview proxy for session %s port %d failed: %v", session.ID, port, err)
+				http.Error(w, fmt.Sprintf("nothing is listening on port %d", port), http.StatusBadGateway)
+			},
+		}
+		proxy.ServeHTTP(c.Writer, c.Request)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/prefs"
+	"github.com/gin-gonic/gin"
+)
+
+// requireUser returns the verified caller of a request about themselves, or
+// responds 401
+func (h *Hub) requireUser(c *gin.Context) (string, bool) {
+	username := h.requestUsername(c)
+	if username == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "a valid token is required"})
+		return "", false
+	}
+	return username, true
+}
+
+// handleGetPreferences returns the caller's notification preferences
+func handleGetPreferences(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, ok := hub.requireUser(c)
+		if !ok {
+			return
+		}
+		p, err := hub.prefs.Get(username)
+		if err != nil {
+			log.Printf("Failed to read preferences of %s: %v", username, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read preferences"})
+			return
+		}
+		c.JSON(http.StatusOK, p)
+	}
+}
+
+// handlePutPreferences replaces the caller's notification preferences
+func handlePutPreferences(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, ok := hub.requireUser(c)
+		if !ok {
+			return
+		}
+
+		var body struct {
+			Notifications     string     `json:"notifications"`
+			DoNotDisturbUntil *time.Time `json:"doNotDisturbUntil"`
+			SharePresence     bool       `json:"sharePresence"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+		p := prefs.Preferences{
+			Notifications:     body.Notifications,
+			DoNotDisturbUntil: body.DoNotDisturbUntil,
+			SharePresence:     body.SharePresence,
+		}
+		if err := p.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		p, err := hub.prefs.Put(username, p)
+		if err != nil {
+			log.Printf("Failed to store preferences of %s: %v", username, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store preferences"})
+			return
+		}
+		log.Printf("Notification preferences of %s set to %s", username, p.Notifications)
+		c.JSON(http.StatusOK, p)
+	}
+}
+
+// notificationAllowed is the check every notification sent to a user
+// outside their current session goes through. direct marks notifications
+// addressed to the user, like mentions and invitations. Users whose
+// preferences can't be read get them, so a storage fault doesn't silence
+// everyone.
+func (h *Hub) notificationAllowed(username string, direct bool) bool {
+	p, err := h.prefs.Get(username)
+	if err != nil {
+		log.Printf("Failed to read preferences of %s: %v", username, err)
+		return true
+	}
+	return p.Allows(direct, time.Now())
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// trackPresence counts c as a connection of username, replacing whoever it
+// was counted as before. Only verified users are tracked, so nobody can
+// set someone else's status by choosing their name.
+func (h *Hub) trackPresence(c *Client, username string) {
+	if c.presenceUser == username {
+		return
+	}
+	h.untrackPresence(c)
+	c.presenceUser = username
+	h.presence.Connect(username, c.Org, c.SessionID)
+
+	h.mu.Lock()
+	if h.online[username] == nil {
+		h.online[username] = make(map[*Client]string)
+	}
+	h.online[username][c] = c.Org
+	h.mu.Unlock()
+}
+
+// untrackPresence stops counting c as a connection
+func (h *Hub) untrackPresence(c *Client) {
+	if c.presenceUser == "" {
+		return
+	}
+	h.presence.Disconnect(c.presenceUser, c.SessionID)
+
+	h.mu.Lock()
+	delete(h.online[c.presenceUser], c)
+	if len(h.online[c.presenceUser]) == 0 {
+		delete(h.online, c.presenceUser)
+	}
+	h.mu.Unlock()
+	c.presenceUser = ""
+}
+
+// touchPresence records that c's user did something
+func (h *Hub) touchPresence(c *Client) {
+	if c.presenceUser != "" {
+		h.presence.Touch(c.presenceUser)
+	}
+}
+
+// presenceSweepInterval is how often state changes are looked for, at most
+const presenceSweepInterval = 15 * time.Second
+
+// runPresence reports users going active, idle and offline to the
+// presence webhook
+func (h *Hub) runPresence() {
+	interval := min(presenceSweepInterval, h.config.PresenceIdle/2)
+	ticker := time.NewTicker(max(interval, time.Second))
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		changed := h.presence.Sweep(now)
+		for _, status := range changed {
+			log.Printf("User %s is now %s", status.Username, status.State)
+		}
+		if h.config.PresenceWebhookURL == "" || len(changed) == 0 {
+			continue
+		}
+		// Delivered in order, so a receiver never sees a stale state last
+		go func() {
+			for _, status := range changed {
+				ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+				if err := h.webhooks.Send(ctx, h.config.PresenceWebhookURL, "presence", status); err != nil {
+					log.Printf("Presence webhook for %s failed: %v", status.Username, err)
+				}
+				cancel()
+			}
+		}()
+	}
+}
+
+// handleGetPresence returns whether the caller is coding right now
+func handleGetPresence(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, ok := hub.requireUser(c)
+		if !ok {
+			return
+		}
+		c.JSON(http.StatusOK, hub.presence.Get(username))
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"unicode/utf8"
+)
+
+// Keymaps an EditorPreset may recommend
+var presetKeymaps = map[string]bool{"default": true, "vim": true, "emacs": true, "sublime": true, "vscode": true}
+
+// Editor preset limits
+const (
+	maxPresetNameBytes = 64
+	minPresetFontSize  = 8
+	maxPresetFontSize  = 72
+)
+
+// EditorPreset is the look of the editor the session owner recommends,
+// such as a large font and a high-contrast theme for projecting a session
+// on a big screen. Clients apply it when joining and may override it; what
+// it leaves empty is up to them.
+type EditorPreset struct {
+	Name     string `json:"name,omitempty"`
+	Theme    string `json:"theme,omitempty"`
+	FontSize int    `json:"fontSize,omitempty"`
+	Keymap   string `json:"keymap,omitempty"`
+}
+
+func (p *EditorPreset) validate() error {
+	if len(p.Name) > maxPresetNameBytes || !utf8.ValidString(p.Name) {
+		return fmt.Errorf("preset names are limited to %d bytes of UTF-8", maxPresetNameBytes)
+	}
+	if len(p.Theme) > maxPresetNameBytes || !utf8.ValidString(p.Theme) {
+		return fmt.Errorf("theme names are limited to %d bytes of UTF-8", maxPresetNameBytes)
+	}
+	if p.FontSize != 0 && (p.FontSize < minPresetFontSize || p.FontSize > maxPresetFontSize) {
+		return fmt.Errorf("fontSize must be between %d and %d", minPresetFontSize, maxPresetFontSize)
+	}
+	if p.Keymap != "" && !presetKeymaps[p.Keymap] {
+		return fmt.Errorf("unsupported keymap: %q", p.Keymap)
+	}
+	return nil
+}
+
+// setEditorPreset sets the editor preset the session recommends, or with
+// an empty one stops recommending one, and pushes it to everyone in the
+// session
+func (h *Hub) setEditorPreset(c *Client, preset *EditorPreset) {
+	if preset != nil && *preset == (EditorPreset{}) {
+		preset = nil
+	}
+	if preset != nil {
+		if err := preset.validate(); err != nil {
+			h.sendToClient(c, OutgoingMessage{Type: "error", Error: err.Error()})
+			return
+		}
+	}
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	if session.roleLocked(c) != RoleOwner {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: "only the session owner can recommend an editor preset"})
+		return
+	}
+	session.Preset = preset
+	session.mu.Unlock()
+
+	log.Printf("Session %s editor preset set by %s", c.SessionID, c.ID)
+	h.schedulePersist(c.SessionID)
+	h.broadcastToSession(c.SessionID, OutgoingMessage{Type: "editor-preset", Username: c.Username, Preset: preset})
+}
+
+func (h *Hub) sendEditorPreset(c *Client) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	preset := session.Preset
+	session.mu.RUnlock()
+
+	if preset != nil {
+		h.sendToClient(c, OutgoingMessage{Type: "editor-preset", Preset: preset})
+	}
+}
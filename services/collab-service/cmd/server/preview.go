@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+// markdownRenderer uses goldmark's safe defaults: raw HTML is omitted and
+// links with dangerous schemes (javascript:, etc.) are dropped, so the
+// output can be injected into clients as-is.
+var markdownRenderer = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+func isMarkdown(filePath string) bool {
+	switch strings.ToLower(path.Ext(filePath)) {
+	case ".md", ".markdown":
+		return true
+	}
+	return false
+}
+
+func renderMarkdown(content string) (string, error) {
+	var buf bytes.Buffer
+	if err := markdownRenderer.Convert([]byte(content), &buf); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// schedulePreview debounces re-rendering a Markdown file and pushing the
+// preview to everyone who can see it
+func (h *Hub) schedulePreview(sessionID, filePath string) {
+	if !isMarkdown(filePath) {
+		return
+	}
+	session, exists := h.getSession(sessionID)
+	if !exists {
+		return
+	}
+
+	h.debounce(session, "preview:"+filePath, h.config.PreviewDebounce, func() {
+		session.mu.RLock()
+		file, ok := session.Files[filePath]
+		var content string
+		if ok && !file.Binary {
+			content = file.Content
+		}
+		session.mu.RUnlock()
+		if !ok || file.Binary {
+			return
+		}
+
+		rendered, err := renderMarkdown(content)
+		if err != nil {
+			log.Printf("Error rendering preview for %s: %v", filePath, err)
+			return
+		}
+		h.broadcastToReaders(sessionID, "", filePath, OutgoingMessage{
+			Type: "preview-update",
+			Path: filePath,
+			HTML: rendered,
+		})
+	})
+}
+
+// sendPreview sends the rendered preview of a Markdown file to one client
+func (h *Hub) sendPreview(c *Client, file *File) {
+	if file.Binary || !isMarkdown(file.Path) {
+		return
+	}
+	rendered, err := renderMarkdown(file.Content)
+	if err != nil {
+		log.Printf("Error rendering preview for %s: %v", file.Path, err)
+		return
+	}
+	h.sendToClient(c, OutgoingMessage{Type: "preview-update", Path: file.Path, HTML: rendered})
+}
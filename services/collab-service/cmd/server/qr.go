@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Sizes of the QR code image, in pixels
+const (
+	minQRSize     = 128
+	maxQRSize     = 1024
+	defaultQRSize = 512
+)
+
+// viewerLink returns a link into the web app that joins sessionID as a
+// viewer until expiresAt. Anyone who has it may join, so it names no one.
+func (h *Hub) viewerLink(sessionID string, expiresAt time.Time) (string, error) {
+	token, err := signToken(h.config.JWTSecret, tokenClaims{
+		Subject: "viewer",
+		Session: sessionID,
+		Role:    string(RoleViewer),
+		Expiry:  expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return sessionLink(h.config.AppURL, sessionID, token), nil
+}
+
+// sessionLink returns a link into the web app at appURL that joins
+// sessionID with token
+func sessionLink(appURL, sessionID, token string) string {
+	return strings.TrimSuffix(appURL, "/") + "/session/" + url.PathEscape(sessionID) +
+		"?" + url.Values{"token": {token}}.Encode()
+}
+
+// handleSessionQR returns a PNG QR code of a viewer link to the session,
+// for presenters to show their audience. The size query parameter sets its
+// width in pixels.
+func handleSessionQR(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.ownerSession(c, "share a viewer link")
+		if !ok {
+			return
+		}
+
+		size := defaultQRSize
+		if raw := c.Query("size"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < minQRSize || n > maxQRSize {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("size must be %d to %d pixels", minQRSize, maxQRSize)})
+				return
+			}
+			size = n
+		}
+
+		expiresAt := time.Now().Add(hub.config.ViewerLinkTTL).UTC()
+		link, err := hub.viewerLink(session.ID, expiresAt)
+		if err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "viewer links are not available: " + err.Error()})
+			return
+		}
+		png, err := qrcode.Encode(link, qrcode.Medium, size)
+		if err != nil {
+			log.Printf("Failed to encode the viewer link of session %s: %v", session.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create QR code"})
+			return
+		}
+
+		// Each request signs a new link, which goes stale
+		c.Header("Cache-Control", "no-store")
+		c.Header("Expires", expiresAt.Format(http.TimeFormat))
+		c.Data(http.StatusOK, "image/png", png)
+	}
+}
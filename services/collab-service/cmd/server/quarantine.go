@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// quarantinePoll is how often a quarantined client is checked on
+const quarantinePoll = 100 * time.Millisecond
+
+// A client whose queue fills up is quarantined instead of being dropped or
+// silently missing messages: nothing more is queued for it until it has
+// read its queue down to a quarter, when it gets one catch-up-sync with
+// its file tree and the documents it can read, as they are then, and
+// rejoins the live stream. The sync is queued and the quarantine lifted
+// under the session lock, so no edit falls between the two; operations
+// broadcast around then may repeat what the sync has, with revisions it
+// already includes. Participants and chat follow, as on joining. A client
+// that hasn't caught up within SlowClientTimeout is disconnected.
+
+// deliver queues a message for the client, quarantining it if its queue
+// is full. Caller must hold session.mu.
+func (c *Client) deliver(msg []byte) {
+	if c.quarantined.Load() {
+		return
+	}
+	if !c.enqueue(msg) {
+		c.lag()
+	}
+}
+
+// deliverCursor queues a cursor update for the client, in place of the one
+// of the same client still waiting to be written, if any. Cursor updates
+// aren't numbered, and one the queue has no room for is dropped rather
+// than quarantining the client, as the next replaces it. Caller must hold
+// session.mu.
+func (c *Client) deliverCursor(clientID string, msg []byte) {
+	if c.quarantined.Load() {
+		return
+	}
+	c.Send.Coalesce(clientID, msg)
+}
+
+// deliverCursors queues a cursors-update for the client. Like cursor
+// updates, batches aren't numbered, and one the queue has no room for is
+// dropped. Caller must hold session.mu.
+func (c *Client) deliverCursors(msg []byte) {
+	if c.quarantined.Load() {
+		return
+	}
+	c.Send.Push(msg)
+}
+
+// lag quarantines the client, unless it already is
+func (c *Client) lag() {
+	if c.quarantined.CompareAndSwap(false, true) {
+		select {
+		case c.lagging <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// quarantine waits for a quarantined client to catch up, or gives up on it
+func (h *Hub) quarantine(c *Client) {
+	log.Printf("Client %s of session %s is too slow, pausing its updates", c.ID, c.SessionID)
+	started := time.Now()
+	ticker := time.NewTicker(quarantinePoll)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !h.connected(c) {
+			return
+		}
+		if c.Send.Len() <= c.Send.Cap()/4 && !c.behind() && h.catchUp(c) {
+			log.Printf("Client %s of session %s caught up after %s", c.ID, c.SessionID, time.Since(started).Round(time.Millisecond))
+			if session, exists := h.getSession(c.SessionID); exists {
+				h.sendToClient(c, OutgoingMessage{Type: "participants-update", Participants: h.participants(session)})
+			}
+			h.sendChatHistory(c)
+			return
+		}
+		if timeout := h.config.SlowClientTimeout; timeout > 0 && time.Since(started) > timeout {
+			log.Printf("Client %s of session %s didn't catch up in %s, disconnecting it", c.ID, c.SessionID, timeout)
+			c.disconnect(websocket.CloseTryAgainLater, "too slow")
+			return
+		}
+	}
+}
+
+// catchUp queues the catch-up-sync and lifts the quarantine, reporting
+// whether it did
+func (h *Hub) catchUp(c *Client) bool {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return false
+	}
+
+	type chunked struct {
+		path     string
+		revision int
+		parts    []string
+	}
+	var pending []chunked
+
+	session.mu.Lock()
+	defer func() {
+		session.mu.Unlock()
+		for _, doc := range pending {
+			go h.sendChunks(c, doc.path, doc.revision, doc.parts)
+		}
+	}()
+	if session.Clients[c.ID] != c {
+		return false
+	}
+	role := session.roleLocked(c)
+	sync := OutgoingMessage{Type: "catch-up-sync", Files: session.fileTreeLocked(role)}
+	for _, file := range session.Files {
+		if file.Binary || !file.visibleTo(role) {
+			continue
+		}
+		doc := OutgoingMessage{
+			Type:     "document-sync",
+			Path:     file.Path,
+			Code:     file.Content,
+			Revision: file.doc.Revision(),
+			Language: h.fileLanguageLocked(session, file.Path),
+			Access:   file.accessFor(role),
+		}
+		if size := h.config.DocumentChunkBytes; size > 0 && len(doc.Code) > size {
+			parts := documentChunks(doc.Code, size)
+			doc.Code, doc.Size, doc.Chunks = "", len(file.Content), len(parts)
+			pending = append(pending, chunked{file.Path, doc.Revision, parts})
+		}
+		sync.Documents = append(sync.Documents, doc)
+	}
+	sort.Slice(sync.Documents, func(i, j int) bool { return sync.Documents[i].Path < sync.Documents[j].Path })
+
+	msgBytes, err := json.Marshal(sync)
+	if err != nil {
+		log.Printf("Error marshaling catch-up-sync: %v", err)
+		pending = nil
+		return false
+	}
+	if !c.enqueueCatchUp(msgBytes) {
+		pending = nil
+		return false
+	}
+	c.quarantined.Store(false)
+	return true
+}
@@ -0,0 +1,28 @@
+package main
+
+import "fmt"
+
+// workspaceBytesLocked returns the total size of all files in the session.
+// Caller must hold session.mu.
+func (s *Session) workspaceBytesLocked() int {
+	total := 0
+	for _, file := range s.Files {
+		total += file.size()
+	}
+	return total
+}
+
+// checkQuotaLocked reports whether adding newFiles files and growing the
+// workspace by growth bytes stays within the configured limits. Caller must
+// hold session.mu.
+func (h *Hub) checkQuotaLocked(s *Session, newFiles, growth int) error {
+	if limit := h.config.MaxWorkspaceFiles; limit > 0 && newFiles > 0 && len(s.Files)+newFiles > limit {
+		return fmt.Errorf("workspace file limit reached: at most %d files per session", limit)
+	}
+	if limit := h.config.MaxWorkspaceBytes; limit > 0 && growth > 0 {
+		if total := s.workspaceBytesLocked() + growth; total > limit {
+			return fmt.Errorf("workspace size limit exceeded: %d of %d bytes", total, limit)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+
+	"github.com/codecollab/collab-service/internal/ratelimit"
+	"github.com/gorilla/websocket"
+)
+
+// Rate limits, as rate-limited warnings name them
+const (
+	limitMessages = "messages"
+	limitEdits    = "edits"
+	limitCursor   = "cursor"
+)
+
+// messageBudgets maps the message types with a budget of their own, on top
+// of the limit on all messages, to it
+var messageBudgets = map[string]string{
+	"code-change": limitEdits,
+	"operation":   limitEdits,
+	"crdt-update": limitEdits,
+	"undo":        limitEdits,
+	"redo":        limitEdits,
+	"cursor-move": limitCursor,
+}
+
+// newBudgets returns a client's full budgets
+func (h *Hub) newBudgets() map[string]*ratelimit.Bucket {
+	return map[string]*ratelimit.Bucket{
+		limitEdits:  ratelimit.New(h.config.EditRate, h.config.EditBurst),
+		limitCursor: ratelimit.New(h.config.CursorRate, h.config.CursorBurst),
+	}
+}
+
+// newStrikes returns the bucket a client's dropped messages are taken
+// from, which refills with RateLimitStrikes a minute. Without it clients
+// aren't disconnected.
+func (h *Hub) newStrikes() *ratelimit.Bucket {
+	if h.config.RateLimitStrikes <= 0 {
+		return nil
+	}
+	return ratelimit.New(float64(h.config.RateLimitStrikes)/60, h.config.RateLimitStrikes)
+}
+
+// admit takes a message from the bucket of a limit, reporting whether it
+// may go through. Only the first message dropped while over a limit is
+// warned about.
+func (c *Client) admit(hub *Hub, limit string, bucket *ratelimit.Bucket) bool {
+	if bucket.Allow() {
+		c.throttled[limit] = false
+		return true
+	}
+	if !c.throttled[limit] {
+		c.throttled[limit] = true
+		hub.sendToClient(c, OutgoingMessage{Type: "rate-limited", Limit: limit, Error: "rate limit exceeded; messages are being dropped"})
+	}
+	return false
+}
+
+// flooding counts a dropped message against the client, reporting whether
+// it has had too many dropped to stay connected
+func (c *Client) flooding() bool {
+	return c.strikes != nil && !c.strikes.Allow()
+}
+
+// disconnectFlooding disconnects a client that kept sending over its
+// limits, telling it why
+func (c *Client) disconnectFlooding() {
+	log.Printf("Disconnecting client %s for exceeding its rate limits", c.ID)
+	c.flooded = true
+	c.disconnect(websocket.ClosePolicyViolation, "rate limit exceeded")
+}
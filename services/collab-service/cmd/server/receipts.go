@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// receiptInterval is how often the sender of a notice hears about its
+// read state at most
+const receiptInterval = time.Second
+
+// Receipts records who an important message was delivered to and who has
+// read it, by username. Chat notices keep theirs under session.mu and
+// announcements under h.mu.
+type Receipts struct {
+	delivered map[string]time.Time
+	read      map[string]time.Time
+}
+
+// ReadState is the aggregate read state of a message, for its sender.
+// Unread lists who got the message but hasn't read it yet.
+type ReadState struct {
+	MessageID string   `json:"messageId"`
+	Delivered int      `json:"delivered"`
+	Read      int      `json:"read"`
+	Unread    []string `json:"unread"`
+}
+
+func newReceipts() *Receipts {
+	return &Receipts{delivered: make(map[string]time.Time), read: make(map[string]time.Time)}
+}
+
+// deliveredTo records that username got the message and reports whether
+// it hadn't before
+func (r *Receipts) deliveredTo(username string) bool {
+	if _, ok := r.delivered[username]; ok {
+		return false
+	}
+	r.delivered[username] = time.Now()
+	return true
+}
+
+// readBy records that username read the message and reports whether that
+// is news. Only those it was delivered to can read it.
+func (r *Receipts) readBy(username string) bool {
+	if _, ok := r.delivered[username]; !ok {
+		return false
+	}
+	if _, ok := r.read[username]; ok {
+		return false
+	}
+	r.read[username] = time.Now()
+	return true
+}
+
+func (r *Receipts) state(messageID string) *ReadState {
+	state := &ReadState{MessageID: messageID, Delivered: len(r.delivered), Read: len(r.read), Unread: []string{}}
+	for username := range r.delivered {
+		if _, ok := r.read[username]; !ok {
+			state.Unread = append(state.Unread, username)
+		}
+	}
+	sort.Strings(state.Unread)
+	return state
+}
+
+// noticesDelivered records the receipts of the notices and announcements
+// a client was sent on connecting, once it has said who it is
+func (h *Hub) noticesDelivered(c *Client) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	var delivered []string
+	for _, msg := range session.Chat {
+		if msg.receipts != nil && c.Username != msg.Username && msg.receipts.deliveredTo(c.Username) {
+			delivered = append(delivered, msg.ID)
+		}
+	}
+	session.mu.Unlock()
+	for _, id := range delivered {
+		h.scheduleReadState(session, id)
+	}
+
+	h.mu.Lock()
+	active := h.activeAnnouncementsLocked()
+	h.mu.Unlock()
+	session.mu.RLock()
+	var reaching []*Announcement
+	for _, a := range active {
+		if a.reachesLocked(session) {
+			reaching = append(reaching, a)
+		}
+	}
+	session.mu.RUnlock()
+	h.mu.Lock()
+	for _, a := range reaching {
+		h.announcementDeliveredLocked(a.ID, c)
+	}
+	h.mu.Unlock()
+}
+
+// chatMessageLocked finds a message in the recent chat. Caller must hold
+// session.mu.
+func (s *Session) chatMessageLocked(id string) *ChatMessage {
+	for _, msg := range s.Chat {
+		if msg.ID == id {
+			return msg
+		}
+	}
+	return nil
+}
+
+// markRead records that c's user read a notice or announcement. Reading
+// other chat messages isn't tracked and is ignored.
+func (h *Hub) markRead(c *Client, messageID string) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	msg := session.chatMessageLocked(messageID)
+	read := msg != nil && msg.receipts != nil && msg.receipts.readBy(c.Username)
+	session.mu.Unlock()
+
+	switch {
+	case read:
+		h.scheduleReadState(session, messageID)
+	case msg == nil && !h.markAnnouncementRead(c, messageID):
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: fmt.Sprintf("message not found: %s", messageID)})
+	}
+}
+
+// scheduleReadState sends the sender of a notice its read state, folding
+// the receipts of a second together
+func (h *Hub) scheduleReadState(session *Session, messageID string) {
+	h.throttle(session, "receipts:"+messageID, receiptInterval, func() {
+		h.sendReadState(session, messageID, nil)
+	})
+}
+
+// sendReadState sends a notice's read state to its sender's connections,
+// or to c alone if it asked for it
+func (h *Hub) sendReadState(session *Session, messageID string, c *Client) {
+	session.mu.RLock()
+	msg := session.chatMessageLocked(messageID)
+	if msg == nil || msg.receipts == nil {
+		session.mu.RUnlock()
+		if c != nil {
+			h.sendToClient(c, OutgoingMessage{Type: "error", Error: fmt.Sprintf("message not found: %s", messageID)})
+		}
+		return
+	}
+	if c != nil && c.Username != msg.Username {
+		session.mu.RUnlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: "only the sender can see read receipts"})
+		return
+	}
+	state := msg.receipts.state(messageID)
+	var senders []*Client
+	if c != nil {
+		senders = append(senders, c)
+	} else {
+		for _, client := range session.Clients {
+			if client.Username == msg.Username {
+				senders = append(senders, client)
+			}
+		}
+	}
+	session.mu.RUnlock()
+
+	for _, sender := range senders {
+		h.sendToClient(sender, OutgoingMessage{Type: "read-receipts", Receipts: state})
+	}
+}
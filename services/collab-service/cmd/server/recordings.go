@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/listquery"
+	"github.com/codecollab/collab-service/internal/ot"
+	"github.com/codecollab/collab-service/internal/recording"
+	"github.com/gin-gonic/gin"
+)
+
+// maxReplaySpeed bounds how much faster than it happened a recording may
+// be played back
+const maxReplaySpeed = 64
+
+// recordLocked appends an event to the session's recording, starting one
+// with the documents as they are if this is the first. Lobbies have no
+// documents and aren't recorded. Caller must hold session.mu for writing.
+func (h *Hub) recordLocked(s *Session, event recording.Event) {
+	if h.recordings == nil || s.Lobby || s.recordingFailed {
+		return
+	}
+	now := time.Now().UTC()
+	if s.recorder == nil {
+		recorder, err := h.recordings.Start(s.ID, s.Owner, now)
+		if err != nil {
+			log.Printf("Session %s won't be recorded: %v", s.ID, err)
+			s.recordingFailed = true
+			return
+		}
+		s.recorder = recorder
+
+		paths := make([]string, 0, len(s.Files))
+		for filePath, file := range s.Files {
+			if !file.Binary {
+				paths = append(paths, filePath)
+			}
+		}
+		sort.Strings(paths)
+		for _, filePath := range paths {
+			h.appendRecordingLocked(s, recording.Event{
+				Kind:    recording.Snapshot,
+				At:      now,
+				Path:    filePath,
+				Content: s.Files[filePath].Content,
+			})
+		}
+	}
+	event.At = now
+	h.appendRecordingLocked(s, event)
+}
+
+// appendRecordingLocked writes an event to the recording, which is given
+// up on if that fails. Caller must hold session.mu for writing.
+func (h *Hub) appendRecordingLocked(s *Session, event recording.Event) {
+	if s.recorder == nil {
+		return
+	}
+	if err := s.recorder.Append(event); err != nil {
+		log.Printf("Stopped recording session %s: %v", s.ID, err)
+		s.recorder.Close()
+		s.recorder = nil
+		s.recordingFailed = true
+	}
+}
+
+// recordChangeLocked records replacing file's content with content, by
+// the given participant or, without one, another instance, and adds it to
+// the audit log as an operation of type kind. Caller must hold session.mu
+// for writing.
+func (h *Hub) recordChangeLocked(s *Session, kind, userID, username string, file *File, content string) {
+	if content == file.Content {
+		return
+	}
+	edits := ot.FromDiff(file.Content, content).Edits()
+	h.auditLocked(s, kind, userID, username, file.Path, edits)
+	h.recordLocked(s, recording.Event{
+		Kind:     recording.Edit,
+		Path:     file.Path,
+		UserID:   userID,
+		Username: username,
+		Ops:      edits,
+	})
+}
+
+// stopRecording ends the recording of a session that is closing
+func (h *Hub) stopRecording(session *Session) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.recorder == nil {
+		return
+	}
+	h.appendRecordingLocked(session, recording.Event{Kind: recording.End, At: time.Now().UTC()})
+	if session.recorder != nil {
+		session.recorder.Close()
+		session.recorder = nil
+	}
+}
+
+// runRecordingCompaction folds the changes in recordings that are older
+// than the horizon into snapshots, every so often, so long-lived rooms play
+// back from a recent state instead of their whole history. Recordings
+// still going on are compacted once they end.
+func (h *Hub) runRecordingCompaction() {
+	if h.recordings == nil || h.config.RecordingHorizon <= 0 {
+		return
+	}
+	ticker := time.NewTicker(max(h.config.RecordingCompaction, time.Minute))
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		compacted, err := h.recordings.CompactAll(now.Add(-h.config.RecordingHorizon))
+		if err != nil {
+			log.Printf("Failed to compact recordings: %v", err)
+		}
+		if compacted > 0 {
+			log.Printf("Compacted %d recordings", compacted)
+		}
+	}
+}
+
+// recordingCaller returns the verified username of a caller, or responds
+// 404 when sessions aren't recorded and 401 for anonymous callers
+func (h *Hub) recordingCaller(c *gin.Context) (string, bool) {
+	if h.recordings == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "sessions are not recorded"})
+		return "", false
+	}
+	username := h.requestUsername(c)
+	if username == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "a valid token is required"})
+		return "", false
+	}
+	return username, true
+}
+
+// recordingListSpec is how a session's recordings can be listed
+var recordingListSpec = listquery.Spec{
+	Sorts:   []string{"started", "-started"},
+	Filters: []listquery.Filter{listquery.Since, listquery.Until},
+}
+
+// handleListRecordings returns the recordings of a session the caller
+// owned, oldest first, a page at a time. They outlive the session, so it
+// needn't be open.
+func handleListRecordings(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, ok := hub.recordingCaller(c)
+		if !ok {
+			return
+		}
+		q, ok := listQuery(c, recordingListSpec)
+		if !ok {
+			return
+		}
+
+		infos, err := hub.recordings.List(c.Param("sessionId"))
+		if err != nil {
+			log.Printf("Failed to list the recordings of session %s: %v", c.Param("sessionId"), err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list recordings"})
+			return
+		}
+		var owned []recording.Info
+		for _, info := range infos {
+			if info.Owner == username && q.During(info.StartedAt) {
+				owned = append(owned, info)
+			}
+		}
+		page, next := listquery.Page(owned, q,
+			func(info recording.Info, _ string) string { return listquery.TimeKey(info.StartedAt) },
+			func(info recording.Info) string { return info.ID })
+		listPage(c, "recordings", page, next)
+	}
+}
+
+// handleStreamRecording plays one of the caller's recordings back as JSON
+// lines, each event sent when it happened relative to the start. The
+// speed query parameter plays it faster or slower; 0 sends everything at
+// once. A recording still going on is played up to where it is.
+func handleStreamRecording(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, ok := hub.recordingCaller(c)
+		if !ok {
+			return
+		}
+
+		speed := 1.0
+		if raw := c.Query("speed"); raw != "" {
+			parsed, err := strconv.ParseFloat(raw, 64)
+			if err != nil || parsed < 0 || parsed > maxReplaySpeed {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "speed must be from 0 to " + strconv.Itoa(maxReplaySpeed)})
+				return
+			}
+			speed = parsed
+		}
+
+		sessionID, id := c.Param("sessionId"), c.Param("recordingId")
+		info, err := hub.recordings.Stat(sessionID, id)
+		if err == nil && info.Owner != username {
+			err = recording.ErrNotFound
+		}
+		if errors.Is(err, recording.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "recording not found"})
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to read recording %s of session %s: %v", id, sessionID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read recording"})
+			return
+		}
+		reader, err := hub.recordings.Open(sessionID, id)
+		if err != nil {
+			log.Printf("Failed to read recording %s of session %s: %v", id, sessionID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read recording"})
+			return
+		}
+		defer reader.Close()
+
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Status(http.StatusOK)
+		ctx := c.Request.Context()
+		var last time.Time
+		for {
+			event, err := reader.Next()
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if err != nil {
+				log.Printf("Failed to read recording %s of session %s: %v", id, sessionID, err)
+				return
+			}
+
+			// Snapshots of a compacted recording stand for everything
+			// before them, which isn't waited through
+			if speed > 0 && event.Kind != recording.Snapshot && !last.IsZero() && event.At.After(last) {
+				timer := time.NewTimer(time.Duration(float64(event.At.Sub(last)) / speed))
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				case <-timer.C:
+				}
+			}
+			last = event.At
+
+			line, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("Error marshaling recording event: %v", err)
+				return
+			}
+			if _, err := c.Writer.Write(append(line, '\n')); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+	}
+}
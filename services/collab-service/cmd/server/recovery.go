@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// recoverSessions opens the sessions saved within RecoveryWindow, with
+// their history, as they were when the server went down. Clients
+// reconnecting after a crash or restart land in them instead of waiting
+// for them to load, and the other instances learn they are served here
+// again. The ones nobody rejoins close after RecoveryWindow, unless they
+// are always-on rooms, which stay open anyway.
+func (h *Hub) recoverSessions() {
+	if h.store == nil || h.config.RecoveryWindow <= 0 || h.config.RecoveryLimit <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+	ids, err := h.store.Recent(ctx, time.Now().Add(-h.config.RecoveryWindow), h.config.RecoveryLimit)
+	cancel()
+	if err != nil {
+		log.Printf("Failed to find the sessions to recover: %v", err)
+		return
+	}
+
+	for _, id := range ids {
+		session := h.getOrCreateSession(id)
+		h.loadHistory(session)
+		time.AfterFunc(h.config.RecoveryWindow, func() {
+			h.expire <- session
+		})
+	}
+	if len(ids) > 0 {
+		log.Printf("Recovered %d sessions active within %s", len(ids), h.config.RecoveryWindow)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// relayHeader marks connections relayed from another region, which are
+// served where they land rather than relayed again
+const relayHeader = "X-Codecollab-Relay"
+
+// relayPing is how often a relay measures the round trip to the session's
+// home region
+const relayPing = 10 * time.Second
+
+// relayRTTWeight is how much each round trip counts towards the average
+const relayRTTWeight = 0.2
+
+// Sessions are homed in the region of whoever first locates or joins
+// them, and served there only, so their edits are ordered in one place.
+// Clients ask /locate where to connect, which is the edge in their own
+// region; an edge relays a client of a session homed elsewhere to the home
+// region, frame by frame, measuring the round trip as it goes. Where each
+// session is homed is kept on the backplane, which the regions share.
+// Without one, only this instance knows where the sessions it placed are.
+
+// RegionRelays are the relays from this region to another, with the
+// latency to it, in milliseconds
+type RegionRelays struct {
+	Region    string  `json:"region"`
+	Active    int     `json:"active"`
+	Total     int64   `json:"total"`
+	Messages  int64   `json:"messages"`
+	LastRTTMs float64 `json:"lastRttMs"`
+	AvgRTTMs  float64 `json:"avgRttMs"`
+	MaxRTTMs  float64 `json:"maxRttMs"`
+}
+
+// regionStats is what the relays to each region measured
+type regionStats struct {
+	mu     sync.Mutex
+	byHome map[string]*RegionRelays
+	// conns are the relayed client connections, to see off at shutdown
+	conns map[*websocket.Conn]bool
+}
+
+func newRegionStats() *regionStats {
+	return &regionStats{byHome: make(map[string]*RegionRelays), conns: make(map[*websocket.Conn]bool)}
+}
+
+func (s *regionStats) opened(home string, conn *websocket.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	relays, ok := s.byHome[home]
+	if !ok {
+		relays = &RegionRelays{Region: home}
+		s.byHome[home] = relays
+	}
+	relays.Active++
+	relays.Total++
+	s.conns[conn] = true
+}
+
+func (s *regionStats) closed(home string, conn *websocket.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byHome[home].Active--
+	delete(s.conns, conn)
+}
+
+func (s *regionStats) relayed(home string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byHome[home].Messages++
+}
+
+func (s *regionStats) measured(home string, rtt time.Duration) {
+	ms := float64(rtt.Microseconds()) / 1000
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	relays := s.byHome[home]
+	if relays.AvgRTTMs == 0 {
+		relays.AvgRTTMs = ms
+	} else {
+		relays.AvgRTTMs += relayRTTWeight * (ms - relays.AvgRTTMs)
+	}
+	relays.LastRTTMs = ms
+	relays.MaxRTTMs = max(relays.MaxRTTMs, ms)
+}
+
+// snapshot returns the relays to each region, by region
+func (s *regionStats) snapshot() []RegionRelays {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot := make([]RegionRelays, 0, len(s.byHome))
+	for _, relays := range s.byHome {
+		snapshot = append(snapshot, *relays)
+	}
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].Region < snapshot[j].Region })
+	return snapshot
+}
+
+// disconnectAll sends every relayed client a close frame
+func (s *regionStats) disconnectAll(code int, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	frame := websocket.FormatCloseMessage(code, reason)
+	for conn := range s.conns {
+		conn.WriteControl(websocket.CloseMessage, frame, time.Now().Add(writeWait))
+	}
+}
+
+// parseRegions reads a list like "us=https://us.example.com,eu=..." of the
+// base URLs of each region's collab service
+func parseRegions(spec string) (map[string]string, error) {
+	regions := make(map[string]string)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, endpoint, ok := strings.Cut(entry, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid region %q, expected name=url", entry)
+		}
+		parsed, err := url.Parse(endpoint)
+		if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid endpoint URL %q of region %s", endpoint, name)
+		}
+		regions[name] = strings.TrimRight(endpoint, "/")
+	}
+	return regions, nil
+}
+
+// regional reports whether sessions are placed in regions
+func (h *Hub) regional() bool {
+	return h.config.Region != "" && len(h.regions) > 0
+}
+
+// wsEndpoint is where clients connect to a session in a region
+func (h *Hub) wsEndpoint(region, sessionID string) string {
+	endpoint := h.regions[region]
+	if rest, ok := strings.CutPrefix(endpoint, "https://"); ok {
+		endpoint = "wss://" + rest
+	} else if rest, ok := strings.CutPrefix(endpoint, "http://"); ok {
+		endpoint = "ws://" + rest
+	}
+	return endpoint + "/ws/" + url.PathEscape(sessionID)
+}
+
+// homeRegion returns the region a session is homed in, homing it in region
+// if it isn't yet. While the backplane is down sessions are served where
+// they are joined.
+func (h *Hub) homeRegion(ctx context.Context, sessionID, region string) string {
+	if h.peers != nil {
+		home, err := h.peers.Home(ctx, sessionID, region)
+		if err != nil {
+			log.Printf("Failed to find the home region of session %s, serving it here: %v", sessionID, err)
+			return h.config.Region
+		}
+		return home
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	home, ok := h.homes[sessionID]
+	if !ok {
+		home = region
+		h.homes[sessionID] = home
+	}
+	return home
+}
+
+// handleLocate tells a client where to connect to a session: the edge in
+// its region, given by the region query parameter, which relays it to the
+// session's home region unless that is the same. A session not homed yet
+// is homed in the client's region.
+func handleLocate(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hub.regional() {
+			c.JSON(http.StatusNotFound, gin.H{"error": "sessions are not placed in regions"})
+			return
+		}
+		region := c.DefaultQuery("region", hub.config.Region)
+		if _, ok := hub.regions[region]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown region " + region})
+			return
+		}
+
+		sessionID := c.Param("sessionId")
+		ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+		defer cancel()
+		home := hub.homeRegion(ctx, sessionID, region)
+		c.JSON(http.StatusOK, gin.H{
+			"sessionId":    sessionID,
+			"region":       region,
+			"endpoint":     hub.wsEndpoint(region, sessionID),
+			"home":         home,
+			"homeEndpoint": hub.wsEndpoint(home, sessionID),
+		})
+	}
+}
+
+// handleRegions returns the regions and the relays from this one, with
+// the latency to each region relayed to
+func handleRegions(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hub.regional() {
+			c.JSON(http.StatusNotFound, gin.H{"error": "sessions are not placed in regions"})
+			return
+		}
+		names := make([]string, 0, len(hub.regions))
+		for name := range hub.regions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		c.JSON(http.StatusOK, gin.H{"region": hub.config.Region, "regions": names, "relays": hub.regionStats.snapshot()})
+	}
+}
+
+// relayHome connects the client to the session in its home region, if
+// that isn't this one, reporting whether it did or responded with an error
+func (h *Hub) relayHome(c *gin.Context, sessionID string) bool {
+	if !h.regional() || c.GetHeader(relayHeader) != "" {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+	home := h.homeRegion(ctx, sessionID, h.config.Region)
+	cancel()
+	if _, known := h.regions[home]; home == h.config.Region || !known {
+		return false
+	}
+
+	target := h.wsEndpoint(home, sessionID)
+	if c.Request.URL.RawQuery != "" {
+		target += "?" + c.Request.URL.RawQuery
+	}
+	header := http.Header{relayHeader: {h.config.Region}, "X-Forwarded-For": {c.ClientIP()}}
+	for _, name := range []string{"Authorization", "Accept-Language", "User-Agent"} {
+		if value := c.GetHeader(name); value != "" {
+			header.Set(name, value)
+		}
+	}
+	dialCtx, cancelDial := context.WithTimeout(c.Request.Context(), persistTimeout)
+	upstream, _, err := websocket.DefaultDialer.DialContext(dialCtx, target, header)
+	cancelDial()
+	if err != nil {
+		log.Printf("Failed to relay a client of session %s to region %s: %v", sessionID, home, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "the session's home region is unreachable"})
+		return true
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("Failed to upgrade connection: %v", err)
+		upstream.Close()
+		return true
+	}
+	if h.config.MaxMessageBytes > 0 {
+		conn.SetReadLimit(int64(h.config.MaxMessageBytes))
+	}
+	log.Printf("Relaying a client of session %s to region %s", sessionID, home)
+	go h.relay(conn, upstream, home)
+	return true
+}
+
+// relay copies frames between a client and its session's home region
+// until either side closes, passing the close on to the other, and pings
+// the home region to measure the round trip
+func (h *Hub) relay(conn, upstream *websocket.Conn, home string) {
+	h.regionStats.opened(home, conn)
+	defer h.regionStats.closed(home, conn)
+	h.connections.Add(1)
+	defer h.connections.Add(-1)
+
+	upstream.SetPongHandler(func(data string) error {
+		if len(data) == 8 {
+			sent := time.Unix(0, int64(binary.BigEndian.Uint64([]byte(data))))
+			h.regionStats.measured(home, time.Since(sent))
+		}
+		return nil
+	})
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(relayPing)
+		defer ticker.Stop()
+		for {
+			ping := binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+			if err := upstream.WriteControl(websocket.PingMessage, ping, time.Now().Add(writeWait)); err != nil {
+				return
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	// Home to client, in its own goroutine; client to home here
+	go func() {
+		pipeFrames(upstream, conn, func() { h.regionStats.relayed(home) })
+		conn.Close()
+	}()
+	pipeFrames(conn, upstream, func() { h.regionStats.relayed(home) })
+	close(done)
+	upstream.Close()
+}
+
+// pipeFrames copies messages from src to dst until src closes, then
+// passes its close code on
+func pipeFrames(src, dst *websocket.Conn, copied func()) {
+	for {
+		kind, data, err := src.ReadMessage()
+		if err != nil {
+			code, reason := websocket.CloseGoingAway, ""
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) && closeErr.Code != websocket.CloseNoStatusReceived {
+				code, reason = closeErr.Code, closeErr.Text
+			}
+			dst.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeWait))
+			return
+		}
+		if err := dst.WriteMessage(kind, data); err != nil {
+			return
+		}
+		copied()
+	}
+}
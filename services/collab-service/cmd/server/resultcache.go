@@ -0,0 +1,39 @@
+package main
+
+import "log"
+
+// setResultCache turns result caching on or off for the session. Only the
+// owner may change it, since cached results hide nondeterministic output.
+func (h *Hub) setResultCache(c *Client, enabled bool) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	if session.roleLocked(c) != RoleOwner {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: "only the session owner can change result caching"})
+		return
+	}
+	session.CacheResults = enabled
+	session.mu.Unlock()
+
+	log.Printf("Session %s result caching set to %t by %s", c.SessionID, enabled, c.ID)
+	h.broadcastToSession(c.SessionID, OutgoingMessage{Type: "result-cache", Enabled: enabled})
+}
+
+func (h *Hub) sendResultCache(c *Client) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	enabled := session.CacheResults
+	session.mu.RUnlock()
+
+	if enabled {
+		h.sendToClient(c, OutgoingMessage{Type: "result-cache", Enabled: true})
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sort"
+)
+
+// errNothingToResume is sent for a "resume" from a client that didn't
+// reconnect with the session's resume token, and was sent every document
+const errNothingToResume = "there is nothing to resume; the documents were sent in full"
+
+// A client is sent a resume-token when it connects. If it loses its
+// connection, it reconnects with ?resume=<token> and, instead of every
+// document, is sent nothing until it says with a "resume" which revision
+// of each file it has. It is then sent the operations it missed, as
+// "operation" messages, and the files it can't catch up on that way in
+// full, as on connecting, followed by a "resumed". A token the session no
+// longer has, as once it closed or on another instance, is ignored and the
+// documents are sent in full.
+
+func newResumeToken() string {
+	token := make([]byte, 16)
+	rand.Read(token)
+	return hex.EncodeToString(token)
+}
+
+// offerResume sends a newly connected client the session's resume token,
+// and reports whether it reconnected with it, to be sent what it missed
+// once it resumes
+func (h *Hub) offerResume(session *Session, c *Client) bool {
+	session.mu.Lock()
+	token := session.resumeToken
+	c.resuming = c.resume != "" && c.resume == token
+	resuming := c.resuming
+	session.mu.Unlock()
+
+	h.sendToClient(c, OutgoingMessage{Type: "resume-token", ResumeToken: token})
+	if resuming {
+		log.Printf("Client %s is resuming session %s", c.ID, session.ID)
+	}
+	return resuming
+}
+
+// resume sends a reconnected client what was done to the files since the
+// revisions it has: the operations, if the session still has them all,
+// or else the file as it is. Operations are queued while the session is
+// locked, so any made meanwhile follow them in order.
+func (h *Hub) resume(c *Client, revisions map[string]int) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	if !c.resuming {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: errNothingToResume})
+		return
+	}
+	c.resuming = false
+	role := session.roleLocked(c)
+	replayed := 0
+	var docs []OutgoingMessage
+	for _, file := range session.Files {
+		if file.Binary || !file.visibleTo(role) {
+			continue
+		}
+		revision, known := revisions[file.Path]
+		if known && session.SyncMode != SyncCRDT {
+			if ops, err := file.doc.Since(revision); err == nil {
+				for i, op := range ops {
+					sendLocked(c, OutgoingMessage{
+						Type:     "operation",
+						Path:     file.Path,
+						Revision: revision + i + 1,
+						Ops:      op.Edits(),
+					})
+				}
+				replayed += len(ops)
+				continue
+			}
+		}
+		docs = append(docs, h.documentSyncLocked(session, file, role))
+	}
+	session.mu.Unlock()
+
+	sort.Slice(docs, func(i, j int) bool { return docs[i].Path < docs[j].Path })
+	for _, doc := range docs {
+		h.sendDocument(c, doc)
+	}
+	h.sendToClient(c, OutgoingMessage{Type: "resumed"})
+	log.Printf("Client %s resumed session %s: %d operations replayed, %d documents resent", c.ID, c.SessionID, replayed, len(docs))
+}
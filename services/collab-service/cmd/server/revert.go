@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/ot"
+)
+
+// Reversal is what a revert-user took back: Edits of Username's changes
+// since Since, to Paths. Stale is set when some of them were too old to
+// take back.
+type Reversal struct {
+	Username string    `json:"username"`
+	Since    time.Time `json:"since"`
+	Edits    int       `json:"edits"`
+	Paths    []string  `json:"paths"`
+	Stale    bool      `json:"stale,omitempty"`
+}
+
+// undoStacksOf returns the undo histories of edits made under username,
+// from every connection or verified user that took the name, in a set
+// order. Caller must hold session.mu.
+func (f *File) undoStacksOf(username string) []*undoStacks {
+	owners := make([]string, 0, len(f.undo))
+	for owner, stacks := range f.undo {
+		if stacks.username == username {
+			owners = append(owners, owner)
+		}
+	}
+	sort.Strings(owners)
+	matching := make([]*undoStacks, len(owners))
+	for i, owner := range owners {
+		matching[i] = f.undo[owner]
+	}
+	return matching
+}
+
+// revertUser takes back what username changed in the last minutes, for
+// cleaning up after a bad paste or a vandal. Each edit is undone as their
+// own undo would, newest first, so what others changed since stays; only
+// the edits still in username's undo history can be. The owner may do it
+// for anyone, and the session is told what was taken back.
+func (h *Hub) revertUser(c *Client, username string, minutes int) {
+	if username == "" {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: "username is required"})
+		return
+	}
+	if minutes <= 0 {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: "minutes must be positive"})
+		return
+	}
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	if !isTrustedLocked(session, c) {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: "only the session owner can revert a participant's edits"})
+		return
+	}
+
+	since := time.Now().Add(-time.Duration(minutes) * time.Minute)
+	reversal := &Reversal{Username: username, Since: since.UTC(), Paths: []string{}}
+	paths := make([]string, 0, len(session.Files))
+	for filePath := range session.Files {
+		paths = append(paths, filePath)
+	}
+	sort.Strings(paths)
+
+	var err error
+	for _, filePath := range paths {
+		file := session.Files[filePath]
+		if file.Binary {
+			continue
+		}
+		reverted := 0
+		for _, stacks := range file.undoStacksOf(username) {
+			for err == nil && len(stacks.undo) > 0 {
+				entry := stacks.undo[len(stacks.undo)-1]
+				if entry.at.Before(since) {
+					break
+				}
+				stacks.undo = stacks.undo[:len(stacks.undo)-1]
+
+				op, transformErr := file.doc.Transform(entry.revision, entry.op)
+				if errors.Is(transformErr, ot.ErrStale) {
+					// Everything older is staler still
+					stacks.undo = nil
+					reversal.Stale = true
+					break
+				}
+				if transformErr != nil || op.IsNoop() {
+					continue
+				}
+				content, applyErr := op.Apply(file.Content)
+				if applyErr != nil || content == file.Content {
+					continue
+				}
+				if err = h.checkQuotaLocked(session, 0, len(content)-len(file.Content)); err != nil {
+					break
+				}
+
+				session.recordEditLocked(c.ID, c.Username, file, content)
+				h.recordChangeLocked(session, auditRevert, c.ID, c.Username, file, content)
+				file.commitOperation(op, content, c.Username)
+				session.broadcastToReadersLocked("", file, OutgoingMessage{
+					Type:     "operation",
+					UserID:   c.ID,
+					Path:     file.Path,
+					Revision: file.doc.Revision(),
+					Ops:      op.Edits(),
+				})
+				reverted++
+			}
+		}
+		if reverted > 0 {
+			reversal.Edits += reverted
+			reversal.Paths = append(reversal.Paths, filePath)
+		}
+	}
+	session.mu.Unlock()
+
+	if err != nil {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: err.Error()})
+	}
+	if reversal.Edits == 0 {
+		if err == nil {
+			h.sendToClient(c, OutgoingMessage{Type: "error", Error: "there are no recent edits to revert"})
+		}
+		return
+	}
+
+	log.Printf("Session %s: %d edits of %s since %s reverted by %s", session.ID, reversal.Edits, username, reversal.Since.Format(time.RFC3339), c.ID)
+	for _, filePath := range reversal.Paths {
+		h.fileChanged(c.SessionID, filePath)
+	}
+	h.scheduleSummaries(session)
+	h.broadcastToSession(c.SessionID, OutgoingMessage{Type: "edits-reverted", Username: c.Username, Reversal: reversal})
+}
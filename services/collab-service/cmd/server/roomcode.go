@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Room code words. Codes are an adjective, an animal and a number from 10
+// to 99, like blue-otter-42, easy to say out loud in a meeting.
+var (
+	codeAdjectives = []string{
+		"amber", "bold", "brave", "bright", "calm", "clever", "cosmic", "crisp",
+		"daring", "eager", "fancy", "fluffy", "gentle", "golden", "happy", "humble",
+		"icy", "jolly", "keen", "lively", "lucky", "mellow", "merry", "misty",
+		"noble", "olive", "proud", "quick", "quiet", "rapid", "rosy", "rusty",
+		"shiny", "silver", "sleepy", "smooth", "snowy", "sunny", "swift", "tidy",
+		"tiny", "vivid", "warm", "wild", "witty", "young", "zany", "blue",
+	}
+	codeAnimals = []string{
+		"badger", "bear", "beaver", "bison", "cat", "cobra", "crane", "crow",
+		"deer", "dolphin", "eagle", "falcon", "ferret", "finch", "fox", "frog",
+		"gecko", "goat", "hare", "hawk", "heron", "ibis", "koala", "lemur",
+		"lion", "llama", "lynx", "marten", "mole", "moose", "newt", "otter",
+		"owl", "panda", "parrot", "puffin", "quail", "raven", "seal", "shark",
+		"sloth", "swan", "tiger", "toad", "trout", "walrus", "whale", "wolf",
+	}
+)
+
+// roomCodeAttempts bounds the codes tried for one that is free
+const roomCodeAttempts = 20
+
+func randomRoomCode() string {
+	return fmt.Sprintf("%s-%s-%d",
+		codeAdjectives[rand.IntN(len(codeAdjectives))],
+		codeAnimals[rand.IntN(len(codeAnimals))],
+		10+rand.IntN(90))
+}
+
+// roomCode returns the session's room code, giving it one the first time.
+// With a backplane, the code is the same on every instance and any of
+// them can resolve it.
+func (h *Hub) roomCode(session *Session) string {
+	session.mu.RLock()
+	code := session.RoomCode
+	session.mu.RUnlock()
+	if code != "" {
+		return code
+	}
+
+	if h.peers != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+		defer cancel()
+		var err error
+		if code, err = h.peers.RoomCode(ctx, session.ID, randomRoomCode); err != nil {
+			log.Printf("Session %s: no shared room code: %v", session.ID, err)
+			code = ""
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := 0; code == "" && i < roomCodeAttempts; i++ {
+		if candidate := randomRoomCode(); h.roomCodes[candidate] == "" {
+			code = candidate
+		}
+	}
+	if code == "" {
+		return ""
+	}
+	session.mu.Lock()
+	if session.RoomCode == "" {
+		session.RoomCode = code
+		h.roomCodes[code] = session.ID
+	}
+	code = session.RoomCode
+	session.mu.Unlock()
+	return code
+}
+
+// releaseRoomCode frees the code of a session that is closing. The shared
+// code of a session on a backplane is kept, as other instances may still
+// have the session open.
+func (h *Hub) releaseRoomCode(session *Session) {
+	session.mu.RLock()
+	code := session.RoomCode
+	session.mu.RUnlock()
+
+	h.mu.Lock()
+	if h.roomCodes[code] == session.ID {
+		delete(h.roomCodes, code)
+	}
+	h.mu.Unlock()
+}
+
+// sendRoomCode tells a newly connected client the code others can join
+// the session with
+func (h *Hub) sendRoomCode(session *Session, c *Client) {
+	if code := h.roomCode(session); code != "" {
+		h.sendToClient(c, OutgoingMessage{Type: "room-code", RoomCode: code})
+	}
+}
+
+// handleJoinCode resolves a room code to the session it's for
+func handleJoinCode(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		code := strings.ToLower(strings.TrimSpace(c.Param("code")))
+
+		hub.mu.RLock()
+		sessionID := hub.roomCodes[code]
+		hub.mu.RUnlock()
+		if sessionID == "" && hub.peers != nil {
+			ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+			defer cancel()
+			var err error
+			if sessionID, _, err = hub.peers.ResolveRoomCode(ctx, code); err != nil {
+				log.Printf("Failed to resolve room code %s: %v", code, err)
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "room codes are unavailable"})
+				return
+			}
+		}
+		if sessionID == "" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "unknown room code"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": code, "sessionId": sessionID})
+	}
+}
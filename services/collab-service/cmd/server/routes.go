@@ -0,0 +1,206 @@
+package main
+
+import "github.com/gin-gonic/gin"
+
+// newRouter routes the REST API and the WebSocket endpoints to hub
+func newRouter(hub *Hub) *gin.Engine {
+	router := gin.Default()
+	router.Use(hub.checkSignature, hub.requireScopes)
+
+	// Health check
+	router.GET("/health", func(c *gin.Context) {
+		status, degraded := "healthy", hub.degradedServices()
+		if len(degraded) > 0 {
+			status = "degraded"
+		}
+		c.JSON(200, gin.H{
+			"status":        status,
+			"service":       "collab-service",
+			"sandboxes":     hub.sandboxes.Stats(),
+			"degraded":      degraded,
+			"pendingWrites": hub.pendingSaves(),
+			"load":          hub.loadStats(),
+		})
+	})
+
+	// Root
+	router.GET("/", func(c *gin.Context) {
+		c.JSON(200, gin.H{
+			"service": "collab-service",
+			"status":  "running",
+			"version": "0.1.0",
+		})
+	})
+
+	// WebSocket endpoint
+	router.GET("/ws/:sessionId", handleWebSocket(hub))
+
+	// Multi-region placement
+	router.GET("/locate/:sessionId", handleLocate(hub))
+	router.GET("/regions", handleRegions(hub))
+
+	// Short codes that stand for session IDs, for sharing out loud
+	router.GET("/join/:code", handleJoinCode(hub))
+
+	// QR code of a viewer link, for presenting
+	router.GET("/sessions/:sessionId/qr", handleSessionQR(hub))
+
+	// Revocable read-only links to sessions
+	router.GET("/sessions/:sessionId/share-links", handleListShareLinks(hub))
+	router.POST("/sessions/:sessionId/share-links", handleCreateShareLink(hub))
+	router.DELETE("/sessions/:sessionId/share-links/:linkId", handleRevokeShareLink(hub))
+
+	// Short-lived URLs to download recordings, assets and exports from
+	// without a token, which a CDN can cache
+	router.POST("/signed-urls", handleSignURL(hub))
+
+	// Recordings of sessions, for playback
+	router.GET("/sessions/:sessionId/recordings", handleListRecordings(hub))
+	router.GET("/sessions/:sessionId/recordings/:recordingId", handleStreamRecording(hub))
+
+	// Organizations' stable names for recurring sessions
+	router.GET("/s/:slug", handleResolveSlug(hub))
+	router.GET("/org/slugs", handleListSlugs(hub))
+	router.POST("/org/slugs", handleReserveSlug(hub))
+	router.DELETE("/org/slugs/:slug", handleReleaseSlug(hub))
+
+	// Session listings for dashboards
+	router.GET("/org/sessions", handleListSessions(hub))
+	router.POST("/org/sessions/close", handleCloseSessions(hub))
+	router.POST("/org/sessions/purge", handlePurgeSessions(hub))
+	router.POST("/org/sessions/reassign", handleReassignSessions(hub))
+	router.GET("/sessions/:sessionId/participants", handleListParticipants(hub))
+
+	// Organization backups and migration between deployments
+	router.GET("/org/export", handleExportOrg(hub))
+	router.POST("/org/import", handleImportOrg(hub))
+
+	// SCIM provisioning of organizations' users and groups by their
+	// identity providers
+	router.POST("/org/scim/token", handleCreateSCIMToken(hub))
+	router.DELETE("/org/scim/token", handleRevokeSCIMToken(hub))
+	router.GET(scimBase+"/ServiceProviderConfig", handleSCIMConfig(hub))
+	router.GET(scimBase+"/ResourceTypes", handleSCIMResourceTypes(hub))
+	router.GET(scimBase+"/Users", handleListSCIMUsers(hub))
+	router.POST(scimBase+"/Users", handleCreateSCIMUser(hub))
+	router.GET(scimBase+"/Users/:userId", handleGetSCIMUser(hub))
+	router.PUT(scimBase+"/Users/:userId", handleReplaceSCIMUser(hub))
+	router.PATCH(scimBase+"/Users/:userId", handlePatchSCIMUser(hub))
+	router.DELETE(scimBase+"/Users/:userId", handleDeleteSCIMUser(hub))
+	router.GET(scimBase+"/Groups", handleListSCIMGroups(hub))
+	router.POST(scimBase+"/Groups", handleCreateSCIMGroup(hub))
+	router.GET(scimBase+"/Groups/:groupId", handleGetSCIMGroup(hub))
+	router.PUT(scimBase+"/Groups/:groupId", handleReplaceSCIMGroup(hub))
+	router.PATCH(scimBase+"/Groups/:groupId", handlePatchSCIMGroup(hub))
+	router.DELETE(scimBase+"/Groups/:groupId", handleDeleteSCIMGroup(hub))
+
+	// Session document export
+	router.GET("/sessions/:sessionId/export", handleExport(hub))
+
+	// Workspace file upload
+	router.PUT("/sessions/:sessionId/files/*path", handleUpload(hub))
+	router.GET("/sessions/:sessionId/assets/*path", handleAsset(hub))
+
+	// Zip archives of projects unpacked into the workspace, uploaded with
+	// the tus protocol so they can resume (owner only)
+	router.OPTIONS("/sessions/:sessionId/imports", handleImportOptions(hub))
+	router.POST("/sessions/:sessionId/imports", handleCreateImport(hub))
+	router.HEAD("/sessions/:sessionId/imports/:importId", handleImportOffset(hub))
+	router.PATCH("/sessions/:sessionId/imports/:importId", handleImportPart(hub))
+	router.DELETE("/sessions/:sessionId/imports/:importId", handleDeleteImport(hub))
+
+	// Read-only HTML rendering of the session
+	router.GET("/sessions/:sessionId/snapshot.html", handleSnapshotHTML(hub))
+
+	// Printable PDF with per-line author colors
+	router.GET("/sessions/:sessionId/export.pdf", handleExportPDF(hub))
+
+	// Environment variables and secrets for runs (owner only)
+	router.GET("/sessions/:sessionId/env", handleListEnv(hub))
+	router.PUT("/sessions/:sessionId/env/:name", handleSetEnv(hub))
+	router.DELETE("/sessions/:sessionId/env/:name", handleDeleteEnv(hub))
+
+	// Checkpoints, which only the owner may restore
+	router.GET("/sessions/:sessionId/checkpoints", handleListCheckpoints(hub))
+	router.POST("/sessions/:sessionId/checkpoints/:checkpointId/restore", handleRestoreCheckpoint(hub))
+
+	// Scheduled snapshots (owner only)
+	router.GET("/sessions/:sessionId/snapshots", handleListSnapshots(hub))
+	router.GET("/sessions/:sessionId/snapshots/:snapshotId", handleGetSnapshot(hub))
+	router.GET("/sessions/:sessionId/snapshots/:snapshotId/diff", handleDiffSnapshot(hub))
+
+	// Diffs between any two versions of the files (owner only)
+	router.GET("/sessions/:sessionId/diff", handleDiff(hub))
+
+	// Audit log of every operation (owner only)
+	router.GET("/sessions/:sessionId/history", handleOperationHistory(hub))
+
+	// Open suggestions as tracked changes or patches (owner only)
+	router.GET("/sessions/:sessionId/suggestions/export", handleExportSuggestions(hub))
+
+	// Webhook receiving each checkpoint's diff (owner only)
+	router.GET("/sessions/:sessionId/checkpoint-webhook", handleGetCheckpointHook(hub))
+	router.PUT("/sessions/:sessionId/checkpoint-webhook", handleSetCheckpointHook(hub))
+	router.DELETE("/sessions/:sessionId/checkpoint-webhook", handleDeleteCheckpointHook(hub))
+
+	// Preview proxy for servers started inside the execution sandbox
+	router.Any("/sessions/:sessionId/preview/:token/*path", handlePortPreview(hub))
+
+	// Run history
+	router.GET("/sessions/:sessionId/runs", handleListRuns(hub))
+
+	// Git repository the session is imported from and pushed to (owner only)
+	router.GET("/sessions/:sessionId/git", handleGetGit(hub))
+	router.POST("/sessions/:sessionId/git/import", handleImportGit(hub))
+	router.POST("/sessions/:sessionId/git/commit-and-push", handlePushGit(hub))
+
+	// Session templates, managed by admins
+	router.GET("/templates", handleListTemplates(hub))
+	router.GET("/templates/:templateId", handleGetTemplate(hub))
+	router.POST("/templates/:templateId/sessions", handleCreateFromTemplate(hub))
+	router.PUT("/admin/templates/:templateId", handlePutTemplate(hub))
+	router.DELETE("/admin/templates/:templateId", handleDeleteTemplate(hub))
+
+	// GitHub Gists
+	router.POST("/sessions/:sessionId/gist", handleExportGist(hub))
+	router.POST("/gists/import", handleImportGist(hub))
+
+	// IRC channel or Matrix room the chat is mirrored to (owner only)
+	router.GET("/sessions/:sessionId/chat-bridge", handleGetChatBridge(hub))
+	router.PUT("/sessions/:sessionId/chat-bridge", handleSetChatBridge(hub))
+	router.DELETE("/sessions/:sessionId/chat-bridge", handleDeleteChatBridge(hub))
+
+	// Each organization's lobby chat, for verified users of the organization
+	router.GET("/lobby", handleLobby(hub))
+
+	// Edits and deletions of chat messages, for moderation (owner only)
+	router.GET("/sessions/:sessionId/chat/audit", handleChatAudit(hub))
+
+	// Triggers and actions for no-code automation tools (owner only)
+	router.GET("/connectors", handleListConnectors(hub))
+	router.GET("/sessions/:sessionId/connectors/subscriptions", handleListSubscriptions(hub))
+	router.POST("/sessions/:sessionId/connectors/subscriptions", handleSubscribe(hub))
+	router.DELETE("/sessions/:sessionId/connectors/subscriptions/:id", handleUnsubscribe(hub))
+	router.POST("/sessions/:sessionId/connectors/actions/:action", handleRunAction(hub))
+
+	// Notification preferences of the calling user
+	router.GET("/users/me/preferences", handleGetPreferences(hub))
+	router.PUT("/users/me/preferences", handlePutPreferences(hub))
+
+	// Whether the caller is coding right now, for status integrations
+	router.GET("/users/me/presence", handleGetPresence(hub))
+	// Colleagues in the caller's organization who share their presence
+	router.GET("/users/me/colleagues", handleListColleagues(hub))
+
+	// The caller's connections, and signing them out
+	router.GET("/users/me/connections", handleListConnections(hub))
+	router.DELETE("/users/me/connections/:connectionId", handleCloseConnection(hub))
+
+	// System announcements from operators (ADMIN_TOKEN)
+	router.GET("/admin/announcements", handleListAnnouncements(hub))
+	router.POST("/admin/announcements", handleCreateAnnouncement(hub))
+	router.DELETE("/admin/announcements/:id", handleDeleteAnnouncement(hub))
+	router.GET("/admin/announcements/:id/receipts", handleAnnouncementReceipts(hub))
+
+	return router
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/codecollab/collab-service/internal/execution"
+	"github.com/codecollab/collab-service/internal/languages"
+	"github.com/codecollab/collab-service/internal/listquery"
+	"github.com/codecollab/collab-service/internal/resultcache"
+	"github.com/gin-gonic/gin"
+)
+
+// Run kinds and statuses
+const (
+	RunKindFile = "file"
+	RunKindCell = "cell"
+	RunKindTask = "task"
+
+	RunRunning   = "running"
+	RunDone      = "done"
+	RunError     = "error"
+	RunCancelled = "cancelled"
+)
+
+// Run is one execution in the session's sandbox, kept in the run history
+// so participants can revisit earlier results. Output is masked and
+// truncated before it is stored.
+type Run struct {
+	ID         string    `json:"id"`
+	Kind       string    `json:"kind"`
+	Path       string    `json:"path,omitempty"`
+	Task       string    `json:"task,omitempty"`
+	Cell       *int      `json:"cell,omitempty"`
+	Language   string    `json:"language,omitempty"`
+	Variant    string    `json:"variant,omitempty"`
+	Command    string    `json:"command"`
+	Env        []string  `json:"env,omitempty"`
+	RunBy      string    `json:"runBy"`
+	Status     string    `json:"status"`
+	ExitCode   int       `json:"exitCode"`
+	Stdout     string    `json:"stdout,omitempty"`
+	Stderr     string    `json:"stderr,omitempty"`
+	Truncated  bool      `json:"truncated,omitempty"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt,omitzero"`
+	// Duration is in milliseconds
+	Duration    float64 `json:"duration,omitempty"`
+	CancelledBy string  `json:"cancelledBy,omitempty"`
+	// CachedAt is set when the result was reused from an identical run
+	// instead of being executed
+	CachedAt time.Time `json:"cachedAt,omitzero"`
+
+	// execID tags the run's processes in its sandbox, and
+	// stop abandons the request if killing them fails
+	execID string
+	stop   context.CancelFunc
+	// files are the workspace files a task run was given
+	files []string
+	// role is the starter's role, which decides the manifests the install
+	// phase reads
+	role Role
+	// subject is the starter's verified token subject, who may cancel the
+	// run, or "" when they only named themselves
+	subject string
+}
+
+// truncateLog cuts s to at most limit bytes without splitting a rune
+func truncateLog(s string, limit int) (string, bool) {
+	if limit <= 0 || len(s) <= limit {
+		return s, false
+	}
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut], true
+}
+
+// startRunLocked adds a run to the history, dropping the oldest runs past
+// the retention limit. Caller must hold session.mu.
+func (h *Hub) startRunLocked(s *Session, run *Run, env map[string]string) {
+	s.nextRunID++
+	run.ID = fmt.Sprintf("r%d", s.nextRunID)
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	run.execID = hex.EncodeToString(buf)
+	run.Status = RunRunning
+	run.StartedAt = time.Now()
+	run.Command, run.Truncated = truncateLog(run.Command, h.config.RunLogBytes)
+	for name := range env {
+		run.Env = append(run.Env, name)
+	}
+	sort.Strings(run.Env)
+
+	s.Runs = append(s.Runs, run)
+	if limit := h.config.RunHistoryLimit; limit > 0 && len(s.Runs) > limit {
+		s.Runs = append([]*Run(nil), s.Runs[len(s.Runs)-limit:]...)
+	}
+}
+
+// finishRunLocked records the outcome of a run. stdout and stderr must
+// already be masked. Caller must hold session.mu.
+func (h *Hub) finishRunLocked(run *Run, stdout, stderr string, exitCode int, duration float64) {
+	var cutOut, cutErr bool
+	run.Stdout, cutOut = truncateLog(stdout, h.config.RunLogBytes)
+	run.Stderr, cutErr = truncateLog(stderr, h.config.RunLogBytes)
+	run.Truncated = run.Truncated || cutOut || cutErr
+	run.ExitCode = exitCode
+	run.Duration = duration
+	run.FinishedAt = time.Now()
+	switch {
+	case run.CancelledBy != "":
+		run.Status = RunCancelled
+	case exitCode != 0:
+		run.Status = RunError
+	default:
+		run.Status = RunDone
+	}
+}
+
+// runVisibleLocked reports whether role may see a run: the run's file,
+// or for a task every file the task was given. Caller must hold session.mu.
+func (s *Session) runVisibleLocked(run *Run, role Role) bool {
+	if run.Kind != RunKindTask {
+		file, ok := s.Files[run.Path]
+		return ok && file.visibleTo(role)
+	}
+	for _, filePath := range run.files {
+		if file, ok := s.Files[filePath]; ok && !file.visibleTo(role) {
+			return false
+		}
+	}
+	return true
+}
+
+// runLocked finds a run in the history. Caller must hold session.mu.
+func (s *Session) runLocked(runID string) *Run {
+	for _, run := range s.Runs {
+		if run.ID == runID {
+			return run
+		}
+	}
+	return nil
+}
+
+// QueueStatus is a run's place in the node's execution queue. Position 0
+// means the run has left the queue and is executing.
+type QueueStatus struct {
+	RunID    string `json:"runId"`
+	Position int    `json:"position"`
+	Waiting  int    `json:"waiting"`
+}
+
+// execute waits for a free execution slot, then sends the run to the
+// execution service, bounded by the configured timeout plus some slack for
+// the round trip. Queue positions are sent to everyone who can see the file.
+// Sessions with result caching get an earlier identical run's result
+// without executing anything.
+func (h *Hub) execute(session *Session, run *Run, req execution.Request) (*execution.Result, error) {
+	return h.executeStreaming(session, run, req, nil)
+}
+
+// executeStreaming is execute with the run's output passed to onOutput as
+// it is produced. Streamed runs always execute, bypassing the result cache.
+func (h *Hub) executeStreaming(session *Session, run *Run, req execution.Request, onOutput func(execution.Output)) (*execution.Result, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	session.mu.Lock()
+	run.stop = cancel
+	req.RunID = run.execID
+	cancelled := run.CancelledBy != ""
+	runID, filePath := run.ID, run.Path
+	caching := session.CacheResults && onOutput == nil
+	plan, err := h.installPlanLocked(session, run.role)
+	policy := h.sessionPolicyLocked(session)
+	session.mu.Unlock()
+
+	if cancelled {
+		return nil, context.Canceled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if plan != nil {
+		// Runs get the manifests too, which also keeps cached results
+		// apart when the dependencies change
+		files := make(map[string]string, len(req.Files)+len(plan.Files))
+		maps.Copy(files, req.Files)
+		maps.Copy(files, plan.Files)
+		req.Files = files
+	}
+
+	var cacheKey string
+	if caching {
+		cacheKey = resultcache.Key(req)
+		if result, storedAt, ok := h.results.Get(cacheKey); ok {
+			session.mu.Lock()
+			run.CachedAt = storedAt
+			session.mu.Unlock()
+			return result, nil
+		}
+	}
+
+	// Provisioning happens before queueing, so a cold start doesn't hold a
+	// slot other sessions are waiting for
+	sb, err := h.sandboxes.Acquire(ctx, session.ID, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	queueCtx, queueCancel := context.WithTimeout(ctx, h.config.ExecutionQueueTimeout)
+	defer queueCancel()
+	release, err := h.runQueue.Acquire(queueCtx, session.ID, func(position, waiting int) {
+		h.broadcastToRunReaders(session, run, OutgoingMessage{
+			Type:  "queue-position",
+			Path:  filePath,
+			Queue: &QueueStatus{RunID: runID, Position: position, Waiting: waiting},
+		})
+	})
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, fmt.Errorf("timed out waiting for a free sandbox")
+		}
+		return nil, err
+	}
+	defer release()
+
+	// req.Env may be shared with other runs of the same file
+	env := make(map[string]string, len(req.Env))
+	maps.Copy(env, req.Env)
+	networkEnv := h.networkEnv(policy)
+	maps.Copy(env, networkEnv)
+	if plan != nil {
+		dir, err := h.ensureInstalled(ctx, session, run, sb, plan, networkEnv)
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(env, plan.Env(dir))
+	}
+	req.Env = env
+
+	if req.Timeout == 0 {
+		req.Timeout = int(h.config.ExecutionTimeout / time.Second)
+	}
+	runCtx, runCancel := context.WithTimeout(ctx, time.Duration(req.Timeout)*time.Second+5*time.Second)
+	defer runCancel()
+
+	var result *execution.Result
+	if onOutput != nil {
+		result, err = sb.ExecuteStream(runCtx, req, onOutput)
+	} else {
+		result, err = sb.Execute(runCtx, req)
+	}
+	if err == nil && caching {
+		session.mu.RLock()
+		cancelled = run.CancelledBy != ""
+		session.mu.RUnlock()
+		if !cancelled {
+			h.results.Put(cacheKey, result)
+		}
+	}
+	return result, err
+}
+
+// cancelRun kills a running execution. Only the participant who started it
+// and the session owner may cancel a run.
+func (h *Hub) cancelRun(c *Client, runID string) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	run := session.runLocked(runID)
+	var err error
+	switch {
+	case run == nil:
+		err = fmt.Errorf("run not found: %s", runID)
+	case run.Status != RunRunning:
+		err = fmt.Errorf("run %s is not running", runID)
+	case run.CancelledBy != "":
+		err = fmt.Errorf("run %s is already being cancelled", runID)
+	case (run.subject == "" || run.subject != c.subject()) && session.roleLocked(c) != RoleOwner:
+		err = fmt.Errorf("only the participant who started a run or the session owner can cancel it")
+	}
+	if err != nil {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: err.Error()})
+		return
+	}
+	run.CancelledBy = c.Username
+	execID, stop := run.execID, run.stop
+	cancelled := *run
+	session.mu.Unlock()
+
+	log.Printf("Client %s cancelled run %s in session %s", c.ID, runID, c.SessionID)
+	h.broadcastToRunReaders(session, run, OutgoingMessage{Type: "execution-cancelled", Path: cancelled.Path, Run: &cancelled})
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		killed, err := 0, fmt.Errorf("session has no sandbox")
+		if sb, ok := h.sandboxes.Lookup(c.SessionID); ok {
+			killed, err = sb.Cancel(ctx, execID)
+		}
+		if err != nil || killed == 0 {
+			// Nothing to kill yet, or the service can't be reached: stop
+			// waiting so the session isn't held until the timeout
+			if err != nil {
+				log.Printf("Failed to cancel run %s in session %s: %v", runID, c.SessionID, err)
+			}
+			if stop != nil {
+				stop()
+			}
+		}
+	}()
+}
+
+// runFile executes a whole file and shares the result with everyone who
+// can see it. language is only used when it can't be told from the path.
+// A language with a build matrix gets one run per matrix entry.
+func (h *Hub) runFile(c *Client, filePath, language string) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	role := session.roleLocked(c)
+	file, err := session.visibleFileLocked(filePath, role)
+	if err == nil {
+		switch {
+		case role == RoleViewer:
+			err = fmt.Errorf("viewers cannot run code")
+		case file.Binary:
+			err = fmt.Errorf("binary files cannot be run")
+		}
+	}
+	var builds []languages.Build
+	if err == nil {
+		var registry *languages.Registry
+		var lang *languages.Language
+		registry, lang, err = h.resolveLanguageLocked(session, file, language)
+		if err == nil {
+			builds = registry.Builds(lang)
+		}
+	}
+	var env map[string]string
+	var secrets []string
+	if err == nil {
+		env, secrets, err = h.runEnvLocked(session)
+	}
+	if err != nil {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Path: filePath, Error: err.Error()})
+		return
+	}
+
+	code := file.Content
+	runs := make([]*Run, len(builds))
+	started := make([]Run, len(builds))
+	for i, build := range builds {
+		runs[i] = &Run{Kind: RunKindFile, Path: file.Path, Language: build.Language, Variant: build.Variant, Command: code, RunBy: c.Username, role: role, subject: c.subject()}
+		h.startRunLocked(session, runs[i], env)
+		started[i] = *runs[i]
+	}
+	session.mu.Unlock()
+
+	for i, build := range builds {
+		log.Printf("Client %s started run %s of %s in session %s", c.ID, started[i].ID, started[i].Path, c.SessionID)
+		h.broadcastToReaders(c.SessionID, "", started[i].Path, OutgoingMessage{Type: "run-started", Path: started[i].Path, Run: &started[i]})
+		go h.finishFileRun(c, session, runs[i], buildRequest(build, code, env), secrets)
+	}
+}
+
+// finishFileRun executes a started file run and shares its result
+func (h *Hub) finishFileRun(c *Client, session *Session, run *Run, req execution.Request, secrets []string) {
+	result, err := h.execute(session, run, req)
+
+	session.mu.Lock()
+	if err != nil {
+		h.finishRunLocked(run, "", err.Error(), -1, 0)
+	} else {
+		h.finishRunLocked(run, maskSecrets(result.Stdout, secrets), maskSecrets(result.Stderr, secrets), result.ExitCode, result.ExecutionTime)
+	}
+	finished := *run
+	session.mu.Unlock()
+
+	h.broadcastToReaders(c.SessionID, "", finished.Path, OutgoingMessage{Type: "run-finished", Path: finished.Path, Run: &finished})
+	h.fireTrigger(session, TriggerRunFinished, TriggerEvent{Run: &finished})
+	for _, port := range detectListeningPorts(finished.Stdout + finished.Stderr) {
+		if err := h.openPortPreview(session, port, c.Username); err != nil {
+			log.Printf("Failed to expose port %d for session %s: %v", port, c.SessionID, err)
+		}
+	}
+}
+
+// runListSpec is how a session's run history can be listed
+var runListSpec = listquery.Spec{
+	Sorts:   []string{"-started", "started"},
+	Filters: []listquery.Filter{listquery.Owner, listquery.Language, listquery.Since, listquery.Until},
+}
+
+// handleListRuns returns the session's run history, newest first and a page
+// at a time, leaving out runs of files the caller can't see. ?path= narrows
+// it to one file and owner to the runs one user started.
+func handleListRuns(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, exists := hub.getSession(c.Param("sessionId"))
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+			return
+		}
+		q, ok := listQuery(c, runListSpec)
+		if !ok {
+			return
+		}
+
+		hub.loadHistory(session)
+		filterPath := c.Query("path")
+		username := hub.requestUsername(c)
+
+		session.mu.RLock()
+		role := session.requestRoleLocked(username)
+		runs := make([]Run, 0, len(session.Runs))
+		for _, run := range session.Runs {
+			if filterPath != "" && run.Path != filterPath {
+				continue
+			}
+			if q.Owner != "" && run.RunBy != q.Owner || q.Language != "" && run.Language != q.Language || !q.During(run.StartedAt) {
+				continue
+			}
+			if !session.runVisibleLocked(run, role) {
+				continue
+			}
+			runs = append(runs, *run)
+		}
+		session.mu.RUnlock()
+
+		page, next := listquery.Page(runs, q,
+			func(run Run, _ string) string { return listquery.TimeKey(run.StartedAt) },
+			func(run Run) string { return run.ID })
+		listPage(c, "runs", page, next)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/codecollab/collab-service/internal/sandbox"
+)
+
+// newSandboxPool builds the sandbox pool for the configured driver
+func newSandboxPool(config Config) (*sandbox.Pool, error) {
+	cpus := float64(config.SandboxMilliCPUs) / 1000
+	proxyPort, err := strconv.Atoi(config.EgressProxyPort)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EGRESS_PROXY_PORT %q", config.EgressProxyPort)
+	}
+
+	var driver sandbox.Driver
+	switch config.SandboxDriver {
+	case "service":
+		driver = sandbox.NewServiceDriver(config.ExecutionServiceURL, config.PortPreviewHost)
+	case "docker":
+		d, err := sandbox.NewDockerDriver(sandbox.DockerOptions{
+			Host:          config.SandboxDockerHost,
+			Image:         config.SandboxImage,
+			Network:       config.SandboxNetwork,
+			EgressNetwork: config.SandboxEgressNetwork,
+			MemoryMB:      config.SandboxMemoryMB,
+			CPUs:          cpus,
+		})
+		if err != nil {
+			return nil, err
+		}
+		driver = d
+	case "kubernetes":
+		labels, err := parseLabels(config.SandboxK8sProxyLabels)
+		if err != nil {
+			return nil, err
+		}
+		d, err := sandbox.NewKubernetesDriver(sandbox.KubernetesOptions{
+			Namespace:   config.SandboxK8sNamespace,
+			Image:       config.SandboxImage,
+			MemoryMB:    config.SandboxMemoryMB,
+			CPUs:        cpus,
+			ProxyLabels: labels,
+			ProxyPort:   proxyPort,
+		})
+		if err != nil {
+			return nil, err
+		}
+		driver = d
+	case "firecracker":
+		taps, err := parseTaps(config.FirecrackerTaps)
+		if err != nil {
+			return nil, err
+		}
+		vcpus := config.SandboxMilliCPUs / 1000
+		if vcpus < 1 {
+			vcpus = 1
+		}
+		d, err := sandbox.NewFirecrackerDriver(sandbox.FirecrackerOptions{
+			Binary:      config.FirecrackerBinary,
+			KernelImage: config.FirecrackerKernel,
+			RootFS:      config.FirecrackerRootFS,
+			VCPUs:       vcpus,
+			MemoryMB:    config.SandboxMemoryMB,
+			WorkDir:     config.FirecrackerWorkDir,
+			Taps:        taps,
+			ProxyPort:   proxyPort,
+		})
+		if err != nil {
+			return nil, err
+		}
+		driver = d
+	default:
+		return nil, fmt.Errorf("unknown sandbox driver %q", config.SandboxDriver)
+	}
+
+	return sandbox.NewPool(driver, sandbox.PoolOptions{
+		WarmSize: config.SandboxWarmPool,
+		MaxSize:  config.SandboxMaxPool,
+	}), nil
+}
+
+// parseLabels reads SANDBOX_K8S_PROXY_LABELS ("app=collab-service,...")
+func parseLabels(spec string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid label %q, expected key=value", entry)
+		}
+		labels[key] = value
+	}
+	if len(labels) == 0 {
+		return nil, fmt.Errorf("SANDBOX_K8S_PROXY_LABELS must select the collab service's pods")
+	}
+	return labels, nil
+}
+
+// parseTaps reads FIRECRACKER_TAPS ("tap0:172.16.0.2:172.16.0.1,...")
+func parseTaps(spec string) ([]sandbox.Tap, error) {
+	var taps []sandbox.Tap
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid tap %q, expected device:guestIP:hostIP", entry)
+		}
+		taps = append(taps, sandbox.Tap{
+			Device:  parts[0],
+			GuestIP: parts[1],
+			HostIP:  parts[2],
+			Netmask: "255.255.255.252",
+		})
+	}
+	return taps, nil
+}
@@ -0,0 +1,725 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/scim"
+	"github.com/codecollab/collab-service/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+// An organization's identity provider provisions its users and groups
+// over SCIM, at /scim/v2, with the SCIM token one of its admins created.
+// Users are matched to tokens by userName, the tokens' subject. A user
+// the provider deactivates or deletes is signed out of their connections
+// with closeSignedOut, and their tokens are refused until they're active
+// again: at once on the instance the provider called, and on the others
+// within directorySweep. The store keeps who is inactive, so an instance
+// refuses their tokens from when it starts serving.
+
+// scimBase is where the SCIM endpoints are served
+const scimBase = "/scim/v2"
+
+// directorySweep is how often the users deprovisioned in every
+// organization are loaded from the store
+const directorySweep = 30 * time.Second
+
+// errDeprovisioned is sent to a connection before its user is signed out
+// for having been deprovisioned
+const errDeprovisioned = "your organization deactivated your account"
+
+// errDeprovisionedToken is why a deprovisioned user's token is refused
+var errDeprovisionedToken = errors.New("user was deprovisioned by their organization")
+
+// verifyToken is parseToken, refusing the tokens of users their
+// organization deprovisioned
+func (h *Hub) verifyToken(token string) (*tokenClaims, error) {
+	claims, err := parseToken(h.config.JWTSecret, token)
+	if err != nil {
+		return nil, err
+	}
+	h.mu.RLock()
+	deprovisioned := claims.Org != "" && h.deprovisioned[claims.Org][claims.Subject]
+	h.mu.RUnlock()
+	if deprovisioned {
+		return nil, errDeprovisionedToken
+	}
+	return claims, nil
+}
+
+// setProvisioned records whether an organization's user may connect,
+// signing them out of their connections here if not
+func (h *Hub) setProvisioned(org, username string, active bool) {
+	h.mu.Lock()
+	if active {
+		delete(h.deprovisioned[org], username)
+	} else {
+		if h.deprovisioned[org] == nil {
+			h.deprovisioned[org] = make(map[string]bool)
+		}
+		h.deprovisioned[org][username] = true
+	}
+	h.mu.Unlock()
+	if !active {
+		h.signOutDeprovisioned()
+	}
+}
+
+// signOutDeprovisioned signs deprovisioned users out of their connections
+// here
+func (h *Hub) signOutDeprovisioned() {
+	h.mu.RLock()
+	var clients []*Client
+	for username, connections := range h.online {
+		for client, org := range connections {
+			if h.deprovisioned[org][username] {
+				clients = append(clients, client)
+			}
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, client := range clients {
+		h.sendToClient(client, OutgoingMessage{Type: "signed-out", Error: errDeprovisioned})
+		client.disconnect(closeSignedOut, "deprovisioned")
+		log.Printf("Signed deprovisioned %s out of client %s of session %s", client.presenceUser, client.ID, client.SessionID)
+	}
+}
+
+// loadDeprovisioned replaces the users deprovisioned in every
+// organization with those the store has, signing them out here
+func (h *Hub) loadDeprovisioned(ctx context.Context) error {
+	if h.store == nil {
+		return nil
+	}
+	deprovisioned, err := h.store.Deprovisioned(ctx)
+	if err != nil {
+		return err
+	}
+	set := make(map[string]map[string]bool, len(deprovisioned))
+	for org, usernames := range deprovisioned {
+		set[org] = make(map[string]bool, len(usernames))
+		for _, username := range usernames {
+			set[org][username] = true
+		}
+	}
+	h.mu.Lock()
+	h.deprovisioned = set
+	h.mu.Unlock()
+	h.signOutDeprovisioned()
+	return nil
+}
+
+// runDirectory keeps the users deprovisioned in every organization as the
+// store has them, for those deprovisioned through other instances. They
+// were loaded once before the server started.
+func (h *Hub) runDirectory() {
+	if h.store == nil {
+		return
+	}
+	ticker := time.NewTicker(directorySweep)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+		if err := h.loadDeprovisioned(ctx); err != nil {
+			log.Printf("Failed to load deprovisioned users: %v", err)
+		}
+		cancel()
+	}
+}
+
+// hashSCIMToken is what is kept of a SCIM token
+func hashSCIMToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newDirectoryID returns the ID of a new user or group
+func newDirectoryID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// scimJSON responds with a SCIM resource or message
+func scimJSON(c *gin.Context, status int, body any) {
+	c.Header("Content-Type", scim.ContentType)
+	c.JSON(status, body)
+}
+
+// scimError responds with a SCIM error
+func scimError(c *gin.Context, status int, scimType, detail string) {
+	scimJSON(c, status, scim.NewError(status, scimType, detail))
+}
+
+// scimStoreError responds to a failed call to the store
+func scimStoreError(c *gin.Context, err error, what string) {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		scimError(c, http.StatusNotFound, "", what+" not found")
+	case errors.Is(err, store.ErrNameTaken):
+		scimError(c, http.StatusConflict, "uniqueness", "another "+what+" has that name")
+	default:
+		log.Printf("SCIM call on %s failed: %v", what, err)
+		scimError(c, http.StatusServiceUnavailable, "", "the directory is unavailable")
+	}
+}
+
+// scimCaller returns the organization whose SCIM token the caller has, or
+// responds with an error
+func (h *Hub) scimCaller(c *gin.Context) (string, bool) {
+	if h.store == nil {
+		scimError(c, http.StatusNotFound, "", "SCIM provisioning needs a database")
+		return "", false
+	}
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		scimError(c, http.StatusUnauthorized, "", "a SCIM token is required")
+		return "", false
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+	defer cancel()
+	kept, err := h.store.SCIMToken(ctx, hashSCIMToken(token))
+	if errors.Is(err, store.ErrNotFound) {
+		scimError(c, http.StatusUnauthorized, "", "invalid SCIM token")
+		return "", false
+	}
+	if err != nil {
+		scimStoreError(c, err, "token")
+		return "", false
+	}
+	return kept.Org, true
+}
+
+// toSCIMUser is a user as SCIM returns them
+func toSCIMUser(user *store.DirectoryUser) scim.User {
+	active := user.Active
+	resource := scim.User{
+		Schemas:     []string{scim.UserSchema},
+		ID:          user.ID,
+		ExternalID:  user.ExternalID,
+		UserName:    user.UserName,
+		DisplayName: user.DisplayName,
+		Active:      &active,
+		Meta: &scim.Meta{
+			ResourceType: "User",
+			Created:      user.CreatedAt,
+			LastModified: user.UpdatedAt,
+			Location:     scimBase + "/Users/" + user.ID,
+		},
+	}
+	if user.GivenName != "" || user.FamilyName != "" {
+		resource.Name = &scim.Name{
+			Formatted:  strings.TrimSpace(user.GivenName + " " + user.FamilyName),
+			GivenName:  user.GivenName,
+			FamilyName: user.FamilyName,
+		}
+	}
+	if user.Email != "" {
+		resource.Emails = []scim.Email{{Value: user.Email, Type: "work", Primary: true}}
+	}
+	for _, group := range user.Groups {
+		resource.Groups = append(resource.Groups, scim.Ref{Value: group, Ref: scimBase + "/Groups/" + group})
+	}
+	return resource
+}
+
+// fromSCIMUser copies what is kept of a SCIM user into user
+func fromSCIMUser(resource scim.User, user *store.DirectoryUser) {
+	user.UserName = resource.UserName
+	user.ExternalID = resource.ExternalID
+	user.DisplayName = resource.DisplayName
+	user.GivenName, user.FamilyName = "", ""
+	if resource.Name != nil {
+		user.GivenName, user.FamilyName = resource.Name.GivenName, resource.Name.FamilyName
+	}
+	user.Email = resource.PrimaryEmail()
+	user.Active = resource.IsActive()
+}
+
+// toSCIMGroup is a group as SCIM returns it
+func toSCIMGroup(group *store.DirectoryGroup) scim.Group {
+	resource := scim.Group{
+		Schemas:     []string{scim.GroupSchema},
+		ID:          group.ID,
+		ExternalID:  group.ExternalID,
+		DisplayName: group.DisplayName,
+		Meta: &scim.Meta{
+			ResourceType: "Group",
+			Created:      group.CreatedAt,
+			LastModified: group.UpdatedAt,
+			Location:     scimBase + "/Groups/" + group.ID,
+		},
+	}
+	for _, member := range group.Members {
+		resource.Members = append(resource.Members, scim.Ref{Value: member, Ref: scimBase + "/Users/" + member})
+	}
+	return resource
+}
+
+// fromSCIMGroup copies a SCIM group into group
+func fromSCIMGroup(resource scim.Group, group *store.DirectoryGroup) {
+	group.DisplayName = resource.DisplayName
+	group.ExternalID = resource.ExternalID
+	group.Members = nil
+	for _, member := range resource.Members {
+		group.Members = append(group.Members, member.Value)
+	}
+}
+
+// handleCreateSCIMToken creates a new SCIM token for the caller's
+// organization, replacing the one it had, and returns it. Only its hash
+// is kept, so it can't be shown again.
+func handleCreateSCIMToken(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := hub.orgAdminCaller(c, "manage its SCIM provisioning")
+		if !ok {
+			return
+		}
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create a token"})
+			return
+		}
+		token := hex.EncodeToString(secret)
+		kept := &store.SCIMToken{Org: claims.Org, Hash: hashSCIMToken(token), CreatedBy: claims.Subject, CreatedAt: time.Now().UTC()}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+		defer cancel()
+		if err := hub.store.SaveSCIMToken(ctx, kept); err != nil {
+			log.Printf("Failed to save the SCIM token of %s: %v", claims.Org, err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "the directory is unavailable"})
+			return
+		}
+		log.Printf("%s created a SCIM token for %s", claims.Subject, claims.Org)
+		c.JSON(http.StatusCreated, gin.H{"token": token, "createdAt": kept.CreatedAt, "baseUrl": scimBase})
+	}
+}
+
+// handleRevokeSCIMToken revokes the caller's organization's SCIM token
+func handleRevokeSCIMToken(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := hub.orgAdminCaller(c, "manage its SCIM provisioning")
+		if !ok {
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+		defer cancel()
+		err := hub.store.DeleteSCIMToken(ctx, claims.Org)
+		if errors.Is(err, store.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "the organization has no SCIM token"})
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to revoke the SCIM token of %s: %v", claims.Org, err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "the directory is unavailable"})
+			return
+		}
+		log.Printf("%s revoked the SCIM token of %s", claims.Subject, claims.Org)
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// handleSCIMConfig describes what of SCIM is supported
+func handleSCIMConfig(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := hub.scimCaller(c); !ok {
+			return
+		}
+		scimJSON(c, http.StatusOK, scim.ServiceProviderConfig())
+	}
+}
+
+// handleSCIMResourceTypes describes the User and Group resources
+func handleSCIMResourceTypes(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := hub.scimCaller(c); !ok {
+			return
+		}
+		types := scim.ResourceTypes(scimBase)
+		scimJSON(c, http.StatusOK, scim.List(types, scim.Page{StartIndex: 1, Count: len(types)}))
+	}
+}
+
+// handleListSCIMUsers returns a page of the organization's users, which
+// filter may pick by userName or externalId
+func handleListSCIMUsers(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, ok := hub.scimCaller(c)
+		if !ok {
+			return
+		}
+		page, err := scim.ParsePage(c.Query("startIndex"), c.Query("count"))
+		if err != nil {
+			scimError(c, http.StatusBadRequest, "invalidValue", err.Error())
+			return
+		}
+		filter, err := scim.ParseFilter(c.Query("filter"), "userName", "externalId")
+		if err != nil {
+			scimError(c, http.StatusBadRequest, "invalidFilter", err.Error())
+			return
+		}
+		var picked store.DirectoryFilter
+		switch filter.Attribute {
+		case "userName":
+			picked.UserName = filter.Value
+		case "externalId":
+			picked.ExternalID = filter.Value
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+		defer cancel()
+		users, err := hub.store.DirectoryUsers(ctx, org, picked)
+		if err != nil {
+			scimStoreError(c, err, "user")
+			return
+		}
+		resources := make([]scim.User, len(users))
+		for i, user := range users {
+			resources[i] = toSCIMUser(user)
+		}
+		scimJSON(c, http.StatusOK, scim.List(resources, page))
+	}
+}
+
+// handleGetSCIMUser returns one of the organization's users
+func handleGetSCIMUser(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, ok := hub.scimCaller(c)
+		if !ok {
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+		defer cancel()
+		user, err := hub.store.DirectoryUser(ctx, org, c.Param("userId"))
+		if err != nil {
+			scimStoreError(c, err, "user")
+			return
+		}
+		scimJSON(c, http.StatusOK, toSCIMUser(user))
+	}
+}
+
+// handleCreateSCIMUser provisions a user, who may be created inactive
+func handleCreateSCIMUser(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, ok := hub.scimCaller(c)
+		if !ok {
+			return
+		}
+		var resource scim.User
+		if err := c.ShouldBindJSON(&resource); err != nil {
+			scimError(c, http.StatusBadRequest, "invalidSyntax", "invalid request body")
+			return
+		}
+		if resource.UserName == "" {
+			scimError(c, http.StatusBadRequest, "invalidValue", "userName is required")
+			return
+		}
+
+		now := time.Now().UTC()
+		user := &store.DirectoryUser{Org: org, ID: newDirectoryID(), CreatedAt: now, UpdatedAt: now}
+		fromSCIMUser(resource, user)
+		ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+		defer cancel()
+		if err := hub.store.AddDirectoryUser(ctx, user); err != nil {
+			scimStoreError(c, err, "user")
+			return
+		}
+		hub.setProvisioned(org, user.UserName, user.Active)
+		log.Printf("Provisioned user %s of %s", user.UserName, org)
+		scimJSON(c, http.StatusCreated, toSCIMUser(user))
+	}
+}
+
+// updateSCIMUser applies change to one of the organization's users and
+// responds with them as they are then. A user deactivated or renamed is
+// signed out.
+func (h *Hub) updateSCIMUser(c *gin.Context, org string, change func(*scim.User) error) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+	defer cancel()
+	user, err := h.store.DirectoryUser(ctx, org, c.Param("userId"))
+	if err != nil {
+		scimStoreError(c, err, "user")
+		return
+	}
+	resource := toSCIMUser(user)
+	if err := change(&resource); err != nil {
+		scimError(c, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+	if resource.UserName == "" {
+		scimError(c, http.StatusBadRequest, "invalidValue", "userName is required")
+		return
+	}
+
+	previous := user.UserName
+	fromSCIMUser(resource, user)
+	user.UpdatedAt = time.Now().UTC()
+	if err := h.store.UpdateDirectoryUser(ctx, user); err != nil {
+		scimStoreError(c, err, "user")
+		return
+	}
+	if previous != user.UserName {
+		h.setProvisioned(org, previous, true)
+	}
+	h.setProvisioned(org, user.UserName, user.Active)
+	if !user.Active {
+		log.Printf("Deprovisioned user %s of %s", user.UserName, org)
+	}
+	scimJSON(c, http.StatusOK, toSCIMUser(user))
+}
+
+// handleReplaceSCIMUser replaces one of the organization's users
+func handleReplaceSCIMUser(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, ok := hub.scimCaller(c)
+		if !ok {
+			return
+		}
+		var replacement scim.User
+		if err := c.ShouldBindJSON(&replacement); err != nil {
+			scimError(c, http.StatusBadRequest, "invalidSyntax", "invalid request body")
+			return
+		}
+		hub.updateSCIMUser(c, org, func(resource *scim.User) error {
+			replacement.ID, replacement.Groups, replacement.Meta = resource.ID, resource.Groups, resource.Meta
+			*resource = replacement
+			return nil
+		})
+	}
+}
+
+// handlePatchSCIMUser changes some of one of the organization's users,
+// such as deactivating them
+func handlePatchSCIMUser(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, ok := hub.scimCaller(c)
+		if !ok {
+			return
+		}
+		var patch scim.PatchOp
+		if err := c.ShouldBindJSON(&patch); err != nil {
+			scimError(c, http.StatusBadRequest, "invalidSyntax", "invalid request body")
+			return
+		}
+		hub.updateSCIMUser(c, org, patch.ApplyUser)
+	}
+}
+
+// handleDeleteSCIMUser deprovisions one of the organization's users for
+// good, taking them out of its groups
+func handleDeleteSCIMUser(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, ok := hub.scimCaller(c)
+		if !ok {
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+		defer cancel()
+		user, err := hub.store.DirectoryUser(ctx, org, c.Param("userId"))
+		if err == nil {
+			err = hub.store.DeleteDirectoryUser(ctx, org, user.ID)
+		}
+		if err != nil {
+			scimStoreError(c, err, "user")
+			return
+		}
+		hub.setProvisioned(org, user.UserName, false)
+		log.Printf("Deleted user %s of %s", user.UserName, org)
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// handleListSCIMGroups returns a page of the organization's groups, which
+// filter may pick by displayName or externalId
+func handleListSCIMGroups(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, ok := hub.scimCaller(c)
+		if !ok {
+			return
+		}
+		page, err := scim.ParsePage(c.Query("startIndex"), c.Query("count"))
+		if err != nil {
+			scimError(c, http.StatusBadRequest, "invalidValue", err.Error())
+			return
+		}
+		filter, err := scim.ParseFilter(c.Query("filter"), "displayName", "externalId")
+		if err != nil {
+			scimError(c, http.StatusBadRequest, "invalidFilter", err.Error())
+			return
+		}
+		var picked store.DirectoryFilter
+		switch filter.Attribute {
+		case "displayName":
+			picked.DisplayName = filter.Value
+		case "externalId":
+			picked.ExternalID = filter.Value
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+		defer cancel()
+		groups, err := hub.store.DirectoryGroups(ctx, org, picked)
+		if err != nil {
+			scimStoreError(c, err, "group")
+			return
+		}
+		resources := make([]scim.Group, len(groups))
+		for i, group := range groups {
+			resources[i] = toSCIMGroup(group)
+		}
+		scimJSON(c, http.StatusOK, scim.List(resources, page))
+	}
+}
+
+// handleGetSCIMGroup returns one of the organization's groups
+func handleGetSCIMGroup(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, ok := hub.scimCaller(c)
+		if !ok {
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+		defer cancel()
+		group, err := hub.store.DirectoryGroup(ctx, org, c.Param("groupId"))
+		if err != nil {
+			scimStoreError(c, err, "group")
+			return
+		}
+		scimJSON(c, http.StatusOK, toSCIMGroup(group))
+	}
+}
+
+// handleCreateSCIMGroup provisions a group. Members that aren't users of
+// the organization are left out of it.
+func handleCreateSCIMGroup(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, ok := hub.scimCaller(c)
+		if !ok {
+			return
+		}
+		var resource scim.Group
+		if err := c.ShouldBindJSON(&resource); err != nil {
+			scimError(c, http.StatusBadRequest, "invalidSyntax", "invalid request body")
+			return
+		}
+		if resource.DisplayName == "" {
+			scimError(c, http.StatusBadRequest, "invalidValue", "displayName is required")
+			return
+		}
+
+		now := time.Now().UTC()
+		group := &store.DirectoryGroup{Org: org, ID: newDirectoryID(), CreatedAt: now, UpdatedAt: now}
+		fromSCIMGroup(resource, group)
+		ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+		defer cancel()
+		if err := hub.store.AddDirectoryGroup(ctx, group); err != nil {
+			scimStoreError(c, err, "group")
+			return
+		}
+		hub.respondSCIMGroup(ctx, c, org, group.ID, http.StatusCreated)
+	}
+}
+
+// respondSCIMGroup responds with a group as it was kept, with the members
+// that were
+func (h *Hub) respondSCIMGroup(ctx context.Context, c *gin.Context, org, id string, status int) {
+	group, err := h.store.DirectoryGroup(ctx, org, id)
+	if err != nil {
+		scimStoreError(c, err, "group")
+		return
+	}
+	scimJSON(c, status, toSCIMGroup(group))
+}
+
+// updateSCIMGroup applies change to one of the organization's groups and
+// responds with it as it is then
+func (h *Hub) updateSCIMGroup(c *gin.Context, org string, change func(*scim.Group) error) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+	defer cancel()
+	group, err := h.store.DirectoryGroup(ctx, org, c.Param("groupId"))
+	if err != nil {
+		scimStoreError(c, err, "group")
+		return
+	}
+	resource := toSCIMGroup(group)
+	if err := change(&resource); err != nil {
+		scimError(c, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+	if resource.DisplayName == "" {
+		scimError(c, http.StatusBadRequest, "invalidValue", "displayName is required")
+		return
+	}
+
+	fromSCIMGroup(resource, group)
+	group.UpdatedAt = time.Now().UTC()
+	if err := h.store.UpdateDirectoryGroup(ctx, group); err != nil {
+		scimStoreError(c, err, "group")
+		return
+	}
+	h.respondSCIMGroup(ctx, c, org, group.ID, http.StatusOK)
+}
+
+// handleReplaceSCIMGroup replaces one of the organization's groups
+func handleReplaceSCIMGroup(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, ok := hub.scimCaller(c)
+		if !ok {
+			return
+		}
+		var replacement scim.Group
+		if err := c.ShouldBindJSON(&replacement); err != nil {
+			scimError(c, http.StatusBadRequest, "invalidSyntax", "invalid request body")
+			return
+		}
+		hub.updateSCIMGroup(c, org, func(resource *scim.Group) error {
+			*resource = replacement
+			return nil
+		})
+	}
+}
+
+// handlePatchSCIMGroup changes some of one of the organization's groups,
+// such as adding and removing members
+func handlePatchSCIMGroup(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, ok := hub.scimCaller(c)
+		if !ok {
+			return
+		}
+		var patch scim.PatchOp
+		if err := c.ShouldBindJSON(&patch); err != nil {
+			scimError(c, http.StatusBadRequest, "invalidSyntax", "invalid request body")
+			return
+		}
+		hub.updateSCIMGroup(c, org, patch.ApplyGroup)
+	}
+}
+
+// handleDeleteSCIMGroup deletes one of the organization's groups. Its
+// members are left as they are.
+func handleDeleteSCIMGroup(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, ok := hub.scimCaller(c)
+		if !ok {
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+		defer cancel()
+		if err := hub.store.DeleteDirectoryGroup(ctx, org, c.Param("groupId")); err != nil {
+			scimStoreError(c, err, "group")
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
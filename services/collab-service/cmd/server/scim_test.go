@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/breaker"
+	"github.com/codecollab/collab-service/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+// storeHub is a hub keeping sessions and the directory in the SQLite
+// database at path, started as the server starts it
+func storeHub(t *testing.T, path string) *Hub {
+	t.Helper()
+	sessions, err := store.Open(context.Background(), "sqlite:"+path, breaker.New(5, time.Minute))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { sessions.Close() })
+	hub := newHub(Config{JWTSecret: "secret"}, nil, nil, nil, nil, nil, nil, nil, sessions, nil, nil, nil, nil, nil)
+	if err := hub.loadDeprovisioned(context.Background()); err != nil {
+		t.Fatalf("loadDeprovisioned: %v", err)
+	}
+	return hub
+}
+
+// scimCall makes a SCIM request to hub with the SCIM token of acme,
+// returning the ID of the user it responds with
+func scimCall(t *testing.T, hub *Hub, method, path, body string) string {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer acme-scim")
+	r.Header.Set("Content-Type", "application/scim+json")
+	w := httptest.NewRecorder()
+	newRouter(hub).ServeHTTP(w, r)
+	if w.Code >= 300 {
+		t.Fatalf("%s %s = %d %s", method, path, w.Code, w.Body)
+	}
+	var user struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &user)
+	return user.ID
+}
+
+// userToken is a token of username in org
+func userToken(t *testing.T, org, username string) string {
+	t.Helper()
+	token, err := signToken("secret", tokenClaims{Subject: username, Org: org, Expiry: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatalf("signToken: %v", err)
+	}
+	return token
+}
+
+func TestDeprovisionedTokensAreRefused(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	gin.DefaultWriter = io.Discard
+	tests := []struct {
+		name string
+		// provision provisions bob in acme
+		provision func(t *testing.T, hub *Hub)
+		refused   bool
+	}{
+		{"active", func(t *testing.T, hub *Hub) {
+			scimCall(t, hub, "POST", "/scim/v2/Users", `{"userName":"bob"}`)
+		}, false},
+		{"created inactive", func(t *testing.T, hub *Hub) {
+			scimCall(t, hub, "POST", "/scim/v2/Users", `{"userName":"bob","active":false}`)
+		}, true},
+		{"deactivated", func(t *testing.T, hub *Hub) {
+			id := scimCall(t, hub, "POST", "/scim/v2/Users", `{"userName":"bob"}`)
+			scimCall(t, hub, "PATCH", "/scim/v2/Users/"+id, `{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[{"op":"replace","path":"active","value":false}]}`)
+		}, true},
+		{"reactivated", func(t *testing.T, hub *Hub) {
+			id := scimCall(t, hub, "POST", "/scim/v2/Users", `{"userName":"bob","active":false}`)
+			scimCall(t, hub, "PUT", "/scim/v2/Users/"+id, `{"userName":"bob","active":true}`)
+		}, false},
+		{"deleted", func(t *testing.T, hub *Hub) {
+			id := scimCall(t, hub, "POST", "/scim/v2/Users", `{"userName":"bob"}`)
+			scimCall(t, hub, "DELETE", "/scim/v2/Users/"+id, "")
+		}, true},
+		{"renamed while inactive", func(t *testing.T, hub *Hub) {
+			id := scimCall(t, hub, "POST", "/scim/v2/Users", `{"userName":"robert","active":false}`)
+			scimCall(t, hub, "PUT", "/scim/v2/Users/"+id, `{"userName":"bob","active":false}`)
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "collab.db")
+			hub := storeHub(t, path)
+			err := hub.store.SaveSCIMToken(context.Background(), &store.SCIMToken{Org: "acme", Hash: hashSCIMToken("acme-scim"), CreatedAt: time.Now()})
+			if err != nil {
+				t.Fatalf("SaveSCIMToken: %v", err)
+			}
+			tt.provision(t, hub)
+
+			// Refused on the instance the provider called, and on one
+			// started afterwards
+			for i, hub := range []*Hub{hub, storeHub(t, path)} {
+				_, err := hub.verifyToken(userToken(t, "acme", "bob"))
+				if refused := errors.Is(err, errDeprovisionedToken); refused != tt.refused {
+					t.Fatalf("instance %d: verifyToken = %v, want refused %t", i, err, tt.refused)
+				}
+				if _, err := hub.verifyToken(userToken(t, "globex", "bob")); err != nil {
+					t.Fatalf("instance %d: another organization's bob was refused: %v", i, err)
+				}
+				if _, err := hub.verifyToken(userToken(t, "acme", "robert")); err != nil {
+					t.Fatalf("instance %d: a renamed user's old name was refused: %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestDeprovisionedTokensAreRefusedOverREST(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	gin.DefaultWriter = io.Discard
+	hub := storeHub(t, filepath.Join(t.TempDir(), "collab.db"))
+	hub.setProvisioned("acme", "bob", false)
+
+	r := httptest.NewRequest("GET", "/sessions/s/export", nil)
+	r.Header.Set("Authorization", "Bearer "+userToken(t, "acme", "bob"))
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = r
+	if claims := hub.requestClaims(c); claims != nil {
+		t.Fatalf("a deprovisioned user's token gave %+v", claims)
+	}
+}
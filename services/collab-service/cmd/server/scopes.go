@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The scopes a token may be limited to, so that an integration can be given
+// only what it needs. Every REST route needs one of them, as routeScope
+// decides, and a token limited to scopes that don't include it is refused
+// with 403. Over WebSocket, a token needs sessions:read to join as its
+// user, joins as a viewer without sessions:write, and can't run code
+// without exec:run. The gRPC relay between edges and instances carries no
+// user tokens, only its shared secret, so scopes don't apply to it.
+const (
+	scopeSessionsRead  = "sessions:read"
+	scopeSessionsWrite = "sessions:write"
+	scopeExecRun       = "exec:run"
+	scopeAdmin         = "admin"
+)
+
+// errScopeExec is sent for a message that runs code from a client whose
+// token doesn't allow it
+const errScopeExec = "your token's scopes don't allow running code"
+
+// execRoutes are the REST routes that reach code a session runs
+var execRoutes = map[string]bool{
+	"/sessions/:sessionId/preview/:token/*path": true,
+}
+
+// execMessages are the messages that run code
+var execMessages = map[string]bool{
+	"run-file":       true,
+	"run-task":       true,
+	"run-cell":       true,
+	"restart-kernel": true,
+	"run-query":      true,
+	"run-request":    true,
+	"expose-port":    true,
+}
+
+// routeScope is the scope a request to route needs: admin for the
+// organization's and operators' endpoints but its listings, exec:run for
+// those in execRoutes, and otherwise sessions:read to read, signing URLs
+// to read from included, and sessions:write to change anything. Routes that take no token, or one of
+// their own, need none.
+func routeScope(method, route string) string {
+	switch {
+	case route == "" || route == "/" || route == "/health" || route == "/ws/:sessionId" || route == "/lobby" ||
+		strings.HasPrefix(route, scimBase+"/"):
+		return ""
+	case strings.HasPrefix(route, "/admin/"),
+		strings.HasPrefix(route, "/org/") && (method != http.MethodGet || route == "/org/export"):
+		return scopeAdmin
+	case execRoutes[route]:
+		return scopeExecRun
+	case method == http.MethodGet || method == http.MethodHead || route == "/signed-urls":
+		return scopeSessionsRead
+	}
+	return scopeSessionsWrite
+}
+
+// requireScopes refuses requests whose token's scopes don't include the
+// one their route needs. Anonymous requests and tokens of other kinds are
+// left to the handlers.
+func (h *Hub) requireScopes(c *gin.Context) {
+	scope := routeScope(c.Request.Method, c.FullPath())
+	if scope == "" {
+		return
+	}
+	claims := h.requestClaims(c)
+	if claims == nil || claims.allows(scope) {
+		return
+	}
+	c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, scope))
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "the token's scopes don't allow this", "scope": scope})
+}
+
+// allowedByScope reports whether a client's token allows a message,
+// telling it if not
+func (h *Hub) allowedByScope(c *Client, msgType string) bool {
+	if !execMessages[msgType] || c.token == nil || c.token.allows(scopeExecRun) {
+		return true
+	}
+	h.sendToClient(c, OutgoingMessage{Type: "error", Error: errScopeExec})
+	return false
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// routeScopes is the scope each route needs, but the preview proxy's,
+// which needs exec:run whatever the method
+var routeScopes = []struct {
+	method, route, scope string
+}{
+	{"GET", "/health", ""},
+	{"GET", "/", ""},
+	{"GET", "/ws/:sessionId", ""},
+	{"GET", "/locate/:sessionId", scopeSessionsRead},
+	{"GET", "/regions", scopeSessionsRead},
+	{"GET", "/join/:code", scopeSessionsRead},
+	{"GET", "/sessions/:sessionId/qr", scopeSessionsRead},
+	{"GET", "/sessions/:sessionId/share-links", scopeSessionsRead},
+	{"POST", "/sessions/:sessionId/share-links", scopeSessionsWrite},
+	{"DELETE", "/sessions/:sessionId/share-links/:linkId", scopeSessionsWrite},
+	{"POST", "/signed-urls", scopeSessionsRead},
+	{"GET", "/sessions/:sessionId/recordings", scopeSessionsRead},
+	{"GET", "/sessions/:sessionId/recordings/:recordingId", scopeSessionsRead},
+	{"GET", "/s/:slug", scopeSessionsRead},
+	{"GET", "/org/slugs", scopeSessionsRead},
+	{"POST", "/org/slugs", scopeAdmin},
+	{"DELETE", "/org/slugs/:slug", scopeAdmin},
+	{"GET", "/org/sessions", scopeSessionsRead},
+	{"POST", "/org/sessions/close", scopeAdmin},
+	{"POST", "/org/sessions/purge", scopeAdmin},
+	{"POST", "/org/sessions/reassign", scopeAdmin},
+	{"GET", "/sessions/:sessionId/participants", scopeSessionsRead},
+	{"GET", "/org/export", scopeAdmin},
+	{"POST", "/org/import", scopeAdmin},
+	{"POST", "/org/scim/token", scopeAdmin},
+	{"DELETE", "/org/scim/token", scopeAdmin},
+	{"GET", "/scim/v2/ServiceProviderConfig", ""},
+	{"GET", "/scim/v2/ResourceTypes", ""},
+	{"GET", "/scim/v2/Users", ""},
+	{"POST", "/scim/v2/Users", ""},
+	{"GET", "/scim/v2/Users/:userId", ""},
+	{"PUT", "/scim/v2/Users/:userId", ""},
+	{"PATCH", "/scim/v2/Users/:userId", ""},
+	{"DELETE", "/scim/v2/Users/:userId", ""},
+	{"GET", "/scim/v2/Groups", ""},
+	{"POST", "/scim/v2/Groups", ""},
+	{"GET", "/scim/v2/Groups/:groupId", ""},
+	{"PUT", "/scim/v2/Groups/:groupId", ""},
+	{"PATCH", "/scim/v2/Groups/:groupId", ""},
+	{"DELETE", "/scim/v2/Groups/:groupId", ""},
+	{"GET", "/sessions/:sessionId/export", scopeSessionsRead},
+	{"PUT", "/sessions/:sessionId/files/*path", scopeSessionsWrite},
+	{"GET", "/sessions/:sessionId/assets/*path", scopeSessionsRead},
+	{"OPTIONS", "/sessions/:sessionId/imports", scopeSessionsWrite},
+	{"POST", "/sessions/:sessionId/imports", scopeSessionsWrite},
+	{"HEAD", "/sessions/:sessionId/imports/:importId", scopeSessionsRead},
+	{"PATCH", "/sessions/:sessionId/imports/:importId", scopeSessionsWrite},
+	{"DELETE", "/sessions/:sessionId/imports/:importId", scopeSessionsWrite},
+	{"GET", "/sessions/:sessionId/snapshot.html", scopeSessionsRead},
+	{"GET", "/sessions/:sessionId/export.pdf", scopeSessionsRead},
+	{"GET", "/sessions/:sessionId/env", scopeSessionsRead},
+	{"PUT", "/sessions/:sessionId/env/:name", scopeSessionsWrite},
+	{"DELETE", "/sessions/:sessionId/env/:name", scopeSessionsWrite},
+	{"GET", "/sessions/:sessionId/checkpoints", scopeSessionsRead},
+	{"POST", "/sessions/:sessionId/checkpoints/:checkpointId/restore", scopeSessionsWrite},
+	{"GET", "/sessions/:sessionId/snapshots", scopeSessionsRead},
+	{"GET", "/sessions/:sessionId/snapshots/:snapshotId", scopeSessionsRead},
+	{"GET", "/sessions/:sessionId/snapshots/:snapshotId/diff", scopeSessionsRead},
+	{"GET", "/sessions/:sessionId/diff", scopeSessionsRead},
+	{"GET", "/sessions/:sessionId/history", scopeSessionsRead},
+	{"GET", "/sessions/:sessionId/suggestions/export", scopeSessionsRead},
+	{"GET", "/sessions/:sessionId/checkpoint-webhook", scopeSessionsRead},
+	{"PUT", "/sessions/:sessionId/checkpoint-webhook", scopeSessionsWrite},
+	{"DELETE", "/sessions/:sessionId/checkpoint-webhook", scopeSessionsWrite},
+	{"GET", "/sessions/:sessionId/runs", scopeSessionsRead},
+	{"GET", "/sessions/:sessionId/git", scopeSessionsRead},
+	{"POST", "/sessions/:sessionId/git/import", scopeSessionsWrite},
+	{"POST", "/sessions/:sessionId/git/commit-and-push", scopeSessionsWrite},
+	{"GET", "/templates", scopeSessionsRead},
+	{"GET", "/templates/:templateId", scopeSessionsRead},
+	{"POST", "/templates/:templateId/sessions", scopeSessionsWrite},
+	{"PUT", "/admin/templates/:templateId", scopeAdmin},
+	{"DELETE", "/admin/templates/:templateId", scopeAdmin},
+	{"POST", "/sessions/:sessionId/gist", scopeSessionsWrite},
+	{"POST", "/gists/import", scopeSessionsWrite},
+	{"GET", "/sessions/:sessionId/chat-bridge", scopeSessionsRead},
+	{"PUT", "/sessions/:sessionId/chat-bridge", scopeSessionsWrite},
+	{"DELETE", "/sessions/:sessionId/chat-bridge", scopeSessionsWrite},
+	{"GET", "/lobby", ""},
+	{"GET", "/sessions/:sessionId/chat/audit", scopeSessionsRead},
+	{"GET", "/connectors", scopeSessionsRead},
+	{"GET", "/sessions/:sessionId/connectors/subscriptions", scopeSessionsRead},
+	{"POST", "/sessions/:sessionId/connectors/subscriptions", scopeSessionsWrite},
+	{"DELETE", "/sessions/:sessionId/connectors/subscriptions/:id", scopeSessionsWrite},
+	{"POST", "/sessions/:sessionId/connectors/actions/:action", scopeSessionsWrite},
+	{"GET", "/users/me/preferences", scopeSessionsRead},
+	{"PUT", "/users/me/preferences", scopeSessionsWrite},
+	{"GET", "/users/me/presence", scopeSessionsRead},
+	{"GET", "/users/me/colleagues", scopeSessionsRead},
+	{"GET", "/users/me/connections", scopeSessionsRead},
+	{"DELETE", "/users/me/connections/:connectionId", scopeSessionsWrite},
+	{"GET", "/admin/announcements", scopeAdmin},
+	{"POST", "/admin/announcements", scopeAdmin},
+	{"DELETE", "/admin/announcements/:id", scopeAdmin},
+	{"GET", "/admin/announcements/:id/receipts", scopeAdmin},
+}
+
+const previewRoute = "/sessions/:sessionId/preview/:token/*path"
+
+// scopedRequest is a request to route, its parameters filled in, with a
+// token limited to scope, or of no scope with "*", or none with ""
+func scopedRequest(t *testing.T, hub *Hub, method, route, scope string) *http.Request {
+	t.Helper()
+	path := regexp.MustCompile(`[:*]\w+`).ReplaceAllStringFunc(route, func(param string) string { return param[1:] })
+	r := httptest.NewRequest(method, path, nil)
+	if scope == "" {
+		return r
+	}
+	claims := tokenClaims{Subject: "alice", Expiry: time.Now().Add(time.Hour).Unix(), Scope: scope}
+	if scope == "*" {
+		claims.Scope = ""
+	}
+	token, err := signToken(hub.config.JWTSecret, claims)
+	if err != nil {
+		t.Fatalf("signToken: %v", err)
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+// otherScope is a scope that doesn't include scope
+func otherScope(scope string) string {
+	if scope == scopeSessionsRead {
+		return scopeExecRun
+	}
+	if scope == scopeSessionsWrite {
+		return scopeSessionsRead
+	}
+	return scopeSessionsWrite
+}
+
+func TestEveryRouteHasItsScope(t *testing.T) {
+	hub := newHub(Config{JWTSecret: "secret"}, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil)
+	want := make(map[string]string)
+	for _, r := range routeScopes {
+		want[r.method+" "+r.route] = r.scope
+	}
+	for _, r := range newRouter(hub).Routes() {
+		scope, listed := want[r.Method+" "+r.Path]
+		if r.Path == previewRoute {
+			scope, listed = scopeExecRun, true
+		}
+		if !listed {
+			t.Errorf("%s %s isn't in routeScopes", r.Method, r.Path)
+			continue
+		}
+		if got := routeScope(r.Method, r.Path); got != scope {
+			t.Errorf("routeScope(%s %s) = %q, want %q", r.Method, r.Path, got, scope)
+		}
+		delete(want, r.Method+" "+r.Path)
+	}
+	for route := range want {
+		t.Errorf("%s isn't routed", route)
+	}
+}
+
+func TestRoutesRefuseTokensWithoutTheirScope(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	gin.DefaultWriter = io.Discard
+	hub := newHub(Config{JWTSecret: "secret"}, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil)
+	router := newRouter(hub)
+	for _, r := range router.Routes() {
+		scope := routeScope(r.Method, r.Path)
+		if scope == "" {
+			continue
+		}
+		t.Run(r.Method+" "+r.Path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, scopedRequest(t, hub, r.Method, r.Path, otherScope(scope)))
+			if w.Code != http.StatusForbidden {
+				t.Fatalf("got %d, want 403", w.Code)
+			}
+			if got := w.Header().Get("WWW-Authenticate"); !strings.Contains(got, `scope="`+scope+`"`) {
+				t.Fatalf("WWW-Authenticate = %q, want scope %q", got, scope)
+			}
+		})
+	}
+}
+
+func TestRequireScopes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	hub := newHub(Config{JWTSecret: "secret"}, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil)
+	tests := []struct {
+		name          string
+		method, route string
+		// scope is the token's, as scopedRequest takes it
+		scope   string
+		allowed bool
+	}{
+		{"read with sessions:read", "GET", "/sessions/:sessionId/export", scopeSessionsRead, true},
+		{"read with sessions:write", "GET", "/sessions/:sessionId/export", scopeSessionsWrite, true},
+		{"read with exec:run", "GET", "/sessions/:sessionId/export", scopeExecRun, false},
+		{"write with sessions:write", "PUT", "/sessions/:sessionId/files/*path", scopeSessionsWrite, true},
+		{"write with sessions:read", "PUT", "/sessions/:sessionId/files/*path", scopeSessionsRead, false},
+		{"write with several scopes", "PUT", "/sessions/:sessionId/files/*path", scopeExecRun + " " + scopeSessionsWrite, true},
+		{"preview with exec:run", "GET", previewRoute, scopeExecRun, true},
+		{"preview with sessions:write", "GET", previewRoute, scopeSessionsWrite, false},
+		{"admin with admin", "POST", "/org/sessions/purge", scopeAdmin, true},
+		{"admin with sessions:write", "POST", "/org/sessions/purge", scopeSessionsWrite, false},
+		{"organization listing with sessions:read", "GET", "/org/sessions", scopeSessionsRead, true},
+		{"organization export with sessions:read", "GET", "/org/export", scopeSessionsRead, false},
+		{"signing URLs with sessions:read", "POST", "/signed-urls", scopeSessionsRead, true},
+		{"token of no scope", "POST", "/org/sessions/purge", "*", true},
+		{"no token", "POST", "/org/sessions/purge", "", true},
+		{"route needing no scope", "GET", "/health", scopeExecRun, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.Use(hub.requireScopes)
+			router.Handle(tt.method, tt.route, func(c *gin.Context) { c.Status(http.StatusNoContent) })
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, scopedRequest(t, hub, tt.method, tt.route, tt.scope))
+			if allowed := w.Code == http.StatusNoContent; allowed != tt.allowed {
+				t.Fatalf("got %d, want allowed %t", w.Code, tt.allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// maxSearchResults caps the number of matches returned for one query
+const maxSearchResults = 200
+
+// SearchResult is a single match in a "search-results" message
+type SearchResult struct {
+	Path    string `json:"path"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Preview string `json:"preview"`
+}
+
+// search finds query in every file the client can see
+func (h *Hub) search(c *Client, query string) {
+	if query == "" {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: "query is required"})
+		return
+	}
+
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	role := session.roleLocked(c)
+	paths := make([]string, 0, len(session.Files))
+	for filePath, file := range session.Files {
+		if file.visibleTo(role) && !file.Binary {
+			paths = append(paths, filePath)
+		}
+	}
+	sort.Strings(paths)
+
+	results := []SearchResult{}
+	for _, filePath := range paths {
+		for i, line := range strings.Split(session.Files[filePath].Content, "\n") {
+			column := strings.Index(line, query)
+			if column < 0 {
+				continue
+			}
+			results = append(results, SearchResult{
+				Path:    filePath,
+				Line:    i + 1,
+				Column:  column + 1,
+				Preview: strings.TrimRight(line, "\r"),
+			})
+			if len(results) >= maxSearchResults {
+				break
+			}
+		}
+		if len(results) >= maxSearchResults {
+			break
+		}
+	}
+	session.mu.RUnlock()
+
+	h.sendToClient(c, OutgoingMessage{Type: "search-results", Results: results})
+}
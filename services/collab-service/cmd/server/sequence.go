@@ -0,0 +1,147 @@
+package main
+
+import (
+	"log"
+	"strconv"
+)
+
+// Every message queued for a client but cursor updates, which a newer one
+// replaces, is numbered with a "seq", counting from 1 on each connection,
+// so the client can tell when one is missing or came out of order instead
+// of going on without it. A client that acks,
+// sending an "ack" with the seq of the last message it handled in order,
+// can have those after it sent again with a "resend" from the seq of the
+// first it's missing: the server keeps the resendWindow latest it hasn't
+// acked. One whose queue is full is still numbered and kept, so it shows
+// up missing. What isn't kept, as before the client first acked, is made
+// up for with a catch-up-sync, as for a client too slow to keep up, which
+// replaces everything numbered before it. A client further behind its
+// acks than resendWindow is treated as too slow.
+const (
+	resendWindow      = 1024
+	resendWindowBytes = 8 << 20
+)
+
+// numbered is a message as queued for a client, with its seq
+type numbered struct {
+	seq int64
+	msg []byte
+}
+
+// withSeq adds seq to a message, a JSON object
+func withSeq(msg []byte, seq int64) []byte {
+	if len(msg) < 2 || msg[len(msg)-1] != '}' {
+		return msg
+	}
+	out := make([]byte, 0, len(msg)+24)
+	out = append(out, msg[:len(msg)-1]...)
+	if len(msg) > 2 {
+		out = append(out, ',')
+	}
+	out = append(out, `"seq":`...)
+	out = strconv.AppendInt(out, seq, 10)
+	return append(out, '}')
+}
+
+// enqueue numbers a message and queues it, reporting whether it did. One
+// the queue has no room for, or that puts the client too far behind its
+// acks, is numbered all the same.
+func (c *Client) enqueue(msg []byte) bool {
+	c.seqMu.Lock()
+	defer c.seqMu.Unlock()
+	return c.enqueueLocked(msg)
+}
+
+// enqueueLocked is enqueue for callers holding c.seqMu
+func (c *Client) enqueueLocked(msg []byte) bool {
+	c.seq++
+	msg = withSeq(msg, c.seq)
+	if c.acking {
+		c.keepLocked(numbered{c.seq, msg})
+		if c.seq-c.acked > resendWindow {
+			return false
+		}
+	}
+	return c.Send.Push(msg)
+}
+
+// enqueueCatchUp queues a catch-up-sync, after which nothing numbered
+// before it is resent
+func (c *Client) enqueueCatchUp(msg []byte) bool {
+	c.seqMu.Lock()
+	defer c.seqMu.Unlock()
+	c.unacked, c.unackedBytes = nil, 0
+	c.acked = c.seq
+	return c.enqueueLocked(msg)
+}
+
+// keepLocked keeps a message to resend, forgetting the oldest kept past
+// resendWindow. Caller must hold c.seqMu.
+func (c *Client) keepLocked(entry numbered) {
+	c.unacked = append(c.unacked, entry)
+	c.unackedBytes += len(entry.msg)
+	drop := 0
+	for len(c.unacked)-drop > resendWindow || c.unackedBytes > resendWindowBytes && len(c.unacked)-drop > 1 {
+		c.unackedBytes -= len(c.unacked[drop].msg)
+		drop++
+	}
+	if drop > 0 {
+		c.unacked = append([]numbered(nil), c.unacked[drop:]...)
+	}
+}
+
+// ack records that the client handled the messages up to seq
+func (c *Client) ack(seq int64) {
+	c.seqMu.Lock()
+	defer c.seqMu.Unlock()
+	if seq <= c.acked || seq > c.seq {
+		return
+	}
+	c.acking, c.acked = true, seq
+	drop := 0
+	for drop < len(c.unacked) && c.unacked[drop].seq <= seq {
+		c.unackedBytes -= len(c.unacked[drop].msg)
+		drop++
+	}
+	c.unacked = c.unacked[drop:]
+}
+
+// behind reports whether the client is further behind its acks than the
+// messages kept to resend
+func (c *Client) behind() bool {
+	c.seqMu.Lock()
+	defer c.seqMu.Unlock()
+	return c.acking && c.seq-c.acked > resendWindow
+}
+
+// resend queues again the messages from seq on, or if they aren't all kept
+// has the client catch up instead. It runs on the client's readPump, so
+// the client hasn't left.
+func (h *Hub) resend(c *Client, from int64) {
+	c.seqMu.Lock()
+	if from <= 0 || from > c.seq {
+		c.seqMu.Unlock()
+		return
+	}
+	kept := len(c.unacked) > 0 && c.unacked[0].seq <= from
+	queued := kept
+	if kept {
+		for _, entry := range c.unacked[from-c.unacked[0].seq:] {
+			if !c.Send.Push(entry.msg) {
+				queued = false
+				break
+			}
+		}
+	}
+	last := c.seq
+	c.seqMu.Unlock()
+
+	if kept {
+		log.Printf("Resending messages %d to %d to client %s of session %s", from, last, c.ID, c.SessionID)
+	} else {
+		log.Printf("Client %s of session %s missed messages from %d that aren't kept, catching it up", c.ID, c.SessionID, from)
+	}
+	if !queued {
+		c.lag()
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"github.com/codecollab/collab-service/internal/outbox"
+)
+
+// drain takes every message waiting for c, returning their seqs
+func drain(t *testing.T, c *Client) []int64 {
+	t.Helper()
+	var seqs []int64
+	for {
+		msg, ok := c.Send.Pop()
+		if !ok {
+			return seqs
+		}
+		var numbered struct {
+			Seq int64 `json:"seq"`
+		}
+		if err := json.Unmarshal(msg, &numbered); err != nil {
+			t.Fatalf("invalid message %s: %v", msg, err)
+		}
+		seqs = append(seqs, numbered.Seq)
+	}
+}
+
+func TestResend(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		// before are sent before the client first acks, with first, after
+		// are sent then, and acks are sent once everything was
+		before int
+		first  int64
+		after  int
+		acks   []int64
+		from   int64
+		want   []int64
+		// lagged is whether the client was left to catch up instead
+		lagged bool
+	}{
+		{"the messages after the ack", 8, 2, 2, 3, nil, 3, []int64{3, 4, 5}, false},
+		{"from further on than the ack", 8, 2, 2, 3, nil, 5, []int64{5}, false},
+		{"acks skipping messages", 8, 1, 1, 5, []int64{4}, 5, []int64{5, 6}, false},
+		{"stale and future acks are ignored", 8, 1, 1, 5, []int64{4, 2, 9}, 5, []int64{5, 6}, false},
+		{"from before the ack isn't kept", 8, 1, 1, 4, []int64{3}, 2, nil, true},
+		{"nothing kept before the first ack", 8, 3, 0, 0, nil, 2, nil, true},
+		{"everything acked", 8, 1, 1, 2, []int64{3}, 3, nil, true},
+		{"past the latest is ignored", 8, 1, 1, 2, nil, 4, nil, false},
+		{"no room to resend", 2, 1, 1, 4, nil, 2, []int64{2, 3}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Client{ID: "c", SessionID: "s", Send: outbox.New(tt.capacity)}
+			for range tt.before {
+				c.enqueue([]byte(`{"type":"operation"}`))
+			}
+			c.ack(tt.first)
+			for range tt.after {
+				c.enqueue([]byte(`{"type":"operation"}`))
+			}
+			for _, seq := range tt.acks {
+				c.ack(seq)
+			}
+			drain(t, c)
+
+			(&Hub{}).resend(c, tt.from)
+			if got := drain(t, c); !slices.Equal(got, tt.want) {
+				t.Fatalf("resent %v, want %v", got, tt.want)
+			}
+			if got := c.quarantined.Load(); got != tt.lagged {
+				t.Fatalf("lagged = %t, want %t", got, tt.lagged)
+			}
+		})
+	}
+}
+
+func TestResendAfterCatchUp(t *testing.T) {
+	c := &Client{ID: "c", SessionID: "s", Send: outbox.New(8)}
+	for range 3 {
+		c.enqueue([]byte(`{"type":"operation"}`))
+	}
+	c.ack(1)
+	c.enqueueCatchUp([]byte(`{"type":"catch-up-sync"}`))
+	c.enqueue([]byte(`{"type":"operation"}`))
+	if got, want := drain(t, c), []int64{1, 2, 3, 4, 5}; !slices.Equal(got, want) {
+		t.Fatalf("sent %v, want %v", got, want)
+	}
+
+	(&Hub{}).resend(c, 5)
+	if got, want := drain(t, c), []int64{5}; !slices.Equal(got, want) {
+		t.Fatalf("resent %v, want %v", got, want)
+	}
+	(&Hub{}).resend(c, 3)
+	if got := drain(t, c); len(got) != 0 || !c.quarantined.Load() {
+		t.Fatalf("resending from before the catch-up gave %v, want a lag", got)
+	}
+}
+
+func TestBehindPastResendWindow(t *testing.T) {
+	c := &Client{ID: "c", SessionID: "s", Send: outbox.New(resendWindow + 8)}
+	c.enqueue([]byte(`{}`))
+	c.ack(1)
+	for i := range resendWindow {
+		if !c.enqueue([]byte(`{}`)) {
+			t.Fatalf("message %d past the ack wasn't queued", i+1)
+		}
+	}
+	if c.behind() {
+		t.Fatal("behind with resendWindow messages unacked")
+	}
+	if c.enqueue([]byte(`{}`)) {
+		t.Fatal("queued a message past resendWindow unacked")
+	}
+	if !c.behind() {
+		t.Fatal("not behind past resendWindow unacked")
+	}
+	if got := len(c.unacked); got != resendWindow {
+		t.Fatalf("kept %d messages, want %d", got, resendWindow)
+	}
+}
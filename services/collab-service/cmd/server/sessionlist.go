@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/backplane"
+	"github.com/codecollab/collab-service/internal/listquery"
+	"github.com/codecollab/collab-service/internal/metacache"
+	"github.com/codecollab/collab-service/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+// sessionListSpec is how an organization's sessions can be listed
+var sessionListSpec = listquery.Spec{
+	Sorts:   []string{"-updated", "updated"},
+	Filters: []listquery.Filter{listquery.Owner, listquery.Language, listquery.Tag, listquery.Since, listquery.Until},
+}
+
+// participantsCacheDelay is how often, at most, the participants of a
+// session are cached for the other instances
+const participantsCacheDelay = time.Second
+
+// SessionSummary is a session as the REST listings show it
+type SessionSummary struct {
+	ID           string        `json:"id"`
+	Owner        string        `json:"owner,omitempty"`
+	UpdatedAt    time.Time     `json:"updatedAt"`
+	AlwaysOn     bool          `json:"alwaysOn,omitempty"`
+	Locked       bool          `json:"locked,omitempty"`
+	Notebook     bool          `json:"notebook,omitempty"`
+	Tags         []string      `json:"tags,omitempty"`
+	Participants []Participant `json:"participants"`
+}
+
+// cachedParticipants is who is in a session, as cached by the instances
+// serving it. The organization goes along, so it can be checked on
+// instances that don't have the session open.
+type cachedParticipants struct {
+	Org          string        `json:"org"`
+	Participants []Participant `json:"participants"`
+}
+
+func newMetadataCache(config Config, peers *backplane.Backplane) *metacache.Cache {
+	if peers == nil {
+		return metacache.New(config.MetadataCacheSize, config.MetadataCacheTTL, nil)
+	}
+	return metacache.New(config.MetadataCacheSize, config.MetadataCacheLocal, peers)
+}
+
+func sessionsKey(org string) string {
+	return "sessions:" + org
+}
+
+func participantsKey(sessionID string) string {
+	return "participants:" + sessionID
+}
+
+// participants lists everyone in the session, on this instance and the
+// others, with their colors
+func (h *Hub) participants(session *Session) []Participant {
+	session.mu.RLock()
+	participants := append(session.localParticipantsLocked(), session.remoteParticipantsLocked()...)
+	if session.ChatBridge != nil {
+		participants = append(participants, Participant{
+			ID:       bridgeParticipantID,
+			Username: session.ChatBridge.Room,
+			Color:    userColors[paletteColor(bridgeParticipantID)],
+			Via:      session.ChatBridge.Network,
+		})
+	}
+	session.mu.RUnlock()
+	return participants
+}
+
+// participantsChanged caches the session's participants for the other
+// instances, which can't tell who is in a session they don't have open.
+// Without a backplane there are no others to tell.
+func (h *Hub) participantsChanged(session *Session) {
+	if h.peers == nil {
+		return
+	}
+	h.throttle(session, "participants-cache", participantsCacheDelay, func() {
+		h.cacheParticipants(session)
+	})
+}
+
+// cacheParticipants caches who is in the session until the instances
+// would forget this one if it went quiet, so it's refreshed with every
+// presence heartbeat
+func (h *Hub) cacheParticipants(session *Session) {
+	session.mu.RLock()
+	org := session.Org
+	session.mu.RUnlock()
+	ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+	defer cancel()
+	h.metadata.Set(ctx, participantsKey(session.ID), cachedParticipants{Org: org, Participants: h.participants(session)}, peerTimeout)
+}
+
+// uncacheParticipants drops the participants cached for a session that
+// closed here
+func (h *Hub) uncacheParticipants(sessionID string) {
+	if h.peers == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+	defer cancel()
+	h.metadata.Delete(ctx, participantsKey(sessionID))
+}
+
+// sessionSaved invalidates the organization's listing once a session of
+// it was saved
+func (h *Hub) sessionSaved(snapshot *store.Session) {
+	if session, exists := h.getSession(snapshot.ID); exists {
+		session.mu.Lock()
+		session.stored = true
+		session.mu.Unlock()
+	}
+	if snapshot.Org == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+	defer cancel()
+	h.metadata.Delete(ctx, sessionsKey(snapshot.Org))
+}
+
+// sessionParticipants returns who is in a session and the organization it
+// belongs to. Sessions open here are asked, and the others are what the
+// instances serving them cached, if any does.
+func (h *Hub) sessionParticipants(ctx context.Context, sessionID string) (cachedParticipants, bool) {
+	if session, exists := h.getSession(sessionID); exists {
+		session.mu.RLock()
+		org := session.Org
+		session.mu.RUnlock()
+		return cachedParticipants{Org: org, Participants: h.participants(session)}, true
+	}
+	var cached cachedParticipants
+	if h.peers == nil || !h.metadata.Get(ctx, participantsKey(sessionID), &cached) {
+		return cachedParticipants{}, false
+	}
+	return cached, true
+}
+
+// listSessions returns the page of an organization's sessions q asks for,
+// and the cursor of the next one if there is one: what is kept of them,
+// and those open here which aren't kept yet. The first page of the
+// listing everyone gets by default is cached. Without a store only those
+// open here are listed.
+func (h *Hub) listSessions(ctx context.Context, org string, q listquery.Query) ([]SessionSummary, string, error) {
+	var summaries []SessionSummary
+	if h.store != nil {
+		cached := q.Default(sessionListSpec)
+		if !cached || !h.metadata.Get(ctx, sessionsKey(org), &summaries) {
+			// One more than the page, to tell whether there's another
+			filter := store.SessionFilter{
+				Owner:     q.Owner,
+				Language:  q.Language,
+				Tag:       q.Tag,
+				Since:     q.Since,
+				Until:     q.Until,
+				Ascending: !q.Descending,
+				Limit:     q.Limit + 1,
+			}
+			if q.After != nil {
+				at, err := listquery.ParseTimeKey(q.After.Key)
+				if err != nil {
+					return nil, "", listquery.ErrCursor
+				}
+				filter.AfterUpdate, filter.AfterID = at, q.After.ID
+			}
+			kept, err := h.store.Sessions(ctx, org, filter)
+			if err != nil {
+				return nil, "", err
+			}
+			summaries = make([]SessionSummary, 0, len(kept))
+			for _, saved := range kept {
+				var metadata persistedMetadata
+				json.Unmarshal(saved.Metadata, &metadata)
+				summaries = append(summaries, SessionSummary{
+					ID:        saved.ID,
+					Owner:     saved.Owner,
+					UpdatedAt: saved.UpdatedAt,
+					AlwaysOn:  metadata.AlwaysOn,
+					Locked:    metadata.Locked,
+					Notebook:  metadata.Notebook,
+					Tags:      saved.Tags,
+				})
+			}
+			if cached {
+				h.metadata.Set(ctx, sessionsKey(org), summaries, h.config.MetadataCacheTTL)
+			}
+		}
+	}
+
+	listed := make(map[string]bool, len(summaries))
+	for _, summary := range summaries {
+		listed[summary.ID] = true
+	}
+	for _, session := range h.openSessions() {
+		if session.Lobby || listed[session.ID] {
+			continue
+		}
+		session.mu.Lock()
+		// The store lists those it has
+		if session.Org == org && (h.store == nil || !session.stored) {
+			if summary, ok := h.openSummaryLocked(session, q); ok {
+				summaries = append(summaries, summary)
+			}
+		}
+		session.mu.Unlock()
+	}
+	page, next := listquery.Page(summaries, q,
+		func(summary SessionSummary, _ string) string { return listquery.TimeKey(summary.UpdatedAt) },
+		func(summary SessionSummary) string { return summary.ID })
+
+	for i := range page {
+		page[i].Participants = []Participant{}
+		if cached, ok := h.sessionParticipants(ctx, page[i].ID); ok {
+			page[i].Participants = cached.Participants
+		}
+	}
+	return page, next, nil
+}
+
+// openSummaryLocked is the listing of a session open here, and whether
+// the filters of q pick it. Caller must hold session.mu for writing, to
+// detect languages.
+func (h *Hub) openSummaryLocked(session *Session, q listquery.Query) (SessionSummary, bool) {
+	if q.Owner != "" && session.Owner != q.Owner || q.Tag != "" && !slices.Contains(session.Tags, q.Tag) {
+		return SessionSummary{}, false
+	}
+	summary := SessionSummary{
+		ID:       session.ID,
+		Owner:    session.Owner,
+		AlwaysOn: session.AlwaysOn,
+		Locked:   session.Locked,
+		Notebook: session.Notebook,
+		Tags:     session.Tags,
+	}
+	language := q.Language == ""
+	for _, file := range session.Files {
+		if file.UpdatedAt.After(summary.UpdatedAt) {
+			summary.UpdatedAt = file.UpdatedAt
+		}
+		if !language && !file.Binary && h.fileLanguageLocked(session, file.Path) == q.Language {
+			language = true
+		}
+	}
+	return summary, language && q.During(summary.UpdatedAt)
+}
+
+// handleListSessions returns the caller's organization's sessions, most
+// recently updated first unless sort=updated, with who is in each, a page
+// at a time. owner, language, tag, since and until narrow them down.
+func handleListSessions(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := hub.requestClaims(c)
+		if claims == nil || claims.Org == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "a valid token with an organization is required"})
+			return
+		}
+		q, ok := listQuery(c, sessionListSpec)
+		if !ok {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+		defer cancel()
+		summaries, next, err := hub.listSessions(ctx, claims.Org, q)
+		if errors.Is(err, listquery.ErrCursor) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to list the sessions of %s: %v", claims.Org, err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "sessions are unavailable"})
+			return
+		}
+		listPage(c, "sessions", summaries, next)
+	}
+}
+
+// handleListParticipants returns who is in a session, on whichever
+// instance serves it. A session of an organization is only shown to its
+// members.
+func handleListParticipants(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+		defer cancel()
+		cached, ok := hub.sessionParticipants(ctx, c.Param("sessionId"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+			return
+		}
+		if cached.Org != "" {
+			if claims := hub.requestClaims(c); claims == nil || claims.Org != cached.Org {
+				c.JSON(http.StatusForbidden, gin.H{"error": "the session belongs to another organization"})
+				return
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"participants": cached.Participants})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// SessionSettings are the settings of a session its owner sets with one
+// session-settings message: the editor settings, the language of files
+// whose paths don't say, whether editors format files when saving them,
+// and read-only mode, which is the session lock
+type SessionSettings struct {
+	EditorSettings
+	Language     string `json:"language"`
+	FormatOnSave bool   `json:"formatOnSave"`
+	ReadOnly     bool   `json:"readOnly"`
+}
+
+// sessionSettingsLocked returns the session's settings. Caller must hold
+// session.mu.
+func (s *Session) sessionSettingsLocked() SessionSettings {
+	return SessionSettings{
+		EditorSettings: s.Settings,
+		Language:       s.Language,
+		FormatOnSave:   s.FormatOnSave,
+		ReadOnly:       s.Locked,
+	}
+}
+
+func (h *Hub) sendSessionSettings(c *Client) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	settings := session.sessionSettingsLocked()
+	session.mu.RUnlock()
+
+	h.sendToClient(c, OutgoingMessage{Type: "session-settings", SessionSettings: &settings})
+}
+
+// broadcastSessionSettings tells everyone in the session its settings,
+// after any of them changed
+func (h *Hub) broadcastSessionSettings(session *Session, by string) {
+	session.mu.RLock()
+	settings := session.sessionSettingsLocked()
+	session.mu.RUnlock()
+
+	h.broadcastToSession(session.ID, OutgoingMessage{Type: "session-settings", Username: by, SessionSettings: &settings})
+}
+
+// setEditorSettingsLocked applies editor settings to the session and its
+// files. Caller must hold session.mu for writing.
+func (s *Session) setEditorSettingsLocked(settings EditorSettings) {
+	s.Settings = settings
+	for _, file := range s.Files {
+		file.Content = settings.normalizeImport(file.Content)
+	}
+}
+
+// updateSessionSettings applies the session owner's settings and syncs
+// them to every participant. Those who follow settings-update and
+// session-lock get those too.
+func (h *Hub) updateSessionSettings(c *Client, settings *SessionSettings) {
+	if settings == nil {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: "settings are required"})
+		return
+	}
+	if !h.isOwner(c) {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: "only the session owner can change settings"})
+		return
+	}
+	if err := settings.validate(); err != nil {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: err.Error()})
+		return
+	}
+
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	if settings.Language != "" {
+		registry, err := h.languagesLocked(session)
+		if err != nil {
+			registry = h.languages
+		}
+		if _, ok := registry.Lookup(settings.Language); !ok {
+			session.mu.Unlock()
+			h.sendToClient(c, OutgoingMessage{Type: "error", Error: fmt.Sprintf("unsupported language: %s", settings.Language)})
+			return
+		}
+	}
+	editorChanged := session.Settings != settings.EditorSettings
+	if editorChanged {
+		session.setEditorSettingsLocked(settings.EditorSettings)
+	}
+	session.Language = settings.Language
+	session.FormatOnSave = settings.FormatOnSave
+	session.mu.Unlock()
+
+	log.Printf("Session %s settings updated by %s", c.SessionID, c.ID)
+	h.schedulePersist(c.SessionID)
+	if editorChanged {
+		h.broadcastToSession(c.SessionID, OutgoingMessage{Type: "settings-update", Settings: &settings.EditorSettings})
+	}
+	// The lock tells everyone the settings itself when it changes
+	if !h.setLock(session, settings.ReadOnly, c.Username) {
+		h.broadcastSessionSettings(session, c.Username)
+	}
+}
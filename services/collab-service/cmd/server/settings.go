@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Line ending and encoding values accepted in EditorSettings
+const (
+	LineEndingLF   = "lf"
+	LineEndingCRLF = "crlf"
+
+	EncodingUTF8    = "utf-8"
+	EncodingUTF8BOM = "utf-8-bom"
+)
+
+const utf8BOM = "\uFEFF"
+
+// EditorSettings holds the editor behaviour shared by everyone in a session
+type EditorSettings struct {
+	TabSize      int    `json:"tabSize"`
+	InsertSpaces bool   `json:"insertSpaces"`
+	LineEnding   string `json:"lineEnding"`
+	Encoding     string `json:"encoding"`
+}
+
+func defaultEditorSettings() EditorSettings {
+	return EditorSettings{
+		TabSize:      4,
+		InsertSpaces: true,
+		LineEnding:   LineEndingLF,
+		Encoding:     EncodingUTF8,
+	}
+}
+
+func (s EditorSettings) validate() error {
+	if s.TabSize < 1 || s.TabSize > 16 {
+		return fmt.Errorf("tabSize must be between 1 and 16")
+	}
+	switch s.LineEnding {
+	case LineEndingLF, LineEndingCRLF:
+	default:
+		return fmt.Errorf("unsupported lineEnding: %q", s.LineEnding)
+	}
+	switch s.Encoding {
+	case EncodingUTF8, EncodingUTF8BOM:
+	default:
+		return fmt.Errorf("unsupported encoding: %q", s.Encoding)
+	}
+	return nil
+}
+
+// normalizeImport converts text coming into the session to its canonical
+// in-memory form: no BOM and the session's line endings.
+func (s EditorSettings) normalizeImport(text string) string {
+	text = strings.TrimPrefix(text, utf8BOM)
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	if s.LineEnding == LineEndingCRLF {
+		text = strings.ReplaceAll(text, "\n", "\r\n")
+	}
+	return text
+}
+
+// normalizeExport prepares session text for leaving the service, adding a
+// BOM when the session asks for one.
+func (s EditorSettings) normalizeExport(text string) string {
+	text = s.normalizeImport(text)
+	if s.Encoding == EncodingUTF8BOM {
+		text = utf8BOM + text
+	}
+	return text
+}
+
+// claimOwnership makes the first user to join a session with a verified
+// token its owner, unless they joined as a viewer. Those who only named
+// themselves never claim it.
+func (h *Hub) claimOwnership(c *Client) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.Owner == "" && c.token != nil && c.Role != RoleViewer {
+		session.Owner = c.token.Subject
+		session.Org = c.Org
+		log.Printf("Client %s (%s) is now owner of session %s", c.ID, c.Username, c.SessionID)
+	}
+}
+
+func (h *Hub) isOwner(c *Client) bool {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return false
+	}
+
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+	return session.roleLocked(c) == RoleOwner
+}
+
+func (h *Hub) sendSettings(c *Client) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	settings := session.Settings
+	session.mu.RUnlock()
+
+	h.sendToClient(c, OutgoingMessage{
+		Type:     "settings-update",
+		Settings: &settings,
+	})
+}
+
+// updateSettings applies new editor settings from the session owner and
+// syncs them to every participant
+func (h *Hub) updateSettings(c *Client, settings *EditorSettings) {
+	if settings == nil {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: "settings are required"})
+		return
+	}
+	if !h.isOwner(c) {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: "only the session owner can change settings"})
+		return
+	}
+	if err := settings.validate(); err != nil {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: err.Error()})
+		return
+	}
+
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	session.setEditorSettingsLocked(*settings)
+	session.mu.Unlock()
+
+	log.Printf("Session %s settings updated by %s", c.SessionID, c.ID)
+	h.schedulePersist(c.SessionID)
+	h.broadcastToSession(c.SessionID, OutgoingMessage{
+		Type:     "settings-update",
+		Settings: settings,
+	})
+	h.broadcastSessionSettings(session, c.Username)
+}
+
+// handleExport returns a file from the session (the default file unless
+// ?path= is given) normalized for download according to its editor settings
+func handleExport(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, exists := hub.getSession(c.Param("sessionId"))
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+			return
+		}
+
+		username := hub.requestUsername(c)
+
+		session.mu.RLock()
+		file, err := session.visibleFileLocked(c.Query("path"), session.requestRoleLocked(username))
+		var body string
+		if err == nil {
+			if file.Binary {
+				err = fmt.Errorf("%s is a binary file; download it from %s", file.Path, assetURL(session.ID, file.Path))
+			} else {
+				body = session.Settings.normalizeExport(file.Content)
+			}
+		}
+		session.mu.RUnlock()
+
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(file.Path)))
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(body))
+	}
+}
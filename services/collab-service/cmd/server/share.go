@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/backplane"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// peerShareLinks carries a session's share links, when they change
+const peerShareLinks = "share-links"
+
+// errShareLinkRevoked is sent to whoever joins through a link that was
+// revoked, or is forgotten since it expired
+const errShareLinkRevoked = "this share link has been revoked"
+
+// ShareLink lets anyone who has it watch a session, read-only. Its token
+// is a viewer token naming the link, so a link can be revoked, which also
+// disconnects those watching through it. Joining is allowed until the
+// link expires; viewers who joined before stay until they leave.
+type ShareLink struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url,omitempty"`
+	CreatedBy string    `json:"createdBy,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// shareLinkURL returns the link into the web app a share link stands for.
+// Tokens sign the same every time, so it can be made again whenever the
+// link is listed.
+func (h *Hub) shareLinkURL(sessionID string, link *ShareLink) (string, error) {
+	token, err := signToken(h.config.JWTSecret, tokenClaims{
+		Subject: "viewer",
+		Session: sessionID,
+		Role:    string(RoleViewer),
+		ID:      link.ID,
+		Expiry:  link.ExpiresAt.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return sessionLink(h.config.AppURL, sessionID, token), nil
+}
+
+// shareLinksLocked returns the session's share links that haven't
+// expired, oldest first, forgetting the others. Caller must hold
+// session.mu for writing.
+func (s *Session) shareLinksLocked() []*ShareLink {
+	now := time.Now()
+	links := make([]*ShareLink, 0, len(s.ShareLinks))
+	for id, link := range s.ShareLinks {
+		if !now.Before(link.ExpiresAt) {
+			delete(s.ShareLinks, id)
+			continue
+		}
+		links = append(links, link)
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].CreatedAt.Before(links[j].CreatedAt) })
+	return links
+}
+
+// joinShareLink lets a client joining through a share link in, if the link
+// still is, or disconnects it
+func (h *Hub) joinShareLink(c *Client, linkID string) bool {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return false
+	}
+	session.mu.Lock()
+	link, ok := session.ShareLinks[linkID]
+	if ok && time.Now().Before(link.ExpiresAt) {
+		c.shareLink = linkID
+	} else {
+		ok = false
+	}
+	session.mu.Unlock()
+
+	if !ok {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: errShareLinkRevoked})
+		c.disconnect(websocket.ClosePolicyViolation, "share link revoked")
+	}
+	return ok
+}
+
+// dropViewers disconnects whoever watches the session through a share
+// link that was revoked
+func (h *Hub) dropViewers(session *Session, revoked string) {
+	session.mu.RLock()
+	var viewers []*Client
+	for _, client := range session.Clients {
+		if client.shareLink == revoked {
+			viewers = append(viewers, client)
+		}
+	}
+	session.mu.RUnlock()
+
+	for _, client := range viewers {
+		h.sendToClient(client, OutgoingMessage{Type: "error", Error: errShareLinkRevoked})
+		client.disconnect(websocket.ClosePolicyViolation, "share link revoked")
+	}
+}
+
+// peerShareLinkState is a session's share links as sent between
+// instances, with the one just revoked, if any
+type peerShareLinkState struct {
+	Links   []*ShareLink `json:"links"`
+	Revoked string       `json:"revoked,omitempty"`
+}
+
+// shareLinksChanged saves the session's share links and tells the other
+// instances, after revoked, if set, was revoked
+func (h *Hub) shareLinksChanged(session *Session, revoked string) {
+	if revoked != "" {
+		h.dropViewers(session, revoked)
+	}
+	h.schedulePersist(session.ID)
+	h.publishShareLinks(session, revoked)
+}
+
+// publishShareLinks sends the session's share links to the other
+// instances
+func (h *Hub) publishShareLinks(session *Session, revoked string) {
+	if h.peers == nil {
+		return
+	}
+	session.mu.Lock()
+	links := session.shareLinksLocked()
+	session.mu.Unlock()
+	h.peers.Publish(session.ID, peerShareLinks, peerShareLinkState{Links: links, Revoked: revoked})
+}
+
+// handlePeerShareLinks applies another instance's share links
+func (h *Hub) handlePeerShareLinks(session *Session, env backplane.Envelope) {
+	var state peerShareLinkState
+	if err := json.Unmarshal(env.Data, &state); err != nil {
+		log.Printf("Invalid share links from instance %s: %v", env.Node, err)
+		return
+	}
+	session.mu.Lock()
+	session.ShareLinks = make(map[string]*ShareLink, len(state.Links))
+	for _, link := range state.Links {
+		session.ShareLinks[link.ID] = link
+	}
+	session.mu.Unlock()
+	if state.Revoked != "" {
+		h.dropViewers(session, state.Revoked)
+	}
+}
+
+// listedShareLinks returns the session's share links with their URLs
+func (h *Hub) listedShareLinks(session *Session) ([]ShareLink, error) {
+	session.mu.Lock()
+	links := session.shareLinksLocked()
+	session.mu.Unlock()
+
+	listed := make([]ShareLink, 0, len(links))
+	for _, link := range links {
+		entry := *link
+		var err error
+		if entry.URL, err = h.shareLinkURL(session.ID, link); err != nil {
+			return nil, err
+		}
+		listed = append(listed, entry)
+	}
+	return listed, nil
+}
+
+// handleListShareLinks returns the session's share links that haven't
+// expired
+func handleListShareLinks(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.ownerSession(c, "manage share links")
+		if !ok {
+			return
+		}
+		links, err := hub.listedShareLinks(session)
+		if err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "share links are not available: " + err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"shareLinks": links})
+	}
+}
+
+// handleCreateShareLink mints a share link to the session. ttlMinutes sets
+// how long it may be joined through, by default ViewerLinkTTL and at most
+// ShareLinkMaxTTL.
+func handleCreateShareLink(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.ownerSession(c, "manage share links")
+		if !ok {
+			return
+		}
+
+		var req struct {
+			TTLMinutes int `json:"ttlMinutes"`
+		}
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+				return
+			}
+		}
+		ttl := hub.config.ViewerLinkTTL
+		if req.TTLMinutes != 0 {
+			ttl = time.Duration(req.TTLMinutes) * time.Minute
+		}
+		if ttl <= 0 || hub.config.ShareLinkMaxTTL > 0 && ttl > hub.config.ShareLinkMaxTTL {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("ttlMinutes must be from 1 to %d", int(hub.config.ShareLinkMaxTTL.Minutes()))})
+			return
+		}
+
+		id := make([]byte, 12)
+		rand.Read(id)
+		now := time.Now().UTC()
+		link := &ShareLink{
+			ID:        hex.EncodeToString(id),
+			CreatedBy: hub.requestUsername(c),
+			CreatedAt: now,
+			ExpiresAt: now.Add(ttl),
+		}
+		url, err := hub.shareLinkURL(session.ID, link)
+		if err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "share links are not available: " + err.Error()})
+			return
+		}
+
+		session.mu.Lock()
+		session.ShareLinks[link.ID] = link
+		session.mu.Unlock()
+		hub.shareLinksChanged(session, "")
+		log.Printf("%s created share link %s to session %s, until %s", link.CreatedBy, link.ID, session.ID, link.ExpiresAt.Format(time.RFC3339))
+
+		created := *link
+		created.URL = url
+		c.JSON(http.StatusCreated, created)
+	}
+}
+
+// handleRevokeShareLink revokes one of the session's share links,
+// disconnecting whoever watches through it
+func handleRevokeShareLink(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.ownerSession(c, "manage share links")
+		if !ok {
+			return
+		}
+
+		id := c.Param("linkId")
+		session.mu.Lock()
+		_, exists := session.ShareLinks[id]
+		delete(session.ShareLinks, id)
+		session.mu.Unlock()
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "share link not found"})
+			return
+		}
+		hub.shareLinksChanged(session, id)
+		log.Printf("Share link %s to session %s revoked", id, session.ID)
+		c.Status(http.StatusNoContent)
+	}
+}
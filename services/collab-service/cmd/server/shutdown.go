@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// shutdownPoll is how often shutdown checks whether everyone has left
+const shutdownPoll = 50 * time.Millisecond
+
+// accepting reports whether the server takes new connections, responding
+// 503 once it's shutting down so clients reconnect elsewhere
+func (h *Hub) accepting(c *gin.Context) bool {
+	if !h.draining.Load() {
+		return true
+	}
+	c.Header("Retry-After", "1")
+	c.JSON(http.StatusServiceUnavailable, gin.H{"error": "the server is restarting"})
+	return false
+}
+
+// openSessions returns the sessions open here
+func (h *Hub) openSessions() []*Session {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	sessions := make([]*Session, 0, len(h.sessions))
+	for _, session := range h.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// shutdown stops the server within ShutdownTimeout without losing work.
+// New connections are turned away and every client is told the server is
+// restarting, then sent a close frame. Sessions close as their clients
+// leave, which saves them; whatever is still open afterwards, always-on
+// rooms, lobbies and sessions whose clients didn't go in time, is saved
+// before the remaining connections are dropped.
+func (h *Hub) shutdown(server *http.Server) {
+	log.Printf("Shutting down, within %s", h.config.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.ShutdownTimeout)
+	defer cancel()
+	h.draining.Store(true)
+
+	// The listener closes now; REST requests under way may finish
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("REST requests still under way at shutdown: %v", err)
+		}
+	}()
+
+	for _, session := range h.openSessions() {
+		h.broadcastToSession(session.ID, OutgoingMessage{Type: "server-restarting"})
+		session.mu.RLock()
+		for _, client := range session.Clients {
+			client.disconnect(websocket.CloseServiceRestart, "server restarting")
+		}
+		session.mu.RUnlock()
+	}
+	h.regionStats.disconnectAll(websocket.CloseServiceRestart, "server restarting")
+
+	// Clients answer the close frame and leave; half the time is theirs
+	leave, cancelLeave := context.WithTimeout(ctx, h.config.ShutdownTimeout/2)
+	defer cancelLeave()
+	for h.connectedClients() > 0 && leave.Err() == nil {
+		time.Sleep(shutdownPoll)
+	}
+
+	for _, session := range h.openSessions() {
+		h.flushSession(session)
+	}
+	// Sessions that closed are saved in the background
+	for h.savesPending() && ctx.Err() == nil {
+		time.Sleep(shutdownPoll)
+	}
+	// One last try for what failed to save before
+	if h.pendingSaves() > 0 {
+		h.retrySaves()
+		if n := h.pendingSaves(); n > 0 {
+			log.Printf("%d sessions and lobbies couldn't be saved", n)
+		}
+	}
+
+	for _, session := range h.openSessions() {
+		session.mu.RLock()
+		for _, client := range session.Clients {
+			client.Conn.Close()
+		}
+		session.mu.RUnlock()
+	}
+	<-served
+	log.Printf("Shut down")
+}
+
+// connectedClients counts the connections to this instance
+func (h *Hub) connectedClients() int {
+	n := 0
+	for _, session := range h.openSessions() {
+		session.mu.RLock()
+		n += len(session.Clients)
+		session.mu.RUnlock()
+	}
+	return n
+}
+
+// savesPending reports whether sessions that closed are still being saved
+func (h *Hub) savesPending() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.closing) > 0
+}
+
+// flushSession saves a session that is still open at shutdown and ends
+// its recording
+func (h *Hub) flushSession(session *Session) {
+	h.stopRecording(session)
+	if h.store == nil {
+		return
+	}
+	if session.Lobby {
+		h.saveLobby(session)
+		return
+	}
+
+	session.persistMu.Lock()
+	defer session.persistMu.Unlock()
+	session.mu.Lock()
+	if !session.persist {
+		session.mu.Unlock()
+		return
+	}
+	snapshot := h.snapshotLocked(session)
+	session.mu.Unlock()
+	h.saveSession(snapshot)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// signatureParam is the query parameter of a signed URL its token is in
+const signatureParam = "signature"
+
+// signedRoutes are the downloads URLs can be signed for. They are served
+// to a signed URL's requester as they would be to its signer, but only
+// with what the signer's token allowed.
+var signedRoutes = []string{
+	"/sessions/:sessionId/recordings/:recordingId",
+	"/sessions/:sessionId/assets/*path",
+	"/sessions/:sessionId/export",
+	"/sessions/:sessionId/export.pdf",
+	"/org/export",
+}
+
+// matchRoute reports whether path is one of route's, where a ":" segment
+// matches any one segment and a "*" segment the rest of the path
+func matchRoute(route, path string) bool {
+	routeSegments := strings.Split(strings.TrimPrefix(route, "/"), "/")
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for i, routeSegment := range routeSegments {
+		if strings.HasPrefix(routeSegment, "*") {
+			return i < len(segments) && segments[i] != ""
+		}
+		if i >= len(segments) || segments[i] == "" {
+			return false
+		}
+		if !strings.HasPrefix(routeSegment, ":") && routeSegment != segments[i] {
+			return false
+		}
+	}
+	return len(segments) == len(routeSegments)
+}
+
+// signable reports whether a URL can be signed for path
+func signable(path string) bool {
+	for _, route := range signedRoutes {
+		if matchRoute(route, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// signedURLExpiry is when a URL signed at now expires. URLs signed within
+// the same SignedURLTTL expire together, at the end of the next one, so
+// that a signer gets the same URL each time and their browser can serve
+// them all one cached response. No URL outlives the token it was signed
+// with.
+func (h *Hub) signedURLExpiry(now time.Time, claims *tokenClaims) time.Time {
+	expiresAt := now.Truncate(h.config.SignedURLTTL).Add(2 * h.config.SignedURLTTL)
+	if claims.Expiry != 0 && claims.Expiry < expiresAt.Unix() {
+		expiresAt = time.Unix(claims.Expiry, 0)
+	}
+	return expiresAt
+}
+
+// signedClaims returns the token of the signed URL requested, or nil if
+// the request isn't for one. A signature that isn't valid for the request
+// is an error.
+func (h *Hub) signedClaims(c *gin.Context) (*tokenClaims, error) {
+	token := c.Query(signatureParam)
+	if token == "" {
+		return nil, nil
+	}
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+		return nil, errors.New("signed URLs are only for downloading")
+	}
+	claims, err := h.verifyToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if claims.URL == "" || claims.URL != c.Request.URL.Path {
+		return nil, errors.New("the signature is for another URL")
+	}
+	return claims, nil
+}
+
+// checkSignature refuses requests for signed URLs whose signature isn't
+// valid, and lets the downloads of those that are be cached until they
+// expire, by the requester only, as they are made with the signer's access
+func (h *Hub) checkSignature(c *gin.Context) {
+	claims, err := h.signedClaims(c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "the signed URL is not valid: " + err.Error()})
+		return
+	}
+	if claims == nil {
+		return
+	}
+	maxAge := time.Until(time.Unix(claims.Expiry, 0))
+	c.Header("Cache-Control", fmt.Sprintf("private, max-age=%d", int(maxAge.Seconds())))
+}
+
+// handleSignURL signs a URL to download from path, which may have a query,
+// for the caller. Whoever it is shown to downloads as the caller, until it
+// expires.
+func handleSignURL(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if hub.config.SignedURLTTL <= 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "signed URLs are disabled"})
+			return
+		}
+		claims := hub.requestClaims(c)
+		if claims == nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "a valid token is required"})
+			return
+		}
+
+		var req struct {
+			Path string `json:"path" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+		target, err := url.Parse(req.Path)
+		if err != nil || target.Scheme != "" || target.Host != "" || !signable(target.Path) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "only recordings, assets and exports can be downloaded from signed URLs"})
+			return
+		}
+		query := target.Query()
+		if query.Has(signatureParam) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "the path is already signed"})
+			return
+		}
+
+		expiresAt := hub.signedURLExpiry(time.Now(), claims)
+		token, err := signToken(hub.config.JWTSecret, tokenClaims{
+			Subject: claims.Subject,
+			Org:     claims.Org,
+			OrgRole: claims.OrgRole,
+			Scope:   claims.Scope,
+			URL:     target.Path,
+			Expiry:  expiresAt.Unix(),
+		})
+		if err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "signed URLs are not available: " + err.Error()})
+			return
+		}
+		query.Set(signatureParam, token)
+		target.RawQuery = query.Encode()
+
+		c.JSON(http.StatusCreated, gin.H{
+			"url":       strings.TrimSuffix(hub.config.DownloadURL, "/") + target.String(),
+			"expiresAt": expiresAt.UTC(),
+		})
+	}
+}
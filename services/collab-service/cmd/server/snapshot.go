@@ -0,0 +1,131 @@
+package main
+
+import (
+	"html"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/highlight"
+	"github.com/gin-gonic/gin"
+)
+
+var snapshotTemplate = template.Must(template.New("snapshot").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.SessionID}} – CodeCollab snapshot</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2rem; color: #1f2328; }
+h1 { font-size: 1.25rem; }
+h2 { font-size: 1rem; font-family: ui-monospace, monospace; margin-top: 2rem; }
+pre { background: #f6f8fa; padding: 1rem; overflow-x: auto; line-height: 1.45; }
+.ln { display: inline-block; width: 3em; color: #8c959f; user-select: none; }
+.keyword { color: #cf222e; }
+.string { color: #0a3069; }
+.comment { color: #6e7781; font-style: italic; }
+.number { color: #0550ae; }
+footer { margin-top: 2rem; color: #8c959f; font-size: 0.8rem; }
+</style>
+</head>
+<body>
+<h1>Session {{.SessionID}}</h1>
+{{range .Files}}
+<h2>{{.Path}}</h2>
+{{if .Binary}}<p>Binary file: <a href="{{.DownloadURL}}">download</a></p>{{else}}<pre><code>{{.HTML}}</code></pre>{{end}}
+{{end}}
+<footer>Read-only snapshot generated {{.GeneratedAt}}</footer>
+</body>
+</html>
+`))
+
+type snapshotFile struct {
+	Path        string
+	Binary      bool
+	DownloadURL string
+	HTML        template.HTML
+}
+
+// renderHighlighted escapes content and wraps highlight tokens in spans,
+// prefixing each line with its number
+func renderHighlighted(language, content string) template.HTML {
+	tokensByLine := make(map[int][]highlight.Token)
+	for _, token := range highlight.Tokenize(language, content) {
+		tokensByLine[token.Line] = append(tokensByLine[token.Line], token)
+	}
+
+	var b strings.Builder
+	for i, line := range strings.Split(strings.TrimSuffix(content, "\n"), "\n") {
+		line = strings.TrimRight(line, "\r")
+		b.WriteString(`<span class="ln">`)
+		b.WriteString(strconv.Itoa(i + 1))
+		b.WriteString(`</span>`)
+
+		tokens := tokensByLine[i+1]
+		sort.Slice(tokens, func(a, b int) bool { return tokens[a].Column < tokens[b].Column })
+		pos := 0
+		for _, token := range tokens {
+			start := token.Column - 1
+			end := start + token.Length
+			if start < pos || end > len(line) {
+				continue
+			}
+			b.WriteString(html.EscapeString(line[pos:start]))
+			b.WriteString(`<span class="` + token.Type + `">`)
+			b.WriteString(html.EscapeString(line[start:end]))
+			b.WriteString(`</span>`)
+			pos = end
+		}
+		b.WriteString(html.EscapeString(line[pos:]))
+		b.WriteString("\n")
+	}
+	return template.HTML(b.String())
+}
+
+// handleSnapshotHTML renders every file the caller can see as a
+// syntax-highlighted, read-only HTML page
+func handleSnapshotHTML(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, exists := hub.getSession(c.Param("sessionId"))
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+			return
+		}
+
+		username := hub.requestUsername(c)
+
+		session.mu.RLock()
+		role := session.requestRoleLocked(username)
+		files := make([]snapshotFile, 0, len(session.Files))
+		for _, file := range session.Files {
+			if !file.visibleTo(role) {
+				continue
+			}
+			entry := snapshotFile{Path: file.Path, Binary: file.Binary}
+			if file.Binary {
+				entry.DownloadURL = assetURL(session.ID, file.Path)
+			} else {
+				entry.HTML = renderHighlighted(fileLanguage(file), file.Content)
+			}
+			files = append(files, entry)
+		}
+		session.mu.RUnlock()
+
+		sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		c.Status(http.StatusOK)
+		err := snapshotTemplate.Execute(c.Writer, gin.H{
+			"SessionID":   session.ID,
+			"Files":       files,
+			"GeneratedAt": time.Now().UTC().Format(time.RFC1123),
+		})
+		if err != nil {
+			log.Printf("Error rendering snapshot for session %s: %v", session.ID, err)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/listquery"
+	"github.com/codecollab/collab-service/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+// snapshotSweep is how often the open sessions are checked for a snapshot
+// that is due
+const snapshotSweep = 15 * time.Second
+
+// Snapshot is a session's text files as its snapshot schedule took them
+type Snapshot struct {
+	ID        string            `json:"id"`
+	CreatedAt time.Time         `json:"createdAt"`
+	Files     map[string]string `json:"files,omitempty"`
+}
+
+// runSnapshots takes a snapshot of each open session that changed, every
+// SnapshotInterval or as soon as SnapshotOperations edits were made since
+// the last one, and thins out the older ones
+func (h *Hub) runSnapshots() {
+	if h.config.SnapshotInterval <= 0 && h.config.SnapshotOperations <= 0 {
+		return
+	}
+	ticker := time.NewTicker(snapshotSweep)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		h.mu.RLock()
+		sessions := make([]*Session, 0, len(h.sessions))
+		for _, session := range h.sessions {
+			sessions = append(sessions, session)
+		}
+		h.mu.RUnlock()
+
+		for _, session := range sessions {
+			if snapshot := h.dueSnapshot(session, now); snapshot != nil {
+				h.keepSnapshot(session, snapshot)
+			}
+		}
+	}
+}
+
+// dueSnapshot captures the session's text files if a snapshot is due
+func (h *Hub) dueSnapshot(session *Session, now time.Time) *store.Snapshot {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.Lobby {
+		return nil
+	}
+
+	// Revisions start over when a session is restored
+	operations := 0
+	for filePath, file := range session.Files {
+		if file.Binary {
+			continue
+		}
+		if revision, last := file.doc.Revision(), session.snapshotRevisions[filePath]; revision >= last {
+			operations += revision - last
+		} else {
+			operations += revision
+		}
+	}
+	interval, limit := h.config.SnapshotInterval, h.config.SnapshotOperations
+	if operations == 0 || !(interval > 0 && now.Sub(session.lastSnapshot) >= interval || limit > 0 && operations >= limit) {
+		return nil
+	}
+
+	files := make(map[string]string, len(session.Files))
+	session.snapshotRevisions = make(map[string]int, len(session.Files))
+	for filePath, file := range session.Files {
+		if !file.Binary {
+			files[filePath] = file.Content
+			session.snapshotRevisions[filePath] = file.doc.Revision()
+		}
+	}
+	session.lastSnapshot = now
+	encoded, err := json.Marshal(files)
+	if err != nil {
+		log.Printf("Failed to encode a snapshot of session %s: %v", session.ID, err)
+		return nil
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &store.Snapshot{SessionID: session.ID, ID: hex.EncodeToString(id), Files: encoded, CreatedAt: now.UTC()}
+}
+
+// keepSnapshot saves a snapshot, in the store or with the session when
+// there is none, and deletes those the retention policy no longer keeps
+func (h *Hub) keepSnapshot(session *Session, snapshot *store.Snapshot) {
+	if h.store == nil {
+		session.mu.Lock()
+		kept := append([]*store.Snapshot{snapshot}, session.snapshots...)
+		drop := make(map[string]bool)
+		for _, old := range h.expiredSnapshots(kept, snapshot.CreatedAt) {
+			drop[old.ID] = true
+		}
+		session.snapshots = session.snapshots[:0]
+		for _, s := range kept {
+			if !drop[s.ID] {
+				session.snapshots = append(session.snapshots, s)
+			}
+		}
+		session.mu.Unlock()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+	defer cancel()
+	if err := h.store.SaveSnapshot(ctx, snapshot); err != nil {
+		log.Printf("Failed to save a snapshot of session %s: %v", session.ID, err)
+		return
+	}
+	kept, err := h.store.Snapshots(ctx, session.ID)
+	if err != nil {
+		log.Printf("Failed to list the snapshots of session %s: %v", session.ID, err)
+		return
+	}
+	for _, old := range h.expiredSnapshots(kept, snapshot.CreatedAt) {
+		if err := h.store.DeleteSnapshot(ctx, session.ID, old.ID); err != nil {
+			log.Printf("Failed to delete snapshot %s of session %s: %v", old.ID, session.ID, err)
+		}
+	}
+}
+
+// expiredSnapshots picks the snapshots, newest first, that the retention
+// policy drops as of now: those of the last hour are all kept, then the
+// newest of each hour for SnapshotHourly, and the newest of each day for
+// SnapshotDaily
+func (h *Hub) expiredSnapshots(snapshots []*store.Snapshot, now time.Time) []*store.Snapshot {
+	var expired []*store.Snapshot
+	hours, days := make(map[time.Time]bool), make(map[time.Time]bool)
+	for _, snapshot := range snapshots {
+		age := now.Sub(snapshot.CreatedAt)
+		hour := snapshot.CreatedAt.UTC().Truncate(time.Hour)
+		day := snapshot.CreatedAt.UTC().Truncate(24 * time.Hour)
+		keep := age < time.Hour ||
+			age < h.config.SnapshotHourly && !hours[hour] ||
+			age < h.config.SnapshotDaily && !days[day]
+		hours[hour], days[day] = true, true
+		if !keep {
+			expired = append(expired, snapshot)
+		}
+	}
+	return expired
+}
+
+// listSnapshots returns the session's snapshots, newest first, without
+// their files
+func (h *Hub) listSnapshots(ctx context.Context, session *Session) ([]*Snapshot, error) {
+	var kept []*store.Snapshot
+	if h.store != nil {
+		var err error
+		if kept, err = h.store.Snapshots(ctx, session.ID); err != nil {
+			return nil, err
+		}
+	} else {
+		session.mu.RLock()
+		kept = append(kept, session.snapshots...)
+		session.mu.RUnlock()
+	}
+	snapshots := make([]*Snapshot, len(kept))
+	for i, snapshot := range kept {
+		snapshots[i] = &Snapshot{ID: snapshot.ID, CreatedAt: snapshot.CreatedAt}
+	}
+	return snapshots, nil
+}
+
+// lookupSnapshot returns one of the session's snapshots with its files
+func (h *Hub) lookupSnapshot(ctx context.Context, session *Session, id string) (*Snapshot, error) {
+	var kept *store.Snapshot
+	if h.store != nil {
+		var err error
+		if kept, err = h.store.Snapshot(ctx, session.ID, id); err != nil {
+			return nil, err
+		}
+	} else {
+		session.mu.RLock()
+		for _, snapshot := range session.snapshots {
+			if snapshot.ID == id {
+				kept = snapshot
+				break
+			}
+		}
+		session.mu.RUnlock()
+		if kept == nil {
+			return nil, store.ErrNotFound
+		}
+	}
+	snapshot := &Snapshot{ID: kept.ID, CreatedAt: kept.CreatedAt}
+	if err := json.Unmarshal(kept.Files, &snapshot.Files); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// lookupSnapshotOr looks up a snapshot, responding 404 or 503 if it can't
+func (h *Hub) lookupSnapshotOr(c *gin.Context, session *Session, id string) (*Snapshot, bool) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+	defer cancel()
+	snapshot, err := h.lookupSnapshot(ctx, session, id)
+	if errors.Is(err, store.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "snapshot not found"})
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Failed to look up snapshot %s of session %s: %v", id, session.ID, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "snapshots are unavailable"})
+		return nil, false
+	}
+	return snapshot, true
+}
+
+// textFiles makes a snapshot's files into a checkpoint's, to be diffed
+func (s *Snapshot) textFiles() map[string]checkpointFile {
+	files := make(map[string]checkpointFile, len(s.Files))
+	for filePath, content := range s.Files {
+		files[filePath] = checkpointFile{content: content}
+	}
+	return files
+}
+
+// snapshotListSpec is how a session's snapshots can be listed
+var snapshotListSpec = listquery.Spec{
+	Sorts:   []string{"-created", "created"},
+	Filters: []listquery.Filter{listquery.Since, listquery.Until},
+}
+
+// handleListSnapshots returns the session's snapshots, newest first, a
+// page at a time
+func handleListSnapshots(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.ownerSession(c, "browse snapshots")
+		if !ok {
+			return
+		}
+		q, ok := listQuery(c, snapshotListSpec)
+		if !ok {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+		defer cancel()
+		snapshots, err := hub.listSnapshots(ctx, session)
+		if err != nil {
+			log.Printf("Failed to list the snapshots of session %s: %v", session.ID, err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "snapshots are unavailable"})
+			return
+		}
+		var taken []*Snapshot
+		for _, snapshot := range snapshots {
+			if q.During(snapshot.CreatedAt) {
+				taken = append(taken, snapshot)
+			}
+		}
+		page, next := listquery.Page(taken, q,
+			func(snapshot *Snapshot, _ string) string { return listquery.TimeKey(snapshot.CreatedAt) },
+			func(snapshot *Snapshot) string { return snapshot.ID })
+		listPage(c, "snapshots", page, next)
+	}
+}
+
+// handleGetSnapshot returns a snapshot with its files
+func handleGetSnapshot(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.ownerSession(c, "browse snapshots")
+		if !ok {
+			return
+		}
+		if snapshot, ok := hub.lookupSnapshotOr(c, session, c.Param("snapshotId")); ok {
+			c.JSON(http.StatusOK, snapshot)
+		}
+	}
+}
+
+// handleDiffSnapshot returns what changed from a snapshot to the snapshot
+// ?to, or to the session's text files as they are now
+func handleDiffSnapshot(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.ownerSession(c, "browse snapshots")
+		if !ok {
+			return
+		}
+		from, ok := hub.lookupSnapshotOr(c, session, c.Param("snapshotId"))
+		if !ok {
+			return
+		}
+
+		var after map[string]checkpointFile
+		if to := c.Query("to"); to != "" {
+			target, ok := hub.lookupSnapshotOr(c, session, to)
+			if !ok {
+				return
+			}
+			after = target.textFiles()
+		} else {
+			session.mu.RLock()
+			after = session.snapshotFilesLocked()
+			session.mu.RUnlock()
+			for filePath, file := range after {
+				if file.binary {
+					delete(after, filePath)
+				}
+			}
+		}
+
+		files := diffCheckpoints(from.textFiles(), after)
+		if files == nil {
+			files = []FileDiff{}
+		}
+		c.JSON(http.StatusOK, gin.H{"files": files})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/sqlsandbox"
+)
+
+// isSQL reports whether queries can be run from a file
+func isSQL(file *File) bool {
+	return !file.Binary && strings.EqualFold(path.Ext(file.Path), ".sql")
+}
+
+// sandboxLocked returns the session's SQL sandbox, provisioning it on first
+// use. Caller must hold session.mu.
+func (h *Hub) sandboxLocked(s *Session) (*sqlsandbox.Sandbox, error) {
+	if s.sandboxClosed {
+		return nil, fmt.Errorf("session has ended")
+	}
+	if s.Sandbox == nil {
+		sandbox, err := sqlsandbox.Open(h.config.SQLSandboxDir, s.ID)
+		if err != nil {
+			return nil, err
+		}
+		s.Sandbox = sandbox
+		log.Printf("Provisioned SQL sandbox for session %s", s.ID)
+	}
+	return s.Sandbox, nil
+}
+
+// closeSandbox tears down the session's SQL sandbox when the session ends
+func (h *Hub) closeSandbox(session *Session) {
+	session.mu.Lock()
+	sandbox := session.Sandbox
+	session.Sandbox = nil
+	session.sandboxClosed = true
+	session.mu.Unlock()
+
+	if sandbox == nil {
+		return
+	}
+	if err := sandbox.Close(); err != nil {
+		log.Printf("Failed to remove SQL sandbox for session %s: %v", session.ID, err)
+	}
+}
+
+// runQuery runs a query against the session's sandbox and streams the
+// result set back to the client a page at a time. An empty query runs the
+// whole file.
+func (h *Hub) runQuery(c *Client, filePath, query string) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	role := session.roleLocked(c)
+	file, err := session.visibleFileLocked(filePath, role)
+	if err == nil {
+		switch {
+		case role == RoleViewer:
+			err = fmt.Errorf("viewers cannot run queries")
+		case !isSQL(file):
+			err = fmt.Errorf("queries can only be run from .sql files")
+		}
+	}
+	var sandbox *sqlsandbox.Sandbox
+	if err == nil {
+		sandbox, err = h.sandboxLocked(session)
+	}
+	if err != nil {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Path: filePath, Error: err.Error()})
+		return
+	}
+	if strings.TrimSpace(query) == "" {
+		query = file.Content
+	}
+	filePath = file.Path
+	session.nextQueryID++
+	queryID := fmt.Sprintf("q%d", session.nextQueryID)
+	session.mu.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), h.config.SQLQueryTimeout)
+		defer cancel()
+
+		result, err := sandbox.Query(ctx, query, h.config.SQLPageSize, h.config.SQLMaxRows, func(page sqlsandbox.Page) error {
+			if err := waitForSendRoom(ctx, c); err != nil {
+				return err
+			}
+			h.sendToClient(c, OutgoingMessage{
+				Type:    "query-rows",
+				Path:    filePath,
+				QueryID: queryID,
+				Columns: page.Columns,
+				Rows:    page.Rows,
+			})
+			return nil
+		})
+
+		outMsg := OutgoingMessage{
+			Type:         "query-complete",
+			Path:         filePath,
+			QueryID:      queryID,
+			RowCount:     result.RowCount,
+			RowsAffected: result.RowsAffected,
+		}
+		switch {
+		case errors.Is(err, sqlsandbox.ErrTooManyRows):
+			outMsg.Truncated = true
+		case errors.Is(err, context.DeadlineExceeded):
+			outMsg.Error = fmt.Sprintf("query exceeded %s", h.config.SQLQueryTimeout)
+		case err != nil:
+			outMsg.Error = err.Error()
+		}
+		h.sendToClient(c, outMsg)
+	}()
+}
+
+// waitForSendRoom holds back a stream until the client has drained at
+// least half of its send buffer, so large result sets aren't dropped
+func waitForSendRoom(ctx context.Context, c *Client) error {
+	for c.Send.Len() > c.Send.Cap()/2 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/ot"
+)
+
+// maxOpenSuggestions bounds the suggestions waiting in a session
+const maxOpenSuggestions = 500
+
+var errSuggestingCRDT = errors.New("suggestion mode isn't available with CRDT sync")
+
+// Suggestion is an edit proposed by a participant in suggestion mode,
+// which the owner accepts or rejects. Ops are its edits as of Revision of
+// the file, to be shown as a tracked change.
+type Suggestion struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"`
+	UserID    string    `json:"userId"`
+	Username  string    `json:"username"`
+	Revision  int       `json:"revision"`
+	Ops       []ot.Edit `json:"ops"`
+	CreatedAt time.Time `json:"createdAt"`
+	// AcceptedBy is who accepted the suggestion, once someone has
+	AcceptedBy string `json:"acceptedBy,omitempty"`
+
+	op ot.Operation
+}
+
+// suggestingLocked reports whether c's edits are staged as suggestions.
+// While the owner keeps anyone in suggestion mode, so do clients that
+// didn't verify who they are, who could otherwise leave it by joining
+// again. Caller must hold session.mu.
+func (s *Session) suggestingLocked(c *Client) bool {
+	if s.suggesters[c.identity()] != "" {
+		return true
+	}
+	if c.token == nil {
+		for target, by := range s.suggesters {
+			if by != target {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// suggestLocked stages an edit of c's to file, turning it into content,
+// as a suggestion, shows it to everyone who can see the file and puts c's
+// editor back to the file as it is. Caller must hold session.mu for
+// writing.
+func (s *Session) suggestLocked(c *Client, file *File, content string) error {
+	op := ot.FromDiff(file.Content, content)
+	if op.IsNoop() {
+		return nil
+	}
+	if len(s.Suggestions) >= maxOpenSuggestions {
+		return fmt.Errorf("too many open suggestions")
+	}
+
+	s.nextSuggestionID++
+	suggestion := &Suggestion{
+		ID:        fmt.Sprintf("s%d", s.nextSuggestionID),
+		Path:      file.Path,
+		UserID:    c.ID,
+		Username:  c.Username,
+		Revision:  file.doc.Revision(),
+		Ops:       op.Edits(),
+		CreatedAt: time.Now().UTC(),
+		op:        op,
+	}
+	if s.Suggestions == nil {
+		s.Suggestions = make(map[string]*Suggestion)
+	}
+	s.Suggestions[suggestion.ID] = suggestion
+	s.broadcastToReadersLocked("", file, OutgoingMessage{Type: "suggestion-added", Suggestion: suggestion})
+	sendLocked(c, OutgoingMessage{Type: "code-update", Path: file.Path, Code: file.Content, Revision: file.doc.Revision()})
+	return nil
+}
+
+// setSuggestMode switches suggestion mode on or off, for c or, when the
+// owner asks, for another participant. Participants may only switch it
+// off if they switched it on themselves. The mode follows a verified user to
+// all their connections.
+func (h *Hub) setSuggestMode(c *Client, userID string, enabled bool) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	owner := isTrustedLocked(session, c)
+	target := c
+	var err error
+	if userID != "" && userID != c.ID {
+		if target = session.Clients[userID]; target == nil {
+			err = fmt.Errorf("participant not found")
+		} else if !owner {
+			err = fmt.Errorf("only the session owner can set suggestion mode for others")
+		}
+	}
+	if err == nil && enabled && session.SyncMode == SyncCRDT {
+		err = errSuggestingCRDT
+	}
+	if by := session.suggesters[target.identity()]; err == nil && !enabled && !owner && by != "" && by != c.identity() {
+		err = fmt.Errorf("only the session owner can take you out of suggestion mode")
+	}
+	if err != nil {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", UserID: userID, Error: err.Error()})
+		return
+	}
+	if enabled {
+		if session.suggesters == nil {
+			session.suggesters = make(map[string]string)
+		}
+		session.suggesters[target.identity()] = c.identity()
+	} else {
+		delete(session.suggesters, target.identity())
+	}
+	session.mu.Unlock()
+
+	log.Printf("Session %s: suggestion mode of %s set to %t by %s", session.ID, target.Username, enabled, c.ID)
+	h.broadcastToSession(session.ID, OutgoingMessage{Type: "suggest-mode", UserID: target.ID, Username: target.Username, Enabled: enabled})
+}
+
+// sendSuggestions tells a joining client whether they are in suggestion
+// mode, and of the open suggestions to files they can see, as of the
+// files' current revisions
+func (h *Hub) sendSuggestions(c *Client) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	suggesting := session.suggestingLocked(c)
+	suggestions, _ := session.currentSuggestionsLocked(session.roleLocked(c))
+	session.mu.RUnlock()
+
+	if suggesting {
+		h.sendToClient(c, OutgoingMessage{Type: "suggest-mode", UserID: c.ID, Username: c.Username, Enabled: true})
+	}
+	if len(suggestions) > 0 {
+		h.sendToClient(c, OutgoingMessage{Type: "suggestions", Suggestions: suggestions})
+	}
+}
+
+// currentSuggestionsLocked returns the open suggestions to text files role
+// can see, oldest first, as of the files' current revisions, and the IDs of
+// those too old to be brought up to date. Caller must hold session.mu.
+func (s *Session) currentSuggestionsLocked(role Role) ([]*Suggestion, []string) {
+	var suggestions []*Suggestion
+	var stale []string
+	for _, suggestion := range s.Suggestions {
+		file, ok := s.Files[suggestion.Path]
+		if !ok || file.Binary || !file.visibleTo(role) {
+			continue
+		}
+		op, err := file.doc.Transform(suggestion.Revision, suggestion.op)
+		if err != nil {
+			stale = append(stale, suggestion.ID)
+			continue
+		}
+		if op.IsNoop() {
+			continue
+		}
+		current := *suggestion
+		current.Revision, current.Ops, current.op = file.doc.Revision(), op.Edits(), op
+		suggestions = append(suggestions, &current)
+	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		if !suggestions[i].CreatedAt.Equal(suggestions[j].CreatedAt) {
+			return suggestions[i].CreatedAt.Before(suggestions[j].CreatedAt)
+		}
+		return suggestions[i].ID < suggestions[j].ID
+	})
+	sort.Strings(stale)
+	return suggestions, stale
+}
+
+// resolveSuggestion accepts or rejects a suggestion. An accepted one is
+// transformed past what changed since and applied as an operation, with its
+// lines attributed to the participant who suggested it and its undo to the
+// owner who accepted it.
+func (h *Hub) resolveSuggestion(c *Client, id string, accept bool) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	if !isTrustedLocked(session, c) {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: "only the session owner can resolve suggestions"})
+		return
+	}
+	suggestion, ok := session.Suggestions[id]
+	if !ok {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: "unknown suggestion"})
+		return
+	}
+	delete(session.Suggestions, id)
+	file, ok := session.Files[suggestion.Path]
+	if !ok || file.Binary {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Path: suggestion.Path, Error: "file can no longer be edited"})
+		return
+	}
+
+	resolved := *suggestion
+	if accept {
+		op, err := file.doc.Transform(suggestion.Revision, suggestion.op)
+		if errors.Is(err, ot.ErrStale) {
+			err = fmt.Errorf("that suggestion is too old to accept")
+		}
+		var content string
+		if err == nil {
+			content, err = op.Apply(file.Content)
+		}
+		if err == nil {
+			err = h.checkQuotaLocked(session, 0, len(content)-len(file.Content))
+		}
+		if err != nil {
+			session.mu.Unlock()
+			h.sendToClient(c, OutgoingMessage{Type: "error", Path: file.Path, Error: err.Error()})
+			return
+		}
+
+		session.recordEditLocked(suggestion.UserID, suggestion.Username, file, content)
+		h.recordChangeLocked(session, auditSuggestion, suggestion.UserID, suggestion.Username, file, content)
+		before := file.Content
+		file.commitOperation(op, content, suggestion.Username)
+		file.pushUndo(c.identity(), c.Username, op, before)
+		session.broadcastToReadersLocked("", file, OutgoingMessage{
+			Type:     "operation",
+			UserID:   c.ID,
+			Path:     file.Path,
+			Revision: file.doc.Revision(),
+			Ops:      op.Edits(),
+		})
+		resolved.AcceptedBy = c.Username
+		resolved.Revision, resolved.Ops = file.doc.Revision()-1, op.Edits()
+		session.broadcastToReadersLocked("", file, OutgoingMessage{Type: "suggestion-accepted", Username: c.Username, Suggestion: &resolved})
+	} else {
+		session.broadcastToReadersLocked("", file, OutgoingMessage{Type: "suggestion-rejected", Username: c.Username, Suggestion: &resolved})
+	}
+	session.mu.Unlock()
+
+	log.Printf("Suggestion %s of session %s accepted=%t by %s", id, session.ID, accept, c.ID)
+	if accept {
+		h.fileChanged(c.SessionID, file.Path)
+		h.scheduleSummaries(session)
+	}
+}
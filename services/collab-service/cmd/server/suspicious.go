@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// What makes activity suspicious
+const (
+	// suspicionMassDeletion is one edit deleting most of a file
+	suspicionMassDeletion = "mass-deletion"
+	// suspicionRapidDeletion is a newcomer deleting a lot in a short while
+	suspicionRapidDeletion = "rapid-deletion"
+)
+
+// guardName is who protective checkpoints and locks are by
+const guardName = "activity guard"
+
+// ActivityAlert is suspicious activity the session owner is asked to look
+// at: who deleted how much of which file, the protective checkpoint of the
+// files from before, and whether the session was locked until the owner
+// answers
+type ActivityAlert struct {
+	UserID     string    `json:"userId"`
+	Username   string    `json:"username"`
+	Path       string    `json:"path"`
+	Reason     string    `json:"reason"`
+	Deleted    int       `json:"deleted"`
+	Checkpoint int       `json:"checkpoint,omitempty"`
+	Locked     bool      `json:"locked"`
+	At         time.Time `json:"at"`
+	// Resolution is "confirmed" or "reverted" once the owner has answered
+	Resolution string `json:"resolution,omitempty"`
+
+	// files are those of the protective checkpoint
+	files map[string]checkpointFile
+}
+
+// suspect is what a newcomer deleted since the first deletion of the
+// current window, and the files from before it
+type suspect struct {
+	since   time.Time
+	deleted int
+	files   map[string]checkpointFile
+}
+
+// deletedBytes is how much of before an edit to after removed or replaced
+func deletedBytes(before, after string) int {
+	prefix := 0
+	for prefix < len(before) && prefix < len(after) && before[prefix] == after[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(before)-prefix && suffix < len(after)-prefix &&
+		before[len(before)-1-suffix] == after[len(after)-1-suffix] {
+		suffix++
+	}
+	return len(before) - prefix - suffix
+}
+
+// watchEditLocked looks at an edit of c's before it is applied and raises
+// an alert when it is suspicious. Only sessions with an owner, who can
+// answer, are watched, and only one alert is open at a time. Caller must
+// hold session.mu for writing.
+func (h *Hub) watchEditLocked(session *Session, c *Client, file *File, content string) {
+	threshold := h.config.SuspiciousDeleteBytes
+	if threshold <= 0 || session.Owner == "" || session.Alert != nil || isTrustedLocked(session, c) {
+		return
+	}
+	deleted := deletedBytes(file.Content, content)
+	if deleted == 0 {
+		return
+	}
+
+	now := time.Now()
+	alert := &ActivityAlert{UserID: c.ID, Username: c.Username, Path: file.Path, Deleted: deleted, At: now.UTC()}
+	switch {
+	case deleted >= threshold && len(content)*10 <= len(file.Content):
+		alert.Reason = suspicionMassDeletion
+		alert.files = session.snapshotFilesLocked()
+	case now.Sub(c.connectedAt) < h.config.SuspiciousNewcomer:
+		tracked := session.suspects[c.ID]
+		if tracked == nil || now.Sub(tracked.since) > h.config.SuspiciousWindow {
+			if session.suspects == nil {
+				session.suspects = make(map[string]*suspect)
+			}
+			tracked = &suspect{since: now, files: session.snapshotFilesLocked()}
+			session.suspects[c.ID] = tracked
+		}
+		tracked.deleted += deleted
+		if tracked.deleted < threshold {
+			return
+		}
+		alert.Reason = suspicionRapidDeletion
+		alert.Deleted = tracked.deleted
+		alert.files = tracked.files
+	default:
+		return
+	}
+
+	delete(session.suspects, c.ID)
+	session.Alert = alert
+	// Locking here keeps the next edits out before anyone is told
+	if h.config.SuspiciousLock && !session.Locked {
+		session.Locked = true
+		alert.Locked = true
+	}
+	go h.raiseAlert(session, alert)
+}
+
+// raiseAlert takes an alert's protective checkpoint and tells the session
+func (h *Hub) raiseAlert(session *Session, alert *ActivityAlert) {
+	log.Printf("Session %s: %s of %s by %s", session.ID, alert.Reason, alert.Path, alert.UserID)
+	name := fmt.Sprintf("Before %s by %s", strings.ReplaceAll(alert.Reason, "-", " "), alert.Username)
+	checkpoint, err := h.checkpointOf(session, name, guardName, alert.files)
+	if err != nil {
+		log.Printf("Failed to checkpoint session %s before %s: %v", session.ID, alert.Reason, err)
+	}
+
+	session.mu.Lock()
+	if checkpoint != nil {
+		alert.Checkpoint = checkpoint.ID
+	}
+	current := *alert
+	session.mu.Unlock()
+
+	if alert.Locked {
+		h.schedulePersist(session.ID)
+		h.announceLock(session, true, guardName)
+	}
+	h.broadcastToSession(session.ID, OutgoingMessage{Type: "suspicious-activity", Alert: &current})
+}
+
+// sendAlert tells a joining client of the session's open alert, if any
+func (h *Hub) sendAlert(c *Client) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	var alert *ActivityAlert
+	if session.Alert != nil {
+		current := *session.Alert
+		alert = &current
+	}
+	session.mu.RUnlock()
+
+	if alert != nil {
+		h.sendToClient(c, OutgoingMessage{Type: "suspicious-activity", Alert: alert})
+	}
+}
+
+// resolveAlert is the owner's answer to the session's alert: confirming
+// leaves the files as they are, reverting puts back those of the
+// protective checkpoint, recreating the ones deleted since and leaving the
+// ones created since. Either way the lock the alert took is lifted.
+func (h *Hub) resolveAlert(c *Client, revert bool) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	trusted, alert := isTrustedLocked(session, c), session.Alert
+	var checkpoint *Checkpoint
+	if alert != nil {
+		checkpoint = session.checkpointLocked(alert.Checkpoint)
+	}
+	session.mu.RUnlock()
+	if !trusted {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: "only the session owner can resolve suspicious activity"})
+		return
+	}
+	if alert == nil {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: "there is no suspicious activity to resolve"})
+		return
+	}
+
+	resolution := "confirmed"
+	if revert {
+		resolution = "reverted"
+		// The checkpoint may not be taken yet, or no longer be kept
+		if checkpoint == nil {
+			checkpoint = &Checkpoint{ID: alert.Checkpoint, CreatedBy: guardName, files: alert.files}
+		}
+		if _, err := h.restoreCheckpoint(session, checkpoint, c.Username); err != nil {
+			h.sendToClient(c, OutgoingMessage{Type: "error", Error: err.Error()})
+			return
+		}
+	}
+
+	session.mu.Lock()
+	if session.Alert != alert {
+		// Another of the owner's connections answered first
+		session.mu.Unlock()
+		return
+	}
+	session.Alert = nil
+	alert.Resolution = resolution
+	resolved := *alert
+	session.mu.Unlock()
+
+	log.Printf("Session %s: %s of %s by %s %s by %s", session.ID, alert.Reason, alert.Path, alert.UserID, resolution, c.ID)
+	if alert.Locked {
+		h.schedulePersist(session.ID)
+		h.setLock(session, false, c.Username)
+	}
+	h.broadcastToSession(session.ID, OutgoingMessage{Type: "activity-resolved", Username: c.Username, Alert: &resolved})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// maxSessionTags bounds the tags a session may have
+const maxSessionTags = 20
+
+// tagPattern is what a tag looks like once lowercased
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,31}$`)
+
+// normalizeTags lowercases tags and drops duplicates, in order
+func normalizeTags(tags []string) ([]string, error) {
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if !tagPattern.MatchString(tag) {
+			return nil, fmt.Errorf("invalid tag: %q", tag)
+		}
+		if !slices.Contains(normalized, tag) {
+			normalized = append(normalized, tag)
+		}
+	}
+	if len(normalized) > maxSessionTags {
+		return nil, fmt.Errorf("sessions are limited to %d tags", maxSessionTags)
+	}
+	slices.Sort(normalized)
+	return normalized, nil
+}
+
+// setTags replaces the tags the organization's sessions can be listed by
+// and pushes them to everyone in the session
+func (h *Hub) setTags(c *Client, tags []string) {
+	tags, err := normalizeTags(tags)
+	if err != nil {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: err.Error()})
+		return
+	}
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	if session.roleLocked(c) != RoleOwner {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: "only the session owner can tag the session"})
+		return
+	}
+	session.Tags = tags
+	session.mu.Unlock()
+
+	log.Printf("Session %s tagged %v by %s", c.SessionID, tags, c.ID)
+	h.schedulePersist(c.SessionID)
+	h.broadcastToSession(c.SessionID, OutgoingMessage{Type: "session-tags", Username: c.Username, Tags: tags})
+}
+
+func (h *Hub) sendTags(c *Client) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	tags := session.Tags
+	session.mu.RUnlock()
+
+	if len(tags) > 0 {
+		h.sendToClient(c, OutgoingMessage{Type: "session-tags", Tags: tags})
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/codecollab/collab-service/internal/execution"
+)
+
+// OutputChunk is a piece of a running task's output
+type OutputChunk struct {
+	RunID string `json:"runId"`
+	// Stream is "stdout" or "stderr"
+	Stream string `json:"stream"`
+	Data   string `json:"data"`
+}
+
+// canRunTask reports whether role may run a task restricted to roles.
+// Without a list, the owner and editors may.
+func canRunTask(roles []string, role Role) bool {
+	if len(roles) == 0 {
+		return role != RoleViewer
+	}
+	return role == RoleOwner || slices.Contains(roles, string(role))
+}
+
+// broadcastToRunReaders delivers a message about a run to every client
+// allowed to see it
+func (h *Hub) broadcastToRunReaders(session *Session, run *Run, outMsg OutgoingMessage) {
+	msgBytes, err := json.Marshal(outMsg)
+	if err != nil {
+		log.Printf("Error marshaling %s: %v", outMsg.Type, err)
+		return
+	}
+
+	session.mu.RLock()
+	for _, client := range session.Clients {
+		if !session.runVisibleLocked(run, session.roleLocked(client)) {
+			continue
+		}
+		client.deliver(msgBytes)
+	}
+	session.mu.RUnlock()
+}
+
+// runTask runs a task from the workspace config against a copy of every
+// text file the participant can see, streaming its output to everyone who
+// can see those files as well
+func (h *Hub) runTask(c *Client, name string) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	role := session.roleLocked(c)
+	registry, err := h.languagesLocked(session)
+	if err != nil {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: fmt.Sprintf("%s: %v", workspaceConfigPath, err)})
+		return
+	}
+	task, resources, ok := registry.Task(name)
+	switch {
+	case !ok:
+		err = fmt.Errorf("task not found: %s", name)
+	case !canRunTask(task.Roles, role):
+		err = fmt.Errorf("your role cannot run task %s", name)
+	}
+	var env map[string]string
+	var secrets []string
+	if err == nil {
+		env, secrets, err = h.runEnvLocked(session)
+	}
+	if err != nil {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: err.Error()})
+		return
+	}
+
+	files := make(map[string]string)
+	run := &Run{Kind: RunKindTask, Task: task.Name, Command: task.Command, RunBy: c.Username, role: role, subject: c.subject()}
+	for filePath, file := range session.Files {
+		if file.Binary || !file.visibleTo(role) {
+			continue
+		}
+		files[filePath] = file.Content
+		run.files = append(run.files, filePath)
+	}
+	h.startRunLocked(session, run, env)
+	started := *run
+	session.mu.Unlock()
+
+	log.Printf("Client %s started task %s (run %s) in session %s", c.ID, task.Name, started.ID, c.SessionID)
+	h.broadcastToRunReaders(session, run, OutgoingMessage{Type: "run-started", Run: &started})
+
+	req := execution.Request{
+		Language: "task",
+		Env:      env,
+		Files:    files,
+		Run:      task.Command,
+		Timeout:  resources.Timeout,
+		MemoryMB: resources.MemoryMB,
+	}
+	go func() {
+		result, err := h.executeStreaming(session, run, req, func(out execution.Output) {
+			h.broadcastToRunReaders(session, run, OutgoingMessage{
+				Type:  "task-output",
+				Chunk: &OutputChunk{RunID: started.ID, Stream: out.Stream, Data: maskSecrets(out.Data, secrets)},
+			})
+		})
+
+		session.mu.Lock()
+		if err != nil {
+			h.finishRunLocked(run, "", err.Error(), -1, 0)
+		} else {
+			h.finishRunLocked(run, maskSecrets(result.Stdout, secrets), maskSecrets(result.Stderr, secrets), result.ExitCode, result.ExecutionTime)
+		}
+		finished := *run
+		session.mu.Unlock()
+
+		h.broadcastToRunReaders(session, run, OutgoingMessage{Type: "run-finished", Run: &finished})
+		h.fireTrigger(session, TriggerRunFinished, TriggerEvent{Run: &finished})
+		for _, port := range detectListeningPorts(finished.Stdout + finished.Stderr) {
+			if err := h.openPortPreview(session, port, c.Username); err != nil {
+				log.Printf("Failed to expose port %d for session %s: %v", port, c.SessionID, err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/gitrepo"
+	"github.com/codecollab/collab-service/internal/listquery"
+	"github.com/codecollab/collab-service/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+// seededSessionWait is how long a session created from a template or a
+// gist stays open for someone to join it
+const seededSessionWait = 10 * time.Minute
+
+// Template bounds
+const (
+	maxTemplateNameBytes        = 100
+	maxTemplateDescriptionBytes = 1000
+	maxTemplateFiles            = 500
+	maxTemplateBytes            = 5 << 20
+)
+
+// Template is a starter project, such as a Go HTTP server or a React app,
+// that admins define and sessions can be created from. Its ID is a slug.
+type Template struct {
+	ID          string         `json:"id"`
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Files       []TemplateFile `json:"files,omitempty"`
+	// Paths are those of the files, listed instead of them
+	Paths     []string  `json:"paths,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// TemplateFile is one of a template's files
+type TemplateFile struct {
+	Path    string `json:"path"`
+	Content string `json:"content"`
+}
+
+// sessionTemplate decodes a kept template
+func sessionTemplate(kept *store.Template) (*Template, error) {
+	template := &Template{
+		ID:          kept.ID,
+		Name:        kept.Name,
+		Description: kept.Description,
+		CreatedAt:   kept.CreatedAt,
+		UpdatedAt:   kept.UpdatedAt,
+	}
+	if err := json.Unmarshal(kept.Files, &template.Files); err != nil {
+		return nil, fmt.Errorf("template %s: %w", kept.ID, err)
+	}
+	return template, nil
+}
+
+// listed is the template as listings show it, with its paths only
+func (t *Template) listed() *Template {
+	entry := *t
+	entry.Files, entry.Paths = nil, make([]string, len(t.Files))
+	for i, file := range t.Files {
+		entry.Paths[i] = file.Path
+	}
+	return &entry
+}
+
+// saveTemplate keeps a template, in the store or here if there is none,
+// reporting whether it is new
+func (h *Hub) saveTemplate(ctx context.Context, template *store.Template) (bool, error) {
+	if h.store != nil {
+		return h.store.SaveTemplate(ctx, template)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	existing, ok := h.templates[template.ID]
+	if ok {
+		template.CreatedAt = existing.CreatedAt
+	}
+	h.templates[template.ID] = template
+	return !ok, nil
+}
+
+// lookupTemplate finds a template
+func (h *Hub) lookupTemplate(ctx context.Context, id string) (*Template, error) {
+	var kept *store.Template
+	if h.store != nil {
+		var err error
+		if kept, err = h.store.Template(ctx, id); err != nil {
+			return nil, err
+		}
+	} else {
+		h.mu.RLock()
+		kept = h.templates[id]
+		h.mu.RUnlock()
+		if kept == nil {
+			return nil, store.ErrNotFound
+		}
+	}
+	return sessionTemplate(kept)
+}
+
+// listTemplates returns the templates, by name
+func (h *Hub) listTemplates(ctx context.Context) ([]*Template, error) {
+	var kept []*store.Template
+	if h.store != nil {
+		var err error
+		if kept, err = h.store.Templates(ctx); err != nil {
+			return nil, err
+		}
+	} else {
+		h.mu.RLock()
+		for _, template := range h.templates {
+			kept = append(kept, template)
+		}
+		h.mu.RUnlock()
+		sort.Slice(kept, func(i, j int) bool {
+			if kept[i].Name != kept[j].Name {
+				return kept[i].Name < kept[j].Name
+			}
+			return kept[i].ID < kept[j].ID
+		})
+	}
+	templates := make([]*Template, 0, len(kept))
+	for _, k := range kept {
+		template, err := sessionTemplate(k)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, template)
+	}
+	return templates, nil
+}
+
+// deleteTemplate deletes a template
+func (h *Hub) deleteTemplate(ctx context.Context, id string) error {
+	if h.store != nil {
+		return h.store.DeleteTemplate(ctx, id)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.templates[id]; !ok {
+		return store.ErrNotFound
+	}
+	delete(h.templates, id)
+	return nil
+}
+
+// lookupTemplateOr finds the template of the request's path, or responds
+// 404 or 503
+func (h *Hub) lookupTemplateOr(c *gin.Context) (*Template, bool) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+	defer cancel()
+	template, err := h.lookupTemplate(ctx, c.Param("templateId"))
+	if errors.Is(err, store.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "template not found"})
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Failed to look up template %s: %v", c.Param("templateId"), err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "templates are unavailable"})
+		return nil, false
+	}
+	return template, true
+}
+
+// templateListSpec is how the templates can be listed
+var templateListSpec = listquery.Spec{
+	Sorts:   []string{"name", "-name", "-updated", "updated"},
+	Filters: []listquery.Filter{listquery.Language, listquery.Since, listquery.Until},
+}
+
+// hasLanguage reports whether one of the template's files is detected as
+// language
+func (h *Hub) hasLanguage(template *Template, language string) bool {
+	for _, file := range template.Files {
+		if lang, ok := h.languages.Detect(file.Path); ok && lang.Name == language {
+			return true
+		}
+	}
+	return false
+}
+
+// handleListTemplates returns the templates, with the paths of their files,
+// by name unless sort says otherwise and a page at a time. language picks
+// those with a file in it, and since and until those updated then.
+func handleListTemplates(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q, ok := listQuery(c, templateListSpec)
+		if !ok {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+		defer cancel()
+		templates, err := hub.listTemplates(ctx)
+		if err != nil {
+			log.Printf("Failed to list templates: %v", err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "templates are unavailable"})
+			return
+		}
+		var entries []*Template
+		for _, template := range templates {
+			if (q.Language == "" || hub.hasLanguage(template, q.Language)) && q.During(template.UpdatedAt) {
+				entries = append(entries, template.listed())
+			}
+		}
+		page, next := listquery.Page(entries, q, func(template *Template, field string) string {
+			if field == "updated" {
+				return listquery.TimeKey(template.UpdatedAt)
+			}
+			return template.Name
+		}, func(template *Template) string { return template.ID })
+		listPage(c, "templates", page, next)
+	}
+}
+
+// handleGetTemplate returns a template with its files
+func handleGetTemplate(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if template, ok := hub.lookupTemplateOr(c); ok {
+			c.JSON(http.StatusOK, template)
+		}
+	}
+}
+
+// handlePutTemplate creates or replaces the template with the path's ID,
+// from {"name", "description", "files": [{"path", "content"}]}
+func handlePutTemplate(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hub.requireAdmin(c) {
+			return
+		}
+
+		id := c.Param("templateId")
+		if !slugPattern.MatchString(id) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "template IDs are 3 to 48 lowercase letters, digits and hyphens, starting and ending with a letter or digit"})
+			return
+		}
+		var body struct {
+			Name        string         `json:"name"`
+			Description string         `json:"description"`
+			Files       []TemplateFile `json:"files"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+		body.Name = strings.TrimSpace(body.Name)
+		if body.Name == "" || len(body.Name) > maxTemplateNameBytes {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("name must be 1 to %d bytes", maxTemplateNameBytes)})
+			return
+		}
+		if len(body.Description) > maxTemplateDescriptionBytes {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("description must be at most %d bytes", maxTemplateDescriptionBytes)})
+			return
+		}
+		if len(body.Files) == 0 || len(body.Files) > maxTemplateFiles {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("a template has 1 to %d files", maxTemplateFiles)})
+			return
+		}
+		seen, total := make(map[string]bool), 0
+		for i, file := range body.Files {
+			filePath, err := cleanFilePath(file.Path)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s: %v", file.Path, err)})
+				return
+			}
+			if seen[filePath] {
+				c.JSON(http.StatusBadRequest, gin.H{"error": filePath + " is in the template twice"})
+				return
+			}
+			seen[filePath] = true
+			body.Files[i].Path = filePath
+			total += len(file.Content)
+		}
+		if total > maxTemplateBytes {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("a template's files may have %d bytes in all", maxTemplateBytes)})
+			return
+		}
+		sort.Slice(body.Files, func(i, j int) bool { return body.Files[i].Path < body.Files[j].Path })
+
+		files, err := json.Marshal(body.Files)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save the template"})
+			return
+		}
+		now := time.Now().UTC()
+		kept := &store.Template{ID: id, Name: body.Name, Description: body.Description, Files: files, CreatedAt: now, UpdatedAt: now}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+		defer cancel()
+		created, err := hub.saveTemplate(ctx, kept)
+		if err != nil {
+			log.Printf("Failed to save template %s: %v", id, err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "templates are unavailable"})
+			return
+		}
+
+		template, _ := sessionTemplate(kept)
+		status := http.StatusOK
+		if created {
+			status = http.StatusCreated
+		}
+		log.Printf("Saved template %s with %d files", id, len(body.Files))
+		c.JSON(status, template.listed())
+	}
+}
+
+// handleDeleteTemplate deletes a template
+func handleDeleteTemplate(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hub.requireAdmin(c) {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+		defer cancel()
+		err := hub.deleteTemplate(ctx, c.Param("templateId"))
+		if errors.Is(err, store.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "template not found"})
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to delete template %s: %v", c.Param("templateId"), err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "templates are unavailable"})
+			return
+		}
+		log.Printf("Deleted template %s", c.Param("templateId"))
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// handleCreateFromTemplate creates a session with a template's files and
+// returns its ID
+func handleCreateFromTemplate(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		template, ok := hub.lookupTemplateOr(c)
+		if !ok {
+			return
+		}
+
+		files := make([]gitrepo.File, len(template.Files))
+		for i, file := range template.Files {
+			files[i] = gitrepo.File{Path: file.Path, Data: []byte(file.Content)}
+		}
+		session, imported, _, ok := hub.seedSession(c, files)
+		if !ok {
+			return
+		}
+
+		log.Printf("Created session %s from template %s for %s", session.ID, template.ID, hub.requestUsername(c))
+		c.JSON(http.StatusCreated, gin.H{"sessionId": session.ID, "template": template.ID, "files": len(imported)})
+	}
+}
+
+// seedSession opens a new session with files in place of the empty one
+// sessions start with. The caller owns it, or whoever joins it first if
+// they are anonymous, and it closes if nobody joins within
+// seededSessionWait, saved if sessions are kept. It returns the paths
+// imported and those skipped, or responds with why there is no session.
+func (h *Hub) seedSession(c *gin.Context, files []gitrepo.File) (session *Session, imported, skipped []string, ok bool) {
+	sessionID := newSlugSessionID()
+	if !h.admitting(c, sessionID) {
+		return nil, nil, nil, false
+	}
+
+	session = h.getOrCreateSession(sessionID)
+	username := h.requestUsername(c)
+	session.mu.Lock()
+	if claims := h.requestClaims(c); claims != nil {
+		session.Owner, session.Org = claims.Subject, claims.Org
+	}
+	if placeholder := session.Files[defaultFilePath]; placeholder != nil && placeholder.Content == "" {
+		delete(session.Files, defaultFilePath)
+	}
+	session.mu.Unlock()
+
+	imported, skipped, err := h.importFiles(session, files, username)
+	if err != nil || len(imported) == 0 {
+		h.expire <- session
+		if err != nil {
+			c.JSON(http.StatusInsufficientStorage, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "there are no text files to start the session with", "skipped": skipped})
+		}
+		return nil, nil, nil, false
+	}
+	h.schedulePersist(session.ID)
+	time.AfterFunc(seededSessionWait, func() {
+		h.expire <- session
+	})
+	if skipped == nil {
+		skipped = []string{}
+	}
+	return session, imported, skipped, true
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Thread subscription states. Subscribers are sent a thread's replies;
+// everyone else only hears that it got one, unless they muted it. Writing
+// in a thread subscribes to it, unless a state was chosen already.
+const (
+	ThreadSubscribed   = "subscribed"
+	ThreadUnsubscribed = "unsubscribed"
+	ThreadMuted        = "muted"
+)
+
+// ChatThread is a message with the replies to it, each with theirs, for
+// "chat-thread". Message is nil for the start of a thread that is no
+// longer in the recent chat.
+type ChatThread struct {
+	Message *ChatMessage  `json:"message"`
+	Replies []*ChatThread `json:"replies"`
+}
+
+// ThreadSubscription is a user's state for the thread started by the
+// message ThreadID
+type ThreadSubscription struct {
+	ThreadID string `json:"threadId"`
+	State    string `json:"state"`
+}
+
+// threadStateLocked is username's state for a thread, or empty if they
+// haven't got one. Caller must hold session.mu.
+func (s *Session) threadStateLocked(username, threadID string) string {
+	return s.threadSubs[username][threadID]
+}
+
+// setThreadStateLocked sets username's state for a thread. Caller must
+// hold session.mu for writing.
+func (s *Session) setThreadStateLocked(username, threadID, state string) {
+	if s.threadSubs[username] == nil {
+		s.threadSubs[username] = make(map[string]string)
+	}
+	s.threadSubs[username][threadID] = state
+}
+
+// subscribeLocked subscribes username to a thread they wrote in, unless
+// they chose a state for it. Caller must hold session.mu for writing.
+func (s *Session) subscribeLocked(username, threadID string) {
+	if s.threadStateLocked(username, threadID) == "" {
+		s.setThreadStateLocked(username, threadID, ThreadSubscribed)
+	}
+}
+
+// threadRepliedLocked counts a reply on the message that started its
+// thread and subscribes the authors of both. It returns that message, or
+// nil if it is no longer in the recent chat or msg isn't a reply. Caller
+// must hold session.mu for writing.
+func (s *Session) threadRepliedLocked(msg *ChatMessage) *ChatMessage {
+	if msg.ThreadID == "" {
+		return nil
+	}
+	s.subscribeLocked(msg.Username, msg.ThreadID)
+	root := s.chatMessageLocked(msg.ThreadID)
+	if root == nil {
+		return nil
+	}
+	root.Replies++
+	sentAt := msg.SentAt
+	root.LastReplyAt = &sentAt
+	s.subscribeLocked(root.Username, msg.ThreadID)
+	return root
+}
+
+// threadLocked builds the thread started by the message rootID from the
+// recent chat. Replies whose parent is gone hang off the start. Caller
+// must hold session.mu.
+func (s *Session) threadLocked(rootID string) *ChatThread {
+	root := &ChatThread{Message: s.chatMessageLocked(rootID), Replies: []*ChatThread{}}
+	nodes := map[string]*ChatThread{rootID: root}
+	for _, msg := range s.Chat {
+		if msg.ThreadID == rootID {
+			nodes[msg.ID] = &ChatThread{Message: msg, Replies: []*ChatThread{}}
+		}
+	}
+	for _, msg := range s.Chat {
+		if msg.ThreadID != rootID {
+			continue
+		}
+		parent, ok := nodes[msg.ParentID]
+		if !ok {
+			parent = root
+		}
+		parent.Replies = append(parent.Replies, nodes[msg.ID])
+	}
+	return root
+}
+
+// threadOf is the ID of the thread a message is in, or starts
+func threadOf(msg *ChatMessage) string {
+	if msg.ThreadID != "" {
+		return msg.ThreadID
+	}
+	return msg.ID
+}
+
+// sendThread sends c the thread a message is in
+func (h *Hub) sendThread(c *Client, messageID string) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	msg := session.chatMessageLocked(messageID)
+	var thread *ChatThread
+	if msg != nil {
+		thread = session.threadLocked(threadOf(msg))
+	}
+	session.mu.RUnlock()
+
+	if thread == nil {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: fmt.Sprintf("message not found: %s", messageID)})
+		return
+	}
+	h.sendToClient(c, OutgoingMessage{Type: "chat-thread", Thread: thread})
+}
+
+// setThreadSubscription sets c's user's state for the thread a message is
+// in, and sends their connections the states they now have
+func (h *Hub) setThreadSubscription(c *Client, messageID, state string) {
+	if state != ThreadSubscribed && state != ThreadUnsubscribed && state != ThreadMuted {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: fmt.Sprintf("invalid thread subscription: %q", state)})
+		return
+	}
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	msg := session.chatMessageLocked(messageID)
+	if msg == nil {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Error: fmt.Sprintf("message not found: %s", messageID)})
+		return
+	}
+	session.setThreadStateLocked(c.Username, threadOf(msg), state)
+	var clients []*Client
+	for _, client := range session.Clients {
+		if client.Username == c.Username {
+			clients = append(clients, client)
+		}
+	}
+	session.mu.Unlock()
+
+	for _, client := range clients {
+		h.sendThreadSubscriptions(client)
+	}
+}
+
+// sendThreadSubscriptions sends c its user's thread states, if they have
+// any, once it has said who it is
+func (h *Hub) sendThreadSubscriptions(c *Client) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	subs := make([]ThreadSubscription, 0, len(session.threadSubs[c.Username]))
+	for threadID, state := range session.threadSubs[c.Username] {
+		subs = append(subs, ThreadSubscription{ThreadID: threadID, State: state})
+	}
+	session.mu.RUnlock()
+	if len(subs) == 0 {
+		return
+	}
+
+	sort.Slice(subs, func(i, j int) bool { return subs[i].ThreadID < subs[j].ThreadID })
+	h.sendToClient(c, OutgoingMessage{Type: "thread-subscriptions", ThreadSubscriptions: subs})
+}
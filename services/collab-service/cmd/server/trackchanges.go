@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/ot"
+	"github.com/codecollab/collab-service/internal/textdiff"
+	"github.com/gin-gonic/gin"
+)
+
+// TrackedFile is a file with its open suggestions as tracked changes, in
+// CriticMarkup
+type TrackedFile struct {
+	Path   string `json:"path"`
+	Markup string `json:"markup"`
+	// Suggestions are the IDs of the suggestions marked up
+	Suggestions []string `json:"suggestions"`
+}
+
+// replacement is a suggestion as one change to its file's current content:
+// length runes from pos replaced by text
+type replacement struct {
+	suggestion *Suggestion
+	pos        int
+	length     int
+	text       string
+}
+
+// replacementOf is the span of content a suggestion changes, from the
+// first to the last rune it touches
+func replacementOf(content string, suggestion *Suggestion) (replacement, error) {
+	after, err := suggestion.op.Apply(content)
+	if err != nil {
+		return replacement{}, err
+	}
+	r := replacement{suggestion: suggestion}
+	for i, edit := range ot.FromDiff(content, after).Edits() {
+		if i == 0 {
+			r.pos = edit.Pos
+		}
+		if edit.Type == "delete" {
+			r.length = edit.Length
+		} else {
+			r.text = edit.Text
+		}
+	}
+	return r, nil
+}
+
+// criticMarkup marks content up with the suggestions to it, each followed
+// by a comment naming who made it. Suggestions overlapping an earlier one
+// can't be marked up alongside it and are left out; the IDs of those that
+// were marked up are returned.
+func criticMarkup(content string, suggestions []*Suggestion) (string, []string) {
+	var replacements []replacement
+	for _, suggestion := range suggestions {
+		if r, err := replacementOf(content, suggestion); err == nil {
+			replacements = append(replacements, r)
+		}
+	}
+	sort.SliceStable(replacements, func(i, j int) bool { return replacements[i].pos < replacements[j].pos })
+
+	runes := []rune(content)
+	var out strings.Builder
+	marked := []string{}
+	at := 0
+	for _, r := range replacements {
+		if r.pos < at {
+			continue
+		}
+		out.WriteString(string(runes[at:r.pos]))
+		deleted := string(runes[r.pos : r.pos+r.length])
+		switch {
+		case deleted != "" && r.text != "":
+			fmt.Fprintf(&out, "{~~%s~>%s~~}", deleted, r.text)
+		case deleted != "":
+			fmt.Fprintf(&out, "{--%s--}", deleted)
+		default:
+			fmt.Fprintf(&out, "{++%s++}", r.text)
+		}
+		fmt.Fprintf(&out, "{>>%s (%s)<<}", r.suggestion.Username, r.suggestion.ID)
+		at = r.pos + r.length
+		marked = append(marked, r.suggestion.ID)
+	}
+	out.WriteString(string(runes[at:]))
+	return out.String(), marked
+}
+
+// suggestionPatches is the open suggestions as a patch series of one patch
+// per author, in the order they first suggested something, that git am can
+// apply. Each patch applies on top of the ones before it, so authors who
+// suggested changes to the same lines get a patch that conflicts, as they
+// would in review.
+func suggestionPatches(contents map[string]string, suggestions []*Suggestion) (string, error) {
+	var authors []string
+	byAuthor := make(map[string][]*Suggestion)
+	for _, suggestion := range suggestions {
+		if byAuthor[suggestion.Username] == nil {
+			authors = append(authors, suggestion.Username)
+		}
+		byAuthor[suggestion.Username] = append(byAuthor[suggestion.Username], suggestion)
+	}
+
+	// applied is, by path, what the patches so far changed
+	applied := make(map[string]ot.Operation)
+	var out strings.Builder
+	for n, author := range authors {
+		ops := make(map[string]ot.Operation)
+		var ids, paths []string
+		for _, suggestion := range byAuthor[author] {
+			ids = append(ids, suggestion.ID)
+			op, ok := ops[suggestion.Path]
+			if !ok {
+				paths = append(paths, suggestion.Path)
+				ops[suggestion.Path] = suggestion.op
+				continue
+			}
+			// Each suggestion was made against the file without the others
+			_, next, err := ot.Transform(op, suggestion.op)
+			if err == nil {
+				op, err = ot.Compose(op, next)
+			}
+			if err != nil {
+				return "", err
+			}
+			ops[suggestion.Path] = op
+		}
+		sort.Strings(paths)
+
+		var diff strings.Builder
+		for _, filePath := range paths {
+			op, before := ops[filePath], contents[filePath]
+			if previous, ok := applied[filePath]; ok {
+				var err error
+				if _, op, err = ot.Transform(previous, op); err != nil {
+					return "", err
+				}
+				if before, err = previous.Apply(before); err != nil {
+					return "", err
+				}
+				if applied[filePath], err = ot.Compose(previous, op); err != nil {
+					return "", err
+				}
+			} else {
+				applied[filePath] = op
+			}
+			after, err := op.Apply(before)
+			if err != nil {
+				return "", err
+			}
+			if patch := textdiff.Unified("a/"+filePath, "b/"+filePath, before, after); patch != "" {
+				fmt.Fprintf(&diff, "diff --git a/%s b/%s\n%s", filePath, filePath, patch)
+			}
+		}
+
+		first := byAuthor[author][0]
+		fmt.Fprintf(&out, "From 0000000000000000000000000000000000000000 Mon Sep 17 00:00:00 2001\n")
+		fmt.Fprintf(&out, "From: %s <%s>\n", author, author)
+		fmt.Fprintf(&out, "Date: %s\n", first.CreatedAt.Format(time.RFC1123Z))
+		fmt.Fprintf(&out, "Subject: [PATCH %d/%d] Suggestions by %s\n\n", n+1, len(authors), author)
+		fmt.Fprintf(&out, "Suggestions %s.\n---\n%s-- \n\n", strings.Join(ids, ", "), diff.String())
+	}
+	return out.String(), nil
+}
+
+// handleExportSuggestions exports the session's open suggestions so their
+// review can go on in other tools: as the files marked up with tracked
+// changes in CriticMarkup, or with format=patch, as a patch series of one
+// patch per author. Suggestions too old to bring up to date are listed
+// rather than exported.
+func handleExportSuggestions(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := hub.ownerSession(c, "export suggestions")
+		if !ok {
+			return
+		}
+		format := c.DefaultQuery("format", "markup")
+		if format != "markup" && format != "patch" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "format must be markup or patch"})
+			return
+		}
+
+		session.mu.RLock()
+		suggestions, stale := session.currentSuggestionsLocked(RoleOwner)
+		contents := make(map[string]string)
+		for _, suggestion := range suggestions {
+			contents[suggestion.Path] = session.Files[suggestion.Path].Content
+		}
+		session.mu.RUnlock()
+
+		if format == "patch" {
+			series, err := suggestionPatches(contents, suggestions)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to export suggestions"})
+				return
+			}
+			if len(stale) > 0 {
+				c.Header("X-Stale-Suggestions", strings.Join(stale, ","))
+			}
+			c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-suggestions.patch"`, session.ID))
+			c.Data(http.StatusOK, "text/x-patch; charset=utf-8", []byte(series))
+			return
+		}
+
+		byPath := make(map[string][]*Suggestion)
+		for _, suggestion := range suggestions {
+			byPath[suggestion.Path] = append(byPath[suggestion.Path], suggestion)
+		}
+		paths := make([]string, 0, len(byPath))
+		for filePath := range byPath {
+			paths = append(paths, filePath)
+		}
+		sort.Strings(paths)
+
+		files := make([]TrackedFile, 0, len(paths))
+		exported := make(map[string]bool)
+		for _, filePath := range paths {
+			markup, marked := criticMarkup(contents[filePath], byPath[filePath])
+			files = append(files, TrackedFile{Path: filePath, Markup: markup, Suggestions: marked})
+			for _, id := range marked {
+				exported[id] = true
+			}
+		}
+		// Overlapping suggestions are left out of the markup
+		overlapping := []string{}
+		for _, suggestion := range suggestions {
+			if !exported[suggestion.ID] {
+				overlapping = append(overlapping, suggestion.ID)
+			}
+		}
+		if stale == nil {
+			stale = []string{}
+		}
+		c.JSON(http.StatusOK, gin.H{"files": files, "overlapping": overlapping, "stale": stale})
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import "time"
+
+// typingTimeout is how long a participant counts as typing after saying
+// so. Clients repeat "typing" while the user keeps at it; one that goes
+// quiet, or disconnects, stops typing when it runs out.
+const typingTimeout = 5 * time.Second
+
+// setTyping records whether c's user is typing a chat message and tells
+// the others when that changes. Renewals only push back the timeout, so
+// the indicator costs nothing while someone types.
+func (h *Hub) setTyping(c *Client, typing bool) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	if !typing {
+		session.stopTypingLocked(c)
+	} else if !session.typing[c.ID] {
+		session.typing[c.ID] = true
+		session.sendTypingLocked(c, true)
+	}
+	session.mu.Unlock()
+
+	if typing {
+		h.debounce(session, "typing:"+c.ID, typingTimeout, func() {
+			h.setTyping(c, false)
+		})
+	}
+}
+
+// stopTypingLocked records that c's user stopped typing, because they
+// sent their message, gave up or left. Caller must hold session.mu for
+// writing.
+func (s *Session) stopTypingLocked(c *Client) {
+	if s.typing[c.ID] {
+		delete(s.typing, c.ID)
+		s.sendTypingLocked(c, false)
+	}
+}
+
+// sendTypingLocked tells everyone but c, here and on the other instances,
+// whether c's user is typing. Caller must hold session.mu.
+func (s *Session) sendTypingLocked(c *Client, typing bool) {
+	outMsg := OutgoingMessage{Type: "typing", UserID: c.ID, Username: c.Username, Enabled: typing}
+	for _, client := range s.Clients {
+		if client.ID != c.ID {
+			sendLocked(client, outMsg)
+		}
+	}
+	if s.peers != nil {
+		s.peers.Publish(s.ID, peerTyping, outMsg)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/ot"
+)
+
+// maxUndoDepth bounds how many of their edits to a file a participant can
+// undo
+const maxUndoDepth = 100
+
+// undoEntry is the operation taking back an edit, as of the revision it
+// applies to, and when the edit was made. Later edits are transformed past
+// before it's applied, so only the edit itself is taken back and everyone
+// else's stay.
+type undoEntry struct {
+	op       ot.Operation
+	revision int
+	at       time.Time
+}
+
+// undoStacks is one participant's undo and redo history of a file, newest
+// last, and the name they made the edits under
+type undoStacks struct {
+	username string
+	undo     []undoEntry
+	redo     []undoEntry
+}
+
+func pushEntry(stack []undoEntry, entry undoEntry) []undoEntry {
+	stack = append(stack, entry)
+	if len(stack) > maxUndoDepth {
+		stack = append([]undoEntry(nil), stack[len(stack)-maxUndoDepth:]...)
+	}
+	return stack
+}
+
+// pushUndo keeps the inverse of op, just applied to before by username, in
+// the undo history of owner. A new edit can't be redone past, so redo is
+// cleared. Edits without an owner, from other instances, can't be undone
+// here. Caller must hold session.mu.
+func (f *File) pushUndo(owner, username string, op ot.Operation, before string) {
+	if owner == "" {
+		return
+	}
+	inverse, err := op.Invert(before)
+	if err != nil {
+		log.Printf("Failed to invert an edit of %s: %v", f.Path, err)
+		return
+	}
+	if f.undo == nil {
+		f.undo = make(map[string]*undoStacks)
+	}
+	stacks, ok := f.undo[owner]
+	if !ok {
+		stacks = &undoStacks{}
+		f.undo[owner] = stacks
+	}
+	stacks.username = username
+	stacks.undo = pushEntry(stacks.undo, undoEntry{op: inverse, revision: f.doc.Revision(), at: time.Now()})
+	stacks.redo = nil
+}
+
+// undo takes back c's latest edit of a file, or with redo set makes again
+// the latest edit undone, leaving what others changed since in place. The
+// result is a revision like any other, sent as an "operation" to everyone
+// who can see the file, the sender included. Edits others have already
+// taken out entirely are skipped.
+func (h *Hub) undo(c *Client, filePath string, redo bool) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	file, err := session.editableFileLocked(c, filePath)
+	var op ot.Operation
+	var content string
+	if err == nil {
+		op, content, err = file.popUndoLocked(c.identity(), redo)
+	}
+	if err == nil {
+		err = h.checkQuotaLocked(session, 0, len(content)-len(file.Content))
+	}
+	if err != nil {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Path: filePath, Error: err.Error()})
+		return
+	}
+
+	session.recordEditLocked(c.ID, c.Username, file, content)
+	h.watchEditLocked(session, c, file, content)
+	kind := auditUndo
+	if redo {
+		kind = auditRedo
+	}
+	h.recordChangeLocked(session, kind, c.ID, c.Username, file, content)
+	before := file.Content
+	file.commitOperation(op, content, c.Username)
+	if inverse, err := op.Invert(before); err == nil {
+		stacks := file.undo[c.identity()]
+		entry := undoEntry{op: inverse, revision: file.doc.Revision(), at: time.Now()}
+		if redo {
+			stacks.undo = pushEntry(stacks.undo, entry)
+		} else {
+			stacks.redo = pushEntry(stacks.redo, entry)
+		}
+	}
+	session.broadcastToReadersLocked("", file, OutgoingMessage{
+		Type:     "operation",
+		UserID:   c.ID,
+		Path:     file.Path,
+		Revision: file.doc.Revision(),
+		Ops:      op.Edits(),
+	})
+	session.mu.Unlock()
+
+	h.fileChanged(c.SessionID, file.Path)
+	h.scheduleSummaries(session)
+}
+
+// popUndoLocked takes the latest of owner's undo or redo entries that
+// still changes something and returns it transformed to apply to the
+// current content, with the content it makes. Caller must hold session.mu.
+func (f *File) popUndoLocked(owner string, redo bool) (ot.Operation, string, error) {
+	nothing, stale := errors.New("nothing to undo"), errors.New("that edit is too old to undo")
+	if redo {
+		nothing, stale = errors.New("nothing to redo"), errors.New("that edit is too old to redo")
+	}
+	stacks := f.undo[owner]
+	if stacks == nil {
+		return ot.Operation{}, "", nothing
+	}
+	stack := &stacks.undo
+	if redo {
+		stack = &stacks.redo
+	}
+
+	for len(*stack) > 0 {
+		entry := (*stack)[len(*stack)-1]
+		*stack = (*stack)[:len(*stack)-1]
+
+		op, err := f.doc.Transform(entry.revision, entry.op)
+		if errors.Is(err, ot.ErrStale) {
+			// Everything older is staler still
+			*stack = nil
+			return ot.Operation{}, "", stale
+		}
+		if err != nil {
+			return ot.Operation{}, "", err
+		}
+		if op.IsNoop() {
+			continue
+		}
+		content, err := op.Apply(f.Content)
+		if err != nil {
+			return ot.Operation{}, "", err
+		}
+		if content != f.Content {
+			return op, content, nil
+		}
+	}
+	return ot.Operation{}, "", nothing
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/codecollab/collab-service/internal/recording"
+	"github.com/gin-gonic/gin"
+)
+
+// handleUpload stores the request body as a workspace file, creating the
+// file if it doesn't exist yet. Binary content is kept in the blob store and
+// exposed as a downloadable asset instead of entering the text sync path.
+func handleUpload(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, exists := hub.getSession(c.Param("sessionId"))
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+			return
+		}
+
+		filePath, err := cleanFilePath(strings.TrimPrefix(c.Param("path"), "/"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		reader := io.Reader(c.Request.Body)
+		if limit := hub.config.MaxWorkspaceBytes; limit > 0 {
+			reader = io.LimitReader(reader, int64(limit)+1)
+		}
+		body, err := io.ReadAll(reader)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read upload"})
+			return
+		}
+
+		username := hub.requestUsername(c)
+
+		session.mu.Lock()
+		role := session.requestRoleLocked(username)
+		file, existed := session.Files[filePath]
+		status, err := http.StatusOK, error(nil)
+		switch {
+		case role == RoleViewer:
+			status, err = http.StatusForbidden, errors.New("uploads require an authenticated editor")
+		case existed && !file.visibleTo(role):
+			status, err = http.StatusNotFound, errors.New("file not found: "+filePath)
+		case existed && file.accessFor(role) != AccessWrite:
+			status, err = http.StatusForbidden, errors.New(filePath+" is read-only")
+		case session.writableLocked(role) != nil:
+			status, err = http.StatusForbidden, errSessionLocked
+		}
+		if err != nil {
+			session.mu.Unlock()
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+
+		contentType, binary := detectBinary(body)
+		content, warnings := "", []EditWarning(nil)
+		if !binary {
+			var ok bool
+			content, warnings, ok = normalizeEdit(session.Settings, string(body), utf8.Valid(body), hub.config.InvalidUTF8Policy)
+			if !ok {
+				session.mu.Unlock()
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "upload rejected", "warnings": warnings})
+				return
+			}
+		}
+		size := len(content)
+		if binary {
+			size = len(body)
+		}
+
+		previousSize, newFiles := 0, 1
+		if existed {
+			previousSize, newFiles = file.size(), 0
+		}
+		delta := size - previousSize
+		if delta < 0 {
+			delta = -delta
+		}
+		if role != RoleOwner && hub.config.LargeEditBytes > 0 && delta > hub.config.LargeEditBytes {
+			session.mu.Unlock()
+			c.JSON(http.StatusForbidden, gin.H{"error": "upload exceeds the large edit limit; ask the session owner to upload it"})
+			return
+		}
+		if err := hub.checkQuotaLocked(session, newFiles, size-previousSize); err != nil {
+			session.mu.Unlock()
+			c.JSON(http.StatusInsufficientStorage, gin.H{"error": err.Error()})
+			return
+		}
+
+		key := blobKey(session.ID, filePath)
+		if binary {
+			if err := hub.blobs.Put(key, body); err != nil {
+				session.mu.Unlock()
+				log.Printf("Failed to store blob for %s: %v", filePath, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store file"})
+				return
+			}
+		} else if existed && file.Binary {
+			if err := hub.blobs.Delete(file.BlobKey); err != nil {
+				log.Printf("Failed to delete blob %s: %v", file.BlobKey, err)
+			}
+		}
+
+		wasBinary := existed && file.Binary
+		if !existed {
+			file = newFile(filePath)
+			session.Files[filePath] = file
+		}
+		if binary {
+			file.Content, file.LineAuthors = "", nil
+			file.doc.Reset()
+			file.crdt, file.crdtPending = nil, nil
+		} else {
+			if !existed || wasBinary {
+				hub.auditLocked(session, auditCreate, "", username, filePath, nil)
+				hub.recordLocked(session, recording.Event{Kind: recording.Create, Path: filePath, Username: username})
+			}
+			hub.recordChangeLocked(session, auditUpload, "", username, file, content)
+			file.setContent(content, username)
+		}
+		file.Binary = binary
+		file.BlobKey, file.ContentType, file.BlobSize = "", "", 0
+		if binary {
+			file.BlobKey, file.ContentType, file.BlobSize = key, contentType, len(body)
+		}
+		file.UpdatedAt = time.Now()
+		revision := file.doc.Revision()
+		session.mu.Unlock()
+
+		log.Printf("Uploaded %d bytes to %s in session %s (binary=%t)", size, filePath, session.ID, binary)
+		if !existed || binary || wasBinary {
+			hub.broadcastFileTree(session.ID)
+		}
+		if !binary {
+			hub.fileChanged(session.ID, filePath)
+			hub.broadcastToReaders(session.ID, "", filePath, OutgoingMessage{
+				Type:     "code-update",
+				Username: username,
+				Path:     filePath,
+				Code:     content,
+				Revision: revision,
+			})
+		}
+
+		status = http.StatusOK
+		if !existed {
+			status = http.StatusCreated
+		}
+		response := gin.H{"path": filePath, "size": size, "binary": binary, "warnings": warnings}
+		if binary {
+			response["downloadUrl"] = assetURL(session.ID, filePath)
+		}
+		c.JSON(status, response)
+	}
+}
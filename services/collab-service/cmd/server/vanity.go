@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/listquery"
+	"github.com/codecollab/collab-service/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+// slugPattern is what a slug may look like: 3 to 48 lowercase letters,
+// digits and inner hyphens, so it reads well in a URL
+var slugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,46}[a-z0-9]$`)
+
+// VanitySlug is a stable name an organization gave one of its sessions,
+// such as a standup room, which /s/<slug> resolves for its members
+type VanitySlug struct {
+	Slug      string    `json:"slug"`
+	SessionID string    `json:"sessionId"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func vanitySlug(slug *store.Slug) VanitySlug {
+	return VanitySlug{Slug: slug.Slug, SessionID: slug.SessionID, CreatedBy: slug.CreatedBy, CreatedAt: slug.CreatedAt}
+}
+
+// slugKey is where an organization's slug is in h.slugs
+func slugKey(org, name string) string {
+	return org + "/" + name
+}
+
+// newSlugSessionID makes up the ID of a session for a new slug
+func newSlugSessionID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// reserveSlug keeps a slug in the store, or here if there is none, unless
+// the organization already has it
+func (h *Hub) reserveSlug(ctx context.Context, slug *store.Slug) error {
+	if h.store != nil {
+		return h.store.ReserveSlug(ctx, slug)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := slugKey(slug.Org, slug.Slug)
+	if _, taken := h.slugs[key]; taken {
+		return store.ErrSlugTaken
+	}
+	h.slugs[key] = slug
+	return nil
+}
+
+// lookupSlug finds an organization's slug
+func (h *Hub) lookupSlug(ctx context.Context, org, name string) (*store.Slug, error) {
+	if h.store != nil {
+		return h.store.Slug(ctx, org, name)
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	slug, ok := h.slugs[slugKey(org, name)]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	return slug, nil
+}
+
+// listSlugs returns an organization's slugs, by name
+func (h *Hub) listSlugs(ctx context.Context, org string) ([]*store.Slug, error) {
+	if h.store != nil {
+		return h.store.Slugs(ctx, org)
+	}
+	h.mu.RLock()
+	var slugs []*store.Slug
+	for _, slug := range h.slugs {
+		if slug.Org == org {
+			slugs = append(slugs, slug)
+		}
+	}
+	h.mu.RUnlock()
+	sort.Slice(slugs, func(i, j int) bool { return slugs[i].Slug < slugs[j].Slug })
+	return slugs, nil
+}
+
+// releaseSlug frees an organization's slug
+func (h *Hub) releaseSlug(ctx context.Context, org, name string) error {
+	if h.store != nil {
+		return h.store.ReleaseSlug(ctx, org, name)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := slugKey(org, name)
+	if _, ok := h.slugs[key]; !ok {
+		return store.ErrNotFound
+	}
+	delete(h.slugs, key)
+	return nil
+}
+
+// slugCaller returns the verified token of a caller in an organization,
+// and if admin is set one of its admins, or responds 401 or 403
+func (h *Hub) slugCaller(c *gin.Context, admin bool) (*tokenClaims, bool) {
+	claims := h.requestClaims(c)
+	if claims == nil || claims.Org == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "a valid token with an organization is required"})
+		return nil, false
+	}
+	if admin && !claims.orgAdmin() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only organization admins can manage slugs"})
+		return nil, false
+	}
+	return claims, true
+}
+
+// handleResolveSlug resolves one of the caller's organization's slugs to
+// the session it is for
+func handleResolveSlug(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := hub.slugCaller(c, false)
+		if !ok {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+		defer cancel()
+		slug, err := hub.lookupSlug(ctx, claims.Org, strings.ToLower(c.Param("slug")))
+		if errors.Is(err, store.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "unknown slug"})
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to resolve slug %s of %s: %v", c.Param("slug"), claims.Org, err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "slugs are unavailable"})
+			return
+		}
+		c.JSON(http.StatusOK, vanitySlug(slug))
+	}
+}
+
+// slugListSpec is how an organization's slugs can be listed
+var slugListSpec = listquery.Spec{
+	Sorts:   []string{"slug", "-slug", "-created", "created"},
+	Filters: []listquery.Filter{listquery.Owner, listquery.Since, listquery.Until},
+}
+
+// handleListSlugs returns the caller's organization's slugs, by name
+// unless sort says otherwise and a page at a time. owner picks those one
+// admin reserved.
+func handleListSlugs(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := hub.slugCaller(c, false)
+		if !ok {
+			return
+		}
+		q, ok := listQuery(c, slugListSpec)
+		if !ok {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+		defer cancel()
+		slugs, err := hub.listSlugs(ctx, claims.Org)
+		if err != nil {
+			log.Printf("Failed to list the slugs of %s: %v", claims.Org, err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "slugs are unavailable"})
+			return
+		}
+		var entries []VanitySlug
+		for _, slug := range slugs {
+			if (q.Owner == "" || slug.CreatedBy == q.Owner) && q.During(slug.CreatedAt) {
+				entries = append(entries, vanitySlug(slug))
+			}
+		}
+		page, next := listquery.Page(entries, q, func(slug VanitySlug, field string) string {
+			if field == "created" {
+				return listquery.TimeKey(slug.CreatedAt)
+			}
+			return slug.Slug
+		}, func(slug VanitySlug) string { return slug.Slug })
+		listPage(c, "slugs", page, next)
+	}
+}
+
+// handleReserveSlug gives a session of the admin's organization a slug.
+// Without a session ID the slug gets a new session; sessions are kept, so
+// it's the same one every time, when the service has a database.
+func handleReserveSlug(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := hub.slugCaller(c, true)
+		if !ok {
+			return
+		}
+
+		var req struct {
+			Slug      string `json:"slug"`
+			SessionID string `json:"sessionId"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+		if !slugPattern.MatchString(req.Slug) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "slugs are 3 to 48 lowercase letters, digits and hyphens, starting and ending with a letter or digit"})
+			return
+		}
+		if req.SessionID == "" {
+			req.SessionID = newSlugSessionID()
+		} else if isLobby(req.SessionID) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "lobbies can't have slugs"})
+			return
+		} else if session, exists := hub.getSession(req.SessionID); exists {
+			session.mu.RLock()
+			org := session.Org
+			session.mu.RUnlock()
+			if org != "" && org != claims.Org {
+				c.JSON(http.StatusForbidden, gin.H{"error": "the session belongs to another organization"})
+				return
+			}
+		}
+
+		slug := &store.Slug{
+			Org:       claims.Org,
+			Slug:      req.Slug,
+			SessionID: req.SessionID,
+			CreatedBy: claims.Subject,
+			CreatedAt: time.Now().UTC(),
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+		defer cancel()
+		err := hub.reserveSlug(ctx, slug)
+		if errors.Is(err, store.ErrSlugTaken) {
+			c.JSON(http.StatusConflict, gin.H{"error": "slug already taken"})
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to reserve slug %s of %s: %v", req.Slug, claims.Org, err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "slugs are unavailable"})
+			return
+		}
+		log.Printf("%s reserved slug %s of %s for session %s", claims.Subject, slug.Slug, slug.Org, slug.SessionID)
+		c.JSON(http.StatusCreated, vanitySlug(slug))
+	}
+}
+
+// handleReleaseSlug frees one of the admin's organization's slugs. The
+// session it named stays as it is.
+func handleReleaseSlug(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := hub.slugCaller(c, true)
+		if !ok {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), persistTimeout)
+		defer cancel()
+		err := hub.releaseSlug(ctx, claims.Org, c.Param("slug"))
+		if errors.Is(err, store.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "unknown slug"})
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to release slug %s of %s: %v", c.Param("slug"), claims.Org, err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "slugs are unavailable"})
+			return
+		}
+		log.Printf("%s released slug %s of %s", claims.Subject, c.Param("slug"), claims.Org)
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/crdt"
+	"github.com/codecollab/collab-service/internal/ot"
+	"github.com/codecollab/collab-service/internal/recording"
+)
+
+// defaultFilePath is the document edited by clients that don't send a path
+const defaultFilePath = "main"
+
+// Role determines what a participant may do in a session
+type Role string
+
+const (
+	RoleOwner  Role = "owner"
+	RoleEditor Role = "editor"
+	RoleViewer Role = "viewer"
+)
+
+// FileAccess is the access level a role has on a single file
+type FileAccess string
+
+const (
+	// AccessHidden removes the file from everything the role can see
+	AccessHidden FileAccess = "hidden"
+	AccessRead   FileAccess = "read"
+	AccessWrite  FileAccess = "write"
+)
+
+// File is a single document in a session workspace
+type File struct {
+	Path    string
+	Content string
+	// Access overrides the default access level per role. The owner always
+	// has write access.
+	Access    map[Role]FileAccess
+	UpdatedAt time.Time
+	// LineAuthors holds the username that last changed each line
+	LineAuthors []string
+	// doc counts the file's revisions and keeps the operations behind the
+	// recent ones, so concurrent operations can be transformed
+	doc ot.History
+	// version is the newest version of the file among those sent between
+	// instances that the content reflects
+	version int64
+	// crdt is the file's CRDT in a CRDT session, with the changes made to
+	// it for edits of other kinds waiting in crdtPending to be broadcast
+	crdt        *crdt.Doc
+	crdtPending []crdt.Update
+	// undo holds each participant's own edits, by identity, so they can
+	// take them back
+	undo map[string]*undoStacks
+
+	// Binary files keep their bytes in the blob store instead of Content
+	Binary      bool
+	BlobKey     string
+	ContentType string
+	BlobSize    int
+}
+
+// FileEntry describes a file in a "file-tree" message
+type FileEntry struct {
+	Path   string     `json:"path"`
+	Size   int        `json:"size"`
+	Access FileAccess `json:"access"`
+	// Binary files can't be opened as text and are fetched from DownloadURL
+	Binary      bool   `json:"binary,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	DownloadURL string `json:"downloadUrl,omitempty"`
+	// Permissions is only included for the owner so they can manage it
+	Permissions map[Role]FileAccess `json:"permissions,omitempty"`
+}
+
+func newFile(filePath string) *File {
+	return &File{
+		Path:      filePath,
+		Access:    make(map[Role]FileAccess),
+		UpdatedAt: time.Now(),
+	}
+}
+
+func defaultAccess(role Role) FileAccess {
+	if role == RoleViewer {
+		return AccessRead
+	}
+	return AccessWrite
+}
+
+func (f *File) accessFor(role Role) FileAccess {
+	if role == RoleOwner {
+		return AccessWrite
+	}
+	if access, ok := f.Access[role]; ok {
+		return access
+	}
+	return defaultAccess(role)
+}
+
+// size returns the number of bytes the file occupies in the workspace
+func (f *File) size() int {
+	if f.Binary {
+		return f.BlobSize
+	}
+	return len(f.Content)
+}
+
+func (f *File) visibleTo(role Role) bool {
+	return f.accessFor(role) != AccessHidden
+}
+
+// cleanFilePath validates a client-supplied path and returns its canonical
+// form. An empty path refers to the default file.
+func cleanFilePath(filePath string) (string, error) {
+	if filePath == "" {
+		return defaultFilePath, nil
+	}
+	if strings.Contains(filePath, "\\") {
+		return "", fmt.Errorf("path must use forward slashes")
+	}
+	cleaned := path.Clean("/" + filePath)[1:]
+	if cleaned == "" || cleaned != strings.TrimPrefix(filePath, "/") {
+		return "", fmt.Errorf("invalid path: %q", filePath)
+	}
+	return cleaned, nil
+}
+
+// roleLocked returns the role of c in the session. Only a client that
+// joined with a verified token for the owner is the owner; a name alone
+// never makes one, and those who joined through a viewer link stay
+// viewers. Caller must hold session.mu.
+func (s *Session) roleLocked(c *Client) Role {
+	if s.Owner != "" && c.token != nil && c.token.Subject == s.Owner && c.Role != RoleViewer {
+		return RoleOwner
+	}
+	return c.Role
+}
+
+// fileLocked looks up a file by client-supplied path. Caller must hold
+// session.mu.
+func (s *Session) fileLocked(filePath string) (*File, error) {
+	cleaned, err := cleanFilePath(filePath)
+	if err != nil {
+		return nil, err
+	}
+	file, ok := s.Files[cleaned]
+	if !ok {
+		return nil, fmt.Errorf("file not found: %s", cleaned)
+	}
+	return file, nil
+}
+
+// editableFileLocked looks up a text file c may write to. Caller must hold
+// session.mu.
+func (s *Session) editableFileLocked(c *Client, filePath string) (*File, error) {
+	role := s.roleLocked(c)
+	file, err := s.visibleFileLocked(filePath, role)
+	if err != nil {
+		return nil, err
+	}
+	if file.accessFor(role) != AccessWrite {
+		return nil, fmt.Errorf("%s is read-only", file.Path)
+	}
+	if err := s.writableLocked(role); err != nil {
+		return nil, err
+	}
+	if file.Binary {
+		return nil, fmt.Errorf("%s is a binary file and cannot be edited", file.Path)
+	}
+	return file, nil
+}
+
+// visibleFileLocked looks up a file the role may see. Hidden files are
+// reported as missing so their existence doesn't leak. Caller must hold
+// session.mu.
+func (s *Session) visibleFileLocked(filePath string, role Role) (*File, error) {
+	file, err := s.fileLocked(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if !file.visibleTo(role) {
+		return nil, fmt.Errorf("file not found: %s", file.Path)
+	}
+	return file, nil
+}
+
+// fileTreeLocked lists the workspace as seen by role, leaving out hidden
+// files. Caller must hold session.mu.
+func (s *Session) fileTreeLocked(role Role) []FileEntry {
+	entries := make([]FileEntry, 0, len(s.Files))
+	for _, file := range s.Files {
+		if !file.visibleTo(role) {
+			continue
+		}
+		entry := FileEntry{
+			Path:   file.Path,
+			Size:   file.size(),
+			Access: file.accessFor(role),
+		}
+		if file.Binary {
+			entry.Binary = true
+			entry.ContentType = file.ContentType
+			entry.DownloadURL = assetURL(s.ID, file.Path)
+		}
+		if role == RoleOwner {
+			entry.Permissions = make(map[Role]FileAccess, len(file.Access))
+			for r, access := range file.Access {
+				entry.Permissions[r] = access
+			}
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries
+}
+
+func (h *Hub) sendFileTree(c *Client) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	files := session.fileTreeLocked(session.roleLocked(c))
+	session.mu.RUnlock()
+
+	h.sendToClient(c, OutgoingMessage{Type: "file-tree", Files: files})
+}
+
+// broadcastToReaders delivers a message about a file to every client other
+// than excludeID that is allowed to see that file
+func (h *Hub) broadcastToReaders(sessionID, excludeID, filePath string, outMsg OutgoingMessage) {
+	session, exists := h.getSession(sessionID)
+	if !exists {
+		return
+	}
+
+	msgBytes, err := json.Marshal(outMsg)
+	if err != nil {
+		log.Printf("Error marshaling %s: %v", outMsg.Type, err)
+		return
+	}
+
+	session.mu.RLock()
+	file := session.Files[filePath]
+	for _, client := range session.Clients {
+		if client.ID == excludeID || file == nil || !file.visibleTo(session.roleLocked(client)) {
+			continue
+		}
+		client.deliver(msgBytes)
+	}
+	session.mu.RUnlock()
+}
+
+// broadcastFileTree sends every client the file tree as seen by its role.
+// The tree changed, so the session is saved.
+func (h *Hub) broadcastFileTree(sessionID string) {
+	session, exists := h.getSession(sessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	clients := make([]*Client, 0, len(session.Clients))
+	for _, client := range session.Clients {
+		clients = append(clients, client)
+	}
+	session.mu.RUnlock()
+
+	for _, client := range clients {
+		h.sendFileTree(client)
+	}
+	h.schedulePersist(sessionID)
+}
+
+// sendDocuments sends a newly connected client the content of each text
+// file it can read, with its revision and language, so its editor isn't
+// empty until someone types
+func (h *Hub) sendDocuments(c *Client) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	role := session.roleLocked(c)
+	var docs []OutgoingMessage
+	for _, file := range session.Files {
+		if file.Binary || !file.visibleTo(role) {
+			continue
+		}
+		docs = append(docs, h.documentSyncLocked(session, file, role))
+	}
+	session.mu.Unlock()
+
+	sort.Slice(docs, func(i, j int) bool { return docs[i].Path < docs[j].Path })
+	for _, doc := range docs {
+		h.sendDocument(c, doc)
+	}
+}
+
+// documentSyncLocked is the document-sync of a text file for a client
+// with role. Caller must hold session.mu for writing.
+func (h *Hub) documentSyncLocked(session *Session, file *File, role Role) OutgoingMessage {
+	return OutgoingMessage{
+		Type:     "document-sync",
+		Path:     file.Path,
+		Code:     file.Content,
+		Revision: file.doc.Revision(),
+		Language: h.fileLanguageLocked(session, file.Path),
+		Access:   file.accessFor(role),
+	}
+}
+
+// openFile sends the content of a file the client is allowed to read
+func (h *Hub) openFile(c *Client, filePath string) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.RLock()
+	role := session.roleLocked(c)
+	file, err := session.visibleFileLocked(filePath, role)
+	var outMsg OutgoingMessage
+	var opened File
+	var synced bool
+	if err == nil {
+		opened = *file
+		synced = session.SyncMode == SyncCRDT && !file.Binary
+		outMsg = OutgoingMessage{
+			Type:     "file-opened",
+			Path:     file.Path,
+			Code:     file.Content,
+			Revision: file.doc.Revision(),
+			Access:   file.accessFor(role),
+		}
+		if file.Binary {
+			outMsg.Binary = true
+			outMsg.DownloadURL = assetURL(session.ID, file.Path)
+		}
+	}
+	session.mu.RUnlock()
+
+	if err != nil {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Path: filePath, Error: err.Error()})
+		return
+	}
+	h.sendDocument(c, outMsg)
+	h.sendOutline(c, &opened)
+	h.sendLint(c, &opened)
+	h.sendPreview(c, &opened)
+	h.sendCells(c, &opened)
+	if c.Highlight {
+		h.sendHighlights(c, &opened)
+	}
+	if synced {
+		h.sendCRDTState(c, opened.Path, nil)
+	}
+}
+
+// createFile adds an empty file to the workspace
+func (h *Hub) createFile(c *Client, filePath string) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	cleaned, err := cleanFilePath(filePath)
+	if err != nil {
+		h.sendToClient(c, OutgoingMessage{Type: "error", Path: filePath, Error: err.Error()})
+		return
+	}
+
+	session.mu.Lock()
+	if session.roleLocked(c) == RoleViewer {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Path: cleaned, Error: "viewers cannot create files"})
+		return
+	}
+	if err := session.writableLocked(session.roleLocked(c)); err != nil {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Path: cleaned, Error: err.Error()})
+		return
+	}
+	if _, ok := session.Files[cleaned]; ok {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Path: cleaned, Error: "file already exists"})
+		return
+	}
+	if err := h.checkQuotaLocked(session, 1, 0); err != nil {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Path: cleaned, Error: err.Error()})
+		return
+	}
+	session.Files[cleaned] = newFile(cleaned)
+	h.auditLocked(session, auditCreate, c.ID, c.Username, cleaned, nil)
+	h.recordLocked(session, recording.Event{Kind: recording.Create, Path: cleaned, UserID: c.ID, Username: c.Username})
+	session.recordActivityLocked(&activity{userID: c.ID, username: c.Username, path: cleaned, kind: "created"})
+	session.mu.Unlock()
+
+	log.Printf("Client %s created %s in session %s", c.ID, cleaned, c.SessionID)
+	h.broadcastFileTree(c.SessionID)
+	h.publishFile(c.SessionID, cleaned)
+	h.scheduleSummaries(session)
+}
+
+// setFilePermissions replaces the per-role access overrides of a file
+func (h *Hub) setFilePermissions(c *Client, filePath string, permissions map[Role]FileAccess) {
+	session, exists := h.getSession(c.SessionID)
+	if !exists {
+		return
+	}
+
+	for role, access := range permissions {
+		if role != RoleEditor && role != RoleViewer {
+			h.sendToClient(c, OutgoingMessage{Type: "error", Path: filePath, Error: fmt.Sprintf("cannot set permissions for role %q", role)})
+			return
+		}
+		if access != AccessHidden && access != AccessRead && access != AccessWrite {
+			h.sendToClient(c, OutgoingMessage{Type: "error", Path: filePath, Error: fmt.Sprintf("unknown access level %q", access)})
+			return
+		}
+	}
+
+	session.mu.Lock()
+	if session.roleLocked(c) != RoleOwner {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Path: filePath, Error: "only the session owner can change file permissions"})
+		return
+	}
+	file, err := session.fileLocked(filePath)
+	if err != nil {
+		session.mu.Unlock()
+		h.sendToClient(c, OutgoingMessage{Type: "error", Path: filePath, Error: err.Error()})
+		return
+	}
+	file.Access = make(map[Role]FileAccess, len(permissions))
+	for role, access := range permissions {
+		file.Access[role] = access
+	}
+	session.mu.Unlock()
+
+	log.Printf("Session %s: permissions for %s updated by %s", c.SessionID, file.Path, c.ID)
+	h.broadcastFileTree(c.SessionID)
+}
@@ -0,0 +1,368 @@
+// Package backplane connects the instances of the collab service through
+// Redis pub/sub, so a session whose participants landed on different
+// instances behind a load balancer is still one session.
+//
+// Each session has a channel, which an instance subscribes to while it has
+// the session open. What goes over it is up to the caller; the backplane
+// only numbers the latest-state messages, such as a file's content, so
+// every instance agrees on which one is newest. The sessions' room codes
+// are kept in Redis too, so any instance can resolve them, and so is what
+// the instances cache for the REST list endpoints and the region each
+// session is homed in.
+package backplane
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/breaker"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	channelPrefix = "codecollab:session:"
+	versionPrefix = "codecollab:versions:"
+	// versionTTL is how long a session's version counters outlive its last
+	// change
+	versionTTL = 24 * time.Hour
+	// queueSize bounds the messages waiting to be published
+	queueSize = 1024
+	// publishTimeout bounds each round trip to Redis
+	publishTimeout = 5 * time.Second
+)
+
+// Envelope is a message between instances about a session. Node is the
+// instance that sent it; Version is set on messages sent with
+// PublishLatest.
+type Envelope struct {
+	Node    string          `json:"node"`
+	Session string          `json:"session"`
+	Kind    string          `json:"kind"`
+	Version int64           `json:"version,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// Backplane is this instance's connection to the others. Calls to Redis
+// go through a circuit breaker: while it is down, what would be sent is
+// dropped and the rest fails with breaker.ErrOpen, so the instance serves
+// its sessions on its own.
+type Backplane struct {
+	client  *redis.Client
+	pubsub  *redis.PubSub
+	node    string
+	breaker *breaker.Breaker
+	// queue holds the sends and subscription changes still to be made, in
+	// the order they were asked for
+	queue chan func(ctx context.Context) error
+}
+
+// Open connects to the Redis server at url, a redis:// URL. guard is the
+// breaker calls go through.
+func Open(ctx context.Context, url string, guard *breaker.Breaker) (*Backplane, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(options)
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	id := make([]byte, 4)
+	rand.Read(id)
+	b := &Backplane{
+		client:  client,
+		pubsub:  client.Subscribe(ctx),
+		node:    hex.EncodeToString(id),
+		breaker: guard,
+		queue:   make(chan func(ctx context.Context) error, queueSize),
+	}
+	go b.work()
+	return b, nil
+}
+
+// Down reports whether Redis is thought to be down, so that nothing is
+// sent to the other instances
+func (b *Backplane) Down() bool {
+	return b.breaker.Open()
+}
+
+// Ping checks that Redis can be reached
+func (b *Backplane) Ping(ctx context.Context) error {
+	return b.breaker.Do(func() error {
+		return b.client.Ping(ctx).Err()
+	})
+}
+
+// Node identifies this instance to the others
+func (b *Backplane) Node() string {
+	return b.node
+}
+
+func (b *Backplane) Close() error {
+	b.pubsub.Close()
+	return b.client.Close()
+}
+
+// work runs the queue. Jobs are dropped while the breaker is open.
+func (b *Backplane) work() {
+	for job := range b.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+		b.breaker.Do(func() error { return job(ctx) })
+		cancel()
+	}
+}
+
+// enqueue adds a job to the queue. A full queue means Redis can't keep up
+// or is down, and the job is dropped rather than holding up the session.
+func (b *Backplane) enqueue(what string, job func(ctx context.Context) error) {
+	select {
+	case b.queue <- job:
+	default:
+		log.Printf("backplane: queue full, dropping %s", what)
+	}
+}
+
+// Join subscribes to a session's messages
+func (b *Backplane) Join(session string) {
+	b.enqueue("subscription to "+session, func(ctx context.Context) error {
+		err := b.pubsub.Subscribe(ctx, channelPrefix+session)
+		if err != nil {
+			log.Printf("backplane: subscribing to session %s: %v", session, err)
+		}
+		return err
+	})
+}
+
+// Leave unsubscribes from a session's messages, after what was published
+// for it before
+func (b *Backplane) Leave(session string) {
+	b.enqueue("unsubscription from "+session, func(ctx context.Context) error {
+		err := b.pubsub.Unsubscribe(ctx, channelPrefix+session)
+		if err != nil {
+			log.Printf("backplane: unsubscribing from session %s: %v", session, err)
+		}
+		return err
+	})
+}
+
+// Publish sends data, marshaled to JSON, to the other instances with the
+// session open. Messages are sent in the background, in order.
+func (b *Backplane) Publish(session, kind string, data any) {
+	b.enqueue(kind+" for "+session, func(ctx context.Context) error {
+		return b.publish(ctx, Envelope{Session: session, Kind: kind}, data)
+	})
+}
+
+// PublishLatest is Publish for the latest state of something in the
+// session, such as a file, under key. The message gets the next version in
+// a sequence per session and key that all instances share; data is only
+// called with it when the message is sent, so what it returns is what is
+// current then, and whatever has the highest version is the newest. The
+// message isn't sent if data returns false.
+func (b *Backplane) PublishLatest(session, key, kind string, data func(version int64) (any, bool)) {
+	b.enqueue(kind+" for "+session, func(ctx context.Context) error {
+		pipe := b.client.TxPipeline()
+		incr := pipe.HIncrBy(ctx, versionPrefix+session, key, 1)
+		pipe.Expire(ctx, versionPrefix+session, versionTTL)
+		if _, err := pipe.Exec(ctx); err != nil {
+			log.Printf("backplane: numbering %s for %s: %v", kind, session, err)
+			return err
+		}
+		version := incr.Val()
+		if payload, ok := data(version); ok {
+			return b.publish(ctx, Envelope{Session: session, Kind: kind, Version: version}, payload)
+		}
+		return nil
+	})
+}
+
+// publish sends a message, returning an error only if Redis failed
+func (b *Backplane) publish(ctx context.Context, env Envelope, data any) error {
+	env.Node = b.node
+	if data != nil {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			log.Printf("backplane: marshaling %s: %v", env.Kind, err)
+			return nil
+		}
+		env.Data = raw
+	}
+	msg, err := json.Marshal(env)
+	if err != nil {
+		log.Printf("backplane: marshaling %s: %v", env.Kind, err)
+		return nil
+	}
+	if err := b.client.Publish(ctx, channelPrefix+env.Session, msg).Err(); err != nil {
+		log.Printf("backplane: publishing %s for %s: %v", env.Kind, env.Session, err)
+		return err
+	}
+	return nil
+}
+
+// Receive calls handle with each message of the sessions joined, in the
+// order Redis delivered them, until the backplane is closed. This
+// instance's own messages are left out.
+func (b *Backplane) Receive(handle func(Envelope)) {
+	for msg := range b.pubsub.Channel() {
+		var env Envelope
+		if err := json.Unmarshal([]byte(msg.Payload), &env); err != nil {
+			log.Printf("backplane: invalid message on %s: %v", msg.Channel, err)
+			continue
+		}
+		if env.Node != b.node {
+			handle(env)
+		}
+	}
+}
+
+// String describes the backplane for logs
+func (b *Backplane) String() string {
+	return fmt.Sprintf("instance %s on %s", b.node, b.client.Options().Addr)
+}
+
+const (
+	codePrefix   = "codecollab:code:"
+	codeOfPrefix = "codecollab:code-of:"
+	// codeTTL is how long a room code outlives the last time its session
+	// was opened
+	codeTTL = 7 * 24 * time.Hour
+	// codeAttempts bounds the candidates tried for a free room code
+	codeAttempts = 20
+)
+
+// ErrNoCode is returned by RoomCode when no candidate was free
+var ErrNoCode = errors.New("no free room code")
+
+// RoomCode returns the room code of a session, the same on every instance.
+// A session without one gets the first free code candidate comes up with.
+func (b *Backplane) RoomCode(ctx context.Context, session string, candidate func() string) (string, error) {
+	var code string
+	var found error
+	err := b.breaker.Do(func() error {
+		code, found = b.roomCode(ctx, session, candidate)
+		if errors.Is(found, ErrNoCode) {
+			return nil
+		}
+		return found
+	})
+	if err == nil {
+		err = found
+	}
+	return code, err
+}
+
+func (b *Backplane) roomCode(ctx context.Context, session string, candidate func() string) (string, error) {
+	code, err := b.client.Get(ctx, codeOfPrefix+session).Result()
+	if err == nil {
+		b.client.Expire(ctx, codeOfPrefix+session, codeTTL)
+		b.client.Expire(ctx, codePrefix+code, codeTTL)
+		return code, nil
+	}
+	if !errors.Is(err, redis.Nil) {
+		return "", err
+	}
+
+	for range codeAttempts {
+		code := candidate()
+		ok, err := b.client.SetNX(ctx, codePrefix+code, session, codeTTL).Result()
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			continue
+		}
+		// Another instance may have named the session meanwhile; theirs wins
+		won, err := b.client.SetNX(ctx, codeOfPrefix+session, code, codeTTL).Result()
+		if err != nil {
+			return "", err
+		}
+		if won {
+			return code, nil
+		}
+		b.client.Del(ctx, codePrefix+code)
+		return b.roomCode(ctx, session, candidate)
+	}
+	return "", ErrNoCode
+}
+
+// ResolveRoomCode returns the session a room code is for
+func (b *Backplane) ResolveRoomCode(ctx context.Context, code string) (session string, ok bool, err error) {
+	err = b.breaker.Do(func() error {
+		session, err = b.client.Get(ctx, codePrefix+code).Result()
+		if errors.Is(err, redis.Nil) {
+			return nil
+		}
+		ok = err == nil
+		return err
+	})
+	return session, ok, err
+}
+
+const (
+	// homePrefix is where the region each session is homed in is kept
+	homePrefix = "codecollab:home:"
+	// homeTTL is how long a session stays homed after it was last located
+	homeTTL = 30 * 24 * time.Hour
+)
+
+// Home returns the region a session is homed in, homing it in region if
+// it isn't yet
+func (b *Backplane) Home(ctx context.Context, session, region string) (home string, err error) {
+	err = b.breaker.Do(func() error {
+		homed, err := b.client.SetNX(ctx, homePrefix+session, region, homeTTL).Result()
+		if err != nil {
+			return err
+		}
+		if homed {
+			home = region
+			return nil
+		}
+		if home, err = b.client.Get(ctx, homePrefix+session).Result(); err != nil {
+			return err
+		}
+		return b.client.Expire(ctx, homePrefix+session, homeTTL).Err()
+	})
+	return home, err
+}
+
+// cachePrefix is where values cached for the metadata cache are in Redis
+const cachePrefix = "codecollab:cache:"
+
+// CacheGet returns a value cached under key by any instance
+func (b *Backplane) CacheGet(ctx context.Context, key string) (value []byte, ok bool, err error) {
+	err = b.breaker.Do(func() error {
+		value, err = b.client.Get(ctx, cachePrefix+key).Bytes()
+		if errors.Is(err, redis.Nil) {
+			return nil
+		}
+		ok = err == nil
+		return err
+	})
+	return value, ok, err
+}
+
+// CacheSet caches a value under key for ttl, for every instance
+func (b *Backplane) CacheSet(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return b.breaker.Do(func() error {
+		return b.client.Set(ctx, cachePrefix+key, value, ttl).Err()
+	})
+}
+
+// CacheDelete invalidates the values cached under keys
+func (b *Backplane) CacheDelete(ctx context.Context, keys ...string) error {
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = cachePrefix + key
+	}
+	return b.breaker.Do(func() error {
+		return b.client.Del(ctx, prefixed...).Err()
+	})
+}
@@ -0,0 +1,168 @@
+// Package blob stores opaque file contents, such as binary workspace
+// assets, outside the text document model.
+package blob
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when a key has no stored blob
+var ErrNotFound = errors.New("blob not found")
+
+// ErrNotPublished is returned by PresignGet when blobs can't be downloaded
+// other than through the store
+var ErrNotPublished = errors.New("blobs are not published")
+
+// Store persists blobs by key. Keys are slash-separated and must not
+// contain ".." segments.
+type Store interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+	// DeletePrefix removes every blob whose key starts with prefix and a
+	// slash
+	DeletePrefix(prefix string) error
+}
+
+// Presigner is a Store that can hand out URLs to download a blob from
+// directly, until they expire, so the blob isn't streamed through the
+// service
+type Presigner interface {
+	PresignGet(key string, expires time.Time) (string, error)
+}
+
+// FileStore keeps each blob as a file under a root directory
+type FileStore struct {
+	root string
+	// base is where another server serves root, and secret what signs
+	// the URLs to it, if it does
+	base   *url.URL
+	secret string
+}
+
+// NewFileStore creates the root directory if needed and returns a store
+// rooted there
+func NewFileStore(root string) (*FileStore, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileStore{root: root}, nil
+}
+
+func (s *FileStore) path(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") {
+		return "", errors.New("invalid blob key")
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", errors.New("invalid blob key")
+		}
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+// Publish has the store presign URLs into base, where a server such as
+// nginx serves the root directory, checking links as
+//
+//	secure_link $arg_md5,$arg_expires;
+//	secure_link_md5 "$secure_link_expires$uri <secret>";
+func (s *FileStore) Publish(base, secret string) error {
+	parsed, err := url.Parse(strings.TrimSuffix(base, "/"))
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme == "" || parsed.Host == "" || secret == "" {
+		return errors.New("publishing blobs needs an absolute URL and a secret")
+	}
+	s.base, s.secret = parsed, secret
+	return nil
+}
+
+// PresignGet returns a URL the blob under key can be downloaded from until
+// expires, or ErrNotPublished if the store isn't published
+func (s *FileStore) PresignGet(key string, expires time.Time) (string, error) {
+	if _, err := s.path(key); err != nil {
+		return "", err
+	}
+	if s.base == nil {
+		return "", ErrNotPublished
+	}
+	uri := s.base.Path + "/" + key
+	expiry := strconv.FormatInt(expires.Unix(), 10)
+	sum := md5.Sum([]byte(expiry + uri + " " + s.secret))
+
+	link := *s.base
+	link.Path = uri
+	link.RawQuery = url.Values{"md5": {base64.RawURLEncoding.EncodeToString(sum[:])}, "expires": {expiry}}.Encode()
+	return link.String(), nil
+}
+
+// Put writes data under key, replacing any existing blob atomically
+func (s *FileStore) Put(key string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get reads the blob stored under key
+func (s *FileStore) Get(key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+// Delete removes the blob stored under key. Deleting a missing blob is not
+// an error.
+func (s *FileStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// DeletePrefix removes every blob under prefix. Deleting a prefix with no
+// blobs is not an error.
+func (s *FileStore) DeletePrefix(prefix string) error {
+	path, err := s.path(prefix)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(path)
+}
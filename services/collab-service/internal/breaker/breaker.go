@@ -0,0 +1,80 @@
+// Package breaker is a circuit breaker for the services the collab
+// service depends on, so that while one is down calls to it fail at once
+// instead of each waiting for its timeout.
+package breaker
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrOpen is returned for calls the breaker doesn't let through
+var ErrOpen = errors.New("breaker: service unavailable")
+
+// Breaker opens after Threshold failures in a row and lets no calls
+// through until Cooldown has passed. Then one call at a time is let
+// through to probe the service, until one succeeds and the breaker closes
+// again or one fails and it stays open for another Cooldown.
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// New returns a closed breaker. A threshold of 0 or less never opens.
+func New(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{threshold: threshold, cooldown: cooldown}
+}
+
+// Allow reports whether a call may go ahead. Every call allowed has its
+// outcome reported with Record.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openedAt.IsZero() {
+		return true
+	}
+	if b.probing || time.Since(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// Record reports the outcome of a call Allow let through
+func (b *Breaker) Record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err == nil {
+		b.failures = 0
+		b.openedAt = time.Time{}
+		return
+	}
+	b.failures++
+	if b.threshold > 0 && (b.failures >= b.threshold || !b.openedAt.IsZero()) {
+		b.openedAt = time.Now()
+	}
+}
+
+// Do runs fn if the breaker lets it, recording whether it failed
+func (b *Breaker) Do(fn func() error) error {
+	if !b.Allow() {
+		return ErrOpen
+	}
+	err := fn()
+	b.Record(err)
+	return err
+}
+
+// Open reports whether the breaker is keeping calls from the service
+func (b *Breaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.openedAt.IsZero()
+}
@@ -0,0 +1,120 @@
+// Package chatbridge mirrors a chat to a room on an outside chat network,
+// an IRC channel or a Matrix room, and hands back what is said there.
+// Bridges reconnect on their own until they are closed.
+package chatbridge
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Networks that can be bridged to
+const (
+	NetworkIRC    = "irc"
+	NetworkMatrix = "matrix"
+)
+
+// Message is something said in the bridged room by someone other than the
+// bridge
+type Message struct {
+	Sender string
+	Text   string
+}
+
+// DeliverFunc receives the messages said in the room. It is called from
+// the bridge's own goroutine, one message at a time.
+type DeliverFunc func(Message)
+
+// Bridge is a connection to one room
+type Bridge interface {
+	// Network is NetworkIRC or NetworkMatrix, and Room the channel or room
+	// bridged to
+	Network() string
+	Room() string
+	// Post says text in the room on behalf of sender. It never blocks:
+	// when the network can't keep up the message is dropped.
+	Post(sender, text string)
+	Close()
+}
+
+// outboxSize is how many posts may wait for the network
+const outboxSize = 100
+
+// Reconnect backoff bounds
+const (
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute
+)
+
+// outbox queues the posts a bridge has yet to send, with Sender the
+// participant they are on behalf of
+type outbox chan Message
+
+func (o outbox) post(network, room, sender, text string) {
+	// Names are on one line with the text, so can't break it
+	sender = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, sender)
+	select {
+	case o <- Message{Sender: sender, Text: text}:
+	default:
+		log.Printf("%s bridge to %s: outbox full, dropping a message from %s", network, room, sender)
+	}
+}
+
+// quote attributes text to sender the way IRC clients show it
+func quote(sender, text string) string {
+	return "<" + sender + "> " + text
+}
+
+// reconnect calls connect until ctx is done, waiting longer after each
+// failure. connect reports whether it got far enough to reset the wait.
+func reconnect(ctx context.Context, network, room string, connect func(context.Context) (bool, error)) {
+	backoff := minBackoff
+	for {
+		established, err := connect(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if established {
+			backoff = minBackoff
+		}
+		log.Printf("%s bridge to %s: %v; reconnecting in %s", network, room, err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// splitLines breaks text into lines of at most max bytes, cutting long
+// lines at word or rune boundaries. Blank lines are dropped.
+func splitLines(text string, max int) []string {
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r", ""), "\n") {
+		for len(line) > max {
+			cut := strings.LastIndexByte(line[:max], ' ')
+			if cut <= 0 {
+				cut = max
+				for cut > 0 && !utf8.RuneStart(line[cut]) {
+					cut--
+				}
+			}
+			lines = append(lines, line[:cut])
+			line = strings.TrimLeft(line[cut:], " ")
+		}
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,267 @@
+package chatbridge
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IRCConfig is the network IRC bridges connect to. Addr is host:port,
+// reached over TLS unless Plaintext is set.
+type IRCConfig struct {
+	Addr      string
+	Plaintext bool
+	Nick      string
+	Password  string
+}
+
+// IRC timing. Servers disconnect clients that send too fast, so lines go
+// out at most one per ircLineInterval.
+const (
+	ircDialTimeout  = 15 * time.Second
+	ircLineInterval = 500 * time.Millisecond
+	// ircIdleTimeout is how long the connection may stay silent before
+	// the server is pinged, and then how long it has to answer
+	ircIdleTimeout = 2 * time.Minute
+)
+
+// ircLineBytes is the message text that fits in a line once the server
+// adds our prefix, leaving room for a long hostmask
+const ircLineBytes = 512 - 2 - 100
+
+// IRC is a bridge to an IRC channel
+type IRC struct {
+	config  IRCConfig
+	channel string
+	deliver DeliverFunc
+	outbox  outbox
+	cancel  context.CancelFunc
+}
+
+// NewIRC joins channel and starts bridging it
+func NewIRC(config IRCConfig, channel string, deliver DeliverFunc) (*IRC, error) {
+	if !validChannel(channel) {
+		return nil, fmt.Errorf("invalid IRC channel: %q", channel)
+	}
+	if config.Nick == "" {
+		config.Nick = "codecollab"
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &IRC{config: config, channel: channel, deliver: deliver, outbox: make(outbox, outboxSize), cancel: cancel}
+	go reconnect(ctx, NetworkIRC, channel, b.connect)
+	return b, nil
+}
+
+// validChannel reports whether name is a channel name a JOIN can carry
+func validChannel(name string) bool {
+	if len(name) < 2 || len(name) > 50 || (name[0] != '#' && name[0] != '&') {
+		return false
+	}
+	return !strings.ContainsAny(name, " ,:\x07\r\n\x00")
+}
+
+func (b *IRC) Network() string { return NetworkIRC }
+func (b *IRC) Room() string    { return b.channel }
+func (b *IRC) Close()          { b.cancel() }
+
+func (b *IRC) Post(sender, text string) {
+	b.outbox.post(NetworkIRC, b.channel, sender, text)
+}
+
+// ircConn is one connection to the server
+type ircConn struct {
+	conn net.Conn
+	mu   sync.Mutex
+	nick string
+}
+
+func (c *ircConn) send(format string, args ...any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(ircIdleTimeout))
+	_, err := fmt.Fprintf(c.conn, format+"\r\n", args...)
+	return err
+}
+
+// connect registers with the server, joins the channel and relays until
+// the connection fails. It reports whether the channel was joined.
+func (b *IRC) connect(ctx context.Context) (bool, error) {
+	dialer := &net.Dialer{Timeout: ircDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", b.config.Addr)
+	if err != nil {
+		return false, err
+	}
+	if !b.config.Plaintext {
+		host, _, _ := net.SplitHostPort(b.config.Addr)
+		conn = tls.Client(conn, &tls.Config{ServerName: host})
+	}
+	defer conn.Close()
+
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-connCtx.Done()
+		conn.Close()
+	}()
+
+	c := &ircConn{conn: conn, nick: b.config.Nick}
+	if b.config.Password != "" {
+		c.send("PASS %s", b.config.Password)
+	}
+	c.send("NICK %s", c.nick)
+	if err := c.send("USER %s 0 * :CodeCollab chat bridge", b.config.Nick); err != nil {
+		return false, err
+	}
+
+	joined := false
+	reader := bufio.NewReader(conn)
+	pinged := false
+	for {
+		conn.SetReadDeadline(time.Now().Add(ircIdleTimeout))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && !pinged {
+				pinged = true
+				c.send("PING :%s", c.nick)
+				continue
+			}
+			return joined, err
+		}
+		pinged = false
+
+		prefix, command, params := parseIRCLine(strings.TrimRight(line, "\r\n"))
+		from, _, _ := strings.Cut(prefix, "!")
+		switch command {
+		case "PING":
+			c.send("PONG :%s", lastParam(params))
+		case "001":
+			c.send("JOIN %s", b.channel)
+		case "433":
+			// Nickname in use, by another session's bridge perhaps
+			c.nick += "_"
+			c.send("NICK %s", c.nick)
+		case "NICK":
+			if from == c.nick && len(params) > 0 {
+				c.nick = params[0]
+			}
+		case "JOIN":
+			if from == c.nick && len(params) > 0 && strings.EqualFold(params[0], b.channel) && !joined {
+				joined = true
+				go b.write(connCtx, c)
+			}
+		case "KICK":
+			if len(params) > 1 && strings.EqualFold(params[0], b.channel) && params[1] == c.nick {
+				return joined, fmt.Errorf("kicked by %s", from)
+			}
+		case "PRIVMSG":
+			if len(params) < 2 || !strings.EqualFold(params[0], b.channel) || from == c.nick {
+				continue
+			}
+			if text, ok := ircText(params[1]); ok {
+				b.deliver(Message{Sender: from, Text: text})
+			}
+		case "ERROR":
+			return joined, fmt.Errorf("server closed the connection: %s", lastParam(params))
+		}
+	}
+}
+
+// write sends the outbox to the channel, paced so the server doesn't
+// take it for flooding
+func (b *IRC) write(ctx context.Context, c *ircConn) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-b.outbox:
+			prefix := quote(msg.Sender, "")
+			for _, line := range splitLines(msg.Text, ircLineBytes-len(b.channel)-len(prefix)) {
+				if err := c.send("PRIVMSG %s :%s%s", b.channel, prefix, line); err != nil {
+					return
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(ircLineInterval):
+				}
+			}
+		}
+	}
+}
+
+// parseIRCLine splits a line into its prefix, command and parameters, the
+// trailing one included
+func parseIRCLine(line string) (prefix, command string, params []string) {
+	if strings.HasPrefix(line, "@") {
+		// IRCv3 message tags
+		_, line, _ = strings.Cut(line, " ")
+	}
+	if strings.HasPrefix(line, ":") {
+		prefix, line, _ = strings.Cut(line[1:], " ")
+	}
+	line, trailing, hasTrailing := strings.Cut(line, " :")
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return prefix, "", nil
+	}
+	params = fields[1:]
+	if hasTrailing {
+		params = append(params, trailing)
+	}
+	return prefix, strings.ToUpper(fields[0]), params
+}
+
+func lastParam(params []string) string {
+	if len(params) == 0 {
+		return ""
+	}
+	return params[len(params)-1]
+}
+
+// ircText turns a PRIVMSG into chat text, dropping formatting codes. CTCP
+// actions become "* text"; other CTCP requests aren't chat.
+func ircText(text string) (string, bool) {
+	if strings.HasPrefix(text, "\x01") {
+		action, ok := strings.CutPrefix(strings.Trim(text, "\x01"), "ACTION ")
+		if !ok {
+			return "", false
+		}
+		text = "* " + action
+	}
+	text = stripFormatting(text)
+	return text, strings.TrimSpace(text) != ""
+}
+
+// stripFormatting removes mIRC bold, colour, italic, underline and reset
+// codes
+func stripFormatting(text string) string {
+	var out strings.Builder
+	for i := 0; i < len(text); i++ {
+		switch ch := text[i]; ch {
+		case '\x02', '\x0f', '\x11', '\x16', '\x1d', '\x1e', '\x1f':
+		case '\x03':
+			// \x03 is followed by up to two digits of foreground and,
+			// after a comma, of background colour
+			for n := 0; n < 2 && i+1 < len(text) && isDigit(text[i+1]); n++ {
+				i++
+			}
+			if i+2 < len(text) && text[i+1] == ',' && isDigit(text[i+2]) {
+				i += 2
+				if i+1 < len(text) && isDigit(text[i+1]) {
+					i++
+				}
+			}
+		default:
+			out.WriteByte(ch)
+		}
+	}
+	return out.String()
+}
+
+func isDigit(ch byte) bool { return ch >= '0' && ch <= '9' }
@@ -0,0 +1,247 @@
+package chatbridge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// MatrixConfig is the bot account Matrix bridges use: an access token for
+// a user on the homeserver at Homeserver, a base URL
+type MatrixConfig struct {
+	Homeserver  string
+	AccessToken string
+}
+
+// matrixSyncTimeout is how long a /sync long poll waits for events
+const matrixSyncTimeout = 30 * time.Second
+
+// Matrix is a bridge to a Matrix room
+type Matrix struct {
+	config  MatrixConfig
+	room    string
+	deliver DeliverFunc
+	outbox  outbox
+	cancel  context.CancelFunc
+	http    *http.Client
+	txn     atomic.Int64
+}
+
+// NewMatrix joins room, an ID or alias, and starts bridging it
+func NewMatrix(config MatrixConfig, room string, deliver DeliverFunc) (*Matrix, error) {
+	if _, server, ok := strings.Cut(room, ":"); !ok || server == "" || (room[0] != '!' && room[0] != '#') {
+		return nil, fmt.Errorf("invalid Matrix room: %q", room)
+	}
+	config.Homeserver = strings.TrimRight(config.Homeserver, "/")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &Matrix{
+		config:  config,
+		room:    room,
+		deliver: deliver,
+		outbox:  make(outbox, outboxSize),
+		cancel:  cancel,
+		http:    &http.Client{Timeout: matrixSyncTimeout + 15*time.Second},
+	}
+	b.txn.Store(time.Now().UnixNano())
+	go reconnect(ctx, NetworkMatrix, room, b.connect)
+	return b, nil
+}
+
+func (b *Matrix) Network() string { return NetworkMatrix }
+func (b *Matrix) Room() string    { return b.room }
+func (b *Matrix) Close()          { b.cancel() }
+
+func (b *Matrix) Post(sender, text string) {
+	b.outbox.post(NetworkMatrix, b.room, sender, text)
+}
+
+// matrixEvent is the part of a room event the bridge reads
+type matrixEvent struct {
+	Type     string  `json:"type"`
+	Sender   string  `json:"sender"`
+	StateKey *string `json:"state_key"`
+	Content  struct {
+		MsgType     string `json:"msgtype"`
+		Body        string `json:"body"`
+		DisplayName string `json:"displayname"`
+	} `json:"content"`
+}
+
+type matrixSync struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[string]struct {
+			State struct {
+				Events []matrixEvent `json:"events"`
+			} `json:"state"`
+			Timeline struct {
+				Events []matrixEvent `json:"events"`
+			} `json:"timeline"`
+		} `json:"join"`
+	} `json:"rooms"`
+}
+
+// connect joins the room and relays until a request fails. It reports
+// whether the room was joined.
+func (b *Matrix) connect(ctx context.Context) (bool, error) {
+	var joined struct {
+		RoomID string `json:"room_id"`
+	}
+	if err := b.call(ctx, http.MethodPost, "/join/"+url.PathEscape(b.room), struct{}{}, &joined); err != nil {
+		return false, fmt.Errorf("joining: %w", err)
+	}
+	var whoami struct {
+		UserID string `json:"user_id"`
+	}
+	if err := b.call(ctx, http.MethodGet, "/account/whoami", nil, &whoami); err != nil {
+		return true, err
+	}
+
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go b.write(connCtx, joined.RoomID)
+
+	filter, _ := json.Marshal(map[string]any{
+		"presence":     map[string]any{"types": []string{}},
+		"account_data": map[string]any{"types": []string{}},
+		"room": map[string]any{
+			"rooms":        []string{joined.RoomID},
+			"account_data": map[string]any{"types": []string{}},
+			"ephemeral":    map[string]any{"types": []string{}},
+			"state":        map[string]any{"types": []string{"m.room.member"}, "lazy_load_members": true},
+			"timeline":     map[string]any{"types": []string{"m.room.message", "m.room.member"}, "lazy_load_members": true},
+		},
+	})
+	names := make(map[string]string)
+	since := ""
+	for {
+		query := url.Values{"filter": {string(filter)}, "timeout": {strconv.Itoa(int(matrixSyncTimeout.Milliseconds()))}}
+		if since != "" {
+			query.Set("since", since)
+		} else {
+			// The first sync only finds where the room is up to; what was
+			// said before the bridge was set up isn't relayed
+			query.Set("timeout", "0")
+		}
+		var sync matrixSync
+		if err := b.call(ctx, http.MethodGet, "/sync?"+query.Encode(), nil, &sync); err != nil {
+			return true, err
+		}
+
+		room := sync.Rooms.Join[joined.RoomID]
+		for _, event := range append(room.State.Events, room.Timeline.Events...) {
+			if event.Type == "m.room.member" && event.StateKey != nil && event.Content.DisplayName != "" {
+				names[*event.StateKey] = event.Content.DisplayName
+			}
+			if since == "" || event.Type != "m.room.message" || event.Sender == whoami.UserID {
+				continue
+			}
+			if text, ok := matrixText(event); ok {
+				b.deliver(Message{Sender: displayName(names, event.Sender), Text: text})
+			}
+		}
+		since = sync.NextBatch
+	}
+}
+
+// matrixText turns a message event into chat text. Notices, which bots
+// post, and media aren't chat.
+func matrixText(event matrixEvent) (string, bool) {
+	switch event.Content.MsgType {
+	case "m.text":
+		return event.Content.Body, strings.TrimSpace(event.Content.Body) != ""
+	case "m.emote":
+		return "* " + event.Content.Body, true
+	}
+	return "", false
+}
+
+// displayName is the name a user set in the room, or else the localpart
+// of their ID
+func displayName(names map[string]string, userID string) string {
+	if name, ok := names[userID]; ok {
+		return name
+	}
+	localpart, _, _ := strings.Cut(strings.TrimPrefix(userID, "@"), ":")
+	return localpart
+}
+
+// write sends the outbox to the room
+func (b *Matrix) write(ctx context.Context, roomID string) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-b.outbox:
+			content := map[string]string{"msgtype": "m.text", "body": quote(msg.Sender, msg.Text)}
+			path := fmt.Sprintf("/rooms/%s/send/m.room.message/%d", url.PathEscape(roomID), b.txn.Add(1))
+			if err := b.call(ctx, http.MethodPut, path, content, nil); err != nil && ctx.Err() == nil {
+				// The sync loop notices a homeserver that is down, so a
+				// message it refused is only dropped
+				log.Printf("matrix bridge to %s: dropping a message from %s: %v", b.room, msg.Sender, err)
+			}
+		}
+	}
+}
+
+// matrixError is the error body of the client-server API
+type matrixError struct {
+	ErrCode string `json:"errcode"`
+	Error   string `json:"error"`
+}
+
+// call makes a client-server API request, decoding the response into out
+// when it's not nil
+func (b *Matrix) call(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, b.config.Homeserver+"/_matrix/client/v3"+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+b.config.AccessToken)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := b.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr matrixError
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.ErrCode != "" {
+			return fmt.Errorf("%s: %s", apiErr.ErrCode, apiErr.Error)
+		}
+		return fmt.Errorf("homeserver returned %s", resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return errors.New("invalid response from homeserver")
+	}
+	return nil
+}
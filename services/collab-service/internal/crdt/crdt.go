@@ -0,0 +1,326 @@
+// Package crdt is a replicated text type for editors that sync by exchanging
+// commutative updates instead of having the server transform their edits.
+// It is an RGA: every character ever inserted keeps a unique ID and the ID
+// of the character it was inserted after, deletions leave tombstones, and
+// concurrent inserts after the same character are ordered by ID. Replicas
+// that have integrated the same updates, in any causal order, hold the
+// same text.
+//
+// IDs carry Lamport clocks: a character's clock is greater than that of
+// every character its site had seen when inserting it, and one site's
+// clocks only grow. A state vector of the highest clock seen per site is
+// then enough to tell which inserts a replica is missing.
+package crdt
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// ID identifies one inserted character
+type ID struct {
+	Site  string `json:"site"`
+	Clock int    `json:"clock"`
+}
+
+// after reports whether id wins over other when both are inserted after
+// the same character, which puts it first
+func (id ID) after(other ID) bool {
+	if id.Clock != other.Clock {
+		return id.Clock > other.Clock
+	}
+	return id.Site > other.Site
+}
+
+// Insert is a run of characters inserted together by one site. The first
+// has ID and goes after Origin, or at the start when Origin is nil; each
+// following one has the next clock and goes after the one before it.
+type Insert struct {
+	ID     ID     `json:"id"`
+	Origin *ID    `json:"origin,omitempty"`
+	Text   string `json:"text"`
+}
+
+// Delete removes the Length characters of one site starting at ID, with
+// consecutive clocks
+type Delete struct {
+	ID     ID  `json:"id"`
+	Length int `json:"length"`
+}
+
+// Update is a batch of changes. Inserts are integrated in order, so one may
+// go after a character inserted earlier in the same update.
+type Update struct {
+	Inserts []Insert `json:"inserts,omitempty"`
+	Deletes []Delete `json:"deletes,omitempty"`
+}
+
+// IsEmpty reports whether the update changes nothing
+func (u Update) IsEmpty() bool {
+	return len(u.Inserts) == 0 && len(u.Deletes) == 0
+}
+
+// StateVector maps each site to the highest clock seen from it
+type StateVector map[string]int
+
+// maxClock bounds clocks so they can't overflow
+const maxClock = 1 << 50
+
+// Errors returned by Apply
+var (
+	ErrUnknownOrigin = errors.New("update refers to a character that doesn't exist")
+	ErrOutOfOrder    = errors.New("update is older than what its site already sent")
+)
+
+type item struct {
+	id      ID
+	origin  *ID
+	r       rune
+	deleted bool
+}
+
+// Doc is one replica of a text
+type Doc struct {
+	// items are every character ever inserted, tombstones included, in
+	// document order
+	items  []*item
+	byID   map[ID]*item
+	clocks StateVector
+	// clock is the highest clock seen from any site
+	clock int
+}
+
+// New returns an empty document
+func New() *Doc {
+	return &Doc{byID: make(map[ID]*item), clocks: make(StateVector)}
+}
+
+// FromText returns a document holding text, inserted by site
+func FromText(site, text string) *Doc {
+	d := New()
+	d.Replace(site, text)
+	return d
+}
+
+// Text returns the document's visible text
+func (d *Doc) Text() string {
+	runes := make([]rune, 0, len(d.items))
+	for _, it := range d.items {
+		if !it.deleted {
+			runes = append(runes, it.r)
+		}
+	}
+	return string(runes)
+}
+
+// StateVector returns the highest clock integrated from each site
+func (d *Doc) StateVector() StateVector {
+	sv := make(StateVector, len(d.clocks))
+	for site, clock := range d.clocks {
+		sv[site] = clock
+	}
+	return sv
+}
+
+// Clone returns an independent copy of the document
+func (d *Doc) Clone() *Doc {
+	c := &Doc{
+		items:  make([]*item, len(d.items)),
+		byID:   make(map[ID]*item, len(d.byID)),
+		clocks: d.StateVector(),
+		clock:  d.clock,
+	}
+	for i, it := range d.items {
+		copied := *it
+		c.items[i] = &copied
+		c.byID[it.id] = &copied
+	}
+	return c
+}
+
+// validate checks an update against the document without changing it.
+// Inserts the document already has are reported in dup, so applying an
+// update twice is harmless.
+func (d *Doc) validate(u Update) (dup map[int]bool, err error) {
+	added := make(map[ID]bool)
+	has := func(id ID) bool { return added[id] || d.byID[id] != nil }
+	for i, ins := range u.Inserts {
+		n := utf8.RuneCountInString(ins.Text)
+		switch {
+		case n == 0 || !utf8.ValidString(ins.Text):
+			return nil, fmt.Errorf("insert %d: text must be non-empty UTF-8", i)
+		case ins.ID.Site == "" || ins.ID.Clock < 1 || ins.ID.Clock > maxClock-n:
+			return nil, fmt.Errorf("insert %d: invalid id", i)
+		case ins.Origin != nil && !has(*ins.Origin):
+			return nil, fmt.Errorf("insert %d: %w", i, ErrUnknownOrigin)
+		case ins.Origin != nil && ins.Origin.Clock >= ins.ID.Clock:
+			return nil, fmt.Errorf("insert %d: clock must be greater than its origin's", i)
+		}
+		if d.byID[ins.ID] != nil {
+			if dup == nil {
+				dup = make(map[int]bool)
+			}
+			dup[i] = true
+			continue
+		}
+		// Within an update a site's inserts may come in any order, as they
+		// do in diffs
+		if ins.ID.Clock <= d.clocks[ins.ID.Site] {
+			return nil, fmt.Errorf("insert %d: %w", i, ErrOutOfOrder)
+		}
+		for k := range n {
+			id := ID{ins.ID.Site, ins.ID.Clock + k}
+			if added[id] {
+				return nil, fmt.Errorf("insert %d: id is used twice", i)
+			}
+			added[id] = true
+		}
+	}
+	for i, del := range u.Deletes {
+		if del.Length < 1 || del.ID.Clock < 1 || del.ID.Clock > maxClock-del.Length {
+			return nil, fmt.Errorf("delete %d: invalid range", i)
+		}
+		for k := range del.Length {
+			if !has(ID{del.ID.Site, del.ID.Clock + k}) {
+				return nil, fmt.Errorf("delete %d: %w", i, ErrUnknownOrigin)
+			}
+		}
+	}
+	return dup, nil
+}
+
+// Apply integrates an update. Nothing is changed when it is invalid.
+func (d *Doc) Apply(u Update) error {
+	dup, err := d.validate(u)
+	if err != nil {
+		return err
+	}
+	for i, ins := range u.Inserts {
+		if !dup[i] {
+			d.integrate(ins)
+		}
+	}
+	for _, del := range u.Deletes {
+		for k := range del.Length {
+			d.byID[ID{del.ID.Site, del.ID.Clock + k}].deleted = true
+		}
+	}
+	return nil
+}
+
+// integrate places a validated insert
+func (d *Doc) integrate(ins Insert) {
+	pos := 0
+	if ins.Origin != nil {
+		origin := d.byID[*ins.Origin]
+		for i := len(d.items) - 1; i >= 0; i-- {
+			if d.items[i] == origin {
+				pos = i + 1
+				break
+			}
+		}
+	}
+	// Concurrent inserts after the same character with greater IDs, and
+	// everything inserted after those, come first
+	for pos < len(d.items) && d.items[pos].id.after(ins.ID) {
+		pos++
+	}
+
+	runes := []rune(ins.Text)
+	run := make([]*item, len(runes))
+	origin := ins.Origin
+	for k, r := range runes {
+		it := &item{id: ID{ins.ID.Site, ins.ID.Clock + k}, origin: origin, r: r}
+		run[k] = it
+		d.byID[it.id] = it
+		origin = &it.id
+	}
+	d.items = append(d.items[:pos], append(run, d.items[pos:]...)...)
+
+	last := ins.ID.Clock + len(runes) - 1
+	d.clocks[ins.ID.Site] = max(d.clocks[ins.ID.Site], last)
+	d.clock = max(d.clock, last)
+}
+
+// Diff returns the update bringing a replica at state vector sv up to date:
+// the inserts it hasn't seen and every deletion. Inserts are in document
+// order, which puts each after its origin.
+func (d *Doc) Diff(sv StateVector) Update {
+	var u Update
+	var prev *item
+	for _, it := range d.items {
+		if it.id.Clock <= sv[it.id.Site] {
+			prev = nil
+			continue
+		}
+		if prev != nil && it.origin != nil && *it.origin == prev.id && it.id == (ID{prev.id.Site, prev.id.Clock + 1}) {
+			last := &u.Inserts[len(u.Inserts)-1]
+			last.Text += string(it.r)
+		} else {
+			u.Inserts = append(u.Inserts, Insert{ID: it.id, Origin: it.origin, Text: string(it.r)})
+		}
+		prev = it
+	}
+	u.Deletes = d.deletes(d.items)
+	return u
+}
+
+// deletes returns the tombstones among items as ranges
+func (d *Doc) deletes(items []*item) []Delete {
+	var dels []Delete
+	for _, it := range items {
+		if !it.deleted {
+			continue
+		}
+		if n := len(dels); n > 0 {
+			last := &dels[n-1]
+			if last.ID.Site == it.id.Site && last.ID.Clock+last.Length == it.id.Clock {
+				last.Length++
+				continue
+			}
+		}
+		dels = append(dels, Delete{ID: it.id, Length: 1})
+	}
+	return dels
+}
+
+// Replace changes the visible text to text as an edit by site, replacing
+// whatever lies between the common prefix and suffix, and returns the
+// update doing so, which is empty when the text is unchanged
+func (d *Doc) Replace(site, text string) Update {
+	var visible []*item
+	for _, it := range d.items {
+		if !it.deleted {
+			visible = append(visible, it)
+		}
+	}
+	runes := []rune(text)
+	prefix := 0
+	for prefix < len(visible) && prefix < len(runes) && visible[prefix].r == runes[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(visible)-prefix && suffix < len(runes)-prefix && visible[len(visible)-1-suffix].r == runes[len(runes)-1-suffix] {
+		suffix++
+	}
+
+	var u Update
+	if inserted := runes[prefix : len(runes)-suffix]; len(inserted) > 0 {
+		ins := Insert{ID: ID{site, d.clock + 1}, Text: string(inserted)}
+		if prefix > 0 {
+			origin := visible[prefix-1].id
+			ins.Origin = &origin
+		}
+		u.Inserts = []Insert{ins}
+	}
+	removed := visible[prefix : len(visible)-suffix]
+	for _, it := range removed {
+		it.deleted = true
+	}
+	u.Deletes = d.deletes(removed)
+	for _, ins := range u.Inserts {
+		d.integrate(ins)
+	}
+	return u
+}
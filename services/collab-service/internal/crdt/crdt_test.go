@@ -0,0 +1,136 @@
+package crdt
+
+import (
+	"errors"
+	"testing"
+)
+
+// permutations returns every ordering of the indexes below n
+func permutations(n int) [][]int {
+	if n == 0 {
+		return [][]int{{}}
+	}
+	var out [][]int
+	for _, perm := range permutations(n - 1) {
+		for i := 0; i <= len(perm); i++ {
+			next := append(append(append([]int(nil), perm[:i]...), n-1), perm[i:]...)
+			out = append(out, next)
+		}
+	}
+	return out
+}
+
+// concurrentUpdates returns the updates of several sites editing "abc",
+// each having seen the updates named in its deps, by index
+func concurrentUpdates(t *testing.T) (base Update, updates []Update, deps map[int][]int) {
+	t.Helper()
+	doc := FromText("base", "abc")
+	base = doc.Diff(nil)
+
+	a := doc.Clone()
+	b := doc.Clone()
+	updates = []Update{
+		a.Replace("a", "aXbc"),
+		b.Replace("b", "aYbc"),
+		doc.Clone().Replace("c", "ac"),
+		// Deletes a's X, which b, c and e never saw
+		a.Clone().Replace("d", "aZbc"),
+		// Inserts after b's Y
+		b.Clone().Replace("e", "aYWbc"),
+		// Inserts after a's X, concurrently with d deleting it
+		a.Clone().Replace("f", "aXVbc"),
+	}
+	deps = map[int][]int{3: {0}, 4: {1}, 5: {0}}
+	return base, updates, deps
+}
+
+func TestConcurrentUpdatesConverge(t *testing.T) {
+	base, updates, deps := concurrentUpdates(t)
+	const want = "aZYWVc"
+
+	orders := 0
+	for _, order := range permutations(len(updates)) {
+		seen := make(map[int]bool)
+		causal := true
+		for _, i := range order {
+			for _, dep := range deps[i] {
+				causal = causal && seen[dep]
+			}
+			seen[i] = true
+		}
+		if !causal {
+			continue
+		}
+		orders++
+
+		doc := New()
+		if err := doc.Apply(base); err != nil {
+			t.Fatalf("Apply(base): %v", err)
+		}
+		for _, i := range order {
+			if err := doc.Apply(updates[i]); err != nil {
+				t.Fatalf("order %v: Apply(%d): %v", order, i, err)
+			}
+		}
+		if got := doc.Text(); got != want {
+			t.Fatalf("order %v: got %q, want %q", order, got, want)
+		}
+	}
+	if orders == 0 {
+		t.Fatal("no causal order was tried")
+	}
+}
+
+func TestApplyTwiceIsHarmless(t *testing.T) {
+	base, updates, _ := concurrentUpdates(t)
+	doc := New()
+	for _, u := range []Update{base, updates[0], updates[3], updates[0], updates[3], base} {
+		if err := doc.Apply(u); err != nil {
+			t.Fatalf("Apply: %v", err)
+		}
+	}
+	if got, want := doc.Text(), "aZbc"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestApplyRejectsMissingOrigin(t *testing.T) {
+	base, updates, _ := concurrentUpdates(t)
+	doc := New()
+	if err := doc.Apply(base); err != nil {
+		t.Fatalf("Apply(base): %v", err)
+	}
+	// e's insert goes after b's Y, which the document doesn't have
+	if err := doc.Apply(updates[4]); !errors.Is(err, ErrUnknownOrigin) {
+		t.Fatalf("got %v, want ErrUnknownOrigin", err)
+	}
+	if got, want := doc.Text(), "abc"; got != want {
+		t.Fatalf("a rejected update changed the text to %q", got)
+	}
+}
+
+func TestDiffBringsReplicaUpToDate(t *testing.T) {
+	base, updates, _ := concurrentUpdates(t)
+	full := New()
+	behind := New()
+	for _, u := range append([]Update{base}, updates...) {
+		if err := full.Apply(u); err != nil {
+			t.Fatalf("Apply: %v", err)
+		}
+	}
+	for _, u := range []Update{base, updates[1], updates[2]} {
+		if err := behind.Apply(u); err != nil {
+			t.Fatalf("Apply: %v", err)
+		}
+	}
+
+	if err := behind.Apply(full.Diff(behind.StateVector())); err != nil {
+		t.Fatalf("Apply(diff): %v", err)
+	}
+	if got, want := behind.Text(), full.Text(); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if fresh := New(); fresh.Apply(full.Diff(nil)) != nil || fresh.Text() != full.Text() {
+		t.Fatalf("a full diff gave %q, want %q", fresh.Text(), full.Text())
+	}
+}
@@ -0,0 +1,122 @@
+// Package delta encodes one byte string as a binary diff against another,
+// in the spirit of xdelta: a patch copies ranges of the base and inserts
+// the bytes that aren't in it. Matches are found by indexing the base in
+// fixed-size blocks and extending each hit both ways, which finds what
+// typical edits leave in place at a fraction of bsdiff's cost.
+package delta
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// blockSize is the shortest run of the base a patch copies
+const blockSize = 16
+
+// Patch instructions
+const (
+	opInsert byte = iota
+	opCopy
+)
+
+// ErrCorrupt means a patch can't be applied to the base given
+var ErrCorrupt = errors.New("delta: corrupt patch")
+
+// Diff returns a patch turning base into target
+func Diff(base, target []byte) []byte {
+	index := make(map[string]int, len(base)/blockSize)
+	for i := 0; i+blockSize <= len(base); i += blockSize {
+		key := string(base[i : i+blockSize])
+		if _, ok := index[key]; !ok {
+			index[key] = i
+		}
+	}
+
+	patch := binary.AppendUvarint(nil, uint64(len(base)))
+	patch = binary.AppendUvarint(patch, uint64(len(target)))
+	literal := 0 // start of the bytes not matched yet
+	for pos := 0; pos+blockSize <= len(target); {
+		at, ok := index[string(target[pos:pos+blockSize])]
+		if !ok {
+			pos++
+			continue
+		}
+		// Extend the match back into the pending literal, then forward
+		start, from := pos, at
+		for start > literal && from > 0 && target[start-1] == base[from-1] {
+			start--
+			from--
+		}
+		end := pos + blockSize
+		for end < len(target) && from+end-start < len(base) && target[end] == base[from+end-start] {
+			end++
+		}
+
+		patch = appendInsert(patch, target[literal:start])
+		patch = append(patch, opCopy)
+		patch = binary.AppendUvarint(patch, uint64(from))
+		patch = binary.AppendUvarint(patch, uint64(end-start))
+		pos, literal = end, end
+	}
+	return appendInsert(patch, target[literal:])
+}
+
+func appendInsert(patch, data []byte) []byte {
+	if len(data) == 0 {
+		return patch
+	}
+	patch = append(patch, opInsert)
+	patch = binary.AppendUvarint(patch, uint64(len(data)))
+	return append(patch, data...)
+}
+
+// Apply reconstructs the target a patch was made for from its base
+func Apply(base, patch []byte) ([]byte, error) {
+	baseLen, n := binary.Uvarint(patch)
+	if n <= 0 {
+		return nil, ErrCorrupt
+	}
+	patch = patch[n:]
+	if baseLen != uint64(len(base)) {
+		return nil, fmt.Errorf("delta: patch is for a base of %d bytes, not %d", baseLen, len(base))
+	}
+	targetLen, n := binary.Uvarint(patch)
+	if n <= 0 || targetLen > 1<<40 {
+		return nil, ErrCorrupt
+	}
+	patch = patch[n:]
+
+	target := make([]byte, 0, targetLen)
+	for len(patch) > 0 {
+		op := patch[0]
+		patch = patch[1:]
+		switch op {
+		case opInsert:
+			size, n := binary.Uvarint(patch)
+			if n <= 0 || size > uint64(len(patch)-n) {
+				return nil, ErrCorrupt
+			}
+			target = append(target, patch[n:n+int(size)]...)
+			patch = patch[n+int(size):]
+		case opCopy:
+			from, n := binary.Uvarint(patch)
+			if n <= 0 {
+				return nil, ErrCorrupt
+			}
+			patch = patch[n:]
+			size, n := binary.Uvarint(patch)
+			if n <= 0 || from > uint64(len(base)) || size > uint64(len(base))-from {
+				return nil, ErrCorrupt
+			}
+			patch = patch[n:]
+			target = append(target, base[from:from+size]...)
+		default:
+			return nil, ErrCorrupt
+		}
+	}
+	if uint64(len(target)) != targetLen {
+		return nil, ErrCorrupt
+	}
+	return target, nil
+}
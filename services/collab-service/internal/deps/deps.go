@@ -0,0 +1,297 @@
+// Package deps plans the install phase that runs before code in a
+// workspace with a requirements.txt, package.json or go.mod. Installs
+// only reach allowlisted registries: manifests may not point at URLs,
+// local paths or VCS sources outside them.
+package deps
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Manager is a package manager the install phase knows how to drive
+type Manager struct {
+	Name string
+	// Manifest is the workspace file that declares dependencies, and
+	// Lockfiles are copied along with it when present
+	Manifest  string
+	Lockfiles []string
+	// command returns the install command using registry
+	command func(registry string) string
+	// validate checks a manifest against the allowed registries
+	validate func(content string, registries []string) error
+	// env returns the variables runs need to find what was installed in dir
+	env func(dir string) map[string]string
+}
+
+// Managers are the supported package managers, in install order
+var Managers = []Manager{
+	{
+		Name:     "pip",
+		Manifest: "requirements.txt",
+		command: func(registry string) string {
+			return "pip install --disable-pip-version-check --no-input --target python --index-url " + shellQuote(registry) + " -r requirements.txt"
+		},
+		validate: validateRequirements,
+		env: func(dir string) map[string]string {
+			return map[string]string{"PYTHONPATH": dir + "/python"}
+		},
+	},
+	{
+		Name:      "npm",
+		Manifest:  "package.json",
+		Lockfiles: []string{"package-lock.json"},
+		command: func(registry string) string {
+			// Lifecycle scripts would run arbitrary code with network access
+			return "npm install --no-audit --no-fund --ignore-scripts --registry " + shellQuote(registry)
+		},
+		validate: validatePackageJSON,
+		env: func(dir string) map[string]string {
+			return map[string]string{"NODE_PATH": dir + "/node_modules"}
+		},
+	},
+	{
+		Name:      "go",
+		Manifest:  "go.mod",
+		Lockfiles: []string{"go.sum"},
+		command: func(registry string) string {
+			return "GOPROXY=" + shellQuote(registry) + " GOMODCACHE=\"$PWD/gomod\" go mod download"
+		},
+		validate: validateGoMod,
+		env: func(dir string) map[string]string {
+			return map[string]string{"GOMODCACHE": dir + "/gomod", "GOPROXY": "off", "GOFLAGS": "-mod=mod"}
+		},
+	},
+}
+
+// Plan is the install phase for one workspace
+type Plan struct {
+	// Key identifies the install; it changes with the manifests
+	Key      string
+	Managers []string
+	// Files are the manifests and lockfiles, which runs also need
+	Files   map[string]string
+	Command string
+
+	env []func(dir string) map[string]string
+}
+
+// Env returns the variables that let a run use the install in dir
+func (p *Plan) Env(dir string) map[string]string {
+	env := make(map[string]string)
+	for _, fn := range p.env {
+		for name, value := range fn(dir) {
+			env[name] = value
+		}
+	}
+	return env
+}
+
+// Installer plans installs against a fixed set of registries
+type Installer struct {
+	// registries lists the allowed registries per manager; the first is
+	// the one installs use
+	registries map[string][]string
+}
+
+// NewInstaller returns an installer allowing registries, keyed by manager
+// name. Managers without a registry are disabled.
+func NewInstaller(registries map[string][]string) *Installer {
+	return &Installer{registries: registries}
+}
+
+// Enabled returns the managers that have a registry, in install order
+func (i *Installer) Enabled() []string {
+	var names []string
+	for _, manager := range Managers {
+		if len(i.registries[manager.Name]) > 0 {
+			names = append(names, manager.Name)
+		}
+	}
+	return names
+}
+
+// ParseRegistries reads a list like "pip=https://pypi.org/simple,npm=..."
+// where a manager may appear more than once
+func ParseRegistries(spec string) (map[string][]string, error) {
+	registries := make(map[string][]string)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, registry, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid registry %q, expected manager=url", entry)
+		}
+		if !slices.ContainsFunc(Managers, func(m Manager) bool { return m.Name == name }) {
+			return nil, fmt.Errorf("unknown package manager %q", name)
+		}
+		parsed, err := url.Parse(registry)
+		if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid registry URL %q", registry)
+		}
+		registries[name] = append(registries[name], strings.TrimRight(registry, "/"))
+	}
+	return registries, nil
+}
+
+// Plan returns the install phase for a workspace, or nil when it has no
+// manifests. scope keeps installs of different sessions apart.
+func (i *Installer) Plan(scope string, files map[string]string) (*Plan, error) {
+	plan := &Plan{Files: make(map[string]string)}
+	var commands []string
+	for _, manager := range Managers {
+		content, ok := files[manager.Manifest]
+		if !ok {
+			continue
+		}
+		registries := i.registries[manager.Name]
+		if len(registries) == 0 {
+			return nil, fmt.Errorf("installing %s dependencies is not enabled", manager.Name)
+		}
+		if err := manager.validate(content, registries); err != nil {
+			return nil, fmt.Errorf("%s: %w", manager.Manifest, err)
+		}
+
+		plan.Managers = append(plan.Managers, manager.Name)
+		plan.Files[manager.Manifest] = content
+		for _, lockfile := range manager.Lockfiles {
+			if content, ok := files[lockfile]; ok {
+				plan.Files[lockfile] = content
+			}
+		}
+		commands = append(commands, manager.command(registries[0]))
+		plan.env = append(plan.env, manager.env)
+	}
+	if len(plan.Managers) == 0 {
+		return nil, nil
+	}
+	plan.Command = strings.Join(commands, " && ")
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", scope, plan.Command)
+	names := make([]string, 0, len(plan.Files))
+	for name := range plan.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "%s\x00%d\x00%s", name, len(plan.Files[name]), plan.Files[name])
+	}
+	plan.Key = hex.EncodeToString(h.Sum(nil))[:32]
+	return plan, nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// allowedURL reports whether raw is under one of the registries
+func allowedURL(raw string, registries []string) bool {
+	raw = strings.TrimRight(raw, "/")
+	for _, registry := range registries {
+		if raw == registry || strings.HasPrefix(raw, registry+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// validateRequirements allows plain requirement specifiers, with index
+// options only for allowlisted registries
+func validateRequirements(content string, registries []string) error {
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(line, " #"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "-") {
+			option, value, _ := strings.Cut(line, "=")
+			if value == "" {
+				option, value, _ = strings.Cut(line, " ")
+			}
+			switch option {
+			case "-i", "--index-url", "--extra-index-url":
+				if !allowedURL(strings.TrimSpace(value), registries) {
+					return fmt.Errorf("line %d: registry %s is not allowed", n, strings.TrimSpace(value))
+				}
+				continue
+			}
+			return fmt.Errorf("line %d: option %s is not allowed", n, option)
+		}
+		// Direct references ("pkg @ url"), URLs and local paths bypass
+		// the registry
+		if strings.Contains(line, "@") || strings.Contains(line, "://") ||
+			strings.HasPrefix(line, ".") || strings.HasPrefix(line, "/") {
+			return fmt.Errorf("line %d: only packages from the registry can be installed", n)
+		}
+	}
+	return scanner.Err()
+}
+
+// validatePackageJSON allows version ranges and npm: aliases, but no URL,
+// git, GitHub or local dependencies
+func validatePackageJSON(content string, _ []string) error {
+	var manifest map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(content), &manifest); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	for _, field := range []string{"dependencies", "devDependencies", "optionalDependencies", "peerDependencies"} {
+		raw, ok := manifest[field]
+		if !ok {
+			continue
+		}
+		var deps map[string]string
+		if err := json.Unmarshal(raw, &deps); err != nil {
+			return fmt.Errorf("%s must map package names to versions", field)
+		}
+		for name, version := range deps {
+			spec := strings.TrimPrefix(version, "npm:")
+			if strings.Contains(spec, ":") || strings.Contains(spec, "/") && !strings.HasPrefix(spec, "@") {
+				return fmt.Errorf("%s: %s must come from the registry", field, name)
+			}
+		}
+	}
+	return nil
+}
+
+// validateGoMod refuses replace directives that point at local paths,
+// since modules can only come through the module proxy
+func validateGoMod(content string, _ []string) error {
+	inReplace := false
+	for n, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		switch {
+		case line == "replace (":
+			inReplace = true
+			continue
+		case inReplace && line == ")":
+			inReplace = false
+			continue
+		case !inReplace && !strings.HasPrefix(line, "replace "):
+			continue
+		}
+		_, target, ok := strings.Cut(line, "=>")
+		target = strings.TrimSpace(target)
+		if ok && (strings.HasPrefix(target, ".") || strings.HasPrefix(target, "/")) {
+			return fmt.Errorf("line %d: local replace directives are not allowed", n+1)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+// Package egress is the forward proxy sandboxes under an allowlist policy
+// reach the internet through. Sandboxes are identified by the address they
+// connect from, and may only reach the hosts their policy allows, at
+// public addresses.
+package egress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/httprunner"
+	"github.com/codecollab/collab-service/internal/netpolicy"
+)
+
+// PolicyFunc returns the policy of the sandbox connecting from addr, or
+// false when addr isn't a sandbox
+type PolicyFunc func(addr string) (netpolicy.Policy, bool)
+
+// Proxy handles CONNECT tunnels and plain HTTP requests
+type Proxy struct {
+	policy    PolicyFunc
+	dialer    *net.Dialer
+	transport *http.Transport
+}
+
+// New returns a proxy enforcing the policies policy returns
+func New(policy PolicyFunc) *Proxy {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		// Checked on the dialled address, so an allowed name resolving to
+		// an internal address gets nowhere
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !httprunner.IsPublic(ip) {
+				return fmt.Errorf("%w: %s", httprunner.ErrBlockedAddress, host)
+			}
+			return nil
+		},
+	}
+	return &Proxy{
+		policy: policy,
+		dialer: dialer,
+		transport: &http.Transport{
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: time.Minute,
+			MaxIdleConns:          50,
+			IdleConnTimeout:       30 * time.Second,
+		},
+	}
+}
+
+// hopHeaders apply to a single connection and are not forwarded
+var hopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "bad remote address", http.StatusBadRequest)
+		return
+	}
+	policy, ok := p.policy(addr)
+	if !ok {
+		http.Error(w, "not a sandbox", http.StatusForbidden)
+		return
+	}
+
+	target := r.Host
+	if r.Method != http.MethodConnect {
+		if r.URL.Scheme != "http" || r.URL.Host == "" {
+			http.Error(w, "only absolute http URLs and CONNECT are proxied", http.StatusBadRequest)
+			return
+		}
+		target = r.URL.Host
+	}
+	host := target
+	if h, _, err := net.SplitHostPort(target); err == nil {
+		host = h
+	}
+	if !policy.Allows(host) {
+		log.Printf("Egress to %s from sandbox %s denied by %s policy", host, addr, policy.Mode)
+		http.Error(w, fmt.Sprintf("%s is not allowed by the network policy", host), http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		p.tunnel(w, r, target)
+		return
+	}
+	p.forward(w, r)
+}
+
+// tunnel connects the client to target and copies bytes both ways
+func (p *Proxy) tunnel(w http.ResponseWriter, r *http.Request, target string) {
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, "443")
+	}
+	upstream, err := p.dialer.DialContext(r.Context(), "tcp", target)
+	if err != nil {
+		p.dialError(w, err)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "tunnelling not supported", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		// Anything the client sent after the CONNECT is already buffered
+		if n := buffered.Reader.Buffered(); n > 0 {
+			data, _ := buffered.Reader.Peek(n)
+			upstream.Write(data)
+		}
+		io.Copy(upstream, client)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+	client.Close()
+	upstream.Close()
+	<-done
+}
+
+// forward sends a plain HTTP request on and relays the response
+func (p *Proxy) forward(w http.ResponseWriter, r *http.Request) {
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	for _, header := range hopHeaders {
+		out.Header.Del(header)
+	}
+
+	resp, err := p.transport.RoundTrip(out)
+	if err != nil {
+		p.dialError(w, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, header := range hopHeaders {
+		resp.Header.Del(header)
+	}
+	for name, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func (p *Proxy) dialError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, httprunner.ErrBlockedAddress):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, context.Canceled):
+	default:
+		http.Error(w, strings.TrimSpace(err.Error()), http.StatusBadGateway)
+	}
+}
@@ -0,0 +1,264 @@
+// Package execution is a client for the execution service, which runs
+// code in a sandbox and returns its output.
+package execution
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Request is a single run. Timeout is in seconds; 0 uses the service default.
+type Request struct {
+	Code     string `json:"code"`
+	Language string `json:"language"`
+	Timeout  int    `json:"timeout,omitempty"`
+	// Env is set in the environment of the process running the code
+	Env map[string]string `json:"env,omitempty"`
+	// RunID identifies the run so it can be cancelled
+	RunID string `json:"run_id,omitempty"`
+	// When Run is set the code is written to File and run with these shell
+	// commands instead of the service's built-in handler for Language
+	File    string `json:"file,omitempty"`
+	Compile string `json:"compile,omitempty"`
+	Run     string `json:"run,omitempty"`
+	// MemoryMB limits the memory of the run's processes
+	MemoryMB int `json:"memory_mb,omitempty"`
+	// Files are written next to File, keyed by relative path, so commands
+	// can work on a whole workspace
+	Files map[string]string `json:"files,omitempty"`
+}
+
+// Output is a piece of a streamed run's output
+type Output struct {
+	// Stream is "stdout" or "stderr"
+	Stream string
+	Data   string
+}
+
+// Result is what the execution service reports for a run. ExecutionTime
+// is in milliseconds.
+type Result struct {
+	Stdout        string  `json:"stdout"`
+	Stderr        string  `json:"stderr"`
+	ExitCode      int     `json:"exit_code"`
+	ExecutionTime float64 `json:"execution_time"`
+}
+
+// Client talks to the execution service over HTTP
+type Client struct {
+	baseURL string
+	http    *http.Client
+}
+
+// NewClient returns a client for the service at baseURL. Requests are
+// bounded by the caller's context, so no client-wide timeout is set.
+func NewClient(baseURL string) *Client {
+	return &Client{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		http:    &http.Client{},
+	}
+}
+
+// Execute runs req and waits for its result
+func (c *Client) Execute(ctx context.Context, req Request) (*Result, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/execute", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	start := time.Now()
+	resp, err := c.http.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("execution service unavailable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("execution service returned %s", resp.Status)
+	}
+
+	var result Result
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid execution service response: %w", err)
+	}
+	if result.ExecutionTime == 0 {
+		result.ExecutionTime = float64(time.Since(start).Milliseconds())
+	}
+	return &result, nil
+}
+
+// streamEvent is one line of the /execute/stream response: output, or
+// the final result when Done is set
+type streamEvent struct {
+	Stdout        string  `json:"stdout,omitempty"`
+	Stderr        string  `json:"stderr,omitempty"`
+	Done          bool    `json:"done,omitempty"`
+	ExitCode      int     `json:"exit_code"`
+	ExecutionTime float64 `json:"execution_time"`
+}
+
+// ExecuteStream runs req, passing output to onOutput as it is produced.
+// The returned result holds all of the output.
+func (c *Client) ExecuteStream(ctx context.Context, req Request, onOutput func(Output)) (*Result, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/execute/stream", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("execution service unavailable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("execution service returned %s", resp.Status)
+	}
+
+	var stdout, stderr strings.Builder
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event streamEvent
+		if err := decoder.Decode(&event); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, fmt.Errorf("invalid execution service response: %w", err)
+		}
+		if event.Done {
+			return &Result{
+				Stdout:        stdout.String(),
+				Stderr:        stderr.String(),
+				ExitCode:      event.ExitCode,
+				ExecutionTime: event.ExecutionTime,
+			}, nil
+		}
+		if event.Stdout != "" {
+			stdout.WriteString(event.Stdout)
+			onOutput(Output{Stream: "stdout", Data: event.Stdout})
+		}
+		if event.Stderr != "" {
+			stderr.WriteString(event.Stderr)
+			onOutput(Output{Stream: "stderr", Data: event.Stderr})
+		}
+	}
+}
+
+// InstallRequest installs dependencies into a directory the service keeps
+// under Key, so later runs can use them. Command runs in that directory
+// after Files are written to it.
+type InstallRequest struct {
+	Key     string            `json:"key"`
+	Files   map[string]string `json:"files"`
+	Command string            `json:"command"`
+	Env     map[string]string `json:"env,omitempty"`
+	Timeout int               `json:"timeout,omitempty"`
+}
+
+// InstallResult reports an install. Cached is set when Key was already
+// installed and nothing ran.
+type InstallResult struct {
+	Dir           string  `json:"dir"`
+	Cached        bool    `json:"cached"`
+	Stdout        string  `json:"stdout"`
+	Stderr        string  `json:"stderr"`
+	ExitCode      int     `json:"exit_code"`
+	ExecutionTime float64 `json:"execution_time"`
+}
+
+// Install runs an install, or returns the existing one for req.Key
+func (c *Client) Install(ctx context.Context, req InstallRequest) (*InstallResult, error) {
+	var result InstallResult
+	if err := c.post(ctx, "/install", req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// PurgeInstalls removes the installs kept under keys
+func (c *Client) PurgeInstalls(ctx context.Context, keys []string) error {
+	return c.post(ctx, "/install/purge", map[string][]string{"keys": keys}, nil)
+}
+
+// post sends a JSON request and decodes the JSON response into out
+func (c *Client) post(ctx context.Context, path string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("execution service unavailable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("execution service returned %s", resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid execution service response: %w", err)
+	}
+	return nil
+}
+
+// Cancel kills the processes of a run started with the given RunID and
+// returns how many were killed
+func (c *Client) Cancel(ctx context.Context, runID string) (int, error) {
+	body, err := json.Marshal(map[string]string{"run_id": runID})
+	if err != nil {
+		return 0, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/cancel", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(httpReq)
+	if err != nil {
+		return 0, fmt.Errorf("execution service unavailable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("execution service returned %s", resp.Status)
+	}
+
+	var result struct {
+		Killed int `json:"killed"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("invalid execution service response: %w", err)
+	}
+	return result.Killed, nil
+}
@@ -0,0 +1,247 @@
+// Package gist reads and creates GitHub Gists through the GitHub REST API.
+// Gists have no directories, so workspace paths are kept in file names
+// with their slashes escaped, and mapped back when a gist is read.
+package gist
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrAuth is returned when GitHub refuses the token, or wants one
+	ErrAuth = errors.New("GitHub refused the token")
+	// ErrNotFound is returned for gists that don't exist, or that the
+	// token can't see
+	ErrNotFound = errors.New("gist not found")
+)
+
+// maxFileBytes bounds what is read of a file too large for the API to
+// return in full
+const maxFileBytes = 10 << 20
+
+// File is a file of a gist, with Path its workspace path
+type File struct {
+	Path    string
+	Content string
+}
+
+// Gist is a gist as read or created. Truncated is set when it has more
+// files than the API lists, which are left out.
+type Gist struct {
+	ID          string
+	URL         string
+	Description string
+	Owner       string
+	Files       []File
+	Truncated   bool
+}
+
+// Client talks to the API at a base URL, https://api.github.com or that
+// of a GitHub Enterprise server
+type Client struct {
+	base   string
+	client *http.Client
+}
+
+// New returns a client of the API at base; requests time out after
+// timeout
+func New(base string, timeout time.Duration) *Client {
+	return &Client{base: strings.TrimRight(base, "/"), client: &http.Client{Timeout: timeout}}
+}
+
+var gistID = regexp.MustCompile(`^[0-9A-Za-z]+$`)
+
+// ParseID returns the ID of a gist from its URL, such as
+// https://gist.github.com/octocat/aa5a315d61ae9438b18d, or the ID itself
+func ParseID(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if gistID.MatchString(raw) {
+		return raw, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return "", errors.New("not a gist URL or ID")
+	}
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	id := strings.TrimSuffix(segments[len(segments)-1], ".git")
+	// A revision's URL ends in the revision, after the ID
+	if len(segments) >= 3 && len(segments[len(segments)-1]) == 40 {
+		id = segments[len(segments)-2]
+	}
+	if !gistID.MatchString(id) {
+		return "", errors.New("not a gist URL or ID")
+	}
+	return id, nil
+}
+
+// FileName is the name path is kept under in a gist: its slashes, and the
+// percent signs that escape them, are percent-escaped
+func FileName(path string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(path, "%", "%25"), "/", "%2F")
+}
+
+// PathOf is the workspace path of a gist's file, undoing FileName
+func PathOf(name string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(name, "%2F", "/"), "%25", "%")
+}
+
+// apiFile and apiGist are what the API says of a gist
+type apiFile struct {
+	Content   *string `json:"content,omitempty"`
+	Truncated bool    `json:"truncated,omitempty"`
+	RawURL    string  `json:"raw_url,omitempty"`
+}
+
+type apiGist struct {
+	ID          string              `json:"id"`
+	HTMLURL     string              `json:"html_url"`
+	Description string              `json:"description"`
+	Files       map[string]*apiFile `json:"files"`
+	Truncated   bool                `json:"truncated"`
+	Owner       *struct {
+		Login string `json:"login"`
+	} `json:"owner"`
+}
+
+func (g *apiGist) gist() *Gist {
+	out := &Gist{ID: g.ID, URL: g.HTMLURL, Description: g.Description, Truncated: g.Truncated}
+	if g.Owner != nil {
+		out.Owner = g.Owner.Login
+	}
+	for name, file := range g.Files {
+		if file != nil && file.Content != nil {
+			out.Files = append(out.Files, File{Path: PathOf(name), Content: *file.Content})
+		}
+	}
+	sort.Slice(out.Files, func(i, j int) bool { return out.Files[i].Path < out.Files[j].Path })
+	return out
+}
+
+// do sends a request to the API and decodes its answer into out
+func (c *Client) do(ctx context.Context, method, path, token string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := apiError(resp); err != nil {
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// apiError makes a failed response into an error
+func apiError(resp *http.Response) error {
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+		return ErrAuth
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	}
+	var body struct {
+		Message string `json:"message"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body)
+	if body.Message == "" {
+		body.Message = resp.Status
+	}
+	return fmt.Errorf("GitHub answered %d: %s", resp.StatusCode, body.Message)
+}
+
+// Get reads a gist, fetching in full the files too large for the API to
+// return with it
+func (c *Client) Get(ctx context.Context, id, token string) (*Gist, error) {
+	var g apiGist
+	if err := c.do(ctx, http.MethodGet, "/gists/"+url.PathEscape(id), token, nil, &g); err != nil {
+		return nil, err
+	}
+	for name, file := range g.Files {
+		if file == nil || !file.Truncated || file.RawURL == "" {
+			continue
+		}
+		content, err := c.raw(ctx, file.RawURL, token)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", name, err)
+		}
+		file.Content = &content
+	}
+	return g.gist(), nil
+}
+
+// raw fetches a file's content from its raw URL
+func (c *Client) raw(ctx context.Context, rawURL, token string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := apiError(resp); err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxFileBytes+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxFileBytes {
+		return "", fmt.Errorf("larger than %d bytes", maxFileBytes)
+	}
+	return string(data), nil
+}
+
+// Create makes a gist of files, which mustn't be empty, as the token's
+// owner
+func (c *Client) Create(ctx context.Context, token, description string, public bool, files []File) (*Gist, error) {
+	body := struct {
+		Description string                       `json:"description"`
+		Public      bool                         `json:"public"`
+		Files       map[string]map[string]string `json:"files"`
+	}{Description: description, Public: public, Files: make(map[string]map[string]string, len(files))}
+	for _, file := range files {
+		body.Files[FileName(file.Path)] = map[string]string{"content": file.Content}
+	}
+	var g apiGist
+	if err := c.do(ctx, http.MethodPost, "/gists", token, body, &g); err != nil {
+		return nil, err
+	}
+	return g.gist(), nil
+}
@@ -0,0 +1,266 @@
+// Package gitrepo clones Git repositories and pushes commits to them over
+// HTTPS, running git. The caller's token goes in an Authorization header
+// set through the environment, so it is neither in the URL nor on the
+// command line, and nothing is kept once an operation is done: every
+// clone and commit works in a directory of its own, which the caller
+// removes.
+package gitrepo
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	// ErrAuth is returned when the host refuses the token
+	ErrAuth = errors.New("the repository refused the token")
+	// ErrNotFound is returned for repositories and branches that don't
+	// exist, or that the token can't see
+	ErrNotFound = errors.New("repository or branch not found")
+	// ErrConflict is returned when the branch moved on since the commit
+	// being built on
+	ErrConflict = errors.New("the branch has commits that aren't in the session")
+	// ErrNothingToCommit is returned when the files are as they were
+	ErrNothingToCommit = errors.New("nothing to commit")
+)
+
+// Remote is a repository and the token to reach it with
+type Remote struct {
+	URL   string
+	Token string
+}
+
+// ParseURL checks that rawURL is the HTTPS URL of a repository on one of
+// hosts
+func ParseURL(rawURL string, hosts []string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" || u.User != nil || strings.Trim(u.Path, "/") == "" {
+		return "", errors.New("the repository must be an https:// URL without credentials")
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range hosts {
+		if host == allowed {
+			u.RawQuery, u.Fragment = "", ""
+			return u.String(), nil
+		}
+	}
+	return "", fmt.Errorf("repositories on %s can't be used", host)
+}
+
+var branchName = regexp.MustCompile(`^[A-Za-z0-9._/-]+$`)
+
+// ValidBranch reports whether name may be used as a branch
+func ValidBranch(name string) bool {
+	return branchName.MatchString(name) && !strings.HasPrefix(name, "-") && !strings.HasPrefix(name, "/") &&
+		!strings.HasSuffix(name, "/") && !strings.HasSuffix(name, ".lock") && !strings.Contains(name, "..") &&
+		!strings.Contains(name, "//")
+}
+
+// username is what the token is sent as the password of: hosts take any
+// name with a token, but GitLab documents oauth2 and GitHub x-access-token
+func (r Remote) username() string {
+	if u, err := url.Parse(r.URL); err == nil && strings.Contains(u.Hostname(), "gitlab") {
+		return "oauth2"
+	}
+	return "x-access-token"
+}
+
+// passedOn are the variables git gets from the server's environment, for
+// reaching hosts through proxies and trusting their certificates
+var passedOn = []string{"HTTPS_PROXY", "https_proxy", "NO_PROXY", "no_proxy", "SSL_CERT_FILE", "SSL_CERT_DIR", "GIT_SSL_CAINFO"}
+
+// env is the environment git runs in: no prompts, no configuration but
+// its own, HTTPS only, and the token as a header
+func (r Remote) env() []string {
+	env := []string{
+		"PATH=" + os.Getenv("PATH"),
+		"HOME=" + os.TempDir(),
+		"GIT_TERMINAL_PROMPT=0",
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_ALLOW_PROTOCOL=https",
+	}
+	for _, name := range passedOn {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	if r.Token != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(r.username() + ":" + r.Token))
+		env = append(env,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic "+credentials,
+		)
+	}
+	return env
+}
+
+// git runs git in dir and returns what it printed
+func (r Remote) git(ctx context.Context, dir string, args ...string) (string, error) {
+	return r.run(ctx, dir, nil, args...)
+}
+
+// run runs git in dir with env added to its environment
+func (r Remote) run(ctx context.Context, dir string, env []string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(r.env(), env...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", gitError(args[0], stderr.String(), err)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// gitError makes what git said of a failure into an error
+func gitError(command, stderr string, err error) error {
+	lower := strings.ToLower(stderr)
+	switch {
+	case strings.Contains(lower, "authentication failed"), strings.Contains(lower, "could not read username"),
+		strings.Contains(lower, "returned error: 401"), strings.Contains(lower, "returned error: 403"):
+		return ErrAuth
+	case strings.Contains(lower, "not found"), strings.Contains(lower, "returned error: 404"),
+		strings.Contains(lower, "couldn't find remote ref"):
+		return ErrNotFound
+	case strings.Contains(lower, "non-fast-forward"), strings.Contains(lower, "fetch first"):
+		return ErrConflict
+	}
+	message := strings.TrimSpace(stderr)
+	if i := strings.LastIndex(message, "\n"); i >= 0 {
+		message = message[i+1:]
+	}
+	if message == "" {
+		message = err.Error()
+	}
+	return fmt.Errorf("git %s: %s", command, strings.TrimPrefix(message, "fatal: "))
+}
+
+// Clone fetches the latest commit of branch, or of the default branch if
+// it's "", into dir, which must be empty. It returns the commit and the
+// branch it is on.
+func Clone(ctx context.Context, remote Remote, branch, dir string) (commit, cloned string, err error) {
+	args := []string{"clone", "--quiet", "--depth=1", "--single-branch", "--no-tags"}
+	if branch != "" {
+		args = append(args, "--branch", branch)
+	}
+	if _, err := remote.git(ctx, dir, append(args, "--", remote.URL, ".")...); err != nil {
+		return "", "", err
+	}
+	if commit, err = remote.git(ctx, dir, "rev-parse", "HEAD"); err != nil {
+		return "", "", err
+	}
+	if cloned, err = remote.git(ctx, dir, "symbolic-ref", "--short", "HEAD"); err != nil {
+		return "", "", err
+	}
+	return commit, cloned, nil
+}
+
+// File is a file of a checkout
+type File struct {
+	Path string
+	Data []byte
+}
+
+// Files returns the files checked out in dir, leaving out .git and
+// symlinks, in lexical order
+func Files(dir string) ([]File, error) {
+	var files []File
+	err := filepath.WalkDir(dir, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() && entry.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		files = append(files, File{Path: filepath.ToSlash(rel), Data: data})
+		return nil
+	})
+	return files, err
+}
+
+// Commit is a commit to build on Base and push to Branch: Files are
+// written over those of Base and Deleted removed
+type Commit struct {
+	Base        string
+	Branch      string
+	Message     string
+	AuthorName  string
+	AuthorEmail string
+	Files       []File
+	Deleted     []string
+}
+
+// Push makes commit in dir, which must be empty, and pushes it. It returns
+// the new commit.
+func Push(ctx context.Context, remote Remote, dir string, commit Commit) (string, error) {
+	steps := [][]string{
+		{"init", "--quiet"},
+		{"fetch", "--quiet", "--depth=1", "--no-tags", "--", remote.URL, commit.Base},
+		{"checkout", "--quiet", "--detach", "FETCH_HEAD"},
+	}
+	for _, args := range steps {
+		if _, err := remote.git(ctx, dir, args...); err != nil {
+			return "", err
+		}
+	}
+
+	for _, file := range commit.Files {
+		name := filepath.Join(dir, filepath.FromSlash(file.Path))
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(name, file.Data, 0o644); err != nil {
+			return "", err
+		}
+	}
+	for _, deleted := range commit.Deleted {
+		if err := os.Remove(filepath.Join(dir, filepath.FromSlash(deleted))); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+	}
+	if _, err := remote.git(ctx, dir, "add", "--all"); err != nil {
+		return "", err
+	}
+	if status, err := remote.git(ctx, dir, "status", "--porcelain"); err != nil {
+		return "", err
+	} else if status == "" {
+		return "", ErrNothingToCommit
+	}
+
+	identity := []string{
+		"GIT_AUTHOR_NAME=" + commit.AuthorName, "GIT_AUTHOR_EMAIL=" + commit.AuthorEmail,
+		"GIT_COMMITTER_NAME=" + commit.AuthorName, "GIT_COMMITTER_EMAIL=" + commit.AuthorEmail,
+	}
+	if _, err := remote.run(ctx, dir, identity, "commit", "--quiet", "--no-verify", "-m", commit.Message); err != nil {
+		return "", err
+	}
+	if _, err := remote.git(ctx, dir, "push", "--quiet", "--", remote.URL, "HEAD:refs/heads/"+commit.Branch); err != nil {
+		return "", err
+	}
+	return remote.git(ctx, dir, "rev-parse", "HEAD")
+}
@@ -0,0 +1,4 @@
+// Package grammars parses source files with tree-sitter, for the outline
+// and highlight packages. Tree-sitter is C, so the package is empty in
+// builds without cgo, where those packages fall back to line rules.
+package grammars
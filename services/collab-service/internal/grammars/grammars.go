@@ -0,0 +1,55 @@
+//go:build cgo
+
+package grammars
+
+import (
+	"context"
+
+	sitter "github.com/smacker/go-tree-sitter"
+	"github.com/smacker/go-tree-sitter/c"
+	"github.com/smacker/go-tree-sitter/cpp"
+	"github.com/smacker/go-tree-sitter/elixir"
+	"github.com/smacker/go-tree-sitter/golang"
+	"github.com/smacker/go-tree-sitter/java"
+	"github.com/smacker/go-tree-sitter/javascript"
+	"github.com/smacker/go-tree-sitter/python"
+	"github.com/smacker/go-tree-sitter/rust"
+	"github.com/smacker/go-tree-sitter/typescript/typescript"
+)
+
+// languages are the grammars, by the language names the outline package
+// guesses from file extensions
+var languages = map[string]*sitter.Language{
+	"go":         golang.GetLanguage(),
+	"python":     python.GetLanguage(),
+	"javascript": javascript.GetLanguage(),
+	"typescript": typescript.GetLanguage(),
+	"rust":       rust.GetLanguage(),
+	"java":       java.GetLanguage(),
+	"c":          c.GetLanguage(),
+	"cpp":        cpp.GetLanguage(),
+	"elixir":     elixir.GetLanguage(),
+}
+
+// Language returns the grammar of language, or nil if there is none
+func Language(language string) *sitter.Language {
+	return languages[language]
+}
+
+// Parse returns the syntax tree of content, which the caller closes, or
+// nil if language has no grammar. A parse always succeeds; what doesn't
+// parse becomes ERROR nodes.
+func Parse(language string, content []byte) *sitter.Tree {
+	lang := languages[language]
+	if lang == nil {
+		return nil
+	}
+	parser := sitter.NewParser()
+	defer parser.Close()
+	parser.SetLanguage(lang)
+	tree, err := parser.ParseCtx(context.Background(), nil, content)
+	if err != nil {
+		return nil
+	}
+	return tree
+}
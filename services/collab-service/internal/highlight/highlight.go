@@ -0,0 +1,287 @@
+// Package highlight produces syntax highlighting token ranges for thin
+// clients that don't ship their own highlighter: keywords, strings,
+// comments and numbers. Languages with a tree-sitter grammar are
+// highlighted from their syntax tree; the others, and all of them in
+// builds without cgo, by a small lexer.
+package highlight
+
+import (
+	"sort"
+	"strings"
+)
+
+// Token types
+const (
+	TypeKeyword = "keyword"
+	TypeString  = "string"
+	TypeComment = "comment"
+	TypeNumber  = "number"
+)
+
+// Token is a highlighted range on a single line. Line and Column are
+// 1-based; Column and Length count bytes.
+type Token struct {
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+	Length int    `json:"length"`
+	Type   string `json:"type"`
+}
+
+type syntax struct {
+	lineComments []string
+	blockComment [2]string
+	// quotes are string delimiters that end at the next newline
+	quotes string
+	// multilineQuotes are string delimiters that may span lines
+	multilineQuotes string
+	tripleQuotes    bool
+	keywords        map[string]bool
+}
+
+func words(list string) map[string]bool {
+	set := make(map[string]bool)
+	for _, word := range strings.Fields(list) {
+		set[word] = true
+	}
+	return set
+}
+
+var cStyle = [2]string{"/*", "*/"}
+
+var jsKeywords = "async await break case catch class const continue debugger default delete do else export extends false finally for from function if import in instanceof let new null of return static super switch this throw true try typeof undefined var void while yield"
+
+var cKeywords = "auto break case char const continue default do double else enum extern float for goto if inline int long register return short signed sizeof static struct switch typedef union unsigned void volatile while NULL true false"
+
+var languages = map[string]syntax{
+	"go": {
+		lineComments:    []string{"//"},
+		blockComment:    cStyle,
+		quotes:          `"'`,
+		multilineQuotes: "`",
+		keywords:        words("break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var nil true false iota"),
+	},
+	"python": {
+		lineComments: []string{"#"},
+		quotes:       `"'`,
+		tripleQuotes: true,
+		keywords:     words("and as assert async await break class continue def del elif else except False finally for from global if import in is lambda None nonlocal not or pass raise return True try while with yield self"),
+	},
+	"javascript": {
+		lineComments:    []string{"//"},
+		blockComment:    cStyle,
+		quotes:          `"'`,
+		multilineQuotes: "`",
+		keywords:        words(jsKeywords),
+	},
+	"typescript": {
+		lineComments:    []string{"//"},
+		blockComment:    cStyle,
+		quotes:          `"'`,
+		multilineQuotes: "`",
+		keywords:        words(jsKeywords + " abstract any as boolean declare enum implements interface keyof namespace never number private protected public readonly string type unknown"),
+	},
+	"rust": {
+		lineComments: []string{"//"},
+		blockComment: cStyle,
+		quotes:       `"`,
+		keywords:     words("as async await break const continue crate dyn else enum extern false fn for if impl in let loop match mod move mut pub ref return self Self static struct super trait true type unsafe use where while"),
+	},
+	"java": {
+		lineComments: []string{"//"},
+		blockComment: cStyle,
+		quotes:       `"'`,
+		keywords:     words("abstract boolean break byte case catch char class const continue default do double else enum extends final finally float for if implements import instanceof int interface long new null package private protected public return short static super switch synchronized this throw throws try void volatile while true false var"),
+	},
+	"c": {
+		lineComments: []string{"//"},
+		blockComment: cStyle,
+		quotes:       `"'`,
+		keywords:     words(cKeywords),
+	},
+	"cpp": {
+		lineComments: []string{"//"},
+		blockComment: cStyle,
+		quotes:       `"'`,
+		keywords:     words(cKeywords + " bool catch class constexpr delete explicit friend mutable namespace new noexcept nullptr operator override private protected public template this throw try typename using virtual"),
+	},
+	"zig": {
+		lineComments: []string{"//"},
+		quotes:       `"'`,
+		keywords:     words("align and anyerror break catch comptime const continue defer else enum errdefer error export extern false fn for if inline null or orelse packed pub return struct switch test true try undefined union unreachable var while"),
+	},
+	"elixir": {
+		lineComments: []string{"#"},
+		quotes:       `"'`,
+		tripleQuotes: true,
+		keywords:     words("after alias and case catch cond def defmodule defp defstruct do else end false fn for if import in nil not or quote raise receive require rescue true try unless use when with"),
+	},
+	"v": {
+		lineComments:    []string{"//"},
+		blockComment:    cStyle,
+		quotes:          `"'`,
+		multilineQuotes: "`",
+		keywords:        words("as assert break const continue defer else enum false fn for go if import in interface is match module mut none or pub return select struct true type unsafe"),
+	},
+}
+
+// Supported reports whether tokens can be produced for language
+func Supported(language string) bool {
+	_, ok := languages[language]
+	return ok
+}
+
+// tokenList collects the tokens of content, split at line ends
+type tokenList struct {
+	content    string
+	lineStarts []int
+	tokens     []Token
+}
+
+func newTokenList(content string) *tokenList {
+	lineStarts := []int{0}
+	for i := 0; i < len(content); i++ {
+		if content[i] == '\n' {
+			lineStarts = append(lineStarts, i+1)
+		}
+	}
+	return &tokenList{content: content, lineStarts: lineStarts, tokens: []Token{}}
+}
+
+// emit adds a token for content[start:end], one per line it spans
+func (l *tokenList) emit(start, end int, tokenType string) {
+	for start < end {
+		line := sort.Search(len(l.lineStarts), func(i int) bool { return l.lineStarts[i] > start }) - 1
+		lineEnd := end
+		if nl := strings.IndexByte(l.content[start:end], '\n'); nl >= 0 {
+			lineEnd = start + nl
+		}
+		if lineEnd > start {
+			l.tokens = append(l.tokens, Token{
+				Line:   line + 1,
+				Column: start - l.lineStarts[line] + 1,
+				Length: lineEnd - start,
+				Type:   tokenType,
+			})
+		}
+		start = lineEnd + 1
+	}
+}
+
+// Tokenize returns the highlight tokens of content in document order.
+// Strings and comments spanning several lines are split into one token per
+// line.
+func Tokenize(language, content string) []Token {
+	lang, ok := languages[language]
+	if !ok {
+		return nil
+	}
+	if tokens, ok := parse(lang, language, content); ok {
+		return tokens
+	}
+
+	list := newTokenList(content)
+	emit := list.emit
+
+	for i := 0; i < len(content); {
+		rest := content[i:]
+
+		if open := lang.blockComment[0]; open != "" && strings.HasPrefix(rest, open) {
+			end := len(content)
+			if idx := strings.Index(content[i+len(open):], lang.blockComment[1]); idx >= 0 {
+				end = i + len(open) + idx + len(lang.blockComment[1])
+			}
+			emit(i, end, TypeComment)
+			i = end
+			continue
+		}
+
+		if lineComment(lang, rest) {
+			end := len(content)
+			if idx := strings.IndexByte(rest, '\n'); idx >= 0 {
+				end = i + idx
+			}
+			emit(i, end, TypeComment)
+			i = end
+			continue
+		}
+
+		c := rest[0]
+		if lang.tripleQuotes && (strings.HasPrefix(rest, `"""`) || strings.HasPrefix(rest, `'''`)) {
+			end := len(content)
+			if idx := strings.Index(content[i+3:], rest[:3]); idx >= 0 {
+				end = i + 3 + idx + 3
+			}
+			emit(i, end, TypeString)
+			i = end
+			continue
+		}
+		if strings.IndexByte(lang.quotes, c) >= 0 || strings.IndexByte(lang.multilineQuotes, c) >= 0 {
+			multiline := strings.IndexByte(lang.multilineQuotes, c) >= 0
+			end := scanString(content, i, c, multiline)
+			emit(i, end, TypeString)
+			i = end
+			continue
+		}
+
+		if isDigit(c) && (i == 0 || !isIdent(content[i-1])) {
+			end := i + 1
+			for end < len(content) && (isIdent(content[end]) || content[end] == '.') {
+				end++
+			}
+			emit(i, end, TypeNumber)
+			i = end
+			continue
+		}
+
+		if isIdentStart(c) {
+			end := i + 1
+			for end < len(content) && isIdent(content[end]) {
+				end++
+			}
+			if lang.keywords[content[i:end]] {
+				emit(i, end, TypeKeyword)
+			}
+			i = end
+			continue
+		}
+
+		i++
+	}
+	return list.tokens
+}
+
+func lineComment(lang syntax, rest string) bool {
+	for _, prefix := range lang.lineComments {
+		if strings.HasPrefix(rest, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanString returns the offset just past the string starting at start
+func scanString(content string, start int, quote byte, multiline bool) int {
+	for i := start + 1; i < len(content); i++ {
+		switch content[i] {
+		case '\\':
+			if quote != '`' {
+				i++
+			}
+		case '\n':
+			if !multiline {
+				return i
+			}
+		case quote:
+			return i + 1
+		}
+	}
+	return len(content)
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdent(c byte) bool { return isIdentStart(c) || isDigit(c) }
@@ -0,0 +1,79 @@
+//go:build cgo
+
+package highlight
+
+import (
+	"strings"
+
+	"github.com/codecollab/collab-service/internal/grammars"
+	sitter "github.com/smacker/go-tree-sitter"
+)
+
+// stringTypes are the syntax nodes of string literals across the grammars,
+// besides those named *string_literal
+var stringTypes = words("string template_string regex char_literal character_literal rune_literal text_block charlist sigil system_lib_string")
+
+// numberTypes are the syntax nodes of number literals across the grammars,
+// besides Java's *integer_literal and *floating_point_literal
+var numberTypes = words("number integer float int_literal float_literal imaginary_literal number_literal integer_literal")
+
+// parse highlights content from its tree-sitter syntax tree, and reports
+// whether language has a grammar. The grammar's own keywords are the
+// unnamed words in the tree; lang's keywords add the names that act as
+// keywords, such as nil or Elixir's def.
+func parse(lang syntax, language, content string) ([]Token, bool) {
+	src := []byte(content)
+	tree := grammars.Parse(language, src)
+	if tree == nil {
+		return nil, false
+	}
+	defer tree.Close()
+
+	list := newTokenList(content)
+	cursor := sitter.NewTreeCursor(tree.RootNode())
+	defer cursor.Close()
+	for {
+		node := cursor.CurrentNode()
+		tokenType := classify(node, src, lang.keywords)
+		if tokenType != "" {
+			list.emit(int(node.StartByte()), int(node.EndByte()), tokenType)
+		} else if cursor.GoToFirstChild() {
+			continue
+		}
+		for !cursor.GoToNextSibling() {
+			if !cursor.GoToParent() {
+				return list.tokens, true
+			}
+		}
+	}
+}
+
+// classify returns the token type of a syntax node, or "" for one that is
+// none, whose children may be
+func classify(node *sitter.Node, src []byte, keywords map[string]bool) string {
+	nodeType := node.Type()
+	switch {
+	case strings.Contains(nodeType, "comment"):
+		return TypeComment
+	case stringTypes[nodeType] || strings.HasSuffix(nodeType, "string_literal"):
+		return TypeString
+	case node.ChildCount() > 0:
+		return ""
+	case numberTypes[nodeType] || strings.HasSuffix(nodeType, "integer_literal") || strings.HasSuffix(nodeType, "floating_point_literal"):
+		return TypeNumber
+	case !node.IsNamed() && isWord(nodeType):
+		return TypeKeyword
+	case node.IsNamed() && keywords[node.Content(src)]:
+		return TypeKeyword
+	}
+	return ""
+}
+
+func isWord(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isIdentStart(s[i]) {
+			return false
+		}
+	}
+	return s != ""
+}
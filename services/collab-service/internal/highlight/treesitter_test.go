@@ -0,0 +1,59 @@
+//go:build cgo
+
+package highlight
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenizeFromSyntaxTree(t *testing.T) {
+	tests := []struct {
+		name     string
+		language string
+		content  string
+		want     []Token
+	}{
+		{
+			"go raw strings span lines", "go",
+			"var s = `if\nelse`",
+			[]Token{
+				{Line: 1, Column: 1, Length: 3, Type: TypeKeyword},
+				{Line: 1, Column: 9, Length: 3, Type: TypeString},
+				{Line: 2, Column: 1, Length: 5, Type: TypeString},
+			},
+		},
+		{
+			"javascript regular expressions are literals", "javascript",
+			"x = /\"/g; // y",
+			[]Token{
+				{Line: 1, Column: 5, Length: 4, Type: TypeString},
+				{Line: 1, Column: 11, Length: 4, Type: TypeComment},
+			},
+		},
+		{
+			"rust raw strings and lifetimes", "rust",
+			"fn f<'a>() -> &'a str { r#\"\"\"#; 0x2a }",
+			[]Token{
+				{Line: 1, Column: 1, Length: 2, Type: TypeKeyword},
+				{Line: 1, Column: 25, Length: 6, Type: TypeString},
+				{Line: 1, Column: 33, Length: 4, Type: TypeNumber},
+			},
+		},
+		{
+			"elixir definitions are keywords", "elixir",
+			"def f, do: nil",
+			[]Token{
+				{Line: 1, Column: 1, Length: 3, Type: TypeKeyword},
+				{Line: 1, Column: 12, Length: 3, Type: TypeKeyword},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Tokenize(tt.language, tt.content); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
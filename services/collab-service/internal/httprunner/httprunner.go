@@ -0,0 +1,243 @@
+// Package httprunner sends HTTP requests on behalf of session participants.
+// Requests may only reach public addresses so the service can't be used to
+// probe its own network.
+package httprunner
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrBlockedAddress is returned when a request resolves to an address that
+// isn't publicly routable
+var ErrBlockedAddress = errors.New("destination address is not allowed")
+
+const maxRedirects = 5
+
+// Request is an HTTP request defined in a session
+type Request struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
+
+// Response is what came back. Duration is in milliseconds.
+type Response struct {
+	Status     int                 `json:"status"`
+	StatusText string              `json:"statusText"`
+	Headers    map[string][]string `json:"headers,omitempty"`
+	Body       string              `json:"body,omitempty"`
+	Truncated  bool                `json:"truncated,omitempty"`
+	Duration   int64               `json:"duration"`
+}
+
+// Options configure a Runner
+type Options struct {
+	Timeout      time.Duration
+	MaxBodyBytes int64
+	// AllowPrivate lifts the address restrictions, for local development
+	AllowPrivate bool
+}
+
+// Runner executes requests
+type Runner struct {
+	client  *http.Client
+	maxBody int64
+}
+
+// NewRunner returns a runner that enforces opts
+func NewRunner(opts Options) *Runner {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if !opts.AllowPrivate {
+		// Checking the address being dialled, rather than the hostname in
+		// the URL, also covers DNS rebinding and redirects
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !IsPublic(ip) {
+				return fmt.Errorf("%w: %s", ErrBlockedAddress, host)
+			}
+			return nil
+		}
+	}
+
+	transport := &http.Transport{
+		// Never route through an environment proxy, which would bypass the
+		// address checks
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: opts.Timeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	}
+
+	return &Runner{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   opts.Timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= maxRedirects {
+					return fmt.Errorf("stopped after %d redirects", maxRedirects)
+				}
+				return checkScheme(req.URL)
+			},
+		},
+		maxBody: opts.MaxBodyBytes,
+	}
+}
+
+// IsPublic reports whether ip is a globally routable unicast address
+func IsPublic(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		// Carrier-grade NAT, 100.64.0.0/10
+		if ip4[0] == 100 && ip4[1]&0xc0 == 64 {
+			return false
+		}
+		// Broadcast and the reserved 240.0.0.0/4 block
+		if ip4[0] >= 240 {
+			return false
+		}
+	}
+	return true
+}
+
+func checkScheme(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	return nil
+}
+
+// Do sends req and reads up to the configured number of body bytes
+func (r *Runner) Do(ctx context.Context, req Request) (*Response, error) {
+	method := strings.ToUpper(strings.TrimSpace(req.Method))
+	if method == "" {
+		method = http.MethodGet
+	}
+	target, err := url.Parse(strings.TrimSpace(req.URL))
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %w", err)
+	}
+	if err := checkScheme(target); err != nil {
+		return nil, err
+	}
+	if target.Host == "" {
+		return nil, fmt.Errorf("url must include a host")
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, method, target.String(), strings.NewReader(req.Body))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range req.Headers {
+		httpReq.Header.Set(name, value)
+	}
+	if host := httpReq.Header.Get("Host"); host != "" {
+		httpReq.Host = host
+	}
+
+	start := time.Now()
+	resp, err := r.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	reader := io.Reader(resp.Body)
+	if r.maxBody > 0 {
+		reader = io.LimitReader(resp.Body, r.maxBody+1)
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	truncated := r.maxBody > 0 && int64(len(body)) > r.maxBody
+	if truncated {
+		body = body[:r.maxBody]
+	}
+
+	return &Response{
+		Status:     resp.StatusCode,
+		StatusText: http.StatusText(resp.StatusCode),
+		Headers:    resp.Header,
+		Body:       strings.ToValidUTF8(string(body), "\uFFFD"),
+		Truncated:  truncated,
+		Duration:   time.Since(start).Milliseconds(),
+	}, nil
+}
+
+// Parse reads the first request from a .http file: a request line
+// ("METHOD URL"), header lines, a blank line and the body. Lines starting
+// with # or // are comments, and ### separates requests.
+func Parse(text string) (Request, error) {
+	var req Request
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var body []string
+	inBody := false
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "###") {
+			if req.URL != "" {
+				break
+			}
+			continue
+		}
+
+		switch {
+		case inBody:
+			body = append(body, line)
+		case strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, "//"):
+		case req.URL == "":
+			if trimmed == "" {
+				continue
+			}
+			fields := strings.Fields(trimmed)
+			if len(fields) == 1 {
+				req.Method, req.URL = http.MethodGet, fields[0]
+			} else {
+				req.Method, req.URL = strings.ToUpper(fields[0]), fields[1]
+			}
+		case trimmed == "":
+			inBody = true
+		default:
+			name, value, ok := strings.Cut(line, ":")
+			if !ok {
+				return req, fmt.Errorf("invalid header line: %q", line)
+			}
+			if req.Headers == nil {
+				req.Headers = make(map[string]string)
+			}
+			req.Headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return req, err
+	}
+	if req.URL == "" {
+		return req, fmt.Errorf("no request found")
+	}
+	req.Body = strings.TrimRight(strings.Join(body, "\n"), "\n")
+	return req, nil
+}
@@ -0,0 +1,213 @@
+// Package i18n translates server-generated text for clients that declare a
+// locale. Catalogs are keyed by the English message written in the code,
+// with the same %s, %d and %q verbs in the same order in the translation,
+// so messages are written once in English and looked up when sent.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Default is the locale of the messages in the code
+const Default = "en"
+
+//go:embed catalogs/*.json
+var catalogFiles embed.FS
+
+// verbRe matches the formatting verbs a message may contain
+var verbRe = regexp.MustCompile(`%[sdqv]`)
+
+// Catalogs holds every locale's translations
+type Catalogs struct {
+	locales map[string]*catalog
+}
+
+type catalog struct {
+	exact    map[string]string
+	patterns []pattern
+}
+
+// pattern matches a formatted message and rebuilds it in another language
+type pattern struct {
+	re          *regexp.Regexp
+	translation string
+}
+
+// Load parses the built-in catalogs
+func Load() (*Catalogs, error) {
+	entries, err := catalogFiles.ReadDir("catalogs")
+	if err != nil {
+		return nil, err
+	}
+	c := &Catalogs{locales: make(map[string]*catalog)}
+	for _, entry := range entries {
+		data, err := catalogFiles.ReadFile("catalogs/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		locale := strings.TrimSuffix(entry.Name(), path.Ext(entry.Name()))
+		parsed, err := parseCatalog(data)
+		if err != nil {
+			return nil, fmt.Errorf("catalog %s: %w", locale, err)
+		}
+		c.locales[locale] = parsed
+	}
+	return c, nil
+}
+
+func parseCatalog(data []byte) (*catalog, error) {
+	var messages map[string]string
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return nil, err
+	}
+
+	cat := &catalog{exact: make(map[string]string)}
+	for source, translation := range messages {
+		verbs := verbRe.FindAllString(source, -1)
+		if !slices.Equal(verbs, verbRe.FindAllString(translation, -1)) {
+			return nil, fmt.Errorf("%q: translation must use the verbs %v in order", source, verbs)
+		}
+		if len(verbs) == 0 {
+			cat.exact[source] = translation
+			continue
+		}
+
+		var expr strings.Builder
+		expr.WriteString("^")
+		last := 0
+		for _, loc := range verbRe.FindAllStringIndex(source, -1) {
+			expr.WriteString(regexp.QuoteMeta(source[last:loc[0]]))
+			if source[loc[1]-1] == 'd' {
+				expr.WriteString(`(-?\d+)`)
+			} else {
+				expr.WriteString(`(.+?)`)
+			}
+			last = loc[1]
+		}
+		expr.WriteString(regexp.QuoteMeta(source[last:]))
+		expr.WriteString("$")
+		cat.patterns = append(cat.patterns, pattern{re: regexp.MustCompile(expr.String()), translation: translation})
+	}
+	// Longer sources first, so the most specific pattern wins
+	sort.Slice(cat.patterns, func(i, j int) bool {
+		return len(cat.patterns[i].re.String()) > len(cat.patterns[j].re.String())
+	})
+	return cat, nil
+}
+
+// Locales lists the supported locales, including the default
+func (c *Catalogs) Locales() []string {
+	locales := []string{Default}
+	for locale := range c.locales {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales[1:])
+	return locales
+}
+
+// Negotiate picks the supported locale closest to the requested ones, in
+// order of preference. "pt-BR" falls back to "pt".
+func (c *Catalogs) Negotiate(requested ...string) string {
+	for _, locale := range requested {
+		locale = strings.ToLower(strings.TrimSpace(locale))
+		if locale == "" {
+			continue
+		}
+		for _, candidate := range []string{locale, strings.SplitN(strings.ReplaceAll(locale, "_", "-"), "-", 2)[0]} {
+			if candidate == Default {
+				return Default
+			}
+			if _, ok := c.locales[candidate]; ok {
+				return candidate
+			}
+		}
+	}
+	return Default
+}
+
+// ParseAcceptLanguage returns the locales of an Accept-Language header in
+// order of preference
+func ParseAcceptLanguage(header string) []string {
+	type weighted struct {
+		locale string
+		q      float64
+	}
+	var entries []weighted
+	for _, part := range strings.Split(header, ",") {
+		locale, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if locale == "" || locale == "*" {
+			continue
+		}
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if _, err := fmt.Sscanf(value, "%g", &q); err != nil {
+				continue
+			}
+		}
+		entries = append(entries, weighted{locale, q})
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].q > entries[j].q })
+	locales := make([]string, len(entries))
+	for i, entry := range entries {
+		locales[i] = entry.locale
+	}
+	return locales
+}
+
+// Translate returns text in locale. Messages wrapped with context, like
+// "task: file not found: x", are translated part by part. Text without a
+// translation is returned unchanged.
+func (c *Catalogs) Translate(locale, text string) string {
+	cat, ok := c.locales[locale]
+	if !ok || text == "" {
+		return text
+	}
+	if translated, ok := cat.translate(text); ok {
+		return translated
+	}
+
+	parts := strings.Split(text, ": ")
+	translatedAny := false
+	for i := 0; i < len(parts); i++ {
+		// Try the longest run of parts first, since a message may itself
+		// contain ": "
+		for j := len(parts); j > i; j-- {
+			if translated, ok := cat.translate(strings.Join(parts[i:j], ": ")); ok {
+				parts = append(parts[:i], append([]string{translated}, parts[j:]...)...)
+				translatedAny = true
+				break
+			}
+		}
+	}
+	if !translatedAny {
+		return text
+	}
+	return strings.Join(parts, ": ")
+}
+
+func (cat *catalog) translate(text string) (string, bool) {
+	if translated, ok := cat.exact[text]; ok {
+		return translated, true
+	}
+	for _, p := range cat.patterns {
+		match := p.re.FindStringSubmatch(text)
+		if match == nil {
+			continue
+		}
+		args := match[1:]
+		n := 0
+		return verbRe.ReplaceAllStringFunc(p.translation, func(string) string {
+			arg := args[n]
+			n++
+			return arg
+		}), true
+	}
+	return "", false
+}
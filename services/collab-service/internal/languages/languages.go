@@ -0,0 +1,433 @@
+// Package languages is the registry of runnable languages: how a source
+// file is named, compiled and run, and with which resources. A workspace
+// can override it, and define named tasks, with a .codecollab.yml file:
+//
+//	languages:
+//	  python:
+//	    run: python3 -X dev {file}
+//	    resources: large
+//	  ruby:
+//	    extensions: [.rb]
+//	    file: main.rb
+//	    run: ruby {file}
+//	    matrix:
+//	      - name: ruby-3.2
+//	        run: ruby3.2 {file}
+//	      - name: ruby-3.3
+//	        run: ruby3.3 {file}
+//	presets:
+//	  large:
+//	    timeout: 30
+//	    memory: 2048
+//	tasks:
+//	  test:
+//	    command: python3 -m pytest -q
+//	    description: Run the test suite
+//	    roles: [owner, editor, viewer]
+//
+// Commands run through sh in a fresh directory holding only the source
+// file; {file} expands to its name. Tasks run in a copy of the workspace.
+package languages
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultPreset is the resource preset of languages that don't name one
+const DefaultPreset = "default"
+
+// Resources bound a single run
+type Resources struct {
+	// Timeout is in seconds
+	Timeout  int `yaml:"timeout" json:"timeout"`
+	MemoryMB int `yaml:"memory" json:"memoryMb"`
+}
+
+// Variant is one entry of a build matrix. Empty commands fall back to the
+// language's own.
+type Variant struct {
+	Name    string `yaml:"name" json:"name"`
+	Compile string `yaml:"compile,omitempty" json:"compile,omitempty"`
+	Run     string `yaml:"run,omitempty" json:"run,omitempty"`
+}
+
+// Language describes how to run one language
+type Language struct {
+	Name       string   `yaml:"-" json:"name"`
+	Extensions []string `yaml:"extensions,omitempty" json:"extensions,omitempty"`
+	// File is the name the source is written to
+	File    string `yaml:"file,omitempty" json:"file,omitempty"`
+	Compile string `yaml:"compile,omitempty" json:"compile,omitempty"`
+	// Run is empty for languages the execution service runs with its own
+	// built-in handler
+	Run       string    `yaml:"run,omitempty" json:"run,omitempty"`
+	Resources string    `yaml:"resources,omitempty" json:"resources,omitempty"`
+	Matrix    []Variant `yaml:"matrix,omitempty" json:"matrix,omitempty"`
+}
+
+// Task is a named workspace command, like a package.json script
+type Task struct {
+	Name        string `yaml:"-" json:"name"`
+	Command     string `yaml:"command" json:"command"`
+	Description string `yaml:"description,omitempty" json:"description,omitempty"`
+	// Roles may run the task; the owner and editors when empty
+	Roles     []string `yaml:"roles,omitempty" json:"roles,omitempty"`
+	Resources string   `yaml:"resources,omitempty" json:"resources,omitempty"`
+}
+
+// Build is a fully resolved way of running a file
+type Build struct {
+	Language string
+	// Variant names the matrix entry, if any
+	Variant   string
+	File      string
+	Compile   string
+	Run       string
+	Resources Resources
+}
+
+// Registry maps language names and file extensions to languages
+type Registry struct {
+	languages  map[string]*Language
+	extensions map[string]string
+	presets    map[string]Resources
+	tasks      map[string]*Task
+}
+
+var builtins = []Language{
+	{Name: "python", Extensions: []string{".py"}, File: "main.py", Run: "python3 {file}"},
+	{Name: "javascript", Extensions: []string{".js", ".jsx", ".mjs"}, File: "main.js", Run: "node {file}"},
+	{Name: "typescript", Extensions: []string{".ts", ".tsx"}, File: "main.ts", Run: `ts-node --transpile-only --compiler-options '{"module":"commonjs"}' {file}`},
+	{Name: "rust", Extensions: []string{".rs"}, File: "main.rs", Compile: "rustc {file} -o main", Run: "./main"},
+	{Name: "go", Extensions: []string{".go"}, File: "main.go", Run: "go run {file}"},
+	{Name: "cpp", Extensions: []string{".cpp", ".cc", ".hpp"}, File: "main.cpp", Compile: "g++ {file} -o main -std=c++17", Run: "./main"},
+	// Java sources are named after their public class, which the execution
+	// service works out itself
+	{Name: "java", Extensions: []string{".java"}},
+	{Name: "c", Extensions: []string{".c", ".h"}, File: "main.c", Compile: "gcc {file} -o main", Run: "./main"},
+	{Name: "zig", Extensions: []string{".zig"}, File: "main.zig", Compile: "zig build-exe {file}", Run: "./main"},
+	{Name: "elixir", Extensions: []string{".ex", ".exs"}, File: "main.exs", Run: "elixir {file}"},
+	{Name: "v", Extensions: []string{".v"}, File: "main.v", Run: "v run {file}"},
+}
+
+// Default returns the built-in registry. defaultTimeout is the timeout of
+// the default preset, in seconds.
+func Default(defaultTimeout int) *Registry {
+	r := &Registry{
+		languages:  make(map[string]*Language),
+		extensions: make(map[string]string),
+		presets: map[string]Resources{
+			"small":       {Timeout: 5, MemoryMB: 256},
+			DefaultPreset: {Timeout: defaultTimeout, MemoryMB: 512},
+			"large":       {Timeout: 30, MemoryMB: 2048},
+		},
+		tasks: make(map[string]*Task),
+	}
+	for _, lang := range builtins {
+		r.add(lang)
+	}
+	return r
+}
+
+func (r *Registry) add(lang Language) {
+	if old, ok := r.languages[lang.Name]; ok {
+		for _, ext := range old.Extensions {
+			delete(r.extensions, ext)
+		}
+	}
+	r.languages[lang.Name] = &lang
+	for _, ext := range lang.Extensions {
+		// An extension moves to the language that claimed it last
+		if owner, ok := r.languages[r.extensions[ext]]; ok && owner.Name != lang.Name {
+			owner.Extensions = slices.DeleteFunc(owner.Extensions, func(e string) bool { return e == ext })
+		}
+		r.extensions[ext] = lang.Name
+	}
+}
+
+func (r *Registry) clone() *Registry {
+	c := &Registry{
+		languages:  make(map[string]*Language, len(r.languages)),
+		extensions: make(map[string]string, len(r.extensions)),
+		presets:    make(map[string]Resources, len(r.presets)),
+		tasks:      make(map[string]*Task, len(r.tasks)),
+	}
+	for name, lang := range r.languages {
+		copied := *lang
+		copied.Extensions = append([]string(nil), lang.Extensions...)
+		copied.Matrix = append([]Variant(nil), lang.Matrix...)
+		c.languages[name] = &copied
+	}
+	for ext, name := range r.extensions {
+		c.extensions[ext] = name
+	}
+	for name, preset := range r.presets {
+		c.presets[name] = preset
+	}
+	for name, task := range r.tasks {
+		copied := *task
+		copied.Roles = append([]string(nil), task.Roles...)
+		c.tasks[name] = &copied
+	}
+	return c
+}
+
+// Lookup returns the language called name
+func (r *Registry) Lookup(name string) (*Language, bool) {
+	lang, ok := r.languages[name]
+	return lang, ok
+}
+
+// Detect returns the language of a file from its extension
+func (r *Registry) Detect(filePath string) (*Language, bool) {
+	name, ok := r.extensions[strings.ToLower(path.Ext(filePath))]
+	if !ok {
+		return nil, false
+	}
+	return r.Lookup(name)
+}
+
+// Languages lists the registry sorted by name
+func (r *Registry) Languages() []Language {
+	langs := make([]Language, 0, len(r.languages))
+	for _, lang := range r.languages {
+		langs = append(langs, *lang)
+	}
+	sort.Slice(langs, func(i, j int) bool { return langs[i].Name < langs[j].Name })
+	return langs
+}
+
+// Task returns the task called name and the resources it runs with
+func (r *Registry) Task(name string) (*Task, Resources, bool) {
+	task, ok := r.tasks[name]
+	if !ok {
+		return nil, Resources{}, false
+	}
+	preset := task.Resources
+	if preset == "" {
+		preset = DefaultPreset
+	}
+	return task, r.presets[preset], true
+}
+
+// Tasks lists the workspace tasks sorted by name
+func (r *Registry) Tasks() []Task {
+	tasks := make([]Task, 0, len(r.tasks))
+	for _, task := range r.tasks {
+		tasks = append(tasks, *task)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].Name < tasks[j].Name })
+	return tasks
+}
+
+// Builds resolves the ways lang is run: one per matrix entry, or a single
+// build without a matrix
+func (r *Registry) Builds(lang *Language) []Build {
+	base := Build{
+		Language:  lang.Name,
+		File:      lang.File,
+		Compile:   expand(lang.Compile, lang.File),
+		Run:       expand(lang.Run, lang.File),
+		Resources: r.presets[presetName(lang)],
+	}
+	if len(lang.Matrix) == 0 {
+		return []Build{base}
+	}
+
+	builds := make([]Build, 0, len(lang.Matrix))
+	for _, variant := range lang.Matrix {
+		build := base
+		build.Variant = variant.Name
+		if variant.Compile != "" {
+			build.Compile = expand(variant.Compile, lang.File)
+		}
+		if variant.Run != "" {
+			build.Run = expand(variant.Run, lang.File)
+		}
+		builds = append(builds, build)
+	}
+	return builds
+}
+
+func presetName(lang *Language) string {
+	if lang.Resources == "" {
+		return DefaultPreset
+	}
+	return lang.Resources
+}
+
+func expand(command, file string) string {
+	return strings.ReplaceAll(command, "{file}", file)
+}
+
+// config is the shape of a .codecollab.yml file
+type config struct {
+	Languages map[string]Language  `yaml:"languages"`
+	Presets   map[string]Resources `yaml:"presets"`
+	Tasks     map[string]Task      `yaml:"tasks"`
+}
+
+// maxTasks bounds the tasks a workspace may define
+const maxTasks = 32
+
+var (
+	nameRe      = regexp.MustCompile(`^[a-z][a-z0-9+#-]{0,31}$`)
+	extensionRe = regexp.MustCompile(`^\.[a-z0-9+_-]{1,16}$`)
+	fileRe      = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]{0,63}$`)
+)
+
+// Override returns a copy of r with a workspace config applied. Fields set
+// in the config replace the built-in ones; new languages need a run
+// command. Preset timeouts may not exceed maxTimeout seconds.
+func (r *Registry) Override(data []byte, maxTimeout int) (*Registry, error) {
+	var cfg config
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	merged := r.clone()
+	for name, preset := range cfg.Presets {
+		if !nameRe.MatchString(name) {
+			return nil, fmt.Errorf("invalid preset name %q", name)
+		}
+		if preset.Timeout < 1 || preset.Timeout > maxTimeout {
+			return nil, fmt.Errorf("preset %s: timeout must be between 1 and %d seconds", name, maxTimeout)
+		}
+		if preset.MemoryMB < 16 {
+			return nil, fmt.Errorf("preset %s: memory must be at least 16 MB", name)
+		}
+		merged.presets[name] = preset
+	}
+
+	names := make([]string, 0, len(cfg.Languages))
+	for name := range cfg.Languages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lang, err := merged.overrideLanguage(name, cfg.Languages[name])
+		if err != nil {
+			return nil, fmt.Errorf("language %s: %w", name, err)
+		}
+		merged.add(lang)
+	}
+
+	if len(cfg.Tasks) > maxTasks {
+		return nil, fmt.Errorf("at most %d tasks may be defined", maxTasks)
+	}
+	for name, task := range cfg.Tasks {
+		if err := merged.validateTask(name, task); err != nil {
+			return nil, fmt.Errorf("task %s: %w", name, err)
+		}
+		task.Name = name
+		merged.tasks[name] = &task
+	}
+	return merged, nil
+}
+
+func (r *Registry) validateTask(name string, task Task) error {
+	if !nameRe.MatchString(name) {
+		return fmt.Errorf("invalid name")
+	}
+	if strings.TrimSpace(task.Command) == "" {
+		return fmt.Errorf("command is required")
+	}
+	for _, role := range task.Roles {
+		switch role {
+		case "owner", "editor", "viewer":
+		default:
+			return fmt.Errorf("unknown role %q", role)
+		}
+	}
+	if task.Resources != "" {
+		if _, ok := r.presets[task.Resources]; !ok {
+			return fmt.Errorf("unknown resource preset %q", task.Resources)
+		}
+	}
+	return nil
+}
+
+func (r *Registry) overrideLanguage(name string, override Language) (Language, error) {
+	if !nameRe.MatchString(name) {
+		return Language{}, fmt.Errorf("invalid name")
+	}
+
+	lang := Language{Name: name}
+	if existing, ok := r.languages[name]; ok {
+		lang = *existing
+	}
+	if override.Extensions != nil {
+		lang.Extensions = nil
+		for _, ext := range override.Extensions {
+			ext = strings.ToLower(ext)
+			if !extensionRe.MatchString(ext) {
+				return Language{}, fmt.Errorf("invalid extension %q", ext)
+			}
+			lang.Extensions = append(lang.Extensions, ext)
+		}
+	}
+	if override.File != "" {
+		if !fileRe.MatchString(override.File) {
+			return Language{}, fmt.Errorf("invalid file name %q", override.File)
+		}
+		lang.File = override.File
+	}
+	if override.Compile != "" {
+		lang.Compile = override.Compile
+	}
+	if override.Run != "" {
+		lang.Run = override.Run
+	}
+	if override.Resources != "" {
+		if _, ok := r.presets[override.Resources]; !ok {
+			return Language{}, fmt.Errorf("unknown resource preset %q", override.Resources)
+		}
+		lang.Resources = override.Resources
+	}
+	if override.Matrix != nil {
+		seen := make(map[string]bool, len(override.Matrix))
+		for _, variant := range override.Matrix {
+			if !nameRe.MatchString(variant.Name) {
+				return Language{}, fmt.Errorf("invalid matrix entry name %q", variant.Name)
+			}
+			if seen[variant.Name] {
+				return Language{}, fmt.Errorf("duplicate matrix entry %q", variant.Name)
+			}
+			seen[variant.Name] = true
+		}
+		if len(override.Matrix) > 8 {
+			return Language{}, fmt.Errorf("a build matrix may have at most 8 entries")
+		}
+		lang.Matrix = override.Matrix
+	}
+
+	if (lang.Compile != "" || lang.Run != "" || len(lang.Matrix) > 0) && lang.File == "" {
+		return Language{}, fmt.Errorf("file is required with custom commands")
+	}
+	if lang.Run == "" {
+		if lang.Compile != "" {
+			return Language{}, fmt.Errorf("run is required with compile")
+		}
+		if _, builtin := r.languages[name]; !builtin {
+			return Language{}, fmt.Errorf("run is required")
+		}
+		for _, variant := range lang.Matrix {
+			if variant.Run == "" {
+				return Language{}, fmt.Errorf("matrix entry %s needs a run command", variant.Name)
+			}
+		}
+	}
+	return lang, nil
+}
@@ -0,0 +1,210 @@
+package lint
+
+import (
+	"fmt"
+	"strings"
+)
+
+// syntax is what checking brackets in a language needs to know: where
+// comments and strings are, so the brackets in them are left alone
+type syntax struct {
+	lineComment  string
+	blockComment [2]string
+	// quotes are string delimiters that end at the next newline
+	quotes string
+	// multilineQuotes are string delimiters that may span lines
+	multilineQuotes string
+	tripleQuotes    bool
+	// charLiterals are single-quoted characters in a language whose single
+	// quotes otherwise mark lifetimes
+	charLiterals bool
+	// regexLiterals are /patterns/ where an operand may start
+	regexLiterals bool
+	// indentation matters, so mixing tabs and spaces in it is flagged
+	indentation bool
+}
+
+var cStyle = [2]string{"/*", "*/"}
+
+var languages = map[string]syntax{
+	"python":     {lineComment: "#", quotes: `"'`, tripleQuotes: true, indentation: true},
+	"javascript": {lineComment: "//", blockComment: cStyle, quotes: `"'`, multilineQuotes: "`", regexLiterals: true},
+	"typescript": {lineComment: "//", blockComment: cStyle, quotes: `"'`, multilineQuotes: "`", regexLiterals: true},
+	"rust":       {lineComment: "//", blockComment: cStyle, quotes: `"`, charLiterals: true},
+	"java":       {lineComment: "//", blockComment: cStyle, quotes: `"'`},
+	"c":          {lineComment: "//", blockComment: cStyle, quotes: `"'`},
+	"cpp":        {lineComment: "//", blockComment: cStyle, quotes: `"'`},
+	"zig":        {lineComment: "//", quotes: `"'`},
+	"v":          {lineComment: "//", blockComment: cStyle, quotes: `"'`, multilineQuotes: "`"},
+}
+
+var closers = map[byte]byte{')': '(', ']': '[', '}': '{'}
+
+// checkBrackets reports brackets that aren't closed, or closed by the
+// wrong one, and strings and comments left open
+func checkBrackets(s syntax, content string) []Diagnostic {
+	type opened struct {
+		char   byte
+		offset int
+	}
+	var (
+		stack       []opened
+		diagnostics []Diagnostic
+		pos         = newPositions(content)
+		// operand is whether an operand may start here, for regexes
+		operand = true
+	)
+	report := func(offset int, format string, args ...any) {
+		line, column := pos.at(offset)
+		diagnostics = append(diagnostics, Diagnostic{Line: line, Column: column, Severity: SeverityError, Message: fmt.Sprintf(format, args...)})
+	}
+
+	for i := 0; i < len(content); {
+		c := content[i]
+		rest := content[i:]
+		switch {
+		case s.lineComment != "" && strings.HasPrefix(rest, s.lineComment):
+			i += lineLength(rest)
+			continue
+		case s.blockComment[0] != "" && strings.HasPrefix(rest, s.blockComment[0]):
+			end := strings.Index(rest[len(s.blockComment[0]):], s.blockComment[1])
+			if end < 0 {
+				report(i, "unterminated comment")
+				return diagnostics
+			}
+			i += len(s.blockComment[0]) + end + len(s.blockComment[1])
+			continue
+		case s.tripleQuotes && (strings.HasPrefix(rest, `"""`) || strings.HasPrefix(rest, `'''`)):
+			end := strings.Index(rest[3:], rest[:3])
+			if end < 0 {
+				report(i, "unterminated string")
+				return diagnostics
+			}
+			i += 3 + end + 3
+			operand = false
+			continue
+		case s.charLiterals && c == '\'':
+			if n := charLiteral(rest); n > 0 {
+				i += n
+				operand = false
+				continue
+			}
+		case strings.IndexByte(s.quotes, c) >= 0 || strings.IndexByte(s.multilineQuotes, c) >= 0:
+			n, ok := quoted(rest, strings.IndexByte(s.multilineQuotes, c) >= 0)
+			if !ok {
+				report(i, "unterminated string")
+			}
+			i += n
+			operand = false
+			continue
+		case s.regexLiterals && c == '/' && operand:
+			if n := regexLiteral(rest); n > 0 {
+				i += n
+				operand = false
+				continue
+			}
+		case c == '(' || c == '[' || c == '{':
+			stack = append(stack, opened{c, i})
+		case closers[c] != 0:
+			switch {
+			case len(stack) == 0:
+				report(i, "unexpected '%c'", c)
+			case stack[len(stack)-1].char != closers[c]:
+				top := stack[len(stack)-1]
+				line, _ := pos.at(top.offset)
+				report(i, "'%c' doesn't close the '%c' on line %d", c, top.char, line)
+				stack = stack[:len(stack)-1]
+			default:
+				stack = stack[:len(stack)-1]
+			}
+		}
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+		case strings.IndexByte("(,=:[!&|?{};+-*%<>~^", c) >= 0:
+			operand = true
+		default:
+			operand = false
+		}
+		i++
+	}
+	for _, open := range stack {
+		report(open.offset, "unclosed '%c'", open.char)
+	}
+	return diagnostics
+}
+
+// lineLength is the length of s up to the end of its first line
+func lineLength(s string) int {
+	if n := strings.IndexByte(s, '\n'); n >= 0 {
+		return n
+	}
+	return len(s)
+}
+
+// quoted returns the length of the string s starts with, and whether it
+// ends before the line does, unless multiline, or the file does
+func quoted(s string, multiline bool) (int, bool) {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '\n':
+			if !multiline {
+				return i, false
+			}
+		case s[0]:
+			return i + 1, true
+		}
+	}
+	return len(s), false
+}
+
+// charLiteral returns the length of the character literal s starts with,
+// like 'a' or '\n', or 0 if it is a lifetime
+func charLiteral(s string) int {
+	if len(s) >= 3 && s[1] != '\\' && s[2] == '\'' {
+		return 3
+	}
+	if len(s) >= 4 && s[1] == '\\' {
+		if end := strings.IndexByte(s[3:lineLength(s)], '\''); end >= 0 && end < 10 {
+			return 3 + end + 1
+		}
+	}
+	return 0
+}
+
+// regexLiteral returns the length of the regex s starts with, or 0 if it
+// doesn't end on the line
+func regexLiteral(s string) int {
+	class := false
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\n':
+			return 0
+		case c == '\\':
+			i++
+		case c == '[':
+			class = true
+		case c == ']':
+			class = false
+		case c == '/' && !class:
+			if i == 1 {
+				return 0
+			}
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// checkIndentation warns about lines indented with both tabs and spaces
+func checkIndentation(content string) []Diagnostic {
+	var diagnostics []Diagnostic
+	for i, line := range strings.Split(content, "\n") {
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if strings.Contains(indent, " ") && strings.Contains(indent, "\t") {
+			diagnostics = append(diagnostics, Diagnostic{Line: i + 1, Column: 1, Severity: SeverityWarning, Message: "indentation mixes tabs and spaces"})
+		}
+	}
+	return diagnostics
+}
@@ -0,0 +1,173 @@
+// Package lint finds the errors that can be found in a source file without
+// building it: Go, JSON and YAML files are parsed with their own parsers,
+// and in other languages brackets, strings and comments are checked to be
+// closed. Like the outline package it needs no external tools, so it can
+// run after every edit.
+package lint
+
+import (
+	"encoding/json"
+	"errors"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxDiagnostics is the most diagnostics reported for a file
+const maxDiagnostics = 100
+
+// Severities
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Diagnostic is a problem at a place in a file. Line and Column are
+// 1-based; Column counts bytes.
+type Diagnostic struct {
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// formats are the data files checked, which the outline package doesn't
+// know as languages
+var formats = map[string]string{
+	".json": "json",
+	".yaml": "yaml",
+	".yml":  "yaml",
+}
+
+// FormatFromPath returns the data format of a file from its extension, or
+// "" if it isn't one
+func FormatFromPath(filePath string) string {
+	return formats[strings.ToLower(path.Ext(filePath))]
+}
+
+// Supported reports whether files in language can be checked
+func Supported(language string) bool {
+	switch language {
+	case "go", "json", "yaml":
+		return true
+	}
+	_, ok := languages[language]
+	return ok
+}
+
+// Check returns the problems found in content, in document order
+func Check(language, content string) []Diagnostic {
+	var diagnostics []Diagnostic
+	switch language {
+	case "go":
+		diagnostics = checkGo(content)
+	case "json":
+		diagnostics = checkJSON(content)
+	case "yaml":
+		diagnostics = checkYAML(content)
+	default:
+		lang, ok := languages[language]
+		if !ok {
+			return nil
+		}
+		diagnostics = checkBrackets(lang, content)
+		if lang.indentation {
+			diagnostics = append(diagnostics, checkIndentation(content)...)
+		}
+		sort.SliceStable(diagnostics, func(i, j int) bool {
+			a, b := diagnostics[i], diagnostics[j]
+			return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+		})
+	}
+	if diagnostics == nil {
+		diagnostics = []Diagnostic{}
+	}
+	if len(diagnostics) > maxDiagnostics {
+		diagnostics = diagnostics[:maxDiagnostics]
+	}
+	return diagnostics
+}
+
+func checkGo(content string) []Diagnostic {
+	_, err := parser.ParseFile(token.NewFileSet(), "", content, parser.AllErrors|parser.SkipObjectResolution)
+	var list scanner.ErrorList
+	if !errors.As(err, &list) {
+		return nil
+	}
+	// One error a line; the parser often finds several where one went wrong
+	list.RemoveMultiples()
+	diagnostics := make([]Diagnostic, 0, len(list))
+	for _, e := range list {
+		diagnostics = append(diagnostics, Diagnostic{Line: e.Pos.Line, Column: e.Pos.Column, Severity: SeverityError, Message: e.Msg})
+	}
+	return diagnostics
+}
+
+func checkJSON(content string) []Diagnostic {
+	if strings.TrimSpace(content) == "" {
+		return nil
+	}
+	var value any
+	err := json.Unmarshal([]byte(content), &value)
+	var syntaxErr *json.SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		return nil
+	}
+	// Offset is just past where the error was found
+	line, column := newPositions(content).at(int(syntaxErr.Offset) - 1)
+	return []Diagnostic{{Line: line, Column: column, Severity: SeverityError, Message: syntaxErr.Error()}}
+}
+
+// yamlLine is where yaml.v3 errors say they are
+var yamlLine = regexp.MustCompile(`line (\d+): (.*)`)
+
+func checkYAML(content string) []Diagnostic {
+	var node yaml.Node
+	err := yaml.Unmarshal([]byte(content), &node)
+	if err == nil {
+		return nil
+	}
+	messages := []string{strings.TrimPrefix(err.Error(), "yaml: ")}
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		messages = typeErr.Errors
+	}
+	diagnostics := make([]Diagnostic, 0, len(messages))
+	for _, message := range messages {
+		d := Diagnostic{Line: 1, Column: 1, Severity: SeverityError, Message: message}
+		if match := yamlLine.FindStringSubmatch(message); match != nil {
+			d.Line, _ = strconv.Atoi(match[1])
+			d.Message = match[2]
+		}
+		diagnostics = append(diagnostics, d)
+	}
+	return diagnostics
+}
+
+// positions turns byte offsets in a file into lines and columns
+type positions []int
+
+func newPositions(content string) positions {
+	starts := positions{0}
+	for i := 0; i < len(content); i++ {
+		if content[i] == '\n' {
+			starts = append(starts, i+1)
+		}
+	}
+	return starts
+}
+
+func (p positions) at(offset int) (line, column int) {
+	if offset < 0 {
+		offset = 0
+	}
+	line = sort.Search(len(p), func(i int) bool { return p[i] > offset })
+	return line, offset - p[line-1] + 1
+}
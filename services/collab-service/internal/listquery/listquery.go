@@ -0,0 +1,238 @@
+// Package listquery is the query string the REST list endpoints share, so
+// dashboards page through every listing the same way: limit items at a
+// time, continuing from the cursor of the page before, in the order sort
+// names and narrowed down by the owner, language, tag, since and until
+// filters an endpoint supports. Lists kept in memory are paged with Page;
+// those in the database continue from the key and ID of the cursor.
+package listquery
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Page sizes
+const (
+	DefaultLimit = 100
+	MaxLimit     = 500
+)
+
+// Filter is a query parameter narrowing a listing down
+type Filter string
+
+// Filters an endpoint may support. Owner, Language and Tag have to match
+// exactly; Since and Until are RFC 3339 times, from Since up to Until.
+const (
+	Owner    Filter = "owner"
+	Language Filter = "language"
+	Tag      Filter = "tag"
+	Since    Filter = "since"
+	Until    Filter = "until"
+)
+
+var allFilters = []Filter{Owner, Language, Tag, Since, Until}
+
+// ErrCursor is returned by Parse for a cursor no listing gave out, or one
+// given out by a listing in another order
+var ErrCursor = errors.New("invalid cursor")
+
+// Spec is what a list endpoint supports. Sorts names the orders it can be
+// listed in, the default one first, each by a field and descending when
+// prefixed with "-".
+type Spec struct {
+	Sorts   []string
+	Filters []Filter
+}
+
+// Query is a page of a listing as asked for
+type Query struct {
+	Limit      int
+	Sort       string
+	Descending bool
+	// After is where the page before ended, if this isn't the first
+	After *Cursor
+
+	Owner    string
+	Language string
+	Tag      string
+	Since    time.Time
+	Until    time.Time
+}
+
+// Cursor is where a page ended: the sort key and ID of its last item, and
+// the order it was in
+type Cursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	ID   string `json:"i"`
+}
+
+// String encodes the cursor for a nextCursor
+func (c Cursor) String() string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func parseCursor(raw string) (*Cursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, ErrCursor
+	}
+	var cursor Cursor
+	if err := json.Unmarshal(decoded, &cursor); err != nil || cursor.Sort == "" {
+		return nil, ErrCursor
+	}
+	return &cursor, nil
+}
+
+// sortName is how a cursor and the sort parameter name an order
+func sortName(field string, descending bool) string {
+	if descending {
+		return "-" + field
+	}
+	return field
+}
+
+// Parse reads the query string of a request to an endpoint supporting
+// spec. Filters the endpoint doesn't support are an error rather than
+// ignored, so nobody takes a listing for narrowed down when it isn't.
+func Parse(values url.Values, spec Spec) (Query, error) {
+	field, descending := strings.CutPrefix(spec.Sorts[0], "-")
+	q := Query{Limit: DefaultLimit, Sort: field, Descending: descending}
+
+	if raw := values.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit <= 0 || limit > MaxLimit {
+			return Query{}, fmt.Errorf("limit must be from 1 to %d", MaxLimit)
+		}
+		q.Limit = limit
+	}
+	if raw := values.Get("sort"); raw != "" {
+		if !slices.Contains(spec.Sorts, raw) {
+			return Query{}, fmt.Errorf("sort must be one of %s", strings.Join(spec.Sorts, ", "))
+		}
+		q.Sort, q.Descending = strings.CutPrefix(raw, "-")
+	}
+	if raw := values.Get("cursor"); raw != "" {
+		cursor, err := parseCursor(raw)
+		if err != nil || cursor.Sort != sortName(q.Sort, q.Descending) {
+			return Query{}, ErrCursor
+		}
+		q.After = cursor
+	}
+
+	for _, filter := range allFilters {
+		raw := values.Get(string(filter))
+		if raw == "" {
+			continue
+		}
+		if !slices.Contains(spec.Filters, filter) {
+			return Query{}, fmt.Errorf("this listing can't be filtered by %s", filter)
+		}
+		switch filter {
+		case Owner:
+			q.Owner = raw
+		case Language:
+			q.Language = raw
+		case Tag:
+			q.Tag = raw
+		case Since, Until:
+			at, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				return Query{}, fmt.Errorf("%s must be an RFC 3339 time", filter)
+			}
+			if filter == Since {
+				q.Since = at
+			} else {
+				q.Until = at
+			}
+		}
+	}
+	return q, nil
+}
+
+// Default reports whether q is the first page of the listing as it is
+// when nothing is asked for, which endpoints may cache
+func (q Query) Default(spec Spec) bool {
+	field, descending := strings.CutPrefix(spec.Sorts[0], "-")
+	return q == Query{Limit: DefaultLimit, Sort: field, Descending: descending}
+}
+
+// During reports whether t is in the date range asked for
+func (q Query) During(t time.Time) bool {
+	return (q.Since.IsZero() || !t.Before(q.Since)) && (q.Until.IsZero() || t.Before(q.Until))
+}
+
+// Next is the cursor continuing after an item with key and id
+func (q Query) Next(key, id string) string {
+	return Cursor{Sort: sortName(q.Sort, q.Descending), Key: key, ID: id}.String()
+}
+
+// Continue is q for the page after an item with key and id, for callers
+// going through every page themselves
+func (q Query) Continue(key, id string) Query {
+	q.After = &Cursor{Sort: sortName(q.Sort, q.Descending), Key: key, ID: id}
+	return q
+}
+
+// Before reports whether the item with key and id comes before the one
+// with otherKey and otherID in the order asked for
+func (q Query) Before(key, id, otherKey, otherID string) bool {
+	if key != otherKey {
+		return key < otherKey != q.Descending
+	}
+	return id != otherID && id < otherID != q.Descending
+}
+
+// TimeKey is the sort key of a time, which sorts as the times do
+func TimeKey(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000000000Z")
+}
+
+// ParseTimeKey reads a TimeKey back
+func ParseTimeKey(key string) (time.Time, error) {
+	return time.Parse("2006-01-02T15:04:05.000000000Z", key)
+}
+
+// NumberKey is the sort key of a number that isn't negative, which sorts
+// as the numbers do
+func NumberKey(n int64) string {
+	return fmt.Sprintf("%020d", n)
+}
+
+// Page returns the page of items q asks for, which the caller has already
+// filtered, and the cursor continuing after it if there are more. key
+// returns an item's sort key in the order asked for, such as a TimeKey,
+// and id what tells those with the same key apart.
+func Page[T any](items []T, q Query, key func(item T, sort string) string, id func(item T) string) (page []T, next string) {
+	type keyed struct {
+		item    T
+		key, id string
+	}
+	sorted := make([]keyed, 0, len(items))
+	for _, item := range items {
+		k, i := key(item, q.Sort), id(item)
+		if q.After == nil || q.Before(q.After.Key, q.After.ID, k, i) {
+			sorted = append(sorted, keyed{item, k, i})
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return q.Before(sorted[i].key, sorted[i].id, sorted[j].key, sorted[j].id) })
+
+	page = make([]T, 0, min(len(sorted), q.Limit))
+	for _, entry := range sorted[:min(len(sorted), q.Limit)] {
+		page = append(page, entry.item)
+	}
+	if len(sorted) > q.Limit {
+		last := sorted[q.Limit-1]
+		next = q.Next(last.key, last.id)
+	}
+	return page, next
+}
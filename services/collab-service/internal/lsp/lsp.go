@@ -0,0 +1,311 @@
+// Package lsp runs language servers, such as gopls or pyright, and talks
+// the Language Server Protocol to them: JSON-RPC messages over the
+// server's standard input and output, each after a Content-Length header.
+// A Conn sends requests and notifications and hands on the notifications
+// the server sends, answering the few requests servers make of their
+// client with empty results.
+package lsp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// closeWait is how long a server has to exit once asked to
+const closeWait = 2 * time.Second
+
+// Error is an error a server answered a request with
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Message, e.Code)
+}
+
+// ErrClosed is returned for requests to a server that exited
+var ErrClosed = errors.New("language server exited")
+
+// message is any JSON-RPC message
+type message struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  json.RawMessage  `json:"result,omitempty"`
+	Error   *Error           `json:"error,omitempty"`
+}
+
+type response struct {
+	result json.RawMessage
+	err    error
+}
+
+// Conn is a running language server
+type Conn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	notify func(method string, params json.RawMessage)
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  int64
+	pending map[int64]chan response
+	done    chan struct{}
+}
+
+// Start runs command in dir, the root of the workspace it serves, and
+// initializes it. notify is called, on one goroutine, with each
+// notification the server sends.
+func Start(ctx context.Context, command []string, dir string, notify func(method string, params json.RawMessage)) (*Conn, error) {
+	if len(command) == 0 {
+		return nil, errors.New("no language server command")
+	}
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Dir = dir
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	c := &Conn{
+		cmd:     cmd,
+		stdin:   stdin,
+		notify:  notify,
+		pending: make(map[int64]chan response),
+		done:    make(chan struct{}),
+	}
+	go c.read(stdout)
+
+	root := URI(dir)
+	_, err = c.Call(ctx, "initialize", map[string]any{
+		"processId":        os.Getpid(),
+		"rootUri":          root,
+		"workspaceFolders": []map[string]string{{"uri": root, "name": filepath.Base(dir)}},
+		"capabilities": map[string]any{
+			"textDocument": map[string]any{
+				"synchronization":    map[string]any{"didSave": false},
+				"hover":              map[string]any{"contentFormat": []string{"markdown", "plaintext"}},
+				"completion":         map[string]any{"completionItem": map[string]any{"snippetSupport": false}},
+				"signatureHelp":      map[string]any{},
+				"definition":         map[string]any{},
+				"references":         map[string]any{},
+				"documentSymbol":     map[string]any{"hierarchicalDocumentSymbolSupport": true},
+				"publishDiagnostics": map[string]any{"relatedInformation": true},
+			},
+			"workspace": map[string]any{"configuration": true, "workspaceFolders": true},
+		},
+	})
+	if err == nil {
+		err = c.Notify("initialized", map[string]any{})
+	}
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("initializing %s: %w", command[0], err)
+	}
+	return c, nil
+}
+
+// Call sends a request and waits for its result
+func (c *Conn) Call(ctx context.Context, method string, params any) (json.RawMessage, error) {
+	c.mu.Lock()
+	c.nextID++
+	id := c.nextID
+	reply := make(chan response, 1)
+	c.pending[id] = reply
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	raw := json.RawMessage(strconv.FormatInt(id, 10))
+	if err := c.write(message{ID: &raw, Method: method, Params: encode(params)}); err != nil {
+		return nil, err
+	}
+	select {
+	case r := <-reply:
+		return r.result, r.err
+	case <-c.done:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		c.Notify("$/cancelRequest", map[string]any{"id": id})
+		return nil, ctx.Err()
+	}
+}
+
+// Notify sends a notification
+func (c *Conn) Notify(method string, params any) error {
+	return c.write(message{Method: method, Params: encode(params)})
+}
+
+// Done is closed once the server has exited
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close asks the server to shut down and stops it if it doesn't in time
+func (c *Conn) Close() error {
+	select {
+	case <-c.done:
+		return nil
+	default:
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), closeWait)
+	defer cancel()
+	if _, err := c.Call(ctx, "shutdown", nil); err == nil {
+		c.Notify("exit", nil)
+	}
+	c.stdin.Close()
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		c.cmd.Process.Kill()
+		<-c.done
+	}
+	return nil
+}
+
+func encode(params any) json.RawMessage {
+	if params == nil {
+		return nil
+	}
+	if raw, ok := params.(json.RawMessage); ok {
+		return raw
+	}
+	data, _ := json.Marshal(params)
+	return data
+}
+
+func (c *Conn) write(msg message) error {
+	msg.JSONRPC = "2.0"
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+	if _, err := fmt.Fprintf(c.stdin, "Content-Length: %d\r\n\r\n", len(body)); err != nil {
+		return err
+	}
+	_, err = c.stdin.Write(body)
+	return err
+}
+
+// read handles what the server sends until it exits
+func (c *Conn) read(stdout io.Reader) {
+	defer func() {
+		c.cmd.Wait()
+		close(c.done)
+	}()
+	r := bufio.NewReader(stdout)
+	for {
+		body, err := readMessage(r)
+		if err != nil {
+			return
+		}
+		var msg message
+		if json.Unmarshal(body, &msg) != nil {
+			continue
+		}
+		switch {
+		case msg.Method != "" && msg.ID != nil:
+			c.answer(msg)
+		case msg.Method != "":
+			if c.notify != nil {
+				c.notify(msg.Method, msg.Params)
+			}
+		case msg.ID != nil:
+			id, err := strconv.ParseInt(string(*msg.ID), 10, 64)
+			if err != nil {
+				continue
+			}
+			c.mu.Lock()
+			reply, ok := c.pending[id]
+			c.mu.Unlock()
+			if ok {
+				r := response{result: msg.Result}
+				if msg.Error != nil {
+					r.err = msg.Error
+				}
+				reply <- r
+			}
+		}
+	}
+}
+
+// answer replies to a request from the server: with no settings for each
+// workspace/configuration item, and an empty result to anything else
+func (c *Conn) answer(req message) {
+	result := json.RawMessage("null")
+	if req.Method == "workspace/configuration" {
+		var params struct {
+			Items []json.RawMessage `json:"items"`
+		}
+		json.Unmarshal(req.Params, &params)
+		result = encode(make([]any, len(params.Items)))
+	}
+	go c.write(message{ID: req.ID, Result: result})
+}
+
+// readMessage reads one message's body
+func readMessage(r *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if name, value, ok := strings.Cut(line, ":"); ok && strings.EqualFold(name, "Content-Length") {
+			if length, err = strconv.Atoi(strings.TrimSpace(value)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if length < 0 {
+		return nil, errors.New("message without a Content-Length")
+	}
+	body := make([]byte, length)
+	_, err := io.ReadFull(r, body)
+	return body, err
+}
+
+// URI returns the file URI of a path
+func URI(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}).String()
+}
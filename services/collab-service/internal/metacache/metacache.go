@@ -0,0 +1,147 @@
+// Package metacache keeps what REST list endpoints return about sessions,
+// so dashboards polling them don't query the database every time. Values
+// are kept here in an LRU and, when there is Redis, there as well, where
+// every instance finds what any of them cached or invalidated.
+package metacache
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// Remote is a cache shared between instances, such as Redis. CacheGet
+// reports whether it had the key.
+type Remote interface {
+	CacheGet(ctx context.Context, key string) ([]byte, bool, error)
+	CacheSet(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	CacheDelete(ctx context.Context, keys ...string) error
+}
+
+type entry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// Cache is an LRU of JSON values in front of an optional Remote. Another
+// instance's invalidation only reaches the Remote, so values are kept here
+// for at most local, however long they are cached for.
+type Cache struct {
+	size   int
+	local  time.Duration
+	remote Remote
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// New returns a cache holding up to size values here, each for up to
+// local, in front of remote, which may be nil
+func New(size int, local time.Duration, remote Remote) *Cache {
+	return &Cache{
+		size:    size,
+		local:   local,
+		remote:  remote,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Get unmarshals the value cached under key into v, reporting whether
+// there was one. A value found in the Remote is kept here as well.
+func (c *Cache) Get(ctx context.Context, key string, v any) bool {
+	if value, ok := c.getLocal(key); ok {
+		return json.Unmarshal(value, v) == nil
+	}
+	if c.remote == nil {
+		return false
+	}
+	value, ok, err := c.remote.CacheGet(ctx, key)
+	if err != nil {
+		log.Printf("metacache: reading %s: %v", key, err)
+		return false
+	}
+	if !ok || json.Unmarshal(value, v) != nil {
+		return false
+	}
+	c.putLocal(key, value, c.local)
+	return true
+}
+
+// Set caches v under key for ttl
+func (c *Cache) Set(ctx context.Context, key string, v any, ttl time.Duration) {
+	value, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("metacache: marshaling %s: %v", key, err)
+		return
+	}
+	c.putLocal(key, value, min(ttl, c.local))
+	if c.remote != nil {
+		if err := c.remote.CacheSet(ctx, key, value, ttl); err != nil {
+			log.Printf("metacache: writing %s: %v", key, err)
+		}
+	}
+}
+
+// Delete invalidates the values cached under keys
+func (c *Cache) Delete(ctx context.Context, keys ...string) {
+	c.mu.Lock()
+	for _, key := range keys {
+		if elem, ok := c.entries[key]; ok {
+			c.order.Remove(elem)
+			delete(c.entries, key)
+		}
+	}
+	c.mu.Unlock()
+	if c.remote != nil {
+		if err := c.remote.CacheDelete(ctx, keys...); err != nil {
+			log.Printf("metacache: invalidating %v: %v", keys, err)
+		}
+	}
+}
+
+func (c *Cache) getLocal(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := elem.Value.(*entry)
+	if time.Now().After(e.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return e.value, true
+}
+
+// putLocal keeps a value here, evicting the least recently used one when
+// full
+func (c *Cache) putLocal(key string, value []byte, ttl time.Duration) {
+	if c.size <= 0 || ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := &entry{key: key, value: value, expires: time.Now().Add(ttl)}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = e
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(e)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*entry).key)
+	}
+}
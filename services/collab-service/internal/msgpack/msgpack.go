@@ -0,0 +1,397 @@
+// Package msgpack converts between JSON and MessagePack, the binary
+// encoding of the same data model: objects, arrays, strings, numbers,
+// booleans and null. Messages are built and parsed as JSON and converted
+// at the edge, for clients that would rather have the smaller, faster to
+// parse encoding.
+package msgpack
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// maxDepth bounds how deeply arrays and maps may nest
+const maxDepth = 64
+
+// ErrInvalid means data isn't MessagePack that can be written as JSON
+var ErrInvalid = errors.New("msgpack: invalid data")
+
+// FromJSON converts a JSON value to MessagePack. Integers are encoded as
+// such, in the fewest bytes, and other numbers as float64.
+func FromJSON(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	e := &encoder{buf: make([]byte, 0, len(data))}
+	if err := e.value(decoder, 0); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("msgpack: trailing data after JSON value")
+	}
+	return e.buf, nil
+}
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) value(decoder *json.Decoder, depth int) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	switch token := token.(type) {
+	case json.Delim:
+		if depth >= maxDepth {
+			return errors.New("msgpack: JSON nested too deeply")
+		}
+		return e.container(decoder, token == '{', depth+1)
+	case string:
+		e.str(token)
+	case json.Number:
+		return e.number(token)
+	case bool:
+		if token {
+			e.buf = append(e.buf, 0xc3)
+		} else {
+			e.buf = append(e.buf, 0xc2)
+		}
+	case nil:
+		e.buf = append(e.buf, 0xc0)
+	}
+	return nil
+}
+
+// container encodes the elements of an array, or the entries of a map,
+// up to its closing delimiter. Its length is only known at the end, so
+// room is left for the largest header and the elements moved up once the
+// header is written, if it's smaller.
+func (e *encoder) container(decoder *json.Decoder, isMap bool, depth int) error {
+	start := len(e.buf)
+	e.buf = append(e.buf, 0, 0, 0, 0, 0)
+	n := 0
+	for decoder.More() {
+		if isMap {
+			key, err := decoder.Token()
+			if err != nil {
+				return err
+			}
+			e.str(key.(string))
+		}
+		if err := e.value(decoder, depth); err != nil {
+			return err
+		}
+		n++
+	}
+	if _, err := decoder.Token(); err != nil {
+		return err
+	}
+
+	var header []byte
+	switch {
+	case n < 16 && isMap:
+		header = []byte{0x80 | byte(n)}
+	case n < 16:
+		header = []byte{0x90 | byte(n)}
+	case n <= math.MaxUint16 && isMap:
+		header = binary.BigEndian.AppendUint16([]byte{0xde}, uint16(n))
+	case n <= math.MaxUint16:
+		header = binary.BigEndian.AppendUint16([]byte{0xdc}, uint16(n))
+	case isMap:
+		header = binary.BigEndian.AppendUint32([]byte{0xdf}, uint32(n))
+	default:
+		header = binary.BigEndian.AppendUint32([]byte{0xdd}, uint32(n))
+	}
+	copy(e.buf[start:], header)
+	if len(header) < 5 {
+		body := start + 5
+		copy(e.buf[start+len(header):], e.buf[body:])
+		e.buf = e.buf[:len(e.buf)-(5-len(header))]
+	}
+	return nil
+}
+
+func (e *encoder) str(s string) {
+	n := len(s)
+	switch {
+	case n < 32:
+		e.buf = append(e.buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, 0xda), uint16(n))
+	default:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xdb), uint32(n))
+	}
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) number(number json.Number) error {
+	if i, err := strconv.ParseInt(string(number), 10, 64); err == nil {
+		e.int(i)
+		return nil
+	}
+	if u, err := strconv.ParseUint(string(number), 10, 64); err == nil {
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, 0xcf), u)
+		return nil
+	}
+	f, err := strconv.ParseFloat(string(number), 64)
+	if err != nil {
+		return fmt.Errorf("msgpack: invalid number %s", number)
+	}
+	e.buf = binary.BigEndian.AppendUint64(append(e.buf, 0xcb), math.Float64bits(f))
+	return nil
+}
+
+func (e *encoder) int(i int64) {
+	switch {
+	case i >= 0 && i <= 0x7f:
+		e.buf = append(e.buf, byte(i))
+	case i < 0 && i >= -32:
+		e.buf = append(e.buf, byte(i))
+	case i >= 0 && i <= math.MaxUint8:
+		e.buf = append(e.buf, 0xcc, byte(i))
+	case i >= 0 && i <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, 0xcd), uint16(i))
+	case i >= 0 && i <= math.MaxUint32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xce), uint32(i))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		e.buf = append(e.buf, 0xd0, byte(i))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, 0xd1), uint16(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xd2), uint32(i))
+	default:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, 0xd3), uint64(i))
+	}
+}
+
+// ToJSON converts a MessagePack value to JSON. Map keys must be strings,
+// binary data becomes base64 strings, as encoding/json writes []byte, and
+// extension types aren't supported. Strings are copied as they are, so
+// invalid UTF-8 in them is still invalid in the JSON.
+func ToJSON(data []byte) ([]byte, error) {
+	d := &decoder{data: data, out: make([]byte, 0, len(data)+len(data)/2)}
+	if err := d.value(0); err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, fmt.Errorf("%w: trailing bytes", ErrInvalid)
+	}
+	return d.out, nil
+}
+
+type decoder struct {
+	data []byte
+	pos  int
+	out  []byte
+}
+
+// take consumes the next n bytes
+func (d *decoder) take(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, fmt.Errorf("%w: truncated", ErrInvalid)
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// length reads a big-endian length of size bytes
+func (d *decoder) length(size int) (int, error) {
+	b, err := d.take(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return int(b[0]), nil
+	case 2:
+		return int(binary.BigEndian.Uint16(b)), nil
+	}
+	return int(binary.BigEndian.Uint32(b)), nil
+}
+
+func (d *decoder) value(depth int) error {
+	b, err := d.take(1)
+	if err != nil {
+		return err
+	}
+	switch c := b[0]; {
+	case c <= 0x7f:
+		d.out = strconv.AppendInt(d.out, int64(c), 10)
+	case c >= 0xe0:
+		d.out = strconv.AppendInt(d.out, int64(int8(c)), 10)
+	case c >= 0x80 && c <= 0x8f:
+		return d.container(int(c&0x0f), true, depth)
+	case c >= 0x90 && c <= 0x9f:
+		return d.container(int(c&0x0f), false, depth)
+	case c >= 0xa0 && c <= 0xbf:
+		return d.str(int(c & 0x1f))
+	case c == 0xc0:
+		d.out = append(d.out, "null"...)
+	case c == 0xc2:
+		d.out = append(d.out, "false"...)
+	case c == 0xc3:
+		d.out = append(d.out, "true"...)
+	case c >= 0xc4 && c <= 0xc6:
+		n, err := d.length(1 << (c - 0xc4))
+		if err != nil {
+			return err
+		}
+		raw, err := d.take(n)
+		if err != nil {
+			return err
+		}
+		d.out = append(d.out, '"')
+		d.out = base64.StdEncoding.AppendEncode(d.out, raw)
+		d.out = append(d.out, '"')
+	case c == 0xca || c == 0xcb:
+		var f float64
+		if c == 0xca {
+			raw, err := d.take(4)
+			if err != nil {
+				return err
+			}
+			f = float64(math.Float32frombits(binary.BigEndian.Uint32(raw)))
+		} else {
+			raw, err := d.take(8)
+			if err != nil {
+				return err
+			}
+			f = math.Float64frombits(binary.BigEndian.Uint64(raw))
+		}
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return fmt.Errorf("%w: %v has no JSON form", ErrInvalid, f)
+		}
+		d.out = strconv.AppendFloat(d.out, f, 'g', -1, 64)
+	case c >= 0xcc && c <= 0xcf:
+		raw, err := d.take(1 << (c - 0xcc))
+		if err != nil {
+			return err
+		}
+		var u uint64
+		for _, x := range raw {
+			u = u<<8 | uint64(x)
+		}
+		d.out = strconv.AppendUint(d.out, u, 10)
+	case c >= 0xd0 && c <= 0xd3:
+		raw, err := d.take(1 << (c - 0xd0))
+		if err != nil {
+			return err
+		}
+		var i int64
+		switch len(raw) {
+		case 1:
+			i = int64(int8(raw[0]))
+		case 2:
+			i = int64(int16(binary.BigEndian.Uint16(raw)))
+		case 4:
+			i = int64(int32(binary.BigEndian.Uint32(raw)))
+		default:
+			i = int64(binary.BigEndian.Uint64(raw))
+		}
+		d.out = strconv.AppendInt(d.out, i, 10)
+	case c >= 0xd9 && c <= 0xdb:
+		n, err := d.length(1 << (c - 0xd9))
+		if err != nil {
+			return err
+		}
+		return d.str(n)
+	case c == 0xdc || c == 0xdd:
+		n, err := d.length(2 << (c - 0xdc))
+		if err != nil {
+			return err
+		}
+		return d.container(n, false, depth)
+	case c == 0xde || c == 0xdf:
+		n, err := d.length(2 << (c - 0xde))
+		if err != nil {
+			return err
+		}
+		return d.container(n, true, depth)
+	default:
+		return fmt.Errorf("%w: unsupported type 0x%02x", ErrInvalid, c)
+	}
+	return nil
+}
+
+func (d *decoder) container(n int, isMap bool, depth int) error {
+	if depth >= maxDepth {
+		return fmt.Errorf("%w: nested too deeply", ErrInvalid)
+	}
+	// Every element takes a byte at least
+	if n > len(d.data)-d.pos {
+		return fmt.Errorf("%w: truncated", ErrInvalid)
+	}
+	opening, closing := byte('['), byte(']')
+	if isMap {
+		opening, closing = '{', '}'
+	}
+	d.out = append(d.out, opening)
+	for i := range n {
+		if i > 0 {
+			d.out = append(d.out, ',')
+		}
+		if isMap {
+			if err := d.key(); err != nil {
+				return err
+			}
+			d.out = append(d.out, ':')
+		}
+		if err := d.value(depth + 1); err != nil {
+			return err
+		}
+	}
+	d.out = append(d.out, closing)
+	return nil
+}
+
+// key writes a map key, which must be a string
+func (d *decoder) key() error {
+	b, err := d.take(1)
+	if err != nil {
+		return err
+	}
+	switch c := b[0]; {
+	case c >= 0xa0 && c <= 0xbf:
+		return d.str(int(c & 0x1f))
+	case c >= 0xd9 && c <= 0xdb:
+		n, err := d.length(1 << (c - 0xd9))
+		if err != nil {
+			return err
+		}
+		return d.str(n)
+	}
+	return fmt.Errorf("%w: map keys must be strings", ErrInvalid)
+}
+
+const hex = "0123456789abcdef"
+
+// str writes a string of n bytes as a JSON string
+func (d *decoder) str(n int) error {
+	raw, err := d.take(n)
+	if err != nil {
+		return err
+	}
+	d.out = append(d.out, '"')
+	for _, c := range raw {
+		switch {
+		case c == '"' || c == '\\':
+			d.out = append(d.out, '\\', c)
+		case c < 0x20:
+			d.out = append(d.out, '\\', 'u', '0', '0', hex[c>>4], hex[c&0x0f])
+		default:
+			d.out = append(d.out, c)
+		}
+	}
+	d.out = append(d.out, '"')
+	return nil
+}
@@ -0,0 +1,152 @@
+package msgpack
+
+import (
+	"bytes"
+	hexenc "encoding/hex"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// decodeJSON parses data keeping numbers as they are written, so round
+// trips are compared exactly
+func decodeJSON(t *testing.T, data []byte) any {
+	t.Helper()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var v any
+	if err := decoder.Decode(&v); err != nil {
+		t.Fatalf("invalid JSON %s: %v", data, err)
+	}
+	return v
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+	}{
+		{"operation", `{"type":"operation","userId":"1791989026384071848","revision":42,"ops":[{"type":"insert","pos":0,"text":"hello \"world\"\n"},{"type":"delete","pos":12,"length":3}],"path":"src/main.go","seq":16}`},
+		{"operation-ack", `{"type":"operation-ack","revision":1000,"path":"a.txt","seq":12}`},
+		{"cursor-update", `{"type":"cursor-update","userId":"u1","username":"alice","cursor":{"line":12,"column":4,"selection":null},"color":"#ff8800","seq":7}`},
+		{"cursors-update", `{"type":"cursors-update","cursors":[{"userId":"u1","cursor":{"line":1,"column":0}},{"userId":"u2","cursor":{"line":-3,"column":2.5},"color":"#00ff00"}],"seq":9}`},
+		{"empty containers", `{"ops":[],"cursor":{}}`},
+		{"literals", `[true,false,null,"",0]`},
+		{"integers", `[127,128,255,256,65535,65536,4294967295,4294967296,9223372036854775807,18446744073709551615,-1,-32,-33,-128,-129,-32768,-32769,-2147483648,-2147483649,-9223372036854775808]`},
+		{"floats", `[1.5,-0.25,1e+100,3.141592653589793]`},
+		{"unicode and control characters", `"héllo 世界 😀 \u0001\t"`},
+		{"array of 16", `[0,1,2,3,4,5,6,7,8,9,10,11,12,13,14,15]`},
+		{"map of 16", `{"a":0,"b":1,"c":2,"d":3,"e":4,"f":5,"g":6,"h":7,"i":8,"j":9,"k":10,"l":11,"m":12,"n":13,"o":14,"p":15}`},
+		{"str8", `"` + strings.Repeat("x", 32) + `"`},
+		{"str16", `"` + strings.Repeat("x", 256) + `"`},
+		{"str32", `"` + strings.Repeat("x", 65536) + `"`},
+		{"array16 of nested maps", `[` + strings.Repeat(`{"a":[1]},`, 20) + `{}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packed, err := FromJSON([]byte(tt.json))
+			if err != nil {
+				t.Fatalf("FromJSON: %v", err)
+			}
+			unpacked, err := ToJSON(packed)
+			if err != nil {
+				t.Fatalf("ToJSON(%x): %v", packed, err)
+			}
+			if got, want := decodeJSON(t, unpacked), decodeJSON(t, []byte(tt.json)); !reflect.DeepEqual(got, want) {
+				t.Fatalf("round trip gave %s, want %s", unpacked, tt.json)
+			}
+		})
+	}
+}
+
+func TestFromJSONEncoding(t *testing.T) {
+	tests := []struct {
+		json string
+		want string
+	}{
+		{`{"revision":1}`, "81a87265766973696f6e01"},
+		{`[-1,200,true,null]`, "94ffccc8c3c0"},
+		{`"x"`, "a178"},
+		{`1.5`, "cb3ff8000000000000"},
+		{`[0,1,2,3,4,5,6,7,8,9,10,11,12,13,14,15]`, "dc0010000102030405060708090a0b0c0d0e0f"},
+	}
+	for _, tt := range tests {
+		packed, err := FromJSON([]byte(tt.json))
+		if err != nil {
+			t.Fatalf("FromJSON(%s): %v", tt.json, err)
+		}
+		if got := hexenc.EncodeToString(packed); got != tt.want {
+			t.Errorf("FromJSON(%s) = %s, want %s", tt.json, got, tt.want)
+		}
+	}
+}
+
+func TestFromJSONInvalid(t *testing.T) {
+	for _, input := range []string{``, `{"a":`, `[1,2`, `{"a":1} {}`, `nope`, strings.Repeat("[", maxDepth+1) + strings.Repeat("]", maxDepth+1)} {
+		if _, err := FromJSON([]byte(input)); err == nil {
+			t.Errorf("FromJSON(%q) succeeded", input)
+		}
+	}
+}
+
+func TestToJSONTruncated(t *testing.T) {
+	packed, err := FromJSON([]byte(`{"type":"operation","revision":70000,"ops":[{"type":"insert","pos":300,"text":"` + strings.Repeat("y", 40) + `"}],"x":-1.5}`))
+	if err != nil {
+		t.Fatalf("FromJSON: %v", err)
+	}
+	for n := range len(packed) {
+		if _, err := ToJSON(packed[:n]); !errors.Is(err, ErrInvalid) {
+			t.Fatalf("ToJSON of the first %d of %d bytes = %v, want ErrInvalid", n, len(packed), err)
+		}
+	}
+}
+
+func TestToJSONInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		hex  string
+	}{
+		{"array16 longer than the data", "dcffff"},
+		{"array32 longer than the data", "ddffffffff"},
+		{"map16 longer than the data", "deffff"},
+		{"map32 longer than the data", "dfffffffff"},
+		{"str8 longer than the data", "d9ff61"},
+		{"str16 longer than the data", "daffff61"},
+		{"str32 longer than the data", "dbffffffff"},
+		{"bin32 longer than the data", "c6ffffffff00"},
+		{"fixstr longer than the data", "a561"},
+		{"map key cut off", "81a1"},
+		{"map value missing", "81a161"},
+		{"length prefix cut off", "dc00"},
+		{"non-string key", "810101"},
+		{"nested too deeply", strings.Repeat("91", maxDepth+1) + "c0"},
+		{"NaN", "cb7ff8000000000000"},
+		{"infinity", "cb7ff0000000000000"},
+		{"extension type", "d40100"},
+		{"never used", "c1"},
+		{"trailing bytes", "c0c0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := hexenc.DecodeString(tt.hex)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out, err := ToJSON(data); !errors.Is(err, ErrInvalid) {
+				t.Fatalf("ToJSON(%s) = %s, %v, want ErrInvalid", tt.hex, out, err)
+			}
+		})
+	}
+}
+
+func TestToJSONBinary(t *testing.T) {
+	out, err := ToJSON([]byte{0xc4, 0x03, 'a', 'b', 'c'})
+	if err != nil {
+		t.Fatalf("ToJSON: %v", err)
+	}
+	if got, want := string(out), `"YWJj"`; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
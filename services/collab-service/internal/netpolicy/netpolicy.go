@@ -0,0 +1,160 @@
+// Package netpolicy describes what network access sandboxed code gets.
+// Policies are set per organization in a YAML file:
+//
+//	default:
+//	  mode: deny
+//	organizations:
+//	  acme:
+//	    mode: allowlist
+//	    hosts: [pypi.org, files.pythonhosted.org, "*.github.com"]
+//	  research:
+//	    mode: full
+//
+// The sandbox drivers enforce them; allowlisted hosts are reached through
+// the egress proxy, which is the only thing such sandboxes can connect to.
+package netpolicy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Modes
+const (
+	// Deny blocks all outbound connections
+	Deny = "deny"
+	// Allowlist permits connections to Hosts only, through the egress proxy
+	Allowlist = "allowlist"
+	// Full permits any outbound connection
+	Full = "full"
+)
+
+// maxHosts bounds the allowlist of one policy
+const maxHosts = 256
+
+var hostRe = regexp.MustCompile(`^(\*\.)?([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// Policy is the network access of one organization's sandboxes
+type Policy struct {
+	Mode string `yaml:"mode" json:"mode"`
+	// Hosts are allowed in allowlist mode. "*.example.com" matches
+	// subdomains of example.com but not example.com itself.
+	Hosts []string `yaml:"hosts,omitempty" json:"hosts,omitempty"`
+}
+
+// Allows reports whether the policy lets sandboxes connect to host
+func (p Policy) Allows(host string) bool {
+	switch p.Mode {
+	case Full:
+		return true
+	case Allowlist:
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		for _, pattern := range p.Hosts {
+			if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+				if strings.HasSuffix(host, suffix) {
+					return true
+				}
+			} else if host == pattern {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *Policy) validate() error {
+	switch p.Mode {
+	case Deny, Full:
+		if len(p.Hosts) > 0 {
+			return fmt.Errorf("hosts only apply in %s mode", Allowlist)
+		}
+	case Allowlist:
+		if len(p.Hosts) > maxHosts {
+			return fmt.Errorf("at most %d hosts may be allowed", maxHosts)
+		}
+		for i, host := range p.Hosts {
+			host = strings.ToLower(strings.TrimSuffix(host, "."))
+			if !hostRe.MatchString(host) {
+				return fmt.Errorf("invalid host %q", p.Hosts[i])
+			}
+			p.Hosts[i] = host
+		}
+	default:
+		return fmt.Errorf("mode must be %s, %s or %s", Deny, Allowlist, Full)
+	}
+	return nil
+}
+
+// Policies maps organizations to their policy
+type Policies struct {
+	// Default applies to sessions whose owner has no organization, or one
+	// without its own policy
+	Default       Policy            `yaml:"default"`
+	Organizations map[string]Policy `yaml:"organizations"`
+}
+
+// Unrestricted is used when no policy file is configured
+func Unrestricted() *Policies {
+	return &Policies{Default: Policy{Mode: Full}}
+}
+
+// Load reads and validates a policy file
+func Load(path string) (*Policies, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse reads and validates policies in the file format
+func Parse(data []byte) (*Policies, error) {
+	var policies Policies
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&policies); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid network policies: %w", err)
+	}
+
+	if policies.Default.Mode == "" {
+		return nil, errors.New("a default policy is required")
+	}
+	if err := policies.Default.validate(); err != nil {
+		return nil, fmt.Errorf("default policy: %w", err)
+	}
+	for org, policy := range policies.Organizations {
+		if err := policy.validate(); err != nil {
+			return nil, fmt.Errorf("organization %s: %w", org, err)
+		}
+		policies.Organizations[org] = policy
+	}
+	return &policies, nil
+}
+
+// For returns the policy of an organization
+func (p *Policies) For(org string) Policy {
+	if policy, ok := p.Organizations[org]; ok && org != "" {
+		return policy
+	}
+	return p.Default
+}
+
+// Restricted reports whether any policy limits network access
+func (p *Policies) Restricted() bool {
+	if p.Default.Mode != Full {
+		return true
+	}
+	for _, policy := range p.Organizations {
+		if policy.Mode != Full {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package ot
+
+import (
+	"errors"
+	"fmt"
+)
+
+// HistoryLimit is how many operations a History keeps. Clients further
+// behind than that have to reload the document.
+const HistoryLimit = 1000
+
+// ErrStale means an edit was made against a revision the history no
+// longer has
+var ErrStale = errors.New("revision is too old; reopen the file")
+
+// History is the revision counter of a document and the operations that
+// produced its recent revisions. The zero value is revision 0.
+type History struct {
+	// base is the revision before ops[0]
+	base int
+	ops  []Operation
+}
+
+// Revision is the number of operations applied to the document
+func (h *History) Revision() int {
+	return h.base + len(h.ops)
+}
+
+// Record adds an operation taking the document to the next revision
+func (h *History) Record(op Operation) {
+	h.ops = append(h.ops, op)
+	if len(h.ops) > HistoryLimit {
+		drop := len(h.ops) - HistoryLimit
+		h.ops = append([]Operation(nil), h.ops[drop:]...)
+		h.base += drop
+	}
+}
+
+// Reset moves to a new revision without an operation, for changes that
+// can't be expressed as one. Every client has to reload.
+func (h *History) Reset() {
+	h.base = h.Revision() + 1
+	h.ops = nil
+}
+
+// Since returns the operations applied after revision, oldest first, for
+// a client that has the document as of revision to catch up with
+func (h *History) Since(revision int) ([]Operation, error) {
+	current := h.Revision()
+	if revision > current {
+		return nil, fmt.Errorf("revision %d is ahead of the document's %d", revision, current)
+	}
+	if revision < h.base {
+		return nil, ErrStale
+	}
+	return append([]Operation(nil), h.ops[revision-h.base:]...), nil
+}
+
+// Rebase builds the operation for edits made against revision, when the
+// document is now currentLen runes long, and transforms it past every
+// operation applied since. The result applies to the current document.
+func (h *History) Rebase(revision, currentLen int, edits []Edit) (Operation, error) {
+	current := h.Revision()
+	if revision > current {
+		return Operation{}, fmt.Errorf("revision %d is ahead of the document's %d", revision, current)
+	}
+	if revision < h.base {
+		return Operation{}, ErrStale
+	}
+
+	baseLen := currentLen
+	if revision < current {
+		baseLen = h.ops[revision-h.base].BaseLen
+	}
+	op, err := FromEdits(baseLen, edits)
+	if err != nil {
+		return Operation{}, err
+	}
+	return h.Transform(revision, op)
+}
+
+// Transform transforms op, made against revision, past every operation
+// applied since. The result applies to the current document.
+func (h *History) Transform(revision int, op Operation) (Operation, error) {
+	current := h.Revision()
+	if revision > current {
+		return Operation{}, fmt.Errorf("revision %d is ahead of the document's %d", revision, current)
+	}
+	if revision < h.base {
+		return Operation{}, ErrStale
+	}
+
+	var err error
+	for _, other := range h.ops[revision-h.base:] {
+		if op, _, err = Transform(op, other); err != nil {
+			return Operation{}, err
+		}
+	}
+	return op, nil
+}
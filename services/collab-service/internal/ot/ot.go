@@ -0,0 +1,371 @@
+// Package ot is the operational transformation engine behind concurrent
+// text editing. An Operation walks a whole document, retaining, inserting
+// and deleting runes, so two operations made against the same revision can
+// be transformed past each other and applied in either order with the same
+// result. Clients send edits by position; the server turns them into
+// operations, transforms them against whatever was applied since the
+// client's revision, and rebroadcasts the result.
+//
+// Positions and lengths count Unicode code points, not bytes.
+package ot
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+type kind uint8
+
+const (
+	retain kind = iota
+	insert
+	del
+)
+
+type component struct {
+	kind kind
+	// n is the length of a retain or delete
+	n    int
+	text []rune
+}
+
+func (c component) len() int {
+	if c.kind == insert {
+		return len(c.text)
+	}
+	return c.n
+}
+
+// Operation transforms a document of BaseLen runes into one of TargetLen
+// runes. The zero value is the no-op on an empty document.
+type Operation struct {
+	ops       []component
+	BaseLen   int
+	TargetLen int
+}
+
+// Identity returns the operation leaving a document of n runes unchanged
+func Identity(n int) Operation {
+	var op Operation
+	op.Retain(n)
+	return op
+}
+
+// Retain skips n runes
+func (o *Operation) Retain(n int) {
+	if n <= 0 {
+		return
+	}
+	o.BaseLen += n
+	o.TargetLen += n
+	if last := len(o.ops) - 1; last >= 0 && o.ops[last].kind == retain {
+		o.ops[last].n += n
+		return
+	}
+	o.ops = append(o.ops, component{kind: retain, n: n})
+}
+
+// Insert adds text at the current position
+func (o *Operation) Insert(text string) {
+	o.insertRunes([]rune(text))
+}
+
+func (o *Operation) insertRunes(text []rune) {
+	if len(text) == 0 {
+		return
+	}
+	o.TargetLen += len(text)
+	last := len(o.ops) - 1
+	switch {
+	case last >= 0 && o.ops[last].kind == insert:
+		o.ops[last].text = append(o.ops[last].text, text...)
+	case last >= 0 && o.ops[last].kind == del:
+		// Inserts go before deletes at the same position, so equivalent
+		// operations have one form
+		if last > 0 && o.ops[last-1].kind == insert {
+			o.ops[last-1].text = append(o.ops[last-1].text, text...)
+			return
+		}
+		o.ops = append(o.ops, o.ops[last])
+		o.ops[last] = component{kind: insert, text: append([]rune(nil), text...)}
+	default:
+		o.ops = append(o.ops, component{kind: insert, text: append([]rune(nil), text...)})
+	}
+}
+
+// Delete removes n runes
+func (o *Operation) Delete(n int) {
+	if n <= 0 {
+		return
+	}
+	o.BaseLen += n
+	if last := len(o.ops) - 1; last >= 0 && o.ops[last].kind == del {
+		o.ops[last].n += n
+		return
+	}
+	o.ops = append(o.ops, component{kind: del, n: n})
+}
+
+// IsNoop reports whether the operation changes nothing
+func (o Operation) IsNoop() bool {
+	return len(o.ops) == 0 || (len(o.ops) == 1 && o.ops[0].kind == retain)
+}
+
+// Apply runs the operation on doc
+func (o Operation) Apply(doc string) (string, error) {
+	runes := []rune(doc)
+	if len(runes) != o.BaseLen {
+		return "", fmt.Errorf("operation expects a document of %d characters, not %d", o.BaseLen, len(runes))
+	}
+	out := make([]rune, 0, o.TargetLen)
+	pos := 0
+	for _, c := range o.ops {
+		switch c.kind {
+		case retain:
+			out = append(out, runes[pos:pos+c.n]...)
+			pos += c.n
+		case insert:
+			out = append(out, c.text...)
+		case del:
+			pos += c.n
+		}
+	}
+	return string(out), nil
+}
+
+// Invert returns the operation that undoes o, given the document o was
+// applied to
+func (o Operation) Invert(doc string) (Operation, error) {
+	runes := []rune(doc)
+	if len(runes) != o.BaseLen {
+		return Operation{}, fmt.Errorf("operation expects a document of %d characters, not %d", o.BaseLen, len(runes))
+	}
+	var inverse Operation
+	pos := 0
+	for _, c := range o.ops {
+		switch c.kind {
+		case retain:
+			inverse.Retain(c.n)
+			pos += c.n
+		case insert:
+			inverse.Delete(len(c.text))
+		case del:
+			inverse.insertRunes(runes[pos : pos+c.n])
+			pos += c.n
+		}
+	}
+	return inverse, nil
+}
+
+// iterator steps through an operation's components, splitting them when
+// the other side of a compose or transform only consumes part of one
+type iterator struct {
+	ops []component
+	i   int
+	cur component
+	ok  bool
+}
+
+func newIterator(o Operation) *iterator {
+	it := &iterator{ops: o.ops}
+	it.next()
+	return it
+}
+
+func (it *iterator) next() {
+	if it.i < len(it.ops) {
+		it.cur = it.ops[it.i]
+		it.i++
+		it.ok = true
+		return
+	}
+	it.ok = false
+}
+
+// take consumes n runes of the current component
+func (it *iterator) take(n int) {
+	if n >= it.cur.len() {
+		it.next()
+		return
+	}
+	if it.cur.kind == insert {
+		it.cur.text = it.cur.text[n:]
+	} else {
+		it.cur.n -= n
+	}
+}
+
+// ErrMismatch means two operations don't apply to compatible documents
+var ErrMismatch = errors.New("operations apply to documents of different lengths")
+
+// Compose returns the operation with the effect of a followed by b
+func Compose(a, b Operation) (Operation, error) {
+	if a.TargetLen != b.BaseLen {
+		return Operation{}, ErrMismatch
+	}
+	var out Operation
+	ia, ib := newIterator(a), newIterator(b)
+	for ia.ok || ib.ok {
+		if ia.ok && ia.cur.kind == del {
+			out.Delete(ia.cur.n)
+			ia.next()
+			continue
+		}
+		if ib.ok && ib.cur.kind == insert {
+			out.insertRunes(ib.cur.text)
+			ib.next()
+			continue
+		}
+		if !ia.ok || !ib.ok {
+			return Operation{}, ErrMismatch
+		}
+
+		n := min(ia.cur.len(), ib.cur.len())
+		switch {
+		case ia.cur.kind == retain && ib.cur.kind == retain:
+			out.Retain(n)
+		case ia.cur.kind == insert && ib.cur.kind == retain:
+			out.insertRunes(ia.cur.text[:n])
+		case ia.cur.kind == retain && ib.cur.kind == del:
+			out.Delete(n)
+		case ia.cur.kind == insert && ib.cur.kind == del:
+			// Inserted then deleted: nothing left of it
+		}
+		ia.take(n)
+		ib.take(n)
+	}
+	return out, nil
+}
+
+// Transform takes operations a and b made against the same document and
+// returns a' and b' such that applying a then b' equals applying b then
+// a'. When both insert at the same position, a's text comes first.
+func Transform(a, b Operation) (Operation, Operation, error) {
+	if a.BaseLen != b.BaseLen {
+		return Operation{}, Operation{}, ErrMismatch
+	}
+	var aPrime, bPrime Operation
+	ia, ib := newIterator(a), newIterator(b)
+	for ia.ok || ib.ok {
+		if ia.ok && ia.cur.kind == insert {
+			aPrime.insertRunes(ia.cur.text)
+			bPrime.Retain(len(ia.cur.text))
+			ia.next()
+			continue
+		}
+		if ib.ok && ib.cur.kind == insert {
+			aPrime.Retain(len(ib.cur.text))
+			bPrime.insertRunes(ib.cur.text)
+			ib.next()
+			continue
+		}
+		if !ia.ok || !ib.ok {
+			return Operation{}, Operation{}, ErrMismatch
+		}
+
+		n := min(ia.cur.len(), ib.cur.len())
+		switch {
+		case ia.cur.kind == retain && ib.cur.kind == retain:
+			aPrime.Retain(n)
+			bPrime.Retain(n)
+		case ia.cur.kind == del && ib.cur.kind == retain:
+			aPrime.Delete(n)
+		case ia.cur.kind == retain && ib.cur.kind == del:
+			bPrime.Delete(n)
+		case ia.cur.kind == del && ib.cur.kind == del:
+			// Both deleted the same text
+		}
+		ia.take(n)
+		ib.take(n)
+	}
+	return aPrime, bPrime, nil
+}
+
+// Edit is one position-based change, as clients send them. Edits in a list
+// apply in order, each to the document the previous ones produced.
+type Edit struct {
+	// Type is "insert" or "delete"
+	Type string `json:"type"`
+	Pos  int    `json:"pos"`
+	// Text is inserted at Pos, or Length characters deleted from it
+	Text   string `json:"text,omitempty"`
+	Length int    `json:"length,omitempty"`
+}
+
+// FromEdits builds the operation applying edits to a document of baseLen
+// runes
+func FromEdits(baseLen int, edits []Edit) (Operation, error) {
+	op := Identity(baseLen)
+	for i, edit := range edits {
+		length := op.TargetLen
+		var step Operation
+		switch edit.Type {
+		case "insert":
+			if edit.Pos < 0 || edit.Pos > length {
+				return Operation{}, fmt.Errorf("edit %d: position %d is outside the document", i, edit.Pos)
+			}
+			if !utf8.ValidString(edit.Text) {
+				return Operation{}, fmt.Errorf("edit %d: text is not valid UTF-8", i)
+			}
+			step.Retain(edit.Pos)
+			step.Insert(edit.Text)
+			step.Retain(length - edit.Pos)
+		case "delete":
+			if edit.Pos < 0 || edit.Length < 0 || edit.Pos+edit.Length > length {
+				return Operation{}, fmt.Errorf("edit %d: range %d+%d is outside the document", i, edit.Pos, edit.Length)
+			}
+			step.Retain(edit.Pos)
+			step.Delete(edit.Length)
+			step.Retain(length - edit.Pos - edit.Length)
+		default:
+			return Operation{}, fmt.Errorf("edit %d: type must be insert or delete", i)
+		}
+		composed, err := Compose(op, step)
+		if err != nil {
+			return Operation{}, err
+		}
+		op = composed
+	}
+	return op, nil
+}
+
+// Edits returns the operation as position-based edits
+func (o Operation) Edits() []Edit {
+	edits := []Edit{}
+	pos := 0
+	for _, c := range o.ops {
+		switch c.kind {
+		case retain:
+			pos += c.n
+		case insert:
+			edits = append(edits, Edit{Type: "insert", Pos: pos, Text: string(c.text)})
+			pos += len(c.text)
+		case del:
+			edits = append(edits, Edit{Type: "delete", Pos: pos, Length: c.n})
+		}
+	}
+	return edits
+}
+
+// FromDiff returns an operation turning before into after, replacing
+// everything between their common prefix and suffix. It is how whole
+// document replacements enter the history.
+func FromDiff(before, after string) Operation {
+	a, b := []rune(before), []rune(after)
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var op Operation
+	op.Retain(prefix)
+	op.Delete(len(a) - prefix - suffix)
+	op.insertRunes(b[prefix : len(b)-suffix])
+	op.Retain(suffix)
+	return op
+}
@@ -0,0 +1,174 @@
+package ot
+
+import (
+	"errors"
+	"testing"
+)
+
+func mustEdits(t *testing.T, doc string, edits ...Edit) Operation {
+	t.Helper()
+	op, err := FromEdits(len([]rune(doc)), edits)
+	if err != nil {
+		t.Fatalf("FromEdits(%q, %v): %v", doc, edits, err)
+	}
+	return op
+}
+
+func mustApply(t *testing.T, op Operation, doc string) string {
+	t.Helper()
+	out, err := op.Apply(doc)
+	if err != nil {
+		t.Fatalf("Apply(%q): %v", doc, err)
+	}
+	return out
+}
+
+func insertAt(pos int, text string) Edit {
+	return Edit{Type: "insert", Pos: pos, Text: text}
+}
+
+func deleteAt(pos, length int) Edit {
+	return Edit{Type: "delete", Pos: pos, Length: length}
+}
+
+func TestTransformConverges(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		a, b []Edit
+		want string
+	}{
+		{"insert tie puts a first", "abc", []Edit{insertAt(1, "X")}, []Edit{insertAt(1, "Y")}, "aXYbc"},
+		{"insert tie at start", "abc", []Edit{insertAt(0, "X")}, []Edit{insertAt(0, "YY")}, "XYYabc"},
+		{"insert tie at end", "abc", []Edit{insertAt(3, "X")}, []Edit{insertAt(3, "Y")}, "abcXY"},
+		{"insert into empty document", "", []Edit{insertAt(0, "a")}, []Edit{insertAt(0, "b")}, "ab"},
+		{"inserts apart", "abcdef", []Edit{insertAt(1, "X")}, []Edit{insertAt(5, "Y")}, "aXbcdeYf"},
+		{"same delete", "abcdef", []Edit{deleteAt(1, 3)}, []Edit{deleteAt(1, 3)}, "aef"},
+		{"overlapping deletes", "abcdef", []Edit{deleteAt(1, 3)}, []Edit{deleteAt(2, 3)}, "af"},
+		{"delete inside delete", "abcdef", []Edit{deleteAt(0, 6)}, []Edit{deleteAt(2, 2)}, ""},
+		{"adjacent deletes", "abcdef", []Edit{deleteAt(0, 3)}, []Edit{deleteAt(3, 3)}, ""},
+		{"insert inside deleted range", "abcdef", []Edit{deleteAt(1, 4)}, []Edit{insertAt(3, "X")}, "aXf"},
+		{"insert where delete starts", "abcdef", []Edit{insertAt(2, "X")}, []Edit{deleteAt(2, 2)}, "abXef"},
+		{"insert where delete ends", "abcdef", []Edit{deleteAt(1, 2)}, []Edit{insertAt(3, "X")}, "aXdef"},
+		{"several edits each", "hello world", []Edit{insertAt(0, ">"), deleteAt(6, 6)}, []Edit{deleteAt(0, 5), insertAt(0, "goodbye")}, ">goodbye"},
+		{"code points, not bytes", "héllo", []Edit{insertAt(2, "é")}, []Edit{deleteAt(1, 1)}, "héllo"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := mustEdits(t, tt.doc, tt.a...), mustEdits(t, tt.doc, tt.b...)
+			aPrime, bPrime, err := Transform(a, b)
+			if err != nil {
+				t.Fatalf("Transform: %v", err)
+			}
+			viaA := mustApply(t, bPrime, mustApply(t, a, tt.doc))
+			viaB := mustApply(t, aPrime, mustApply(t, b, tt.doc))
+			if viaA != viaB {
+				t.Fatalf("a then b' = %q, b then a' = %q", viaA, viaB)
+			}
+			if viaA != tt.want {
+				t.Fatalf("got %q, want %q", viaA, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransformMismatch(t *testing.T) {
+	_, _, err := Transform(Identity(2), Identity(3))
+	if !errors.Is(err, ErrMismatch) {
+		t.Fatalf("got %v, want ErrMismatch", err)
+	}
+}
+
+// record applies the edits to doc as the next revision of h
+func record(t *testing.T, h *History, doc string, edits ...Edit) string {
+	t.Helper()
+	op := mustEdits(t, doc, edits...)
+	h.Record(op)
+	return mustApply(t, op, doc)
+}
+
+func TestHistoryRebase(t *testing.T) {
+	var h History
+	doc := "abcdef"
+	doc = record(t, &h, doc, insertAt(0, ">"))
+	doc = record(t, &h, doc, deleteAt(3, 2))
+
+	// Made against revision 0, before either of the above
+	op, err := h.Rebase(0, len([]rune(doc)), []Edit{insertAt(6, "!"), deleteAt(1, 1)})
+	if err != nil {
+		t.Fatalf("Rebase: %v", err)
+	}
+	if got, want := mustApply(t, op, doc), ">aef!"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	if _, err := h.Rebase(3, len([]rune(doc)), nil); err == nil {
+		t.Fatal("Rebase accepted a revision ahead of the document")
+	}
+}
+
+func TestHistoryLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		recorded int
+		// since is the revision asked for, and stale whether it was dropped
+		since int
+		stale bool
+	}{
+		{"all kept", HistoryLimit, 0, false},
+		{"oldest dropped", HistoryLimit + 1, 0, true},
+		{"next oldest kept", HistoryLimit + 1, 1, false},
+		{"current revision", HistoryLimit + 5, HistoryLimit + 5, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h History
+			doc := ""
+			for range tt.recorded {
+				doc = record(t, &h, doc, insertAt(0, "x"))
+			}
+			if got := h.Revision(); got != tt.recorded {
+				t.Fatalf("Revision() = %d, want %d", got, tt.recorded)
+			}
+
+			ops, err := h.Since(tt.since)
+			if tt.stale {
+				if !errors.Is(err, ErrStale) {
+					t.Fatalf("Since(%d) = %v, want ErrStale", tt.since, err)
+				}
+				if _, err := h.Transform(tt.since, Identity(0)); !errors.Is(err, ErrStale) {
+					t.Fatalf("Transform(%d) = %v, want ErrStale", tt.since, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Since(%d): %v", tt.since, err)
+			}
+			if len(ops) != tt.recorded-tt.since {
+				t.Fatalf("Since(%d) returned %d operations, want %d", tt.since, len(ops), tt.recorded-tt.since)
+			}
+			op, err := h.Rebase(tt.since, len([]rune(doc)), []Edit{insertAt(0, "y")})
+			if err != nil {
+				t.Fatalf("Rebase(%d): %v", tt.since, err)
+			}
+			if got := mustApply(t, op, doc); len(got) != len(doc)+1 {
+				t.Fatalf("rebased insert gave %d characters, want %d", len(got), len(doc)+1)
+			}
+		})
+	}
+}
+
+func TestResetMakesEveryRevisionStale(t *testing.T) {
+	var h History
+	record(t, &h, "", insertAt(0, "a"))
+	h.Reset()
+	if got := h.Revision(); got != 2 {
+		t.Fatalf("Revision() = %d, want 2", got)
+	}
+	if _, err := h.Since(1); !errors.Is(err, ErrStale) {
+		t.Fatalf("Since(1) = %v, want ErrStale", err)
+	}
+	if ops, err := h.Since(2); err != nil || len(ops) != 0 {
+		t.Fatalf("Since(2) = %v, %v, want no operations", ops, err)
+	}
+}
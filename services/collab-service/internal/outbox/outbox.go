@@ -0,0 +1,170 @@
+// Package outbox is the queue of messages waiting to be written to a
+// client: a ring buffer of bounded size, which rather than being closed
+// under its writers is marked closed and drained. A message queued with a
+// key, such as a cursor update, replaces the one with the same key that
+// is still waiting, and goes to the back of the queue.
+package outbox
+
+import "sync"
+
+type entry struct {
+	msg []byte
+	key string
+}
+
+// Queue holds up to its capacity of messages, oldest first. Replaced
+// messages leave a gap that is skipped, and squeezed out once the ring
+// fills up.
+type Queue struct {
+	mu      sync.Mutex
+	entries []entry
+	// head is the slot of the oldest message, used the slots taken from
+	// it on, gaps included, and live the messages among them
+	head, used, live int
+	// keyed is the slot of the waiting message with each key
+	keyed  map[string]int
+	ready  chan struct{}
+	closed bool
+}
+
+// New returns an empty queue of capacity messages
+func New(capacity int) *Queue {
+	return &Queue{
+		entries: make([]entry, max(capacity, 1)),
+		keyed:   make(map[string]int),
+		ready:   make(chan struct{}, 1),
+	}
+}
+
+// Ready is signaled when there may be a message to take, or the queue was
+// closed
+func (q *Queue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+func (q *Queue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Push queues a message, reporting whether there was room for it and the
+// queue is open
+func (q *Queue) Push(msg []byte) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pushLocked(entry{msg: msg})
+}
+
+// Coalesce queues a message in place of the one with the same key still
+// waiting, if any, reporting whether there was room for it and the queue
+// is open
+func (q *Queue) Coalesce(key string, msg []byte) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false
+	}
+	if slot, ok := q.keyed[key]; ok {
+		q.entries[slot] = entry{}
+		q.live--
+		delete(q.keyed, key)
+	}
+	return q.pushLocked(entry{msg: msg, key: key})
+}
+
+func (q *Queue) pushLocked(e entry) bool {
+	if q.closed {
+		return false
+	}
+	if q.used == len(q.entries) && q.live < q.used {
+		q.compactLocked()
+	}
+	if q.used == len(q.entries) {
+		return false
+	}
+	slot := (q.head + q.used) % len(q.entries)
+	q.entries[slot] = e
+	q.used++
+	q.live++
+	if e.key != "" {
+		q.keyed[e.key] = slot
+	}
+	q.signal()
+	return true
+}
+
+// compactLocked squeezes the gaps out of the ring, moving the messages to
+// the front in order
+func (q *Queue) compactLocked() {
+	entries := make([]entry, len(q.entries))
+	n := 0
+	clear(q.keyed)
+	for i := range q.used {
+		e := q.entries[(q.head+i)%len(q.entries)]
+		if e.msg == nil {
+			continue
+		}
+		entries[n] = e
+		if e.key != "" {
+			q.keyed[e.key] = n
+		}
+		n++
+	}
+	q.entries, q.head, q.used = entries, 0, n
+}
+
+// Pop takes the oldest message, if there is one. Ready stays signaled
+// while there are more.
+func (q *Queue) Pop() ([]byte, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.used > 0 {
+		e := q.entries[q.head]
+		q.entries[q.head] = entry{}
+		q.head = (q.head + 1) % len(q.entries)
+		q.used--
+		if e.msg == nil {
+			continue
+		}
+		q.live--
+		if e.key != "" {
+			delete(q.keyed, e.key)
+		}
+		if q.live > 0 {
+			q.signal()
+		}
+		return e.msg, true
+	}
+	return nil, false
+}
+
+// Len is how many messages are waiting
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.live
+}
+
+// Cap is how many messages the queue holds
+func (q *Queue) Cap() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
+
+// Close stops the queue taking messages. Those waiting can still be taken.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.signal()
+}
+
+// Drained reports whether the queue was closed and every message taken
+func (q *Queue) Drained() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed && q.live == 0
+}
@@ -0,0 +1,95 @@
+package outbox
+
+import "testing"
+
+// step is an operation on a queue: "push" or "coalesce" msg, under key,
+// with ok whether it was taken, or "pop" with msg what comes out, "" for
+// nothing, or "close"
+type step struct {
+	op, key, msg string
+	ok           bool
+}
+
+func push(msg string, ok bool) step          { return step{op: "push", msg: msg, ok: ok} }
+func coalesce(key, msg string, ok bool) step { return step{op: "coalesce", key: key, msg: msg, ok: ok} }
+func pop(msg string) step                    { return step{op: "pop", msg: msg} }
+
+func TestQueue(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		steps    []step
+		// live is how many messages are left waiting
+		live int
+	}{
+		{"oldest first", 3, []step{push("a", true), push("b", true), pop("a"), pop("b"), pop("")}, 0},
+		{"overflow is refused", 2, []step{push("a", true), push("b", true), push("c", false), pop("a"), push("c", true), pop("b"), pop("c")}, 0},
+		{"wraps around the ring", 3, []step{push("a", true), push("b", true), pop("a"), push("c", true), push("d", true), push("e", false), pop("b"), pop("c"), pop("d")}, 0},
+		{"at least one slot", 0, []step{push("a", true), push("b", false), pop("a")}, 0},
+		{"coalescing replaces the waiting message and goes to the back", 3, []step{coalesce("k", "1", true), push("a", true), coalesce("k", "2", true), pop("a"), pop("2"), pop("")}, 0},
+		{"coalescing after the message was taken queues anew", 2, []step{coalesce("k", "1", true), pop("1"), coalesce("k", "2", true), pop("2")}, 0},
+		{"keys coalesce apart", 3, []step{coalesce("k", "k1", true), coalesce("j", "j1", true), coalesce("k", "k2", true), pop("j1"), pop("k2")}, 0},
+		{"gaps are squeezed out when the ring fills", 2, []step{push("a", true), coalesce("k", "1", true), coalesce("k", "2", true), coalesce("k", "3", true), pop("a"), pop("3")}, 0},
+		{"a ring full of live messages refuses coalescing new keys", 2, []step{coalesce("k", "1", true), coalesce("j", "1", true), coalesce("i", "1", false), coalesce("k", "2", true), pop("1"), pop("2")}, 0},
+		{"waiting messages are counted", 4, []step{push("a", true), coalesce("k", "1", true), coalesce("k", "2", true), push("b", true)}, 3},
+		{"closed queues take nothing but drain", 3, []step{push("a", true), {op: "close"}, push("b", false), coalesce("k", "1", false), pop("a"), pop("")}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := New(tt.capacity)
+			for i, s := range tt.steps {
+				switch s.op {
+				case "push":
+					if ok := q.Push([]byte(s.msg)); ok != s.ok {
+						t.Fatalf("step %d: Push(%q) = %t, want %t", i, s.msg, ok, s.ok)
+					}
+				case "coalesce":
+					if ok := q.Coalesce(s.key, []byte(s.msg)); ok != s.ok {
+						t.Fatalf("step %d: Coalesce(%q, %q) = %t, want %t", i, s.key, s.msg, ok, s.ok)
+					}
+				case "pop":
+					msg, ok := q.Pop()
+					if string(msg) != s.msg || ok != (s.msg != "") {
+						t.Fatalf("step %d: Pop() = %q, %t, want %q", i, msg, ok, s.msg)
+					}
+				case "close":
+					q.Close()
+				}
+			}
+			if got := q.Len(); got != tt.live {
+				t.Fatalf("Len() = %d, want %d", got, tt.live)
+			}
+		})
+	}
+}
+
+func TestReadySignalsWhileMessagesWait(t *testing.T) {
+	q := New(4)
+	q.Push([]byte("a"))
+	q.Push([]byte("b"))
+	for _, want := range []string{"a", "b"} {
+		select {
+		case <-q.Ready():
+		default:
+			t.Fatalf("Ready not signaled with %q waiting", want)
+		}
+		if msg, _ := q.Pop(); string(msg) != want {
+			t.Fatalf("Pop() = %q, want %q", msg, want)
+		}
+	}
+	select {
+	case <-q.Ready():
+		t.Fatal("Ready signaled with nothing waiting")
+	default:
+	}
+
+	q.Close()
+	select {
+	case <-q.Ready():
+	default:
+		t.Fatal("Ready not signaled on close")
+	}
+	if !q.Drained() {
+		t.Fatal("a closed empty queue isn't drained")
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !cgo
+
+package outline
+
+// parse reports that no language has a grammar in builds without cgo
+func parse(language, content string) ([]Symbol, bool) {
+	return nil, false
+}
@@ -0,0 +1,197 @@
+// Package outline extracts a symbol outline (functions, types, classes)
+// from source files. Languages with a tree-sitter grammar are outlined from
+// their syntax tree; the others, and all of them in builds without cgo, by
+// per-language line rules.
+package outline
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Symbol is a single declaration in a document
+type Symbol struct {
+	Name      string `json:"name"`
+	Kind      string `json:"kind"`
+	Line      int    `json:"line"`
+	Column    int    `json:"column"`
+	Container string `json:"container,omitempty"`
+}
+
+// Symbol kinds
+const (
+	KindFunction  = "function"
+	KindMethod    = "method"
+	KindClass     = "class"
+	KindStruct    = "struct"
+	KindInterface = "interface"
+	KindEnum      = "enum"
+	KindType      = "type"
+	KindModule    = "module"
+)
+
+// rule matches one kind of declaration on a line. The name is taken from the
+// submatch called "name"; an optional "recv" submatch names the container.
+type rule struct {
+	kind    string
+	pattern *regexp.Regexp
+}
+
+var rules = map[string][]rule{
+	"go": {
+		{KindMethod, regexp.MustCompile(`^func\s+\(\s*\w*\s*\*?(?P<recv>\w+)[^)]*\)\s*(?P<name>\w+)`)},
+		{KindFunction, regexp.MustCompile(`^func\s+(?P<name>\w+)`)},
+		{KindStruct, regexp.MustCompile(`^type\s+(?P<name>\w+)\s+struct\b`)},
+		{KindInterface, regexp.MustCompile(`^type\s+(?P<name>\w+)\s+interface\b`)},
+		{KindType, regexp.MustCompile(`^type\s+(?P<name>\w+)\s`)},
+	},
+	"python": {
+		{KindClass, regexp.MustCompile(`^\s*class\s+(?P<name>\w+)`)},
+		{KindFunction, regexp.MustCompile(`^\s*(?:async\s+)?def\s+(?P<name>\w+)`)},
+	},
+	"javascript": jsRules,
+	"typescript": append([]rule{
+		{KindInterface, regexp.MustCompile(`^\s*(?:export\s+)?interface\s+(?P<name>\w+)`)},
+		{KindType, regexp.MustCompile(`^\s*(?:export\s+)?type\s+(?P<name>\w+)\s*(?:<[^>]*>)?\s*=`)},
+		{KindEnum, regexp.MustCompile(`^\s*(?:export\s+)?(?:const\s+)?enum\s+(?P<name>\w+)`)},
+	}, jsRules...),
+	"rust": {
+		{KindFunction, regexp.MustCompile(`^\s*(?:pub(?:\([^)]*\))?\s+)?(?:async\s+)?(?:unsafe\s+)?fn\s+(?P<name>\w+)`)},
+		{KindStruct, regexp.MustCompile(`^\s*(?:pub(?:\([^)]*\))?\s+)?struct\s+(?P<name>\w+)`)},
+		{KindEnum, regexp.MustCompile(`^\s*(?:pub(?:\([^)]*\))?\s+)?enum\s+(?P<name>\w+)`)},
+		{KindInterface, regexp.MustCompile(`^\s*(?:pub(?:\([^)]*\))?\s+)?trait\s+(?P<name>\w+)`)},
+		{KindModule, regexp.MustCompile(`^\s*(?:pub(?:\([^)]*\))?\s+)?mod\s+(?P<name>\w+)`)},
+	},
+	"java": {
+		{KindClass, regexp.MustCompile(`^\s*(?:(?:public|private|protected|abstract|final|static)\s+)*class\s+(?P<name>\w+)`)},
+		{KindInterface, regexp.MustCompile(`^\s*(?:(?:public|private|protected|abstract|static)\s+)*interface\s+(?P<name>\w+)`)},
+		{KindEnum, regexp.MustCompile(`^\s*(?:(?:public|private|protected|static)\s+)*enum\s+(?P<name>\w+)`)},
+		{KindMethod, regexp.MustCompile(`^\s*(?:(?:public|private|protected|abstract|final|static|synchronized)\s+)+[\w<>\[\],\s]+?\s+(?P<name>\w+)\s*\([^;]*$`)},
+	},
+	"c": cRules,
+	"cpp": append([]rule{
+		{KindClass, regexp.MustCompile(`^\s*class\s+(?P<name>\w+)\s*[:{]?\s*$`)},
+		{KindModule, regexp.MustCompile(`^\s*namespace\s+(?P<name>\w+)`)},
+	}, cRules...),
+	"zig": {
+		{KindFunction, regexp.MustCompile(`^\s*(?:pub\s+)?fn\s+(?P<name>\w+)`)},
+		{KindStruct, regexp.MustCompile(`^\s*(?:pub\s+)?const\s+(?P<name>\w+)\s*=\s*(?:extern\s+|packed\s+)?struct\b`)},
+		{KindEnum, regexp.MustCompile(`^\s*(?:pub\s+)?const\s+(?P<name>\w+)\s*=\s*enum\b`)},
+	},
+	"elixir": {
+		{KindModule, regexp.MustCompile(`^\s*defmodule\s+(?P<name>[\w.]+)`)},
+		{KindFunction, regexp.MustCompile(`^\s*defp?\s+(?P<name>\w+[?!]?)`)},
+	},
+	"v": {
+		{KindMethod, regexp.MustCompile(`^(?:pub\s+)?fn\s+\(\s*\w+\s+(?:mut\s+)?&?(?P<recv>\w+)\)\s*(?P<name>\w+)`)},
+		{KindFunction, regexp.MustCompile(`^(?:pub\s+)?fn\s+(?P<name>\w+)`)},
+		{KindStruct, regexp.MustCompile(`^(?:pub\s+)?struct\s+(?P<name>\w+)`)},
+		{KindInterface, regexp.MustCompile(`^(?:pub\s+)?interface\s+(?P<name>\w+)`)},
+		{KindEnum, regexp.MustCompile(`^(?:pub\s+)?enum\s+(?P<name>\w+)`)},
+	},
+}
+
+var jsRules = []rule{
+	{KindClass, regexp.MustCompile(`^\s*(?:export\s+)?(?:default\s+)?(?:abstract\s+)?class\s+(?P<name>\w+)`)},
+	{KindFunction, regexp.MustCompile(`^\s*(?:export\s+)?(?:default\s+)?(?:async\s+)?function\s*\*?\s*(?P<name>\w+)`)},
+	{KindFunction, regexp.MustCompile(`^\s*(?:export\s+)?(?:const|let|var)\s+(?P<name>\w+)\s*=\s*(?:async\s+)?(?:\([^)]*\)|\w+)\s*=>`)},
+}
+
+var cRules = []rule{
+	{KindStruct, regexp.MustCompile(`^\s*(?:typedef\s+)?struct\s+(?P<name>\w+)\s*\{?\s*$`)},
+	{KindEnum, regexp.MustCompile(`^\s*(?:typedef\s+)?enum\s+(?P<name>\w+)\s*\{?\s*$`)},
+	{KindFunction, regexp.MustCompile(`^(?:[\w*&:<>]+\s+)+\**(?P<name>[\w:~]+)\s*\([^;]*\)\s*(?:const\s*)?\{?\s*$`)},
+}
+
+var extensions = map[string]string{
+	".go":   "go",
+	".py":   "python",
+	".js":   "javascript",
+	".jsx":  "javascript",
+	".mjs":  "javascript",
+	".ts":   "typescript",
+	".tsx":  "typescript",
+	".rs":   "rust",
+	".java": "java",
+	".c":    "c",
+	".h":    "c",
+	".cpp":  "cpp",
+	".cc":   "cpp",
+	".hpp":  "cpp",
+	".zig":  "zig",
+	".ex":   "elixir",
+	".exs":  "elixir",
+	".v":    "v",
+}
+
+// LanguageFromPath guesses a document's language from its file extension
+func LanguageFromPath(filePath string) string {
+	return extensions[strings.ToLower(path.Ext(filePath))]
+}
+
+// Supported reports whether an outline can be extracted for language
+func Supported(language string) bool {
+	_, ok := rules[language]
+	return ok
+}
+
+// Extract returns the declarations found in content, in document order
+func Extract(language, content string) []Symbol {
+	if symbols, ok := parse(language, content); ok {
+		return symbols
+	}
+	languageRules, ok := rules[language]
+	if !ok {
+		return nil
+	}
+
+	symbols := []Symbol{}
+	// containers tracks enclosing classes by indentation for languages
+	// where methods are nested in the class body
+	type container struct {
+		name   string
+		indent int
+	}
+	var stack []container
+
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed == "" {
+			continue
+		}
+		indent := len(line) - len(trimmed)
+		for len(stack) > 0 && indent <= stack[len(stack)-1].indent {
+			stack = stack[:len(stack)-1]
+		}
+
+		for _, r := range languageRules {
+			match := r.pattern.FindStringSubmatchIndex(line)
+			if match == nil {
+				continue
+			}
+			nameIdx := r.pattern.SubexpIndex("name")
+			symbol := Symbol{
+				Name:   line[match[2*nameIdx]:match[2*nameIdx+1]],
+				Kind:   r.kind,
+				Line:   i + 1,
+				Column: match[2*nameIdx] + 1,
+			}
+			if recvIdx := r.pattern.SubexpIndex("recv"); recvIdx >= 0 && match[2*recvIdx] >= 0 {
+				symbol.Container = line[match[2*recvIdx]:match[2*recvIdx+1]]
+			} else if len(stack) > 0 {
+				symbol.Container = stack[len(stack)-1].name
+				if symbol.Kind == KindFunction {
+					symbol.Kind = KindMethod
+				}
+			}
+			if symbol.Kind == KindClass || symbol.Kind == KindInterface || symbol.Kind == KindModule {
+				stack = append(stack, container{name: symbol.Name, indent: indent})
+			}
+			symbols = append(symbols, symbol)
+			break
+		}
+	}
+	return symbols
+}
@@ -0,0 +1,188 @@
+//go:build cgo
+
+package outline
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/codecollab/collab-service/internal/grammars"
+	sitter "github.com/smacker/go-tree-sitter"
+)
+
+// queries find each language's declarations. A match captures the
+// declaration as @definition.<kind> and its name as @name; @scope marks a
+// block whose declarations belong to @name, such as a Rust impl, and
+// @recv the receiver a Go method belongs to.
+var queries = map[string]string{
+	"go": `
+(function_declaration name: (identifier) @name) @definition.function
+(method_declaration
+  receiver: (parameter_list (parameter_declaration type: [(type_identifier) @recv (pointer_type (type_identifier) @recv) (generic_type type: (type_identifier) @recv) (pointer_type (generic_type type: (type_identifier) @recv))]))
+  name: (field_identifier) @name) @definition.method
+(type_spec name: (type_identifier) @name type: (struct_type)) @definition.struct
+(type_spec name: (type_identifier) @name type: (interface_type)) @definition.interface
+(type_spec name: (type_identifier) @name type: [(type_identifier) (qualified_type) (generic_type) (pointer_type) (function_type) (map_type) (slice_type) (array_type) (channel_type)]) @definition.type
+(type_alias name: (type_identifier) @name) @definition.type
+`,
+	"python": `
+(class_definition name: (identifier) @name) @definition.class
+(function_definition name: (identifier) @name) @definition.function
+`,
+	"javascript": jsQuery + `
+(class_declaration name: (identifier) @name) @definition.class
+`,
+	"typescript": jsQuery + `
+(class_declaration name: (type_identifier) @name) @definition.class
+(abstract_class_declaration name: (type_identifier) @name) @definition.class
+(interface_declaration name: (type_identifier) @name) @definition.interface
+(type_alias_declaration name: (type_identifier) @name) @definition.type
+(enum_declaration name: (identifier) @name) @definition.enum
+(method_signature name: (property_identifier) @name) @definition.method
+(abstract_method_signature name: (property_identifier) @name) @definition.method
+`,
+	"rust": `
+(function_item name: (identifier) @name) @definition.function
+(function_signature_item name: (identifier) @name) @definition.function
+(struct_item name: (type_identifier) @name) @definition.struct
+(enum_item name: (type_identifier) @name) @definition.enum
+(trait_item name: (type_identifier) @name) @definition.interface
+(mod_item name: (identifier) @name) @definition.module
+(type_item name: (type_identifier) @name) @definition.type
+(impl_item type: [(type_identifier) @name (generic_type type: (type_identifier) @name)]) @scope
+`,
+	"java": `
+(class_declaration name: (identifier) @name) @definition.class
+(record_declaration name: (identifier) @name) @definition.class
+(interface_declaration name: (identifier) @name) @definition.interface
+(enum_declaration name: (identifier) @name) @definition.enum
+(method_declaration name: (identifier) @name) @definition.method
+(constructor_declaration name: (identifier) @name) @definition.method
+`,
+	"c": cQuery,
+	"cpp": cQuery + `
+(function_definition declarator: (function_declarator declarator: [(field_identifier) (qualified_identifier) (destructor_name) (operator_name)] @name)) @definition.function
+(function_definition declarator: (reference_declarator (function_declarator declarator: [(identifier) (field_identifier) (qualified_identifier)] @name))) @definition.function
+(class_specifier name: (type_identifier) @name body: (field_declaration_list)) @definition.class
+(namespace_definition name: (_) @name) @definition.module
+`,
+	"elixir": `
+(call target: (identifier) @keyword (arguments (alias) @name) (#eq? @keyword "defmodule")) @definition.module
+(call target: (identifier) @keyword (arguments [(identifier) @name (call target: (identifier) @name) (binary_operator left: (call target: (identifier) @name))]) (#match? @keyword "^defp?$")) @definition.function
+`,
+}
+
+const jsQuery = `
+(function_declaration name: (identifier) @name) @definition.function
+(generator_function_declaration name: (identifier) @name) @definition.function
+(method_definition name: (property_identifier) @name) @definition.method
+(variable_declarator name: (identifier) @name value: [(arrow_function) (function_expression)]) @definition.function
+`
+
+const cQuery = `
+(function_definition declarator: (function_declarator declarator: (identifier) @name)) @definition.function
+(function_definition declarator: (pointer_declarator declarator: (function_declarator declarator: (identifier) @name))) @definition.function
+(struct_specifier name: (type_identifier) @name body: (field_declaration_list)) @definition.struct
+(enum_specifier name: (type_identifier) @name body: (enumerator_list)) @definition.enum
+`
+
+// compiled are the queries that compile against the grammars built in, by
+// language
+var compiled = make(map[string]*sitter.Query)
+
+func init() {
+	for language, source := range queries {
+		lang := grammars.Language(language)
+		if lang == nil {
+			continue
+		}
+		query, err := sitter.NewQuery([]byte(source), lang)
+		if err != nil {
+			panic("outline: query for " + language + ": " + err.Error())
+		}
+		compiled[language] = query
+	}
+}
+
+// containerKinds are the declarations whose functions are methods
+var containerKinds = map[string]bool{KindClass: true, KindInterface: true, KindModule: true}
+
+// parse extracts the declarations of content from its tree-sitter syntax
+// tree, and reports whether language has a grammar
+func parse(language, content string) ([]Symbol, bool) {
+	query := compiled[language]
+	if query == nil {
+		return nil, false
+	}
+	src := []byte(content)
+	tree := grammars.Parse(language, src)
+	if tree == nil {
+		return nil, false
+	}
+	defer tree.Close()
+
+	type declaration struct {
+		symbol     Symbol
+		start, end uint32
+		scope      bool
+	}
+	var found []declaration
+	seen := make(map[uint32]bool)
+
+	cursor := sitter.NewQueryCursor()
+	defer cursor.Close()
+	cursor.Exec(query, tree.RootNode())
+	for {
+		match, ok := cursor.NextMatch()
+		if !ok {
+			break
+		}
+		match = cursor.FilterPredicates(match, src)
+		var d declaration
+		var node, name *sitter.Node
+		for _, capture := range match.Captures {
+			switch captureName := query.CaptureNameForId(capture.Index); {
+			case captureName == "name":
+				name = capture.Node
+			case captureName == "recv":
+				d.symbol.Container = capture.Node.Content(src)
+			case captureName == "scope":
+				node, d.scope = capture.Node, true
+			case strings.HasPrefix(captureName, "definition."):
+				node, d.symbol.Kind = capture.Node, strings.TrimPrefix(captureName, "definition.")
+			}
+		}
+		if node == nil || name == nil || seen[node.StartByte()] {
+			continue
+		}
+		seen[node.StartByte()] = true
+		start := name.StartPoint()
+		d.symbol.Name = name.Content(src)
+		d.symbol.Line, d.symbol.Column = int(start.Row)+1, int(start.Column)+1
+		d.start, d.end = node.StartByte(), node.EndByte()
+		found = append(found, d)
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].start < found[j].start })
+
+	symbols := []Symbol{}
+	// enclosing holds the declarations around the one at hand, innermost
+	// last
+	var enclosing []declaration
+	for _, d := range found {
+		for len(enclosing) > 0 && d.start >= enclosing[len(enclosing)-1].end {
+			enclosing = enclosing[:len(enclosing)-1]
+		}
+		if d.symbol.Container == "" && len(enclosing) > 0 {
+			parent := enclosing[len(enclosing)-1]
+			d.symbol.Container = parent.symbol.Name
+			if d.symbol.Kind == KindFunction && (parent.scope || containerKinds[parent.symbol.Kind]) {
+				d.symbol.Kind = KindMethod
+			}
+		}
+		enclosing = append(enclosing, d)
+		if !d.scope {
+			symbols = append(symbols, d.symbol)
+		}
+	}
+	return symbols, true
+}
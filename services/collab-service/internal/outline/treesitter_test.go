@@ -0,0 +1,93 @@
+//go:build cgo
+
+package outline
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExtractFromSyntaxTree(t *testing.T) {
+	tests := []struct {
+		name     string
+		language string
+		content  string
+		want     []Symbol
+	}{
+		{
+			"go declarations in comments and strings aren't symbols", "go",
+			"package a\n\n// func commented() {}\nvar s = `\nfunc quoted() {}\n`\n\nfunc (s *Server) Serve(\n\tctx context.Context,\n) error {\n\treturn nil\n}\n",
+			[]Symbol{{Name: "Serve", Kind: KindMethod, Line: 8, Column: 18, Container: "Server"}},
+		},
+		{
+			"go types", "go",
+			"package a\n\ntype (\n\tS struct{}\n\tI interface{ M() }\n\tN int\n)\n",
+			[]Symbol{
+				{Name: "S", Kind: KindStruct, Line: 4, Column: 2},
+				{Name: "I", Kind: KindInterface, Line: 5, Column: 2},
+				{Name: "N", Kind: KindType, Line: 6, Column: 2},
+			},
+		},
+		{
+			"python functions nested in methods", "python",
+			"class A:\n    def m(self):\n        def inner():\n            pass\n\ndef f():\n    '''\n    def quoted():\n    '''\n",
+			[]Symbol{
+				{Name: "A", Kind: KindClass, Line: 1, Column: 7},
+				{Name: "m", Kind: KindMethod, Line: 2, Column: 9, Container: "A"},
+				{Name: "inner", Kind: KindFunction, Line: 3, Column: 13, Container: "m"},
+				{Name: "f", Kind: KindFunction, Line: 6, Column: 5},
+			},
+		},
+		{
+			"typescript classes on one line", "typescript",
+			"export abstract class C { abstract a(): void; b() {} }\nexport const h = async () => {}\n",
+			[]Symbol{
+				{Name: "C", Kind: KindClass, Line: 1, Column: 23},
+				{Name: "a", Kind: KindMethod, Line: 1, Column: 36, Container: "C"},
+				{Name: "b", Kind: KindMethod, Line: 1, Column: 47, Container: "C"},
+				{Name: "h", Kind: KindFunction, Line: 2, Column: 14},
+			},
+		},
+		{
+			"rust impl blocks hold methods", "rust",
+			"struct S;\nimpl<T> Wrapper<T> {\n    fn new() -> Self { todo!() }\n}\nfn main() {}\n",
+			[]Symbol{
+				{Name: "S", Kind: KindStruct, Line: 1, Column: 8},
+				{Name: "new", Kind: KindMethod, Line: 3, Column: 8, Container: "Wrapper"},
+				{Name: "main", Kind: KindFunction, Line: 5, Column: 4},
+			},
+		},
+		{
+			"c prototypes aren't definitions", "c",
+			"int proto(void);\nstatic char *name(int id)\n{\n\treturn 0;\n}\n",
+			[]Symbol{{Name: "name", Kind: KindFunction, Line: 2, Column: 14}},
+		},
+		{
+			"elixir modules", "elixir",
+			"defmodule Shop.Cart do\n  def add(cart, item), do: [item | cart]\n  defp empty?(cart) when cart == [] do\n    true\n  end\nend\n",
+			[]Symbol{
+				{Name: "Shop.Cart", Kind: KindModule, Line: 1, Column: 11},
+				{Name: "add", Kind: KindMethod, Line: 2, Column: 7, Container: "Shop.Cart"},
+				{Name: "empty?", Kind: KindMethod, Line: 3, Column: 8, Container: "Shop.Cart"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Extract(tt.language, tt.content); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractFallsBackToLineRules(t *testing.T) {
+	got := Extract("zig", "pub fn main() void {}\nconst Point = struct {};\n")
+	want := []Symbol{
+		{Name: "main", Kind: KindFunction, Line: 1, Column: 8},
+		{Name: "Point", Kind: KindStruct, Line: 2, Column: 7},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,138 @@
+// Package pdf writes simple multi-page PDF documents using the standard
+// Type 1 fonts, enough for printable code listings without an external
+// dependency.
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Standard page size in points (A4)
+const (
+	PageWidth  = 595.0
+	PageHeight = 842.0
+)
+
+// Fonts available to Text
+const (
+	FontMono = "F1" // Courier
+	FontSans = "F2" // Helvetica
+	FontBold = "F3" // Helvetica-Bold
+)
+
+// Color is an RGB color with components in [0, 1]
+type Color struct {
+	R, G, B float64
+}
+
+// Black is the default text color
+var Black = Color{0, 0, 0}
+
+// ParseHex converts a "#RRGGBB" string to a Color, falling back to black
+func ParseHex(hex string) Color {
+	var r, g, b int
+	if _, err := fmt.Sscanf(strings.TrimPrefix(hex, "#"), "%02x%02x%02x", &r, &g, &b); err != nil {
+		return Black
+	}
+	return Color{float64(r) / 255, float64(g) / 255, float64(b) / 255}
+}
+
+// Document accumulates pages of drawing operations
+type Document struct {
+	pages []*bytes.Buffer
+}
+
+// AddPage starts a new page; subsequent drawing goes to it
+func (d *Document) AddPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+}
+
+func (d *Document) current() *bytes.Buffer {
+	if len(d.pages) == 0 {
+		d.AddPage()
+	}
+	return d.pages[len(d.pages)-1]
+}
+
+// Text draws a single line of text with its baseline at (x, y), measured
+// from the bottom-left corner of the page
+func (d *Document) Text(x, y float64, font string, size float64, color Color, text string) {
+	fmt.Fprintf(d.current(), "BT /%s %.2f Tf %.3f %.3f %.3f rg %.2f %.2f Td (%s) Tj ET\n",
+		font, size, color.R, color.G, color.B, x, y, escape(text))
+}
+
+// Rect fills a rectangle whose bottom-left corner is at (x, y)
+func (d *Document) Rect(x, y, w, h float64, color Color) {
+	fmt.Fprintf(d.current(), "%.3f %.3f %.3f rg %.2f %.2f %.2f %.2f re f\n",
+		color.R, color.G, color.B, x, y, w, h)
+}
+
+// escape encodes text as a PDF literal string in WinAnsi (Latin-1) encoding;
+// characters outside it are replaced with '?'
+func escape(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\t':
+			b.WriteString("    ")
+		case r < 32:
+			b.WriteByte(' ')
+		case r < 127:
+			b.WriteRune(r)
+		case r >= 160 && r < 256:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// Bytes serializes the document
+func (d *Document) Bytes() []byte {
+	if len(d.pages) == 0 {
+		d.AddPage()
+	}
+
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	// Object layout: 1 catalog, 2 page tree, 3-5 fonts, then a page and a
+	// content stream per page
+	const firstPage = 6
+	out.WriteString("%PDF-1.4\n")
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", firstPage+2*i)
+	}
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+
+	for i, page := range d.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] "+
+			"/Resources << /Font << /F1 3 0 R /F2 4 0 R /F3 5 0 R >> >> /Contents %d 0 R >>",
+			PageWidth, PageHeight, firstPage+2*i+1))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", page.Len(), page.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
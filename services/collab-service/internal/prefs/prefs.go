@@ -0,0 +1,130 @@
+// Package prefs stores per-user notification preferences. Anything that
+// notifies a user outside the session they're looking at checks them
+// first.
+package prefs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/blob"
+)
+
+// Notification levels
+const (
+	// All delivers every notification
+	All = "all"
+	// Mentions delivers only notifications addressed to the user
+	Mentions = "mentions"
+	// None delivers nothing
+	None = "none"
+)
+
+// Preferences are one user's notification settings
+type Preferences struct {
+	Notifications string `json:"notifications"`
+	// DoNotDisturbUntil silences everything until then, whatever the level
+	DoNotDisturbUntil *time.Time `json:"doNotDisturbUntil,omitempty"`
+	// SharePresence lets colleagues in the user's organization see when
+	// they're online
+	SharePresence bool `json:"sharePresence"`
+	// UpdatedAt is unset for defaults
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+}
+
+// Default is what users who never set preferences get
+func Default() Preferences {
+	return Preferences{Notifications: All}
+}
+
+// Validate checks the level
+func (p Preferences) Validate() error {
+	switch p.Notifications {
+	case All, Mentions, None:
+		return nil
+	}
+	return fmt.Errorf("notifications must be %s, %s or %s", All, Mentions, None)
+}
+
+// Allows reports whether a notification may be delivered at now. Direct
+// ones, like mentions and invitations, are addressed to the user; the rest
+// are general activity.
+func (p Preferences) Allows(direct bool, now time.Time) bool {
+	if p.DoNotDisturbUntil != nil && now.Before(*p.DoNotDisturbUntil) {
+		return false
+	}
+	switch p.Notifications {
+	case All:
+		return true
+	case Mentions:
+		return direct
+	}
+	return false
+}
+
+// Store keeps preferences in a blob store, with a cache in front
+type Store struct {
+	blobs blob.Store
+	mu    sync.Mutex
+	cache map[string]Preferences
+}
+
+// NewStore returns a store keeping preferences in blobs
+func NewStore(blobs blob.Store) *Store {
+	return &Store{blobs: blobs, cache: make(map[string]Preferences)}
+}
+
+// key hashes the username, which may contain anything
+func key(username string) string {
+	sum := sha256.Sum256([]byte(username))
+	return hex.EncodeToString(sum[:])
+}
+
+// Get returns a user's preferences, or the defaults if they have none
+func (s *Store) Get(username string) (Preferences, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p, ok := s.cache[username]; ok {
+		return p, nil
+	}
+	data, err := s.blobs.Get(key(username))
+	if errors.Is(err, blob.ErrNotFound) {
+		return Default(), nil
+	}
+	if err != nil {
+		return Preferences{}, err
+	}
+	var p Preferences
+	if err := json.Unmarshal(data, &p); err != nil {
+		return Preferences{}, fmt.Errorf("stored preferences: %w", err)
+	}
+	s.cache[username] = p
+	return p, nil
+}
+
+// Put validates and replaces a user's preferences
+func (s *Store) Put(username string, p Preferences) (Preferences, error) {
+	if err := p.Validate(); err != nil {
+		return Preferences{}, err
+	}
+	now := time.Now().UTC()
+	p.UpdatedAt = &now
+	data, err := json.Marshal(p)
+	if err != nil {
+		return Preferences{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.blobs.Put(key(username), data); err != nil {
+		return Preferences{}, err
+	}
+	s.cache[username] = p
+	return p, nil
+}
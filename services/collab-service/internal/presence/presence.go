@@ -0,0 +1,156 @@
+// Package presence tracks whether users are coding right now, across every
+// session they're connected to, for status integrations outside the
+// editor.
+package presence
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// States
+const (
+	// Active users are connected and did something recently
+	Active = "active"
+	// Idle users are connected but haven't done anything for a while
+	Idle = "idle"
+	// Offline users have no connections
+	Offline = "offline"
+)
+
+// Status is one user's presence
+type Status struct {
+	Username string `json:"username"`
+	State    string `json:"state"`
+	// Sessions are the sessions the user is connected to
+	Sessions     []string   `json:"sessions"`
+	LastActiveAt *time.Time `json:"lastActiveAt,omitempty"`
+}
+
+type user struct {
+	org string
+	// sessions counts connections per session
+	sessions   map[string]int
+	lastActive time.Time
+	// reported is the state last returned by Sweep
+	reported string
+}
+
+// Tracker follows users' connections and activity
+type Tracker struct {
+	idle  time.Duration
+	mu    sync.Mutex
+	users map[string]*user
+}
+
+// New returns a tracker considering users idle after idle without activity
+func New(idle time.Duration) *Tracker {
+	return &Tracker{idle: idle, users: make(map[string]*user)}
+}
+
+// Connect records a connection of username, a member of org, to a
+// session, which counts as activity
+func (t *Tracker) Connect(username, org, sessionID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u, ok := t.users[username]
+	if !ok {
+		u = &user{sessions: make(map[string]int), reported: Offline}
+		t.users[username] = u
+	}
+	u.org = org
+	u.sessions[sessionID]++
+	u.lastActive = time.Now()
+}
+
+// Disconnect records a connection closing
+func (t *Tracker) Disconnect(username, sessionID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u, ok := t.users[username]
+	if !ok {
+		return
+	}
+	if u.sessions[sessionID]--; u.sessions[sessionID] <= 0 {
+		delete(u.sessions, sessionID)
+	}
+}
+
+// Touch records activity by a connected user
+func (t *Tracker) Touch(username string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if u, ok := t.users[username]; ok {
+		u.lastActive = time.Now()
+	}
+}
+
+func (t *Tracker) statusLocked(username string, u *user, now time.Time) Status {
+	status := Status{Username: username, State: Offline, Sessions: []string{}}
+	if u == nil {
+		return status
+	}
+	lastActive := u.lastActive
+	status.LastActiveAt = &lastActive
+	for sessionID := range u.sessions {
+		status.Sessions = append(status.Sessions, sessionID)
+	}
+	sort.Strings(status.Sessions)
+	switch {
+	case len(u.sessions) == 0:
+	case now.Sub(u.lastActive) < t.idle:
+		status.State = Active
+	default:
+		status.State = Idle
+	}
+	return status
+}
+
+// Get returns a user's current presence
+func (t *Tracker) Get(username string) Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.statusLocked(username, t.users[username], time.Now())
+}
+
+// Online returns the presence of the connected members of org, except
+// exclude, sorted by username
+func (t *Tracker) Online(org, exclude string) []Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	var online []Status
+	for username, u := range t.users {
+		if u.org != org || username == exclude {
+			continue
+		}
+		if status := t.statusLocked(username, u, now); status.State != Offline {
+			online = append(online, status)
+		}
+	}
+	sort.Slice(online, func(i, j int) bool { return online[i].Username < online[j].Username })
+	return online
+}
+
+// Sweep returns the users whose state changed since the last sweep, and
+// forgets users who went offline
+func (t *Tracker) Sweep(now time.Time) []Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var changed []Status
+	for username, u := range t.users {
+		status := t.statusLocked(username, u, now)
+		if status.State != u.reported {
+			u.reported = status.State
+			changed = append(changed, status)
+		}
+		if status.State == Offline {
+			delete(t.users, username)
+		}
+	}
+	sort.Slice(changed, func(i, j int) bool { return changed[i].Username < changed[j].Username })
+	return changed
+}
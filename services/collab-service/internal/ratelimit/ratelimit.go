@@ -0,0 +1,47 @@
+// Package ratelimit is a token bucket for bounding how often a client may
+// send messages.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket allows Rate events per second on average, with bursts of up to
+// Burst events
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// New returns a full bucket. A rate of 0 or less allows everything.
+func New(rate float64, burst int) *Bucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Bucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Allow takes a token if one is available
+func (b *Bucket) Allow() bool {
+	if b.rate <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
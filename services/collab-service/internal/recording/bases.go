@@ -0,0 +1,191 @@
+package recording
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/codecollab/collab-service/internal/delta"
+)
+
+// minDeltaBytes is the smallest snapshot stored as a delta. Smaller ones
+// cost less to keep whole than to look a base up for.
+const minDeltaBytes = 4096
+
+// Large snapshots are stored as a binary delta against a base: an earlier
+// snapshot of the same file, kept once per session under bases/ by the
+// hash of its content. Each recording of an always-on room opens with a
+// snapshot of every file, and most of a large file doesn't change between
+// them, so the deltas are a fraction of the copies they replace. A file
+// whose delta would be more than half its size becomes the new base.
+// bases/index.json names the newest base of each path.
+
+func (s *Store) basesDir(dir string) string {
+	return filepath.Join(dir, "bases")
+}
+
+func (s *Store) loadIndexLocked(dir string) map[string]string {
+	index := make(map[string]string)
+	data, err := os.ReadFile(filepath.Join(s.basesDir(dir), "index.json"))
+	if err == nil {
+		json.Unmarshal(data, &index)
+	}
+	return index
+}
+
+// writeFile replaces a file in one step, so readers never see part of it
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// encodeSnapshotLocked stores a large snapshot's content as a delta
+// against the newest base of its path, in the session directory dir. If
+// that fails the content is kept whole. The caller holds s.mu until the
+// event is written, so the base isn't collected before it's referred to.
+func (s *Store) encodeSnapshotLocked(dir string, event Event) Event {
+	if len(event.Content) < minDeltaBytes {
+		return event
+	}
+
+	content := []byte(event.Content)
+	index := s.loadIndexLocked(dir)
+	if hash, ok := index[event.Path]; ok {
+		if base, err := os.ReadFile(filepath.Join(s.basesDir(dir), hash)); err == nil {
+			if patch := delta.Diff(base, content); len(patch) <= len(content)/2 {
+				event.Content, event.Base, event.Patch = "", hash, patch
+				return event
+			}
+		}
+	}
+
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+	if err := os.MkdirAll(s.basesDir(dir), 0o755); err != nil {
+		return event
+	}
+	path := filepath.Join(s.basesDir(dir), hash)
+	if _, err := os.Stat(path); err != nil {
+		if err := writeFile(path, content); err != nil {
+			return event
+		}
+	}
+	index[event.Path] = hash
+	data, err := json.Marshal(index)
+	if err != nil || writeFile(filepath.Join(s.basesDir(dir), "index.json"), data) != nil {
+		return event
+	}
+	event.Content, event.Base = "", hash
+	return event
+}
+
+// decodeSnapshot restores the content of a snapshot stored as a delta
+func (r *Reader) decodeSnapshot(event *Event) error {
+	if r.bases == nil {
+		r.bases = make(map[string][]byte)
+	}
+	base, ok := r.bases[event.Base]
+	if !ok {
+		if strings.Trim(event.Base, "0123456789abcdef") != "" {
+			return errors.New("snapshot names an invalid base")
+		}
+		var err error
+		if base, err = os.ReadFile(filepath.Join(r.store.basesDir(r.dir), event.Base)); err != nil {
+			return err
+		}
+		r.bases[event.Base] = base
+	}
+	content := base
+	if event.Patch != nil {
+		var err error
+		if content, err = delta.Apply(base, event.Patch); err != nil {
+			return err
+		}
+	}
+	event.Content, event.Base, event.Patch = string(content), "", nil
+	return nil
+}
+
+// collectBases deletes the bases of a session directory that neither a
+// recording nor the index refers to any longer
+func (s *Store) collectBases(dir string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bases, err := os.ReadDir(s.basesDir(dir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	used := make(map[string]bool)
+	for _, hash := range s.loadIndexLocked(dir) {
+		used[hash] = true
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".jsonl") {
+			if err := referencedBases(filepath.Join(dir, entry.Name()), used); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, base := range bases {
+		if base.Name() == "index.json" || used[base.Name()] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.basesDir(dir), base.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// referencedBases adds the bases a recording's snapshots refer to to used
+func referencedBases(path string, used map[string]bool) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<30)
+	for scanner.Scan() {
+		var event struct {
+			Base string `json:"base"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &event) == nil && event.Base != "" {
+			used[event.Base] = true
+		}
+	}
+	return scanner.Err()
+}
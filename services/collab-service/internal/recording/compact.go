@@ -0,0 +1,185 @@
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/codecollab/collab-service/internal/ot"
+)
+
+// CompactAll compacts every recording in the store that has finished,
+// returning how many were rewritten. A recording that fails to compact is
+// left as it was and doesn't stop the others; the first error is returned.
+func (s *Store) CompactAll(horizon time.Time) (int, error) {
+	dirs, err := os.ReadDir(s.root)
+	if err != nil {
+		return 0, err
+	}
+
+	compacted := 0
+	var firstErr error
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(s.root, dir.Name()))
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		folded := false
+		for _, entry := range entries {
+			if !strings.HasSuffix(entry.Name(), ".jsonl") {
+				continue
+			}
+			ok, err := s.compact(filepath.Join(s.root, dir.Name(), entry.Name()), horizon)
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			if ok {
+				compacted++
+				folded = true
+			}
+		}
+		if folded {
+			if err := s.collectBases(filepath.Join(s.root, dir.Name())); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return compacted, firstErr
+}
+
+// compact folds the changes a recording holds from before horizon into
+// snapshots of the documents as they were then, so playing it back starts
+// there instead of replaying everything older. Snapshots carry the time of
+// the last change folded into them and the rest of the recording is kept
+// as it is. The file is replaced atomically; recordings still being
+// written are skipped, and a finished one is never written to again. It
+// reports whether anything was folded.
+func (s *Store) compact(path string, horizon time.Time) (bool, error) {
+	s.mu.Lock()
+	active := s.active[path]
+	s.mu.Unlock()
+	if active {
+		return false, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	dir := filepath.Dir(path)
+	reader := &Reader{file: file, reader: bufio.NewReader(file), store: s, dir: dir}
+
+	start, err := reader.Next()
+	if err != nil {
+		return false, err
+	}
+	if start.Kind != Start {
+		return false, errors.New("recording doesn't begin with its start")
+	}
+
+	// Fold everything before horizon into docs
+	docs := make(map[string]string)
+	var folded int
+	var last time.Time
+	var end *Event
+	var next *Event
+	for {
+		event, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+		if !event.At.Before(horizon) {
+			next = &event
+			break
+		}
+		switch event.Kind {
+		case Snapshot:
+			docs[event.Path] = event.Content
+		case Create:
+			docs[event.Path] = ""
+			folded++
+		case Edit:
+			content := docs[event.Path]
+			op, err := ot.FromEdits(utf8.RuneCountInString(content), event.Ops)
+			if err == nil {
+				content, err = op.Apply(content)
+			}
+			if err != nil {
+				return false, err
+			}
+			docs[event.Path] = content
+			folded++
+		case End:
+			end = &event
+		}
+		last = event.At
+	}
+	if folded == 0 {
+		return false, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out, err := os.CreateTemp(dir, ".compact-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(out.Name())
+	w := bufio.NewWriter(out)
+	enc := json.NewEncoder(w)
+
+	paths := make([]string, 0, len(docs))
+	for p := range docs {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	events := []Event{start}
+	for _, p := range paths {
+		events = append(events, s.encodeSnapshotLocked(dir, Event{Kind: Snapshot, At: last, Path: p, Content: docs[p]}))
+	}
+	if end != nil {
+		events = append(events, *end)
+	}
+	if next != nil {
+		events = append(events, *next)
+	}
+	for _, event := range events {
+		if err := enc.Encode(event); err != nil {
+			out.Close()
+			return false, err
+		}
+	}
+	// The rest of the recording is copied as it was written
+	if _, err := io.Copy(w, reader.reader); err != nil {
+		out.Close()
+		return false, err
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return false, err
+	}
+	if err := out.Close(); err != nil {
+		return false, err
+	}
+	if err := os.Rename(out.Name(), path); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,282 @@
+// Package recording keeps an append-only log of the changes made to a
+// session's documents, with when each was made, so the session can be
+// played back later with its original timing.
+//
+// A recording starts with the documents as they were, and every change
+// after that is appended as it happens. Each recording is a file of JSON
+// lines under a directory per session. Large snapshots are kept as binary
+// deltas against earlier ones and restored as they are read.
+package recording
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/ot"
+)
+
+// ErrNotFound is returned by Open and Stat for a recording that doesn't exist
+var ErrNotFound = errors.New("recording not found")
+
+// Event kinds
+const (
+	// Start opens a recording and names the session's owner
+	Start = "start"
+	// Snapshot is a document's content when the recording started
+	Snapshot = "snapshot"
+	// Create adds an empty document
+	Create = "create"
+	// Edit changes a document by position-based edits
+	Edit = "edit"
+	// End closes the recording, when the session closed
+	End = "end"
+)
+
+// Event is one entry of a recording. Snapshots come first, unless the
+// recording was compacted, when they follow Start at the time of the last
+// change folded into them.
+type Event struct {
+	Kind     string    `json:"kind"`
+	At       time.Time `json:"at"`
+	Owner    string    `json:"owner,omitempty"`
+	Path     string    `json:"path,omitempty"`
+	UserID   string    `json:"userId,omitempty"`
+	Username string    `json:"username,omitempty"`
+	Content  string    `json:"content,omitempty"`
+	Ops      []ot.Edit `json:"ops,omitempty"`
+
+	// Base and Patch hold a large snapshot's content, as stored, until
+	// it's read
+	Base  string `json:"base,omitempty"`
+	Patch []byte `json:"patch,omitempty"`
+}
+
+// Info describes a recording
+type Info struct {
+	ID        string    `json:"id"`
+	Owner     string    `json:"owner"`
+	StartedAt time.Time `json:"startedAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	Bytes     int64     `json:"bytes"`
+}
+
+// Store keeps recordings under a root directory
+type Store struct {
+	root string
+
+	// active holds the files of recordings still being written, which
+	// aren't compacted. mu also guards the snapshot bases.
+	mu     sync.Mutex
+	active map[string]bool
+}
+
+// NewStore creates the root directory if needed and returns a store
+// rooted there
+func NewStore(root string) (*Store, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+	return &Store{root: root, active: make(map[string]bool)}, nil
+}
+
+// dir is where a session's recordings are. Session IDs come from clients,
+// so they are hashed rather than used as paths.
+func (s *Store) dir(session string) string {
+	sum := sha256.Sum256([]byte(session))
+	return filepath.Join(s.root, hex.EncodeToString(sum[:]))
+}
+
+// path is the file of a recording. IDs are the recording's start time in
+// nanoseconds, and nothing else is accepted.
+func (s *Store) path(session, id string) (string, bool) {
+	if id == "" || strings.Trim(id, "0123456789") != "" {
+		return "", false
+	}
+	return filepath.Join(s.dir(session), id+".jsonl"), true
+}
+
+// Recorder appends to a recording. It isn't safe for concurrent use.
+type Recorder struct {
+	id    string
+	file  *os.File
+	store *Store
+	dir   string
+}
+
+// Start begins a new recording of a session, with its Start event
+func (s *Store) Start(session, owner string, at time.Time) (*Recorder, error) {
+	if err := os.MkdirAll(s.dir(session), 0o755); err != nil {
+		return nil, err
+	}
+	id := strconv.FormatInt(at.UnixNano(), 10)
+	path, _ := s.path(session, id)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{id: id, file: file, store: s, dir: s.dir(session)}
+	if err := r.Append(Event{Kind: Start, At: at, Owner: owner}); err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	s.mu.Lock()
+	s.active[path] = true
+	s.mu.Unlock()
+	return r, nil
+}
+
+// ID identifies the recording among the session's
+func (r *Recorder) ID() string {
+	return r.id
+}
+
+// Append adds an event to the end of the recording
+func (r *Recorder) Append(event Event) error {
+	if event.Kind == Snapshot {
+		r.store.mu.Lock()
+		defer r.store.mu.Unlock()
+		event = r.store.encodeSnapshotLocked(r.dir, event)
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = r.file.Write(append(line, '\n'))
+	return err
+}
+
+func (r *Recorder) Close() error {
+	r.store.mu.Lock()
+	delete(r.store.active, r.file.Name())
+	r.store.mu.Unlock()
+	return r.file.Close()
+}
+
+// List describes a session's recordings, oldest first
+func (s *Store) List(session string) ([]Info, error) {
+	entries, err := os.ReadDir(s.dir(session))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []Info
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".jsonl")
+		if !ok {
+			continue
+		}
+		info, err := s.Stat(session, id)
+		if err != nil {
+			// A recording whose start was never written is skipped
+			continue
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].StartedAt.Before(infos[j].StartedAt) })
+	return infos, nil
+}
+
+// Stat describes one of a session's recordings
+func (s *Store) Stat(session, id string) (Info, error) {
+	reader, err := s.Open(session, id)
+	if err != nil {
+		return Info{}, err
+	}
+	defer reader.Close()
+	start, err := reader.Next()
+	if err != nil {
+		return Info{}, err
+	}
+	if start.Kind != Start {
+		return Info{}, errors.New("recording doesn't begin with its start")
+	}
+	stat, err := reader.file.Stat()
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{ID: id, Owner: start.Owner, StartedAt: start.At, UpdatedAt: stat.ModTime(), Bytes: stat.Size()}, nil
+}
+
+// Reader reads a recording from its start
+type Reader struct {
+	file   *os.File
+	reader *bufio.Reader
+	store  *Store
+	dir    string
+	// bases caches the snapshot bases read so far
+	bases map[string][]byte
+}
+
+// Open reads one of a session's recordings, which may still be going on
+func (s *Store) Open(session, id string) (*Reader, error) {
+	path, ok := s.path(session, id)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{file: file, reader: bufio.NewReader(file), store: s, dir: s.dir(session)}, nil
+}
+
+// Next returns the next event, or io.EOF after the last one written. A
+// line still being written counts as not written yet.
+func (r *Reader) Next() (Event, error) {
+	line, err := r.reader.ReadBytes('\n')
+	if errors.Is(err, io.EOF) {
+		return Event{}, io.EOF
+	}
+	if err != nil {
+		return Event{}, err
+	}
+	var event Event
+	if err := json.Unmarshal(line, &event); err != nil {
+		return Event{}, err
+	}
+	if event.Base != "" {
+		if err := r.decodeSnapshot(&event); err != nil {
+			return Event{}, err
+		}
+	}
+	return event, nil
+}
+
+func (r *Reader) Close() error {
+	return r.file.Close()
+}
+
+// Prune deletes a session's oldest recordings, keeping the newest keep,
+// and the snapshot bases only they used
+func (s *Store) Prune(session string, keep int) error {
+	infos, err := s.List(session)
+	if err != nil {
+		return err
+	}
+	for len(infos) > keep {
+		path, _ := s.path(session, infos[0].ID)
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		infos = infos[1:]
+	}
+	return s.collectBases(s.dir(session))
+}
@@ -0,0 +1,179 @@
+package relay
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxBatch is the most frames sent in one batch
+const maxBatch = 256
+
+// latestWins are the message types only the latest of which matters, for
+// each client, user and file: where cursors are and what is in view
+var latestWins = map[string]bool{
+	"cursor-move":       true,
+	"cursor-update":     true,
+	"view-state":        true,
+	"view-state-update": true,
+}
+
+// supersedable returns what a frame shares with those that would make it
+// redundant, or "" if nothing would
+func supersedable(f Frame) string {
+	switch f.Kind {
+	case KindPong:
+		return strconv.FormatUint(f.Conn, 10)
+	case KindMessage:
+		var msg struct {
+			Type   string `json:"type"`
+			UserID string `json:"userId"`
+			Path   string `json:"path"`
+		}
+		if json.Unmarshal(f.Data, &msg) != nil || !latestWins[msg.Type] {
+			return ""
+		}
+		return strconv.FormatUint(f.Conn, 10) + "\x00" + msg.Type + "\x00" + msg.UserID + "\x00" + msg.Path
+	}
+	return ""
+}
+
+// Compact leaves the frames a later one makes redundant out of frames,
+// keeping the others in order
+func Compact(frames []Frame) []Frame {
+	keys := make([]string, len(frames))
+	last := make(map[string]int)
+	for i, f := range frames {
+		if key := supersedable(f); key != "" {
+			keys[i] = key
+			last[key] = i
+		}
+	}
+	compacted := frames[:0]
+	for i, f := range frames {
+		if keys[i] == "" || last[keys[i]] == i {
+			compacted = append(compacted, f)
+		}
+	}
+	return compacted
+}
+
+// ErrClosed is returned for frames sent after the stream ended
+var ErrClosed = errors.New("relay stream closed")
+
+// Sender sends frames on a stream from one goroutine, batching whatever
+// queued while the last batch went and compacting each batch
+type Sender struct {
+	stream  Stream
+	frames  chan Frame
+	closing chan struct{}
+	done    chan struct{}
+
+	mu     sync.Mutex
+	err    error
+	closed bool
+}
+
+// NewSender starts sending on stream, with room for queue frames waiting
+func NewSender(stream Stream, queue int) *Sender {
+	s := &Sender{stream: stream, frames: make(chan Frame, queue), closing: make(chan struct{}), done: make(chan struct{})}
+	go s.run()
+	return s
+}
+
+// Send queues a frame, waiting until deadline, if set, for room
+func (s *Sender) Send(f Frame, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case s.frames <- f:
+		return nil
+	case <-s.done:
+		return s.Err()
+	case <-timeout:
+		return errors.New("relay stream send timed out")
+	}
+}
+
+// Close sends what is queued and then ends the stream, if this end opened
+// it, or just stops sending
+func (s *Sender) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.closing)
+	}
+}
+
+// Done is closed once the stream can't be sent on
+func (s *Sender) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err is why the stream can't be sent on, once it can't
+func (s *Sender) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Sender) run() {
+	var err error
+	defer func() {
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+		close(s.done)
+	}()
+
+	ctx := s.stream.Context()
+	for {
+		var batch []Frame
+		select {
+		case f := <-s.frames:
+			batch = append(batch, f)
+		case <-s.closing:
+			err = s.flush()
+			return
+		case <-ctx.Done():
+			err = ErrClosed
+			return
+		}
+		if err = s.stream.Send(&Batch{Frames: Compact(s.queued(batch))}); err != nil {
+			return
+		}
+	}
+}
+
+// queued adds the frames waiting to batch, up to maxBatch
+func (s *Sender) queued(batch []Frame) []Frame {
+	for len(batch) < maxBatch {
+		select {
+		case f := <-s.frames:
+			batch = append(batch, f)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// flush sends the frames still queued and ends the stream
+func (s *Sender) flush() error {
+	for batch := s.queued(nil); len(batch) > 0; batch = s.queued(nil) {
+		if err := s.stream.Send(&Batch{Frames: Compact(batch)}); err != nil {
+			return err
+		}
+	}
+	if client, ok := s.stream.(interface{ CloseSend() error }); ok {
+		client.CloseSend()
+	}
+	return ErrClosed
+}
@@ -0,0 +1,176 @@
+// Package relay is how edge relays talk to the collab servers that own
+// sessions. An edge terminates the WebSockets of the participants near it,
+// answering their pings and compressing what it sends them itself, and
+// carries what they exchange with the session to the owner over one gRPC
+// stream per session. Each message on the stream is a Batch of frames, one
+// per client message, opened or closed connection or pong, with the
+// frames a later one makes redundant left out; batches are sent gzipped.
+//
+// There is no generated code: the service is described here and its
+// messages are JSON, which client messages already are.
+package relay
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+)
+
+// Frame kinds
+const (
+	// KindOpen is a client connecting, with its locales, address and user
+	// agent
+	KindOpen = "open"
+	// KindMessage is a message from or to a client
+	KindMessage = "message"
+	// KindPong is a client answering its edge's ping, so the owner knows
+	// it is still there
+	KindPong = "pong"
+	// KindClose is a connection closing, with the close code and reason
+	KindClose = "close"
+)
+
+// Metadata keys of a stream
+const (
+	// SessionKey is the session the stream carries
+	SessionKey = "codecollab-session"
+	// SecretKey is the secret the edge and owner share
+	SecretKey = "codecollab-relay-secret"
+)
+
+// Frame is one thing that happened on one of a session's connections at
+// the edge, Conn, or that the owner sends it
+type Frame struct {
+	Conn      uint64          `json:"c"`
+	Kind      string          `json:"k"`
+	Locales   []string        `json:"l,omitempty"`
+	Addr      string          `json:"a,omitempty"`
+	UserAgent string          `json:"ua,omitempty"`
+	Data      json.RawMessage `json:"d,omitempty"`
+	Code      int             `json:"code,omitempty"`
+	Reason    string          `json:"reason,omitempty"`
+}
+
+// Batch is the frames sent at once
+type Batch struct {
+	Frames []Frame `json:"f"`
+}
+
+// Message returns a message frame with data, which needn't be JSON
+func Message(conn uint64, data []byte) Frame {
+	raw := json.RawMessage(data)
+	if !json.Valid(data) {
+		// Carried as a string, which the owner rejects as the message it is
+		raw, _ = json.Marshal(string(data))
+	}
+	return Frame{Conn: conn, Kind: KindMessage, Data: raw}
+}
+
+// Stream is a session's stream, from either end
+type Stream interface {
+	Send(*Batch) error
+	Recv() (*Batch, error)
+	Context() context.Context
+}
+
+// Server is what an owner serves streams with
+type Server interface {
+	Relay(Stream) error
+}
+
+const (
+	serviceName = "codecollab.relay.Relay"
+	methodName  = "/" + serviceName + "/Relay"
+)
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*Server)(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Relay",
+		ServerStreams: true,
+		ClientStreams: true,
+		Handler: func(srv any, stream grpc.ServerStream) error {
+			return srv.(Server).Relay(serverStream{stream})
+		},
+	}},
+	Metadata: "relay",
+}
+
+// Register serves the relay service on s
+func Register(s *grpc.Server, srv Server) {
+	s.RegisterService(&serviceDesc, srv)
+}
+
+// ErrUnauthenticated is returned by Authenticate for a stream without the
+// secret
+var ErrUnauthenticated = errors.New("relay stream without the shared secret")
+
+// Authenticate returns the session a stream carries, if it came with
+// the secret
+func Authenticate(stream Stream, secret string) (session string, err error) {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	if secret == "" || subtle.ConstantTimeCompare([]byte(first(md, SecretKey)), []byte(secret)) != 1 {
+		return "", ErrUnauthenticated
+	}
+	session = first(md, SessionKey)
+	if session == "" {
+		return "", errors.New("relay stream without a session")
+	}
+	return session, nil
+}
+
+func first(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Open opens a stream for session to the owner on cc
+func Open(ctx context.Context, cc *grpc.ClientConn, session, secret string) (Stream, error) {
+	ctx = metadata.AppendToOutgoingContext(ctx, SessionKey, session, SecretKey, secret)
+	stream, err := cc.NewStream(ctx, &serviceDesc.Streams[0], methodName,
+		grpc.CallContentSubtype(codecName), grpc.UseCompressor(gzip.Name))
+	if err != nil {
+		return nil, err
+	}
+	return clientStream{stream}, nil
+}
+
+type serverStream struct{ grpc.ServerStream }
+
+func (s serverStream) Send(batch *Batch) error { return s.SendMsg(batch) }
+
+func (s serverStream) Recv() (*Batch, error) {
+	batch := new(Batch)
+	return batch, s.RecvMsg(batch)
+}
+
+type clientStream struct{ grpc.ClientStream }
+
+func (s clientStream) Send(batch *Batch) error { return s.SendMsg(batch) }
+
+func (s clientStream) Recv() (*Batch, error) {
+	batch := new(Batch)
+	return batch, s.RecvMsg(batch)
+}
+
+// codecName is the content subtype batches go as
+const codecName = "json"
+
+type codec struct{}
+
+func (codec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (codec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+func (codec) Name() string                       { return codecName }
+
+func init() {
+	encoding.RegisterCodec(codec{})
+}
@@ -0,0 +1,121 @@
+// Package resultcache remembers execution results by a hash of everything
+// that determines them, so identical runs don't need a sandbox.
+package resultcache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/execution"
+)
+
+// Key hashes the code, commands, files and environment of a request.
+// Environment values are part of the key, so runs only share a result
+// when their secrets match as well.
+func Key(req execution.Request) string {
+	h := sha256.New()
+	write := func(s string) {
+		// Length prefixes keep "ab"+"c" and "a"+"bc" apart
+		var n [8]byte
+		binary.LittleEndian.PutUint64(n[:], uint64(len(s)))
+		h.Write(n[:])
+		h.Write([]byte(s))
+	}
+
+	writeMap := func(m map[string]string) {
+		keys := make([]string, 0, len(m))
+		for key := range m {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		write(strconv.Itoa(len(keys)))
+		for _, key := range keys {
+			write(key)
+			write(m[key])
+		}
+	}
+
+	write(req.Language)
+	write(req.Code)
+	write(req.File)
+	write(req.Compile)
+	write(req.Run)
+	write(strconv.Itoa(req.Timeout))
+	write(strconv.Itoa(req.MemoryMB))
+	writeMap(req.Env)
+	writeMap(req.Files)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type entry struct {
+	key      string
+	result   execution.Result
+	storedAt time.Time
+}
+
+// Cache is an LRU of results that expire after a fixed TTL
+type Cache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// New returns a cache holding up to size results for ttl each
+func New(size int, ttl time.Duration) *Cache {
+	return &Cache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Get returns a copy of the cached result for key and when it was stored
+func (c *Cache) Get(key string) (*execution.Result, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	e := elem.Value.(*entry)
+	if c.ttl > 0 && time.Since(e.storedAt) > c.ttl {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, time.Time{}, false
+	}
+	c.order.MoveToFront(elem)
+	result := e.result
+	return &result, e.storedAt, true
+}
+
+// Put stores a result, evicting the least recently used one when full
+func (c *Cache) Put(key string, result *execution.Result) {
+	if c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = &entry{key: key, result: *result, storedAt: time.Now()}
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&entry{key: key, result: *result, storedAt: time.Now()})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*entry).key)
+	}
+}
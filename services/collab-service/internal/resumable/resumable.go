@@ -0,0 +1,222 @@
+// Package resumable keeps uploads that arrive in parts, as the tus
+// protocol sends them, so that one interrupted by a flaky connection
+// carries on from the last byte received instead of starting over.
+//
+// Each upload is a data file under the store's root, holding the bytes
+// received so far, and a JSON file describing it. The offset an upload is
+// at is the size of its data file, so uploads survive restarts.
+package resumable
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned for an upload that doesn't exist, or expired
+	ErrNotFound = errors.New("upload not found")
+	// ErrOffset means a part doesn't start where the upload is at
+	ErrOffset = errors.New("upload offset mismatch")
+	// ErrBusy means another part of the upload is still being received
+	ErrBusy = errors.New("upload is already receiving a part")
+)
+
+// Upload describes an upload: the session it is into and who sends it, its
+// Length in bytes and how many of them were received
+type Upload struct {
+	ID      string    `json:"id"`
+	Session string    `json:"session"`
+	Owner   string    `json:"owner"`
+	Length  int64     `json:"length"`
+	Offset  int64     `json:"-"`
+	Expires time.Time `json:"expires"`
+}
+
+// Complete reports whether every byte of the upload was received
+func (u Upload) Complete() bool {
+	return u.Offset == u.Length
+}
+
+// Store keeps uploads under a root directory for a TTL from their creation
+type Store struct {
+	root string
+	ttl  time.Duration
+
+	mu sync.Mutex
+	// busy are the uploads receiving a part
+	busy map[string]bool
+}
+
+// NewStore creates the root directory if needed and returns a store
+// rooted there
+func NewStore(root string, ttl time.Duration) (*Store, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+	return &Store{root: root, ttl: ttl, busy: make(map[string]bool)}, nil
+}
+
+func (s *Store) dataPath(id string) string {
+	return filepath.Join(s.root, id+".part")
+}
+
+func (s *Store) infoPath(id string) string {
+	return filepath.Join(s.root, id+".json")
+}
+
+// validID reports whether id could be one Create returned, so that those
+// clients send can't name other files
+func validID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// Create starts an upload of length bytes into session, sent by owner
+func (s *Store) Create(session, owner string, length int64) (Upload, error) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	upload := Upload{
+		ID:      hex.EncodeToString(id),
+		Session: session,
+		Owner:   owner,
+		Length:  length,
+		Expires: time.Now().Add(s.ttl).UTC(),
+	}
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return Upload{}, err
+	}
+	if err := os.WriteFile(s.dataPath(upload.ID), nil, 0o644); err != nil {
+		return Upload{}, err
+	}
+	if err := os.WriteFile(s.infoPath(upload.ID), data, 0o644); err != nil {
+		os.Remove(s.dataPath(upload.ID))
+		return Upload{}, err
+	}
+	return upload, nil
+}
+
+// Get returns the upload with id as it is now
+func (s *Store) Get(id string) (Upload, error) {
+	if !validID(id) {
+		return Upload{}, ErrNotFound
+	}
+	data, err := os.ReadFile(s.infoPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return Upload{}, ErrNotFound
+	}
+	if err != nil {
+		return Upload{}, err
+	}
+	var upload Upload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return Upload{}, err
+	}
+	if time.Now().After(upload.Expires) {
+		return Upload{}, ErrNotFound
+	}
+	info, err := os.Stat(s.dataPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return Upload{}, ErrNotFound
+	}
+	if err != nil {
+		return Upload{}, err
+	}
+	upload.Offset = info.Size()
+	return upload, nil
+}
+
+// Append adds the part in r to the upload, which must be at offset. What
+// is received of the part is kept even if reading it fails, so the upload
+// can resume from there. It returns the upload's new offset.
+func (s *Store) Append(id string, offset int64, r io.Reader) (int64, error) {
+	s.mu.Lock()
+	if s.busy[id] {
+		s.mu.Unlock()
+		return 0, ErrBusy
+	}
+	s.busy[id] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.busy, id)
+		s.mu.Unlock()
+	}()
+
+	upload, err := s.Get(id)
+	if err != nil {
+		return 0, err
+	}
+	if offset != upload.Offset {
+		return upload.Offset, ErrOffset
+	}
+	file, err := os.OpenFile(s.dataPath(id), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return upload.Offset, err
+	}
+	written, copyErr := io.Copy(file, io.LimitReader(r, upload.Length-upload.Offset))
+	if err := file.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	return upload.Offset + written, copyErr
+}
+
+// Open reads the bytes received of the upload
+func (s *Store) Open(id string) (*os.File, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+	return os.Open(s.dataPath(id))
+}
+
+// Remove deletes the upload
+func (s *Store) Remove(id string) error {
+	if !validID(id) {
+		return ErrNotFound
+	}
+	err := os.Remove(s.infoPath(id))
+	if dataErr := os.Remove(s.dataPath(id)); err == nil && !errors.Is(dataErr, os.ErrNotExist) {
+		err = dataErr
+	}
+	return err
+}
+
+// Expire removes the uploads that expired, returning how many
+func (s *Store) Expire() (int, error) {
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !validID(id) {
+			continue
+		}
+		if _, err := s.Get(id); !errors.Is(err, ErrNotFound) {
+			continue
+		}
+		s.mu.Lock()
+		busy := s.busy[id]
+		s.mu.Unlock()
+		if busy {
+			continue
+		}
+		if err := s.Remove(id); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
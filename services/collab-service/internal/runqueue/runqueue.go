@@ -0,0 +1,181 @@
+// Package runqueue limits how many runs execute at once on a node. Waiting
+// runs are served round-robin across sessions, so one busy session can't
+// starve the others, and waiters are told their position as it changes.
+package runqueue
+
+import (
+	"context"
+	"sync"
+)
+
+// Queue hands out a fixed number of execution slots
+type Queue struct {
+	mu      sync.Mutex
+	slots   int
+	running int
+	// order lists the sessions with waiters; cursor is the next to serve
+	order   []string
+	cursor  int
+	waiting map[string][]*waiter
+}
+
+type waiter struct {
+	ready    chan struct{}
+	position int
+	notify   func(position, waiting int)
+}
+
+// New returns a queue with the given number of slots. Fewer than one slot
+// is treated as one.
+func New(slots int) *Queue {
+	if slots < 1 {
+		slots = 1
+	}
+	return &Queue{slots: slots, waiting: make(map[string][]*waiter)}
+}
+
+// Acquire waits for a slot for a run in the given session. While the run is
+// queued, notify is called with its 1-based position each time it changes,
+// and with 0 once the run gets a slot. The returned function releases the
+// slot and must be called exactly once.
+func (q *Queue) Acquire(ctx context.Context, session string, notify func(position, waiting int)) (func(), error) {
+	q.mu.Lock()
+	if q.running < q.slots && len(q.order) == 0 {
+		q.running++
+		q.mu.Unlock()
+		return q.release, nil
+	}
+
+	w := &waiter{ready: make(chan struct{}), notify: notify}
+	if len(q.waiting[session]) == 0 {
+		q.order = append(q.order, session)
+	}
+	q.waiting[session] = append(q.waiting[session], w)
+	updates := q.reposition()
+	q.mu.Unlock()
+	deliver(updates)
+
+	select {
+	case <-w.ready:
+		if notify != nil {
+			notify(0, 0)
+		}
+		return q.release, nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		select {
+		case <-w.ready:
+			// Got the slot just as the context ended; hand it back
+			q.mu.Unlock()
+			q.release()
+			return nil, ctx.Err()
+		default:
+		}
+		q.remove(session, w)
+		updates := q.reposition()
+		q.mu.Unlock()
+		deliver(updates)
+		return nil, ctx.Err()
+	}
+}
+
+// Waiting returns the number of queued runs
+func (q *Queue) Waiting() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for _, waiters := range q.waiting {
+		n += len(waiters)
+	}
+	return n
+}
+
+func (q *Queue) release() {
+	q.mu.Lock()
+	q.running--
+	for q.running < q.slots && len(q.order) > 0 {
+		if q.cursor >= len(q.order) {
+			q.cursor = 0
+		}
+		session := q.order[q.cursor]
+		w := q.waiting[session][0]
+		q.waiting[session] = q.waiting[session][1:]
+		if len(q.waiting[session]) == 0 {
+			delete(q.waiting, session)
+			q.order = append(q.order[:q.cursor], q.order[q.cursor+1:]...)
+		} else {
+			q.cursor++
+		}
+		q.running++
+		close(w.ready)
+	}
+	updates := q.reposition()
+	q.mu.Unlock()
+	deliver(updates)
+}
+
+// remove drops a waiter that gave up. Caller must hold q.mu.
+func (q *Queue) remove(session string, w *waiter) {
+	waiters := q.waiting[session]
+	for i, candidate := range waiters {
+		if candidate == w {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) > 0 {
+		q.waiting[session] = waiters
+		return
+	}
+	delete(q.waiting, session)
+	for i, s := range q.order {
+		if s == session {
+			q.order = append(q.order[:i], q.order[i+1:]...)
+			if q.cursor > i {
+				q.cursor--
+			}
+			break
+		}
+	}
+}
+
+type update struct {
+	notify            func(position, waiting int)
+	position, waiting int
+}
+
+// reposition recomputes every waiter's place in the round-robin order and
+// returns the notifications to send. Caller must hold q.mu.
+func (q *Queue) reposition() []update {
+	total := 0
+	for _, waiters := range q.waiting {
+		total += len(waiters)
+	}
+
+	var updates []update
+	position := 0
+	for round := 0; position < total; round++ {
+		for i := range q.order {
+			session := q.order[(q.cursor+i)%len(q.order)]
+			waiters := q.waiting[session]
+			if round >= len(waiters) {
+				continue
+			}
+			position++
+			w := waiters[round]
+			if w.position != position && w.notify != nil {
+				updates = append(updates, update{w.notify, position, total})
+			}
+			w.position = position
+		}
+	}
+	return updates
+}
+
+// deliver calls notifications outside the queue lock, since they typically
+// send messages to clients
+func deliver(updates []update) {
+	for _, u := range updates {
+		u.notify(u.position, u.waiting)
+	}
+}
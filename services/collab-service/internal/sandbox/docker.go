@@ -0,0 +1,217 @@
+package sandbox
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/execution"
+	"github.com/codecollab/collab-service/internal/netpolicy"
+)
+
+// DockerOptions configure DockerDriver
+type DockerOptions struct {
+	// Host is the Docker Engine endpoint, e.g. unix:///var/run/docker.sock
+	Host string
+	// Image runs the execution service on ServicePort
+	Image       string
+	ServicePort int
+	// Network is the Docker network shared with the collab service. It
+	// must be internal for policies other than full access to hold.
+	Network string
+	// EgressNetwork is also joined by sandboxes with full network access
+	EgressNetwork string
+	MemoryMB      int
+	CPUs          float64
+}
+
+// DockerDriver runs each sandbox as a container on the local Docker Engine
+type DockerDriver struct {
+	opts   DockerOptions
+	client *http.Client
+	base   string
+}
+
+// NewDockerDriver returns a driver talking to the Docker Engine API
+func NewDockerDriver(opts DockerOptions) (*DockerDriver, error) {
+	if opts.ServicePort == 0 {
+		opts.ServicePort = 8004
+	}
+	endpoint, err := url.Parse(opts.Host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid docker host: %w", err)
+	}
+
+	transport := &http.Transport{}
+	base := "http://docker/v1.43"
+	switch endpoint.Scheme {
+	case "unix":
+		socket := endpoint.Path
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+	case "tcp", "http":
+		base = "http://" + endpoint.Host + "/v1.43"
+	default:
+		return nil, fmt.Errorf("unsupported docker host scheme %q", endpoint.Scheme)
+	}
+
+	return &DockerDriver{opts: opts, client: &http.Client{Transport: transport}, base: base}, nil
+}
+
+func (d *DockerDriver) Name() string { return "docker" }
+
+func (d *DockerDriver) Shared() bool { return false }
+
+// call sends a request to the Engine API and decodes a JSON response into
+// out, if given
+func (d *DockerDriver) call(ctx context.Context, method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, d.base+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("docker engine unavailable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("docker %s %s: %s %s", method, path, resp.Status, apiErr.Message)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+func (d *DockerDriver) Provision(ctx context.Context) (Sandbox, error) {
+	buf := make([]byte, 6)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	name := "codecollab-sandbox-" + hex.EncodeToString(buf)
+
+	hostConfig := map[string]any{
+		"NetworkMode": d.opts.Network,
+		"PidsLimit":   256,
+		"CapDrop":     []string{"ALL"},
+		"SecurityOpt": []string{"no-new-privileges"},
+	}
+	if d.opts.MemoryMB > 0 {
+		hostConfig["Memory"] = int64(d.opts.MemoryMB) * 1024 * 1024
+	}
+	if d.opts.CPUs > 0 {
+		hostConfig["NanoCpus"] = int64(d.opts.CPUs * 1e9)
+	}
+
+	var created struct {
+		ID string `json:"Id"`
+	}
+	err := d.call(ctx, http.MethodPost, "/containers/create?name="+url.QueryEscape(name), map[string]any{
+		"Image":      d.opts.Image,
+		"Labels":     map[string]string{"codecollab.sandbox": "true"},
+		"Env":        []string{fmt.Sprintf("PORT=%d", d.opts.ServicePort)},
+		"HostConfig": hostConfig,
+	}, &created)
+	if err != nil {
+		return nil, err
+	}
+
+	remove := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		return d.call(ctx, http.MethodDelete, "/containers/"+created.ID+"?force=true&v=true", nil, nil)
+	}
+
+	if err := d.call(ctx, http.MethodPost, "/containers/"+created.ID+"/start", nil, nil); err != nil {
+		remove()
+		return nil, err
+	}
+
+	var inspect struct {
+		NetworkSettings struct {
+			IPAddress string `json:"IPAddress"`
+			Networks  map[string]struct {
+				IPAddress string `json:"IPAddress"`
+			} `json:"Networks"`
+		} `json:"NetworkSettings"`
+	}
+	if err := d.call(ctx, http.MethodGet, "/containers/"+created.ID+"/json", nil, &inspect); err != nil {
+		remove()
+		return nil, err
+	}
+	ip := inspect.NetworkSettings.IPAddress
+	if network, ok := inspect.NetworkSettings.Networks[d.opts.Network]; ok && network.IPAddress != "" {
+		ip = network.IPAddress
+	}
+	if ip == "" {
+		remove()
+		return nil, fmt.Errorf("container %s has no IP address", name)
+	}
+
+	baseURL := fmt.Sprintf("http://%s:%d", ip, d.opts.ServicePort)
+	if err := waitHealthy(ctx, baseURL); err != nil {
+		remove()
+		return nil, err
+	}
+
+	return &service{
+		id:      strings.TrimPrefix(name, "codecollab-sandbox-"),
+		host:    ip,
+		client:  execution.NewClient(baseURL),
+		destroy: remove,
+		setPolicy: func(ctx context.Context, policy netpolicy.Policy) error {
+			return d.setPolicy(ctx, created.ID, policy)
+		},
+	}, nil
+}
+
+// setPolicy gives a container full access by joining the egress network.
+// Otherwise it stays on the internal network alone, where allowlisted
+// hosts are only reachable through the egress proxy.
+func (d *DockerDriver) setPolicy(ctx context.Context, container string, policy netpolicy.Policy) error {
+	if policy.Mode == netpolicy.Full {
+		if d.opts.EgressNetwork == "" {
+			return nil
+		}
+		return d.call(ctx, http.MethodPost, "/networks/"+url.PathEscape(d.opts.EgressNetwork)+"/connect", map[string]string{"Container": container}, nil)
+	}
+
+	var network struct {
+		Internal bool `json:"Internal"`
+	}
+	if err := d.call(ctx, http.MethodGet, "/networks/"+url.PathEscape(d.opts.Network), nil, &network); err != nil {
+		return err
+	}
+	if !network.Internal {
+		return fmt.Errorf("docker network %s is not internal, so it cannot restrict egress", d.opts.Network)
+	}
+	return nil
+}
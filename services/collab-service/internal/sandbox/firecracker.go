@@ -0,0 +1,320 @@
+package sandbox
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/execution"
+	"github.com/codecollab/collab-service/internal/netpolicy"
+)
+
+// Tap is a host tap device reserved for one microVM at a time, with the
+// addresses the guest is booted with
+type Tap struct {
+	Device  string
+	GuestIP string
+	HostIP  string
+	Netmask string
+}
+
+// FirecrackerOptions configure FirecrackerDriver
+type FirecrackerOptions struct {
+	Binary      string
+	KernelImage string
+	// RootFS is copied for every microVM so guests never share a disk
+	RootFS      string
+	KernelArgs  string
+	VCPUs       int
+	MemoryMB    int
+	ServicePort int
+	// WorkDir holds API sockets and per-VM disks
+	WorkDir string
+	Taps    []Tap
+	// IPTables enforces network policies on the tap devices. Guests under
+	// an allowlist may only connect to the host on ProxyPort.
+	IPTables  string
+	ProxyPort int
+}
+
+// FirecrackerDriver boots each sandbox as a Firecracker microVM whose
+// rootfs starts the execution service
+type FirecrackerDriver struct {
+	opts FirecrackerOptions
+
+	mu   sync.Mutex
+	free []Tap
+}
+
+// NewFirecrackerDriver checks the VM assets and returns a driver
+func NewFirecrackerDriver(opts FirecrackerOptions) (*FirecrackerDriver, error) {
+	if opts.ServicePort == 0 {
+		opts.ServicePort = 8004
+	}
+	if opts.VCPUs == 0 {
+		opts.VCPUs = 1
+	}
+	if opts.MemoryMB == 0 {
+		opts.MemoryMB = 512
+	}
+	if opts.IPTables == "" {
+		opts.IPTables = "iptables"
+	}
+	if opts.ProxyPort == 0 {
+		opts.ProxyPort = 3128
+	}
+	if opts.KernelArgs == "" {
+		opts.KernelArgs = "console=ttyS0 reboot=k panic=1 pci=off"
+	}
+	for _, path := range []string{opts.KernelImage, opts.RootFS} {
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("firecracker asset: %w", err)
+		}
+	}
+	if _, err := exec.LookPath(opts.Binary); err != nil {
+		return nil, fmt.Errorf("firecracker binary: %w", err)
+	}
+	if _, err := exec.LookPath(opts.IPTables); err != nil {
+		return nil, fmt.Errorf("iptables: %w", err)
+	}
+	if len(opts.Taps) == 0 {
+		return nil, fmt.Errorf("firecracker needs at least one tap device")
+	}
+	if err := os.MkdirAll(opts.WorkDir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FirecrackerDriver{opts: opts, free: append([]Tap(nil), opts.Taps...)}, nil
+}
+
+func (d *FirecrackerDriver) Name() string { return "firecracker" }
+
+func (d *FirecrackerDriver) Shared() bool { return false }
+
+func (d *FirecrackerDriver) takeTap() (Tap, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.free) == 0 {
+		return Tap{}, false
+	}
+	tap := d.free[0]
+	d.free = d.free[1:]
+	return tap, true
+}
+
+func (d *FirecrackerDriver) returnTap(tap Tap) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.free = append(d.free, tap)
+}
+
+func (d *FirecrackerDriver) Provision(ctx context.Context) (Sandbox, error) {
+	tap, ok := d.takeTap()
+	if !ok {
+		return nil, ErrPoolExhausted
+	}
+
+	buf := make([]byte, 6)
+	if _, err := rand.Read(buf); err != nil {
+		d.returnTap(tap)
+		return nil, err
+	}
+	id := hex.EncodeToString(buf)
+	socket := filepath.Join(d.opts.WorkDir, id+".sock")
+	disk := filepath.Join(d.opts.WorkDir, id+".ext4")
+
+	vm := &firecrackerVM{driver: d, tap: tap, socket: socket, disk: disk}
+	if err := copyFile(d.opts.RootFS, disk); err != nil {
+		vm.destroy()
+		return nil, fmt.Errorf("copy rootfs: %w", err)
+	}
+
+	vm.cmd = exec.Command(d.opts.Binary, "--api-sock", socket)
+	if err := vm.cmd.Start(); err != nil {
+		vm.destroy()
+		return nil, fmt.Errorf("start firecracker: %w", err)
+	}
+
+	if err := vm.configure(ctx); err != nil {
+		vm.destroy()
+		return nil, err
+	}
+
+	baseURL := "http://" + net.JoinHostPort(tap.GuestIP, fmt.Sprint(d.opts.ServicePort))
+	if err := waitHealthy(ctx, baseURL); err != nil {
+		vm.destroy()
+		return nil, err
+	}
+
+	return &service{id: id, host: tap.GuestIP, client: execution.NewClient(baseURL), destroy: vm.destroy, setPolicy: vm.setPolicy}, nil
+}
+
+type firecrackerVM struct {
+	driver *FirecrackerDriver
+	tap    Tap
+	socket string
+	disk   string
+	cmd    *exec.Cmd
+	once   sync.Once
+
+	mu sync.Mutex
+	// rules are the iptables rules added for the VM, as chain and match
+	rules [][]string
+}
+
+// policyRules returns the iptables rules enforcing policy on a tap device,
+// in the order they must end up in their chains
+func policyRules(tap string, policy netpolicy.Policy, proxyPort int) [][]string {
+	if policy.Mode == netpolicy.Full {
+		return nil
+	}
+	rules := [][]string{{"FORWARD", "-i", tap, "-j", "DROP"}}
+	if policy.Mode == netpolicy.Allowlist {
+		rules = append(rules, []string{"INPUT", "-i", tap, "-p", "tcp", "--dport", fmt.Sprint(proxyPort), "-j", "ACCEPT"})
+	}
+	// Replies to the collab service's own connections still get through
+	return append(rules, []string{"INPUT", "-i", tap, "-m", "conntrack", "--ctstate", "NEW", "-j", "DROP"})
+}
+
+// setPolicy adds the iptables rules for policy to the VM's tap device
+func (vm *firecrackerVM) setPolicy(ctx context.Context, policy netpolicy.Policy) error {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+
+	rules := policyRules(vm.tap.Device, policy, vm.driver.opts.ProxyPort)
+	position := make(map[string]int)
+	for _, rule := range rules {
+		chain := rule[0]
+		position[chain]++
+		args := append([]string{"-w", "-I", chain, fmt.Sprint(position[chain])}, rule[1:]...)
+		if out, err := exec.CommandContext(ctx, vm.driver.opts.IPTables, args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("iptables %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+		}
+		vm.rules = append(vm.rules, rule)
+	}
+	return nil
+}
+
+// removeRules deletes the VM's iptables rules so the tap can be reused
+func (vm *firecrackerVM) removeRules() error {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+
+	var err error
+	for _, rule := range vm.rules {
+		args := append([]string{"-w", "-D"}, rule...)
+		if out, runErr := exec.Command(vm.driver.opts.IPTables, args...).CombinedOutput(); runErr != nil && err == nil {
+			err = fmt.Errorf("iptables %s: %v: %s", strings.Join(args, " "), runErr, strings.TrimSpace(string(out)))
+		}
+	}
+	vm.rules = nil
+	return err
+}
+
+// configure sets the microVM up through the Firecracker API and boots it
+func (vm *firecrackerVM) configure(ctx context.Context) error {
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", vm.socket)
+		},
+	}}
+
+	// The API socket appears shortly after the process starts
+	for {
+		if _, err := os.Stat(vm.socket); err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("firecracker API socket did not appear: %w", ctx.Err())
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	opts := vm.driver.opts
+	bootArgs := fmt.Sprintf("%s ip=%s::%s:%s::eth0:off", opts.KernelArgs, vm.tap.GuestIP, vm.tap.HostIP, vm.tap.Netmask)
+	steps := []struct {
+		path string
+		body any
+	}{
+		{"/machine-config", map[string]any{"vcpu_count": opts.VCPUs, "mem_size_mib": opts.MemoryMB}},
+		{"/boot-source", map[string]any{"kernel_image_path": opts.KernelImage, "boot_args": bootArgs}},
+		{"/drives/rootfs", map[string]any{"drive_id": "rootfs", "path_on_host": vm.disk, "is_root_device": true, "is_read_only": false}},
+		{"/network-interfaces/eth0", map[string]any{"iface_id": "eth0", "host_dev_name": vm.tap.Device}},
+		{"/actions", map[string]any{"action_type": "InstanceStart"}},
+	}
+	for _, step := range steps {
+		encoded, err := json.Marshal(step.body)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, "http://firecracker"+step.path, bytes.NewReader(encoded))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("firecracker %s: %w", step.path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("firecracker %s: %s %s", step.path, resp.Status, strings.TrimSpace(string(body)))
+		}
+	}
+	return nil
+}
+
+// destroy stops the microVM and frees its disk and tap device
+func (vm *firecrackerVM) destroy() error {
+	var err error
+	vm.once.Do(func() {
+		if vm.cmd != nil && vm.cmd.Process != nil {
+			vm.cmd.Process.Kill()
+			vm.cmd.Wait()
+		}
+		os.Remove(vm.socket)
+		if rmErr := os.Remove(vm.disk); rmErr != nil && !os.IsNotExist(rmErr) {
+			err = rmErr
+		}
+		if rulesErr := vm.removeRules(); rulesErr != nil {
+			// Leave the tap out of rotation rather than hand it to a VM
+			// with stale rules
+			err = rulesErr
+			return
+		}
+		vm.driver.returnTap(vm.tap)
+	})
+	return err
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
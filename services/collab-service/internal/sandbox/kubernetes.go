@@ -0,0 +1,302 @@
+package sandbox
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/execution"
+	"github.com/codecollab/collab-service/internal/netpolicy"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// KubernetesOptions configure KubernetesDriver
+type KubernetesOptions struct {
+	// Namespace defaults to the namespace of the collab service's pod
+	Namespace   string
+	Image       string
+	ServicePort int
+	MemoryMB    int
+	CPUs        float64
+	// MaxLifetime bounds how long a sandbox Job may run
+	MaxLifetime time.Duration
+	// ProxyLabels select the egress proxy pods that sandboxes under an
+	// allowlist may reach on ProxyPort
+	ProxyLabels map[string]string
+	ProxyPort   int
+}
+
+// KubernetesDriver runs each sandbox as a single-pod Job, using the
+// in-cluster service account
+type KubernetesDriver struct {
+	opts   KubernetesOptions
+	client *http.Client
+	base   string
+	token  string
+}
+
+// NewKubernetesDriver returns a driver for the cluster the service runs in
+func NewKubernetesDriver(opts KubernetesOptions) (*KubernetesDriver, error) {
+	if opts.ServicePort == 0 {
+		opts.ServicePort = 8004
+	}
+	if opts.ProxyPort == 0 {
+		opts.ProxyPort = 3128
+	}
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running inside a Kubernetes cluster")
+	}
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("read service account token: %w", err)
+	}
+	caCert, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("read cluster CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, errors.New("invalid cluster CA certificate")
+	}
+	if opts.Namespace == "" {
+		namespace, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("read namespace: %w", err)
+		}
+		opts.Namespace = strings.TrimSpace(string(namespace))
+	}
+
+	return &KubernetesDriver{
+		opts: opts,
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+		base:  "https://" + net.JoinHostPort(host, port),
+		token: strings.TrimSpace(string(token)),
+	}, nil
+}
+
+func (d *KubernetesDriver) Name() string { return "kubernetes" }
+
+func (d *KubernetesDriver) Shared() bool { return false }
+
+func (d *KubernetesDriver) call(ctx context.Context, method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, d.base+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+d.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("kubernetes API unavailable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var status struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&status)
+		return fmt.Errorf("kubernetes %s %s: %s %s", method, path, resp.Status, status.Message)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+func (d *KubernetesDriver) Provision(ctx context.Context) (Sandbox, error) {
+	resources := map[string]any{}
+	limits := map[string]string{}
+	if d.opts.MemoryMB > 0 {
+		limits["memory"] = fmt.Sprintf("%dMi", d.opts.MemoryMB)
+	}
+	if d.opts.CPUs > 0 {
+		limits["cpu"] = fmt.Sprintf("%dm", int(d.opts.CPUs*1000))
+	}
+	if len(limits) > 0 {
+		resources["limits"] = limits
+	}
+
+	podSpec := map[string]any{
+		"restartPolicy":                "Never",
+		"automountServiceAccountToken": false,
+		"containers": []map[string]any{{
+			"name":      "sandbox",
+			"image":     d.opts.Image,
+			"env":       []map[string]string{{"name": "PORT", "value": fmt.Sprint(d.opts.ServicePort)}},
+			"ports":     []map[string]int{{"containerPort": d.opts.ServicePort}},
+			"resources": resources,
+			"securityContext": map[string]any{
+				"allowPrivilegeEscalation": false,
+				"capabilities":             map[string][]string{"drop": {"ALL"}},
+			},
+		}},
+	}
+	if d.opts.MaxLifetime > 0 {
+		podSpec["activeDeadlineSeconds"] = int(d.opts.MaxLifetime / time.Second)
+	}
+
+	job := map[string]any{
+		"apiVersion": "batch/v1",
+		"kind":       "Job",
+		"metadata": map[string]any{
+			"generateName": "codecollab-sandbox-",
+			"labels":       map[string]string{"app": "codecollab-sandbox"},
+		},
+		"spec": map[string]any{
+			"backoffLimit":            0,
+			"ttlSecondsAfterFinished": 60,
+			"template": map[string]any{
+				"metadata": map[string]any{"labels": map[string]string{"app": "codecollab-sandbox"}},
+				"spec":     podSpec,
+			},
+		},
+	}
+
+	jobsPath := "/apis/batch/v1/namespaces/" + url.PathEscape(d.opts.Namespace) + "/jobs"
+	var created struct {
+		Metadata struct {
+			Name string `json:"name"`
+			UID  string `json:"uid"`
+		} `json:"metadata"`
+	}
+	if err := d.call(ctx, http.MethodPost, jobsPath, job, &created); err != nil {
+		return nil, err
+	}
+	name := created.Metadata.Name
+
+	remove := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		return d.call(ctx, http.MethodDelete, jobsPath+"/"+url.PathEscape(name)+"?propagationPolicy=Background", nil, nil)
+	}
+
+	ip, err := d.waitForPod(ctx, name)
+	if err != nil {
+		remove()
+		return nil, err
+	}
+	baseURL := "http://" + net.JoinHostPort(ip, fmt.Sprint(d.opts.ServicePort))
+	if err := waitHealthy(ctx, baseURL); err != nil {
+		remove()
+		return nil, err
+	}
+
+	return &service{
+		id:      strings.TrimPrefix(name, "codecollab-sandbox-"),
+		host:    ip,
+		client:  execution.NewClient(baseURL),
+		destroy: remove,
+		setPolicy: func(ctx context.Context, policy netpolicy.Policy) error {
+			return d.setPolicy(ctx, name, created.Metadata.UID, policy)
+		},
+	}, nil
+}
+
+// setPolicy restricts a sandbox pod's egress with a NetworkPolicy owned by
+// its Job, so it goes away with the Job. Full access needs none.
+func (d *KubernetesDriver) setPolicy(ctx context.Context, job, uid string, policy netpolicy.Policy) error {
+	if policy.Mode == netpolicy.Full {
+		return nil
+	}
+
+	egress := []map[string]any{}
+	if policy.Mode == netpolicy.Allowlist {
+		egress = append(egress,
+			map[string]any{
+				"to":    []map[string]any{{"podSelector": map[string]any{"matchLabels": d.opts.ProxyLabels}}},
+				"ports": []map[string]any{{"protocol": "TCP", "port": d.opts.ProxyPort}},
+			},
+			// The proxy is addressed by its service name
+			map[string]any{
+				"to": []map[string]any{{
+					"namespaceSelector": map[string]any{},
+					"podSelector":       map[string]any{"matchLabels": map[string]string{"k8s-app": "kube-dns"}},
+				}},
+				"ports": []map[string]any{{"protocol": "UDP", "port": 53}, {"protocol": "TCP", "port": 53}},
+			},
+		)
+	}
+
+	networkPolicy := map[string]any{
+		"apiVersion": "networking.k8s.io/v1",
+		"kind":       "NetworkPolicy",
+		"metadata": map[string]any{
+			"name":   job,
+			"labels": map[string]string{"app": "codecollab-sandbox"},
+			"ownerReferences": []map[string]any{{
+				"apiVersion": "batch/v1",
+				"kind":       "Job",
+				"name":       job,
+				"uid":        uid,
+			}},
+		},
+		"spec": map[string]any{
+			"podSelector": map[string]any{"matchLabels": map[string]string{"job-name": job}},
+			"policyTypes": []string{"Egress"},
+			"egress":      egress,
+		},
+	}
+	path := "/apis/networking.k8s.io/v1/namespaces/" + url.PathEscape(d.opts.Namespace) + "/networkpolicies"
+	return d.call(ctx, http.MethodPost, path, networkPolicy, nil)
+}
+
+// waitForPod polls until the Job's pod is running and returns its IP
+func (d *KubernetesDriver) waitForPod(ctx context.Context, job string) (string, error) {
+	path := "/api/v1/namespaces/" + url.PathEscape(d.opts.Namespace) + "/pods?labelSelector=" + url.QueryEscape("job-name="+job)
+	for {
+		var pods struct {
+			Items []struct {
+				Status struct {
+					Phase string `json:"phase"`
+					PodIP string `json:"podIP"`
+				} `json:"status"`
+			} `json:"items"`
+		}
+		if err := d.call(ctx, http.MethodGet, path, nil, &pods); err != nil {
+			return "", err
+		}
+		for _, pod := range pods.Items {
+			switch pod.Status.Phase {
+			case "Running":
+				if pod.Status.PodIP != "" {
+					return pod.Status.PodIP, nil
+				}
+			case "Failed", "Succeeded":
+				return "", fmt.Errorf("sandbox pod for %s exited (%s)", job, pod.Status.Phase)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("sandbox pod for %s did not start: %w", job, ctx.Err())
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
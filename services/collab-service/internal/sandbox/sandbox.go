@@ -0,0 +1,429 @@
+// Package sandbox abstracts where code runs. A Driver provisions sandboxes
+// that each serve the execution service API, and a Pool hands them out to
+// sessions, keeping some pre-provisioned so a session's first run doesn't
+// pay the cold start.
+package sandbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/execution"
+	"github.com/codecollab/collab-service/internal/netpolicy"
+)
+
+// ErrPoolExhausted is returned when the pool is at its maximum size
+var ErrPoolExhausted = errors.New("no sandbox capacity available")
+
+// Sandbox is an isolated environment that runs code
+type Sandbox interface {
+	ID() string
+	// Host is the address ports opened by runs are reachable on
+	Host() string
+	Execute(ctx context.Context, req execution.Request) (*execution.Result, error)
+	// ExecuteStream is Execute with output passed to onOutput as it arrives
+	ExecuteStream(ctx context.Context, req execution.Request, onOutput func(execution.Output)) (*execution.Result, error)
+	// Cancel kills the processes of a run and returns how many were killed
+	Cancel(ctx context.Context, runID string) (int, error)
+	// Install sets up dependencies that runs can then use
+	Install(ctx context.Context, req execution.InstallRequest) (*execution.InstallResult, error)
+	PurgeInstalls(ctx context.Context, keys []string) error
+	// SetNetworkPolicy restricts the sandbox's outbound connections. It is
+	// applied once, before the sandbox runs any code.
+	SetNetworkPolicy(ctx context.Context, policy netpolicy.Policy) error
+	// Close destroys the sandbox
+	Close() error
+}
+
+// Driver provisions sandboxes on some backend
+type Driver interface {
+	Name() string
+	Provision(ctx context.Context) (Sandbox, error)
+	// Shared reports whether every session uses the same sandbox, in which
+	// case the pool neither pre-provisions nor destroys it
+	Shared() bool
+}
+
+// service is a sandbox reached over the execution service HTTP API
+type service struct {
+	id      string
+	host    string
+	client  *execution.Client
+	destroy func() error
+	// setPolicy enforces a network policy; without it only full access is
+	// possible
+	setPolicy func(ctx context.Context, policy netpolicy.Policy) error
+}
+
+func (s *service) ID() string { return s.id }
+
+func (s *service) Host() string { return s.host }
+
+func (s *service) Execute(ctx context.Context, req execution.Request) (*execution.Result, error) {
+	return s.client.Execute(ctx, req)
+}
+
+func (s *service) ExecuteStream(ctx context.Context, req execution.Request, onOutput func(execution.Output)) (*execution.Result, error) {
+	return s.client.ExecuteStream(ctx, req, onOutput)
+}
+
+func (s *service) Cancel(ctx context.Context, runID string) (int, error) {
+	return s.client.Cancel(ctx, runID)
+}
+
+func (s *service) Install(ctx context.Context, req execution.InstallRequest) (*execution.InstallResult, error) {
+	return s.client.Install(ctx, req)
+}
+
+func (s *service) PurgeInstalls(ctx context.Context, keys []string) error {
+	return s.client.PurgeInstalls(ctx, keys)
+}
+
+func (s *service) SetNetworkPolicy(ctx context.Context, policy netpolicy.Policy) error {
+	if s.setPolicy == nil {
+		if policy.Mode == netpolicy.Full {
+			return nil
+		}
+		return fmt.Errorf("this sandbox cannot enforce a %s network policy", policy.Mode)
+	}
+	return s.setPolicy(ctx, policy)
+}
+
+func (s *service) Close() error {
+	if s.destroy == nil {
+		return nil
+	}
+	return s.destroy()
+}
+
+// waitHealthy polls the execution service health endpoint of a freshly
+// started sandbox until it answers
+func waitHealthy(ctx context.Context, baseURL string) error {
+	client := &http.Client{Timeout: 2 * time.Second}
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/health", nil)
+		if err != nil {
+			return err
+		}
+		if resp, err := client.Do(req); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("sandbox at %s did not become healthy: %w", baseURL, ctx.Err())
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+// ServiceDriver sends every run to one shared execution service
+type ServiceDriver struct {
+	sandbox *service
+}
+
+// NewServiceDriver returns a driver for the execution service at baseURL,
+// whose ports are reached on host
+func NewServiceDriver(baseURL, host string) *ServiceDriver {
+	return &ServiceDriver{sandbox: &service{id: "shared", host: host, client: execution.NewClient(baseURL)}}
+}
+
+func (d *ServiceDriver) Name() string { return "service" }
+
+func (d *ServiceDriver) Shared() bool { return true }
+
+func (d *ServiceDriver) Provision(context.Context) (Sandbox, error) {
+	return d.sandbox, nil
+}
+
+// PoolOptions size a Pool
+type PoolOptions struct {
+	// WarmSize sandboxes are kept provisioned ahead of demand
+	WarmSize int
+	// MaxSize caps warm plus assigned sandboxes; 0 means no limit
+	MaxSize int
+	// ProvisionTimeout bounds starting a single sandbox
+	ProvisionTimeout time.Duration
+}
+
+// Stats describes the pool for health reporting
+type Stats struct {
+	Driver       string `json:"driver"`
+	Warm         int    `json:"warm"`
+	Assigned     int    `json:"assigned"`
+	Provisioning int    `json:"provisioning"`
+}
+
+// Pool assigns one sandbox per session for the session's lifetime
+type Pool struct {
+	driver Driver
+	opts   PoolOptions
+
+	mu           sync.Mutex
+	warm         []Sandbox
+	assigned     map[string]Sandbox
+	pending      map[string]*provision
+	provisioning int
+	// warming counts the provisions that will join the warm set
+	warming int
+	closed  bool
+}
+
+// provision is an in-flight sandbox for a session, shared by concurrent
+// runs so a session never gets two
+type provision struct {
+	done    chan struct{}
+	sandbox Sandbox
+	err     error
+}
+
+// NewPool starts a pool and begins filling its warm set
+func NewPool(driver Driver, opts PoolOptions) *Pool {
+	if opts.ProvisionTimeout <= 0 {
+		opts.ProvisionTimeout = 2 * time.Minute
+	}
+	p := &Pool{
+		driver:   driver,
+		opts:     opts,
+		assigned: make(map[string]Sandbox),
+		pending:  make(map[string]*provision),
+	}
+	if !driver.Shared() {
+		p.refill()
+	}
+	return p
+}
+
+// totalLocked counts sandboxes that exist or are being created. Caller must
+// hold p.mu.
+func (p *Pool) totalLocked() int {
+	return len(p.warm) + len(p.assigned) + p.provisioning
+}
+
+// Acquire returns the session's sandbox, taking a warm one or provisioning
+// a new one on its first run. policy is applied when the sandbox is
+// assigned to the session.
+func (p *Pool) Acquire(ctx context.Context, session string, policy netpolicy.Policy) (Sandbox, error) {
+	if p.driver.Shared() {
+		sb, err := p.driver.Provision(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := sb.SetNetworkPolicy(ctx, policy); err != nil {
+			return nil, err
+		}
+		return sb, nil
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, errors.New("sandbox pool is shut down")
+	}
+	if sb, ok := p.assigned[session]; ok {
+		p.mu.Unlock()
+		return sb, nil
+	}
+	if pending, ok := p.pending[session]; ok {
+		p.mu.Unlock()
+		select {
+		case <-pending.done:
+			return pending.sandbox, pending.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if len(p.warm) > 0 {
+		sb := p.warm[0]
+		p.warm = p.warm[1:]
+		pending := &provision{done: make(chan struct{})}
+		p.pending[session] = pending
+		p.mu.Unlock()
+		p.refill()
+		return p.assign(session, pending, sb, p.applyPolicy(sb, policy))
+	}
+	if p.opts.MaxSize > 0 && p.totalLocked() >= p.opts.MaxSize {
+		p.mu.Unlock()
+		return nil, ErrPoolExhausted
+	}
+	pending := &provision{done: make(chan struct{})}
+	p.pending[session] = pending
+	p.provisioning++
+	p.mu.Unlock()
+
+	provisionCtx, cancel := context.WithTimeout(context.Background(), p.opts.ProvisionTimeout)
+	defer cancel()
+	sb, err := p.driver.Provision(provisionCtx)
+
+	p.mu.Lock()
+	p.provisioning--
+	p.mu.Unlock()
+
+	if err != nil {
+		err = fmt.Errorf("failed to provision %s sandbox: %w", p.driver.Name(), err)
+	} else {
+		log.Printf("Provisioned %s sandbox %s for session %s", p.driver.Name(), sb.ID(), session)
+		err = p.applyPolicy(sb, policy)
+	}
+	return p.assign(session, pending, sb, err)
+}
+
+// applyPolicy sets a sandbox's network policy, bounded like provisioning
+func (p *Pool) applyPolicy(sb Sandbox, policy netpolicy.Policy) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.opts.ProvisionTimeout)
+	defer cancel()
+	if err := sb.SetNetworkPolicy(ctx, policy); err != nil {
+		return fmt.Errorf("failed to apply %s network policy: %w", policy.Mode, err)
+	}
+	return nil
+}
+
+// assign finishes handing sb to a session, or destroys it if err is set or
+// the pool shut down in the meantime, and wakes runs waiting on pending
+func (p *Pool) assign(session string, pending *provision, sb Sandbox, err error) (Sandbox, error) {
+	p.mu.Lock()
+	delete(p.pending, session)
+	closed := p.closed
+	if err == nil && !closed {
+		p.assigned[session] = sb
+	}
+	p.mu.Unlock()
+
+	if err == nil && closed {
+		err = errors.New("sandbox pool is shut down")
+	}
+	if err != nil && sb != nil {
+		if closeErr := sb.Close(); closeErr != nil {
+			log.Printf("Failed to destroy sandbox %s: %v", sb.ID(), closeErr)
+		}
+		sb = nil
+	}
+	pending.sandbox, pending.err = sb, err
+	close(pending.done)
+	return sb, err
+}
+
+// Lookup returns the sandbox already assigned to a session
+func (p *Pool) Lookup(session string) (Sandbox, bool) {
+	if p.driver.Shared() {
+		sb, err := p.driver.Provision(context.Background())
+		return sb, err == nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sb, ok := p.assigned[session]
+	return sb, ok
+}
+
+// SessionAt returns the session whose sandbox is reachable at host
+func (p *Pool) SessionAt(host string) (string, bool) {
+	if p.driver.Shared() {
+		return "", false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for session, sb := range p.assigned {
+		if sb.Host() == host {
+			return session, true
+		}
+	}
+	return "", false
+}
+
+// Release destroys a session's sandbox when the session ends, so no state
+// carries over to other sessions
+func (p *Pool) Release(session string) {
+	if p.driver.Shared() {
+		return
+	}
+
+	p.mu.Lock()
+	sb, ok := p.assigned[session]
+	delete(p.assigned, session)
+	p.mu.Unlock()
+
+	if ok {
+		go func() {
+			if err := sb.Close(); err != nil {
+				log.Printf("Failed to destroy sandbox %s: %v", sb.ID(), err)
+			}
+		}()
+		p.refill()
+	}
+}
+
+// refill provisions warm sandboxes in the background until the warm set is
+// full or the pool reaches its maximum size
+func (p *Pool) refill() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for !p.closed && len(p.warm)+p.warming < p.opts.WarmSize &&
+		(p.opts.MaxSize <= 0 || p.totalLocked() < p.opts.MaxSize) {
+		p.provisioning++
+		p.warming++
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), p.opts.ProvisionTimeout)
+			defer cancel()
+			sb, err := p.driver.Provision(ctx)
+
+			p.mu.Lock()
+			p.provisioning--
+			p.warming--
+			closed := p.closed
+			if err == nil && !closed {
+				p.warm = append(p.warm, sb)
+			}
+			p.mu.Unlock()
+
+			switch {
+			case err != nil:
+				log.Printf("Failed to pre-provision %s sandbox: %v", p.driver.Name(), err)
+			case closed:
+				sb.Close()
+			}
+		}()
+	}
+}
+
+// Stats returns the current pool sizes
+func (p *Pool) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return Stats{
+		Driver:       p.driver.Name(),
+		Warm:         len(p.warm),
+		Assigned:     len(p.assigned),
+		Provisioning: p.provisioning,
+	}
+}
+
+// Close destroys every sandbox the pool owns
+func (p *Pool) Close() {
+	if p.driver.Shared() {
+		return
+	}
+
+	p.mu.Lock()
+	p.closed = true
+	sandboxes := append([]Sandbox(nil), p.warm...)
+	for _, sb := range p.assigned {
+		sandboxes = append(sandboxes, sb)
+	}
+	p.warm = nil
+	p.assigned = make(map[string]Sandbox)
+	p.mu.Unlock()
+
+	for _, sb := range sandboxes {
+		if err := sb.Close(); err != nil {
+			log.Printf("Failed to destroy sandbox %s: %v", sb.ID(), err)
+		}
+	}
+}
@@ -0,0 +1,457 @@
+// Package scim is the part of SCIM 2.0 (RFC 7643 and 7644) enterprise
+// identity providers use to provision an organization's users and groups:
+// the User and Group resources, list responses paged by startIndex and
+// count, filters comparing one attribute with eq, and PATCH operations as
+// Okta and Azure AD send them. Errors are sent as SCIM error responses.
+package scim
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ContentType is the media type of SCIM requests and responses
+const ContentType = "application/scim+json"
+
+// Schema URIs
+const (
+	UserSchema         = "urn:ietf:params:scim:schemas:core:2.0:User"
+	GroupSchema        = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	ListSchema         = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	PatchSchema        = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	ErrorSchema        = "urn:ietf:params:scim:api:messages:2.0:Error"
+	ConfigSchema       = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	ResourceTypeSchema = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+)
+
+// MaxCount bounds the resources a list response returns
+const MaxCount = 200
+
+// Meta describes a resource
+type Meta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location,omitempty"`
+}
+
+// Name is a user's name, in parts
+type Name struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+// Email is one of a user's email addresses
+type Email struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// Ref is a reference to another resource: a group a user is a member of,
+// or a member of a group
+type Ref struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+// User is a User resource. UserName is the username of the user's tokens.
+// Active is a pointer so that a request leaving it out means true.
+type User struct {
+	Schemas     []string `json:"schemas"`
+	ID          string   `json:"id,omitempty"`
+	ExternalID  string   `json:"externalId,omitempty"`
+	UserName    string   `json:"userName"`
+	Name        *Name    `json:"name,omitempty"`
+	DisplayName string   `json:"displayName,omitempty"`
+	Emails      []Email  `json:"emails,omitempty"`
+	Active      *bool    `json:"active,omitempty"`
+	Groups      []Ref    `json:"groups,omitempty"`
+	Meta        *Meta    `json:"meta,omitempty"`
+}
+
+// IsActive reports whether the user is active, which they are unless set
+// otherwise
+func (u *User) IsActive() bool {
+	return u.Active == nil || *u.Active
+}
+
+// PrimaryEmail is the user's primary email address, or else their first
+func (u *User) PrimaryEmail() string {
+	for _, email := range u.Emails {
+		if email.Primary {
+			return email.Value
+		}
+	}
+	if len(u.Emails) > 0 {
+		return u.Emails[0].Value
+	}
+	return ""
+}
+
+// Group is a Group resource
+type Group struct {
+	Schemas     []string `json:"schemas"`
+	ID          string   `json:"id,omitempty"`
+	ExternalID  string   `json:"externalId,omitempty"`
+	DisplayName string   `json:"displayName"`
+	Members     []Ref    `json:"members,omitempty"`
+	Meta        *Meta    `json:"meta,omitempty"`
+}
+
+// ListResponse is a page of resources
+type ListResponse struct {
+	Schemas      []string `json:"schemas"`
+	TotalResults int      `json:"totalResults"`
+	StartIndex   int      `json:"startIndex"`
+	ItemsPerPage int      `json:"itemsPerPage"`
+	Resources    []any    `json:"Resources"`
+}
+
+// Error is the body of an error response. ScimType narrows the error
+// down for some of those with status 400 and 409.
+type Error struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail,omitempty"`
+}
+
+// NewError returns the body of an error response
+func NewError(status int, scimType, detail string) Error {
+	return Error{Schemas: []string{ErrorSchema}, Status: strconv.Itoa(status), ScimType: scimType, Detail: detail}
+}
+
+// Page is where a list request starts, counting from 1, and how many
+// resources it asks for
+type Page struct {
+	StartIndex int
+	Count      int
+}
+
+// ParsePage reads startIndex and count, each of which may be empty
+func ParsePage(startIndex, count string) (Page, error) {
+	page := Page{StartIndex: 1, Count: MaxCount}
+	if startIndex != "" {
+		n, err := strconv.Atoi(startIndex)
+		if err != nil {
+			return Page{}, errors.New("startIndex must be a number")
+		}
+		// Values below 1 are taken as 1
+		page.StartIndex = max(n, 1)
+	}
+	if count != "" {
+		n, err := strconv.Atoi(count)
+		if err != nil {
+			return Page{}, errors.New("count must be a number")
+		}
+		page.Count = min(max(n, 0), MaxCount)
+	}
+	return page, nil
+}
+
+// List returns the list response of the page of resources p asks for
+func List[T any](resources []T, p Page) ListResponse {
+	response := ListResponse{Schemas: []string{ListSchema}, TotalResults: len(resources), StartIndex: p.StartIndex, Resources: []any{}}
+	for _, resource := range resources[min(p.StartIndex-1, len(resources)):min(p.StartIndex-1+p.Count, len(resources))] {
+		response.Resources = append(response.Resources, resource)
+	}
+	response.ItemsPerPage = len(response.Resources)
+	return response
+}
+
+// Filter is a filter comparing one attribute with a value, such as
+// userName eq "alice", which is all identity providers filter by
+type Filter struct {
+	Attribute string
+	Value     string
+}
+
+// ParseFilter reads a filter, which may be empty. attributes are those
+// that can be filtered by.
+func ParseFilter(raw string, attributes ...string) (Filter, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return Filter{}, nil
+	}
+	attribute, rest, ok := strings.Cut(raw, " ")
+	operator, value, ok2 := strings.Cut(strings.TrimSpace(rest), " ")
+	if !ok || !ok2 || !strings.EqualFold(operator, "eq") {
+		return Filter{}, fmt.Errorf("unsupported filter: %s", raw)
+	}
+	var unquoted string
+	if err := json.Unmarshal([]byte(strings.TrimSpace(value)), &unquoted); err != nil {
+		return Filter{}, fmt.Errorf("unsupported filter: %s", raw)
+	}
+	for _, supported := range attributes {
+		if strings.EqualFold(attribute, supported) {
+			return Filter{Attribute: supported, Value: unquoted}, nil
+		}
+	}
+	return Filter{}, fmt.Errorf("can't filter by %s", attribute)
+}
+
+// PatchOp is the body of a PATCH request
+type PatchOp struct {
+	Schemas    []string    `json:"schemas"`
+	Operations []Operation `json:"Operations"`
+}
+
+// Operation is one change of a PATCH: add, replace or remove the value at
+// path, or without a path the attributes of value
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// ErrPatch wraps what is wrong with a PATCH that can't be applied
+var ErrPatch = errors.New("invalid patch")
+
+func patchError(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrPatch, fmt.Sprintf(format, args...))
+}
+
+// ApplyUser applies the operations to a user. Active may come as a string,
+// as Azure AD sends it.
+func (p PatchOp) ApplyUser(u *User) error {
+	for _, op := range p.Operations {
+		kind := strings.ToLower(op.Op)
+		if kind != "add" && kind != "replace" && kind != "remove" {
+			return patchError("unsupported op %q", op.Op)
+		}
+		attributes := map[string]json.RawMessage{}
+		if op.Path == "" {
+			if kind == "remove" {
+				return patchError("remove needs a path")
+			}
+			if err := json.Unmarshal(op.Value, &attributes); err != nil {
+				return patchError("value must be an object without a path")
+			}
+		} else {
+			attributes[op.Path] = op.Value
+		}
+		for path, value := range attributes {
+			if kind == "remove" {
+				value = nil
+			}
+			if err := setUserAttribute(u, path, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func setUserAttribute(u *User, path string, value json.RawMessage) error {
+	var err error
+	switch strings.ToLower(path) {
+	case "active":
+		var active bool
+		if value == nil {
+			return patchError("active can't be removed")
+		}
+		if err = json.Unmarshal(value, &active); err != nil {
+			var text string
+			if json.Unmarshal(value, &text) == nil {
+				active, err = strconv.ParseBool(text)
+			}
+		}
+		u.Active = &active
+	case "username":
+		if value == nil {
+			return patchError("userName can't be removed")
+		}
+		err = json.Unmarshal(value, &u.UserName)
+	case "displayname":
+		u.DisplayName = ""
+		err = unmarshalSet(value, &u.DisplayName)
+	case "externalid":
+		u.ExternalID = ""
+		err = unmarshalSet(value, &u.ExternalID)
+	case "name":
+		u.Name = nil
+		err = unmarshalSet(value, &u.Name)
+	case "name.formatted", "name.givenname", "name.familyname":
+		if u.Name == nil {
+			u.Name = &Name{}
+		}
+		part := map[string]*string{"name.formatted": &u.Name.Formatted, "name.givenname": &u.Name.GivenName, "name.familyname": &u.Name.FamilyName}[strings.ToLower(path)]
+		*part = ""
+		err = unmarshalSet(value, part)
+	case "emails", `emails[type eq "work"].value`, `emails[primary eq true].value`:
+		u.Emails = nil
+		if value != nil && strings.HasSuffix(path, ".value") {
+			var address string
+			if err = json.Unmarshal(value, &address); err == nil {
+				u.Emails = []Email{{Value: address, Type: "work", Primary: true}}
+			}
+		} else {
+			err = unmarshalSet(value, &u.Emails)
+		}
+	default:
+		// Attributes this service doesn't keep are ignored, as they would
+		// be on creating the user
+		return nil
+	}
+	if err != nil {
+		return patchError("invalid value for %s", path)
+	}
+	return nil
+}
+
+// unmarshalSet unmarshals value into v, unless the value is being removed
+func unmarshalSet(value json.RawMessage, v any) error {
+	if value == nil {
+		return nil
+	}
+	return json.Unmarshal(value, v)
+}
+
+// ApplyGroup applies the operations to a group. Members are added and
+// removed by their value, which is a user's ID.
+func (p PatchOp) ApplyGroup(g *Group) error {
+	for _, op := range p.Operations {
+		kind := strings.ToLower(op.Op)
+		path := strings.TrimSpace(op.Path)
+		switch {
+		case kind != "add" && kind != "replace" && kind != "remove":
+			return patchError("unsupported op %q", op.Op)
+
+		case path == "":
+			if kind == "remove" {
+				return patchError("remove needs a path")
+			}
+			var attributes struct {
+				DisplayName *string `json:"displayName"`
+				ExternalID  *string `json:"externalId"`
+				Members     []Ref   `json:"members"`
+			}
+			if err := json.Unmarshal(op.Value, &attributes); err != nil {
+				return patchError("value must be an object without a path")
+			}
+			if attributes.DisplayName != nil {
+				g.DisplayName = *attributes.DisplayName
+			}
+			if attributes.ExternalID != nil {
+				g.ExternalID = *attributes.ExternalID
+			}
+			if attributes.Members != nil {
+				if kind == "replace" {
+					g.Members = nil
+				}
+				g.addMembers(attributes.Members)
+			}
+
+		case strings.EqualFold(path, "displayName"):
+			if kind == "remove" || json.Unmarshal(op.Value, &g.DisplayName) != nil {
+				return patchError("invalid value for displayName")
+			}
+
+		case strings.EqualFold(path, "externalId"):
+			g.ExternalID = ""
+			if kind != "remove" && json.Unmarshal(op.Value, &g.ExternalID) != nil {
+				return patchError("invalid value for externalId")
+			}
+
+		case strings.EqualFold(path, "members"):
+			var members []Ref
+			if op.Value != nil && json.Unmarshal(op.Value, &members) != nil {
+				return patchError("members must be a list")
+			}
+			switch {
+			case kind == "add":
+				g.addMembers(members)
+			case kind == "replace":
+				g.Members = nil
+				g.addMembers(members)
+			case members == nil:
+				g.Members = nil
+			default:
+				for _, member := range members {
+					g.removeMember(member.Value)
+				}
+			}
+
+		case kind == "remove" && strings.HasPrefix(strings.ToLower(path), "members["):
+			// members[value eq "id"]
+			filter, err := ParseFilter(strings.TrimSuffix(path[len("members["):], "]"), "value")
+			if err != nil {
+				return patchError("unsupported path %q", op.Path)
+			}
+			g.removeMember(filter.Value)
+
+		default:
+			return patchError("unsupported path %q", op.Path)
+		}
+	}
+	return nil
+}
+
+func (g *Group) addMembers(members []Ref) {
+	for _, member := range members {
+		if member.Value == "" {
+			continue
+		}
+		known := false
+		for _, existing := range g.Members {
+			known = known || existing.Value == member.Value
+		}
+		if !known {
+			g.Members = append(g.Members, Ref{Value: member.Value})
+		}
+	}
+}
+
+func (g *Group) removeMember(id string) {
+	kept := g.Members[:0]
+	for _, member := range g.Members {
+		if member.Value != id {
+			kept = append(kept, member)
+		}
+	}
+	g.Members = kept
+}
+
+// ServiceProviderConfig describes what of SCIM this service supports
+func ServiceProviderConfig() map[string]any {
+	supported := func(ok bool) map[string]bool { return map[string]bool{"supported": ok} }
+	return map[string]any{
+		"schemas":        []string{ConfigSchema},
+		"patch":          supported(true),
+		"bulk":           map[string]any{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]any{"supported": true, "maxResults": MaxCount},
+		"changePassword": supported(false),
+		"sort":           supported(false),
+		"etag":           supported(false),
+		"authenticationSchemes": []map[string]any{{
+			"type":        "oauthbearertoken",
+			"name":        "OAuth Bearer Token",
+			"description": "The organization's SCIM token",
+		}},
+	}
+}
+
+// ResourceTypes describes the User and Group resources, found under base
+func ResourceTypes(base string) []map[string]any {
+	resourceType := func(name, endpoint, schema string) map[string]any {
+		return map[string]any{
+			"schemas":  []string{ResourceTypeSchema},
+			"id":       name,
+			"name":     name,
+			"endpoint": endpoint,
+			"schema":   schema,
+			"meta":     map[string]string{"resourceType": "ResourceType", "location": base + "/ResourceTypes/" + name},
+		}
+	}
+	return []map[string]any{
+		resourceType("User", "/Users", UserSchema),
+		resourceType("Group", "/Groups", GroupSchema),
+	}
+}
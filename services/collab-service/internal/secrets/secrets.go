@@ -0,0 +1,76 @@
+// Package secrets seals small values with AES-GCM so they are never held in
+// plaintext at rest.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// KeySize is the length of an AES-256 key
+const KeySize = 32
+
+// Box encrypts and decrypts values with a single key
+type Box struct {
+	aead cipher.AEAD
+}
+
+// NewBox returns a Box for a KeySize-byte key
+func NewBox(key []byte) (*Box, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Box{aead: aead}, nil
+}
+
+// ParseKey decodes a base64 key, or generates a random one when encoded is
+// empty. Values sealed with a generated key don't survive a restart.
+func ParseKey(encoded string) ([]byte, error) {
+	if encoded == "" {
+		key := make([]byte, KeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("key is not valid base64: %w", err)
+	}
+	return key, nil
+}
+
+// Seal encrypts plaintext under a fresh nonce, which is prepended to the
+// result
+func (b *Box) Seal(plaintext string) ([]byte, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return b.aead.Seal(nonce, nonce, []byte(plaintext), nil), nil
+}
+
+// Open decrypts a value produced by Seal
+func (b *Box) Open(sealed []byte) (string, error) {
+	size := b.aead.NonceSize()
+	if len(sealed) < size {
+		return "", errors.New("sealed value is too short")
+	}
+	plaintext, err := b.aead.Open(nil, sealed[:size], sealed[size:], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,158 @@
+// Package sqlsandbox provides throwaway SQLite databases that sessions can
+// run queries against without touching any shared database.
+package sqlsandbox
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// ErrTooManyRows is returned when a result set exceeds the row limit. The
+// rows up to the limit have already been delivered.
+var ErrTooManyRows = errors.New("result set truncated")
+
+// Sandbox is a database owned by a single session
+type Sandbox struct {
+	db   *sql.DB
+	path string
+}
+
+// Open creates a new empty database file named after id inside dir
+func Open(dir, id string) (*Sandbox, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	name := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == '.' {
+			return '_'
+		}
+		return r
+	}, id)
+	path := filepath.Join(dir, name+".db")
+	// A leftover file from a previous run belongs to nobody
+	os.Remove(path)
+
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite serializes writers anyway; one connection keeps temp tables
+	// and pragmas visible to every query in the session
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Sandbox{db: db, path: path}, nil
+}
+
+// Page is a batch of rows from a result set. Columns is only set on the
+// first page.
+type Page struct {
+	Columns []string
+	Rows    [][]any
+}
+
+// Result summarizes a finished query
+type Result struct {
+	RowCount     int
+	RowsAffected int64
+}
+
+// Query runs query and hands its rows to fn in pages of pageSize. At most
+// maxRows rows are delivered; 0 means no limit. Statements that return no
+// rows report the number of rows they changed instead.
+func (s *Sandbox) Query(ctx context.Context, query string, pageSize, maxRows int, fn func(Page) error) (Result, error) {
+	var result Result
+	if pageSize < 1 {
+		pageSize = 100
+	}
+
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return result, err
+	}
+	defer conn.Close()
+
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return result, err
+	}
+	if len(columns) == 0 {
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return result, err
+		}
+		var changes int64
+		if err := conn.QueryRowContext(ctx, "SELECT changes()").Scan(&changes); err == nil {
+			result.RowsAffected = changes
+		}
+		return result, nil
+	}
+
+	page := Page{Columns: columns}
+	for rows.Next() {
+		if maxRows > 0 && result.RowCount >= maxRows {
+			if err := fn(page); err != nil {
+				return result, err
+			}
+			return result, ErrTooManyRows
+		}
+		values := make([]any, len(columns))
+		ptrs := make([]any, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return result, err
+		}
+		for i, v := range values {
+			// Text columns come back as []byte, which would encode as base64
+			if b, ok := v.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		page.Rows = append(page.Rows, values)
+		result.RowCount++
+
+		if len(page.Rows) == pageSize {
+			if err := fn(page); err != nil {
+				return result, err
+			}
+			page = Page{}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+	if len(page.Rows) > 0 || page.Columns != nil {
+		if err := fn(page); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// Close closes the database and deletes its file
+func (s *Sandbox) Close() error {
+	err := s.db.Close()
+	for _, suffix := range []string{"", "-journal", "-wal", "-shm"} {
+		if rmErr := os.Remove(s.path + suffix); rmErr != nil && !os.IsNotExist(rmErr) && err == nil {
+			err = fmt.Errorf("remove sandbox: %w", rmErr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,1622 @@
+// Package store keeps session documents in PostgreSQL, or in SQLite for
+// single-binary deployments, so a session can be picked up where it was
+// left after everyone has disconnected, the chat of each organization's
+// lobby, the organizations' vanity slugs, the templates sessions are
+// started from, the snapshots sessions' schedules take, the audit log of
+// the operations made to each session's documents, and the users and
+// groups identity providers provision organizations with over SCIM. Sessions are listed
+// a page at a time, filtered in the database, and an organization's admins
+// can delete or reassign them in bulk. A session's chat and
+// run history are kept apart from its documents, to be loaded once the
+// session is open.
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/breaker"
+	"github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// ErrNotFound is returned by Load, LoadHistory, LoadLobby, Slug, Template
+// and Snapshot for what was never saved
+var ErrNotFound = errors.New("session not found")
+
+// ErrSlugTaken is returned by ReserveSlug for a slug the organization
+// already has
+var ErrSlugTaken = errors.New("slug already taken")
+
+// ErrNameTaken is returned by AddDirectoryUser, UpdateDirectoryUser,
+// AddDirectoryGroup and UpdateDirectoryGroup for a user name or group name
+// another of the organization's users or groups has
+var ErrNameTaken = errors.New("name already taken")
+
+// Session is what is kept of a session. Metadata holds the session's
+// settings and modes, and History its chat and run history, which the
+// store keeps as they are. Load leaves History out, and Save leaves the
+// history kept as it was when History is nil. Save adds Operations to the
+// session's audit log, skipping those already in it; Load leaves them out.
+// Tags are kept apart from the metadata, so sessions can be listed by them.
+type Session struct {
+	ID         string
+	Owner      string
+	Org        string
+	Metadata   json.RawMessage
+	Tags       []string
+	Documents  []Document
+	History    json.RawMessage
+	Operations []*Operation
+	UpdatedAt  time.Time
+}
+
+// SessionFilter picks the sessions Sessions returns: those of Owner, with
+// a document in Language, tagged Tag and updated from Since up to Until,
+// when each is set. They're the most recently updated first, or the least
+// with Ascending, continuing after the session AfterID updated at
+// AfterUpdate when AfterID is set, and up to Limit of them.
+type SessionFilter struct {
+	Owner       string
+	Language    string
+	Tag         string
+	Since       time.Time
+	Until       time.Time
+	AfterUpdate time.Time
+	AfterID     string
+	Ascending   bool
+	Limit       int
+}
+
+// Document is a text file of a session. Language is the one its path
+// was detected as, if any; Access is the file's per-role access levels.
+type Document struct {
+	Path      string
+	Content   string
+	Language  string
+	Access    map[string]string
+	UpdatedAt time.Time
+}
+
+// Lobby is what is kept of an organization's lobby. Chat holds its recent
+// messages, which the store keeps as they are, and NextChatID the number
+// its next message gets.
+type Lobby struct {
+	Org        string
+	Chat       json.RawMessage
+	NextChatID int
+	UpdatedAt  time.Time
+}
+
+// Slug is a stable name an organization gave one of its sessions
+type Slug struct {
+	Org       string
+	Slug      string
+	SessionID string
+	CreatedBy string
+	CreatedAt time.Time
+}
+
+// Template is a set of starter files new sessions can be created with.
+// Files holds them as the service encodes them, which the store keeps as
+// they are.
+type Template struct {
+	ID          string
+	Name        string
+	Description string
+	Files       json.RawMessage
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// Snapshot is a session's files as they were at CreatedAt. Files holds
+// them as the service encodes them, which the store keeps as they are.
+type Snapshot struct {
+	SessionID string
+	ID        string
+	Files     json.RawMessage
+	CreatedAt time.Time
+}
+
+// Operation is one change made to a session's documents, for its audit
+// log. IDs number a session's operations in the order they were made. Ops
+// holds the edits as the service encodes them, which the store keeps as
+// they are.
+type Operation struct {
+	SessionID string
+	ID        int64
+	Path      string
+	UserID    string
+	Username  string
+	Type      string
+	Ops       json.RawMessage
+	At        time.Time
+}
+
+// OperationFilter picks the operations Operations returns: those before
+// the ID Before, by Username, of Type and made from Since up to Until, when
+// each is set, newest first and up to Limit of them
+type OperationFilter struct {
+	Before   int64
+	Username string
+	Type     string
+	Since    time.Time
+	Until    time.Time
+	Limit    int
+}
+
+// SCIMToken is the token an organization's identity provider provisions
+// it with. Only the token's hash is kept.
+type SCIMToken struct {
+	Org       string
+	Hash      string
+	CreatedBy string
+	CreatedAt time.Time
+}
+
+// DirectoryUser is a user an identity provider provisioned an organization
+// with. UserName is the username of their tokens. Users who are deleted
+// are kept, inactive, so their tokens go on being refused until a user of
+// the same name is added again. Groups holds the IDs of the groups they're
+// a member of.
+type DirectoryUser struct {
+	Org         string
+	ID          string
+	UserName    string
+	ExternalID  string
+	DisplayName string
+	GivenName   string
+	FamilyName  string
+	Email       string
+	Active      bool
+	Groups      []string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// DirectoryGroup is a group an identity provider provisioned an
+// organization with. Members holds the IDs of its users.
+type DirectoryGroup struct {
+	Org         string
+	ID          string
+	DisplayName string
+	ExternalID  string
+	Members     []string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// DirectoryFilter picks the users DirectoryUsers returns, by UserName or
+// ExternalID, and the groups DirectoryGroups returns, by DisplayName or
+// ExternalID, when each is set
+type DirectoryFilter struct {
+	UserName    string
+	DisplayName string
+	ExternalID  string
+}
+
+const schema = `
+CREATE TABLE IF NOT EXISTS collab_sessions (
+	id         TEXT PRIMARY KEY,
+	owner      TEXT NOT NULL DEFAULT '',
+	org        TEXT NOT NULL DEFAULT '',
+	metadata   JSONB NOT NULL DEFAULT '{}',
+	updated_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS collab_sessions_org ON collab_sessions (org, updated_at DESC);
+CREATE INDEX IF NOT EXISTS collab_sessions_updated ON collab_sessions (updated_at);
+CREATE TABLE IF NOT EXISTS collab_documents (
+	session_id TEXT NOT NULL REFERENCES collab_sessions (id) ON DELETE CASCADE,
+	path       TEXT NOT NULL,
+	content    TEXT NOT NULL,
+	language   TEXT NOT NULL DEFAULT '',
+	access     JSONB NOT NULL DEFAULT '{}',
+	updated_at TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (session_id, path)
+);
+CREATE TABLE IF NOT EXISTS collab_session_history (
+	session_id TEXT PRIMARY KEY REFERENCES collab_sessions (id) ON DELETE CASCADE,
+	history    JSONB NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL
+);
+CREATE TABLE IF NOT EXISTS collab_lobbies (
+	org          TEXT PRIMARY KEY,
+	chat         JSONB NOT NULL DEFAULT '[]',
+	next_chat_id INTEGER NOT NULL DEFAULT 0,
+	updated_at   TIMESTAMPTZ NOT NULL
+);
+CREATE TABLE IF NOT EXISTS collab_slugs (
+	org        TEXT NOT NULL,
+	slug       TEXT NOT NULL,
+	session_id TEXT NOT NULL,
+	created_by TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (org, slug)
+);
+CREATE TABLE IF NOT EXISTS collab_templates (
+	id          TEXT PRIMARY KEY,
+	name        TEXT NOT NULL,
+	description TEXT NOT NULL DEFAULT '',
+	files       JSONB NOT NULL DEFAULT '[]',
+	created_at  TIMESTAMPTZ NOT NULL,
+	updated_at  TIMESTAMPTZ NOT NULL
+);
+CREATE TABLE IF NOT EXISTS collab_snapshots (
+	session_id TEXT NOT NULL,
+	id         TEXT NOT NULL,
+	files      JSONB NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (session_id, id)
+);
+CREATE INDEX IF NOT EXISTS collab_snapshots_created ON collab_snapshots (session_id, created_at DESC);
+CREATE TABLE IF NOT EXISTS collab_operations (
+	session_id TEXT NOT NULL REFERENCES collab_sessions (id) ON DELETE CASCADE,
+	id         BIGINT NOT NULL,
+	path       TEXT NOT NULL,
+	user_id    TEXT NOT NULL DEFAULT '',
+	username   TEXT NOT NULL DEFAULT '',
+	type       TEXT NOT NULL,
+	ops        JSONB NOT NULL DEFAULT '[]',
+	made_at    TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (session_id, id)
+);
+CREATE TABLE IF NOT EXISTS collab_session_tags (
+	session_id TEXT NOT NULL REFERENCES collab_sessions (id) ON DELETE CASCADE,
+	tag        TEXT NOT NULL,
+	PRIMARY KEY (session_id, tag)
+);
+CREATE INDEX IF NOT EXISTS collab_session_tags_tag ON collab_session_tags (tag);
+CREATE TABLE IF NOT EXISTS collab_scim_tokens (
+	org        TEXT PRIMARY KEY,
+	token_hash TEXT NOT NULL UNIQUE,
+	created_by TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL
+);
+CREATE TABLE IF NOT EXISTS collab_directory_users (
+	org          TEXT NOT NULL,
+	id           TEXT NOT NULL,
+	user_name    TEXT NOT NULL,
+	external_id  TEXT NOT NULL DEFAULT '',
+	display_name TEXT NOT NULL DEFAULT '',
+	given_name   TEXT NOT NULL DEFAULT '',
+	family_name  TEXT NOT NULL DEFAULT '',
+	email        TEXT NOT NULL DEFAULT '',
+	active       BOOLEAN NOT NULL DEFAULT TRUE,
+	deleted      BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at   TIMESTAMPTZ NOT NULL,
+	updated_at   TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (org, id),
+	UNIQUE (org, user_name)
+);
+CREATE INDEX IF NOT EXISTS collab_directory_users_inactive ON collab_directory_users (active);
+CREATE TABLE IF NOT EXISTS collab_directory_groups (
+	org          TEXT NOT NULL,
+	id           TEXT NOT NULL,
+	display_name TEXT NOT NULL,
+	external_id  TEXT NOT NULL DEFAULT '',
+	created_at   TIMESTAMPTZ NOT NULL,
+	updated_at   TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (org, id),
+	UNIQUE (org, display_name)
+);
+CREATE TABLE IF NOT EXISTS collab_directory_members (
+	org      TEXT NOT NULL,
+	group_id TEXT NOT NULL,
+	user_id  TEXT NOT NULL,
+	PRIMARY KEY (org, group_id, user_id),
+	FOREIGN KEY (org, group_id) REFERENCES collab_directory_groups (org, id) ON DELETE CASCADE,
+	FOREIGN KEY (org, user_id) REFERENCES collab_directory_users (org, id) ON DELETE CASCADE
+);`
+
+// sqlitePrefix starts the DSNs of SQLite databases, followed by the path
+// of the database file
+const sqlitePrefix = "sqlite:"
+
+// sqliteTypes maps the schema's column types to those SQLite stores times
+// and JSON as. Times are stored as text, which sorts as they do as long
+// as they're all in UTC.
+var sqliteTypes = strings.NewReplacer("TIMESTAMPTZ", "TIMESTAMP", "JSONB", "TEXT")
+
+// Store is a connection pool to the database. Calls go through a circuit
+// breaker, and fail with breaker.ErrOpen while the database is down.
+type Store struct {
+	db      *sql.DB
+	breaker *breaker.Breaker
+	// sqlite is set when the database is SQLite rather than PostgreSQL
+	sqlite bool
+}
+
+// Open connects to the database at dsn, a postgres:// URL or sqlite:
+// followed by the path of a database file, which is created if needed, and
+// creates the tables if they don't exist. guard is the breaker calls go
+// through.
+func Open(ctx context.Context, dsn string, guard *breaker.Breaker) (*Store, error) {
+	if path, ok := strings.CutPrefix(dsn, sqlitePrefix); ok {
+		return openSQLite(ctx, path, guard)
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.ExecContext(ctx, schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db, breaker: guard}, nil
+}
+
+// openSQLite opens the SQLite database at path. SQLite has one writer at a
+// time, so the pool has one connection, which also keeps transactions from
+// waiting on each other.
+func openSQLite(ctx context.Context, path string, guard *breaker.Breaker) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.ExecContext(ctx, sqliteTypes.Replace(schema)); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db, breaker: guard, sqlite: true}, nil
+}
+
+// record reports how a call went to the breaker. What was never saved or
+// is taken isn't a failure of the database.
+func (s *Store) record(err *error) {
+	if errors.Is(*err, ErrNotFound) || errors.Is(*err, ErrSlugTaken) || errors.Is(*err, ErrNameTaken) {
+		s.breaker.Record(nil)
+		return
+	}
+	s.breaker.Record(*err)
+}
+
+// Down reports whether the database is thought to be down, so that calls
+// fail without trying it
+func (s *Store) Down() bool {
+	return s.breaker.Open()
+}
+
+// Ping checks that the database can be reached
+func (s *Store) Ping(ctx context.Context) (err error) {
+	if !s.breaker.Allow() {
+		return breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	return s.db.PingContext(ctx)
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Save replaces what is kept of the session with session
+func (s *Store) Save(ctx context.Context, session *Session) (err error) {
+	if !s.breaker.Allow() {
+		return breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	metadata := session.Metadata
+	if len(metadata) == 0 {
+		metadata = json.RawMessage("{}")
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO collab_sessions (id, owner, org, metadata, updated_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (id) DO UPDATE SET
+			owner = EXCLUDED.owner, org = EXCLUDED.org,
+			metadata = EXCLUDED.metadata, updated_at = EXCLUDED.updated_at`,
+		session.ID, session.Owner, session.Org, string(metadata), session.UpdatedAt.UTC())
+	if err != nil {
+		return err
+	}
+
+	paths := make([]string, len(session.Documents))
+	for i, doc := range session.Documents {
+		paths[i] = doc.Path
+		access, err := json.Marshal(doc.Access)
+		if err != nil {
+			return err
+		}
+		// Unchanged documents are left alone rather than rewritten
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO collab_documents (session_id, path, content, language, access, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (session_id, path) DO UPDATE SET
+				content = EXCLUDED.content, language = EXCLUDED.language,
+				access = EXCLUDED.access, updated_at = EXCLUDED.updated_at
+			WHERE (collab_documents.content, collab_documents.language, collab_documents.access)
+				IS DISTINCT FROM (EXCLUDED.content, EXCLUDED.language, EXCLUDED.access)`,
+			session.ID, doc.Path, doc.Content, doc.Language, string(access), doc.UpdatedAt)
+		if err != nil {
+			return err
+		}
+	}
+	if s.sqlite {
+		listed, _ := json.Marshal(paths)
+		_, err = tx.ExecContext(ctx, `
+			DELETE FROM collab_documents
+			WHERE session_id = $1 AND path NOT IN (SELECT value FROM json_each($2))`,
+			session.ID, string(listed))
+	} else {
+		_, err = tx.ExecContext(ctx, `DELETE FROM collab_documents WHERE session_id = $1 AND path <> ALL ($2)`,
+			session.ID, pq.Array(paths))
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM collab_session_tags WHERE session_id = $1`, session.ID); err != nil {
+		return err
+	}
+	for _, tag := range session.Tags {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO collab_session_tags (session_id, tag) VALUES ($1, $2)
+			ON CONFLICT (session_id, tag) DO NOTHING`, session.ID, tag)
+		if err != nil {
+			return err
+		}
+	}
+
+	if session.History != nil {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO collab_session_history (session_id, history, updated_at)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (session_id) DO UPDATE SET
+				history = EXCLUDED.history, updated_at = EXCLUDED.updated_at`,
+			session.ID, string(session.History), session.UpdatedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, op := range session.Operations {
+		ops := op.Ops
+		if len(ops) == 0 {
+			ops = json.RawMessage("[]")
+		}
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO collab_operations (session_id, id, path, user_id, username, type, ops, made_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			ON CONFLICT (session_id, id) DO NOTHING`,
+			session.ID, op.ID, op.Path, op.UserID, op.Username, op.Type, string(ops), op.At.UTC())
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Load returns what is kept of a session
+func (s *Store) Load(ctx context.Context, id string) (_ *Session, err error) {
+	if !s.breaker.Allow() {
+		return nil, breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	session := &Session{ID: id}
+	var metadata []byte
+	err = s.db.QueryRowContext(ctx,
+		`SELECT owner, org, metadata, updated_at FROM collab_sessions WHERE id = $1`, id,
+	).Scan(&session.Owner, &session.Org, &metadata, &session.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	session.Metadata = metadata
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT path, content, language, access, updated_at FROM collab_documents
+		WHERE session_id = $1 ORDER BY path`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var doc Document
+		var access []byte
+		if err := rows.Scan(&doc.Path, &doc.Content, &doc.Language, &access, &doc.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(access, &doc.Access); err != nil {
+			return nil, err
+		}
+		session.Documents = append(session.Documents, doc)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	tags, err := s.tags(ctx, []string{id})
+	if err != nil {
+		return nil, err
+	}
+	session.Tags = tags[id]
+	return session, nil
+}
+
+// inList is the placeholders of an IN list of values, and its arguments
+func inList(values []string) (string, []any) {
+	placeholders := make([]string, len(values))
+	args := make([]any, len(values))
+	for i, value := range values {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = value
+	}
+	return strings.Join(placeholders, ", "), args
+}
+
+// tags returns the tags of sessions, by session ID, in order
+func (s *Store) tags(ctx context.Context, ids []string) (map[string][]string, error) {
+	tags := make(map[string][]string)
+	if len(ids) == 0 {
+		return tags, nil
+	}
+	list, args := inList(ids)
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT session_id, tag FROM collab_session_tags
+		WHERE session_id IN (`+list+`) ORDER BY tag`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, tag string
+		if err := rows.Scan(&id, &tag); err != nil {
+			return nil, err
+		}
+		tags[id] = append(tags[id], tag)
+	}
+	return tags, rows.Err()
+}
+
+// LoadHistory returns the chat and run history kept of a session
+func (s *Store) LoadHistory(ctx context.Context, id string) (_ json.RawMessage, err error) {
+	if !s.breaker.Allow() {
+		return nil, breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	var history []byte
+	err = s.db.QueryRowContext(ctx,
+		`SELECT history FROM collab_session_history WHERE session_id = $1`, id,
+	).Scan(&history)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// SaveLobby replaces what is kept of an organization's lobby with lobby
+func (s *Store) SaveLobby(ctx context.Context, lobby *Lobby) (err error) {
+	if !s.breaker.Allow() {
+		return breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	chat := lobby.Chat
+	if len(chat) == 0 {
+		chat = json.RawMessage("[]")
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO collab_lobbies (org, chat, next_chat_id, updated_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (org) DO UPDATE SET
+			chat = EXCLUDED.chat, next_chat_id = EXCLUDED.next_chat_id,
+			updated_at = EXCLUDED.updated_at`,
+		lobby.Org, string(chat), lobby.NextChatID, lobby.UpdatedAt)
+	return err
+}
+
+// LoadLobby returns what is kept of an organization's lobby
+func (s *Store) LoadLobby(ctx context.Context, org string) (_ *Lobby, err error) {
+	if !s.breaker.Allow() {
+		return nil, breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	lobby := &Lobby{Org: org}
+	var chat []byte
+	err = s.db.QueryRowContext(ctx,
+		`SELECT chat, next_chat_id, updated_at FROM collab_lobbies WHERE org = $1`, org,
+	).Scan(&chat, &lobby.NextChatID, &lobby.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	lobby.Chat = chat
+	return lobby, nil
+}
+
+// Sessions returns what is kept of the organization's sessions that filter
+// picks, without their documents
+func (s *Store) Sessions(ctx context.Context, org string, filter SessionFilter) (_ []*Session, err error) {
+	if !s.breaker.Allow() {
+		return nil, breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	query := `SELECT id, owner, metadata, updated_at FROM collab_sessions WHERE org = $1`
+	args := []any{org}
+	where := func(condition string, arg any) {
+		args = append(args, arg)
+		query += fmt.Sprintf(" AND "+condition, len(args))
+	}
+	if filter.Owner != "" {
+		where("owner = $%d", filter.Owner)
+	}
+	if filter.Language != "" {
+		where(`EXISTS (SELECT 1 FROM collab_documents
+			WHERE collab_documents.session_id = collab_sessions.id AND collab_documents.language = $%d)`, filter.Language)
+	}
+	if filter.Tag != "" {
+		where(`EXISTS (SELECT 1 FROM collab_session_tags
+			WHERE collab_session_tags.session_id = collab_sessions.id AND collab_session_tags.tag = $%d)`, filter.Tag)
+	}
+	if !filter.Since.IsZero() {
+		where("updated_at >= $%d", filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		where("updated_at < $%d", filter.Until.UTC())
+	}
+	order, than := "DESC", "<"
+	if filter.Ascending {
+		order, than = "ASC", ">"
+	}
+	if filter.AfterID != "" {
+		args = append(args, filter.AfterUpdate.UTC(), filter.AfterID)
+		query += fmt.Sprintf(" AND (updated_at %[1]s $%[2]d OR updated_at = $%[2]d AND id %[1]s $%[3]d)", than, len(args)-1, len(args))
+	}
+	args = append(args, filter.Limit)
+	query += fmt.Sprintf(" ORDER BY updated_at %[1]s, id %[1]s LIMIT $%[2]d", order, len(args))
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sessions []*Session
+	var ids []string
+	for rows.Next() {
+		session := &Session{Org: org}
+		var metadata []byte
+		if err := rows.Scan(&session.ID, &session.Owner, &metadata, &session.UpdatedAt); err != nil {
+			return nil, err
+		}
+		session.Metadata = metadata
+		sessions = append(sessions, session)
+		ids = append(ids, session.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	tags, err := s.tags(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, session := range sessions {
+		session.Tags = tags[session.ID]
+	}
+	return sessions, nil
+}
+
+// DeleteSessions deletes what is kept of sessions: their documents, history,
+// audit log and tags, and their snapshots and the slugs naming them
+func (s *Store) DeleteSessions(ctx context.Context, ids []string) (err error) {
+	if len(ids) == 0 {
+		return nil
+	}
+	if !s.breaker.Allow() {
+		return breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	list, args := inList(ids)
+	for _, statement := range []string{
+		`DELETE FROM collab_snapshots WHERE session_id IN (` + list + `)`,
+		`DELETE FROM collab_slugs WHERE session_id IN (` + list + `)`,
+		`DELETE FROM collab_sessions WHERE id IN (` + list + `)`,
+	} {
+		if _, err := tx.ExecContext(ctx, statement, args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ReassignSessions makes to the owner of the organization's sessions from
+// owns, and returns their IDs
+func (s *Store) ReassignSessions(ctx context.Context, org, from, to string) (_ []string, err error) {
+	if !s.breaker.Allow() {
+		return nil, breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	rows, err := s.db.QueryContext(ctx, `
+		UPDATE collab_sessions SET owner = $3 WHERE org = $1 AND owner = $2
+		RETURNING id`, org, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// SessionIDs returns the IDs of all of an organization's sessions, least
+// recently updated first
+func (s *Store) SessionIDs(ctx context.Context, org string) (_ []string, err error) {
+	if !s.breaker.Allow() {
+		return nil, breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id FROM collab_sessions WHERE org = $1 ORDER BY updated_at`, org)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Recent returns the IDs of the sessions saved since since, most recently
+// saved first and up to limit of them
+func (s *Store) Recent(ctx context.Context, since time.Time, limit int) (_ []string, err error) {
+	if !s.breaker.Allow() {
+		return nil, breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id FROM collab_sessions
+		WHERE updated_at >= $1 ORDER BY updated_at DESC LIMIT $2`, since.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// ReserveSlug keeps slug for its organization, unless it is taken
+func (s *Store) ReserveSlug(ctx context.Context, slug *Slug) (err error) {
+	if !s.breaker.Allow() {
+		return breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	result, err := s.db.ExecContext(ctx, `
+		INSERT INTO collab_slugs (org, slug, session_id, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (org, slug) DO NOTHING`,
+		slug.Org, slug.Slug, slug.SessionID, slug.CreatedBy, slug.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrSlugTaken
+	}
+	return nil
+}
+
+// Slug returns an organization's slug
+func (s *Store) Slug(ctx context.Context, org, name string) (_ *Slug, err error) {
+	if !s.breaker.Allow() {
+		return nil, breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	slug := &Slug{Org: org, Slug: name}
+	err = s.db.QueryRowContext(ctx,
+		`SELECT session_id, created_by, created_at FROM collab_slugs WHERE org = $1 AND slug = $2`, org, name,
+	).Scan(&slug.SessionID, &slug.CreatedBy, &slug.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return slug, nil
+}
+
+// Slugs returns an organization's slugs, by name
+func (s *Store) Slugs(ctx context.Context, org string) (_ []*Slug, err error) {
+	if !s.breaker.Allow() {
+		return nil, breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT slug, session_id, created_by, created_at FROM collab_slugs
+		WHERE org = $1 ORDER BY slug`, org)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var slugs []*Slug
+	for rows.Next() {
+		slug := &Slug{Org: org}
+		if err := rows.Scan(&slug.Slug, &slug.SessionID, &slug.CreatedBy, &slug.CreatedAt); err != nil {
+			return nil, err
+		}
+		slugs = append(slugs, slug)
+	}
+	return slugs, rows.Err()
+}
+
+// ReleaseSlug frees an organization's slug. The session it named is left
+// as it is.
+func (s *Store) ReleaseSlug(ctx context.Context, org, name string) (err error) {
+	if !s.breaker.Allow() {
+		return breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	result, err := s.db.ExecContext(ctx, `DELETE FROM collab_slugs WHERE org = $1 AND slug = $2`, org, name)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SaveTemplate keeps template, replacing the one with its ID if there is
+// one, whose CreatedAt is kept. It reports whether the template is new.
+func (s *Store) SaveTemplate(ctx context.Context, template *Template) (created bool, err error) {
+	if !s.breaker.Allow() {
+		return false, breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	var createdAt time.Time
+	err = tx.QueryRowContext(ctx, `SELECT created_at FROM collab_templates WHERE id = $1`, template.ID).Scan(&createdAt)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		created = true
+	case err != nil:
+		return false, err
+	default:
+		template.CreatedAt = createdAt
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO collab_templates (id, name, description, files, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (id) DO UPDATE SET
+			name = EXCLUDED.name, description = EXCLUDED.description,
+			files = EXCLUDED.files, updated_at = EXCLUDED.updated_at`,
+		template.ID, template.Name, template.Description, string(template.Files), template.CreatedAt.UTC(), template.UpdatedAt.UTC()); err != nil {
+		return false, err
+	}
+	return created, tx.Commit()
+}
+
+// Template returns a template
+func (s *Store) Template(ctx context.Context, id string) (_ *Template, err error) {
+	if !s.breaker.Allow() {
+		return nil, breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	template := &Template{ID: id}
+	var files []byte
+	err = s.db.QueryRowContext(ctx,
+		`SELECT name, description, files, created_at, updated_at FROM collab_templates WHERE id = $1`, id,
+	).Scan(&template.Name, &template.Description, &files, &template.CreatedAt, &template.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	template.Files = files
+	return template, nil
+}
+
+// Templates returns the templates, by name
+func (s *Store) Templates(ctx context.Context) (_ []*Template, err error) {
+	if !s.breaker.Allow() {
+		return nil, breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, name, description, files, created_at, updated_at FROM collab_templates
+		ORDER BY name, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var templates []*Template
+	for rows.Next() {
+		template := &Template{}
+		var files []byte
+		if err := rows.Scan(&template.ID, &template.Name, &template.Description, &files, &template.CreatedAt, &template.UpdatedAt); err != nil {
+			return nil, err
+		}
+		template.Files = files
+		templates = append(templates, template)
+	}
+	return templates, rows.Err()
+}
+
+// DeleteTemplate deletes a template. Sessions created from it are left as
+// they are.
+func (s *Store) DeleteTemplate(ctx context.Context, id string) (err error) {
+	if !s.breaker.Allow() {
+		return breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	result, err := s.db.ExecContext(ctx, `DELETE FROM collab_templates WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SaveSnapshot keeps a snapshot
+func (s *Store) SaveSnapshot(ctx context.Context, snapshot *Snapshot) (err error) {
+	if !s.breaker.Allow() {
+		return breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO collab_snapshots (session_id, id, files, created_at) VALUES ($1, $2, $3, $4)`,
+		snapshot.SessionID, snapshot.ID, string(snapshot.Files), snapshot.CreatedAt.UTC())
+	return err
+}
+
+// Snapshots returns a session's snapshots, newest first, without their
+// files
+func (s *Store) Snapshots(ctx context.Context, sessionID string) (_ []*Snapshot, err error) {
+	if !s.breaker.Allow() {
+		return nil, breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, created_at FROM collab_snapshots WHERE session_id = $1
+		ORDER BY created_at DESC, id`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var snapshots []*Snapshot
+	for rows.Next() {
+		snapshot := &Snapshot{SessionID: sessionID}
+		if err := rows.Scan(&snapshot.ID, &snapshot.CreatedAt); err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, rows.Err()
+}
+
+// Snapshot returns one of a session's snapshots
+func (s *Store) Snapshot(ctx context.Context, sessionID, id string) (_ *Snapshot, err error) {
+	if !s.breaker.Allow() {
+		return nil, breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	snapshot := &Snapshot{SessionID: sessionID, ID: id}
+	var files []byte
+	err = s.db.QueryRowContext(ctx,
+		`SELECT files, created_at FROM collab_snapshots WHERE session_id = $1 AND id = $2`, sessionID, id,
+	).Scan(&files, &snapshot.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	snapshot.Files = files
+	return snapshot, nil
+}
+
+// DeleteSnapshot deletes one of a session's snapshots
+func (s *Store) DeleteSnapshot(ctx context.Context, sessionID, id string) (err error) {
+	if !s.breaker.Allow() {
+		return breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	_, err = s.db.ExecContext(ctx, `DELETE FROM collab_snapshots WHERE session_id = $1 AND id = $2`, sessionID, id)
+	return err
+}
+
+// Operations returns the operations of a session's audit log that filter
+// picks
+func (s *Store) Operations(ctx context.Context, sessionID string, filter OperationFilter) (_ []*Operation, err error) {
+	if !s.breaker.Allow() {
+		return nil, breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	query := `SELECT id, path, user_id, username, type, ops, made_at FROM collab_operations WHERE session_id = $1`
+	args := []any{sessionID}
+	where := func(condition string, arg any) {
+		args = append(args, arg)
+		query += fmt.Sprintf(" AND "+condition, len(args))
+	}
+	if filter.Before > 0 {
+		where("id < $%d", filter.Before)
+	}
+	if filter.Username != "" {
+		where("username = $%d", filter.Username)
+	}
+	if filter.Type != "" {
+		where("type = $%d", filter.Type)
+	}
+	if !filter.Since.IsZero() {
+		where("made_at >= $%d", filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		where("made_at < $%d", filter.Until.UTC())
+	}
+	args = append(args, filter.Limit)
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d", len(args))
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var operations []*Operation
+	for rows.Next() {
+		op := &Operation{SessionID: sessionID}
+		var ops []byte
+		if err := rows.Scan(&op.ID, &op.Path, &op.UserID, &op.Username, &op.Type, &ops, &op.At); err != nil {
+			return nil, err
+		}
+		op.Ops = ops
+		operations = append(operations, op)
+	}
+	return operations, rows.Err()
+}
+
+// SaveSCIMToken keeps an organization's SCIM token, replacing the one it
+// had
+func (s *Store) SaveSCIMToken(ctx context.Context, token *SCIMToken) (err error) {
+	if !s.breaker.Allow() {
+		return breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO collab_scim_tokens (org, token_hash, created_by, created_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (org) DO UPDATE SET
+			token_hash = EXCLUDED.token_hash, created_by = EXCLUDED.created_by,
+			created_at = EXCLUDED.created_at`,
+		token.Org, token.Hash, token.CreatedBy, token.CreatedAt.UTC())
+	return err
+}
+
+// SCIMToken returns the SCIM token with a hash
+func (s *Store) SCIMToken(ctx context.Context, hash string) (_ *SCIMToken, err error) {
+	if !s.breaker.Allow() {
+		return nil, breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	token := &SCIMToken{Hash: hash}
+	err = s.db.QueryRowContext(ctx,
+		`SELECT org, created_by, created_at FROM collab_scim_tokens WHERE token_hash = $1`, hash,
+	).Scan(&token.Org, &token.CreatedBy, &token.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// DeleteSCIMToken revokes an organization's SCIM token. The users and
+// groups it provisioned are left as they are.
+func (s *Store) DeleteSCIMToken(ctx context.Context, org string) (err error) {
+	if !s.breaker.Allow() {
+		return breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	result, err := s.db.ExecContext(ctx, `DELETE FROM collab_scim_tokens WHERE org = $1`, org)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// claimUserName makes way for a user named userName in an organization,
+// unless another of its users has the name. A deleted user of the name is
+// forgotten.
+func claimUserName(ctx context.Context, tx *sql.Tx, org, id, userName string) error {
+	var taken bool
+	err := tx.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM collab_directory_users
+		WHERE org = $1 AND user_name = $2 AND id <> $3 AND NOT deleted)`, org, userName, id,
+	).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrNameTaken
+	}
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM collab_directory_users WHERE org = $1 AND user_name = $2 AND id <> $3 AND deleted`,
+		org, userName, id)
+	return err
+}
+
+// AddDirectoryUser keeps a new user of an organization, unless another
+// has its user name
+func (s *Store) AddDirectoryUser(ctx context.Context, user *DirectoryUser) (err error) {
+	if !s.breaker.Allow() {
+		return breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := claimUserName(ctx, tx, user.Org, user.ID, user.UserName); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO collab_directory_users (org, id, user_name, external_id, display_name, given_name,
+			family_name, email, active, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		user.Org, user.ID, user.UserName, user.ExternalID, user.DisplayName, user.GivenName,
+		user.FamilyName, user.Email, user.Active, user.CreatedAt.UTC(), user.UpdatedAt.UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateDirectoryUser replaces what is kept of a user, but their groups
+// and CreatedAt, unless another has their new user name
+func (s *Store) UpdateDirectoryUser(ctx context.Context, user *DirectoryUser) (err error) {
+	if !s.breaker.Allow() {
+		return breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := claimUserName(ctx, tx, user.Org, user.ID, user.UserName); err != nil {
+		return err
+	}
+	result, err := tx.ExecContext(ctx, `
+		UPDATE collab_directory_users SET user_name = $3, external_id = $4, display_name = $5,
+			given_name = $6, family_name = $7, email = $8, active = $9, updated_at = $10
+		WHERE org = $1 AND id = $2 AND NOT deleted`,
+		user.Org, user.ID, user.UserName, user.ExternalID, user.DisplayName, user.GivenName,
+		user.FamilyName, user.Email, user.Active, user.UpdatedAt.UTC())
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return tx.Commit()
+}
+
+const directoryUserColumns = `id, user_name, external_id, display_name, given_name, family_name, email, active, created_at, updated_at`
+
+// DirectoryUser returns one of an organization's users
+func (s *Store) DirectoryUser(ctx context.Context, org, id string) (*DirectoryUser, error) {
+	users, err := s.directoryUsers(ctx, org, " AND id = $2", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, ErrNotFound
+	}
+	return users[0], nil
+}
+
+// DirectoryUsers returns the organization's users filter picks, by user
+// name
+func (s *Store) DirectoryUsers(ctx context.Context, org string, filter DirectoryFilter) ([]*DirectoryUser, error) {
+	var conditions string
+	var args []any
+	if filter.UserName != "" {
+		args = append(args, filter.UserName)
+		conditions += fmt.Sprintf(" AND user_name = $%d", len(args)+1)
+	}
+	if filter.ExternalID != "" {
+		args = append(args, filter.ExternalID)
+		conditions += fmt.Sprintf(" AND external_id = $%d", len(args)+1)
+	}
+	return s.directoryUsers(ctx, org, conditions, args...)
+}
+
+func (s *Store) directoryUsers(ctx context.Context, org, conditions string, args ...any) (_ []*DirectoryUser, err error) {
+	if !s.breaker.Allow() {
+		return nil, breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+directoryUserColumns+` FROM collab_directory_users
+		WHERE org = $1 AND NOT deleted`+conditions+` ORDER BY user_name`, append([]any{org}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []*DirectoryUser
+	byID := map[string]*DirectoryUser{}
+	for rows.Next() {
+		user := &DirectoryUser{Org: org}
+		if err := rows.Scan(&user.ID, &user.UserName, &user.ExternalID, &user.DisplayName, &user.GivenName,
+			&user.FamilyName, &user.Email, &user.Active, &user.CreatedAt, &user.UpdatedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+		byID[user.ID] = user
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return users, nil
+	}
+
+	ids := make([]string, len(users))
+	for i, user := range users {
+		ids[i] = user.ID
+	}
+	list, listArgs := inList(ids)
+	rows, err = s.db.QueryContext(ctx, `
+		SELECT user_id, group_id FROM collab_directory_members
+		WHERE org = $`+fmt.Sprint(len(listArgs)+1)+` AND user_id IN (`+list+`) ORDER BY group_id`,
+		append(listArgs, org)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID, groupID string
+		if err := rows.Scan(&userID, &groupID); err != nil {
+			return nil, err
+		}
+		byID[userID].Groups = append(byID[userID].Groups, groupID)
+	}
+	return users, rows.Err()
+}
+
+// DeleteDirectoryUser deletes one of an organization's users, taking them
+// out of its groups. They're kept inactive, for Deprovisioned.
+func (s *Store) DeleteDirectoryUser(ctx context.Context, org, id string) (err error) {
+	if !s.breaker.Allow() {
+		return breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.ExecContext(ctx, `
+		UPDATE collab_directory_users SET active = FALSE, deleted = TRUE, updated_at = $3
+		WHERE org = $1 AND id = $2 AND NOT deleted`, org, id, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM collab_directory_members WHERE org = $1 AND user_id = $2`, org, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Deprovisioned returns the user names of each organization's users who
+// were deactivated or deleted, by organization
+func (s *Store) Deprovisioned(ctx context.Context) (_ map[string][]string, err error) {
+	if !s.breaker.Allow() {
+		return nil, breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	rows, err := s.db.QueryContext(ctx, `SELECT org, user_name FROM collab_directory_users WHERE NOT active`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deprovisioned := map[string][]string{}
+	for rows.Next() {
+		var org, userName string
+		if err := rows.Scan(&org, &userName); err != nil {
+			return nil, err
+		}
+		deprovisioned[org] = append(deprovisioned[org], userName)
+	}
+	return deprovisioned, rows.Err()
+}
+
+// saveMembers replaces a group's members with those of its members who
+// are users of the organization
+func saveMembers(ctx context.Context, tx *sql.Tx, group *DirectoryGroup) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM collab_directory_members WHERE org = $1 AND group_id = $2`,
+		group.Org, group.ID); err != nil {
+		return err
+	}
+	for _, userID := range group.Members {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO collab_directory_members (org, group_id, user_id)
+			SELECT org, $2, id FROM collab_directory_users WHERE org = $1 AND id = $3 AND NOT deleted
+			ON CONFLICT (org, group_id, user_id) DO NOTHING`, group.Org, group.ID, userID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// groupNameTaken reports whether another of an organization's groups is
+// named displayName
+func groupNameTaken(ctx context.Context, tx *sql.Tx, group *DirectoryGroup) (bool, error) {
+	var taken bool
+	err := tx.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM collab_directory_groups WHERE org = $1 AND display_name = $2 AND id <> $3)`,
+		group.Org, group.DisplayName, group.ID,
+	).Scan(&taken)
+	return taken, err
+}
+
+// AddDirectoryGroup keeps a new group of an organization, with those of
+// its members who are users of the organization, unless another group has
+// its name
+func (s *Store) AddDirectoryGroup(ctx context.Context, group *DirectoryGroup) (err error) {
+	if !s.breaker.Allow() {
+		return breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if taken, err := groupNameTaken(ctx, tx, group); err != nil {
+		return err
+	} else if taken {
+		return ErrNameTaken
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO collab_directory_groups (org, id, display_name, external_id, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		group.Org, group.ID, group.DisplayName, group.ExternalID, group.CreatedAt.UTC(), group.UpdatedAt.UTC())
+	if err != nil {
+		return err
+	}
+	if err := saveMembers(ctx, tx, group); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateDirectoryGroup replaces what is kept of a group but its CreatedAt,
+// as AddDirectoryGroup keeps it
+func (s *Store) UpdateDirectoryGroup(ctx context.Context, group *DirectoryGroup) (err error) {
+	if !s.breaker.Allow() {
+		return breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if taken, err := groupNameTaken(ctx, tx, group); err != nil {
+		return err
+	} else if taken {
+		return ErrNameTaken
+	}
+	result, err := tx.ExecContext(ctx, `
+		UPDATE collab_directory_groups SET display_name = $3, external_id = $4, updated_at = $5
+		WHERE org = $1 AND id = $2`,
+		group.Org, group.ID, group.DisplayName, group.ExternalID, group.UpdatedAt.UTC())
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	if err := saveMembers(ctx, tx, group); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DirectoryGroup returns one of an organization's groups
+func (s *Store) DirectoryGroup(ctx context.Context, org, id string) (*DirectoryGroup, error) {
+	groups, err := s.directoryGroups(ctx, org, " AND id = $2", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(groups) == 0 {
+		return nil, ErrNotFound
+	}
+	return groups[0], nil
+}
+
+// DirectoryGroups returns the organization's groups filter picks, by name
+func (s *Store) DirectoryGroups(ctx context.Context, org string, filter DirectoryFilter) ([]*DirectoryGroup, error) {
+	var conditions string
+	var args []any
+	if filter.DisplayName != "" {
+		args = append(args, filter.DisplayName)
+		conditions += fmt.Sprintf(" AND display_name = $%d", len(args)+1)
+	}
+	if filter.ExternalID != "" {
+		args = append(args, filter.ExternalID)
+		conditions += fmt.Sprintf(" AND external_id = $%d", len(args)+1)
+	}
+	return s.directoryGroups(ctx, org, conditions, args...)
+}
+
+func (s *Store) directoryGroups(ctx context.Context, org, conditions string, args ...any) (_ []*DirectoryGroup, err error) {
+	if !s.breaker.Allow() {
+		return nil, breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, display_name, external_id, created_at, updated_at FROM collab_directory_groups
+		WHERE org = $1`+conditions+` ORDER BY display_name`, append([]any{org}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var groups []*DirectoryGroup
+	byID := map[string]*DirectoryGroup{}
+	for rows.Next() {
+		group := &DirectoryGroup{Org: org}
+		if err := rows.Scan(&group.ID, &group.DisplayName, &group.ExternalID, &group.CreatedAt, &group.UpdatedAt); err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+		byID[group.ID] = group
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(groups) == 0 {
+		return groups, nil
+	}
+
+	ids := make([]string, len(groups))
+	for i, group := range groups {
+		ids[i] = group.ID
+	}
+	list, listArgs := inList(ids)
+	rows, err = s.db.QueryContext(ctx, `
+		SELECT group_id, user_id FROM collab_directory_members
+		WHERE org = $`+fmt.Sprint(len(listArgs)+1)+` AND group_id IN (`+list+`) ORDER BY user_id`,
+		append(listArgs, org)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var groupID, userID string
+		if err := rows.Scan(&groupID, &userID); err != nil {
+			return nil, err
+		}
+		byID[groupID].Members = append(byID[groupID].Members, userID)
+	}
+	return groups, rows.Err()
+}
+
+// DeleteDirectoryGroup deletes one of an organization's groups. Its
+// members are left as they are.
+func (s *Store) DeleteDirectoryGroup(ctx context.Context, org, id string) (err error) {
+	if !s.breaker.Allow() {
+		return breaker.ErrOpen
+	}
+	defer s.record(&err)
+
+	result, err := s.db.ExecContext(ctx, `DELETE FROM collab_directory_groups WHERE org = $1 AND id = $2`, org, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/codecollab/collab-service/internal/breaker"
+)
+
+func openSQLiteStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := Open(context.Background(), sqlitePrefix+filepath.Join(t.TempDir(), "collab.db"), breaker.New(5, time.Minute))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func mustSave(t *testing.T, s *Store, session *Session) {
+	t.Helper()
+	if err := s.Save(context.Background(), session); err != nil {
+		t.Fatalf("Save(%s): %v", session.ID, err)
+	}
+}
+
+// sameJSON reports whether a and b encode the same value, however they're
+// spaced
+func sameJSON(t *testing.T, a, b json.RawMessage) bool {
+	t.Helper()
+	var x, y any
+	if err := json.Unmarshal(a, &x); err != nil {
+		t.Fatalf("invalid JSON %s: %v", a, err)
+	}
+	if err := json.Unmarshal(b, &y); err != nil {
+		t.Fatalf("invalid JSON %s: %v", b, err)
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+// binaryMetadata is metadata as the service keeps it for a session with a
+// binary file, whose bytes are in the blob store
+const binaryMetadata = `{"settings":{"tabSize":4},"nextChatId":3,"assets":[{"path":"assets/logo.png","blobKey":"sessions/s1/4f9a","contentType":"image/png","size":2048,"access":{"viewer":"hidden"},"updatedAt":"2026-01-02T03:04:05Z"}]}`
+
+func TestSaveLoadRoundTrip(t *testing.T) {
+	updated := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name string
+		// saves are saved in order, and Load then returns the last
+		saves []*Session
+		// metadata is the metadata Load returns, when not the last save's
+		metadata string
+	}{
+		{"documents, tags and binary metadata", []*Session{{
+			ID: "s1", Owner: "alice", Org: "acme",
+			Metadata: json.RawMessage(binaryMetadata),
+			Tags:     []string{"interview", "go"},
+			Documents: []Document{
+				{Path: "main.go", Content: "package main\n", Language: "go", Access: map[string]string{"viewer": "read"}, UpdatedAt: updated},
+				{Path: "docs/héllo.md", Content: "# 世界 😀\n\ttabs\r\n", Access: map[string]string{}, UpdatedAt: updated},
+			},
+			UpdatedAt: updated,
+		}}, ""},
+		{"without metadata", []*Session{{ID: "s1", Owner: "alice", UpdatedAt: updated}}, `{}`},
+		{"empty document", []*Session{{
+			ID: "s1", Owner: "alice",
+			Documents: []Document{{Path: "empty.txt", Access: map[string]string{}, UpdatedAt: updated}},
+			UpdatedAt: updated,
+		}}, `{}`},
+		{"saving again replaces what was kept", []*Session{{
+			ID: "s1", Owner: "alice", Org: "acme",
+			Metadata: json.RawMessage(binaryMetadata),
+			Tags:     []string{"old"},
+			Documents: []Document{
+				{Path: "a.txt", Content: "a", Access: map[string]string{}, UpdatedAt: updated},
+				{Path: "b.txt", Content: "b", Access: map[string]string{}, UpdatedAt: updated},
+			},
+			UpdatedAt: updated,
+		}, {
+			ID: "s1", Owner: "bob", Org: "acme",
+			Metadata: json.RawMessage(`{"settings":{"tabSize":2}}`),
+			Tags:     []string{"new"},
+			Documents: []Document{
+				{Path: "b.txt", Content: "b changed", Language: "plaintext", Access: map[string]string{"editor": "read"}, UpdatedAt: updated.Add(time.Hour)},
+				{Path: "c.txt", Content: "c", Access: map[string]string{}, UpdatedAt: updated},
+			},
+			UpdatedAt: updated.Add(time.Hour),
+		}}, ""},
+		{"a document left as it was", []*Session{{
+			ID: "s1", Owner: "alice",
+			Documents: []Document{{Path: "a.txt", Content: "a", Access: map[string]string{}, UpdatedAt: updated}},
+			UpdatedAt: updated,
+		}, {
+			ID: "s1", Owner: "alice",
+			Documents: []Document{{Path: "a.txt", Content: "a", Access: map[string]string{}, UpdatedAt: updated.Add(time.Hour)}},
+			UpdatedAt: updated.Add(time.Hour),
+		}}, `{}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := openSQLiteStore(t)
+			for _, session := range tt.saves {
+				mustSave(t, s, session)
+			}
+			want := tt.saves[len(tt.saves)-1]
+			got, err := s.Load(context.Background(), want.ID)
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+
+			metadata := want.Metadata
+			if tt.metadata != "" {
+				metadata = json.RawMessage(tt.metadata)
+			}
+			if !sameJSON(t, got.Metadata, metadata) {
+				t.Fatalf("metadata = %s, want %s", got.Metadata, metadata)
+			}
+			if got.Owner != want.Owner || got.Org != want.Org || !got.UpdatedAt.Equal(want.UpdatedAt) {
+				t.Fatalf("got %s of %s at %s, want %s of %s at %s", got.Owner, got.Org, got.UpdatedAt, want.Owner, want.Org, want.UpdatedAt)
+			}
+			if !reflect.DeepEqual(got.Tags, sortedTags(want.Tags)) {
+				t.Fatalf("tags = %v, want %v", got.Tags, want.Tags)
+			}
+			if len(got.Documents) != len(want.Documents) {
+				t.Fatalf("loaded %d documents, want %d", len(got.Documents), len(want.Documents))
+			}
+			for _, doc := range want.Documents {
+				loaded := findDocument(got.Documents, doc.Path)
+				if loaded == nil {
+					t.Fatalf("%s wasn't loaded", doc.Path)
+				}
+				// Unchanged documents aren't rewritten, so keep the time
+				// they were first saved
+				first := tt.saves[0].Documents
+				wantUpdated := doc.UpdatedAt
+				if kept := findDocument(first, doc.Path); kept != nil && kept.Content == doc.Content && kept.Language == doc.Language && reflect.DeepEqual(kept.Access, doc.Access) {
+					wantUpdated = kept.UpdatedAt
+				}
+				if loaded.Content != doc.Content || loaded.Language != doc.Language || !reflect.DeepEqual(loaded.Access, doc.Access) || !loaded.UpdatedAt.Equal(wantUpdated) {
+					t.Fatalf("loaded %+v, want %+v updated at %s", *loaded, doc, wantUpdated)
+				}
+			}
+		})
+	}
+}
+
+func findDocument(docs []Document, path string) *Document {
+	for i := range docs {
+		if docs[i].Path == path {
+			return &docs[i]
+		}
+	}
+	return nil
+}
+
+// sortedTags is tags in the order Load returns them, nil for none
+func sortedTags(tags []string) []string {
+	if len(tags) == 0 {
+		return nil
+	}
+	return slices.Sorted(slices.Values(tags))
+}
+
+func TestLoadNeverSaved(t *testing.T) {
+	s := openSQLiteStore(t)
+	if _, err := s.Load(context.Background(), "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Load = %v, want ErrNotFound", err)
+	}
+	if _, err := s.LoadHistory(context.Background(), "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("LoadHistory = %v, want ErrNotFound", err)
+	}
+}
+
+func TestHistoryIsKeptApart(t *testing.T) {
+	s := openSQLiteStore(t)
+	history := json.RawMessage(`{"checkpoints":[{"id":1,"files":{"main.go":"package main"},"binary":{"logo.png":"sessions/s1/4f9a"}}]}`)
+	mustSave(t, s, &Session{ID: "s1", Owner: "alice", History: history, UpdatedAt: time.Now()})
+	// Saved without its history, as before the history was loaded
+	mustSave(t, s, &Session{ID: "s1", Owner: "alice", UpdatedAt: time.Now()})
+
+	loaded, err := s.Load(context.Background(), "s1")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if loaded.History != nil {
+		t.Fatalf("Load returned history %s", loaded.History)
+	}
+	got, err := s.LoadHistory(context.Background(), "s1")
+	if err != nil {
+		t.Fatalf("LoadHistory: %v", err)
+	}
+	if !bytes.Equal(got, history) {
+		t.Fatalf("history = %s, want %s", got, history)
+	}
+}
+
+func TestOperationsAreSavedOnce(t *testing.T) {
+	s := openSQLiteStore(t)
+	at := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	ops := []*Operation{
+		{SessionID: "s1", ID: 1, Path: "main.go", UserID: "u1", Username: "alice", Type: "edit", Ops: json.RawMessage(`[{"type":"insert","pos":0,"text":"x"}]`), At: at},
+		{SessionID: "s1", ID: 2, Path: "main.go", UserID: "u1", Username: "alice", Type: "edit", At: at.Add(time.Second)},
+	}
+	mustSave(t, s, &Session{ID: "s1", Owner: "alice", Operations: ops[:1], UpdatedAt: at})
+	mustSave(t, s, &Session{ID: "s1", Owner: "alice", Operations: ops, UpdatedAt: at})
+
+	got, err := s.Operations(context.Background(), "s1", OperationFilter{Limit: 10})
+	if err != nil {
+		t.Fatalf("Operations: %v", err)
+	}
+	if len(got) != len(ops) {
+		t.Fatalf("kept %d operations, want %d", len(got), len(ops))
+	}
+	for _, op := range got {
+		want := ops[op.ID-1]
+		wantOps := want.Ops
+		if wantOps == nil {
+			wantOps = json.RawMessage(`[]`)
+		}
+		if op.Path != want.Path || op.Username != want.Username || op.Type != want.Type || !op.At.Equal(want.At) || !sameJSON(t, op.Ops, wantOps) {
+			t.Fatalf("operation %d = %+v, want %+v", op.ID, *op, *want)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+// Package textdiff produces line-based diffs, as the unified diffs patch
+// and git read or as hunks for clients to render.
+package textdiff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Context is the number of unchanged lines shown around each change
+const Context = 3
+
+type opKind uint8
+
+const (
+	equal opKind = iota
+	remove
+	add
+)
+
+type lineOp struct {
+	kind opKind
+	// a and b are the line's indexes in the old and new text
+	a, b int
+}
+
+// splitLines splits text into lines that keep their newline, so a missing
+// newline at the end is a difference like any other
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// maxCost bounds the edit distance diffLines searches. Texts further apart
+// than that are diffed as one replacement, which keeps the search's memory,
+// quadratic in the distance, small.
+const maxCost = 2000
+
+// diffLines returns the edit script turning a into b, found with Myers'
+// algorithm
+func diffLines(a, b []string) []lineOp {
+	n, m := len(a), len(b)
+	maxD := min(n+m, maxCost)
+	offset := maxD + 1
+	v := make([]int, 2*maxD+3)
+	// trace[d] holds the frontier before step d, diagonals -d-1 to d+1
+	var trace [][]int
+
+	for d := 0; d <= maxD; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(trace, n, m, d)
+			}
+		}
+	}
+	return replaceAll(n, m)
+}
+
+// replaceAll is the edit script removing every line of a and adding every
+// line of b
+func replaceAll(n, m int) []lineOp {
+	ops := make([]lineOp, 0, n+m)
+	for i := range n {
+		ops = append(ops, lineOp{kind: remove, a: i, b: 0})
+	}
+	for j := range m {
+		ops = append(ops, lineOp{kind: add, a: n, b: j})
+	}
+	return ops
+}
+
+// backtrack walks the saved frontiers from the end of both texts back to
+// the start, recovering the path diffLines found
+func backtrack(trace [][]int, x, y, d int) []lineOp {
+	var ops []lineOp
+	for ; d >= 0; d-- {
+		v, offset := trace[d], d+1
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			ops = append(ops, lineOp{kind: equal, a: x, b: y})
+		}
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, lineOp{kind: add, a: x, b: prevY})
+			} else {
+				ops = append(ops, lineOp{kind: remove, a: prevX, b: y})
+			}
+		}
+		x, y = prevX, prevY
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// Unified returns the unified diff turning before into after, labelled
+// with oldName and newName, or "" when they're equal
+func Unified(oldName, newName, before, after string) string {
+	if before == after {
+		return ""
+	}
+	a, b := splitLines(before), splitLines(after)
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", oldName, newName)
+	for _, hunk := range splitHunks(diffLines(a, b)) {
+		writeHunk(&out, a, b, hunk)
+	}
+	return out.String()
+}
+
+// splitHunks groups an edit script into hunks. A hunk runs from Context
+// lines before a change to Context lines after the last change closer
+// than twice that to the next one.
+func splitHunks(ops []lineOp) [][]lineOp {
+	var hunks [][]lineOp
+	for start := 0; start < len(ops); {
+		if ops[start].kind == equal {
+			start++
+			continue
+		}
+		first := max(start-Context, 0)
+		end := start
+		for i := start; i < len(ops); i++ {
+			if ops[i].kind != equal {
+				end = i + 1
+			} else if i+1-end > 2*Context {
+				break
+			}
+		}
+		last := min(end+Context, len(ops))
+		hunks = append(hunks, ops[first:last])
+		start = last
+	}
+	return hunks
+}
+
+// Hunk is a run of changed lines with the unchanged lines around them.
+// Starts count lines from 1, as in a unified diff's hunk header.
+type Hunk struct {
+	OldStart int    `json:"oldStart"`
+	OldLines int    `json:"oldLines"`
+	NewStart int    `json:"newStart"`
+	NewLines int    `json:"newLines"`
+	Lines    []Line `json:"lines"`
+}
+
+// Line is one line of a hunk. Op is "equal", "delete" or "insert". A
+// deleted line followed by the inserted line replacing it both mark the
+// characters that differ in Changed.
+type Line struct {
+	Op      string  `json:"op"`
+	Text    string  `json:"text"`
+	OldLine int     `json:"oldLine,omitempty"`
+	NewLine int     `json:"newLine,omitempty"`
+	Changed []Range `json:"changed,omitempty"`
+}
+
+// Range is the characters of a line from Start up to End, counting Unicode
+// code points
+type Range struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// Hunks returns the hunks turning before into after, none when they're
+// equal
+func Hunks(before, after string) []Hunk {
+	if before == after {
+		return nil
+	}
+	a, b := splitLines(before), splitLines(after)
+
+	var hunks []Hunk
+	for _, ops := range splitHunks(diffLines(a, b)) {
+		hunk := Hunk{OldStart: ops[0].a + 1, NewStart: ops[0].b + 1}
+		for _, op := range ops {
+			switch op.kind {
+			case equal:
+				hunk.OldLines++
+				hunk.NewLines++
+				hunk.Lines = append(hunk.Lines, Line{Op: "equal", Text: a[op.a], OldLine: op.a + 1, NewLine: op.b + 1})
+			case remove:
+				hunk.OldLines++
+				hunk.Lines = append(hunk.Lines, Line{Op: "delete", Text: a[op.a], OldLine: op.a + 1})
+			case add:
+				hunk.NewLines++
+				hunk.Lines = append(hunk.Lines, Line{Op: "insert", Text: b[op.b], NewLine: op.b + 1})
+			}
+		}
+		markChanges(hunk.Lines)
+		hunks = append(hunks, hunk)
+	}
+	return hunks
+}
+
+// markChanges pairs each run of deleted lines with the run of inserted
+// lines after it, line by line, and marks what differs between the pairs
+func markChanges(lines []Line) {
+	for i := 0; i < len(lines); {
+		deletes := i
+		for deletes < len(lines) && lines[deletes].Op == "delete" {
+			deletes++
+		}
+		inserts := deletes
+		for inserts < len(lines) && lines[inserts].Op == "insert" {
+			inserts++
+		}
+		for j := range min(deletes-i, inserts-deletes) {
+			removed, added := &lines[i+j], &lines[deletes+j]
+			removed.Changed, added.Changed = changedRanges(removed.Text, added.Text)
+		}
+		i = max(inserts, i+1)
+	}
+}
+
+// changedRanges is what lies between the common prefix and suffix of two
+// lines, in each of them
+func changedRanges(a, b string) ([]Range, []Range) {
+	ra, rb := []rune(a), []rune(b)
+	prefix := 0
+	for prefix < len(ra) && prefix < len(rb) && ra[prefix] == rb[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(ra)-prefix && suffix < len(rb)-prefix && ra[len(ra)-1-suffix] == rb[len(rb)-1-suffix] {
+		suffix++
+	}
+	var oldRanges, newRanges []Range
+	if end := len(ra) - suffix; end > prefix {
+		oldRanges = []Range{{Start: prefix, End: end}}
+	}
+	if end := len(rb) - suffix; end > prefix {
+		newRanges = []Range{{Start: prefix, End: end}}
+	}
+	return oldRanges, newRanges
+}
+
+func writeHunk(out *strings.Builder, a, b []string, ops []lineOp) {
+	oldStart, newStart := ops[0].a, ops[0].b
+	oldLen, newLen := 0, 0
+	for _, op := range ops {
+		if op.kind != add {
+			oldLen++
+		}
+		if op.kind != remove {
+			newLen++
+		}
+	}
+	fmt.Fprintf(out, "@@ -%s +%s @@\n", hunkRange(oldStart, oldLen), hunkRange(newStart, newLen))
+	for _, op := range ops {
+		switch op.kind {
+		case equal:
+			writeLine(out, ' ', a[op.a])
+		case remove:
+			writeLine(out, '-', a[op.a])
+		case add:
+			writeLine(out, '+', b[op.b])
+		}
+	}
+}
+
+// hunkRange formats a hunk's start and length. Empty ranges start at the
+// line before them.
+func hunkRange(start, length int) string {
+	switch length {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, length)
+}
+
+func writeLine(out *strings.Builder, prefix byte, line string) {
+	out.WriteByte(prefix)
+	out.WriteString(line)
+	if !strings.HasSuffix(line, "\n") {
+		out.WriteString("\n\\ No newline at end of file\n")
+	}
+}
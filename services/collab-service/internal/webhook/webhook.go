@@ -0,0 +1,72 @@
+// Package webhook delivers signed event notifications over HTTP. Receivers
+// verify the X-Codecollab-Signature header, "sha256=" followed by the
+// hex HMAC-SHA256 of the body under the shared secret.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Event is the envelope every delivery is wrapped in
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Data any       `json:"data"`
+}
+
+// Sender posts events to webhook URLs
+type Sender struct {
+	secret string
+	client *http.Client
+}
+
+// New returns a sender signing with secret. Deliveries are unsigned when
+// secret is empty.
+func New(secret string, timeout time.Duration) *Sender {
+	return &Sender{secret: secret, client: &http.Client{Timeout: timeout}}
+}
+
+// Sign returns the signature header value for body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send delivers an event of type eventType to url. Any 2xx response counts
+// as delivered.
+func (s *Sender) Send(ctx context.Context, url, eventType string, data any) error {
+	body, err := json.Marshal(Event{Type: eventType, Time: time.Now().UTC(), Data: data})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Codecollab-Event", eventType)
+	if s.secret != "" {
+		req.Header.Set("X-Codecollab-Signature", Sign(s.secret, body))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
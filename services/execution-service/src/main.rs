@@ -1,6 +1,7 @@
 use actix_web::{web, App, HttpResponse, HttpServer, Responder};
 use actix_cors::Cors;
 use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
 use std::env;
 use std::io::{self, Write};
 
@@ -10,8 +11,73 @@ struct ExecuteRequest {
     language: String,
     #[serde(default)]
     timeout: u64,
+    #[serde(default)]
+    env: HashMap<String, String>,
+    #[serde(default)]
+    run_id: Option<String>,
+    /// With `run` set, the code is written to `file` and run with these
+    /// shell commands instead of the built-in handler for `language`
+    #[serde(default)]
+    file: Option<String>,
+    #[serde(default)]
+    compile: Option<String>,
+    #[serde(default)]
+    run: Option<String>,
+    #[serde(default)]
+    memory_mb: u64,
+    /// Extra files written next to `file`, keyed by relative path
+    #[serde(default)]
+    files: HashMap<String, String>,
+}
+
+#[derive(Debug, Deserialize)]
+struct CancelRequest {
+    run_id: String,
 }
 
+#[derive(Debug, Serialize)]
+struct CancelResponse {
+    run_id: String,
+    killed: usize,
+}
+
+#[derive(Debug, Deserialize)]
+struct InstallRequest {
+    key: String,
+    #[serde(default)]
+    files: HashMap<String, String>,
+    command: String,
+    #[serde(default)]
+    timeout: u64,
+    #[serde(default)]
+    env: HashMap<String, String>,
+}
+
+#[derive(Debug, Serialize, Default)]
+struct InstallResponse {
+    dir: String,
+    cached: bool,
+    stdout: String,
+    stderr: String,
+    exit_code: i32,
+    execution_time: f64,
+}
+
+#[derive(Debug, Deserialize)]
+struct PurgeRequest {
+    keys: Vec<String>,
+}
+
+/// Installed dependencies are kept here, one directory per install key
+const DEPS_DIR: &str = "/tmp/codecollab_deps";
+
+/// Written into an install directory once the install succeeded
+const INSTALLED_MARKER: &str = ".installed";
+
+/// Set in the environment of every process spawned for a run, so the run
+/// can be cancelled by finding its processes (and their children) in /proc
+const RUN_ID_ENV: &str = "CODECOLLAB_RUN_ID";
+
 #[derive(Debug, Serialize)]
 struct ExecuteResponse {
     stdout: String,
@@ -20,6 +86,19 @@ struct ExecuteResponse {
     execution_time: f64,
 }
 
+/// One line of a streamed run: output as it is produced, then the result
+#[derive(Debug, Serialize, Default)]
+struct StreamEvent {
+    #[serde(skip_serializing_if = "String::is_empty")]
+    stdout: String,
+    #[serde(skip_serializing_if = "String::is_empty")]
+    stderr: String,
+    #[serde(skip_serializing_if = "std::ops::Not::not")]
+    done: bool,
+    exit_code: i32,
+    execution_time: f64,
+}
+
 #[derive(Debug, Serialize)]
 struct ServiceInfo {
     service: String,
@@ -53,20 +132,38 @@ async fn execute_code(req: web::Json<ExecuteRequest>) -> impl Responder {
     
     let start_time = std::time::Instant::now();
     let timeout = if req.timeout > 0 { req.timeout } else { 10 };
+    let mut run_env = req.env.clone();
+    if let Some(run_id) = &req.run_id {
+        run_env.insert(RUN_ID_ENV.to_string(), run_id.clone());
+    }
     
-    let result = match req.language.as_str() {
-        "python" => execute_python(&req.code, timeout).await,
-        "javascript" => execute_javascript(&req.code, timeout).await,
-        "typescript" => execute_typescript(&req.code, timeout).await,
-        "rust" => execute_rust(&req.code, timeout).await,
-        "go" => execute_go(&req.code, timeout).await,
-        "cpp" | "c++" => execute_cpp(&req.code, timeout).await,
-        "java" => execute_java(&req.code, timeout).await,
-        "c" => execute_c(&req.code, timeout).await,
-        "zig" => execute_zig(&req.code, timeout).await,
-        "elixir" => execute_elixir(&req.code, timeout).await,
-        "vlang" | "v" => execute_vlang(&req.code, timeout).await,
-        _ => Err(format!("Unsupported language: {}", req.language)),
+    let result = if let Some(run) = req.run.as_deref().filter(|run| !run.is_empty()) {
+        execute_command(
+            &req.code,
+            req.file.as_deref().unwrap_or("main"),
+            &req.files,
+            req.compile.as_deref().unwrap_or(""),
+            run,
+            req.memory_mb,
+            timeout,
+            &run_env,
+        )
+        .await
+    } else {
+        match req.language.as_str() {
+            "python" => execute_python(&req.code, timeout, &run_env).await,
+            "javascript" => execute_javascript(&req.code, timeout, &run_env).await,
+            "typescript" => execute_typescript(&req.code, timeout, &run_env).await,
+            "rust" => execute_rust(&req.code, timeout, &run_env).await,
+            "go" => execute_go(&req.code, timeout, &run_env).await,
+            "cpp" | "c++" => execute_cpp(&req.code, timeout, &run_env).await,
+            "java" => execute_java(&req.code, timeout, &run_env).await,
+            "c" => execute_c(&req.code, timeout, &run_env).await,
+            "zig" => execute_zig(&req.code, timeout, &run_env).await,
+            "elixir" => execute_elixir(&req.code, timeout, &run_env).await,
+            "vlang" | "v" => execute_vlang(&req.code, timeout, &run_env).await,
+            _ => Err(format!("Unsupported language: {}", req.language)),
+        }
     };
     
     let execution_time = start_time.elapsed().as_secs_f64() * 1000.0;
@@ -91,10 +188,457 @@ async fn execute_code(req: web::Json<ExecuteRequest>) -> impl Responder {
     }
 }
 
-async fn execute_python(code: &str, timeout: u64) -> Result<(String, String, i32), String> {
+/// Sends SIGKILL to every process whose environment carries the run ID
+fn kill_run(run_id: &str) -> usize {
+    let needle = format!("{}={}", RUN_ID_ENV, run_id);
+    let entries = match std::fs::read_dir("/proc") {
+        Ok(entries) => entries,
+        Err(_) => return 0,
+    };
+
+    let mut killed = 0;
+    for entry in entries.flatten() {
+        let pid = match entry.file_name().to_str() {
+            Some(pid) if pid.chars().all(|c| c.is_ascii_digit()) => pid.to_string(),
+            _ => continue,
+        };
+        let environ = match std::fs::read(entry.path().join("environ")) {
+            Ok(environ) => environ,
+            Err(_) => continue,
+        };
+        if environ.split(|b| *b == 0).any(|var| var == needle.as_bytes()) {
+            let status = std::process::Command::new("sh")
+                .arg("-c")
+                .arg(format!("kill -9 {}", pid))
+                .status();
+            if matches!(status, Ok(s) if s.success()) {
+                killed += 1;
+            }
+        }
+    }
+    killed
+}
+
+async fn cancel_run(req: web::Json<CancelRequest>) -> impl Responder {
+    if req.run_id.is_empty() {
+        return HttpResponse::BadRequest().json(serde_json::json!({ "error": "run_id is required" }));
+    }
+
+    let run_id = req.run_id.clone();
+    let killed = tokio::task::spawn_blocking(move || kill_run(&run_id))
+        .await
+        .unwrap_or(0);
+    log::info!("Cancelled run {} ({} processes killed)", req.run_id, killed);
+
+    HttpResponse::Ok().json(CancelResponse {
+        run_id: req.run_id.clone(),
+        killed,
+    })
+}
+
+/// Install keys name directories, so only plain hex is accepted
+fn valid_install_key(key: &str) -> bool {
+    !key.is_empty() && key.len() <= 64 && key.chars().all(|c| c.is_ascii_hexdigit())
+}
+
+async fn install_dependencies(req: web::Json<InstallRequest>) -> impl Responder {
+    if !valid_install_key(&req.key) {
+        return HttpResponse::BadRequest().json(serde_json::json!({ "error": "invalid install key" }));
+    }
+
+    let dir = format!("{}/{}", DEPS_DIR, req.key);
+    if std::path::Path::new(&dir).join(INSTALLED_MARKER).exists() {
+        return HttpResponse::Ok().json(InstallResponse {
+            dir,
+            cached: true,
+            ..Default::default()
+        });
+    }
+
+    log::info!("Installing dependencies for {}", req.key);
+    let start_time = std::time::Instant::now();
+    let timeout = if req.timeout > 0 { req.timeout } else { 120 };
+    let result = run_install(&dir, &req.files, &req.command, timeout, &req.env).await;
+    let execution_time = start_time.elapsed().as_secs_f64();
+
+    let response = match result {
+        Ok((stdout, stderr, exit_code)) => InstallResponse {
+            dir: dir.clone(),
+            stdout,
+            stderr,
+            exit_code,
+            execution_time,
+            ..Default::default()
+        },
+        Err(e) => InstallResponse {
+            dir: dir.clone(),
+            stderr: e,
+            exit_code: -1,
+            execution_time,
+            ..Default::default()
+        },
+    };
+    if response.exit_code == 0 {
+        let _ = std::fs::write(std::path::Path::new(&dir).join(INSTALLED_MARKER), "");
+    } else {
+        let _ = std::fs::remove_dir_all(&dir);
+    }
+    HttpResponse::Ok().json(response)
+}
+
+/// Writes the manifests into dir and runs the install command there
+async fn run_install(
+    dir: &str,
+    files: &HashMap<String, String>,
+    command: &str,
+    timeout: u64,
+    env: &HashMap<String, String>,
+) -> Result<(String, String, i32), String> {
+    use std::fs;
+    use std::path::{Component, Path};
+    use std::process::{Command, Stdio};
+
+    if let Some(path) = files
+        .keys()
+        .find(|path| !Path::new(path).components().all(|c| matches!(c, Component::Normal(_))))
+    {
+        return Err(format!("Invalid file path: {}", path));
+    }
+
+    let _ = fs::remove_dir_all(dir);
+    fs::create_dir_all(dir).map_err(|e| format!("Failed to create install dir: {}", e))?;
+    for (path, content) in files {
+        let target = Path::new(dir).join(path);
+        if let Some(parent) = target.parent() {
+            fs::create_dir_all(parent).map_err(|e| format!("Failed to create {}: {}", path, e))?;
+        }
+        fs::write(&target, content).map_err(|e| format!("Failed to write {}: {}", path, e))?;
+    }
+
+    let child = Command::new("sh")
+        .envs(env)
+        .current_dir(dir)
+        .arg("-c")
+        .arg(command)
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()
+        .map_err(|e| format!("Failed to start install: {}", e))?;
+
+    let result = tokio::time::timeout(
+        std::time::Duration::from_secs(timeout),
+        tokio::task::spawn_blocking(move || child.wait_with_output()),
+    )
+    .await;
+
+    match result {
+        Ok(Ok(Ok(output))) => Ok((
+            String::from_utf8_lossy(&output.stdout).to_string(),
+            String::from_utf8_lossy(&output.stderr).to_string(),
+            output.status.code().unwrap_or(1),
+        )),
+        Ok(Ok(Err(e))) => Err(format!("Process error: {}", e)),
+        Ok(Err(e)) => Err(format!("Task error: {}", e)),
+        Err(_) => Err(format!("Install timeout ({}s)", timeout)),
+    }
+}
+
+async fn purge_installs(req: web::Json<PurgeRequest>) -> impl Responder {
+    let mut removed = 0;
+    for key in req.keys.iter().filter(|key| valid_install_key(key)) {
+        if std::fs::remove_dir_all(format!("{}/{}", DEPS_DIR, key)).is_ok() {
+            removed += 1;
+        }
+    }
+    HttpResponse::Ok().json(serde_json::json!({ "removed": removed }))
+}
+
+/// Runs code with commands from the collab service's language registry.
+/// The source is written to `file` in a fresh directory, `compile` (if any)
+/// runs first, and both go through `sh` so they may use shell syntax.
+async fn execute_command(
+    code: &str,
+    file: &str,
+    files: &HashMap<String, String>,
+    compile: &str,
+    run: &str,
+    memory_mb: u64,
+    timeout: u64,
+    env: &HashMap<String, String>,
+) -> Result<(String, String, i32), String> {
+    use std::fs;
+    use std::process::{Command, Stdio};
+
+    let temp_dir = prepare_workspace(code, file, files)?;
+    let limit = memory_limit(memory_mb);
+
+    if let Some(compile_error) = run_compile(&temp_dir, compile, &limit, env) {
+        let _ = fs::remove_dir_all(&temp_dir);
+        return compile_error;
+    }
+
+    let child = Command::new("sh")
+        .envs(env)
+        .current_dir(&temp_dir)
+        .arg("-c")
+        .arg(format!("{}{}", limit, run))
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn();
+
+    let child = match child {
+        Ok(c) => c,
+        Err(e) => {
+            let _ = fs::remove_dir_all(&temp_dir);
+            return Err(format!("Failed to execute: {}", e));
+        }
+    };
+
+    let result = tokio::time::timeout(
+        std::time::Duration::from_secs(timeout),
+        tokio::task::spawn_blocking(move || child.wait_with_output()),
+    )
+    .await;
+
+    let _ = fs::remove_dir_all(&temp_dir);
+
+    match result {
+        Ok(Ok(Ok(output))) => {
+            let stdout = String::from_utf8_lossy(&output.stdout).to_string();
+            let stderr = String::from_utf8_lossy(&output.stderr).to_string();
+            let exit_code = output.status.code().unwrap_or(1);
+            Ok((stdout, stderr, exit_code))
+        }
+        Ok(Ok(Err(e))) => Err(format!("Process error: {}", e)),
+        Ok(Err(e)) => Err(format!("Task error: {}", e)),
+        Err(_) => Err(format!("Execution timeout ({}s)", timeout)),
+    }
+}
+
+/// Creates a fresh directory holding the source as `file` (when given) and
+/// the extra files, refusing paths that would escape it
+fn prepare_workspace(code: &str, file: &str, files: &HashMap<String, String>) -> Result<String, String> {
+    use std::fs;
+    use std::path::{Component, Path};
+    use uuid::Uuid;
+
+    let valid = |path: &str| {
+        !path.is_empty()
+            && Path::new(path).components().all(|c| matches!(c, Component::Normal(_)))
+    };
+    if !file.is_empty() && (file.contains('/') || !valid(file)) {
+        return Err(format!("Invalid source file name: {}", file));
+    }
+    if let Some(path) = files.keys().find(|path| !valid(path)) {
+        return Err(format!("Invalid file path: {}", path));
+    }
+
+    let temp_dir = format!("/tmp/run_{}", Uuid::new_v4());
+    fs::create_dir_all(&temp_dir).map_err(|e| format!("Failed to create temp dir: {}", e))?;
+    let write = |path: &str, content: &str| -> Result<(), String> {
+        let target = Path::new(&temp_dir).join(path);
+        if let Some(parent) = target.parent() {
+            fs::create_dir_all(parent).map_err(|e| format!("Failed to create {}: {}", path, e))?;
+        }
+        fs::write(&target, content).map_err(|e| format!("Failed to write {}: {}", path, e))
+    };
+    let written = files
+        .iter()
+        .try_for_each(|(path, content)| write(path, content))
+        .and_then(|_| if file.is_empty() { Ok(()) } else { write(file, code) });
+    if let Err(e) = written {
+        let _ = fs::remove_dir_all(&temp_dir);
+        return Err(e);
+    }
+    Ok(temp_dir)
+}
+
+/// Shell prefix applying the memory limit. RLIMIT_DATA rather than
+/// RLIMIT_AS, since runtimes like V8 and Go reserve far more address space
+/// than they use.
+fn memory_limit(memory_mb: u64) -> String {
+    if memory_mb > 0 {
+        format!("ulimit -d {} && ", memory_mb * 1024)
+    } else {
+        String::new()
+    }
+}
+
+/// Runs the compile command, returning the run's result if it failed
+fn run_compile(
+    temp_dir: &str,
+    compile: &str,
+    limit: &str,
+    env: &HashMap<String, String>,
+) -> Option<Result<(String, String, i32), String>> {
+    use std::process::{Command, Stdio};
+
+    if compile.is_empty() {
+        return None;
+    }
+    let output = Command::new("sh")
+        .envs(env)
+        .current_dir(temp_dir)
+        .arg("-c")
+        .arg(format!("{}{}", limit, compile))
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .output();
+
+    match output {
+        Err(e) => Some(Err(format!("Failed to start compiler: {}", e))),
+        Ok(output) if !output.status.success() => {
+            let stderr = String::from_utf8_lossy(&output.stderr).to_string();
+            Some(Ok((String::new(), format!("Compilation error:\n{}", stderr), 1)))
+        }
+        Ok(_) => None,
+    }
+}
+
+type StreamSender = tokio::sync::mpsc::UnboundedSender<Result<web::Bytes, std::io::Error>>;
+
+fn send_event(tx: &StreamSender, event: &StreamEvent) {
+    if let Ok(mut line) = serde_json::to_vec(event) {
+        line.push(b'\n');
+        let _ = tx.send(Ok(web::Bytes::from(line)));
+    }
+}
+
+/// Like /execute, but responds with newline-delimited JSON: output lines
+/// as the run produces them, then a final event with `done` set. Only runs
+/// with a `run` command can be streamed.
+async fn execute_stream(req: web::Json<ExecuteRequest>) -> impl Responder {
+    let req = req.into_inner();
+    log::info!("Streaming {} run ({} files)", req.language, req.files.len());
+
+    let (tx, rx) = tokio::sync::mpsc::unbounded_channel();
+    std::thread::spawn(move || {
+        let start_time = std::time::Instant::now();
+        let exit_code = stream_command(&req, &tx);
+        send_event(&tx, &StreamEvent {
+            done: true,
+            exit_code,
+            execution_time: start_time.elapsed().as_secs_f64() * 1000.0,
+            ..Default::default()
+        });
+    });
+
+    HttpResponse::Ok()
+        .content_type("application/x-ndjson")
+        .streaming(tokio_stream::wrappers::UnboundedReceiverStream::new(rx))
+}
+
+/// Runs a streamed request to completion and returns its exit code
+fn stream_command(req: &ExecuteRequest, tx: &StreamSender) -> i32 {
+    use std::fs;
+    use std::io::{BufRead, BufReader};
+    use std::process::{Command, Stdio};
+
+    let fail = |message: String| {
+        send_event(tx, &StreamEvent { stderr: message, ..Default::default() });
+        1
+    };
+
+    let run = match req.run.as_deref().filter(|run| !run.is_empty()) {
+        Some(run) => run,
+        None => return fail("Streaming requires a run command".to_string()),
+    };
+    let timeout = if req.timeout > 0 { req.timeout } else { 10 };
+    let mut env = req.env.clone();
+    if let Some(run_id) = &req.run_id {
+        env.insert(RUN_ID_ENV.to_string(), run_id.clone());
+    }
+
+    let temp_dir = match prepare_workspace(&req.code, req.file.as_deref().unwrap_or(""), &req.files) {
+        Ok(dir) => dir,
+        Err(e) => return fail(e),
+    };
+    let limit = memory_limit(req.memory_mb);
+
+    if let Some(compile_error) = run_compile(&temp_dir, req.compile.as_deref().unwrap_or(""), &limit, &env) {
+        let _ = fs::remove_dir_all(&temp_dir);
+        return match compile_error {
+            Ok((_, stderr, exit_code)) => {
+                fail(stderr);
+                exit_code
+            }
+            Err(e) => fail(e),
+        };
+    }
+
+    let child = Command::new("sh")
+        .envs(&env)
+        .current_dir(&temp_dir)
+        .arg("-c")
+        .arg(format!("{}{}", limit, run))
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn();
+    let mut child = match child {
+        Ok(child) => child,
+        Err(e) => {
+            let _ = fs::remove_dir_all(&temp_dir);
+            return fail(format!("Failed to execute: {}", e));
+        }
+    };
+
+    // Output is forwarded a line at a time so secrets can be masked
+    // without being split across events
+    let forward = |pipe: Box<dyn std::io::Read + Send>, stderr: bool| {
+        let tx = tx.clone();
+        std::thread::spawn(move || {
+            let mut reader = BufReader::new(pipe);
+            let mut line = Vec::new();
+            while matches!(reader.read_until(b'\n', &mut line), Ok(n) if n > 0) {
+                let data = String::from_utf8_lossy(&line).to_string();
+                let event = if stderr {
+                    StreamEvent { stderr: data, ..Default::default() }
+                } else {
+                    StreamEvent { stdout: data, ..Default::default() }
+                };
+                send_event(&tx, &event);
+                line.clear();
+            }
+        })
+    };
+    let readers = [
+        forward(Box::new(child.stdout.take().unwrap()), false),
+        forward(Box::new(child.stderr.take().unwrap()), true),
+    ];
+
+    let deadline = std::time::Instant::now() + std::time::Duration::from_secs(timeout);
+    let status = loop {
+        match child.try_wait() {
+            Ok(Some(status)) => break Ok(status),
+            Ok(None) if std::time::Instant::now() >= deadline => {
+                // Kill the whole run, so no grandchild keeps the pipes open
+                let _ = child.kill();
+                if let Some(run_id) = &req.run_id {
+                    kill_run(run_id);
+                }
+                let _ = child.wait();
+                break Err(format!("Execution timeout ({}s)", timeout));
+            }
+            Ok(None) => std::thread::sleep(std::time::Duration::from_millis(20)),
+            Err(e) => break Err(format!("Process error: {}", e)),
+        }
+    };
+    for reader in readers {
+        let _ = reader.join();
+    }
+    let _ = fs::remove_dir_all(&temp_dir);
+
+    match status {
+        Ok(status) => status.code().unwrap_or(1),
+        Err(e) => fail(e),
+    }
+}
+
+async fn execute_python(code: &str, timeout: u64, env: &HashMap<String, String>) -> Result<(String, String, i32), String> {
     use std::process::{Command, Stdio};
     
     let child = Command::new("python3")
+        .envs(env)
         .arg("-c")
         .arg(code)
         .stdout(Stdio::piped())
@@ -122,10 +666,11 @@ async fn execute_python(code: &str, timeout: u64) -> Result<(String, String, i32
     }
 }
 
-async fn execute_javascript(code: &str, timeout: u64) -> Result<(String, String, i32), String> {
+async fn execute_javascript(code: &str, timeout: u64, env: &HashMap<String, String>) -> Result<(String, String, i32), String> {
     use std::process::{Command, Stdio};
     
     let child = Command::new("node")
+        .envs(env)
         .arg("-e")
         .arg(code)
         .stdout(Stdio::piped())
@@ -152,10 +697,11 @@ async fn execute_javascript(code: &str, timeout: u64) -> Result<(String, String,
     }
 }
 
-async fn execute_typescript(code: &str, timeout: u64) -> Result<(String, String, i32), String> {
+async fn execute_typescript(code: &str, timeout: u64, env: &HashMap<String, String>) -> Result<(String, String, i32), String> {
     use std::process::{Command, Stdio};
     
     let child = Command::new("ts-node")
+        .envs(env)
         .arg("--transpile-only")
         .arg("--compiler-options")
         .arg("{\"module\":\"commonjs\"}")
@@ -185,7 +731,7 @@ async fn execute_typescript(code: &str, timeout: u64) -> Result<(String, String,
     }
 }
 
-async fn execute_rust(code: &str, timeout: u64) -> Result<(String, String, i32), String> {
+async fn execute_rust(code: &str, timeout: u64, env: &HashMap<String, String>) -> Result<(String, String, i32), String> {
     use std::fs;
     use std::process::{Command, Stdio};
     use uuid::Uuid;
@@ -200,6 +746,7 @@ async fn execute_rust(code: &str, timeout: u64) -> Result<(String, String, i32),
     
     // Compile
     let compile = Command::new("rustc")
+        .envs(env)
         .args(&[&source_file, "-o", &format!("{}/main", temp_dir)])
         .stdout(Stdio::piped())
         .stderr(Stdio::piped())
@@ -221,6 +768,7 @@ async fn execute_rust(code: &str, timeout: u64) -> Result<(String, String, i32),
     
     // Execute
     let child = Command::new(format!("{}/main", temp_dir))
+        .envs(env)
         .stdout(Stdio::piped())
         .stderr(Stdio::piped())
         .spawn();
@@ -254,7 +802,7 @@ async fn execute_rust(code: &str, timeout: u64) -> Result<(String, String, i32),
     }
 }
 
-async fn execute_go(code: &str, timeout: u64) -> Result<(String, String, i32), String> {
+async fn execute_go(code: &str, timeout: u64, env: &HashMap<String, String>) -> Result<(String, String, i32), String> {
     use std::fs;
     use std::process::{Command, Stdio};
     use uuid::Uuid;
@@ -268,6 +816,7 @@ async fn execute_go(code: &str, timeout: u64) -> Result<(String, String, i32), S
     
     // Run go code directly
     let child = Command::new("go")
+        .envs(env)
         .args(&["run", &source_file])
         .stdout(Stdio::piped())
         .stderr(Stdio::piped())
@@ -302,7 +851,7 @@ async fn execute_go(code: &str, timeout: u64) -> Result<(String, String, i32), S
     }
 }
 
-async fn execute_cpp(code: &str, timeout: u64) -> Result<(String, String, i32), String> {
+async fn execute_cpp(code: &str, timeout: u64, env: &HashMap<String, String>) -> Result<(String, String, i32), String> {
     use std::fs;
     use std::process::{Command, Stdio};
     use uuid::Uuid;
@@ -317,6 +866,7 @@ async fn execute_cpp(code: &str, timeout: u64) -> Result<(String, String, i32),
     
     // Compile with g++
     let compile = Command::new("g++")
+        .envs(env)
         .args(&[&source_file, "-o", &binary_file, "-std=c++17"])
         .stdout(Stdio::piped())
         .stderr(Stdio::piped())
@@ -338,6 +888,7 @@ async fn execute_cpp(code: &str, timeout: u64) -> Result<(String, String, i32),
     
     // Execute
     let child = Command::new(&binary_file)
+        .envs(env)
         .stdout(Stdio::piped())
         .stderr(Stdio::piped())
         .spawn();
@@ -371,7 +922,7 @@ async fn execute_cpp(code: &str, timeout: u64) -> Result<(String, String, i32),
     }
 }
 
-async fn execute_java(code: &str, timeout: u64) -> Result<(String, String, i32), String> {
+async fn execute_java(code: &str, timeout: u64, env: &HashMap<String, String>) -> Result<(String, String, i32), String> {
     use std::fs;
     use std::process::{Command, Stdio};
     use uuid::Uuid;
@@ -387,6 +938,7 @@ async fn execute_java(code: &str, timeout: u64) -> Result<(String, String, i32),
     
     // Compile
     let compile = Command::new("javac")
+        .envs(env)
         .arg(&source_file)
         .current_dir(&temp_dir)
         .stdout(Stdio::piped())
@@ -409,6 +961,7 @@ async fn execute_java(code: &str, timeout: u64) -> Result<(String, String, i32),
     
     // Execute
     let child = Command::new("java")
+        .envs(env)
         .arg(&class_name)
         .current_dir(&temp_dir)
         .stdout(Stdio::piped())
@@ -444,7 +997,7 @@ async fn execute_java(code: &str, timeout: u64) -> Result<(String, String, i32),
     }
 }
 
-async fn execute_c(code: &str, timeout: u64) -> Result<(String, String, i32), String> {
+async fn execute_c(code: &str, timeout: u64, env: &HashMap<String, String>) -> Result<(String, String, i32), String> {
     use std::fs;
     use std::process::{Command, Stdio};
     use uuid::Uuid;
@@ -459,6 +1012,7 @@ async fn execute_c(code: &str, timeout: u64) -> Result<(String, String, i32), St
     
     // Compile with gcc
     let compile = Command::new("gcc")
+        .envs(env)
         .args(&[&source_file, "-o", &binary_file])
         .stdout(Stdio::piped())
         .stderr(Stdio::piped())
@@ -480,6 +1034,7 @@ async fn execute_c(code: &str, timeout: u64) -> Result<(String, String, i32), St
     
     // Execute
     let child = Command::new(&binary_file)
+        .envs(env)
         .stdout(Stdio::piped())
         .stderr(Stdio::piped())
         .spawn();
@@ -528,7 +1083,7 @@ fn extract_java_class_name(code: &str) -> Option<String> {
     None
 }
 
-async fn execute_zig(code: &str, timeout: u64) -> Result<(String, String, i32), String> {
+async fn execute_zig(code: &str, timeout: u64, env: &HashMap<String, String>) -> Result<(String, String, i32), String> {
     use std::fs;
     use std::process::{Command, Stdio};
     use uuid::Uuid;
@@ -547,6 +1102,7 @@ async fn execute_zig(code: &str, timeout: u64) -> Result<(String, String, i32),
     
     // Compile Zig code
     let compile_output = Command::new("zig")
+        .envs(env)
         .args(&["build-exe", "main.zig"])
         .current_dir(&temp_dir)
         .stdout(Stdio::null())  // Ignore compilation stdout
@@ -570,6 +1126,7 @@ async fn execute_zig(code: &str, timeout: u64) -> Result<(String, String, i32),
     // Execute the compiled binary (only capture execution output, not compilation)
     let exe_path = format!("{}/main", temp_dir);
     let child = match Command::new(&exe_path)
+        .envs(env)
         .current_dir(&temp_dir)
         .stdout(Stdio::piped())
         .stderr(Stdio::piped())
@@ -603,7 +1160,7 @@ async fn execute_zig(code: &str, timeout: u64) -> Result<(String, String, i32),
     }
 }
 
-async fn execute_elixir(code: &str, timeout: u64) -> Result<(String, String, i32), String> {
+async fn execute_elixir(code: &str, timeout: u64, env: &HashMap<String, String>) -> Result<(String, String, i32), String> {
     use std::fs;
     use std::process::{Command, Stdio};
     use uuid::Uuid;
@@ -622,6 +1179,7 @@ async fn execute_elixir(code: &str, timeout: u64) -> Result<(String, String, i32
     
     // Execute Elixir script
     let child = match Command::new("elixir")
+        .envs(env)
         .arg("main.exs")
         .current_dir(&temp_dir)
         .stdout(Stdio::piped())
@@ -656,7 +1214,7 @@ async fn execute_elixir(code: &str, timeout: u64) -> Result<(String, String, i32
     }
 }
 
-async fn execute_vlang(code: &str, timeout: u64) -> Result<(String, String, i32), String> {
+async fn execute_vlang(code: &str, timeout: u64, env: &HashMap<String, String>) -> Result<(String, String, i32), String> {
     use std::fs;
     use std::process::{Command, Stdio};
     use uuid::Uuid;
@@ -675,6 +1233,7 @@ async fn execute_vlang(code: &str, timeout: u64) -> Result<(String, String, i32)
     
     // Execute V code directly (V can run scripts without explicit compilation step)
     let child = match Command::new("v")
+        .envs(env)
         .args(&["run", "main.v"])
         .current_dir(&temp_dir)
         .stdout(Stdio::piped())
@@ -737,6 +1296,10 @@ async fn main() -> std::io::Result<()> {
             .route("/", web::get().to(root))
             .route("/health", web::get().to(health))
             .route("/execute", web::post().to(execute_code))
+            .route("/execute/stream", web::post().to(execute_stream))
+            .route("/cancel", web::post().to(cancel_run))
+            .route("/install", web::post().to(install_dependencies))
+            .route("/install/purge", web::post().to(purge_installs))
     })
     .bind(&bind_address)?
     .run()